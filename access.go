@@ -0,0 +1,133 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// AccessList restricts the client IPs that can connect to a listener. Each
+// entry is an IP address or a CIDR range. A client that matches Deny is
+// refused. Otherwise, if Allow is not empty, the client must match it.
+type AccessList struct {
+	Allow []string
+	Deny  []string
+}
+
+// accessControl is the parsed form of an AccessList, which can be replaced
+// while the server is running. A nil *accessControl allows every client.
+type accessControl struct {
+	mu    sync.RWMutex
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func newAccessControl(list AccessList) (*accessControl, error) {
+	ac := &accessControl{}
+	if err := ac.Update(list); err != nil {
+		return nil, err
+	}
+	return ac, nil
+}
+
+// Update replaces the rules with |list|. If the list is invalid, the rules are
+// left unchanged.
+func (ac *accessControl) Update(list AccessList) error {
+	allow, err := parseNets(list.Allow)
+	if err != nil {
+		return fmt.Errorf("Allow: %v", err)
+	}
+	deny, err := parseNets(list.Deny)
+	if err != nil {
+		return fmt.Errorf("Deny: %v", err)
+	}
+
+	ac.mu.Lock()
+	ac.allow, ac.deny = allow, deny
+	ac.mu.Unlock()
+	return nil
+}
+
+// Allowed reports whether a client at |addr| can connect.
+func (ac *accessControl) Allowed(addr net.Addr) bool {
+	if ac == nil {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	ac.mu.RLock()
+	defer ac.mu.RUnlock()
+	if containsIP(ac.deny, ip) {
+		return false
+	}
+	return len(ac.allow) == 0 || containsIP(ac.allow, ip)
+}
+
+func parseNets(entries []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadAccessLists re-reads the config file at |path| on each reload
+// signal, and applies its access lists to the running listeners.
+func reloadAccessLists(path string, smtpAccess, pop3Access *accessControl, log *zap.Logger) {
+	for range CreateReloadSignal() {
+		config, err := loadConfig(path)
+		if err != nil {
+			log.Error("failed to reload access lists", zap.Error(err))
+			continue
+		}
+		if err := smtpAccess.Update(config.SMTPAccess); err != nil {
+			log.Error("failed to reload SMTPAccess", zap.Error(err))
+		}
+		if err := pop3Access.Update(config.POP3Access); err != nil {
+			log.Error("failed to reload POP3Access", zap.Error(err))
+		}
+		log.Info("reloaded access lists")
+	}
+}
@@ -0,0 +1,64 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAccessControl(t *testing.T) {
+	ac, err := newAccessControl(AccessList{
+		Allow: []string{"192.0.2.0/24", "2001:db8::/32", "198.51.100.7"},
+		Deny:  []string{"192.0.2.66"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.66", false},
+		{"198.51.100.7", true},
+		{"198.51.100.8", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+		{"::ffff:192.0.2.1", true},
+	}
+	for _, c := range cases {
+		addr := &net.TCPAddr{IP: net.ParseIP(c.ip), Port: 25}
+		if want, got := c.allowed, ac.Allowed(addr); want != got {
+			t.Errorf("%s: want allowed %v, got %v", c.ip, want, got)
+		}
+	}
+
+	// An invalid update keeps the old rules.
+	if err := ac.Update(AccessList{Deny: []string{"not-an-ip"}}); err == nil {
+		t.Errorf("Want error for invalid entry")
+	}
+	if ac.Allowed(&net.TCPAddr{IP: net.ParseIP("192.0.2.66")}) {
+		t.Errorf("Want old rules after a failed update")
+	}
+
+	if err := ac.Update(AccessList{Deny: []string{"192.0.2.0/25"}}); err != nil {
+		t.Fatal(err)
+	}
+	if ac.Allowed(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}) {
+		t.Errorf("Want denied after update")
+	}
+	if !ac.Allowed(&net.TCPAddr{IP: net.ParseIP("203.0.113.1")}) {
+		t.Errorf("Want allowed with an empty Allow list")
+	}
+
+	var nilAC *accessControl
+	if !nilAC.Allowed(&net.TCPAddr{IP: net.ParseIP("203.0.113.1")}) {
+		t.Errorf("Want a nil accessControl to allow everything")
+	}
+}
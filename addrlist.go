@@ -0,0 +1,108 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// addressFiles holds the address lists loaded from files, keyed by path, so
+// that each file is only re-read when it changes.
+var addressFiles = &addressFileCache{files: make(map[string]*addressFile)}
+
+type addressFileCache struct {
+	mu    sync.Mutex
+	files map[string]*addressFile
+}
+
+// Match reports whether |address| matches a pattern in the file at |path|.
+func (c *addressFileCache) Match(path, address string, log *zap.Logger) (bool, error) {
+	c.mu.Lock()
+	f, ok := c.files[path]
+	if !ok {
+		f = &addressFile{path: path}
+		c.files[path] = f
+	}
+	c.mu.Unlock()
+	return f.Match(address, log)
+}
+
+// addressFile is a file of address patterns, one per line. Blank lines and
+// lines starting with # are ignored. Patterns use path.Match syntax, so
+// "*@example.com" matches a whole domain. The file is re-read when its
+// modification time changes.
+type addressFile struct {
+	path string
+
+	mu       sync.Mutex
+	loaded   bool
+	modTime  time.Time
+	patterns []string
+}
+
+// Match reports whether |address| matches a pattern in the file. If the file
+// cannot be re-read, the last version that loaded is used, and an error is
+// only returned if it has never loaded.
+func (f *addressFile) Match(address string, log *zap.Logger) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.reloadLocked(); err != nil {
+		if !f.loaded {
+			return false, err
+		}
+		log.Error("failed to reload address file", zap.String("path", f.path), zap.Error(err))
+	}
+
+	for _, pattern := range f.patterns {
+		if ok, _ := path.Match(pattern, address); ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *addressFile) reloadLocked() error {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	if f.loaded && fi.ModTime().Equal(f.modTime) {
+		return nil
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	f.patterns = patterns
+	f.modTime = fi.ModTime()
+	f.loaded = true
+	return nil
+}
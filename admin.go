@@ -0,0 +1,80 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"crypto/subtle"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// runAdminServer serves the health state, metrics, live sessions, and sender
+// reputation over HTTP on Config.AdminAddress, and imports messages into
+// maildrops that are stored locally.
+func runAdminServer(config Config, wd *watchdog, events *mailboxEvents, reputation *reputationDB, log *zap.Logger) <-chan ServerControlMessage {
+	controlChan := make(chan ServerControlMessage)
+	log = log.With(zap.String("server", "admin"))
+
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", wd)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/sessions", sessions)
+	if config.Mode != ModeFrontend {
+		mux.Handle("/import", &importHandler{config: config, events: events, log: log})
+	}
+	if config.AdminProfiling {
+		registerProfiling(mux)
+		log.Warn("profiling is enabled")
+	}
+	if reputation != nil {
+		mux.Handle("/reputation", &reputationHandler{db: reputation, token: config.AdminToken})
+	}
+
+	go func() {
+		log.Info("starting server", zap.String("address", config.AdminAddress))
+		err := http.ListenAndServe(config.AdminAddress, mux)
+		log.Error("serve", zap.Error(err))
+		controlChan <- ServerControlFatalError
+	}()
+
+	return controlChan
+}
+
+// adminAuthorized reports whether |req| carries the AdminToken |token| in an
+// "Authorization: Bearer" header. Without a token, no request is authorized.
+func adminAuthorized(token string, req *http.Request) bool {
+	auth := req.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) == 1
+}
+
+// Sampling rates for the block and mutex profiles, when profiling is
+// enabled. They are low enough to leave on under load.
+const (
+	profileBlockRate     = 10000 // Nanoseconds blocked per sample.
+	profileMutexFraction = 100
+)
+
+// registerProfiling serves the runtime profiles on |mux|, for use with
+// `go tool pprof http://localhost:9080/debug/pprof/profile`.
+func registerProfiling(mux *http.ServeMux) {
+	runtime.SetBlockProfileRate(profileBlockRate)
+	runtime.SetMutexProfileFraction(profileMutexFraction)
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
@@ -0,0 +1,83 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"net/mail"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/maildrop"
+	rfc5322 "src.bluestatic.org/mailpopbox/message"
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+const (
+	archiveInbound  = "inbound"
+	archiveOutbound = "outbound"
+)
+
+// archiveMessage journals a copy of |en| according to the Archive config of
+// |s|. The |direction| is archiveInbound or archiveOutbound. The copy has the
+// headers added by filters, and an X-Mailpopbox-Annotation header for each
+// of the envelope's annotations.
+func (server *smtpServer) archiveMessage(s *Server, en smtp.Envelope, direction string) {
+	a := s.Archive
+	if a == nil || (direction == archiveInbound && !a.Inbound) || (direction == archiveOutbound && !a.Outbound) {
+		return
+	}
+	log := server.log.With(zap.String("id", en.ID), zap.String("direction", direction))
+
+	var rcptTo []string
+	for _, rcpt := range en.RcptTo {
+		rcptTo = append(rcptTo, "<"+rcpt.Address+">")
+	}
+	header, body := rfc5322.Parse(en.Data)
+	for i := len(en.Headers) - 1; i >= 0; i-- {
+		header.Prepend(en.Headers[i].Name, en.Headers[i].Value)
+	}
+	for i := len(en.Annotations) - 1; i >= 0; i-- {
+		header.Prepend("X-Mailpopbox-Annotation", en.Annotations[i].Name+"="+en.Annotations[i].Value)
+	}
+	header.Prepend("X-Envelope-To", strings.Join(rcptTo, ", "))
+	header.Prepend("X-Envelope-From", "<"+en.MailFrom.Address+">")
+	en.Data = rfc5322.Join(header, body)
+	en.Headers = nil
+
+	if a.Folder != "" {
+		md, err := maildrop.New(s.MaildropPath).CreateFolder(a.Folder)
+		if err == nil {
+			err = md.Deliver(en)
+		}
+		if err != nil {
+			log.Error("failed to archive message", zap.String("folder", a.Folder), zap.Error(err))
+		} else {
+			server.events.publish(mailboxEvent{Kind: mailboxDelivered, Path: md.Path(), ID: en.ID})
+		}
+	}
+
+	if a.Address != "" && server.mta != nil {
+		now := time.Now()
+		journal := smtp.Envelope{
+			MailFrom: mail.Address{Address: MailboxAccount + s.Domain},
+			RcptTo:   []mail.Address{{Address: a.Address}},
+			Data:     en.Data,
+			ID:       smtp.GenerateEnvelopeId("j", now),
+			Received: now,
+		}
+		log.Info("relaying archive copy", zap.String("journal", journal.ID))
+		server.mta.QueueMessage(journal, nil, nil)
+	}
+}
+
+// isArchiveAddress reports whether |addr| is the Archive address of |s|. A
+// copy delivered to it is not archived again.
+func isArchiveAddress(s *Server, addr mail.Address) bool {
+	return s.Archive != nil && strings.EqualFold(s.Archive.Address, addr.Address)
+}
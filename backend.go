@@ -0,0 +1,110 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"net"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/backend"
+	"src.bluestatic.org/mailpopbox/maildrop"
+)
+
+// runBackendServer runs the delivery and storage service for remote
+// frontends. It does not open any SMTP or POP3 listeners.
+func runBackendServer(config Config, log *zap.Logger) <-chan ServerControlMessage {
+	controlChan := make(chan ServerControlMessage)
+	log = log.With(zap.String("server", "backend"))
+
+	listings := maildrop.NewListCache()
+	events := startMailboxEvents(listings)
+
+	ss := &smtpServer{
+		config:      config,
+		events:      events,
+		controlChan: controlChan,
+		log:         log,
+	}
+
+	po := &pop3Server{
+		config:      config,
+		listings:    listings,
+		events:      events,
+		controlChan: controlChan,
+		log:         log,
+	}
+
+	go func() {
+		if err := ss.setupDelivery(); err != nil {
+			log.Error("failed to set up delivery", zap.Error(err))
+			controlChan <- ServerControlFatalError
+			return
+		}
+
+		if c := config.Reputation; c != nil {
+			var err error
+			if ss.reputation, err = openReputation(*c, log); err != nil {
+				log.Error("failed to open sender reputation", zap.Error(err))
+				controlChan <- ServerControlFatalError
+				return
+			}
+			go ss.reputation.saveEvery(reputationSaveInterval)
+		}
+
+		if err := ss.loadGeoIP(); err != nil {
+			log.Error("failed to open GeoIP databases", zap.Error(err))
+			controlChan <- ServerControlFatalError
+			return
+		}
+
+		if err := po.createMaildrops(); err != nil {
+			controlChan <- ServerControlFatalError
+			return
+		}
+		if ss.spool != nil {
+			ss.spool.start()
+		}
+
+		tlsConfig, err := config.GetBackendTLSConfig()
+		if err != nil {
+			log.Error("failed to configure TLS", zap.Error(err))
+			controlChan <- ServerControlFatalError
+			return
+		}
+
+		log.Info("starting server", zap.String("address", config.BackendAddress))
+		l, err := net.Listen("tcp", config.BackendAddress)
+		if err != nil {
+			log.Error("listen", zap.Error(err))
+			controlChan <- ServerControlFatalError
+			return
+		}
+
+		server, err := backend.NewServer(ss, po, tlsConfig, log)
+		if err != nil {
+			log.Error("failed to start backend", zap.Error(err))
+			l.Close()
+			controlChan <- ServerControlFatalError
+			return
+		}
+		if err := server.Serve(l); err != nil {
+			log.Error("serve", zap.Error(err))
+		}
+		controlChan <- ServerControlFatalError
+	}()
+
+	return controlChan
+}
+
+func dialBackend(config Config, log *zap.Logger) (*backend.Client, error) {
+	tlsConfig, err := config.GetBackendTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	return backend.Dial(config.BackendAddress, tlsConfig, log.With(zap.String("server", "backend")))
+}
@@ -0,0 +1,329 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package backend
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	"src.bluestatic.org/mailpopbox/pop3"
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+// callTimeout bounds each unary call to the backend.
+const callTimeout = time.Minute
+
+// Client is a frontend's connection to the backend.
+type Client struct {
+	conn *grpc.ClientConn
+	log  *zap.Logger
+}
+
+// Dial connects to the backend at addr. If tlsConfig is nil, the connection
+// is not encrypted.
+func Dial(addr string, tlsConfig *tls.Config, log *zap.Logger) (*Client, error) {
+	opts := []grpc.DialOption{
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(jsonCodec{}.Name())),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, log: log}, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) call(method string, req, resp interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	err := c.conn.Invoke(ctx, methodName(method), req, resp)
+	if err != nil {
+		c.log.Error("backend call failed", zap.String("method", method), zap.Error(err))
+	}
+	return err
+}
+
+// SMTPServer returns an smtp.Server that handles verification, delivery,
+// relaying, and password authentication on the backend. The server name, TLS
+// configuration, and the optional smtp.Server interfaces that local
+// implements, like message size limits and client certificate and token
+// authentication, are provided by local, since those belong to the listener.
+func (c *Client) SMTPServer(local smtp.Server) smtp.Server {
+	s := &remoteSMTPServer{local: local, c: c}
+	// The token mechanisms are only advertised if local can check tokens.
+	if tokenAuth, ok := local.(smtp.TokenAuthenticator); ok {
+		return &remoteTokenSMTPServer{s, tokenAuth}
+	}
+	return s
+}
+
+// PostOffice returns a pop3.PostOffice whose mailboxes are stored on the
+// backend. The server name is provided by local.
+func (c *Client) PostOffice(local pop3.PostOffice) pop3.PostOffice {
+	return &remotePostOffice{local: local, c: c}
+}
+
+var replyUnavailable = smtp.ReplyLine{Code: 451, Message: "local error in processing"}
+
+type remoteSMTPServer struct {
+	local smtp.Server
+	c     *Client
+}
+
+func (s *remoteSMTPServer) Name() string {
+	return s.local.Name()
+}
+
+func (s *remoteSMTPServer) TLSConfig() *tls.Config {
+	return s.local.TLSConfig()
+}
+
+func (s *remoteSMTPServer) VerifyAddress(addr mail.Address) smtp.ReplyLine {
+	var resp replyResponse
+	if err := s.c.call("VerifyAddress", &verifyRequest{addr}, &resp); err != nil || resp.Reply == nil {
+		return replyUnavailable
+	}
+	return *resp.Reply
+}
+
+func (s *remoteSMTPServer) Authenticate(authz, authc, passwd string) bool {
+	var resp authResponse
+	if err := s.c.call("Authenticate", &authRequest{authz, authc, passwd}, &resp); err != nil {
+		return false
+	}
+	return resp.OK
+}
+
+func (s *remoteSMTPServer) DeliverMessage(en smtp.Envelope) *smtp.ReplyLine {
+	var resp replyResponse
+	if err := s.c.call("DeliverMessage", &deliverRequest{en}, &resp); err != nil {
+		return &replyUnavailable
+	}
+	return resp.Reply
+}
+
+func (s *remoteSMTPServer) RelayMessage(en smtp.Envelope, authc string) {
+	s.c.call("RelayMessage", &relayRequest{en, authc}, &empty{})
+}
+
+// IsTrustedRelay answers from the local server, since the trusted relays
+// connect to the frontend.
+func (s *remoteSMTPServer) IsTrustedRelay(addr net.Addr) bool {
+	if checker, ok := s.local.(smtp.TrustedRelayChecker); ok {
+		return checker.IsTrustedRelay(addr)
+	}
+	return false
+}
+
+// InvalidRecipient reports to the local server, since it tracks the clients
+// of the frontend.
+func (s *remoteSMTPServer) InvalidRecipient(addr net.Addr, rcpt mail.Address) bool {
+	if reporter, ok := s.local.(smtp.InvalidRecipientReporter); ok {
+		return reporter.InvalidRecipient(addr, rcpt)
+	}
+	return false
+}
+
+// CertificateAuthenticate answers from the local server, since the client
+// certificates are presented to the frontend.
+func (s *remoteSMTPServer) CertificateAuthenticate(state tls.ConnectionState) string {
+	if certAuth, ok := s.local.(smtp.CertificateAuthenticator); ok {
+		return certAuth.CertificateAuthenticate(state)
+	}
+	return ""
+}
+
+func (s *remoteSMTPServer) MaxMessageSize(rcpt mail.Address) int64 {
+	if limiter, ok := s.local.(smtp.MessageSizeLimiter); ok {
+		return limiter.MaxMessageSize(rcpt)
+	}
+	return 0
+}
+
+func (s *remoteSMTPServer) MaxInboundMessageSize() int64 {
+	if limiter, ok := s.local.(smtp.InboundSizeLimiter); ok {
+		return limiter.MaxInboundMessageSize()
+	}
+	return 0
+}
+
+func (s *remoteSMTPServer) Mailbox(rcpt mail.Address) string {
+	if resolver, ok := s.local.(smtp.MailboxResolver); ok {
+		return resolver.Mailbox(rcpt)
+	}
+	return strings.ToLower(smtp.DomainForAddress(rcpt))
+}
+
+// remoteTokenSMTPServer is a remoteSMTPServer whose local server accepts
+// bearer tokens.
+type remoteTokenSMTPServer struct {
+	*remoteSMTPServer
+	smtp.TokenAuthenticator
+}
+
+type remotePostOffice struct {
+	local pop3.PostOffice
+	c     *Client
+}
+
+func (po *remotePostOffice) Name() string {
+	return po.local.Name()
+}
+
+func (po *remotePostOffice) OpenMailbox(user, pass string) (pop3.Mailbox, error) {
+	var resp openResponse
+	if err := po.c.call("OpenMailbox", &openRequest{user, pass}, &resp); err != nil {
+		if s, ok := status.FromError(err); ok {
+			return nil, errors.New(s.Message())
+		}
+		return nil, err
+	}
+
+	mb := &remoteMailbox{
+		c:        po.c,
+		session:  resp.Session,
+		messages: make([]remoteMessage, len(resp.Messages)),
+	}
+	for i, info := range resp.Messages {
+		mb.messages[i].messageInfo = info
+	}
+	return mb, nil
+}
+
+// remoteMailbox tracks deletions locally and applies them on the backend
+// only when the mailbox is closed, matching the POP3 UPDATE state.
+type remoteMailbox struct {
+	c        *Client
+	session  string
+	messages []remoteMessage
+}
+
+type remoteMessage struct {
+	messageInfo
+	deleted bool
+}
+
+func (m *remoteMessage) UniqueID() string {
+	return m.messageInfo.UniqueID
+}
+
+func (m *remoteMessage) ID() int {
+	return m.messageInfo.ID
+}
+
+func (m *remoteMessage) Size() int {
+	return m.messageInfo.Size
+}
+
+func (m *remoteMessage) Deleted() bool {
+	return m.deleted
+}
+
+func (m *remoteMessage) Delivered() time.Time {
+	return m.messageInfo.Delivered
+}
+
+func (mb *remoteMailbox) ListMessages() ([]pop3.Message, error) {
+	msgs := make([]pop3.Message, len(mb.messages))
+	for i := range mb.messages {
+		msgs[i] = &mb.messages[i]
+	}
+	return msgs, nil
+}
+
+func (mb *remoteMailbox) GetMessage(id int) pop3.Message {
+	for i := range mb.messages {
+		if mb.messages[i].ID() == id {
+			return &mb.messages[i]
+		}
+	}
+	return nil
+}
+
+func (mb *remoteMailbox) Retrieve(msg pop3.Message) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := mb.c.conn.NewStream(ctx, &serviceDesc.Streams[0], methodName("Retrieve"))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := stream.SendMsg(&retrieveRequest{mb.session, msg.ID()}); err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		cancel()
+		return nil, err
+	}
+	return &streamReader{stream: stream, cancel: cancel}, nil
+}
+
+func (mb *remoteMailbox) Delete(msg pop3.Message) error {
+	msg.(*remoteMessage).deleted = true
+	return nil
+}
+
+func (mb *remoteMailbox) Close() error {
+	req := &closeRequest{Session: mb.session}
+	for _, msg := range mb.messages {
+		if msg.deleted {
+			req.Deleted = append(req.Deleted, msg.ID())
+		}
+	}
+	return mb.c.call("CloseMailbox", req, &empty{})
+}
+
+func (mb *remoteMailbox) Reset() {
+	for i := range mb.messages {
+		mb.messages[i].deleted = false
+	}
+}
+
+// streamReader adapts a Retrieve stream of chunks to an io.Reader.
+type streamReader struct {
+	stream grpc.ClientStream
+	cancel context.CancelFunc
+	buf    []byte
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		var c chunk
+		if err := r.stream.RecvMsg(&c); err != nil {
+			return 0, err
+		}
+		r.buf = c.Data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *streamReader) Close() error {
+	r.cancel()
+	return nil
+}
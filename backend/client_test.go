@@ -0,0 +1,356 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package backend
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/pop3"
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+type testSMTPServer struct {
+	smtp.EmptyServerCallbacks
+	delivered []smtp.Envelope
+	relayed   chan smtp.Envelope
+}
+
+func (s *testSMTPServer) Name() string {
+	return "local"
+}
+
+func (s *testSMTPServer) VerifyAddress(addr mail.Address) smtp.ReplyLine {
+	if smtp.DomainForAddress(addr) != "example.com" {
+		return smtp.ReplyBadMailbox
+	}
+	return smtp.ReplyOK
+}
+
+func (s *testSMTPServer) Authenticate(authz, authc, passwd string) bool {
+	return authc == "mailbox@example.com" && passwd == "secret"
+}
+
+func (s *testSMTPServer) DeliverMessage(en smtp.Envelope) *smtp.ReplyLine {
+	s.delivered = append(s.delivered, en)
+	return nil
+}
+
+func (s *testSMTPServer) RelayMessage(en smtp.Envelope, authc string) {
+	s.relayed <- en
+}
+
+type testPostOffice struct {
+	mb *testMailbox
+}
+
+func (po *testPostOffice) Name() string {
+	return "local"
+}
+
+func (po *testPostOffice) OpenMailbox(user, pass string) (pop3.Mailbox, error) {
+	if user != "mailbox@example.com" || pass != "secret" {
+		return nil, errors.New("permission denied")
+	}
+	return po.mb, nil
+}
+
+type testMessage struct {
+	id        int
+	body      string
+	deleted   bool
+	delivered time.Time
+}
+
+func (m *testMessage) UniqueID() string     { return m.body[:3] }
+func (m *testMessage) ID() int              { return m.id }
+func (m *testMessage) Size() int            { return len(m.body) }
+func (m *testMessage) Deleted() bool        { return m.deleted }
+func (m *testMessage) Delivered() time.Time { return m.delivered }
+
+type testMailbox struct {
+	msgs   []*testMessage
+	closed bool
+}
+
+func (mb *testMailbox) ListMessages() ([]pop3.Message, error) {
+	msgs := make([]pop3.Message, len(mb.msgs))
+	for i, msg := range mb.msgs {
+		msgs[i] = msg
+	}
+	return msgs, nil
+}
+
+func (mb *testMailbox) GetMessage(id int) pop3.Message {
+	if id < 1 || id > len(mb.msgs) {
+		return nil
+	}
+	return mb.msgs[id-1]
+}
+
+func (mb *testMailbox) Retrieve(msg pop3.Message) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewBufferString(msg.(*testMessage).body)), nil
+}
+
+func (mb *testMailbox) Delete(msg pop3.Message) error {
+	msg.(*testMessage).deleted = true
+	return nil
+}
+
+func (mb *testMailbox) Close() error {
+	mb.closed = true
+	return nil
+}
+
+func (mb *testMailbox) Reset() {
+	for _, msg := range mb.msgs {
+		msg.deleted = false
+	}
+}
+
+func runBackend(t *testing.T, s smtp.Server, po pop3.PostOffice) *Client {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverTLS, clientTLS := testTLSConfigs(t)
+	server, err := NewServer(s, po, serverTLS, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+
+	c, err := Dial(l.Addr().String(), clientTLS, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+type localServer struct {
+	smtp.EmptyServerCallbacks
+}
+
+func (localServer) Name() string {
+	return "frontend"
+}
+
+func (localServer) TLSConfig() *tls.Config {
+	return &tls.Config{ServerName: "frontend"}
+}
+
+func TestRemoteSMTPServer(t *testing.T) {
+	backend := &testSMTPServer{relayed: make(chan smtp.Envelope, 1)}
+	c := runBackend(t, backend, &testPostOffice{})
+	s := c.SMTPServer(&localServer{})
+
+	if want, got := "frontend", s.Name(); want != got {
+		t.Errorf("Want Name %q, got %q", want, got)
+	}
+	if want, got := "frontend", s.TLSConfig().ServerName; want != got {
+		t.Errorf("Want TLSConfig from local server %q, got %q", want, got)
+	}
+
+	if want, got := smtp.ReplyOK, s.VerifyAddress(mail.Address{Address: "a@example.com"}); want != got {
+		t.Errorf("Want VerifyAddress %v, got %v", want, got)
+	}
+	if want, got := smtp.ReplyBadMailbox, s.VerifyAddress(mail.Address{Address: "a@other.net"}); want != got {
+		t.Errorf("Want VerifyAddress %v, got %v", want, got)
+	}
+
+	if !s.Authenticate("", "mailbox@example.com", "secret") {
+		t.Errorf("Expected authentication to succeed")
+	}
+	if s.Authenticate("", "mailbox@example.com", "wrong") {
+		t.Errorf("Expected authentication to fail")
+	}
+
+	en := smtp.Envelope{
+		RemoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2525},
+		MailFrom:   mail.Address{Address: "sender@other.net"},
+		RcptTo:     []mail.Address{{Address: "a@example.com"}},
+		Data:       []byte("Subject: test\r\n\r\nHello\r\n"),
+		ID:         "m.1",
+	}
+	if reply := s.DeliverMessage(en); reply != nil {
+		t.Errorf("Unexpected delivery reply %v", reply)
+	}
+	if want, got := 1, len(backend.delivered); want != got {
+		t.Fatalf("Want %d delivered message, got %d", want, got)
+	}
+	delivered := backend.delivered[0]
+	if !bytes.Equal(en.Data, delivered.Data) {
+		t.Errorf("Delivered data does not match, got %q", delivered.Data)
+	}
+	if want, got := en.RemoteAddr.String(), delivered.RemoteAddr.String(); want != got {
+		t.Errorf("Want RemoteAddr %q, got %q", want, got)
+	}
+
+	s.RelayMessage(en, "mailbox@example.com")
+	if want, got := en.ID, (<-backend.relayed).ID; want != got {
+		t.Errorf("Want relayed ID %q, got %q", want, got)
+	}
+}
+
+// extendedServer implements the optional smtp.Server interfaces that the
+// frontend answers itself.
+type extendedServer struct {
+	localServer
+}
+
+func (extendedServer) CertificateAuthenticate(state tls.ConnectionState) string {
+	return "mailbox@example.com"
+}
+
+func (extendedServer) MaxMessageSize(rcpt mail.Address) int64 {
+	return 1000
+}
+
+func (extendedServer) MaxInboundMessageSize() int64 {
+	return 2000
+}
+
+func (extendedServer) Mailbox(rcpt mail.Address) string {
+	return "/maildrops/shared"
+}
+
+func (extendedServer) AuthenticateToken(user, token string) bool {
+	return token == "good"
+}
+
+func TestRemoteSMTPServerLocalInterfaces(t *testing.T) {
+	c := runBackend(t, &testSMTPServer{}, &testPostOffice{})
+	rcpt := mail.Address{Address: "a@Example.com"}
+
+	s := c.SMTPServer(&extendedServer{})
+	if want, got := "mailbox@example.com", s.(smtp.CertificateAuthenticator).CertificateAuthenticate(tls.ConnectionState{}); want != got {
+		t.Errorf("Want CertificateAuthenticate %q, got %q", want, got)
+	}
+	if want, got := int64(1000), s.(smtp.MessageSizeLimiter).MaxMessageSize(rcpt); want != got {
+		t.Errorf("Want MaxMessageSize %d, got %d", want, got)
+	}
+	if want, got := int64(2000), s.(smtp.InboundSizeLimiter).MaxInboundMessageSize(); want != got {
+		t.Errorf("Want MaxInboundMessageSize %d, got %d", want, got)
+	}
+	if want, got := "/maildrops/shared", s.(smtp.MailboxResolver).Mailbox(rcpt); want != got {
+		t.Errorf("Want Mailbox %q, got %q", want, got)
+	}
+	tokenAuth, ok := s.(smtp.TokenAuthenticator)
+	if !ok {
+		t.Fatalf("Want a TokenAuthenticator")
+	}
+	if !tokenAuth.AuthenticateToken("mailbox@example.com", "good") || tokenAuth.AuthenticateToken("mailbox@example.com", "bad") {
+		t.Errorf("AuthenticateToken not answered by the local server")
+	}
+
+	// Without the interfaces, the answers are the same as if they were not
+	// implemented.
+	s = c.SMTPServer(&localServer{})
+	if want, got := "", s.(smtp.CertificateAuthenticator).CertificateAuthenticate(tls.ConnectionState{}); want != got {
+		t.Errorf("Want CertificateAuthenticate %q, got %q", want, got)
+	}
+	if want, got := int64(0), s.(smtp.MessageSizeLimiter).MaxMessageSize(rcpt); want != got {
+		t.Errorf("Want MaxMessageSize %d, got %d", want, got)
+	}
+	if want, got := int64(0), s.(smtp.InboundSizeLimiter).MaxInboundMessageSize(); want != got {
+		t.Errorf("Want MaxInboundMessageSize %d, got %d", want, got)
+	}
+	if want, got := "example.com", s.(smtp.MailboxResolver).Mailbox(rcpt); want != got {
+		t.Errorf("Want Mailbox %q, got %q", want, got)
+	}
+	if _, ok := s.(smtp.TokenAuthenticator); ok {
+		t.Errorf("Want no TokenAuthenticator")
+	}
+}
+
+func TestRemoteMailbox(t *testing.T) {
+	local := &testMailbox{
+		msgs: []*testMessage{
+			{id: 1, body: "one message", delivered: time.Date(2020, time.March, 5, 9, 8, 7, 0, time.UTC)},
+			{id: 2, body: "two message"},
+		},
+	}
+	c := runBackend(t, &testSMTPServer{}, &testPostOffice{mb: local})
+	po := c.PostOffice(&testPostOffice{})
+
+	if _, err := po.OpenMailbox("mailbox@example.com", "wrong"); err == nil {
+		t.Errorf("Expected error opening mailbox with wrong password")
+	}
+
+	mb, err := po.OpenMailbox("mailbox@example.com", "secret")
+	if err != nil {
+		t.Fatalf("Failed to open mailbox: %v", err)
+	}
+
+	msgs, err := mb.ListMessages()
+	if err != nil {
+		t.Fatalf("Failed to list messages: %v", err)
+	}
+	if want, got := 2, len(msgs); want != got {
+		t.Fatalf("Want %d messages, got %d", want, got)
+	}
+	if want, got := "two", msgs[1].UniqueID(); want != got {
+		t.Errorf("Want UniqueID %q, got %q", want, got)
+	}
+	if want, got := len("one message"), msgs[0].Size(); want != got {
+		t.Errorf("Want Size %d, got %d", want, got)
+	}
+	if want, got := local.msgs[0].delivered, msgs[0].(pop3.TimedMessage).Delivered(); !want.Equal(got) {
+		t.Errorf("Want Delivered %v, got %v", want, got)
+	}
+	if got := msgs[1].(pop3.TimedMessage).Delivered(); !got.IsZero() {
+		t.Errorf("Want no delivery time, got %v", got)
+	}
+
+	rc, err := mb.Retrieve(mb.GetMessage(2))
+	if err != nil {
+		t.Fatalf("Failed to retrieve message: %v", err)
+	}
+	body, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Errorf("Failed to read message: %v", err)
+	}
+	if want, got := "two message", string(body); want != got {
+		t.Errorf("Want body %q, got %q", want, got)
+	}
+
+	mb.Delete(msgs[0])
+	mb.Delete(msgs[1])
+	mb.Reset()
+	mb.Delete(msgs[1])
+
+	if local.msgs[1].deleted {
+		t.Errorf("Deletion should not be applied before Close")
+	}
+
+	if err := mb.Close(); err != nil {
+		t.Errorf("Failed to close mailbox: %v", err)
+	}
+
+	if !local.closed {
+		t.Errorf("Backend mailbox was not closed")
+	}
+	if local.msgs[0].deleted {
+		t.Errorf("Message 1 should not be deleted")
+	}
+	if !local.msgs[1].deleted {
+		t.Errorf("Message 2 should be deleted")
+	}
+}
@@ -0,0 +1,277 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package backend
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	"src.bluestatic.org/mailpopbox/pop3"
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+// sessionIdleTimeout is how long a mailbox opened by a frontend may go unused
+// before it is discarded without applying deletions, as if the POP3 client
+// had disconnected without issuing QUIT.
+const sessionIdleTimeout = time.Hour
+
+// Server exports a local smtp.Server and pop3.PostOffice to frontends.
+type Server struct {
+	smtp smtp.Server
+	po   pop3.PostOffice
+	log  *zap.Logger
+
+	grpc *grpc.Server
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+type session struct {
+	mb       pop3.Mailbox
+	lastUsed time.Time
+}
+
+// NewServer creates a backend that services frontend requests using the
+// provided local implementations. The backend trusts its callers to have
+// authenticated users, such as the sender of a relayed message, so tlsConfig
+// must require frontends to present a client certificate signed by its
+// ClientCAs.
+func NewServer(s smtp.Server, po pop3.PostOffice, tlsConfig *tls.Config, log *zap.Logger) (*Server, error) {
+	if tlsConfig == nil || tlsConfig.ClientCAs == nil || tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		return nil, errors.New("backend: frontends must be required to present a verified client certificate")
+	}
+	if len(tlsConfig.Certificates) == 0 && tlsConfig.GetCertificate == nil {
+		return nil, errors.New("backend: missing server certificate")
+	}
+
+	server := &Server{
+		smtp:     s,
+		po:       po,
+		log:      log,
+		sessions: make(map[string]*session),
+	}
+
+	server.grpc = grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)))
+	server.grpc.RegisterService(&serviceDesc, server)
+	return server, nil
+}
+
+// Serve accepts frontend connections on the listener until Stop is called.
+func (s *Server) Serve(l net.Listener) error {
+	return s.grpc.Serve(l)
+}
+
+func (s *Server) Stop() {
+	s.grpc.Stop()
+}
+
+type unaryMethod func(s *Server, ctx context.Context, req interface{}) (interface{}, error)
+
+func unary(name string, newReq func() interface{}, m unaryMethod) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := newReq()
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			s := srv.(*Server)
+			if interceptor == nil {
+				return m(s, ctx, req)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: methodName(name)}
+			return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return m(s, ctx, req)
+			})
+		},
+	}
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		unary("VerifyAddress", func() interface{} { return new(verifyRequest) }, (*Server).verifyAddress),
+		unary("Authenticate", func() interface{} { return new(authRequest) }, (*Server).authenticate),
+		unary("DeliverMessage", func() interface{} { return new(deliverRequest) }, (*Server).deliverMessage),
+		unary("RelayMessage", func() interface{} { return new(relayRequest) }, (*Server).relayMessage),
+		unary("OpenMailbox", func() interface{} { return new(openRequest) }, (*Server).openMailbox),
+		unary("CloseMailbox", func() interface{} { return new(closeRequest) }, (*Server).closeMailbox),
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Retrieve",
+			Handler:       retrieveHandler,
+			ServerStreams: true,
+		},
+	},
+}
+
+func (s *Server) verifyAddress(ctx context.Context, req interface{}) (interface{}, error) {
+	r := req.(*verifyRequest)
+	reply := s.smtp.VerifyAddress(r.Address)
+	return &replyResponse{Reply: &reply}, nil
+}
+
+func (s *Server) authenticate(ctx context.Context, req interface{}) (interface{}, error) {
+	r := req.(*authRequest)
+	return &authResponse{OK: s.smtp.Authenticate(r.Authz, r.Authc, r.Passwd)}, nil
+}
+
+func (s *Server) deliverMessage(ctx context.Context, req interface{}) (interface{}, error) {
+	r := req.(*deliverRequest)
+	return &replyResponse{Reply: s.smtp.DeliverMessage(r.Envelope)}, nil
+}
+
+func (s *Server) relayMessage(ctx context.Context, req interface{}) (interface{}, error) {
+	r := req.(*relayRequest)
+	s.smtp.RelayMessage(r.Envelope, r.Authc)
+	return &empty{}, nil
+}
+
+func (s *Server) openMailbox(ctx context.Context, req interface{}) (interface{}, error) {
+	r := req.(*openRequest)
+	mb, err := s.po.OpenMailbox(r.User, r.Pass)
+	if err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	msgs, err := mb.ListMessages()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	resp := &openResponse{
+		Session:  newSessionID(),
+		Messages: make([]messageInfo, 0, len(msgs)),
+	}
+	for _, msg := range msgs {
+		info := messageInfo{
+			ID:       msg.ID(),
+			UniqueID: msg.UniqueID(),
+			Size:     msg.Size(),
+		}
+		if tm, ok := msg.(pop3.TimedMessage); ok {
+			info.Delivered = tm.Delivered()
+		}
+		resp.Messages = append(resp.Messages, info)
+	}
+
+	now := time.Now()
+
+	s.mu.Lock()
+	for id, sess := range s.sessions {
+		if now.Sub(sess.lastUsed) > sessionIdleTimeout {
+			s.log.Warn("expiring idle mailbox session", zap.String("session", id))
+			delete(s.sessions, id)
+		}
+	}
+	s.sessions[resp.Session] = &session{mb: mb, lastUsed: now}
+	s.mu.Unlock()
+
+	return resp, nil
+}
+
+func (s *Server) closeMailbox(ctx context.Context, req interface{}) (interface{}, error) {
+	r := req.(*closeRequest)
+
+	s.mu.Lock()
+	sess, ok := s.sessions[r.Session]
+	delete(s.sessions, r.Session)
+	s.mu.Unlock()
+
+	if !ok {
+		return nil, status.Error(codes.NotFound, "no such session")
+	}
+
+	for _, id := range r.Deleted {
+		msg := sess.mb.GetMessage(id)
+		if msg == nil {
+			continue
+		}
+		if err := sess.mb.Delete(msg); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if err := sess.mb.Close(); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &empty{}, nil
+}
+
+func (s *Server) getSession(id string) *session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if ok {
+		sess.lastUsed = time.Now()
+	}
+	return sess
+}
+
+func retrieveHandler(srv interface{}, stream grpc.ServerStream) error {
+	s := srv.(*Server)
+
+	var req retrieveRequest
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+
+	sess := s.getSession(req.Session)
+	if sess == nil {
+		return status.Error(codes.NotFound, "no such session")
+	}
+
+	msg := sess.mb.GetMessage(req.ID)
+	if msg == nil {
+		return status.Error(codes.NotFound, "no such message")
+	}
+
+	rc, err := sess.mb.Retrieve(msg)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	defer rc.Close()
+
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := rc.Read(buf)
+		if n > 0 {
+			if err := stream.SendMsg(&chunk{Data: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+}
+
+func newSessionID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("backend: generate session ID: %v", err))
+	}
+	return fmt.Sprintf("%x", b)
+}
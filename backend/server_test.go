@@ -0,0 +1,121 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package backend
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/mail"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// newTestCert creates a certificate for |name|, signed by |parent| or else
+// self-signed.
+func newTestCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}
+}
+
+// testTLSConfigs returns the TLS configurations of a backend and a frontend
+// whose certificates are signed by the same CA.
+func testTLSConfigs(t *testing.T) (server, client *tls.Config) {
+	caCert, caTLS := newTestCert(t, "ca", nil, nil)
+	caKey := caTLS.PrivateKey.(*ecdsa.PrivateKey)
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+
+	_, serverCert := newTestCert(t, "localhost", caCert, caKey)
+	_, clientCert := newTestCert(t, "frontend", caCert, caKey)
+	server = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	client = &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      pool,
+		ServerName:   "localhost",
+	}
+	return server, client
+}
+
+func TestNewServerRequiresClientCerts(t *testing.T) {
+	serverTLS, _ := testTLSConfigs(t)
+	noClientAuth := serverTLS.Clone()
+	noClientAuth.ClientAuth = tls.VerifyClientCertIfGiven
+	noCAs := serverTLS.Clone()
+	noCAs.ClientCAs = nil
+	noCert := serverTLS.Clone()
+	noCert.Certificates = nil
+
+	for i, c := range []*tls.Config{nil, noClientAuth, noCAs, noCert} {
+		if _, err := NewServer(&testSMTPServer{}, &testPostOffice{}, c, zap.NewNop()); err == nil {
+			t.Errorf("%d: Want error for %+v", i, c)
+		}
+	}
+}
+
+func TestServerRejectsFrontendWithoutCert(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs(t)
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(&testSMTPServer{}, &testPostOffice{}, serverTLS, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+	defer server.Stop()
+
+	// A frontend that trusts the backend but has no client certificate.
+	clientTLS.Certificates = nil
+	c, err := Dial(l.Addr().String(), clientTLS, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var resp replyResponse
+	if err := c.call("VerifyAddress", &verifyRequest{mail.Address{Address: "a@example.com"}}, &resp); err == nil {
+		t.Errorf("Want call without a client certificate to fail")
+	}
+}
@@ -0,0 +1,109 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+// Package backend splits mailpopbox into stateless protocol frontends and a
+// delivery/storage backend. The backend exports a local smtp.Server and
+// pop3.PostOffice over gRPC, and the Client implements those same interfaces
+// by calling the backend.
+package backend
+
+import (
+	"encoding/json"
+	"net/mail"
+	"time"
+
+	"google.golang.org/grpc/encoding"
+
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+const serviceName = "mailpopbox.Backend"
+
+// chunkSize is the maximum amount of message data sent in a single Retrieve
+// stream message.
+const chunkSize = 32 * 1024
+
+// The service messages are plain Go structs, so rather than requiring protoc
+// to generate bindings, they are encoded as JSON.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+type empty struct{}
+
+type verifyRequest struct {
+	Address mail.Address
+}
+
+type replyResponse struct {
+	Reply *smtp.ReplyLine
+}
+
+type authRequest struct {
+	Authz, Authc, Passwd string
+}
+
+type authResponse struct {
+	OK bool
+}
+
+type deliverRequest struct {
+	Envelope smtp.Envelope
+}
+
+type relayRequest struct {
+	Envelope smtp.Envelope
+	Authc    string
+}
+
+type openRequest struct {
+	User, Pass string
+}
+
+type messageInfo struct {
+	ID       int
+	UniqueID string
+	Size     int
+	// Delivered is zero if the message does not know its delivery time.
+	Delivered time.Time
+}
+
+type openResponse struct {
+	Session  string
+	Messages []messageInfo
+}
+
+type retrieveRequest struct {
+	Session string
+	ID      int
+}
+
+type chunk struct {
+	Data []byte
+}
+
+type closeRequest struct {
+	Session string
+	Deleted []int
+}
+
+func methodName(method string) string {
+	return "/" + serviceName + "/" + method
+}
@@ -0,0 +1,104 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+// Package batv implements Bounce Address Tag Validation with the "prvs"
+// scheme from draft-levine-smtp-batv-01. The envelope sender of outgoing
+// mail is signed, so that a bounce to an address without a valid signature
+// can be recognized as backscatter from forged mail.
+package batv
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const prefix = "prvs="
+
+// ValidDays is how long a signed address is accepted for.
+const ValidDays = 7
+
+var (
+	ErrNotSigned = errors.New("batv: address is not signed")
+	ErrInvalid   = errors.New("batv: invalid signature")
+	ErrExpired   = errors.New("batv: signature expired")
+)
+
+// Sign returns |address| with a signature that is valid for ValidDays after
+// |now|, in the form prvs=KDDDSSSSSS=local@domain.
+func Sign(key []byte, address string, now time.Time) string {
+	at := strings.LastIndexByte(address, '@')
+	if at == -1 || address == "" {
+		return address
+	}
+	tag := fmt.Sprintf("0%03d", (day(now)+ValidDays)%1000)
+	return prefix + tag + signature(key, tag, address) + "=" + address
+}
+
+// Verify checks the signature of a signed |address| at |now|, and returns the
+// address without it. If the address is not signed, it is returned with
+// ErrNotSigned.
+func Verify(key []byte, address string, now time.Time) (string, error) {
+	tag, sig, plain, ok := parse(address)
+	if !ok {
+		return address, ErrNotSigned
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(signature(key, tag, plain))) {
+		return plain, ErrInvalid
+	}
+
+	expires, _ := strconv.Atoi(tag[1:])
+	// The expiry day wraps every 1000 days, so compare the distance from
+	// today instead.
+	if remaining := (expires - day(now)%1000 + 1000) % 1000; remaining > ValidDays {
+		return plain, ErrExpired
+	}
+	return plain, nil
+}
+
+// Strip returns |address| without its signature, if it has one.
+func Strip(address string) string {
+	if _, _, plain, ok := parse(address); ok {
+		return plain
+	}
+	return address
+}
+
+// parse splits prvs=KDDDSSSSSS=local@domain into the KDDD tag, the SSSSSS
+// signature, and local@domain.
+func parse(address string) (tag, sig, plain string, ok bool) {
+	if len(address) < len(prefix) || !strings.EqualFold(address[:len(prefix)], prefix) {
+		return "", "", "", false
+	}
+	rest := address[len(prefix):]
+	eq := strings.IndexByte(rest, '=')
+	if eq != 10 {
+		return "", "", "", false
+	}
+	for _, c := range rest[:4] {
+		if c < '0' || c > '9' {
+			return "", "", "", false
+		}
+	}
+	return rest[:4], strings.ToLower(rest[4:10]), rest[11:], true
+}
+
+func signature(key []byte, tag, address string) string {
+	mac := hmac.New(sha1.New, key)
+	mac.Write([]byte(tag))
+	mac.Write([]byte(address))
+	return hex.EncodeToString(mac.Sum(nil)[:3])
+}
+
+func day(t time.Time) int {
+	return int(t.Unix() / (24 * 60 * 60))
+}
@@ -0,0 +1,72 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package batv
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	key := []byte("secret")
+	now := time.Date(2020, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+	signed := Sign(key, "user@example.com", now)
+	if !strings.HasPrefix(signed, "prvs=") || !strings.HasSuffix(signed, "=user@example.com") {
+		t.Errorf("Unexpected signed address %q", signed)
+	}
+	if want, got := len("prvs=0123abcdef=user@example.com"), len(signed); want != got {
+		t.Errorf("Want signed address length %d, got %d (%q)", want, got, signed)
+	}
+
+	cases := []struct {
+		address string
+		key     string
+		at      time.Time
+		plain   string
+		err     error
+	}{
+		{signed, "secret", now, "user@example.com", nil},
+		{strings.ToUpper(signed[:5]) + signed[5:], "secret", now, "user@example.com", nil},
+		{signed, "secret", now.Add(ValidDays * 24 * time.Hour), "user@example.com", nil},
+		{signed, "secret", now.Add((ValidDays + 1) * 24 * time.Hour), "user@example.com", ErrExpired},
+		{signed, "other", now, "user@example.com", ErrInvalid},
+		{signed[:len(signed)-3] + "net", "secret", now, "user@example.net", ErrInvalid},
+		{"user@example.com", "secret", now, "user@example.com", ErrNotSigned},
+		{"prvs=abc=user@example.com", "secret", now, "prvs=abc=user@example.com", ErrNotSigned},
+	}
+	for i, c := range cases {
+		plain, err := Verify([]byte(c.key), c.address, c.at)
+		if want, got := c.err, err; want != got {
+			t.Errorf("%d: want error %v, got %v", i, want, got)
+		}
+		if want, got := c.plain, plain; want != got {
+			t.Errorf("%d: want plain address %q, got %q", i, want, got)
+		}
+	}
+}
+
+func TestExpiryWraps(t *testing.T) {
+	key := []byte("secret")
+	// Day 999 of the 1000-day cycle, so the expiry day wraps past 0.
+	now := time.Unix(999*24*60*60, 0)
+	signed := Sign(key, "user@example.com", now)
+	if _, err := Verify(key, signed, now.Add(24*time.Hour)); err != nil {
+		t.Errorf("Want a valid signature across the wrap, got %v", err)
+	}
+}
+
+func TestStrip(t *testing.T) {
+	signed := Sign([]byte("k"), "user@example.com", time.Now())
+	if want, got := "user@example.com", Strip(signed); want != got {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+	if want, got := "prvs@example.com", Strip("prvs@example.com"); want != got {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+}
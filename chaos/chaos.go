@@ -0,0 +1,98 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+//go:build chaos
+// +build chaos
+
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Enabled reports whether the binary was built with chaos mode.
+const Enabled = true
+
+var errDropped = errors.New("chaos: dropped connection")
+
+var (
+	mu            sync.RWMutex
+	config        Config
+	slowReadDelay = time.Second
+)
+
+// Configure sets the failure rates.
+func Configure(c Config) error {
+	delay := time.Second
+	if c.SlowReadDelay != "" {
+		var err error
+		delay, err = time.ParseDuration(c.SlowReadDelay)
+		if err != nil {
+			return err
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	config = c
+	slowReadDelay = delay
+	return nil
+}
+
+func roll(probability float64) bool {
+	return probability > 0 && rand.Float64() < probability
+}
+
+func current() (Config, time.Duration) {
+	mu.RLock()
+	defer mu.RUnlock()
+	return config, slowReadDelay
+}
+
+// WrapConn returns a connection that may be slow or dropped.
+func WrapConn(conn net.Conn) net.Conn {
+	return &chaosConn{Conn: conn}
+}
+
+type chaosConn struct {
+	net.Conn
+}
+
+func (c *chaosConn) Read(b []byte) (int, error) {
+	cfg, delay := current()
+	if roll(cfg.DropConnection) {
+		c.Conn.Close()
+		return 0, errDropped
+	}
+	if roll(cfg.SlowRead) {
+		time.Sleep(delay)
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *chaosConn) Write(b []byte) (int, error) {
+	cfg, _ := current()
+	if roll(cfg.DropConnection) {
+		c.Conn.Close()
+		return 0, errDropped
+	}
+	return c.Conn.Write(b)
+}
+
+// DiskError may return an error for the storage operation |op|.
+func DiskError(op string) error {
+	cfg, _ := current()
+	if roll(cfg.DiskFull) {
+		return fmt.Errorf("chaos: %s: %w", op, syscall.ENOSPC)
+	}
+	return nil
+}
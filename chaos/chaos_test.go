@@ -0,0 +1,65 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+//go:build chaos
+// +build chaos
+
+package chaos
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDiskError(t *testing.T) {
+	defer Configure(Config{})
+
+	if err := DiskError("test"); err != nil {
+		t.Errorf("Want no error when unconfigured, got %v", err)
+	}
+
+	Configure(Config{DiskFull: 1})
+	if err := DiskError("test"); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Want ENOSPC, got %v", err)
+	}
+}
+
+func TestWrapConn(t *testing.T) {
+	defer Configure(Config{})
+
+	if err := Configure(Config{SlowRead: 1, SlowReadDelay: "50ms"}); err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := WrapConn(server)
+	go client.Write([]byte("x"))
+
+	start := time.Now()
+	buf := make([]byte, 1)
+	if _, err := conn.Read(buf); err != nil {
+		t.Errorf("Read failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Read should have been delayed, took %v", elapsed)
+	}
+
+	Configure(Config{DropConnection: 1})
+	if _, err := conn.Read(buf); err == nil {
+		t.Errorf("Read should fail on a dropped connection")
+	}
+	if _, err := client.Write([]byte("x")); err == nil {
+		t.Errorf("Peer should see the dropped connection")
+	}
+
+	if err := Configure(Config{SlowReadDelay: "bogus"}); err == nil {
+		t.Errorf("Want error for invalid SlowReadDelay")
+	}
+}
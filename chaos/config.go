@@ -0,0 +1,25 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+// Package chaos injects artificial failures into connections and storage, to
+// exercise the server's error handling in integration tests. Failures are
+// only injected in binaries built with `-tags chaos`; otherwise every
+// function in this package is a no-op.
+package chaos
+
+// Config sets the probability, from 0 to 1, of each kind of failure.
+type Config struct {
+	// SlowRead delays a read from a connection by SlowReadDelay.
+	SlowRead float64
+	// SlowReadDelay is a Go duration string. It defaults to one second.
+	SlowReadDelay string
+
+	// DropConnection closes a connection before a read or write.
+	DropConnection float64
+
+	// DiskFull fails a storage write with ENOSPC.
+	DiskFull float64
+}
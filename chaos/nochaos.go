@@ -0,0 +1,32 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+//go:build !chaos
+// +build !chaos
+
+package chaos
+
+import (
+	"net"
+)
+
+// Enabled reports whether the binary was built with chaos mode.
+const Enabled = false
+
+// Configure has no effect without chaos mode.
+func Configure(c Config) error {
+	return nil
+}
+
+// WrapConn returns |conn| without chaos mode.
+func WrapConn(conn net.Conn) net.Conn {
+	return conn
+}
+
+// DiskError returns nil without chaos mode.
+func DiskError(op string) error {
+	return nil
+}
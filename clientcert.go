@@ -0,0 +1,111 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// clientCertAuth is the set of TLS client certificates that a Server
+// trusts to relay its mail.
+type clientCertAuth struct {
+	fingerprints map[string]bool // Lowercase hex SHA-256.
+	roots        *x509.CertPool  // Nil if there is no ClientCACertPath.
+}
+
+// hasClientCertAuth reports whether any server accepts client certificates.
+func (c Config) hasClientCertAuth() bool {
+	for _, s := range c.Servers {
+		if len(s.ClientCertificates) > 0 || s.ClientCACertPath != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// loadClientCertAuth loads the client certificates trusted by each server,
+// keyed by domain.
+func loadClientCertAuth(config Config) (map[string]*clientCertAuth, error) {
+	auths := make(map[string]*clientCertAuth)
+	for _, s := range config.Servers {
+		if len(s.ClientCertificates) == 0 && s.ClientCACertPath == "" {
+			continue
+		}
+		auth := &clientCertAuth{fingerprints: make(map[string]bool)}
+		for _, fp := range s.ClientCertificates {
+			fp = strings.ToLower(strings.ReplaceAll(fp, ":", ""))
+			if b, err := hex.DecodeString(fp); err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("%s: invalid ClientCertificates fingerprint %q", s.Domain, fp)
+			}
+			auth.fingerprints[fp] = true
+		}
+		if s.ClientCACertPath != "" {
+			pem, err := ioutil.ReadFile(s.ClientCACertPath)
+			if err != nil {
+				return nil, err
+			}
+			auth.roots = x509.NewCertPool()
+			if !auth.roots.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("%s: no certificates found in ClientCACertPath", s.Domain)
+			}
+		}
+		auths[s.Domain] = auth
+	}
+	return auths, nil
+}
+
+// allows reports whether the leaf certificate of |chain| is trusted.
+func (a *clientCertAuth) allows(chain []*x509.Certificate) bool {
+	leaf := chain[0]
+	sum := sha256.Sum256(leaf.Raw)
+	if a.fingerprints[hex.EncodeToString(sum[:])] {
+		return true
+	}
+	if a.roots == nil {
+		return false
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         a.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err == nil
+}
+
+// CertificateAuthenticate implements smtp.CertificateAuthenticator. A client
+// certificate trusted by a Server authenticates the client as that domain's
+// mailbox user.
+func (server *smtpServer) CertificateAuthenticate(state tls.ConnectionState) string {
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	server.tlsMu.RLock()
+	clientCerts := server.clientCerts
+	server.tlsMu.RUnlock()
+	for _, s := range server.config.Servers {
+		auth := clientCerts[s.Domain]
+		if auth != nil && auth.allows(state.PeerCertificates) {
+			server.log.Info("authenticated client certificate",
+				zap.String("domain", s.Domain),
+				zap.String("subject", state.PeerCertificates[0].Subject.String()))
+			return MailboxAccount + s.Domain
+		}
+	}
+	return ""
+}
@@ -0,0 +1,171 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// newTestCert creates a certificate for |name|, signed by |parent| or else
+// self-signed.
+func newTestCert(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestCertificateAuthenticate(t *testing.T) {
+	ca, caKey := newTestCert(t, "Test CA", true, nil, nil)
+	issued, _ := newTestCert(t, "app.example.com", false, ca, caKey)
+	pinned, _ := newTestCert(t, "pinned.example.com", false, nil, nil)
+	other, _ := newTestCert(t, "other.example.com", false, nil, nil)
+
+	dir, err := ioutil.TempDir("", "clientcert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caPath := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := Config{Servers: []Server{
+		{Domain: "example.com", ClientCACertPath: caPath},
+		{Domain: "example.org", ClientCertificates: []string{fingerprint(pinned)}},
+		{Domain: "example.net"},
+	}}
+	auths, err := loadClientCertAuth(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := smtpServer{config: config, clientCerts: auths, log: zap.NewNop()}
+
+	cases := []struct {
+		cert  *x509.Certificate
+		authc string
+	}{
+		{issued, "mailbox@example.com"},
+		{pinned, "mailbox@example.org"},
+		{other, ""},
+	}
+	for _, c := range cases {
+		state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{c.cert}}
+		if want, got := c.authc, server.CertificateAuthenticate(state); want != got {
+			t.Errorf("%s: want authc %q, got %q", c.cert.Subject.CommonName, want, got)
+		}
+	}
+	if want, got := "", server.CertificateAuthenticate(tls.ConnectionState{}); want != got {
+		t.Errorf("Want no authc without a certificate, got %q", got)
+	}
+}
+
+func TestCertificateAuthenticateDuringReload(t *testing.T) {
+	pinned, _ := newTestCert(t, "pinned.example.com", false, nil, nil)
+	server := &smtpServer{
+		config: Config{Servers: []Server{
+			{Domain: "example.org", ClientCertificates: []string{fingerprint(pinned)}},
+		}},
+		log:         zap.NewNop(),
+		controlChan: make(chan ServerControlMessage, 1),
+	}
+	if !server.loadTLSConfig() {
+		t.Fatal("Failed to load TLS config")
+	}
+
+	// Connections read the client certificates while a reload replaces them,
+	// which the race detector checks.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			server.loadTLSConfig()
+		}
+	}()
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{pinned}}
+	for i := 0; i < 100; i++ {
+		if want, got := "mailbox@example.org", server.CertificateAuthenticate(state); want != got {
+			t.Fatalf("Want authc %q, got %q", want, got)
+		}
+		server.TLSConfig()
+	}
+	<-done
+}
+
+func TestLoadClientCertAuthValidates(t *testing.T) {
+	config := Config{Servers: []Server{{Domain: "example.com", ClientCertificates: []string{"abcd"}}}}
+	if _, err := loadClientCertAuth(config); err == nil {
+		t.Errorf("Want error for an invalid fingerprint")
+	}
+}
+
+func TestSMTPTLSConfigRequestsClientCerts(t *testing.T) {
+	config := Config{Servers: []Server{{
+		Domain:      "example.com",
+		TLSCertPath: "testtls/domain.crt",
+		TLSKeyPath:  "testtls/domain.key",
+	}}}
+	tlsConfig, err := config.GetSMTPTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := tls.NoClientCert, tlsConfig.ClientAuth; want != got {
+		t.Errorf("Want ClientAuth %v, got %v", want, got)
+	}
+
+	config.Servers[0].ClientCertificates = []string{"2f:f4:78:89:d6:87:d1:16:22:df:dd:f4:52:42:7a:4a:3c:b3:40:0c:dc:af:ec:82:99:aa:43:f3:b3:48:dd:72"}
+	tlsConfig, err = config.GetSMTPTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := tls.RequestClientCert, tlsConfig.ClientAuth; want != got {
+		t.Errorf("Want ClientAuth %v, got %v", want, got)
+	}
+}
+
+func fingerprint(cert *x509.Certificate) string {
+	return fmt.Sprintf("%x", sha256.Sum256(cert.Raw))
+}
@@ -0,0 +1,211 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+// smtp-loadgen floods an SMTP server with concurrent sessions that each send
+// messages down the happy path, and reports the throughput and latency. It
+// is meant for measuring a test instance of mailpopbox, such as one with
+// AdminProfiling set, before a release.
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	addr        = flag.String("addr", "localhost:9025", "host:port of the SMTP server")
+	concurrency = flag.Int("c", 16, "number of concurrent sessions")
+	total       = flag.Int("n", 1000, "number of messages to send")
+	perConn     = flag.Int("per-conn", 1, "messages sent in each session")
+	size        = flag.Int("size", 4096, "approximate size of each message body, in bytes")
+	from        = flag.String("from", "loadgen@example.net", "envelope sender")
+	to          = flag.String("to", "", "envelope recipient, like test@example.com")
+	helo        = flag.String("helo", "loadgen.example.net", "name sent in EHLO")
+	startTLS    = flag.Bool("starttls", false, "use STARTTLS, without verifying the certificate")
+	timeout     = flag.Duration("timeout", 30*time.Second, "timeout for each session")
+)
+
+// result is the outcome of one message.
+type result struct {
+	latency time.Duration
+	err     error
+}
+
+func main() {
+	flag.Parse()
+	if *to == "" || *concurrency <= 0 || *total <= 0 || *perConn <= 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s -to test@example.com [-addr host:port] [-c 16] [-n 1000] [-per-conn 1] [-size 4096] [-starttls]\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	body := makeMessage(*size)
+	results := make(chan result, *total)
+	var remaining int64 = int64(*total)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				n := claim(&remaining, *perConn)
+				if n == 0 {
+					return
+				}
+				runSession(n, body, results)
+			}
+		}()
+	}
+	wg.Wait()
+	close(results)
+	elapsed := time.Since(start)
+
+	report(results, elapsed)
+}
+
+// claim takes up to |n| messages from |remaining|, and returns how many were
+// taken.
+func claim(remaining *int64, n int) int {
+	for {
+		r := atomic.LoadInt64(remaining)
+		if r <= 0 {
+			return 0
+		}
+		take := int64(n)
+		if take > r {
+			take = r
+		}
+		if atomic.CompareAndSwapInt64(remaining, r, r-take) {
+			return int(take)
+		}
+	}
+}
+
+// makeMessage returns a message with a body of about |size| bytes, in lines
+// of 76 characters.
+func makeMessage(size int) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: <%s>\r\nTo: <%s>\r\nSubject: smtp-loadgen\r\n", *from, *to)
+	fmt.Fprintf(&buf, "Date: %s\r\nMessage-ID: <%d@%s>\r\n\r\n", time.Now().Format(time.RFC1123Z), time.Now().UnixNano(), *helo)
+	line := strings.Repeat("0123456789abcdefghijklmnopqrstuvwxyz", 3)[:76] + "\r\n"
+	for written := 0; written < size; written += len(line) {
+		buf.WriteString(line)
+	}
+	return buf.Bytes()
+}
+
+// runSession sends |n| messages in one session, and reports each one's
+// outcome to |results|. If the session fails, its unsent messages fail too.
+func runSession(n int, body []byte, results chan<- result) {
+	fail := func(sent int, err error) {
+		for i := sent; i < n; i++ {
+			results <- result{err: err}
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", *addr, *timeout)
+	if err != nil {
+		fail(0, err)
+		return
+	}
+	conn.SetDeadline(time.Now().Add(*timeout))
+	host, _, _ := net.SplitHostPort(*addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		fail(0, err)
+		return
+	}
+	defer c.Close()
+
+	if err := c.Hello(*helo); err != nil {
+		fail(0, err)
+		return
+	}
+	if *startTLS {
+		if err := c.StartTLS(&tls.Config{ServerName: host, InsecureSkipVerify: true}); err != nil {
+			fail(0, err)
+			return
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		start := time.Now()
+		if err := sendMessage(c, body); err != nil {
+			fail(i, err)
+			return
+		}
+		results <- result{latency: time.Since(start)}
+	}
+	c.Quit()
+}
+
+func sendMessage(c *smtp.Client, body []byte) error {
+	if err := c.Mail(*from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(*to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// report prints the throughput, the latency percentiles of the messages that
+// were sent, and a count of each error.
+func report(results <-chan result, elapsed time.Duration) {
+	var latencies []time.Duration
+	errors := make(map[string]int)
+	for r := range results {
+		if r.err != nil {
+			errors[r.err.Error()]++
+			continue
+		}
+		latencies = append(latencies, r.latency)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	failed := 0
+	for _, n := range errors {
+		failed += n
+	}
+	fmt.Printf("sent %d, failed %d in %v (%.1f messages/s)\n",
+		len(latencies), failed, elapsed.Round(time.Millisecond), float64(len(latencies))/elapsed.Seconds())
+
+	if len(latencies) > 0 {
+		percentile := func(p float64) time.Duration {
+			return latencies[int(p*float64(len(latencies)-1))]
+		}
+		fmt.Printf("latency p50 %v, p90 %v, p99 %v, max %v\n",
+			percentile(0.5).Round(time.Microsecond),
+			percentile(0.9).Round(time.Microsecond),
+			percentile(0.99).Round(time.Microsecond),
+			latencies[len(latencies)-1].Round(time.Microsecond))
+	}
+	for err, n := range errors {
+		fmt.Printf("%6d  %s\n", n, err)
+	}
+	if failed > 0 {
+		os.Exit(2)
+	}
+}
@@ -8,20 +8,222 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"src.bluestatic.org/mailpopbox/chaos"
+	"src.bluestatic.org/mailpopbox/pop3"
+	"src.bluestatic.org/mailpopbox/smtp"
 )
 
 type Config struct {
 	SMTPPort int
 	POP3Port int
 
+	// SMTPAddress, if set, is where the SMTP listener binds instead of
+	// SMTPPort: the path of a unix socket, like "/var/run/mailpopbox/smtp",
+	// or a TCP address, like "127.0.0.1:2525". Clients of a unix socket are
+	// trusted like TrustedRelays.
+	SMTPAddress string
+
+	// SubmissionPort, if non-zero, runs a second SMTP listener for mail
+	// clients, usually on port 587. It only accepts authenticated mail to
+	// relay, never inbound mail.
+	SubmissionPort int
+
+	// SMTPOptions and POP3Options set the limits on client input. Zero values
+	// use the protocol defaults.
+	SMTPOptions smtp.Options
+	POP3Options pop3.Options
+
+	// SMTPAccess and POP3Access restrict which client IPs can connect to the
+	// listeners. They are reloaded on SIGHUP.
+	SMTPAccess AccessList
+	POP3Access AccessList
+
+	// LMTPAddress, if set, runs an LMTP listener for another MTA to deliver
+	// inbound mail to, on the path of a unix socket, like
+	// "/var/run/mailpopbox/lmtp", or a TCP address, like "127.0.0.1:24".
+	// Its clients are trusted, so it must not be reachable by others.
+	LMTPAddress string
+
+	// SMTPListener, SubmissionListener, LMTPListener, and POP3Listener set
+	// the connection limit and trusted PROXY protocol senders of each
+	// listener.
+	SMTPListener       ListenerOptions
+	SubmissionListener ListenerOptions
+	LMTPListener       ListenerOptions
+	POP3Listener       ListenerOptions
+
+	// TrustedRelays lists the IP addresses or CIDR ranges of filtering
+	// gateways in front of the SMTP listener. They can use the XCLIENT
+	// command, and otherwise the origin client of their messages is taken
+	// from the Received header they add.
+	TrustedRelays []string
+
+	// Harvest, if set, bans client IPs that try many nonexistent recipients.
+	Harvest *HarvestConfig `json:",omitempty"`
+
 	// Hostname is the name of the MX server that is running.
 	Hostname string
 
+	// RelayHostname is the name sent in EHLO when relaying messages, if it
+	// differs from Hostname. It can be overridden for each Server.
+	RelayHostname string
+
+	// RelaySourceIP, if set, is the local IP address that messages are
+	// relayed from, rather than the one chosen by the system. It can be
+	// overridden for each Server.
+	RelaySourceIP string
+
+	// Mode selects which parts of the server run in this process. The
+	// default, "", runs everything. ModeFrontend runs only the SMTP and POP3
+	// listeners, which forward to the backend at BackendAddress. ModeBackend
+	// runs only the delivery and storage service, listening on
+	// BackendAddress.
+	Mode string
+
+	// BackendAddress is the host:port of the backend service.
+	BackendAddress string
+
+	// TLS for the connection between frontends and the backend. In
+	// ModeBackend, all three are required: the certificate is the server's,
+	// and frontends must present a client certificate signed by
+	// BackendCACertPath. In ModeFrontend, the certificate is presented as a
+	// client certificate and BackendCACertPath verifies the backend.
+	BackendTLSKeyPath  string
+	BackendTLSCertPath string
+	BackendCACertPath  string
+
+	// TemplatesPath is an optional directory of text/template files that
+	// override the human-readable text of generated messages. See
+	// smtp.Templates for the file naming.
+	TemplatesPath string
+
+	// MaillogPath, if set, is a file to which a Postfix-style delivery log is
+	// appended, in addition to the regular log.
+	MaillogPath string
+
+	// RelayRetry, if set, retries relayed messages that fail temporarily
+	// before notifying the sender. By default, the sender is notified of any
+	// failure after the first attempt.
+	RelayRetry *RelayRetryConfig `json:",omitempty"`
+
+	// RelayDeadHostTTL is how long an MX host that could not be connected to
+	// is skipped in favor of the domain's other MX hosts, as a Go duration
+	// string. It defaults to two minutes.
+	RelayDeadHostTTL string
+
+	// RelayConcurrency is how many deliveries to different domains are made
+	// at once. It defaults to eight.
+	RelayConcurrency int
+
+	// Smarthost, if set, relays all outbound mail through another SMTP
+	// server instead of delivering it to the recipients' MX hosts.
+	Smarthost *SmarthostConfig `json:",omitempty"`
+
+	// MTASTSCachePath, if set, is a directory in which the MTA-STS policies
+	// of recipient domains are cached. Setting it enables fetching and
+	// applying the policies when relaying.
+	MTASTSCachePath string
+
+	// DANE, if set, authenticates MX hosts by their DNSSEC-signed TLSA
+	// records when relaying.
+	DANE *DANEConfig `json:",omitempty"`
+
+	// DNS, if set, configures the DNS server, timeout, and cache used for
+	// all lookups.
+	DNS *DNSConfig `json:",omitempty"`
+
+	// MaxConcurrentDeliveries limits how many messages are written to
+	// maildrops at once. When all are in use, senders are told to try again
+	// later. The default is DefaultMaxConcurrentDeliveries.
+	MaxConcurrentDeliveries int
+
+	// InboundSpool, if set, accepts inbound messages into a spool directory
+	// and filters and delivers them in the background.
+	InboundSpool *SpoolConfig `json:",omitempty"`
+
+	// AdminAddress is the host:port for an HTTP server that reports health
+	// at /healthz and metrics at /debug/vars. It should not be reachable from
+	// the Internet.
+	AdminAddress string
+
+	// AdminToken, if set, enables the admin endpoints that change mailboxes,
+	// like /import, for requests with an "Authorization: Bearer" header that
+	// carries it.
+	AdminToken string
+
+	// AdminProfiling serves the runtime profiles of net/http/pprof under
+	// /debug/pprof/ on the admin server, and samples blocking and mutex
+	// contention for them.
+	AdminProfiling bool
+
+	// WatchdogInterval is how often the SMTP and POP3 listeners are probed,
+	// as a Go duration string. It defaults to one minute.
+	WatchdogInterval string
+
+	// DMARCReportInterval is how often the aggregate DMARC results of the
+	// Servers with a DMARC config are logged, as a Go duration string. It
+	// defaults to 24 hours.
+	DMARCReportInterval string
+
+	// TLSReport, if set, collects the outcome of TLS negotiation when
+	// relaying mail, for SMTP TLS Reporting.
+	TLSReport *TLSReportConfig `json:",omitempty"`
+
+	// GeoIP, if set, looks up the location of SMTP clients.
+	GeoIP *GeoIPConfig `json:",omitempty"`
+
+	// HeloPolicies act on inbound mail by the result of checking the
+	// client's EHLO name against its forward-confirmed reverse DNS.
+	HeloPolicies []HeloPolicy `json:",omitempty"`
+
+	// ContentFilter, if set, pipes inbound mail through an external command
+	// that can accept, reject, or rewrite it.
+	ContentFilter *ContentFilterConfig `json:",omitempty"`
+
+	// Rspamd, if set, scores inbound mail with rspamd and applies the action
+	// it returns.
+	Rspamd *RspamdConfig `json:",omitempty"`
+
+	// Reputation, if set, tracks how the inbound mail of each sender domain
+	// and client IP fares, and scores or rejects repeat offenders.
+	Reputation *ReputationConfig `json:",omitempty"`
+
+	// Log, if set, adds a JSON log written through log/slog.
+	Log *LogConfig `json:",omitempty"`
+
+	// Chaos configures fault injection, for testing. It requires a binary
+	// built with `-tags chaos`.
+	Chaos *chaos.Config `json:",omitempty"`
+
 	Servers []Server
 }
 
+const (
+	ModeFrontend = "frontend"
+	ModeBackend  = "backend"
+)
+
 const MailboxAccount = "mailbox@"
 
+// RoleAccounts are the local parts that every domain accepts mail for, even
+// if they are blocked or not allowed: postmaster (RFC 5321 § 4.5.1) and abuse
+// (RFC 2142).
+var RoleAccounts = []string{"postmaster", "abuse"}
+
+// QuarantineAccount is the POP3 user that opens the quarantine folder of a
+// Server's maildrop, with its MailboxPassword.
+const QuarantineAccount = "quarantine@"
+
+const DefaultMaxConcurrentDeliveries = 16
+
 type Server struct {
 	// Domain is the second component of a mail address: <local-part@domain.com>.
 	Domain string
@@ -29,25 +231,289 @@ type Server struct {
 	TLSKeyPath  string
 	TLSCertPath string
 
+	// SMTPTLS and POP3TLS, if set, replace TLSKeyPath and TLSCertPath for
+	// one protocol's listener, for when the MX and POP3 hostnames differ.
+	SMTPTLS *TLSPaths `json:",omitempty"`
+	POP3TLS *TLSPaths `json:",omitempty"`
+
 	// Password for the POP3 mailbox user, mailbox@domain.com.
 	MailboxPassword string
 
+	// If set, SMTP clients can also authenticate as the mailbox user with an
+	// OAuth 2.0 bearer token, using XOAUTH2 or OAUTHBEARER. The token is
+	// checked by POSTing it to this RFC 7662 introspection endpoint.
+	TokenIntrospectionURL string
+
+	// SMTP clients that present one of these TLS client certificates after
+	// STARTTLS are authenticated as the mailbox user, to relay mail without
+	// AUTH. ClientCertificates are SHA-256 fingerprints in hex, and
+	// ClientCACertPath is a PEM file of CAs that issue client certificates.
+	ClientCertificates []string
+	ClientCACertPath   string
+
 	// Location to store the mail messages.
 	MaildropPath string
 
+	// SentFolder, if set, is a folder of the maildrop that keeps a copy of
+	// each message relayed from this domain once it is delivered to at least
+	// one recipient. It can be read over POP3 as mailbox+folder@domain.
+	SentFolder string
+
+	// RoleFolder, if set, is a folder of the maildrop that receives the mail
+	// addressed only to the domain's RoleAccounts. It can be read over POP3
+	// as mailbox+folder@domain.
+	RoleFolder string
+
+	// MaildropQuota, if non-zero, is the most bytes of mail the maildrop can
+	// hold. When a delivery would exceed it, the message is rejected as
+	// mailbox full, unless QuotaTrimOldest is set, in which case the oldest
+	// messages are removed to make room and a notice lists them.
+	MaildropQuota   int64
+	QuotaTrimOldest bool
+
+	// TrashRetention, if set, is how long messages deleted over POP3 are
+	// kept in the maildrop's trash, as a Go duration string, during which
+	// they can be restored with the undelete command. By default, they are
+	// removed at once.
+	TrashRetention string
+
+	// MaxMessageSize, if non-zero, is the largest message in bytes that
+	// addresses in this domain accept. It cannot raise the listener's
+	// SMTPOptions.MaxMessageSize.
+	MaxMessageSize int64
+
 	// Addresses that should not accept mail. This should include the @domain
 	// component.
 	BlockedAddresses []string
+
+	// Files of address patterns, one per line, that are re-read whenever
+	// they change. Addresses matching BlockedAddressesFile do not accept
+	// mail. If AllowedAddressesFile is set, only addresses matching it do,
+	// besides the mailbox address. Patterns can use * and ?, like
+	// "*@example.com".
+	BlockedAddressesFile string
+	AllowedAddressesFile string
+
+	// If set, addresses that are not blocked are also checked with an HTTP GET
+	// to this URL, with the address in the "address" query parameter. A 2xx
+	// status accepts the address and a 404 or 410 rejects it.
+	VerifyURL string
+
+	// By default, a send-as message that has a Reply-To of the mailbox address
+	// has it rewritten to the send-as address. If this is set, the mailbox
+	// address is removed from Reply-To instead.
+	SendAsStripReplyTo bool
+
+	// RelayHostname and RelaySourceIP override those of the Config for
+	// messages from this domain, so that it has its own sending identity.
+	RelayHostname string
+	RelaySourceIP string
+
+	// DKIMSigning, if set, signs messages relayed from this domain with
+	// DKIM.
+	DKIMSigning *DKIMSigningConfig `json:",omitempty"`
+
+	// If set, the envelope sender of messages relayed from this domain is
+	// signed with this key, using Bounce Address Tag Validation. Bounces to
+	// this domain without a valid signature are then marked with a header,
+	// or rejected if BATVReject is set.
+	BATVKey    string
+	BATVReject bool
+
+	// Archive, if set, journals a copy of the domain's mail.
+	Archive *ArchiveConfig `json:",omitempty"`
+
+	// Reports, if set, digests the DMARC and TLS aggregate reports sent to
+	// the domain.
+	Reports *ReportsConfig `json:",omitempty"`
+
+	// DMARC, if set, applies the DMARC policy of the sender's domain to
+	// inbound mail, and counts the results for the aggregate log.
+	DMARC *DMARCConfig `json:",omitempty"`
+
+	// Quarantine, if set, delivers inbound mail classified as spam to a
+	// folder of the maildrop.
+	Quarantine *QuarantineConfig `json:",omitempty"`
+}
+
+// ArchiveConfig selects which of a Server's mail is journaled, and where the
+// copies go. Each copy has X-Envelope-From and X-Envelope-To headers, since
+// the message header may not name every recipient.
+type ArchiveConfig struct {
+	// Inbound archives mail delivered to the maildrop, and Outbound archives
+	// mail relayed from the domain.
+	Inbound  bool
+	Outbound bool
+
+	// Folder, if set, stores copies in this folder of the maildrop.
+	Folder string
+
+	// Address, if set, relays copies to this mailbox, from the domain's
+	// mailbox address.
+	Address string
 }
 
-func (c Config) GetTLSConfig() (*tls.Config, error) {
+// TLSPaths is the certificate for one protocol of a Server.
+type TLSPaths struct {
+	KeyPath  string
+	CertPath string
+
+	// Disabled leaves the Server's certificate out of the listener.
+	Disabled bool
+}
+
+// RelayRetryPolicy is the config form of smtp.RetryPolicy, with Go duration
+// strings.
+type RelayRetryPolicy struct {
+	// Retry is how long to keep trying a message, like "48h".
+	Retry string
+	// Interval is the time between attempts. It defaults to five minutes.
+	Interval string
+	// DelayWarning, if set, notifies the sender once a message has been
+	// undelivered this long.
+	DelayWarning string
+}
+
+type RelayRetryConfig struct {
+	RelayRetryPolicy
+
+	// Domains overrides the policy for recipients in a destination domain.
+	Domains map[string]RelayRetryPolicy
+}
+
+// SmarthostConfig is the SMTP server that outbound mail is relayed through,
+// such as an ISP's submission server. TLS is required to connect to it.
+type SmarthostConfig struct {
+	Host string
+	// Port defaults to 587, or to 465 with ImplicitTLS.
+	Port string
+	// ImplicitTLS connects with TLS, rather than with STARTTLS.
+	ImplicitTLS bool
+	// Username and Password, if set, authenticate to the smarthost.
+	Username string
+	Password string
+}
+
+func (c *SmarthostConfig) smarthost() (*smtp.Smarthost, error) {
+	if c.Host == "" {
+		return nil, fmt.Errorf("missing Host")
+	}
+	port := c.Port
+	if port == "" {
+		port = "587"
+		if c.ImplicitTLS {
+			port = "465"
+		}
+	}
+	return &smtp.Smarthost{
+		Host:        c.Host,
+		Port:        port,
+		ImplicitTLS: c.ImplicitTLS,
+		Username:    c.Username,
+		Password:    c.Password,
+	}, nil
+}
+
+// DANEConfig configures DANE (RFC 7672) for relaying.
+type DANEConfig struct {
+	// Resolver is the host:port of a DNSSEC-validating resolver. Its answers
+	// are trusted, so it should run on the same host.
+	Resolver string
+	// Fallback is how the certificates of MX hosts without TLSA records are
+	// checked: "verify" against the system roots, which is the default, or
+	// "opportunistic", which does not check them.
+	Fallback string
+}
+
+func (p RelayRetryPolicy) parse() (smtp.RetryPolicy, error) {
+	var policy smtp.RetryPolicy
+	fields := []struct {
+		name  string
+		value string
+		d     *time.Duration
+	}{
+		{"Retry", p.Retry, &policy.Retry},
+		{"Interval", p.Interval, &policy.Interval},
+		{"DelayWarning", p.DelayWarning, &policy.DelayWarning},
+	}
+	for _, f := range fields {
+		if f.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(f.value)
+		if err != nil {
+			return policy, fmt.Errorf("%s: %v", f.name, err)
+		}
+		*f.d = d
+	}
+	return policy, nil
+}
+
+// serverForDomain returns the Server for |domain|, or nil if there is none.
+func (c Config) serverForDomain(domain string) *Server {
+	for i := range c.Servers {
+		if c.Servers[i].Domain == domain {
+			return &c.Servers[i]
+		}
+	}
+	return nil
+}
+
+// smtpAddress returns the address the SMTP listener binds.
+func (c Config) smtpAddress() string {
+	if c.SMTPAddress != "" {
+		return c.SMTPAddress
+	}
+	return fmt.Sprintf(":%d", c.SMTPPort)
+}
+
+func loadConfig(path string) (Config, error) {
+	var config Config
+
+	f, err := os.Open(path)
+	if err != nil {
+		return config, err
+	}
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(&config)
+	return config, err
+}
+
+// GetSMTPTLSConfig returns the TLS configuration for the SMTP listener, or
+// nil if no server has a certificate.
+func (c Config) GetSMTPTLSConfig() (*tls.Config, error) {
+	config, err := c.getTLSConfig(func(s Server) *TLSPaths { return s.SMTPTLS })
+	if config != nil && c.hasClientCertAuth() {
+		// The certificates are checked by CertificateAuthenticate, since
+		// each Server trusts different ones.
+		config.ClientAuth = tls.RequestClientCert
+	}
+	return config, err
+}
+
+// GetPOP3TLSConfig returns the TLS configuration for the POP3 listener, or
+// nil if no server has a certificate.
+func (c Config) GetPOP3TLSConfig() (*tls.Config, error) {
+	return c.getTLSConfig(func(s Server) *TLSPaths { return s.POP3TLS })
+}
+
+func (c Config) getTLSConfig(override func(Server) *TLSPaths) (*tls.Config, error) {
 	certs := make([]tls.Certificate, 0, len(c.Servers))
 	for _, server := range c.Servers {
-		if server.TLSCertPath == "" {
+		certPath, keyPath := server.TLSCertPath, server.TLSKeyPath
+		if paths := override(server); paths != nil {
+			if paths.Disabled {
+				continue
+			}
+			certPath, keyPath = paths.CertPath, paths.KeyPath
+		}
+
+		if certPath == "" {
 			continue
 		}
 
-		cert, err := tls.LoadX509KeyPair(server.TLSCertPath, server.TLSKeyPath)
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
 		if err != nil {
 			return nil, err
 		}
@@ -64,3 +530,44 @@ func (c Config) GetTLSConfig() (*tls.Config, error) {
 	config.BuildNameToCertificate()
 	return config, nil
 }
+
+// GetBackendTLSConfig returns the TLS configuration for the frontend-backend
+// connection, or nil if it is not encrypted. The backend cannot run without
+// TLS, since it would accept mail to relay from anyone who can reach it.
+func (c Config) GetBackendTLSConfig() (*tls.Config, error) {
+	if c.Mode == ModeBackend && (c.BackendTLSCertPath == "" || c.BackendTLSKeyPath == "" || c.BackendCACertPath == "") {
+		return nil, errors.New("BackendTLSCertPath, BackendTLSKeyPath, and BackendCACertPath are required in backend mode")
+	}
+	if c.BackendTLSCertPath == "" && c.BackendCACertPath == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+
+	if c.BackendTLSCertPath != "" {
+		cert, err := tls.LoadX509KeyPair(c.BackendTLSCertPath, c.BackendTLSKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.BackendCACertPath != "" {
+		pem, err := ioutil.ReadFile(c.BackendCACertPath)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in BackendCACertPath")
+		}
+		if c.Mode == ModeBackend {
+			config.ClientCAs = pool
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			config.RootCAs = pool
+		}
+	}
+
+	return config, nil
+}
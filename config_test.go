@@ -0,0 +1,113 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPerProtocolTLSConfig(t *testing.T) {
+	config := Config{
+		Servers: []Server{
+			{
+				Domain:      "one.net",
+				TLSCertPath: "testtls/domain.crt",
+				TLSKeyPath:  "testtls/domain.key",
+				POP3TLS:     &TLSPaths{Disabled: true},
+			},
+			{
+				Domain:  "two.net",
+				SMTPTLS: &TLSPaths{CertPath: "testtls/domain.crt", KeyPath: "testtls/domain.key"},
+			},
+		},
+	}
+
+	smtpTLS, err := config.GetSMTPTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(smtpTLS.Certificates); want != got {
+		t.Errorf("Want %d SMTP certificates, got %d", want, got)
+	}
+
+	pop3TLS, err := config.GetPOP3TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pop3TLS != nil {
+		t.Errorf("Want no POP3 TLS, got %d certificates", len(pop3TLS.Certificates))
+	}
+
+	config.Servers[1].SMTPTLS.KeyPath = "testtls/missing.key"
+	if _, err := config.GetSMTPTLSConfig(); err == nil {
+		t.Errorf("Want error for missing key")
+	}
+}
+
+func TestRelayRetryPolicy(t *testing.T) {
+	policy, err := RelayRetryPolicy{Retry: "2h", DelayWarning: "30m"}.parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2*time.Hour, policy.Retry; want != got {
+		t.Errorf("Want Retry %v, got %v", want, got)
+	}
+	if want, got := time.Duration(0), policy.Interval; want != got {
+		t.Errorf("Want Interval %v, got %v", want, got)
+	}
+	if want, got := 30*time.Minute, policy.DelayWarning; want != got {
+		t.Errorf("Want DelayWarning %v, got %v", want, got)
+	}
+
+	if _, err := (RelayRetryPolicy{Interval: "often"}).parse(); err == nil {
+		t.Errorf("Expected error for invalid Interval")
+	}
+}
+
+func TestSmarthostConfig(t *testing.T) {
+	cases := []struct {
+		config SmarthostConfig
+		port   string
+	}{
+		{SmarthostConfig{Host: "smtp.isp.net"}, "587"},
+		{SmarthostConfig{Host: "smtp.isp.net", ImplicitTLS: true}, "465"},
+		{SmarthostConfig{Host: "smtp.isp.net", Port: "2525"}, "2525"},
+	}
+	for _, c := range cases {
+		sh, err := c.config.smarthost()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := c.port, sh.Port; want != got {
+			t.Errorf("%+v: want Port %q, got %q", c.config, want, got)
+		}
+	}
+
+	if _, err := (&SmarthostConfig{Port: "587"}).smarthost(); err == nil {
+		t.Errorf("Expected error for missing Host")
+	}
+}
+
+func TestBackendTLSRequired(t *testing.T) {
+	cases := []Config{
+		{Mode: ModeBackend},
+		{Mode: ModeBackend, BackendTLSCertPath: "cert.pem", BackendTLSKeyPath: "key.pem"},
+		{Mode: ModeBackend, BackendCACertPath: "ca.pem"},
+	}
+	for _, c := range cases {
+		if _, err := c.GetBackendTLSConfig(); err == nil {
+			t.Errorf("Want error for %+v", c)
+		}
+	}
+
+	// A frontend may still connect without TLS, though the backend will
+	// refuse it.
+	if config, err := (Config{Mode: ModeFrontend}).GetBackendTLSConfig(); config != nil || err != nil {
+		t.Errorf("Want no TLS for frontend, got %v, %v", config, err)
+	}
+}
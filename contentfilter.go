@@ -0,0 +1,353 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+const (
+	ContentFilterOnErrorTempFail = "tempfail"
+	ContentFilterOnErrorAccept   = "accept"
+)
+
+const (
+	ContentFilterProtocolExit = "exit"
+	ContentFilterProtocolJSON = "json"
+)
+
+const (
+	contentFilterActionAccept   = "accept"
+	contentFilterActionReject   = "reject"
+	contentFilterActionTempFail = "tempfail"
+)
+
+const (
+	defaultContentFilterTimeout = 30 * time.Second
+
+	// contentFilterReject and contentFilterTempFail are the exit statuses
+	// with which a filter command refuses a message. The latter is
+	// EX_TEMPFAIL from sysexits.h.
+	contentFilterReject   = 1
+	contentFilterTempFail = 75
+)
+
+var contentFilterMetrics = expvar.NewMap("contentfilter")
+
+var (
+	replyContentFilterRejected = smtp.ReplyLine{Code: 550, Message: "5.7.1 message rejected by content filter"}
+	replyContentFilterTempFail = smtp.ReplyLine{Code: 451, Message: "4.7.1 message deferred by content filter, try again later"}
+)
+
+// ContentFilterConfig pipes each inbound message through an external
+// command, like spamc or clamdscan, before it is delivered. The message is
+// written to the command's standard input. Its envelope is in the
+// MAILPOPBOX_ID, MAILPOPBOX_SENDER, MAILPOPBOX_RECIPIENT, and
+// MAILPOPBOX_CLIENT environment variables.
+//
+// The command's exit status decides the message's fate: 0 accepts it, 1
+// rejects it, and 75 (EX_TEMPFAIL) asks the sender to try again later. The
+// first line of the command's standard error, if any, is the reason given to
+// the sender.
+//
+// With the "json" Protocol, the command instead reads a contentFilterRequest
+// and writes a contentFilterResponse, so that it can also add headers and
+// annotations, and any non-zero exit status is a failure.
+type ContentFilterConfig struct {
+	Command []string
+
+	// Protocol is how the command is spoken to: "exit", the default, or
+	// "json".
+	Protocol string
+
+	// Timeout is how long the command can run, as a Go duration string. It
+	// defaults to 30 seconds.
+	Timeout string
+
+	// Rewrite, if set, replaces the message with the command's standard
+	// output when it accepts the message, such as for a filter that adds
+	// headers. With the "json" Protocol, it allows the response's Message to
+	// replace the message, which is otherwise ignored.
+	Rewrite bool
+
+	// OnError is what happens to a message when the command fails any other
+	// way or times out: "tempfail", the default, or "accept".
+	OnError string
+}
+
+// contentFilter is the running form of a ContentFilterConfig. A nil
+// *contentFilter accepts every message.
+type contentFilter struct {
+	command  []string
+	protocol string
+	timeout  time.Duration
+	rewrite  bool
+	onError  string
+}
+
+// contentFilterRequest is written to the standard input of a "json" filter.
+// Message is the whole message, encoded in base64.
+type contentFilterRequest struct {
+	ID          string
+	Client      string
+	EHLO        string
+	Sender      string
+	Recipients  []string
+	Annotations []smtp.Annotation `json:",omitempty"`
+	Message     []byte
+}
+
+// contentFilterResponse is read from the standard output of a "json" filter.
+// Action is "accept", "reject", or "tempfail", and Reason, if any, is given
+// to the sender of a refused message. Headers and Annotations are added to
+// an accepted message, and Message, if set, replaces it.
+type contentFilterResponse struct {
+	Action      string
+	Reason      string
+	Headers     []smtp.HeaderField
+	Annotations []smtp.Annotation
+	Message     []byte
+}
+
+func newContentFilter(config ContentFilterConfig) (*contentFilter, error) {
+	f := &contentFilter{
+		command:  config.Command,
+		protocol: config.Protocol,
+		timeout:  defaultContentFilterTimeout,
+		rewrite:  config.Rewrite,
+		onError:  config.OnError,
+	}
+	if len(f.command) == 0 {
+		return nil, fmt.Errorf("missing Command")
+	}
+	switch f.protocol {
+	case "":
+		f.protocol = ContentFilterProtocolExit
+	case ContentFilterProtocolExit, ContentFilterProtocolJSON:
+	default:
+		return nil, fmt.Errorf("unknown Protocol %q", f.protocol)
+	}
+	if config.Timeout != "" {
+		var err error
+		if f.timeout, err = time.ParseDuration(config.Timeout); err != nil {
+			return nil, fmt.Errorf("Timeout: %v", err)
+		}
+	}
+	switch f.onError {
+	case "":
+		f.onError = ContentFilterOnErrorTempFail
+	case ContentFilterOnErrorTempFail, ContentFilterOnErrorAccept:
+	default:
+		return nil, fmt.Errorf("unknown OnError %q", f.onError)
+	}
+	return f, nil
+}
+
+// filter runs the command on |en|, which includes the headers added by
+// earlier filters. It returns a reply if the message is refused. If the
+// message is rewritten, the command's output replaces its Data and Headers.
+func (f *contentFilter) filter(en *smtp.Envelope, log *zap.Logger) *smtp.ReplyLine {
+	if f == nil {
+		return nil
+	}
+	log = log.With(zap.String("id", en.ID))
+
+	var message bytes.Buffer
+	en.WriteHeaders(&message)
+	message.Write(en.Data)
+
+	if f.protocol == ContentFilterProtocolJSON {
+		return f.filterJSON(en, message.Bytes(), log)
+	}
+
+	stdout, stderr, err := f.run(en, &message)
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		reason := firstLine(stderr)
+		switch exitErr.ExitCode() {
+		case contentFilterReject:
+			return f.reject(en, reason, log)
+		case contentFilterTempFail:
+			return f.tempFail(reason, log)
+		}
+	} else if err == nil && f.rewrite && len(stdout) == 0 {
+		err = errors.New("rewritten message is empty")
+	}
+	if err != nil {
+		return f.failed(stderr, err, log)
+	}
+
+	contentFilterMetrics.Add("accepted", 1)
+	if f.rewrite {
+		en.Data = stdout
+		en.Headers = nil
+	}
+	return nil
+}
+
+// filterJSON sends |en|, whose full text is |message|, to the command as a
+// contentFilterRequest and applies the contentFilterResponse it returns.
+func (f *contentFilter) filterJSON(en *smtp.Envelope, message []byte, log *zap.Logger) *smtp.ReplyLine {
+	req := contentFilterRequest{
+		ID:          en.ID,
+		Client:      clientIP(en.RemoteAddr),
+		EHLO:        en.EHLO,
+		Sender:      en.MailFrom.Address,
+		Annotations: en.Annotations,
+		Message:     message,
+	}
+	for _, rcpt := range en.RcptTo {
+		req.Recipients = append(req.Recipients, rcpt.Address)
+	}
+	input, err := json.Marshal(req)
+	if err != nil {
+		return f.failed(nil, err, log)
+	}
+
+	stdout, stderr, err := f.run(en, bytes.NewReader(input))
+	if err != nil {
+		return f.failed(stderr, err, log)
+	}
+	var resp contentFilterResponse
+	if err := json.Unmarshal(stdout, &resp); err != nil {
+		return f.failed(stderr, fmt.Errorf("invalid response: %v", err), log)
+	}
+	for _, h := range resp.Headers {
+		if !validHeaderField(h) {
+			return f.failed(stderr, fmt.Errorf("invalid header %q", h.Name), log)
+		}
+	}
+
+	switch resp.Action {
+	case contentFilterActionAccept:
+	case contentFilterActionReject:
+		return f.reject(en, firstLine([]byte(resp.Reason)), log)
+	case contentFilterActionTempFail:
+		return f.tempFail(firstLine([]byte(resp.Reason)), log)
+	default:
+		return f.failed(stderr, fmt.Errorf("unknown Action %q", resp.Action), log)
+	}
+
+	contentFilterMetrics.Add("accepted", 1)
+	if len(resp.Message) > 0 {
+		if f.rewrite {
+			en.Data = resp.Message
+			en.Headers = nil
+		} else {
+			log.Warn("ignored message from content filter without Rewrite")
+		}
+	}
+	en.Headers = append(en.Headers, resp.Headers...)
+	en.Annotations = append(en.Annotations, resp.Annotations...)
+	return nil
+}
+
+// run runs the command on |input| with the envelope of |en| in its
+// environment. A timeout is returned as the context's error.
+func (f *contentFilter) run(en *smtp.Envelope, input io.Reader) (stdout, stderr []byte, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+
+	var outBuf, errBuf bytes.Buffer
+	cmd := exec.CommandContext(ctx, f.command[0], f.command[1:]...)
+	cmd.Stdin = input
+	cmd.Stdout = &outBuf
+	cmd.Stderr = &errBuf
+	cmd.Env = append(os.Environ(),
+		"MAILPOPBOX_ID="+en.ID,
+		"MAILPOPBOX_SENDER="+en.MailFrom.Address,
+		"MAILPOPBOX_RECIPIENT="+en.RcptTo[0].Address,
+		"MAILPOPBOX_CLIENT="+clientIP(en.RemoteAddr))
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return outBuf.Bytes(), errBuf.Bytes(), err
+}
+
+func (f *contentFilter) reject(en *smtp.Envelope, reason string, log *zap.Logger) *smtp.ReplyLine {
+	log.Info("rejected message by content filter", zap.String("reason", reason))
+	contentFilterMetrics.Add("rejected", 1)
+	en.Annotate("content-filter", "reject")
+	return filterReply(replyContentFilterRejected, reason)
+}
+
+func (f *contentFilter) tempFail(reason string, log *zap.Logger) *smtp.ReplyLine {
+	log.Info("deferred message by content filter", zap.String("reason", reason))
+	contentFilterMetrics.Add("deferred", 1)
+	return filterReply(replyContentFilterTempFail, reason)
+}
+
+// failed handles the command failing with |err|, by the OnError setting.
+func (f *contentFilter) failed(stderr []byte, err error, log *zap.Logger) *smtp.ReplyLine {
+	log.Error("content filter failed",
+		zap.ByteString("stderr", stderr),
+		zap.String("on-error", f.onError),
+		zap.Error(err))
+	contentFilterMetrics.Add("errors", 1)
+	if f.onError == ContentFilterOnErrorAccept {
+		return nil
+	}
+	return &replyContentFilterTempFail
+}
+
+// validHeaderField reports whether |h| can be written as a header without
+// changing the structure of the message.
+func validHeaderField(h smtp.HeaderField) bool {
+	if h.Name == "" || strings.ContainsAny(h.Name, ": \t\r\n") {
+		return false
+	}
+	return !strings.ContainsAny(h.Value, "\r\n")
+}
+
+// filterReply returns |reply| with |reason| in place of its text, keeping the
+// enhanced status code.
+func filterReply(reply smtp.ReplyLine, reason string) *smtp.ReplyLine {
+	if reason != "" {
+		code := reply.Message[:strings.IndexByte(reply.Message, ' ')]
+		reply.Message = code + " " + reason
+	}
+	return &reply
+}
+
+// firstLine returns the first line of |b|, without surrounding space.
+func firstLine(b []byte) string {
+	b = bytes.TrimLeft(b, " \t\r\n")
+	// A bare CR ends the line too, so that it cannot reach the reply.
+	if i := bytes.IndexAny(b, "\r\n"); i != -1 {
+		b = b[:i]
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// clientIP returns the IP of |addr|, or its string form if it has no port.
+func clientIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,270 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/mail"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+func TestContentFilter(t *testing.T) {
+	cases := []struct {
+		name   string
+		config ContentFilterConfig
+		reply  *smtp.ReplyLine
+		data   string
+	}{
+		{
+			name:   "accept",
+			config: ContentFilterConfig{Command: []string{"sh", "-c", "cat > /dev/null"}},
+			data:   "X-Test: 1\r\nSubject: hi\r\n\r\nbody\r\n",
+		},
+		{
+			name: "envelope",
+			config: ContentFilterConfig{
+				Command: []string{"sh", "-c", `test "$MAILPOPBOX_ID $MAILPOPBOX_SENDER $MAILPOPBOX_RECIPIENT $MAILPOPBOX_CLIENT" = "m.1 from@sender.net to@example.com 192.0.2.1"`},
+			},
+			data: "X-Test: 1\r\nSubject: hi\r\n\r\nbody\r\n",
+		},
+		{
+			name: "rewrite",
+			config: ContentFilterConfig{
+				Command: []string{"sh", "-c", `printf 'X-Spam-Flag: NO\r\n'; cat`},
+				Rewrite: true,
+			},
+			data: "X-Spam-Flag: NO\r\nX-Test: 1\r\nSubject: hi\r\n\r\nbody\r\n",
+		},
+		{
+			name: "reject",
+			config: ContentFilterConfig{
+				Command: []string{"sh", "-c", "echo 'virus found' >&2; exit 1"},
+			},
+			reply: &smtp.ReplyLine{Code: 550, Message: "5.7.1 virus found"},
+		},
+		{
+			name:   "reject without reason",
+			config: ContentFilterConfig{Command: []string{"sh", "-c", "exit 1"}},
+			reply:  &replyContentFilterRejected,
+		},
+		{
+			name:   "tempfail",
+			config: ContentFilterConfig{Command: []string{"sh", "-c", "exit 75"}},
+			reply:  &replyContentFilterTempFail,
+		},
+		{
+			name:   "error",
+			config: ContentFilterConfig{Command: []string{"sh", "-c", "exit 2"}},
+			reply:  &replyContentFilterTempFail,
+		},
+		{
+			name: "error accepted",
+			config: ContentFilterConfig{
+				Command: []string{"sh", "-c", "exit 2"},
+				OnError: ContentFilterOnErrorAccept,
+			},
+			data: "X-Test: 1\r\nSubject: hi\r\n\r\nbody\r\n",
+		},
+		{
+			name: "empty rewrite",
+			config: ContentFilterConfig{
+				Command: []string{"sh", "-c", "cat > /dev/null"},
+				Rewrite: true,
+			},
+			reply: &replyContentFilterTempFail,
+		},
+		{
+			name: "timeout",
+			config: ContentFilterConfig{
+				Command: []string{"sh", "-c", "exec sleep 5"},
+				Timeout: "50ms",
+			},
+			reply: &replyContentFilterTempFail,
+		},
+	}
+	for _, c := range cases {
+		f, err := newContentFilter(c.config)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		en := smtp.Envelope{
+			ID:         "m.1",
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4321},
+			MailFrom:   mail.Address{Address: "from@sender.net"},
+			RcptTo:     []mail.Address{{Address: "to@example.com"}},
+			Data:       []byte("Subject: hi\r\n\r\nbody\r\n"),
+		}
+		en.AddHeader("X-Test", "1")
+
+		reply := f.filter(&en, zap.NewNop())
+		if c.reply != nil {
+			if reply == nil || *c.reply != *reply {
+				t.Errorf("%s: want reply %v, got %v", c.name, c.reply, reply)
+			}
+			continue
+		}
+		if reply != nil {
+			t.Errorf("%s: want accepted, got %v", c.name, reply)
+			continue
+		}
+		var stored bytes.Buffer
+		en.WriteHeaders(&stored)
+		stored.Write(en.Data)
+		if want, got := c.data, stored.String(); want != got {
+			t.Errorf("%s: want message %q, got %q", c.name, want, got)
+		}
+	}
+
+	var nilFilter *contentFilter
+	if reply := nilFilter.filter(&smtp.Envelope{}, zap.NewNop()); reply != nil {
+		t.Errorf("Want nil filter to accept, got %v", reply)
+	}
+}
+
+func TestNewContentFilter(t *testing.T) {
+	if _, err := newContentFilter(ContentFilterConfig{}); err == nil {
+		t.Errorf("Want error for missing Command")
+	}
+	if _, err := newContentFilter(ContentFilterConfig{Command: []string{"true"}, OnError: "bounce"}); err == nil {
+		t.Errorf("Want error for unknown OnError")
+	}
+	if _, err := newContentFilter(ContentFilterConfig{Command: []string{"true"}, Timeout: "soon"}); err == nil {
+		t.Errorf("Want error for invalid Timeout")
+	}
+	if _, err := newContentFilter(ContentFilterConfig{Command: []string{"true"}, Protocol: "xml"}); err == nil {
+		t.Errorf("Want error for unknown Protocol")
+	}
+}
+
+func TestContentFilterJSON(t *testing.T) {
+	cases := []struct {
+		name     string
+		response string
+		onError  string
+		rewrite  bool
+		reply    *smtp.ReplyLine
+		data     string
+		annotate string
+	}{
+		{
+			name:     "accept",
+			response: `{"Action": "accept"}`,
+			data:     "X-Test: 1\r\nSubject: hi\r\n\r\nbody\r\n",
+		},
+		{
+			name:     "headers",
+			response: `{"Action": "accept", "Headers": [{"Name": "X-Policy", "Value": "ok"}], "Annotations": [{"Name": "policy", "Value": "ok"}]}`,
+			data:     "X-Test: 1\r\nX-Policy: ok\r\nSubject: hi\r\n\r\nbody\r\n",
+			annotate: "policy",
+		},
+		{
+			name:     "rewrite",
+			response: `{"Action": "accept", "Message": "U3ViamVjdDogbmV3DQoNCmJvZHkNCg=="}`,
+			rewrite:  true,
+			data:     "Subject: new\r\n\r\nbody\r\n",
+		},
+		{
+			name:     "rewrite not allowed",
+			response: `{"Action": "accept", "Message": "U3ViamVjdDogbmV3DQoNCmJvZHkNCg=="}`,
+			data:     "X-Test: 1\r\nSubject: hi\r\n\r\nbody\r\n",
+		},
+		{
+			name:     "reject",
+			response: `{"Action": "reject"}`,
+			reply:    &replyContentFilterRejected,
+			annotate: "content-filter",
+		},
+		{
+			name:     "reject reason",
+			response: `{"Action": "reject", "Reason": "no thanks"}`,
+			reply:    &smtp.ReplyLine{Code: 550, Message: "5.7.1 no thanks"},
+		},
+		{
+			name:     "reject reason with CRLF",
+			response: `{"Action": "reject", "Reason": "no thanks\r\n"}`,
+			reply:    &smtp.ReplyLine{Code: 550, Message: "5.7.1 no thanks"},
+		},
+		{
+			name:     "reject reason with bare CR",
+			response: `{"Action": "reject", "Reason": "no thanks\rRCPT TO:<x@example.com>"}`,
+			reply:    &smtp.ReplyLine{Code: 550, Message: "5.7.1 no thanks"},
+		},
+		{
+			name:     "tempfail",
+			response: `{"Action": "tempfail"}`,
+			reply:    &replyContentFilterTempFail,
+		},
+		{
+			name:     "unknown action",
+			response: `{"Action": "discard"}`,
+			reply:    &replyContentFilterTempFail,
+		},
+		{
+			name:     "invalid header",
+			response: `{"Action": "accept", "Headers": [{"Name": "X-Bad", "Value": "a\r\nBcc: x@example.com"}]}`,
+			reply:    &replyContentFilterTempFail,
+		},
+		{
+			name:     "invalid json",
+			response: `accept`,
+			reply:    &replyContentFilterTempFail,
+		},
+		{
+			name:     "error accepted",
+			response: `accept`,
+			onError:  ContentFilterOnErrorAccept,
+			data:     "X-Test: 1\r\nSubject: hi\r\n\r\nbody\r\n",
+		},
+	}
+	for _, c := range cases {
+		// The filter checks that it was sent the envelope before replying.
+		script := `grep -q '"Recipients":\["to@example.com"\]' && printf '%s\n' '` + c.response + `'`
+		f, err := newContentFilter(ContentFilterConfig{
+			Command:  []string{"sh", "-c", script},
+			Protocol: ContentFilterProtocolJSON,
+			Rewrite:  c.rewrite,
+			OnError:  c.onError,
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		en := smtp.Envelope{
+			ID:         "m.1",
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4321},
+			MailFrom:   mail.Address{Address: "from@sender.net"},
+			RcptTo:     []mail.Address{{Address: "to@example.com"}},
+			Data:       []byte("Subject: hi\r\n\r\nbody\r\n"),
+		}
+		en.AddHeader("X-Test", "1")
+
+		reply := f.filter(&en, zap.NewNop())
+		if c.annotate != "" && (len(en.Annotations) != 1 || en.Annotations[0].Name != c.annotate) {
+			t.Errorf("%s: want annotation %q, got %v", c.name, c.annotate, en.Annotations)
+		}
+		if c.reply != nil {
+			if reply == nil || *c.reply != *reply {
+				t.Errorf("%s: want reply %v, got %v", c.name, c.reply, reply)
+			}
+			continue
+		}
+		if reply != nil {
+			t.Errorf("%s: want accepted, got %v", c.name, reply)
+			continue
+		}
+		var stored bytes.Buffer
+		en.WriteHeaders(&stored)
+		stored.Write(en.Data)
+		if want, got := c.data, stored.String(); want != got {
+			t.Errorf("%s: want message %q, got %q", c.name, want, got)
+		}
+	}
+}
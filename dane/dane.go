@@ -0,0 +1,164 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+// Package dane authenticates SMTP servers with DNS-Based Authentication of
+// Named Entities (RFC 7672), which matches their certificates against
+// DNSSEC-signed TLSA records.
+package dane
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// TLSA certificate usages. SMTP only uses the DANE usages (RFC 7672 § 3.1).
+const (
+	UsageDANETA = 2
+	UsageDANEEE = 3
+)
+
+// TLSA selectors.
+const (
+	SelectorCert = 0
+	SelectorSPKI = 1
+)
+
+// TLSA matching types.
+const (
+	MatchingFull   = 0
+	MatchingSHA256 = 1
+	MatchingSHA512 = 2
+)
+
+// TLSA is a TLSA record (RFC 6698 § 2.1).
+type TLSA struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+// String returns the record in presentation format, like "3 1 1 ab12...".
+func (t TLSA) String() string {
+	return fmt.Sprintf("%d %d %d %s", t.Usage, t.Selector, t.MatchingType, hex.EncodeToString(t.Data))
+}
+
+func (t TLSA) usable() bool {
+	return (t.Usage == UsageDANETA || t.Usage == UsageDANEEE) &&
+		(t.Selector == SelectorCert || t.Selector == SelectorSPKI) &&
+		(t.MatchingType == MatchingFull || t.MatchingType == MatchingSHA256 || t.MatchingType == MatchingSHA512)
+}
+
+// matches reports whether |cert| is the one the record associates.
+func (t TLSA) matches(cert *x509.Certificate) bool {
+	data := cert.Raw
+	if t.Selector == SelectorSPKI {
+		data = cert.RawSubjectPublicKeyInfo
+	}
+	switch t.MatchingType {
+	case MatchingSHA256:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case MatchingSHA512:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	}
+	return bytes.Equal(data, t.Data)
+}
+
+// Usable returns the records that SMTP clients can authenticate with. If
+// records exist but none are usable, the server must still be sent mail over
+// TLS, but without authentication (RFC 7672 § 2.2).
+func Usable(records []TLSA) []TLSA {
+	var usable []TLSA
+	for _, r := range records {
+		if r.usable() {
+			usable = append(usable, r)
+		}
+	}
+	return usable
+}
+
+// ErrNoMatch is returned by Verify if no record authenticates the server.
+var ErrNoMatch = errors.New("dane: no TLSA record matches the certificate chain")
+
+// Verify authenticates the certificate chain |rawCerts| presented by the MX
+// host |host| with |records|. A DANE-EE record must match the leaf
+// certificate, whose name and validity are not checked (RFC 7672 § 3.1.1). A
+// DANE-TA record must match a certificate in the chain, or be a full
+// certificate, to which the leaf must chain and which must be valid for
+// |host|.
+func Verify(records []TLSA, host string, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return ErrNoMatch
+	}
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	leaf := certs[0]
+
+	for _, r := range records {
+		switch r.Usage {
+		case UsageDANEEE:
+			if r.matches(leaf) {
+				return nil
+			}
+		case UsageDANETA:
+			for _, anchor := range trustAnchors(r, certs) {
+				if verifyChain(anchor, certs, host) == nil {
+					return nil
+				}
+			}
+		}
+	}
+	return ErrNoMatch
+}
+
+// trustAnchors returns the certificates that the DANE-TA record |r| names.
+func trustAnchors(r TLSA, certs []*x509.Certificate) []*x509.Certificate {
+	var anchors []*x509.Certificate
+	for _, cert := range certs {
+		if r.matches(cert) {
+			anchors = append(anchors, cert)
+		}
+	}
+	// A full certificate may be a trust anchor that the server does not
+	// send.
+	if r.Selector == SelectorCert && r.MatchingType == MatchingFull {
+		if cert, err := x509.ParseCertificate(r.Data); err == nil {
+			anchors = append(anchors, cert)
+		}
+	}
+	return anchors
+}
+
+func verifyChain(anchor *x509.Certificate, certs []*x509.Certificate, host string) error {
+	roots := x509.NewCertPool()
+	roots.AddCert(anchor)
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   time.Now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
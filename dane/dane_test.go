@@ -0,0 +1,221 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package dane
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, ca bool) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  ca,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if !ca {
+		template.DNSNames = []string{name}
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestVerify(t *testing.T) {
+	ca, caKey := newCert(t, "Test CA", nil, nil, true)
+	leaf, _ := newCert(t, "mx.example.com", ca, caKey, false)
+	chain := [][]byte{leaf.Raw, ca.Raw}
+
+	spki := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	caSum := sha256.Sum256(ca.Raw)
+	wrong := sha256.Sum256([]byte("wrong"))
+
+	cases := []struct {
+		name    string
+		records []TLSA
+		host    string
+		chain   [][]byte
+		valid   bool
+	}{
+		{"EE SPKI", []TLSA{{UsageDANEEE, SelectorSPKI, MatchingSHA256, spki[:]}}, "mx.example.com", chain, true},
+		{"EE ignores name", []TLSA{{UsageDANEEE, SelectorSPKI, MatchingSHA256, spki[:]}}, "other.example.com", chain, true},
+		{"EE full", []TLSA{{UsageDANEEE, SelectorCert, MatchingFull, leaf.Raw}}, "mx.example.com", chain, true},
+		{"EE wrong", []TLSA{{UsageDANEEE, SelectorSPKI, MatchingSHA256, wrong[:]}}, "mx.example.com", chain, false},
+		{"TA", []TLSA{{UsageDANETA, SelectorCert, MatchingSHA256, caSum[:]}}, "mx.example.com", chain, true},
+		{"TA name mismatch", []TLSA{{UsageDANETA, SelectorCert, MatchingSHA256, caSum[:]}}, "other.example.com", chain, false},
+		{"TA not sent", []TLSA{{UsageDANETA, SelectorCert, MatchingFull, ca.Raw}}, "mx.example.com", [][]byte{leaf.Raw}, true},
+		{"TA leaf only", []TLSA{{UsageDANETA, SelectorCert, MatchingSHA256, caSum[:]}}, "mx.example.com", [][]byte{leaf.Raw}, false},
+		{"second record", []TLSA{
+			{UsageDANEEE, SelectorSPKI, MatchingSHA256, wrong[:]},
+			{UsageDANETA, SelectorCert, MatchingSHA256, caSum[:]},
+		}, "mx.example.com", chain, true},
+	}
+	for _, c := range cases {
+		err := Verify(c.records, c.host, c.chain)
+		if want, got := c.valid, err == nil; want != got {
+			t.Errorf("%s: want valid %v, got %v", c.name, want, err)
+		}
+	}
+}
+
+func TestUsable(t *testing.T) {
+	records := []TLSA{
+		{Usage: 0, Selector: SelectorCert, MatchingType: MatchingSHA256},
+		{Usage: 1, Selector: SelectorCert, MatchingType: MatchingSHA256},
+		{Usage: UsageDANETA, Selector: 2, MatchingType: MatchingSHA256},
+		{Usage: UsageDANEEE, Selector: SelectorSPKI, MatchingType: 3},
+		{Usage: UsageDANEEE, Selector: SelectorSPKI, MatchingType: MatchingSHA512},
+	}
+	usable := Usable(records)
+	if want, got := 1, len(usable); want != got {
+		t.Fatalf("Want %d usable record, got %d", want, got)
+	}
+	if want, got := "3 1 2 ", usable[0].String(); want != got {
+		t.Errorf("Want record %q, got %q", want, got)
+	}
+}
+
+// appendName appends |name| to |b| as uncompressed DNS labels.
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// runResolver serves |answer| for each query it receives, and returns its
+// address.
+func runResolver(t *testing.T, answer func(query []byte) []byte) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(answer(buf[:n]), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// response builds a reply to |query| with |flags| and TLSA answers with
+// |rdatas|.
+func response(query []byte, flags uint16, rdatas ...[]byte) []byte {
+	end, _ := skipName(query, 12)
+	question := query[12 : end+4]
+
+	msg := make([]byte, 12)
+	copy(msg, query[:2])
+	binary.BigEndian.PutUint16(msg[2:], flagResponse|flags)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(rdatas)))
+	msg = append(msg, question...)
+	for _, rdata := range rdatas {
+		// A pointer to the question name.
+		msg = append(msg, 0xc0, 12)
+		var rr [10]byte
+		binary.BigEndian.PutUint16(rr[0:], uint16(typeTLSA))
+		binary.BigEndian.PutUint16(rr[2:], 1)
+		binary.BigEndian.PutUint32(rr[4:], 300)
+		binary.BigEndian.PutUint16(rr[8:], uint16(len(rdata)))
+		msg = append(msg, rr[:]...)
+		msg = append(msg, rdata...)
+	}
+	return msg
+}
+
+func TestLookupTLSA(t *testing.T) {
+	addr := runResolver(t, func(query []byte) []byte {
+		end, _ := skipName(query, 12)
+		switch string(query[12:end]) {
+		case string(appendName(nil, "_25._tcp.mx.secure.net")):
+			return response(query, flagAuthentic, []byte{3, 1, 1, 0xab, 0xcd}, []byte{2, 0, 1, 0xef})
+		case string(appendName(nil, "_25._tcp.mx.insecure.net")):
+			return response(query, 0, []byte{3, 1, 1, 0xab, 0xcd})
+		case string(appendName(nil, "secure.net")):
+			return response(query, flagAuthentic)
+		}
+		return response(query, flagAuthentic|rcodeNameError)
+	})
+	r := &Resolver{Addr: addr}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	records, err := r.LookupTLSA(ctx, "mx.secure.net", "25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(records); want != got {
+		t.Fatalf("Want %d records, got %d", want, got)
+	}
+	if want, got := "3 1 1 abcd", records[0].String(); want != got {
+		t.Errorf("Want record %q, got %q", want, got)
+	}
+	if want, got := "2 0 1 ef", records[1].String(); want != got {
+		t.Errorf("Want record %q, got %q", want, got)
+	}
+
+	// Records without the AD flag are ignored.
+	if records, err = r.LookupTLSA(ctx, "mx.insecure.net", "25"); err != nil || records != nil {
+		t.Errorf("Want no records, got %v, %v", records, err)
+	}
+	if records, err = r.LookupTLSA(ctx, "mx.missing.net", "25"); err != nil || records != nil {
+		t.Errorf("Want no records, got %v, %v", records, err)
+	}
+
+	if secure, err := r.SecureMX(ctx, "secure.net"); err != nil || !secure {
+		t.Errorf("Want secure MX, got %v, %v", secure, err)
+	}
+}
+
+func TestLookupTLSAFailure(t *testing.T) {
+	addr := runResolver(t, func(query []byte) []byte {
+		// SERVFAIL, as for a bogus signature.
+		return response(query, 2)
+	})
+	r := &Resolver{Addr: addr}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := r.LookupTLSA(ctx, "mx.bogus.net", "25"); err == nil {
+		t.Errorf("Expected error for SERVFAIL")
+	}
+}
@@ -0,0 +1,248 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package dane
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	typeTLSA = dnsmessage.Type(52)
+
+	// udpSize is the EDNS0 payload size advertised, which avoids
+	// fragmentation.
+	udpSize = 1232
+
+	// Header flag bits.
+	flagResponse  = 1 << 15
+	flagTruncated = 1 << 9
+	flagAuthentic = 1 << 5
+
+	rcodeNameError = 3
+)
+
+// Resolver looks up records with a DNSSEC-validating recursive resolver, and
+// trusts its AD (authentic data) flag. The resolver should be on the same
+// host, or reached over a trusted network, since the flag is not itself
+// authenticated.
+type Resolver struct {
+	// Addr is the host:port of the resolver.
+	Addr string
+}
+
+// SecureMX reports whether the MX records of |domain|, or their absence, are
+// DNSSEC-signed. DANE only applies to the MX hosts of domains whose MX
+// records are (RFC 7672 § 2.2.1).
+func (r *Resolver) SecureMX(ctx context.Context, domain string) (bool, error) {
+	_, authentic, err := r.query(ctx, domain, dnsmessage.TypeMX)
+	return authentic, err
+}
+
+// LookupTLSA returns the TLSA records of the SMTP server at |host|:|port|.
+// They are nil if there are none, or if they are not DNSSEC-signed.
+func (r *Resolver) LookupTLSA(ctx context.Context, host, port string) ([]TLSA, error) {
+	rdatas, authentic, err := r.query(ctx, fmt.Sprintf("_%s._tcp.%s", port, host), typeTLSA)
+	if err != nil || !authentic {
+		return nil, err
+	}
+	var records []TLSA
+	for _, rdata := range rdatas {
+		if len(rdata) < 3 {
+			return nil, errors.New("dane: malformed TLSA record")
+		}
+		records = append(records, TLSA{
+			Usage:        rdata[0],
+			Selector:     rdata[1],
+			MatchingType: rdata[2],
+			Data:         rdata[3:],
+		})
+	}
+	return records, nil
+}
+
+// query looks up the records of |name| with type |qtype|. It returns their
+// data, and whether the resolver validated the answer. A name that does not
+// exist has no records.
+func (r *Resolver) query(ctx context.Context, name string, qtype dnsmessage.Type) ([][]byte, bool, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, false, err
+	}
+
+	id := uint16(rand.Uint32())
+	query, err := buildQuery(id, qname, qtype)
+	if err != nil {
+		return nil, false, err
+	}
+
+	resp, err := r.exchange(ctx, "udp", query)
+	if err == nil && binary.BigEndian.Uint16(resp[2:])&flagTruncated != 0 {
+		resp, err = r.exchange(ctx, "tcp", query)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return parseResponse(resp, id, qtype)
+}
+
+// buildQuery returns a query for the records of |name| with type |qtype|,
+// with the DO bit set to ask for DNSSEC validation.
+func buildQuery(id uint16, name dnsmessage.Name, qtype dnsmessage.Type) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(udpSize, dnsmessage.RCodeSuccess, true); err != nil {
+		return nil, err
+	}
+	if err := b.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// exchange sends |query| to the resolver over |network| and returns the
+// response.
+func (r *Resolver) exchange(ctx context.Context, network string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, r.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		resp := make([]byte, udpSize)
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, err
+		}
+		if n < 12 {
+			return nil, errMalformed
+		}
+		return resp[:n], nil
+	}
+
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	if len(resp) < 12 {
+		return nil, errMalformed
+	}
+	return resp, nil
+}
+
+var errMalformed = errors.New("dane: malformed DNS response")
+
+// parseResponse returns the data of the answers with type |qtype| in the
+// DNS message |msg|, and whether it has the AD flag.
+func parseResponse(msg []byte, id uint16, qtype dnsmessage.Type) ([][]byte, bool, error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg) != id {
+		return nil, false, errMalformed
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&flagResponse == 0 {
+		return nil, false, errMalformed
+	}
+	authentic := flags&flagAuthentic != 0
+	switch rcode := flags & 0xf; rcode {
+	case 0:
+	case rcodeNameError:
+		return nil, authentic, nil
+	default:
+		return nil, false, fmt.Errorf("dane: DNS query failed with %v", dnsmessage.RCode(rcode))
+	}
+
+	qdcount := binary.BigEndian.Uint16(msg[4:])
+	ancount := binary.BigEndian.Uint16(msg[6:])
+	off := 12
+	var err error
+	for i := 0; i < int(qdcount); i++ {
+		if off, err = skipName(msg, off); err != nil {
+			return nil, false, err
+		}
+		off += 4 // Type and class.
+	}
+
+	var rdatas [][]byte
+	for i := 0; i < int(ancount); i++ {
+		if off, err = skipName(msg, off); err != nil {
+			return nil, false, err
+		}
+		// Type, class, TTL, and data length.
+		if off+10 > len(msg) {
+			return nil, false, errMalformed
+		}
+		rtype := dnsmessage.Type(binary.BigEndian.Uint16(msg[off:]))
+		length := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+length > len(msg) {
+			return nil, false, errMalformed
+		}
+		if rtype == qtype {
+			rdatas = append(rdatas, msg[off:off+length])
+		}
+		off += length
+	}
+	return rdatas, authentic, nil
+}
+
+// skipName returns the offset after the domain name at |off| in |msg|.
+func skipName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errMalformed
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			return off + 1, nil
+		case length&0xc0 == 0xc0:
+			// A compression pointer ends the name.
+			return off + 2, nil
+		case length&0xc0 != 0:
+			return 0, errMalformed
+		}
+		off += 1 + length
+	}
+}
@@ -0,0 +1,454 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+// Package dkim verifies and signs DomainKeys Identified Mail signatures (RFC
+// 6376), with the RSA and Ed25519 (RFC 8463) algorithms.
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"src.bluestatic.org/mailpopbox/message"
+	"src.bluestatic.org/mailpopbox/resolver"
+)
+
+// Status is the verdict for a signature, as named in an
+// Authentication-Results header (RFC 8601).
+type Status string
+
+const (
+	StatusNone      Status = "none"
+	StatusPass      Status = "pass"
+	StatusFail      Status = "fail"
+	StatusTempError Status = "temperror"
+	StatusPermError Status = "permerror"
+)
+
+// MaxSignatures is the most signatures on a message that are verified.
+const MaxSignatures = 5
+
+// Result is the outcome of verifying one signature.
+type Result struct {
+	Status Status
+	// Domain and Selector are the d= and s= tags of the signature.
+	Domain   string `json:",omitempty"`
+	Selector string `json:",omitempty"`
+	// Signature is the start of the b= tag, which identifies the signature
+	// when there are several from one domain.
+	Signature string `json:",omitempty"`
+	// Reason explains a status other than pass.
+	Reason string `json:",omitempty"`
+}
+
+// Verify checks the DKIM signatures of the message |data| at |now|, looking
+// up keys with |lookup|. It returns a Result for each signature, which is
+// empty if the message is not signed.
+func Verify(ctx context.Context, data []byte, lookup resolver.LookupTXT, now time.Time) []Result {
+	header, body := message.Parse(data)
+
+	var results []Result
+	for i, f := range header.Fields {
+		if !strings.EqualFold(f.Name, "DKIM-Signature") {
+			continue
+		}
+		if len(results) == MaxSignatures {
+			break
+		}
+		results = append(results, verifySignature(ctx, header, i, body, lookup, now))
+	}
+	return results
+}
+
+// failure is an error that determines the Status of a Result.
+type failure struct {
+	status Status
+	reason string
+}
+
+func (f *failure) Error() string {
+	return string(f.status) + ": " + f.reason
+}
+
+func permError(format string, args ...interface{}) error {
+	return &failure{StatusPermError, fmt.Sprintf(format, args...)}
+}
+
+func verifySignature(ctx context.Context, header *message.Header, index int, body []byte, lookup resolver.LookupTXT, now time.Time) Result {
+	var r Result
+	err := func() error {
+		sig, err := parseSignature(header.Fields[index].Value())
+		if err != nil {
+			return err
+		}
+		r.Domain, r.Selector = sig.domain, sig.selector
+		r.Signature = sig.tags["b"]
+		if len(r.Signature) > 8 {
+			r.Signature = r.Signature[:8]
+		}
+
+		if sig.expires != nil && now.After(*sig.expires) {
+			return permError("signature expired")
+		}
+
+		key, err := lookupKey(ctx, lookup, sig)
+		if err != nil {
+			return err
+		}
+
+		h := sig.hash.New()
+		canonicalBody(h, body, sig.relaxedBody, sig.length)
+		if subtle.ConstantTimeCompare(h.Sum(nil), sig.bodyHash) != 1 {
+			return &failure{StatusFail, "body hash did not verify"}
+		}
+
+		h = sig.hash.New()
+		for _, f := range selectFields(header, sig.headers) {
+			h.Write(canonicalField(f.Raw, sig.relaxedHeader))
+		}
+		self := canonicalField(stripSignature(header.Fields[index].Raw), sig.relaxedHeader)
+		h.Write(bytes.TrimSuffix(self, []byte("\r\n")))
+		hashed := h.Sum(nil)
+
+		switch pub := key.(type) {
+		case *rsa.PublicKey:
+			err = rsa.VerifyPKCS1v15(pub, sig.hash, hashed, sig.signature)
+		case ed25519.PublicKey:
+			if !ed25519.Verify(pub, hashed, sig.signature) {
+				err = errors.New("invalid")
+			}
+		}
+		if err != nil {
+			return &failure{StatusFail, "signature did not verify"}
+		}
+		return nil
+	}()
+
+	r.Status = StatusPass
+	if err != nil {
+		f, ok := err.(*failure)
+		if !ok {
+			f = &failure{StatusPermError, err.Error()}
+		}
+		r.Status, r.Reason = f.status, f.reason
+	}
+	return r
+}
+
+// signature is a parsed DKIM-Signature header.
+type signature struct {
+	tags map[string]string
+
+	keyType       string
+	hash          crypto.Hash
+	relaxedHeader bool
+	relaxedBody   bool
+	domain        string
+	selector      string
+	headers       []string
+	bodyHash      []byte
+	signature     []byte
+	length        int64 // -1 if the whole body is signed.
+	expires       *time.Time
+}
+
+func parseSignature(value string) (*signature, error) {
+	tags, err := parseTags(value)
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[tag]; !ok {
+			return nil, permError("missing %s= tag", tag)
+		}
+	}
+	if tags["v"] != "1" {
+		return nil, permError("unsupported version %q", tags["v"])
+	}
+
+	sig := &signature{
+		tags:     tags,
+		domain:   strings.ToLower(tags["d"]),
+		selector: tags["s"],
+		length:   -1,
+	}
+
+	switch strings.ToLower(tags["a"]) {
+	case "rsa-sha256":
+		sig.keyType, sig.hash = "rsa", crypto.SHA256
+	case "rsa-sha1":
+		sig.keyType, sig.hash = "rsa", crypto.SHA1
+	case "ed25519-sha256":
+		sig.keyType, sig.hash = "ed25519", crypto.SHA256
+	default:
+		return nil, permError("unsupported algorithm %q", tags["a"])
+	}
+
+	if c, ok := tags["c"]; ok {
+		parts := strings.SplitN(strings.ToLower(c), "/", 2)
+		if len(parts) == 1 {
+			parts = append(parts, "simple")
+		}
+		for i, relaxed := range []*bool{&sig.relaxedHeader, &sig.relaxedBody} {
+			switch parts[i] {
+			case "relaxed":
+				*relaxed = true
+			case "simple":
+			default:
+				return nil, permError("unsupported canonicalization %q", c)
+			}
+		}
+	}
+
+	for _, name := range strings.Split(tags["h"], ":") {
+		sig.headers = append(sig.headers, strings.TrimSpace(name))
+	}
+	hasFrom := false
+	for _, name := range sig.headers {
+		hasFrom = hasFrom || strings.EqualFold(name, "From")
+	}
+	if !hasFrom {
+		return nil, permError("From field not signed")
+	}
+
+	if i, ok := tags["i"]; ok {
+		at := strings.LastIndexByte(i, '@')
+		idomain := strings.ToLower(i[at+1:])
+		if at == -1 || (idomain != sig.domain && !strings.HasSuffix(idomain, "."+sig.domain)) {
+			return nil, permError("i= tag does not match domain")
+		}
+	}
+
+	if sig.bodyHash, err = base64.StdEncoding.DecodeString(tags["bh"]); err != nil {
+		return nil, permError("invalid bh= tag")
+	}
+	if sig.signature, err = base64.StdEncoding.DecodeString(tags["b"]); err != nil {
+		return nil, permError("invalid b= tag")
+	}
+	if l, ok := tags["l"]; ok {
+		if sig.length, err = strconv.ParseInt(l, 10, 64); err != nil || sig.length < 0 {
+			return nil, permError("invalid l= tag")
+		}
+	}
+	if x, ok := tags["x"]; ok {
+		secs, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return nil, permError("invalid x= tag")
+		}
+		expires := time.Unix(secs, 0)
+		sig.expires = &expires
+	}
+	return sig, nil
+}
+
+// parseTags parses a tag-list (RFC 6376 § 3.2). Whitespace is removed from
+// the values, which is where it is insignificant for every tag used here.
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, spec := range strings.Split(s, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		kv := strings.SplitN(spec, "=", 2)
+		if len(kv) != 2 {
+			return nil, permError("malformed tag %q", spec)
+		}
+		name := strings.TrimSpace(kv[0])
+		if _, ok := tags[name]; ok {
+			return nil, permError("duplicate tag %q", name)
+		}
+		tags[name] = strings.Join(strings.Fields(kv[1]), "")
+	}
+	return tags, nil
+}
+
+// lookupKey fetches the public key for |sig| from DNS.
+func lookupKey(ctx context.Context, lookup resolver.LookupTXT, sig *signature) (crypto.PublicKey, error) {
+	name := sig.selector + "._domainkey." + sig.domain
+	records, err := lookup(ctx, name)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, permError("no key for signature")
+		}
+		return nil, &failure{StatusTempError, "key unavailable"}
+	}
+	if len(records) == 0 {
+		return nil, permError("no key for signature")
+	}
+
+	tags, err := parseTags(records[0])
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, permError("unsupported key version %q", v)
+	}
+	keyType := "rsa"
+	if k, ok := tags["k"]; ok {
+		keyType = strings.ToLower(k)
+	}
+	if keyType != sig.keyType {
+		return nil, permError("key type %q does not match algorithm", keyType)
+	}
+	if h, ok := tags["h"]; ok {
+		want := strings.ToLower(strings.TrimPrefix(sig.hash.String(), "SHA-"))
+		if !strings.Contains(":"+strings.ToLower(h)+":", ":sha"+want+":") {
+			return nil, permError("hash algorithm not allowed by key")
+		}
+	}
+
+	p, ok := tags["p"]
+	if !ok {
+		return nil, permError("key has no p= tag")
+	}
+	if p == "" {
+		return nil, permError("key revoked")
+	}
+	der, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, permError("invalid key encoding")
+	}
+
+	if keyType == "ed25519" {
+		if len(der) != ed25519.PublicKeySize {
+			return nil, permError("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(der), nil
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		if pub, err = x509.ParsePKCS1PublicKey(der); err != nil {
+			return nil, permError("invalid RSA key")
+		}
+	}
+	rsaKey, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, permError("key is not RSA")
+	}
+	if rsaKey.N.BitLen() < 1024 {
+		return nil, permError("RSA key too short")
+	}
+	return rsaKey, nil
+}
+
+// selectFields returns the header fields named in |names|, which are taken
+// from the bottom of the header up when a name repeats. A name with no
+// remaining field selects nothing.
+func selectFields(header *message.Header, names []string) []message.Field {
+	used := make(map[int]bool)
+	var fields []message.Field
+	for _, name := range names {
+		for i := len(header.Fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(header.Fields[i].Name, name) {
+				used[i] = true
+				fields = append(fields, header.Fields[i])
+				break
+			}
+		}
+	}
+	return fields
+}
+
+// bTagRe matches the value of the b= tag in a DKIM-Signature, but not bh=.
+var bTagRe = regexp.MustCompile(`([:;]\s*b\s*=)[^;]*`)
+
+// stripSignature removes the value of the b= tag from the raw DKIM-Signature
+// field |raw|, which is how it is included in its own hash.
+func stripSignature(raw []byte) []byte {
+	return bTagRe.ReplaceAll(raw, []byte("$1"))
+}
+
+// lines splits |data| into lines without their CRLF or LF endings. Messages
+// are stored with either, but DKIM is computed over CRLF.
+func lines(data []byte) [][]byte {
+	if len(data) == 0 {
+		return nil
+	}
+	split := bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+	for i, line := range split {
+		split[i] = bytes.TrimSuffix(line, []byte("\r"))
+	}
+	return split
+}
+
+// compressWSP replaces each run of spaces and tabs in |b| with one space.
+func compressWSP(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	inWSP := false
+	for _, c := range b {
+		if c == ' ' || c == '\t' {
+			if !inWSP {
+				out = append(out, ' ')
+			}
+			inWSP = true
+			continue
+		}
+		inWSP = false
+		out = append(out, c)
+	}
+	return out
+}
+
+// canonicalField returns the canonical form of the raw header field |raw|,
+// ending in CRLF.
+func canonicalField(raw []byte, relaxed bool) []byte {
+	if !relaxed {
+		return append(bytes.Join(lines(raw), []byte("\r\n")), "\r\n"...)
+	}
+	unfolded := bytes.Join(lines(raw), nil)
+	colon := bytes.IndexByte(unfolded, ':')
+	if colon == -1 {
+		return append(unfolded, "\r\n"...)
+	}
+	name := bytes.ToLower(bytes.TrimRight(unfolded[:colon], " \t"))
+	value := bytes.Trim(compressWSP(unfolded[colon+1:]), " ")
+	out := append(name, ':')
+	out = append(out, value...)
+	return append(out, "\r\n"...)
+}
+
+// canonicalBody writes the canonical form of |body| to |h|, limited to
+// |length| bytes if it is not negative.
+func canonicalBody(h hash.Hash, body []byte, relaxed bool, length int64) {
+	bodyLines := lines(body)
+	if relaxed {
+		for i, line := range bodyLines {
+			bodyLines[i] = bytes.TrimRight(compressWSP(line), " ")
+		}
+	}
+	for len(bodyLines) > 0 && len(bodyLines[len(bodyLines)-1]) == 0 {
+		bodyLines = bodyLines[:len(bodyLines)-1]
+	}
+
+	var canonical []byte
+	for _, line := range bodyLines {
+		canonical = append(canonical, line...)
+		canonical = append(canonical, "\r\n"...)
+	}
+	if len(canonical) == 0 && !relaxed {
+		canonical = []byte("\r\n")
+	}
+	if length >= 0 && int64(len(canonical)) > length {
+		canonical = canonical[:length]
+	}
+	h.Write(canonical)
+}
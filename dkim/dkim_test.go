@@ -0,0 +1,170 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"src.bluestatic.org/mailpopbox/resolver"
+)
+
+// The example from RFC 8463 Appendix A, which is signed with both algorithms.
+const rfc8463Message = `DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;
+ d=football.example.com; i=@football.example.com;
+ q=dns/txt; s=brisbane; t=1528637909; h=from : to :
+ subject : date : message-id : from : subject : date;
+ bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;
+ b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus
+ Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==
+DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed;
+ d=football.example.com; i=@football.example.com;
+ q=dns/txt; s=test; t=1528637909; h=from : to : subject :
+ date : message-id : from : subject : date;
+ bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;
+ b=F45dVWDfMbQDGHJFlXUNB2HKfbCeLRyhDXgFpEL8GwpsRe0IeIixNTe3
+ DhCVlUrSjV4BwcVcOF6+FF3Zo9Rpo1tFOeS9mPYQTnGdaSGsgeefOsk2Jz
+ dA+L10TeYt9BgDfQNZtKdN1WO//KgIqXP7OdEFE4LjFYNcUxZQ4FADY+8=
+From: Joe SixPack <joe@football.example.com>
+To: Suzie Q <suzie@shopping.example.net>
+Subject: Is dinner ready?
+Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)
+Message-ID: <20030712040037.46341.5F8J@football.example.com>
+
+Hi.
+
+We lost the game.  Are you hungry yet?
+
+Joe.
+`
+
+var rfc8463Keys = map[string]string{
+	"brisbane._domainkey.football.example.com": "v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=",
+	"test._domainkey.football.example.com":     "v=DKIM1; k=rsa; p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQDkHlOQoBTzWRiGs5V6NpP3idY6Wk08a5qhdR6wy5bdOKb2jLQiY/J16JYi0Qvx/byYzCNb3W91y3FutACDfzwQ/BC/e/8uBsCR+yz1Lxj+PL6lHvqMKrM3rG4hstT5QjvHO9PzoxZyVYLzBfO2EeC3Ip3G+2kryOTIKT+l/K4w3QIDAQAB",
+}
+
+func lookupKeys(keys map[string]string) resolver.LookupTXT {
+	return func(ctx context.Context, name string) ([]string, error) {
+		if key, ok := keys[name]; ok {
+			return []string{key}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+}
+
+var now = time.Date(2020, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+func TestVerify(t *testing.T) {
+	for _, eol := range []string{"\n", "\r\n"} {
+		data := strings.ReplaceAll(rfc8463Message, "\n", eol)
+		results := Verify(context.Background(), []byte(data), lookupKeys(rfc8463Keys), now)
+		if want, got := 2, len(results); want != got {
+			t.Fatalf("Want %d results, got %v", want, results)
+		}
+		for i, selector := range []string{"brisbane", "test"} {
+			r := results[i]
+			if r.Status != StatusPass || r.Domain != "football.example.com" || r.Selector != selector {
+				t.Errorf("Want pass for %s, got %+v", selector, r)
+			}
+		}
+	}
+	if want, got := "/gCrinpc", Verify(context.Background(), []byte(rfc8463Message), lookupKeys(rfc8463Keys), now)[0].Signature; want != got {
+		t.Errorf("Want signature %q, got %q", want, got)
+	}
+}
+
+func TestVerifyFailures(t *testing.T) {
+	temp := func(ctx context.Context, name string) ([]string, error) {
+		return nil, errors.New("timeout")
+	}
+	revoked := map[string]string{
+		"brisbane._domainkey.football.example.com": "v=DKIM1; k=ed25519; p=",
+		"test._domainkey.football.example.com":     rfc8463Keys["test._domainkey.football.example.com"],
+	}
+
+	cases := []struct {
+		name   string
+		data   string
+		lookup resolver.LookupTXT
+		status Status
+		reason string
+	}{
+		{"body changed", strings.Replace(rfc8463Message, "hungry", "thirsty", 1), lookupKeys(rfc8463Keys), StatusFail, "body hash did not verify"},
+		{"header changed", strings.Replace(rfc8463Message, "dinner", "lunch", 1), lookupKeys(rfc8463Keys), StatusFail, "signature did not verify"},
+		{"whitespace", strings.Replace(rfc8463Message, "Subject: Is dinner", "Subject:  Is  dinner", 1), lookupKeys(rfc8463Keys), StatusPass, ""},
+		{"no key", rfc8463Message, lookupKeys(nil), StatusPermError, "no key for signature"},
+		{"dns failure", rfc8463Message, temp, StatusTempError, "key unavailable"},
+		{"revoked", rfc8463Message, lookupKeys(revoked), StatusPermError, "key revoked"},
+		{"expired", strings.Replace(rfc8463Message, "t=1528637909;", "t=1528637909; x=1528638000;", 1), lookupKeys(rfc8463Keys), StatusPermError, "signature expired"},
+		{"unsigned From", strings.Replace(rfc8463Message, "h=from : to :\n subject : date : message-id : from : subject : date", "h=to : subject", 1), lookupKeys(rfc8463Keys), StatusPermError, "From field not signed"},
+		{"algorithm", strings.Replace(rfc8463Message, "a=ed25519-sha256", "a=dsa-sha256", 1), lookupKeys(rfc8463Keys), StatusPermError, `unsupported algorithm "dsa-sha256"`},
+	}
+	for _, c := range cases {
+		results := Verify(context.Background(), []byte(c.data), c.lookup, now)
+		if len(results) != 2 {
+			t.Errorf("%s: want 2 results, got %v", c.name, results)
+			continue
+		}
+		if want, got := c.status, results[0].Status; want != got {
+			t.Errorf("%s: want status %q, got %q (%s)", c.name, want, got, results[0].Reason)
+		}
+		if want, got := c.reason, results[0].Reason; want != got {
+			t.Errorf("%s: want reason %q, got %q", c.name, want, got)
+		}
+	}
+
+	if results := Verify(context.Background(), []byte("Subject: unsigned\n\nbody\n"), lookupKeys(nil), now); len(results) != 0 {
+		t.Errorf("Want no results for unsigned message, got %v", results)
+	}
+}
+
+func TestCanonicalBody(t *testing.T) {
+	cases := []struct {
+		body    string
+		relaxed bool
+		length  int64
+		want    string
+	}{
+		{"", false, -1, "\r\n"},
+		{"", true, -1, ""},
+		{"a \t b \r\n\r\n\r\n", false, -1, "a \t b \r\n"},
+		{"a \t b \r\n\r\n\r\n", true, -1, "a b\r\n"},
+		{" c\n\nd\n", true, -1, " c\r\n\r\nd\r\n"},
+		{"hello\r\nworld\r\n", false, 7, "hello\r\n"},
+	}
+	for _, c := range cases {
+		h := &recorder{}
+		canonicalBody(h, []byte(c.body), c.relaxed, c.length)
+		if want, got := c.want, h.String(); want != got {
+			t.Errorf("%q (relaxed=%v): want %q, got %q", c.body, c.relaxed, want, got)
+		}
+	}
+}
+
+func TestCanonicalField(t *testing.T) {
+	raw := "Subject :  Hello \r\n\tWorld  \r\n"
+	if want, got := "Subject :  Hello \r\n\tWorld  \r\n", string(canonicalField([]byte(raw), false)); want != got {
+		t.Errorf("Simple: want %q, got %q", want, got)
+	}
+	if want, got := "subject:Hello World\r\n", string(canonicalField([]byte(raw), true)); want != got {
+		t.Errorf("Relaxed: want %q, got %q", want, got)
+	}
+}
+
+// recorder is a hash.Hash that keeps what is written to it.
+type recorder struct {
+	bytes.Buffer
+}
+
+func (r *recorder) Sum(b []byte) []byte { return append(b, r.Bytes()...) }
+func (r *recorder) Size() int           { return r.Len() }
+func (r *recorder) BlockSize() int      { return 1 }
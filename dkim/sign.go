@@ -0,0 +1,182 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"src.bluestatic.org/mailpopbox/message"
+)
+
+// DefaultSignedFields are the header fields signed by a Signer without its
+// own list, when the message has them.
+var DefaultSignedFields = []string{
+	"From", "Reply-To", "To", "Cc", "Subject", "Date", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+// Signer signs messages for a domain, with relaxed canonicalization of the
+// header and body and the SHA-256 hash.
+type Signer struct {
+	// Domain and Selector are the d= and s= tags. The public key is
+	// published at selector._domainkey.domain.
+	Domain   string
+	Selector string
+
+	// Key is an *rsa.PrivateKey or an ed25519.PrivateKey.
+	Key crypto.Signer
+
+	// Fields are the names of the header fields to sign. If nil,
+	// DefaultSignedFields are.
+	Fields []string
+}
+
+// ParsePrivateKey parses a PEM-encoded RSA or Ed25519 private key, in PKCS #8
+// or, for RSA, PKCS #1 form.
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", key)
+}
+
+// algorithm returns the a= tag for the key of |s|.
+func (s *Signer) algorithm() (string, error) {
+	switch key := s.Key.(type) {
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < 1024 {
+			return "", errors.New("RSA key too short")
+		}
+		return "rsa-sha256", nil
+	case ed25519.PrivateKey:
+		return "ed25519-sha256", nil
+	}
+	return "", fmt.Errorf("unsupported key type %T", s.Key)
+}
+
+// Sign returns a DKIM-Signature header field for the message |data|, signed
+// at |now|, to be prepended to the message. The field ends with the same
+// line ending as the message's header.
+func (s *Signer) Sign(data []byte, now time.Time) ([]byte, error) {
+	alg, err := s.algorithm()
+	if err != nil {
+		return nil, err
+	}
+	header, body := message.Parse(data)
+	eol := header.EOL
+
+	h := sha256.New()
+	canonicalBody(h, body, true, -1)
+	bodyHash := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+	// Each occurrence of a field is signed, so that another cannot be added
+	// above it without breaking the signature.
+	names := s.Fields
+	if names == nil {
+		names = DefaultSignedFields
+	}
+	var signed []string
+	for _, name := range names {
+		for range header.Values(name) {
+			signed = append(signed, name)
+		}
+	}
+	if header.Index("From") == -1 {
+		return nil, errors.New("message has no From field")
+	}
+
+	// The h= list is folded after its colons to keep the lines short.
+	hTag := "h="
+	line := len("\th=")
+	for i, name := range signed {
+		if i > 0 {
+			hTag += ":"
+			line++
+			if line+len(name) > 76 {
+				hTag += eol + "\t"
+				line = 1
+			}
+		}
+		hTag += name
+		line += len(name)
+	}
+
+	raw := fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=relaxed/relaxed;%s\td=%s; s=%s; t=%d;%s\t%s;%s\tbh=%s;%s\tb=",
+		alg, eol,
+		s.Domain, s.Selector, now.Unix(), eol,
+		hTag, eol,
+		bodyHash, eol)
+
+	h = sha256.New()
+	for _, f := range selectFields(header, signed) {
+		h.Write(canonicalField(f.Raw, true))
+	}
+	self := canonicalField([]byte(raw+eol), true)
+	h.Write(self[:len(self)-len("\r\n")])
+
+	opts := crypto.Hash(crypto.SHA256)
+	if alg == "ed25519-sha256" {
+		// Ed25519 signs the hash itself, rather than a digest of it (RFC
+		// 8463 § 3).
+		opts = crypto.Hash(0)
+	}
+	sig, err := s.Key.Sign(rand.Reader, h.Sum(nil), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	field := []byte(raw)
+	b := base64.StdEncoding.EncodeToString(sig)
+	for len(b) > 72 {
+		field = append(field, b[:72]...)
+		field = append(field, eol+"\t"...)
+		b = b[72:]
+	}
+	field = append(field, b...)
+	return append(field, eol...), nil
+}
+
+// TXTRecord returns the DNS TXT record that publishes the public key of |s|.
+func (s *Signer) TXTRecord() (string, error) {
+	switch key := s.Key.(type) {
+	case *rsa.PrivateKey:
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			return "", err
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	case ed25519.PrivateKey:
+		pub := key.Public().(ed25519.PublicKey)
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub), nil
+	}
+	return "", fmt.Errorf("unsupported key type %T", s.Key)
+}
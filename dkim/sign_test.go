@@ -0,0 +1,103 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+)
+
+// unsignedMessage is rfc8463Message without its signatures.
+var unsignedMessage = rfc8463Message[strings.Index(rfc8463Message, "From:"):]
+
+func TestSign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []crypto.Signer{rsaKey, edKey} {
+		// Each field is listed twice, so the h= tag is long enough to fold.
+		s := &Signer{Domain: "football.example.com", Selector: "test", Key: key, Fields: append(DefaultSignedFields, DefaultSignedFields...)}
+		record, err := s.TXTRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := map[string]string{"test._domainkey.football.example.com": record}
+
+		for _, eol := range []string{"\n", "\r\n"} {
+			data := []byte(strings.ReplaceAll(unsignedMessage, "\n", eol))
+			field, err := s.Sign(data, now)
+			if err != nil {
+				t.Fatalf("%T: %v", key, err)
+			}
+			if !strings.HasSuffix(string(field), eol) || strings.Contains(strings.ReplaceAll(string(field), eol, ""), "\n") {
+				t.Errorf("%T: field has mixed line endings: %q", key, field)
+			}
+			for _, line := range strings.Split(string(field), eol) {
+				if len(line) > 78 {
+					t.Errorf("%T: line too long: %q", key, line)
+				}
+			}
+
+			signed := append(field, data...)
+			results := Verify(context.Background(), signed, lookupKeys(keys), now)
+			if len(results) != 1 || results[0].Status != StatusPass {
+				t.Errorf("%T: want pass, got %+v\n%s", key, results, signed)
+			}
+
+			tampered := []byte(strings.Replace(string(signed), "We lost", "We won", 1))
+			results = Verify(context.Background(), tampered, lookupKeys(keys), now)
+			if len(results) != 1 || results[0].Status != StatusFail {
+				t.Errorf("%T: want fail for tampered message, got %+v", key, results)
+			}
+		}
+	}
+
+	s := &Signer{Domain: "football.example.com", Selector: "test", Key: edKey}
+	if _, err := s.Sign([]byte("Subject: no from\r\n\r\nbody\r\n"), now); err == nil {
+		t.Errorf("Want error signing a message without From")
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, block := range []*pem.Block{
+		{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)},
+		{Type: "PRIVATE KEY", Bytes: pkcs8},
+	} {
+		if _, err := ParsePrivateKey(pem.EncodeToMemory(block)); err != nil {
+			t.Errorf("%s: %v", block.Type, err)
+		}
+	}
+	if _, err := ParsePrivateKey([]byte("not a key")); err == nil {
+		t.Errorf("Want error for invalid key")
+	}
+}
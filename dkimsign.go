@@ -0,0 +1,104 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/dkim"
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+// DKIMSigningConfig signs the messages relayed from a Server's domain with
+// DKIM, so that they pass DMARC at their recipients.
+type DKIMSigningConfig struct {
+	// Selector is the s= tag of the signatures. The public key must be
+	// published in a TXT record at selector._domainkey.domain.
+	Selector string
+
+	// KeyPath is a PEM file with the RSA or Ed25519 private key.
+	KeyPath string
+}
+
+// loadDKIMSigners reads the signing key of each Server with a DKIMSigning
+// config, and returns the signers keyed by domain.
+func loadDKIMSigners(servers []Server) (map[string]*dkim.Signer, error) {
+	signers := make(map[string]*dkim.Signer)
+	for _, s := range servers {
+		c := s.DKIMSigning
+		if c == nil {
+			continue
+		}
+		if c.Selector == "" {
+			return nil, fmt.Errorf("%s: DKIMSigning: missing Selector", s.Domain)
+		}
+		data, err := ioutil.ReadFile(c.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("%s: DKIMSigning: %v", s.Domain, err)
+		}
+		key, err := dkim.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: DKIMSigning KeyPath: %v", s.Domain, err)
+		}
+		signer := &dkim.Signer{Domain: s.Domain, Selector: c.Selector, Key: key}
+		if _, err := signer.TXTRecord(); err != nil {
+			return nil, fmt.Errorf("%s: DKIMSigning KeyPath: %v", s.Domain, err)
+		}
+		signers[s.Domain] = signer
+	}
+	return signers, nil
+}
+
+// validateRelaySourceIPs checks the RelaySourceIP of |config| and each of its
+// Servers.
+func validateRelaySourceIPs(config Config) error {
+	if ip := config.RelaySourceIP; ip != "" && net.ParseIP(ip) == nil {
+		return fmt.Errorf("RelaySourceIP: invalid address %q", ip)
+	}
+	for _, s := range config.Servers {
+		if ip := s.RelaySourceIP; ip != "" && net.ParseIP(ip) == nil {
+			return fmt.Errorf("%s: RelaySourceIP: invalid address %q", s.Domain, ip)
+		}
+	}
+	return nil
+}
+
+// RelaySourceIP returns the configured address to relay messages from the
+// domain of |en| from, or nil to let the system choose.
+func (server *smtpServer) RelaySourceIP(en smtp.Envelope) net.IP {
+	if s := server.configForAddress(en.MailFrom); s != nil && s.RelaySourceIP != "" {
+		return net.ParseIP(s.RelaySourceIP)
+	}
+	return net.ParseIP(server.config.RelaySourceIP)
+}
+
+// signMessage adds a DKIM signature to |en| for the domain of its sender, if
+// the domain is configured to sign. A message that cannot be signed is
+// relayed unsigned.
+func (server *smtpServer) signMessage(log *zap.Logger, en *smtp.Envelope) {
+	s := server.configForAddress(en.MailFrom)
+	if s == nil {
+		return
+	}
+	signer, ok := server.dkimSigners[s.Domain]
+	if !ok {
+		return
+	}
+	field, err := signer.Sign(en.Data, time.Now())
+	if err != nil {
+		log.Error("failed to sign message with DKIM", zap.Error(err))
+		relayMetrics.Add("dkim-failed", 1)
+		return
+	}
+	en.Data = append(field, en.Data...)
+	relayMetrics.Add("dkim-signed", 1)
+}
@@ -0,0 +1,146 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/dkim"
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+func TestDKIMSigning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dkim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "dkim.pem")
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	servers := []Server{
+		{Domain: "example.com", DKIMSigning: &DKIMSigningConfig{Selector: "mail", KeyPath: keyPath}},
+		{Domain: "other.net"},
+	}
+	signers, err := loadDKIMSigners(servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := smtpServer{
+		config:      Config{Servers: servers},
+		dkimSigners: signers,
+		log:         zap.NewNop(),
+	}
+
+	data := []byte("From: <me@example.com>\r\nTo: <you@remote.org>\r\nSubject: signed\r\n\r\nbody\r\n")
+	en := smtp.Envelope{
+		MailFrom: mail.Address{Address: "me@example.com"},
+		Data:     data,
+	}
+	server.signMessage(zap.NewNop(), &en)
+
+	record, _ := signers["example.com"].TXTRecord()
+	lookup := func(ctx context.Context, name string) ([]string, error) {
+		if name == "mail._domainkey.example.com" {
+			return []string{record}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	results := dkim.Verify(context.Background(), en.Data, lookup, time.Now())
+	if len(results) != 1 || results[0].Status != dkim.StatusPass || results[0].Domain != "example.com" {
+		t.Errorf("Want a passing signature for example.com, got %+v", results)
+	}
+
+	// Mail from a domain without a key is not signed.
+	en = smtp.Envelope{
+		MailFrom: mail.Address{Address: "me@other.net"},
+		Data:     data,
+	}
+	server.signMessage(zap.NewNop(), &en)
+	if want, got := string(data), string(en.Data); want != got {
+		t.Errorf("Want unsigned message, got %q", got)
+	}
+
+	badPath := filepath.Join(dir, "bad.pem")
+	if err := ioutil.WriteFile(badPath, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []DKIMSigningConfig{
+		{KeyPath: keyPath},
+		{Selector: "mail", KeyPath: filepath.Join(dir, "missing.pem")},
+		{Selector: "mail", KeyPath: badPath},
+	} {
+		config := c
+		if _, err := loadDKIMSigners([]Server{{Domain: "example.com", DKIMSigning: &config}}); err == nil {
+			t.Errorf("%+v: want error", c)
+		}
+	}
+}
+
+func TestRelaySourceIP(t *testing.T) {
+	server := smtpServer{
+		config: Config{
+			RelaySourceIP: "192.0.2.1",
+			Servers: []Server{
+				{Domain: "example.com"},
+				{Domain: "other.net", RelaySourceIP: "2001:db8::25"},
+			},
+		},
+		log: zap.NewNop(),
+	}
+	if err := validateRelaySourceIPs(server.config); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		from, ip string
+	}{
+		{"mailbox@example.com", "192.0.2.1"},
+		{"mailbox@other.net", "2001:db8::25"},
+		{"", "192.0.2.1"},
+	}
+	for _, c := range cases {
+		en := smtp.Envelope{MailFrom: mail.Address{Address: c.from}}
+		if want, got := c.ip, server.RelaySourceIP(en).String(); want != got {
+			t.Errorf("%s: want %s, got %s", c.from, want, got)
+		}
+	}
+
+	server.config.RelaySourceIP = ""
+	if ip := server.RelaySourceIP(smtp.Envelope{MailFrom: mail.Address{Address: "mailbox@example.com"}}); ip != nil {
+		t.Errorf("Want the system's choice, got %v", ip)
+	}
+
+	server.config.Servers[1].RelaySourceIP = "mail.other.net"
+	if err := validateRelaySourceIPs(server.config); err == nil {
+		t.Errorf("Want error for an invalid RelaySourceIP")
+	}
+}
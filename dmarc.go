@@ -0,0 +1,175 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/dmarc"
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+// Enforcement modes of a DMARCConfig.
+const (
+	DMARCMonitor    = "monitor"
+	DMARCQuarantine = "quarantine"
+	DMARCEnforce    = "enforce"
+)
+
+const (
+	defaultQuarantineFolder    = "quarantine"
+	defaultDMARCReportInterval = 24 * time.Hour
+)
+
+var dmarcMetrics = expvar.NewMap("dmarc")
+
+var replyDMARCReject = smtp.ReplyLine{Code: 550, Message: "5.7.1 rejected by the sender's DMARC policy"}
+
+// DMARCConfig sets how a Server applies the DMARC policy of the sender's
+// domain to inbound mail that fails it.
+type DMARCConfig struct {
+	// Enforcement is DMARCMonitor, the default, which only records the
+	// results; DMARCQuarantine, which quarantines mail whose policy is
+	// quarantine or reject; or DMARCEnforce, which also rejects mail whose
+	// policy is reject.
+	Enforcement string
+
+	// QuarantineFolder is the maildrop folder for quarantined mail. It
+	// defaults to the Server's Quarantine Folder, or else "quarantine".
+	QuarantineFolder string
+}
+
+func (c *DMARCConfig) validate() error {
+	switch c.Enforcement {
+	case "", DMARCMonitor, DMARCQuarantine, DMARCEnforce:
+		return nil
+	}
+	return fmt.Errorf("unknown DMARC Enforcement %q", c.Enforcement)
+}
+
+// applyDMARC records the DMARC result of |en| and applies the policy under
+// the DMARC config of |s|. It returns a reply if the message is rejected, or
+// else the folder to deliver it to, which is empty for the maildrop itself.
+func (server *smtpServer) applyDMARC(s *Server, en *smtp.Envelope) (string, *smtp.ReplyLine) {
+	c := s.DMARC
+	if c == nil {
+		return "", nil
+	}
+	server.dmarcStats.record(en.RemoteAddr, en.DMARC)
+
+	if en.DMARC.Status != dmarc.StatusFail {
+		return "", nil
+	}
+	en.Annotate("dmarc", string(en.DMARC.Disposition))
+	log := server.log.With(zap.String("id", en.ID),
+		zap.String("header-from", en.DMARC.Domain),
+		zap.String("disposition", string(en.DMARC.Disposition)),
+		zap.String("enforcement", c.Enforcement))
+
+	switch en.DMARC.Disposition {
+	case dmarc.PolicyReject:
+		if c.Enforcement == DMARCEnforce {
+			log.Warn("rejecting message that failed DMARC")
+			dmarcMetrics.Add("rejected", 1)
+			return "", &replyDMARCReject
+		}
+		fallthrough
+	case dmarc.PolicyQuarantine:
+		if c.Enforcement == DMARCQuarantine || c.Enforcement == DMARCEnforce {
+			log.Info("quarantining message that failed DMARC")
+			dmarcMetrics.Add("quarantined", 1)
+			if c.QuarantineFolder == "" {
+				return quarantineFolder(*s), nil
+			}
+			return c.QuarantineFolder, nil
+		}
+	}
+	log.Info("message failed DMARC")
+	return "", nil
+}
+
+// dmarcRow is the key of an aggregate count, like a row of an RFC 7489
+// aggregate report.
+type dmarcRow struct {
+	Domain      string
+	SourceIP    string
+	Status      dmarc.Status
+	Disposition dmarc.Policy
+	DKIMAligned bool
+	SPFAligned  bool
+}
+
+// dmarcStats counts DMARC results for aggregate reporting.
+type dmarcStats struct {
+	mu     sync.Mutex
+	counts map[dmarcRow]int
+	since  time.Time
+}
+
+func (d *dmarcStats) record(addr net.Addr, r dmarc.Result) {
+	if r.Status == "" || r.Status == dmarc.StatusNone {
+		return
+	}
+	dmarcMetrics.Add(string(r.Status), 1)
+
+	row := dmarcRow{
+		Domain:      r.Domain,
+		Status:      r.Status,
+		Disposition: r.Disposition,
+		DKIMAligned: r.DKIMAligned,
+		SPFAligned:  r.SPFAligned,
+	}
+	if addr != nil {
+		ip, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			ip = addr.String()
+		}
+		row.SourceIP = ip
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.counts == nil {
+		d.counts = make(map[dmarcRow]int)
+		d.since = time.Now()
+	}
+	d.counts[row]++
+}
+
+// flush logs the counts since the last flush and resets them.
+func (d *dmarcStats) flush(log *zap.Logger) {
+	d.mu.Lock()
+	counts, since := d.counts, d.since
+	d.counts = nil
+	d.mu.Unlock()
+
+	for row, count := range counts {
+		log.Info("DMARC aggregate",
+			zap.Time("since", since),
+			zap.String("header-from", row.Domain),
+			zap.String("source-ip", row.SourceIP),
+			zap.String("dmarc", string(row.Status)),
+			zap.String("disposition", string(row.Disposition)),
+			zap.Bool("dkim-aligned", row.DKIMAligned),
+			zap.Bool("spf-aligned", row.SPFAligned),
+			zap.Int("count", count))
+	}
+}
+
+// reportDMARC flushes the aggregate DMARC counts to the log every
+// DMARCReportInterval.
+func (server *smtpServer) reportDMARC(interval time.Duration) {
+	for range time.Tick(interval) {
+		server.dmarcStats.flush(server.log)
+	}
+}
@@ -0,0 +1,248 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+// Package dmarc evaluates Domain-based Message Authentication, Reporting,
+// and Conformance policies (RFC 7489), which combine the SPF and DKIM
+// results of a message with the domain in its From header.
+package dmarc
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+
+	"src.bluestatic.org/mailpopbox/dkim"
+	"src.bluestatic.org/mailpopbox/resolver"
+	"src.bluestatic.org/mailpopbox/spf"
+)
+
+// Policy is the handling a domain requests for mail that fails DMARC.
+type Policy string
+
+const (
+	PolicyNone       Policy = "none"
+	PolicyQuarantine Policy = "quarantine"
+	PolicyReject     Policy = "reject"
+)
+
+// Status is the DMARC verdict, as named in an Authentication-Results header
+// (RFC 8601).
+type Status string
+
+const (
+	StatusNone      Status = "none"
+	StatusPass      Status = "pass"
+	StatusFail      Status = "fail"
+	StatusTempError Status = "temperror"
+	StatusPermError Status = "permerror"
+)
+
+// Result is the outcome of evaluating a message.
+type Result struct {
+	Status Status
+	// Domain is the domain of the From header.
+	Domain string `json:",omitempty"`
+	// Policy is the published policy that applies to Domain, or empty if
+	// there is none.
+	Policy Policy `json:",omitempty"`
+	// Disposition is the Policy to apply to the message. It is PolicyNone
+	// unless the message failed, and it may be weakened by the pct= tag.
+	Disposition Policy `json:",omitempty"`
+	// DKIMAligned and SPFAligned report which mechanisms passed for a domain
+	// aligned with Domain.
+	DKIMAligned bool `json:",omitempty"`
+	SPFAligned  bool `json:",omitempty"`
+}
+
+// Record is a parsed DMARC DNS record.
+type Record struct {
+	Policy          Policy
+	SubdomainPolicy Policy
+	StrictDKIM      bool
+	StrictSPF       bool
+	// Percent is the percentage of failing mail to apply Policy to.
+	Percent int
+}
+
+// Evaluate applies the DMARC policy of |fromDomain| to a message with the
+// SPF result |spfResult| for |spfDomain| and the DKIM |dkimResults|.
+func Evaluate(ctx context.Context, lookup resolver.LookupTXT, fromDomain string, spfResult spf.Result, spfDomain string, dkimResults []dkim.Result) Result {
+	fromDomain = strings.ToLower(strings.TrimSuffix(fromDomain, "."))
+	r := Result{Status: StatusNone, Domain: fromDomain}
+
+	org := OrganizationalDomain(fromDomain)
+	record, err := lookupRecord(ctx, lookup, fromDomain)
+	subdomain := false
+	if err == nil && record == nil && org != fromDomain {
+		record, err = lookupRecord(ctx, lookup, org)
+		subdomain = true
+	}
+	if err != nil {
+		if err == errTemporary {
+			r.Status = StatusTempError
+		} else {
+			r.Status = StatusPermError
+		}
+		return r
+	}
+	if record == nil {
+		return r
+	}
+
+	r.Policy = record.Policy
+	if subdomain && record.SubdomainPolicy != "" {
+		r.Policy = record.SubdomainPolicy
+	}
+
+	for _, d := range dkimResults {
+		if d.Status == dkim.StatusPass && aligned(d.Domain, fromDomain, record.StrictDKIM) {
+			r.DKIMAligned = true
+		}
+	}
+	r.SPFAligned = spfResult == spf.Pass && aligned(spfDomain, fromDomain, record.StrictSPF)
+
+	r.Disposition = PolicyNone
+	if r.DKIMAligned || r.SPFAligned {
+		r.Status = StatusPass
+		return r
+	}
+	r.Status = StatusFail
+	r.Disposition = r.Policy
+	if record.Percent < 100 && rand.Intn(100) >= record.Percent {
+		// Mail not sampled gets the next weaker policy (RFC 7489 § 6.6.4).
+		switch r.Disposition {
+		case PolicyReject:
+			r.Disposition = PolicyQuarantine
+		case PolicyQuarantine:
+			r.Disposition = PolicyNone
+		}
+	}
+	return r
+}
+
+// FromDomain returns the domain of the single author address in the From
+// header |from|.
+func FromDomain(from string) (string, error) {
+	addrs, err := mail.ParseAddressList(from)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) != 1 {
+		return "", errors.New("dmarc: From header must have one address")
+	}
+	at := strings.LastIndexByte(addrs[0].Address, '@')
+	if at == -1 {
+		return "", errors.New("dmarc: From address has no domain")
+	}
+	return strings.ToLower(addrs[0].Address[at+1:]), nil
+}
+
+// OrganizationalDomain returns the registered domain of |domain|, which is
+// one label below its public suffix.
+func OrganizationalDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(strings.ToLower(domain))
+	if err != nil {
+		return strings.ToLower(domain)
+	}
+	return org
+}
+
+func aligned(domain, fromDomain string, strict bool) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if strict {
+		return domain == fromDomain
+	}
+	return domain != "" && OrganizationalDomain(domain) == OrganizationalDomain(fromDomain)
+}
+
+var errTemporary = errors.New("dmarc: temporary DNS error")
+
+// lookupRecord fetches the DMARC record of |domain|, which is nil if it has
+// none.
+func lookupRecord(ctx context.Context, lookup resolver.LookupTXT, domain string) (*Record, error) {
+	txts, err := lookup(ctx, "_dmarc."+domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, nil
+		}
+		return nil, errTemporary
+	}
+
+	var record *Record
+	for _, txt := range txts {
+		r, err := ParseRecord(txt)
+		if err == errNotDMARC {
+			continue
+		}
+		if record != nil {
+			// Multiple records are treated as none (RFC 7489 § 6.6.3).
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		record = r
+	}
+	return record, nil
+}
+
+var errNotDMARC = errors.New("dmarc: not a DMARC record")
+
+// ParseRecord parses the DMARC TXT record |txt|.
+func ParseRecord(txt string) (*Record, error) {
+	tags := strings.Split(txt, ";")
+	if strings.TrimSpace(strings.Replace(tags[0], " ", "", -1)) != "v=DMARC1" {
+		return nil, errNotDMARC
+	}
+
+	r := &Record{Percent: 100}
+	for _, tag := range tags[1:] {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		name, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch name {
+		case "p", "sp":
+			policy := Policy(strings.ToLower(value))
+			if policy != PolicyNone && policy != PolicyQuarantine && policy != PolicyReject {
+				return nil, errors.New("dmarc: invalid policy " + value)
+			}
+			if name == "p" {
+				r.Policy = policy
+			} else {
+				r.SubdomainPolicy = policy
+			}
+		case "adkim", "aspf":
+			strict := strings.EqualFold(value, "s")
+			if !strict && !strings.EqualFold(value, "r") {
+				return nil, errors.New("dmarc: invalid alignment " + value)
+			}
+			if name == "adkim" {
+				r.StrictDKIM = strict
+			} else {
+				r.StrictSPF = strict
+			}
+		case "pct":
+			pct, err := strconv.Atoi(value)
+			if err != nil || pct < 0 || pct > 100 {
+				return nil, errors.New("dmarc: invalid pct " + value)
+			}
+			r.Percent = pct
+		}
+	}
+	if r.Policy == "" {
+		return nil, errors.New("dmarc: record has no policy")
+	}
+	return r, nil
+}
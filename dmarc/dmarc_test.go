@@ -0,0 +1,147 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package dmarc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"src.bluestatic.org/mailpopbox/dkim"
+	"src.bluestatic.org/mailpopbox/resolver"
+	"src.bluestatic.org/mailpopbox/spf"
+)
+
+func lookupFrom(records map[string]string) resolver.LookupTXT {
+	return func(ctx context.Context, name string) ([]string, error) {
+		if name == "_dmarc.broken.net" {
+			return nil, errors.New("server failure")
+		}
+		if txt, ok := records[name]; ok {
+			return []string{"unrelated", txt}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	lookup := lookupFrom(map[string]string{
+		"_dmarc.example.com":   "v=DMARC1; p=reject; sp=quarantine",
+		"_dmarc.strict.com":    "v=DMARC1; p=quarantine; adkim=s; aspf=s",
+		"_dmarc.lenient.com":   "v=DMARC1; p=reject; pct=0",
+		"_dmarc.invalid.com":   "v=DMARC1; p=discard",
+		"_dmarc.monitor.com":   "v=DMARC1;p=none;rua=mailto:dmarc@monitor.com",
+		"_dmarc.example.co.uk": "v=DMARC1; p=reject",
+	})
+	pass := func(domain string) []dkim.Result {
+		return []dkim.Result{{Status: dkim.StatusFail, Domain: "other.net"}, {Status: dkim.StatusPass, Domain: domain}}
+	}
+
+	for _, test := range []struct {
+		name        string
+		from        string
+		spf         spf.Result
+		spfDomain   string
+		dkim        []dkim.Result
+		status      Status
+		disposition Policy
+		dkimAligned bool
+		spfAligned  bool
+	}{
+		{"dkim aligned", "example.com", spf.Fail, "example.com", pass("example.com"), StatusPass, PolicyNone, true, false},
+		{"spf aligned", "example.com", spf.Pass, "example.com", nil, StatusPass, PolicyNone, false, true},
+		{"relaxed alignment", "example.com", spf.Pass, "bounce.example.com", pass("mail.example.com"), StatusPass, PolicyNone, true, true},
+		{"unaligned", "example.com", spf.Pass, "other.net", pass("other.net"), StatusFail, PolicyReject, false, false},
+		{"subdomain policy", "news.example.com", spf.Fail, "news.example.com", nil, StatusFail, PolicyQuarantine, false, false},
+		{"strict alignment", "strict.com", spf.Pass, "bounce.strict.com", pass("mail.strict.com"), StatusFail, PolicyQuarantine, false, false},
+		{"strict aligned", "strict.com", spf.Pass, "strict.com", nil, StatusPass, PolicyNone, false, true},
+		{"pct sampling", "lenient.com", spf.Fail, "lenient.com", nil, StatusFail, PolicyQuarantine, false, false},
+		{"monitor", "monitor.com", spf.None, "", nil, StatusFail, PolicyNone, false, false},
+		{"public suffix", "mail.example.co.uk", spf.Fail, "", pass("co.uk"), StatusFail, PolicyReject, false, false},
+		{"no record", "nodmarc.org", spf.Fail, "", nil, StatusNone, "", false, false},
+		{"invalid record", "invalid.com", spf.Pass, "invalid.com", nil, StatusPermError, "", false, false},
+		{"dns failure", "broken.net", spf.Pass, "broken.net", nil, StatusTempError, "", false, false},
+	} {
+		r := Evaluate(context.Background(), lookup, test.from, test.spf, test.spfDomain, test.dkim)
+		if want, got := test.status, r.Status; want != got {
+			t.Errorf("%s: want status %s, got %s", test.name, want, got)
+		}
+		if want, got := test.disposition, r.Disposition; want != got {
+			t.Errorf("%s: want disposition %q, got %q", test.name, want, got)
+		}
+		if r.DKIMAligned != test.dkimAligned || r.SPFAligned != test.spfAligned {
+			t.Errorf("%s: want alignment dkim=%t spf=%t, got %+v", test.name, test.dkimAligned, test.spfAligned, r)
+		}
+	}
+}
+
+func TestParseRecord(t *testing.T) {
+	r, err := ParseRecord("v=DMARC1; p=Quarantine; sp=reject; adkim=s; aspf=r; pct=25; rua=mailto:a@b.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := (Record{PolicyQuarantine, PolicyReject, true, false, 25}), *r; want != got {
+		t.Errorf("Want %+v, got %+v", want, got)
+	}
+
+	for _, txt := range []string{
+		"v=DMARC1",
+		"v=DMARC1; p=none; pct=200",
+		"v=DMARC1; p=none; adkim=x",
+	} {
+		if _, err := ParseRecord(txt); err == nil {
+			t.Errorf("%q: want error", txt)
+		}
+	}
+	if _, err := ParseRecord("v=spf1 -all"); err != errNotDMARC {
+		t.Errorf("Want errNotDMARC, got %v", err)
+	}
+}
+
+func TestFromDomain(t *testing.T) {
+	domain, err := FromDomain(`"Sender" <Sender@Example.COM>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "example.com", domain; want != got {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+
+	for _, from := range []string{"", "a@example.com, b@example.net", "not an address"} {
+		if _, err := FromDomain(from); err == nil {
+			t.Errorf("%q: want error", from)
+		}
+	}
+}
+
+func TestParseAggregateReport(t *testing.T) {
+	r, err := ParseAggregateReport([]byte(`<feedback>
+		<report_metadata><org_name>Mail Co</org_name><report_id>42</report_id>
+			<date_range><begin>1590969600</begin><end>1591055999</end></date_range></report_metadata>
+		<policy_published><domain>example.com</domain><p>quarantine</p></policy_published>
+		<record><row><source_ip>192.0.2.1</source_ip><count>3</count>
+			<policy_evaluated><disposition>quarantine</disposition><dkim>fail</dkim><spf>fail</spf></policy_evaluated>
+		</row></record>
+	</feedback>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := PolicyQuarantine, r.PolicyPublished.Policy; want != got {
+		t.Errorf("Want policy %s, got %s", want, got)
+	}
+	if len(r.Records) != 1 || r.Records[0].Row.Count != 3 || r.Records[0].Passed() {
+		t.Errorf("Want one failed record of 3, got %+v", r.Records)
+	}
+	if want, got := "2020-06-01", r.Begin().Format("2006-01-02"); want != got {
+		t.Errorf("Want begin %s, got %s", want, got)
+	}
+
+	if _, err := ParseAggregateReport([]byte("<html></html>")); err == nil {
+		t.Errorf("Want error for a document that is not a report")
+	}
+}
@@ -0,0 +1,75 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package dmarc
+
+import (
+	"encoding/xml"
+	"errors"
+	"time"
+)
+
+// AggregateReport is the feedback document of an aggregate report (RFC 7489
+// Appendix C). Only the fields needed to summarize it are parsed.
+type AggregateReport struct {
+	Metadata struct {
+		OrgName   string `xml:"org_name"`
+		Email     string `xml:"email"`
+		ReportID  string `xml:"report_id"`
+		DateRange struct {
+			Begin int64 `xml:"begin"`
+			End   int64 `xml:"end"`
+		} `xml:"date_range"`
+	} `xml:"report_metadata"`
+	PolicyPublished struct {
+		Domain string `xml:"domain"`
+		Policy Policy `xml:"p"`
+	} `xml:"policy_published"`
+	Records []AggregateRecord `xml:"record"`
+}
+
+// AggregateRecord is the row of an aggregate report for one source.
+type AggregateRecord struct {
+	Row struct {
+		SourceIP        string `xml:"source_ip"`
+		Count           int    `xml:"count"`
+		PolicyEvaluated struct {
+			Disposition Policy `xml:"disposition"`
+			DKIM        string `xml:"dkim"`
+			SPF         string `xml:"spf"`
+		} `xml:"policy_evaluated"`
+	} `xml:"row"`
+	Identifiers struct {
+		HeaderFrom string `xml:"header_from"`
+	} `xml:"identifiers"`
+}
+
+// Passed reports whether the messages of the record passed DMARC.
+func (r AggregateRecord) Passed() bool {
+	e := r.Row.PolicyEvaluated
+	return e.DKIM == "pass" || e.SPF == "pass"
+}
+
+// Begin and End return the date range of the report.
+func (r *AggregateReport) Begin() time.Time {
+	return time.Unix(r.Metadata.DateRange.Begin, 0).UTC()
+}
+
+func (r *AggregateReport) End() time.Time {
+	return time.Unix(r.Metadata.DateRange.End, 0).UTC()
+}
+
+// ParseAggregateReport parses the XML of an aggregate report.
+func ParseAggregateReport(data []byte) (*AggregateReport, error) {
+	var r AggregateReport
+	if err := xml.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	if r.Metadata.ReportID == "" || r.PolicyPublished.Domain == "" {
+		return nil, errors.New("dmarc: not an aggregate report")
+	}
+	return &r, nil
+}
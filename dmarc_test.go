@@ -0,0 +1,131 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/dmarc"
+	"src.bluestatic.org/mailpopbox/maildrop"
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+func TestDMARCEnforcement(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var servers []Server
+	for _, enforcement := range []string{DMARCMonitor, DMARCQuarantine, DMARCEnforce} {
+		path := filepath.Join(dir, enforcement)
+		if err := os.Mkdir(path, 0700); err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, Server{
+			Domain:       enforcement + ".com",
+			MaildropPath: path,
+			DMARC:        &DMARCConfig{Enforcement: enforcement},
+		})
+	}
+	server := &smtpServer{config: Config{Servers: servers}, log: zap.NewNop()}
+
+	deliver := func(id, rcpt string, status dmarc.Status, disposition dmarc.Policy) *smtp.ReplyLine {
+		return server.DeliverMessage(smtp.Envelope{
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25},
+			MailFrom:   mail.Address{Address: "sender@sender.net"},
+			RcptTo:     []mail.Address{{Address: rcpt}},
+			Data:       []byte("From: <sender@sender.net>\r\nSubject: test\r\n\r\nbody\r\n"),
+			ID:         id,
+			DMARC:      dmarc.Result{Status: status, Domain: "sender.net", Policy: disposition, Disposition: disposition},
+		})
+	}
+	list := func(path string) []string {
+		entries, err := maildrop.New(path).List()
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, e := range entries {
+			ids = append(ids, e.ID)
+		}
+		return ids
+	}
+
+	for _, test := range []struct {
+		enforcement string
+		reject      bool
+		inbox       int
+		quarantine  int
+	}{
+		// Pass, quarantine, and reject messages for each mode.
+		{DMARCMonitor, false, 3, 0},
+		{DMARCQuarantine, false, 1, 2},
+		{DMARCEnforce, true, 1, 1},
+	} {
+		rcpt := "user@" + test.enforcement + ".com"
+		if rl := deliver("pass", rcpt, dmarc.StatusPass, dmarc.PolicyNone); rl != nil {
+			t.Errorf("%s: passing message rejected: %v", test.enforcement, rl)
+		}
+		if rl := deliver("quarantine", rcpt, dmarc.StatusFail, dmarc.PolicyQuarantine); rl != nil {
+			t.Errorf("%s: quarantine message rejected: %v", test.enforcement, rl)
+		}
+		rl := deliver("reject", rcpt, dmarc.StatusFail, dmarc.PolicyReject)
+		if (rl != nil) != test.reject {
+			t.Errorf("%s: want reject %t, got %v", test.enforcement, test.reject, rl)
+		}
+		if rl != nil && rl.Code != 550 {
+			t.Errorf("%s: want 550, got %v", test.enforcement, rl)
+		}
+
+		path := filepath.Join(dir, test.enforcement)
+		if want, got := test.inbox, len(list(path)); want != got {
+			t.Errorf("%s: want %d delivered, got %v", test.enforcement, want, list(path))
+		}
+		if want, got := test.quarantine, len(list(filepath.Join(path, "quarantine"))); want != got {
+			t.Errorf("%s: want %d quarantined, got %d", test.enforcement, want, got)
+		}
+	}
+
+	row := dmarcRow{
+		Domain:      "sender.net",
+		SourceIP:    "192.0.2.1",
+		Status:      dmarc.StatusFail,
+		Disposition: dmarc.PolicyReject,
+	}
+	if want, got := 3, server.dmarcStats.counts[row]; want != got {
+		t.Errorf("Want %d counted for %+v, got %d", want, row, got)
+	}
+	server.dmarcStats.flush(zap.NewNop())
+	if len(server.dmarcStats.counts) != 0 {
+		t.Errorf("Want counts reset after flush, got %v", server.dmarcStats.counts)
+	}
+}
+
+func TestDMARCConfig(t *testing.T) {
+	server := &smtpServer{
+		config: Config{Servers: []Server{{Domain: "example.com", DMARC: &DMARCConfig{Enforcement: "strict"}}}},
+		log:    zap.NewNop(),
+	}
+	if err := server.setupDelivery(); err == nil {
+		t.Errorf("Want error for unknown Enforcement")
+	}
+
+	server.config.Servers[0].DMARC.Enforcement = DMARCEnforce
+	server.config.DMARCReportInterval = "daily"
+	if err := server.setupDelivery(); err == nil {
+		t.Errorf("Want error for invalid DMARCReportInterval")
+	}
+}
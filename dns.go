@@ -0,0 +1,83 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"time"
+
+	"src.bluestatic.org/mailpopbox/resolver"
+)
+
+var dnsMetrics = expvar.NewMap("dns")
+
+// DNSConfig configures the resolver used for all DNS lookups: MX records when
+// relaying, PTR records for traces and HELO checks, and the SPF, DKIM, DMARC,
+// MTA-STS, and TLSRPT records.
+type DNSConfig struct {
+	// Server is the host:port of the DNS server to query, instead of the
+	// system's resolver.
+	Server string
+
+	// Timeout bounds each lookup, as a Go duration string. It defaults to
+	// five seconds.
+	Timeout string
+
+	// CacheSize is how many answers are cached. It defaults to 1024, and a
+	// negative size disables the cache.
+	CacheSize int
+
+	// CacheTTL is how long answers are cached, and NegativeCacheTTL is how
+	// long it is cached that a name does not exist. They are Go duration
+	// strings that default to five minutes and one minute.
+	CacheTTL         string
+	NegativeCacheTTL string
+}
+
+func (c *DNSConfig) options() (resolver.Options, error) {
+	opts := resolver.Options{
+		Server:    c.Server,
+		CacheSize: c.CacheSize,
+	}
+	fields := []struct {
+		name  string
+		value string
+		d     *time.Duration
+	}{
+		{"Timeout", c.Timeout, &opts.Timeout},
+		{"CacheTTL", c.CacheTTL, &opts.TTL},
+		{"NegativeCacheTTL", c.NegativeCacheTTL, &opts.NegativeTTL},
+	}
+	for _, f := range fields {
+		if f.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(f.value)
+		if err != nil {
+			return opts, fmt.Errorf("%s: %v", f.name, err)
+		}
+		*f.d = d
+	}
+	return opts, nil
+}
+
+// configureDNS applies |c|, if it is set, to resolver.Default, and reports
+// the resolver's cache statistics in the dns metrics.
+func configureDNS(c *DNSConfig) error {
+	if c != nil {
+		opts, err := c.options()
+		if err != nil {
+			return err
+		}
+		resolver.Default.Configure(opts)
+	}
+	dnsMetrics.Set("cache", expvar.Func(func() interface{} {
+		return resolver.Default.Stats()
+	}))
+	return nil
+}
@@ -0,0 +1,41 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"src.bluestatic.org/mailpopbox/resolver"
+)
+
+func TestDNSConfigOptions(t *testing.T) {
+	c := DNSConfig{
+		Server:           "127.0.0.1:53",
+		Timeout:          "2s",
+		CacheSize:        -1,
+		NegativeCacheTTL: "30s",
+	}
+	opts, err := c.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := resolver.Options{
+		Server:      "127.0.0.1:53",
+		Timeout:     2 * time.Second,
+		CacheSize:   -1,
+		NegativeTTL: 30 * time.Second,
+	}
+	if want != opts {
+		t.Errorf("Want options %+v, got %+v", want, opts)
+	}
+
+	c = DNSConfig{CacheTTL: "forever"}
+	if _, err := c.options(); err == nil {
+		t.Errorf("Want error for invalid CacheTTL")
+	}
+}
@@ -0,0 +1,88 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"expvar"
+	"sync"
+
+	"src.bluestatic.org/mailpopbox/maildrop"
+)
+
+var mailboxMetrics = expvar.NewMap("mailbox")
+
+// mailboxEventBuffer is the number of events that can be pending for a
+// subscriber before it starts missing them.
+const mailboxEventBuffer = 64
+
+// Kinds of mailboxEvent.
+const (
+	mailboxDelivered = "delivered"
+	mailboxRemoved   = "removed"
+)
+
+// mailboxEvent describes a change to the messages in a maildrop.
+type mailboxEvent struct {
+	// Kind is mailboxDelivered or mailboxRemoved.
+	Kind string
+	// Path is the maildrop or folder directory.
+	Path string
+	// ID is the message ID.
+	ID string
+}
+
+// mailboxEvents publishes changes to maildrops to the features that track
+// them, so that they need not poll the maildrop directories. Publishing never
+// blocks: a subscriber that falls behind misses events, so each must be able
+// to recover from the maildrop itself. A nil *mailboxEvents drops all events.
+type mailboxEvents struct {
+	mu   sync.Mutex
+	subs []chan mailboxEvent
+}
+
+// startMailboxEvents returns an event bus with the built-in subscribers,
+// which invalidate |listings| and count events in the metrics.
+func startMailboxEvents(listings *maildrop.ListCache) *mailboxEvents {
+	events := &mailboxEvents{}
+	go func(ch <-chan mailboxEvent) {
+		for ev := range ch {
+			listings.Invalidate(ev.Path)
+		}
+	}(events.subscribe())
+	go func(ch <-chan mailboxEvent) {
+		for ev := range ch {
+			mailboxMetrics.Add(ev.Kind, 1)
+		}
+	}(events.subscribe())
+	return events
+}
+
+// subscribe returns a channel that receives each event published from now
+// on.
+func (e *mailboxEvents) subscribe() <-chan mailboxEvent {
+	ch := make(chan mailboxEvent, mailboxEventBuffer)
+	e.mu.Lock()
+	e.subs = append(e.subs, ch)
+	e.mu.Unlock()
+	return ch
+}
+
+// publish sends |ev| to the subscribers that have room for it.
+func (e *mailboxEvents) publish(ev mailboxEvent) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, ch := range e.subs {
+		select {
+		case ch <- ev:
+		default:
+			mailboxMetrics.Add("dropped", 1)
+		}
+	}
+}
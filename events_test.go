@@ -0,0 +1,36 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"testing"
+)
+
+func TestMailboxEvents(t *testing.T) {
+	events := &mailboxEvents{}
+	a := events.subscribe()
+	b := events.subscribe()
+
+	ev := mailboxEvent{Kind: mailboxDelivered, Path: "/maildrop", ID: "m.1"}
+	events.publish(ev)
+	for _, ch := range []<-chan mailboxEvent{a, b} {
+		if want, got := ev, <-ch; want != got {
+			t.Errorf("Want event %+v, got %+v", want, got)
+		}
+	}
+
+	// A subscriber that falls behind does not block publishing.
+	for i := 0; i < mailboxEventBuffer+1; i++ {
+		events.publish(ev)
+	}
+	if want, got := mailboxEventBuffer, len(a); want != got {
+		t.Errorf("Want %d pending events, got %d", want, got)
+	}
+
+	var nilEvents *mailboxEvents
+	nilEvents.publish(ev)
+}
@@ -0,0 +1,136 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"src.bluestatic.org/mailpopbox/maildrop"
+)
+
+// exportEntry describes a message in the export's index.json.
+type exportEntry struct {
+	File     string
+	Size     int64
+	Metadata maildrop.Metadata
+}
+
+// runExport implements the export subcommand, returning the exit code.
+func runExport(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	configPath := flags.String("config", "config.json", "path to the configuration file")
+	domain := flags.String("domain", "", "the domain whose mailbox is exported")
+	out := flags.String("out", "", "path of the zip file to create")
+	flags.Parse(args)
+
+	if *domain == "" || *out == "" {
+		fmt.Fprintf(os.Stderr, "Usage: %s export [-config config.json] -domain example.com -out export.zip\n", os.Args[0])
+		return 1
+	}
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config file: %s\n", err)
+		return 2
+	}
+
+	var server *Server
+	for i := range config.Servers {
+		if config.Servers[i].Domain == *domain {
+			server = &config.Servers[i]
+		}
+	}
+	if server == nil {
+		fmt.Fprintf(os.Stderr, "no server for domain %q\n", *domain)
+		return 3
+	}
+
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "create export: %v\n", err)
+		return 4
+	}
+
+	count, err := exportMaildrop(maildrop.New(server.MaildropPath), f)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(*out)
+		fmt.Fprintf(os.Stderr, "export: %v\n", err)
+		return 5
+	}
+
+	fmt.Printf("Exported %d messages to %s\n", count, *out)
+	return 0
+}
+
+// exportMaildrop writes a zip archive to |w| that contains each message in
+// |md| as an .eml file, and an index.json of their metadata. It returns the
+// number of messages exported.
+func exportMaildrop(md *maildrop.Maildrop, w io.Writer) (int, error) {
+	entries, err := md.List()
+	if err != nil {
+		return 0, err
+	}
+
+	zw := zip.NewWriter(w)
+	index := make([]exportEntry, 0, len(entries))
+
+	for _, entry := range entries {
+		meta, err := md.Metadata(entry.ID)
+		if err != nil {
+			return 0, err
+		}
+
+		ie := exportEntry{
+			File:     "messages/" + entry.ID + ".eml",
+			Size:     entry.Size,
+			Metadata: meta,
+		}
+
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     ie.File,
+			Method:   zip.Deflate,
+			Modified: entry.ModTime,
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		msg, err := md.Open(entry.ID)
+		if err != nil {
+			return 0, err
+		}
+		_, err = io.Copy(fw, msg)
+		msg.Close()
+		if err != nil {
+			return 0, err
+		}
+
+		index = append(index, ie)
+	}
+
+	fw, err := zw.Create("index.json")
+	if err != nil {
+		return 0, err
+	}
+	enc := json.NewEncoder(fw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(index); err != nil {
+		return 0, err
+	}
+
+	return len(index), zw.Close()
+}
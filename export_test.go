@@ -0,0 +1,96 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"testing"
+	"time"
+
+	"src.bluestatic.org/mailpopbox/maildrop"
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+func TestExportMaildrop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	md := maildrop.New(dir)
+	for _, id := range []string{"m.1", "m.2"} {
+		err := md.Deliver(smtp.Envelope{
+			MailFrom: mail.Address{Address: "from@sender.net"},
+			RcptTo:   []mail.Address{{Address: "to@example.com"}},
+			Data:     []byte("Subject: " + id + "\r\n\r\nbody\r\n"),
+			Received: time.Now(),
+			ID:       id,
+		})
+		if err != nil {
+			t.Fatalf("Failed to deliver: %v", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	count, err := exportMaildrop(md, &buf)
+	if err != nil {
+		t.Fatalf("Failed to export: %v", err)
+	}
+	if want, got := 2, count; want != got {
+		t.Errorf("Want %d messages exported, got %d", want, got)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("Failed to read zip: %v", err)
+	}
+
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	if want, got := 3, len(files); want != got {
+		t.Errorf("Want %d files in export, got %d", want, got)
+	}
+
+	rc, err := files["index.json"].Open()
+	if err != nil {
+		t.Fatalf("Failed to open index.json: %v", err)
+	}
+	var index []exportEntry
+	if err := json.NewDecoder(rc).Decode(&index); err != nil {
+		t.Fatalf("Failed to decode index.json: %v", err)
+	}
+	rc.Close()
+
+	if want, got := 2, len(index); want != got {
+		t.Fatalf("Want %d index entries, got %d", want, got)
+	}
+	if want, got := "from@sender.net", index[0].Metadata.MailFrom; want != got {
+		t.Errorf("Want MailFrom %q, got %q", want, got)
+	}
+
+	f, ok := files[index[1].File]
+	if !ok {
+		t.Fatalf("Missing %q in export", index[1].File)
+	}
+	rc, _ = f.Open()
+	data, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if !bytes.Contains(data, []byte("Subject: m.2\r\n")) {
+		t.Errorf("Unexpected message content %q", data)
+	}
+	if want, got := index[1].Size, int64(len(data)); want != got {
+		t.Errorf("Want size %d, got %d", want, got)
+	}
+}
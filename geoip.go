@@ -0,0 +1,230 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"go.uber.org/zap"
+)
+
+const defaultTarpitDelay = 15 * time.Second
+
+const (
+	GeoIPActionReject = "reject"
+	GeoIPActionTarpit = "tarpit"
+	GeoIPActionScore  = "score"
+)
+
+var geoipMetrics = expvar.NewMap("geoip")
+
+// GeoIPConfig enables looking up the country and network of SMTP clients in
+// MaxMind databases, to tag connections in the logs and metrics and to apply
+// policies to them.
+type GeoIPConfig struct {
+	// Paths to GeoLite2-Country (or City) and GeoLite2-ASN databases. Either
+	// may be empty.
+	CountryDatabase string
+	ASNDatabase     string
+
+	Policies []GeoIPPolicy
+
+	// TarpitDelay is how long to wait before greeting a client with the
+	// tarpit action, as a Go duration string. The default is 15s.
+	TarpitDelay string
+}
+
+// GeoIPPolicy applies an Action to clients from any of the Countries (ISO
+// 3166 codes) or autonomous system numbers. The "reject" action disconnects
+// the client. The "tarpit" action delays the greeting. The "score" action adds
+// Score to the X-Mailpopbox-GeoIP header of delivered messages.
+type GeoIPPolicy struct {
+	Countries []string
+	ASNs      []uint
+	Action    string
+	Score     int
+}
+
+// geoInfo is the result of a GeoIP lookup.
+type geoInfo struct {
+	Country string
+	ASN     uint
+	Org     string
+}
+
+type geoIP struct {
+	lookup   func(net.IP) geoInfo
+	policies []GeoIPPolicy
+	tarpit   time.Duration
+	closers  []func() error
+}
+
+// openGeoIP opens the databases in |config|.
+func openGeoIP(config GeoIPConfig) (*geoIP, error) {
+	g := &geoIP{
+		policies: config.Policies,
+		tarpit:   defaultTarpitDelay,
+	}
+
+	for _, p := range config.Policies {
+		switch p.Action {
+		case GeoIPActionReject, GeoIPActionTarpit, GeoIPActionScore:
+		default:
+			return nil, fmt.Errorf("unknown policy Action %q", p.Action)
+		}
+	}
+
+	if config.TarpitDelay != "" {
+		var err error
+		g.tarpit, err = time.ParseDuration(config.TarpitDelay)
+		if err != nil {
+			return nil, fmt.Errorf("TarpitDelay: %v", err)
+		}
+	}
+
+	var country, asn *maxminddb.Reader
+	if config.CountryDatabase != "" {
+		var err error
+		country, err = maxminddb.Open(config.CountryDatabase)
+		if err != nil {
+			return nil, err
+		}
+		g.closers = append(g.closers, country.Close)
+	}
+	if config.ASNDatabase != "" {
+		var err error
+		asn, err = maxminddb.Open(config.ASNDatabase)
+		if err != nil {
+			g.Close()
+			return nil, err
+		}
+		g.closers = append(g.closers, asn.Close)
+	}
+
+	g.lookup = func(ip net.IP) geoInfo {
+		var info geoInfo
+		if country != nil {
+			var record struct {
+				Country struct {
+					ISOCode string `maxminddb:"iso_code"`
+				} `maxminddb:"country"`
+			}
+			if country.Lookup(ip, &record) == nil {
+				info.Country = record.Country.ISOCode
+			}
+		}
+		if asn != nil {
+			var record struct {
+				ASN uint   `maxminddb:"autonomous_system_number"`
+				Org string `maxminddb:"autonomous_system_organization"`
+			}
+			if asn.Lookup(ip, &record) == nil {
+				info.ASN, info.Org = record.ASN, record.Org
+			}
+		}
+		return info
+	}
+
+	return g, nil
+}
+
+func (g *geoIP) Close() error {
+	for _, c := range g.closers {
+		c()
+	}
+	return nil
+}
+
+// Lookup returns the country and network of |addr|. A nil *geoIP returns an
+// empty result.
+func (g *geoIP) Lookup(addr net.Addr) geoInfo {
+	if g == nil || addr == nil {
+		return geoInfo{}
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return geoInfo{}
+	}
+	return g.lookup(ip)
+}
+
+// Policy returns the action for a client, which is the first matching reject
+// or tarpit policy, or else "score" with the sum of the matching scores. It
+// returns the empty string if no policy matches.
+func (g *geoIP) Policy(info geoInfo) (string, int) {
+	if g == nil {
+		return "", 0
+	}
+	action, score := "", 0
+	for _, p := range g.policies {
+		if !p.matches(info) {
+			continue
+		}
+		if p.Action != GeoIPActionScore {
+			return p.Action, 0
+		}
+		action = GeoIPActionScore
+		score += p.Score
+	}
+	return action, score
+}
+
+func (p GeoIPPolicy) matches(info geoInfo) bool {
+	for _, c := range p.Countries {
+		if info.Country != "" && strings.EqualFold(c, info.Country) {
+			return true
+		}
+	}
+	for _, asn := range p.ASNs {
+		if info.ASN != 0 && asn == info.ASN {
+			return true
+		}
+	}
+	return false
+}
+
+// fields returns the log fields for |info|.
+func (info geoInfo) fields() []zap.Field {
+	var fields []zap.Field
+	if info.Country != "" {
+		fields = append(fields, zap.String("country", info.Country))
+	}
+	if info.ASN != 0 {
+		fields = append(fields, zap.Uint("asn", info.ASN), zap.String("org", info.Org))
+	}
+	return fields
+}
+
+// header returns the value of the X-Mailpopbox-GeoIP header for |info|.
+func (info geoInfo) header(score int) string {
+	country := info.Country
+	if country == "" {
+		country = "unknown"
+	}
+	return fmt.Sprintf("country=%s; asn=%d; score=%d", country, info.ASN, score)
+}
+
+// countConnection records a connection from |info| in the metrics.
+func countConnection(info geoInfo, action string) {
+	country := info.Country
+	if country == "" {
+		country = "unknown"
+	}
+	geoipMetrics.Add("country_"+country, 1)
+	if action != "" {
+		geoipMetrics.Add("action_"+action, 1)
+	}
+}
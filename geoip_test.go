@@ -0,0 +1,166 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+func newTestGeoIP(policies []GeoIPPolicy) *geoIP {
+	return &geoIP{
+		policies: policies,
+		lookup: func(ip net.IP) geoInfo {
+			switch ip.String() {
+			case "192.0.2.1":
+				return geoInfo{Country: "US", ASN: 64500, Org: "Example"}
+			case "198.51.100.1":
+				return geoInfo{Country: "NL", ASN: 64501}
+			case "203.0.113.1":
+				return geoInfo{Country: "US", ASN: 64502}
+			}
+			return geoInfo{}
+		},
+	}
+}
+
+func TestGeoIPPolicy(t *testing.T) {
+	geo := newTestGeoIP([]GeoIPPolicy{
+		{Countries: []string{"us"}, Action: GeoIPActionScore, Score: 2},
+		{ASNs: []uint{64500}, Action: GeoIPActionScore, Score: 3},
+		{ASNs: []uint{64502}, Action: GeoIPActionTarpit},
+		{Countries: []string{"NL"}, Action: GeoIPActionReject},
+	})
+
+	cases := []struct {
+		ip     string
+		action string
+		score  int
+	}{
+		{"192.0.2.1", GeoIPActionScore, 5},
+		{"198.51.100.1", GeoIPActionReject, 0},
+		{"203.0.113.1", GeoIPActionTarpit, 0},
+		{"192.0.2.99", "", 0},
+	}
+	for _, c := range cases {
+		info := geo.Lookup(&net.TCPAddr{IP: net.ParseIP(c.ip), Port: 25})
+		action, score := geo.Policy(info)
+		if want, got := c.action, action; want != got {
+			t.Errorf("%s: want action %q, got %q", c.ip, want, got)
+		}
+		if want, got := c.score, score; want != got {
+			t.Errorf("%s: want score %d, got %d", c.ip, want, got)
+		}
+	}
+
+	var nilGeo *geoIP
+	if action, _ := nilGeo.Policy(nilGeo.Lookup(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")})); action != "" {
+		t.Errorf("Want no action without GeoIP, got %q", action)
+	}
+}
+
+func TestOpenGeoIPValidates(t *testing.T) {
+	if _, err := openGeoIP(GeoIPConfig{Policies: []GeoIPPolicy{{Action: "block"}}}); err == nil {
+		t.Errorf("Want error for an unknown action")
+	}
+	if _, err := openGeoIP(GeoIPConfig{TarpitDelay: "soon"}); err == nil {
+		t.Errorf("Want error for an invalid TarpitDelay")
+	}
+	if _, err := openGeoIP(GeoIPConfig{CountryDatabase: "/nonexistent.mmdb"}); err == nil {
+		t.Errorf("Want error for a missing database")
+	}
+}
+
+// pipeConn reports a fixed remote address for one end of a net.Pipe.
+type pipeConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c pipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestGeoIPAcceptConnection(t *testing.T) {
+	server := &smtpServer{
+		config: Config{Hostname: "mx.example.com"},
+		geo: newTestGeoIP([]GeoIPPolicy{
+			{Countries: []string{"NL"}, Action: GeoIPActionReject},
+			{Countries: []string{"US"}, Action: GeoIPActionTarpit},
+		}),
+		log: zap.NewNop(),
+	}
+
+	for _, c := range []struct {
+		ip       string
+		accepted bool
+	}{
+		{"198.51.100.1", false},
+		{"192.0.2.1", true},
+	} {
+		client, serverConn := net.Pipe()
+		go server.acceptConnection(pipeConn{serverConn, &net.TCPAddr{IP: net.ParseIP(c.ip), Port: 1234}}, server)
+
+		line, err := bufio.NewReader(client).ReadString('\n')
+		if c.accepted {
+			if !strings.HasPrefix(line, "220 ") {
+				t.Errorf("%s: want greeting, got %q (%v)", c.ip, line, err)
+			}
+		} else if err != io.EOF {
+			t.Errorf("%s: want connection closed, got %q (%v)", c.ip, line, err)
+		}
+		client.Close()
+	}
+}
+
+func TestGeoIPHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := smtpServer{
+		config: Config{
+			Servers: []Server{{Domain: "example.com", MaildropPath: dir}},
+		},
+		geo: newTestGeoIP([]GeoIPPolicy{
+			{Countries: []string{"US"}, Action: GeoIPActionScore, Score: 4},
+		}),
+		log: zap.NewNop(),
+	}
+
+	en := smtp.Envelope{
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234},
+		MailFrom:   mail.Address{Address: "from@sender.net"},
+		RcptTo:     []mail.Address{{Address: "to@example.com"}},
+		Data:       []byte("Subject: hi\r\n\r\nbody\r\n"),
+		ID:         "m.geo",
+	}
+	if reply := server.DeliverMessage(en); reply != nil {
+		t.Fatalf("Failed to deliver: %v", reply)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, en.ID+".msg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "X-Mailpopbox-GeoIP: country=US; asn=64500; score=4\r\n") {
+		t.Errorf("Missing GeoIP header in %q", data)
+	}
+}
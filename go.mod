@@ -2,4 +2,9 @@ module src.bluestatic.org/mailpopbox
 
 go 1.14
 
-require go.uber.org/zap v1.15.0
+require (
+	github.com/oschwald/maxminddb-golang v1.8.0
+	go.uber.org/zap v1.15.0
+	golang.org/x/net v0.0.0-20200822124328-c89045814202
+	google.golang.org/grpc v1.40.0
+)
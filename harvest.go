@@ -0,0 +1,183 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"os/exec"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultHarvestThreshold = 10
+	defaultHarvestWindow    = 10 * time.Minute
+	defaultHarvestBan       = time.Hour
+)
+
+var harvestMetrics = expvar.NewMap("harvest")
+
+// HarvestConfig bans client IPs that probe for valid addresses by trying
+// many nonexistent recipients.
+type HarvestConfig struct {
+	// Threshold is how many invalid recipients one IP can try within Window
+	// before it is banned. The default is 10.
+	Threshold int
+
+	// Window and BanDuration are Go duration strings. The defaults are 10m
+	// and 1h.
+	Window      string
+	BanDuration string
+
+	// BanCommand, if set, is run with the banned IP appended as the last
+	// argument, such as to add a firewall rule. The ban within mailpopbox
+	// still expires after BanDuration.
+	BanCommand []string
+}
+
+// harvestGuard is the running form of a HarvestConfig. A nil *harvestGuard
+// bans no one.
+type harvestGuard struct {
+	threshold int
+	window    time.Duration
+	ban       time.Duration
+	command   []string
+
+	mu       sync.Mutex
+	attempts map[string][]time.Time // Keyed by IP.
+	banned   map[string]time.Time   // The expiration, keyed by IP.
+
+	now func() time.Time
+	log *zap.Logger
+}
+
+func newHarvestGuard(config HarvestConfig, log *zap.Logger) (*harvestGuard, error) {
+	g := &harvestGuard{
+		threshold: config.Threshold,
+		window:    defaultHarvestWindow,
+		ban:       defaultHarvestBan,
+		command:   config.BanCommand,
+		attempts:  make(map[string][]time.Time),
+		banned:    make(map[string]time.Time),
+		now:       time.Now,
+		log:       log,
+	}
+	if g.threshold <= 0 {
+		g.threshold = defaultHarvestThreshold
+	}
+	var err error
+	if config.Window != "" {
+		if g.window, err = time.ParseDuration(config.Window); err != nil {
+			return nil, fmt.Errorf("Window: %v", err)
+		}
+	}
+	if config.BanDuration != "" {
+		if g.ban, err = time.ParseDuration(config.BanDuration); err != nil {
+			return nil, fmt.Errorf("BanDuration: %v", err)
+		}
+	}
+	return g, nil
+}
+
+// addrIP returns the IP of |addr| as a string, or the empty string if it has
+// none.
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// Record counts an invalid recipient tried by the client at |addr|. It
+// returns true if that bans the client.
+func (g *harvestGuard) Record(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if g == nil || ip == "" {
+		return false
+	}
+
+	g.mu.Lock()
+	now := g.now()
+	attempts := g.attempts[ip][:0]
+	for _, t := range g.attempts[ip] {
+		if now.Sub(t) < g.window {
+			attempts = append(attempts, t)
+		}
+	}
+	attempts = append(attempts, now)
+	banned := len(attempts) >= g.threshold
+	if banned {
+		delete(g.attempts, ip)
+		g.banned[ip] = now.Add(g.ban)
+	} else {
+		g.attempts[ip] = attempts
+	}
+	g.expire(now)
+	g.mu.Unlock()
+
+	if banned {
+		harvestMetrics.Add("bans", 1)
+		g.log.Warn("banned client for address harvesting",
+			zap.String("ip", ip),
+			zap.Int("attempts", len(attempts)),
+			zap.Duration("duration", g.ban))
+		if len(g.command) > 0 {
+			go g.runCommand(ip)
+		}
+	}
+	return banned
+}
+
+// Banned reports whether the client at |addr| is banned.
+func (g *harvestGuard) Banned(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if g == nil || ip == "" {
+		return false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	until, ok := g.banned[ip]
+	if ok && g.now().After(until) {
+		delete(g.banned, ip)
+		return false
+	}
+	return ok
+}
+
+// expire forgets the bans and attempts that have lapsed, so that the maps do
+// not grow without bound. It must be called with mu held.
+func (g *harvestGuard) expire(now time.Time) {
+	for ip, until := range g.banned {
+		if now.After(until) {
+			delete(g.banned, ip)
+		}
+	}
+	for ip, attempts := range g.attempts {
+		if now.Sub(attempts[len(attempts)-1]) >= g.window {
+			delete(g.attempts, ip)
+		}
+	}
+}
+
+func (g *harvestGuard) runCommand(ip string) {
+	args := append(append([]string{}, g.command[1:]...), ip)
+	if out, err := exec.Command(g.command[0], args...).CombinedOutput(); err != nil {
+		g.log.Error("ban command failed",
+			zap.String("ip", ip),
+			zap.ByteString("output", out),
+			zap.Error(err))
+	}
+}
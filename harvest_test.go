@@ -0,0 +1,115 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestHarvestGuard(t *testing.T) {
+	g, err := newHarvestGuard(HarvestConfig{Threshold: 3, Window: "1m", BanDuration: "1h"}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2020, time.June, 1, 12, 0, 0, 0, time.UTC)
+	g.now = func() time.Time { return now }
+
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	other := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1234}
+
+	// Attempts outside the window do not count.
+	g.Record(client)
+	g.Record(client)
+	now = now.Add(2 * time.Minute)
+	if g.Record(client) || g.Record(client) {
+		t.Fatalf("Client banned before reaching the threshold")
+	}
+	if g.Record(other) {
+		t.Errorf("Attempts from another client were counted")
+	}
+	if !g.Record(client) {
+		t.Fatalf("Client not banned at the threshold")
+	}
+
+	// A new connection from another port is still banned.
+	if !g.Banned(&net.TCPAddr{IP: client.IP, Port: 5678}) {
+		t.Errorf("Want client banned")
+	}
+	if g.Banned(other) {
+		t.Errorf("Want other client not banned")
+	}
+
+	now = now.Add(61 * time.Minute)
+	if g.Banned(client) {
+		t.Errorf("Want ban to expire")
+	}
+
+	var nilGuard *harvestGuard
+	if nilGuard.Record(client) || nilGuard.Banned(client) {
+		t.Errorf("Want nil guard to ban no one")
+	}
+}
+
+func TestHarvestGuardConfig(t *testing.T) {
+	for _, config := range []HarvestConfig{
+		{Window: "soon"},
+		{BanDuration: "forever"},
+	} {
+		if _, err := newHarvestGuard(config, zap.NewNop()); err == nil {
+			t.Errorf("%+v: want error", config)
+		}
+	}
+}
+
+func TestHarvestBanCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harvest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "banned")
+
+	g, err := newHarvestGuard(HarvestConfig{
+		Threshold:  1,
+		BanCommand: []string{"sh", "-c", `echo "$1" > "$0"`, out},
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &smtpServer{harvest: g, log: zap.NewNop()}
+
+	rcpt := mail.Address{Address: "nobody@example.com"}
+	if !server.InvalidRecipient(&net.TCPAddr{IP: net.ParseIP("192.0.2.9")}, rcpt) {
+		t.Fatalf("Want client banned")
+	}
+
+	for i := 0; ; i++ {
+		data, err := ioutil.ReadFile(out)
+		if err == nil && strings.TrimSpace(string(data)) == "192.0.2.9" {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("Ban command was not run: %q, %v", data, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Trusted relays are never banned.
+	server.trustedRelays, _ = parseNets([]string{"10.0.0.7"})
+	if server.InvalidRecipient(&net.TCPAddr{IP: net.ParseIP("10.0.0.7")}, rcpt) {
+		t.Errorf("Want trusted relay not banned")
+	}
+}
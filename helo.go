@@ -0,0 +1,83 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"strconv"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+const (
+	HeloActionReject = "reject"
+	HeloActionScore  = "score"
+)
+
+var heloMetrics = expvar.NewMap("helo")
+
+var replyHeloRejected = smtp.ReplyLine{Code: 550, Message: "5.7.1 HELO name does not match the client's DNS"}
+
+// HeloPolicy applies an Action to inbound mail from clients whose HELO check
+// is one of Checks: "fail", "none" (no forward-confirmed reverse DNS),
+// "bare-ip", or "unresolvable". The "reject" action refuses the message. The
+// "score" action adds Score to the message's helo-score annotation.
+type HeloPolicy struct {
+	Checks []smtp.HeloCheck
+	Action string
+	Score  int
+}
+
+func validateHeloPolicies(policies []HeloPolicy) error {
+	for _, p := range policies {
+		switch p.Action {
+		case HeloActionReject, HeloActionScore:
+		default:
+			return fmt.Errorf("unknown HeloPolicies Action %q", p.Action)
+		}
+	}
+	return nil
+}
+
+func (p HeloPolicy) matches(check smtp.HeloCheck) bool {
+	for _, c := range p.Checks {
+		if c == check {
+			return true
+		}
+	}
+	return false
+}
+
+// applyHeloPolicies counts the HELO check of |en| and applies the
+// HeloPolicies to it. It returns a reply if the message is rejected.
+func (server *smtpServer) applyHeloPolicies(en *smtp.Envelope) *smtp.ReplyLine {
+	heloMetrics.Add(string(en.HeloCheck), 1)
+
+	matched, score := false, 0
+	for _, p := range server.config.HeloPolicies {
+		if !p.matches(en.HeloCheck) {
+			continue
+		}
+		if p.Action == HeloActionReject {
+			server.log.Info("rejected message by HELO policy",
+				zap.String("id", en.ID),
+				zap.String("helo", en.EHLO),
+				zap.String("helo-check", string(en.HeloCheck)))
+			heloMetrics.Add("rejected", 1)
+			return &replyHeloRejected
+		}
+		matched = true
+		score += p.Score
+	}
+	if matched {
+		en.Annotate("helo-score", strconv.Itoa(score))
+	}
+	return nil
+}
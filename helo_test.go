@@ -0,0 +1,63 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+func TestHeloPolicies(t *testing.T) {
+	server := smtpServer{
+		config: Config{HeloPolicies: []HeloPolicy{
+			{Checks: []smtp.HeloCheck{smtp.HeloCheckBareIP, smtp.HeloCheckUnresolvable}, Action: HeloActionReject},
+			{Checks: []smtp.HeloCheck{smtp.HeloCheckNone}, Action: HeloActionScore, Score: 2},
+			{Checks: []smtp.HeloCheck{smtp.HeloCheckNone, smtp.HeloCheckFail}, Action: HeloActionScore, Score: 1},
+		}},
+		log: zap.NewNop(),
+	}
+
+	cases := []struct {
+		check  smtp.HeloCheck
+		reject bool
+		score  string
+	}{
+		{smtp.HeloCheckPass, false, ""},
+		{smtp.HeloCheckFail, false, "1"},
+		{smtp.HeloCheckNone, false, "3"},
+		{smtp.HeloCheckBareIP, true, ""},
+		{smtp.HeloCheckUnresolvable, true, ""},
+	}
+	for _, c := range cases {
+		en := smtp.Envelope{ID: "m.1", HeloCheck: c.check}
+		reply := server.applyHeloPolicies(&en)
+		if want, got := c.reject, reply != nil; want != got {
+			t.Errorf("%s: want rejected %t, got %v", c.check, want, reply)
+		}
+		var score string
+		for _, a := range en.Annotations {
+			if a.Name == "helo-score" {
+				score = a.Value
+			}
+		}
+		if want, got := c.score, score; want != got {
+			t.Errorf("%s: want helo-score %q, got %q", c.check, want, got)
+		}
+	}
+}
+
+func TestValidateHeloPolicies(t *testing.T) {
+	if err := validateHeloPolicies([]HeloPolicy{{Action: HeloActionScore}}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := validateHeloPolicies([]HeloPolicy{{Action: "block"}}); err == nil {
+		t.Errorf("Want error for an unknown action")
+	}
+}
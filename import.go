@@ -0,0 +1,194 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/maildrop"
+	rfc5322 "src.bluestatic.org/mailpopbox/message"
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+// maxImportSize is the largest message that can be imported.
+const maxImportSize = 64 << 20
+
+var errEmptyMessage = errors.New("empty message")
+
+// importMessage stores the raw RFC 5322 message |data| in |md|, a maildrop or
+// folder of |s|, without going through SMTP. The sender is taken from the
+// message's Return-Path or From header, and the received time from its Date
+// header. It returns the message's ID.
+func importMessage(s *Server, md *maildrop.Maildrop, data []byte) (string, error) {
+	if len(data) == 0 {
+		return "", errEmptyMessage
+	}
+	header, _ := rfc5322.Parse(data)
+
+	now := time.Now()
+	en := smtp.Envelope{
+		RcptTo:   []mail.Address{{Address: MailboxAccount + s.Domain}},
+		Data:     data,
+		Received: now,
+		ID:       smtp.GenerateEnvelopeId("i", now),
+	}
+	if rp := strings.Trim(strings.TrimSpace(header.Get("Return-Path")), "<>"); rp != "" {
+		en.MailFrom.Address = rp
+	} else if from, err := mail.ParseAddress(header.Get("From")); err == nil {
+		en.MailFrom.Address = from.Address
+	}
+	if date, err := mail.ParseDate(header.Get("Date")); err == nil {
+		en.Received = date
+	}
+
+	if err := md.Deliver(en); err != nil {
+		return "", err
+	}
+	return en.ID, nil
+}
+
+// importHandler serves the /import admin endpoint, which imports the raw
+// message in a POST body into the maildrop of the "domain" parameter, or its
+// "folder".
+type importHandler struct {
+	config Config
+	events *mailboxEvents
+	log    *zap.Logger
+}
+
+func (h *importHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !adminAuthorized(h.config.AdminToken, req) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	s := h.config.serverForDomain(req.FormValue("domain"))
+	if s == nil {
+		http.Error(w, "no such domain", http.StatusNotFound)
+		return
+	}
+	md := maildrop.New(s.MaildropPath)
+	if folder := req.FormValue("folder"); folder != "" {
+		var err error
+		if md, err = md.CreateFolder(folder); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxImportSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	id, err := importMessage(s, md, data)
+	if err == errEmptyMessage {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		h.log.Error("failed to import message", zap.String("domain", s.Domain), zap.Error(err))
+		http.Error(w, "failed to store message", http.StatusInternalServerError)
+		return
+	}
+	h.log.Info("imported message", zap.String("id", id), zap.String("dir", md.Path()), zap.Int("size", len(data)))
+	h.events.publish(mailboxEvent{Kind: mailboxDelivered, Path: md.Path(), ID: id})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct{ ID string }{id})
+}
+
+// runImport implements the import subcommand, returning the exit code. It
+// imports each message file, or standard input if there are none.
+func runImport(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	configPath := flags.String("config", "config.json", "path to the configuration file")
+	domain := flags.String("domain", "", "the domain whose mailbox the messages are imported to")
+	folder := flags.String("folder", "", "the folder to import to, instead of the maildrop")
+	flags.Parse(args)
+
+	if *domain == "" {
+		fmt.Fprintf(os.Stderr, "Usage: %s import [-config config.json] -domain example.com [-folder name] [message.eml...]\n", os.Args[0])
+		return 1
+	}
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config file: %s\n", err)
+		return 2
+	}
+
+	server := config.serverForDomain(*domain)
+	if server == nil {
+		fmt.Fprintf(os.Stderr, "no server for domain %q\n", *domain)
+		return 3
+	}
+
+	md := maildrop.New(server.MaildropPath)
+	if *folder != "" {
+		if md, err = md.CreateFolder(*folder); err != nil {
+			fmt.Fprintf(os.Stderr, "open folder: %v\n", err)
+			return 3
+		}
+	}
+
+	files := flags.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, file := range files {
+		data, err := readImportFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "import %s: %v\n", file, err)
+			return 4
+		}
+		id, err := importMessage(server, md, data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "import %s: %v\n", file, err)
+			return 5
+		}
+		fmt.Printf("Imported %s as %s\n", file, id)
+	}
+	return 0
+}
+
+// readImportFile reads the message in |file|, or standard input if it is "-".
+func readImportFile(file string) ([]byte, error) {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxImportSize+1))
+	if err == nil && len(data) > maxImportSize {
+		err = fmt.Errorf("larger than %d bytes", maxImportSize)
+	}
+	return data, err
+}
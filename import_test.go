@@ -0,0 +1,101 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/maildrop"
+)
+
+func TestImportHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := &importHandler{
+		config: Config{
+			AdminToken: "s3cret",
+			Servers:    []Server{{Domain: "example.com", MaildropPath: dir}},
+		},
+		events: &mailboxEvents{},
+		log:    zap.NewNop(),
+	}
+	events := h.events.subscribe()
+
+	const msg = "From: Sender <from@sender.net>\r\nDate: Mon, 1 Jun 2020 12:00:00 +0000\r\nSubject: hi\r\n\r\nbody\r\n"
+	request := func(method, query, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/import?"+query, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	cases := []struct {
+		method, query, token, body string
+		status                     int
+	}{
+		{http.MethodGet, "domain=example.com", "s3cret", msg, http.StatusMethodNotAllowed},
+		{http.MethodPost, "domain=example.com", "", msg, http.StatusUnauthorized},
+		{http.MethodPost, "domain=example.com", "wrong", msg, http.StatusUnauthorized},
+		{http.MethodPost, "domain=other.com", "s3cret", msg, http.StatusNotFound},
+		{http.MethodPost, "domain=example.com&folder=..", "s3cret", msg, http.StatusBadRequest},
+		{http.MethodPost, "domain=example.com", "s3cret", "", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		if want, got := c.status, request(c.method, c.query, c.token, c.body).Code; want != got {
+			t.Errorf("%s %s: want status %d, got %d", c.method, c.query, want, got)
+		}
+	}
+
+	w := request(http.MethodPost, "domain=example.com", "s3cret", msg)
+	if want, got := http.StatusCreated, w.Code; want != got {
+		t.Fatalf("Want status %d, got %d: %s", want, got, w.Body.String())
+	}
+	var resp struct{ ID string }
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	md := maildrop.New(dir)
+	meta, err := md.Metadata(resp.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "from@sender.net", meta.MailFrom; want != got {
+		t.Errorf("Want MailFrom %q, got %q", want, got)
+	}
+	if want, got := time.Date(2020, time.June, 1, 12, 0, 0, 0, time.UTC), meta.Received; !want.Equal(got) {
+		t.Errorf("Want Received %v, got %v", want, got)
+	}
+	if want, got := []string{"mailbox@example.com"}, meta.RcptTo; len(got) != 1 || want[0] != got[0] {
+		t.Errorf("Want RcptTo %v, got %v", want, got)
+	}
+	if want, got := (mailboxEvent{Kind: mailboxDelivered, Path: dir, ID: resp.ID}), <-events; want != got {
+		t.Errorf("Want event %+v, got %+v", want, got)
+	}
+
+	// Without a token, the endpoint is disabled.
+	h.config.AdminToken = ""
+	if want, got := http.StatusUnauthorized, request(http.MethodPost, "domain=example.com", "", msg).Code; want != got {
+		t.Errorf("Want status %d, got %d", want, got)
+	}
+}
@@ -0,0 +1,385 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/chaos"
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+// shutdownTimeout is how long a graceful stop waits for connections to end
+// before they are left to be cut off.
+const shutdownTimeout = 30 * time.Second
+
+const (
+	// defaultCommandTimeout is the SMTP server timeout for waiting on the
+	// next command or line of DATA (RFC 5321 § 4.5.3.2.7).
+	defaultCommandTimeout = 5 * time.Minute
+	// defaultSessionTimeout bounds the length of an entire connection.
+	defaultSessionTimeout = time.Hour
+)
+
+// ListenerOptions are the settings shared by every protocol listener.
+type ListenerOptions struct {
+	// MaxConnections, if non-zero, is the most connections served at once.
+	// Clients beyond it are sent a protocol error and disconnected.
+	MaxConnections int
+
+	// ProxyFrom lists the IP addresses or CIDR ranges of proxies, like
+	// HAProxy, that send a PROXY protocol v1 header before each connection.
+	// For those connections, the client address is taken from the header.
+	ProxyFrom []string
+
+	// CommandTimeout and SessionTimeout are Go duration strings. A client
+	// that sends nothing for CommandTimeout, or stays connected past
+	// SessionTimeout, is disconnected. They default to 5m (10m for POP3)
+	// and 1h; "0" disables the timeout.
+	CommandTimeout string
+	SessionTimeout string
+
+	// RequireTLS, for SMTP listeners, refuses mail from clients that have
+	// not used STARTTLS.
+	RequireTLS bool
+
+	// ReceivedPrivacy, for SMTP listeners, hides the client of authenticated
+	// sessions in the Received header: "redact" replaces its EHLO name and
+	// address, and "omit" leaves out the from clause.
+	ReceivedPrivacy string
+
+	// SocketMode, for listeners on a unix socket, is the octal permissions
+	// of the socket, like "0660". By default, they follow the umask.
+	SocketMode string
+
+	// TrustSocketClients, for SMTP listeners on a unix socket, trusts every
+	// client of the socket like a TrustedRelays address, including its
+	// XCLIENT LOGIN. Only set it if SocketMode limits the socket to the
+	// users of a frontline MTA.
+	TrustSocketClients bool
+}
+
+// listeners is the set of open listeners, to be stopped on shutdown.
+var listeners = &listenerSet{listeners: make(map[*listener]struct{})}
+
+// listener accepts connections on a port for one protocol. It applies the
+// PROXY protocol, the access list, the connection limit, and implicit TLS,
+// and then hands each connection to the protocol.
+type listener struct {
+	name string
+	l    net.Listener
+
+	access *accessControl
+	proxy  []*net.IPNet
+	// proxyTimeout is how long a proxy has to send the PROXY header.
+	proxyTimeout time.Duration
+	// slots bounds the connections being served, if non-nil.
+	slots chan struct{}
+
+	// tlsConfig, if non-nil, wraps each connection in TLS, for protocols
+	// that start with it, like POP3S.
+	tlsConfig *tls.Config
+	// busy, if non-nil, writes the protocol's error to clients over the
+	// connection limit, unless the listener uses TLS.
+	busy func(net.Conn)
+
+	// commandTimeout and sessionTimeout, if non-zero, set the deadlines of
+	// each connection.
+	commandTimeout time.Duration
+	sessionTimeout time.Duration
+
+	log *zap.Logger
+
+	wg sync.WaitGroup
+}
+
+// listen opens the |name| listener on |port|.
+func listen(name string, port int, opts ListenerOptions, access *accessControl, log *zap.Logger) (*listener, error) {
+	return listenAddress(name, fmt.Sprintf(":%d", port), opts, access, log)
+}
+
+// listenAddress opens the |name| listener on |addr|, which is a TCP address,
+// or the path of a unix socket if it contains a slash. A stale socket left at
+// the path is replaced, but any other file is left for the listen to fail on.
+// The access lists, which are of IP addresses, do not apply to a unix socket.
+func listenAddress(name, addr string, opts ListenerOptions, access *accessControl, log *zap.Logger) (*listener, error) {
+	proxy, err := parseNets(opts.ProxyFrom)
+	if err != nil {
+		return nil, fmt.Errorf("ProxyFrom: %v", err)
+	}
+	commandTimeout, err := parseTimeout(opts.CommandTimeout, defaultCommandTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("CommandTimeout: %v", err)
+	}
+	sessionTimeout, err := parseTimeout(opts.SessionTimeout, defaultSessionTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("SessionTimeout: %v", err)
+	}
+
+	switch opts.ReceivedPrivacy {
+	case "", smtp.ReceivedPrivacyRedact, smtp.ReceivedPrivacyOmit:
+	default:
+		return nil, fmt.Errorf("ReceivedPrivacy: unknown value %q", opts.ReceivedPrivacy)
+	}
+
+	log.Info("starting server", zap.String("address", addr), zap.String("listener", name))
+
+	var socketMode uint64
+	if opts.SocketMode != "" {
+		if socketMode, err = strconv.ParseUint(opts.SocketMode, 8, 32); err != nil {
+			return nil, fmt.Errorf("SocketMode: %v", err)
+		}
+	}
+
+	network := listenNetwork(addr)
+	if opts.TrustSocketClients && network != "unix" {
+		return nil, fmt.Errorf("TrustSocketClients: %s is not a unix socket", addr)
+	}
+	if network == "unix" {
+		access = nil
+		if fi, err := os.Lstat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(addr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	nl, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" && opts.SocketMode != "" {
+		if err := os.Chmod(addr, os.FileMode(socketMode)); err != nil {
+			nl.Close()
+			return nil, err
+		}
+	}
+
+	l := &listener{
+		name:           name,
+		l:              nl,
+		access:         access,
+		proxy:          proxy,
+		proxyTimeout:   proxyHeaderTimeout,
+		commandTimeout: commandTimeout,
+		sessionTimeout: sessionTimeout,
+		log:            log.With(zap.String("listener", name)),
+	}
+	if opts.MaxConnections > 0 {
+		l.slots = make(chan struct{}, opts.MaxConnections)
+	}
+	listeners.add(l)
+	return l, nil
+}
+
+// listenNetwork returns the network of the listener address |addr|: "unix"
+// for the path of a unix socket, and otherwise "tcp".
+func listenNetwork(addr string) string {
+	if strings.Contains(addr, "/") {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// parseTimeout parses the duration |s|, which is |def| if empty.
+func parseTimeout(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("negative duration %q", s)
+	}
+	return d, err
+}
+
+// Addr returns the address the listener is bound to.
+func (l *listener) Addr() net.Addr {
+	return l.l.Addr()
+}
+
+// Serve accepts connections and calls |serve| for each on a new goroutine,
+// until the listener is closed. |serve| must close the connection.
+func (l *listener) Serve(serve func(net.Conn)) error {
+	for {
+		conn, err := l.l.Accept()
+		if err != nil {
+			l.log.Error("accept", zap.Error(err))
+			return err
+		}
+
+		if l.slots != nil {
+			select {
+			case l.slots <- struct{}{}:
+			default:
+				l.log.Warn("too many connections", zap.Stringer("client", conn.RemoteAddr()))
+				// The error cannot be sent before a TLS handshake.
+				if l.busy != nil && l.tlsConfig == nil {
+					conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+					l.busy(conn)
+				}
+				conn.Close()
+				continue
+			}
+		}
+
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			if l.slots != nil {
+				defer func() { <-l.slots }()
+			}
+			if conn := l.prepare(conn); conn != nil {
+				serve(conn)
+			}
+		}()
+	}
+}
+
+// prepare applies the PROXY protocol, access list, timeouts, and TLS to
+// |conn|. It returns nil if the connection was refused. A proxy that does not
+// send its header within the proxyTimeout is disconnected.
+func (l *listener) prepare(conn net.Conn) net.Conn {
+	if l.isProxy(conn.RemoteAddr()) {
+		pc, err := readProxyHeader(conn, l.proxyTimeout)
+		if err != nil {
+			l.log.Warn("invalid PROXY header", zap.Stringer("proxy", conn.RemoteAddr()), zap.Error(err))
+			conn.Close()
+			return nil
+		}
+		conn = pc
+	}
+
+	if !l.access.Allowed(conn.RemoteAddr()) {
+		l.log.Info("refused connection", zap.Stringer("client", conn.RemoteAddr()))
+		conn.Close()
+		return nil
+	}
+
+	if l.commandTimeout > 0 || l.sessionTimeout > 0 {
+		conn = newTimeoutConn(conn, l.commandTimeout, l.sessionTimeout)
+	}
+	if l.tlsConfig != nil {
+		conn = tls.Server(conn, l.tlsConfig)
+	}
+	return chaos.WrapConn(conn)
+}
+
+func (l *listener) isProxy(addr net.Addr) bool {
+	if len(l.proxy) == 0 {
+		return false
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && containsIP(l.proxy, tcpAddr.IP)
+}
+
+// Close stops accepting connections, leaving the ones being served to run.
+func (l *listener) Close() error {
+	listeners.remove(l)
+	return l.l.Close()
+}
+
+// Shutdown stops accepting connections and waits up to |timeout| for the
+// ones being served to end. It reports whether they all did.
+func (l *listener) Shutdown(timeout time.Duration) bool {
+	l.Close()
+
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// timeoutConn sets the deadline of each read to the command timeout, but no
+// later than the end of the session, so that a timed-out read returns a
+// net.Error whose Timeout() is true. Writes only get the command timeout, so
+// that the protocol can still say goodbye at the end of the session.
+type timeoutConn struct {
+	net.Conn
+	idle time.Duration
+	end  time.Time // Zero if there is no session timeout.
+}
+
+func newTimeoutConn(conn net.Conn, idle, session time.Duration) *timeoutConn {
+	c := &timeoutConn{Conn: conn, idle: idle}
+	if session > 0 {
+		c.end = time.Now().Add(session)
+	}
+	return c
+}
+
+func (c *timeoutConn) deadline() time.Time {
+	if c.idle <= 0 {
+		return c.end
+	}
+	d := time.Now().Add(c.idle)
+	if !c.end.IsZero() && c.end.Before(d) {
+		return c.end
+	}
+	return d
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(c.deadline())
+	return c.Conn.Read(b)
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	if c.idle > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.idle))
+	}
+	return c.Conn.Write(b)
+}
+
+type listenerSet struct {
+	mu        sync.Mutex
+	listeners map[*listener]struct{}
+}
+
+func (s *listenerSet) add(l *listener) {
+	s.mu.Lock()
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+}
+
+func (s *listenerSet) remove(l *listener) {
+	s.mu.Lock()
+	delete(s.listeners, l)
+	s.mu.Unlock()
+}
+
+// Shutdown gracefully stops all the open listeners, sharing |timeout|.
+func (s *listenerSet) Shutdown(timeout time.Duration, log *zap.Logger) {
+	s.mu.Lock()
+	all := make([]*listener, 0, len(s.listeners))
+	for l := range s.listeners {
+		all = append(all, l)
+	}
+	s.mu.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for _, l := range all {
+		if !l.Shutdown(time.Until(deadline)) {
+			log.Warn("connections still open at shutdown", zap.String("listener", l.name))
+		}
+	}
+}
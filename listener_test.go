@@ -0,0 +1,367 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// servedConn is a connection being served by runTestListener, which is
+// served until it is closed.
+type servedConn struct {
+	net.Conn
+	closed chan struct{}
+}
+
+func (c *servedConn) Close() error {
+	close(c.closed)
+	return c.Conn.Close()
+}
+
+// runTestListener serves a listener on a random port, sending each
+// connection to the returned channel.
+func runTestListener(t *testing.T, opts ListenerOptions, access *accessControl, busy func(net.Conn)) (*listener, <-chan net.Conn) {
+	l, err := listen("test", 0, opts, access, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.busy = busy
+	t.Cleanup(func() { l.Close() })
+
+	connChan := make(chan net.Conn)
+	go l.Serve(func(conn net.Conn) {
+		sc := &servedConn{Conn: conn, closed: make(chan struct{})}
+		connChan <- sc
+		<-sc.closed
+	})
+	return l, connChan
+}
+
+func dialTestListener(t *testing.T, l *listener) net.Conn {
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func TestListenerAccess(t *testing.T) {
+	ac, err := newAccessControl(AccessList{Deny: []string{"127.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, connChan := runTestListener(t, ListenerOptions{}, ac, nil)
+
+	conn := dialTestListener(t, l)
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Want refused connection to be closed, got %v", err)
+	}
+	conn.Close()
+
+	ac.Update(AccessList{})
+	conn = dialTestListener(t, l)
+	defer conn.Close()
+	select {
+	case c := <-connChan:
+		c.Close()
+	case <-time.After(5 * time.Second):
+		t.Errorf("Allowed connection was not accepted")
+	}
+}
+
+func TestListenerUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listener")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A stale socket is replaced.
+	path := filepath.Join(dir, "lmtp.sock")
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	// The access list, of IP addresses, does not apply to unix clients.
+	ac, err := newAccessControl(AccessList{Allow: []string{"192.0.2.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := listenAddress("test", path, ListenerOptions{SocketMode: "0600"}, ac, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := os.FileMode(0600), fi.Mode().Perm(); want != got {
+		t.Errorf("Want socket mode %v, got %v", want, got)
+	}
+	go l.Serve(func(conn net.Conn) {
+		fmt.Fprintf(conn, "hello\r\n")
+		conn.Close()
+	})
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if want, got := "hello\r\n", line; want != got {
+		t.Errorf("Want %q, got %q (%v)", want, got, err)
+	}
+}
+
+func TestListenerSocketMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listener")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := listenAddress("test", filepath.Join(dir, "smtp.sock"), ListenerOptions{SocketMode: "rw"}, nil, zap.NewNop()); err == nil {
+		t.Errorf("Want error for an invalid SocketMode")
+	}
+}
+
+func TestListenerReceivedPrivacy(t *testing.T) {
+	if _, err := listen("test", 0, ListenerOptions{ReceivedPrivacy: "hide"}, nil, zap.NewNop()); err == nil {
+		t.Errorf("Want error for an unknown ReceivedPrivacy")
+	}
+	l, err := listen("test", 0, ListenerOptions{ReceivedPrivacy: "redact"}, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+}
+
+func TestListenerMaxConnections(t *testing.T) {
+	l, connChan := runTestListener(t, ListenerOptions{MaxConnections: 1}, nil, func(conn net.Conn) {
+		fmt.Fprintf(conn, "busy\r\n")
+	})
+
+	first := dialTestListener(t, l)
+	defer first.Close()
+	served := <-connChan
+
+	second := dialTestListener(t, l)
+	line, err := bufio.NewReader(second).ReadString('\n')
+	if want, got := "busy\r\n", line; want != got {
+		t.Errorf("Want %q, got %q (%v)", want, got, err)
+	}
+	second.Close()
+
+	// Once the first connection ends, its slot is free.
+	served.Close()
+	for i := 0; ; i++ {
+		third := dialTestListener(t, l)
+		select {
+		case c := <-connChan:
+			c.Close()
+			third.Close()
+			return
+		case <-time.After(100 * time.Millisecond):
+			third.Close()
+			if i == 20 {
+				t.Fatalf("Connection was not accepted after a slot was freed")
+			}
+		}
+	}
+}
+
+func TestListenerProxy(t *testing.T) {
+	ac, err := newAccessControl(AccessList{Deny: []string{"198.51.100.0/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, connChan := runTestListener(t, ListenerOptions{ProxyFrom: []string{"127.0.0.1"}}, ac, nil)
+
+	conn := dialTestListener(t, l)
+	defer conn.Close()
+	fmt.Fprintf(conn, "PROXY TCP4 192.0.2.7 203.0.113.1 4567 25\r\nhello")
+
+	select {
+	case c := <-connChan:
+		if want, got := "192.0.2.7:4567", c.RemoteAddr().String(); want != got {
+			t.Errorf("Want remote address %q, got %q", want, got)
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+			t.Errorf("Want data after header, got %q (%v)", buf, err)
+		}
+		c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Proxied connection was not accepted")
+	}
+
+	// The access list applies to the client, not the proxy.
+	conn = dialTestListener(t, l)
+	defer conn.Close()
+	fmt.Fprintf(conn, "PROXY TCP4 198.51.100.7 203.0.113.1 4567 25\r\n")
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Want denied client to be closed, got %v", err)
+	}
+}
+
+func TestListenerTimeouts(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		opts ListenerOptions
+	}{
+		{"command", ListenerOptions{CommandTimeout: "100ms"}},
+		{"session", ListenerOptions{CommandTimeout: "0", SessionTimeout: "300ms"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			l, connChan := runTestListener(t, c.opts, nil, nil)
+			conn := dialTestListener(t, l)
+			defer conn.Close()
+
+			served := <-connChan
+			defer served.Close()
+
+			// Activity keeps the connection open until the session ends.
+			start := time.Now()
+			buf := make([]byte, 1)
+			for i := 0; i < 3; i++ {
+				conn.Write([]byte("x"))
+				if _, err := served.Read(buf); err != nil {
+					t.Fatalf("Read %d: %v", i, err)
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+
+			_, err := served.Read(buf)
+			if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				t.Fatalf("Want timeout, got %v", err)
+			}
+			if c.opts.SessionTimeout != "" && time.Since(start) < 300*time.Millisecond {
+				t.Errorf("Session timed out early, after %v", time.Since(start))
+			}
+		})
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		want time.Duration
+		err  bool
+	}{
+		{"", time.Minute, false},
+		{"0", 0, false},
+		{"90s", 90 * time.Second, false},
+		{"-1s", 0, true},
+		{"soon", 0, true},
+	} {
+		got, err := parseTimeout(c.s, time.Minute)
+		if (err != nil) != c.err || (!c.err && got != c.want) {
+			t.Errorf("parseTimeout(%q): want %v (error %v), got %v (%v)", c.s, c.want, c.err, got, err)
+		}
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		remote string
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n", "192.0.2.1:56324"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 1234 110\r\n", "[2001:db8::1]:1234"},
+		{"PROXY UNKNOWN\r\n", "pipe"},
+		{"PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", "pipe"},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", ""},
+		{"PROXY TCP4 nowhere 198.51.100.1 56324 25\r\n", ""},
+		{"PROXY UDP4 192.0.2.1 198.51.100.1 56324 25\r\n", ""},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\n", ""},
+		{"EHLO example.com\r\n", ""},
+	} {
+		client, server := net.Pipe()
+		go func() {
+			client.Write([]byte(c.header))
+			client.Close()
+		}()
+
+		conn, err := readProxyHeader(server, proxyHeaderTimeout)
+		if c.remote == "" {
+			if err == nil {
+				t.Errorf("%q: want error", c.header)
+			}
+		} else if err != nil {
+			t.Errorf("%q: %v", c.header, err)
+		} else if want, got := c.remote, conn.RemoteAddr().String(); want != got {
+			t.Errorf("%q: want remote %q, got %q", c.header, want, got)
+		}
+		server.Close()
+	}
+}
+
+func TestProxyHeaderTimeout(t *testing.T) {
+	// A proxy that sends nothing is not waited on forever.
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	done := make(chan error)
+	go func() {
+		_, err := readProxyHeader(server, 10*time.Millisecond)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("Want error for a proxy that sent no header")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the PROXY header read to give up")
+	}
+}
+
+func TestListenerKeepsNonSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listener")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A file that is not a socket is not removed to make way for one.
+	path := filepath.Join(dir, "smtp")
+	if err := ioutil.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := listenAddress("test", path, ListenerOptions{}, nil, zap.NewNop()); err == nil {
+		l.Close()
+		t.Errorf("Want error listening over a file")
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "data" {
+		t.Errorf("Want file kept, got %q, %v", data, err)
+	}
+}
+
+func TestListenerTrustSocketClients(t *testing.T) {
+	if l, err := listenAddress("test", "127.0.0.1:0", ListenerOptions{TrustSocketClients: true}, nil, zap.NewNop()); err == nil {
+		l.Close()
+		t.Errorf("Want error for TrustSocketClients on a TCP address")
+	}
+}
@@ -0,0 +1,38 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+// Package logger defines the structured logging interface of the smtp and
+// pop3 packages, so that programs embedding them can use any logging library.
+// Package zaplogger adapts a zap.Logger to it.
+package logger
+
+// Logger writes structured log messages. Each message is followed by
+// alternating keys, which are strings, and values.
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+
+	// With returns a Logger that adds |keysAndValues| to each message.
+	With(keysAndValues ...interface{}) Logger
+}
+
+// Nop returns a Logger that discards every message.
+func Nop() Logger {
+	return nop{}
+}
+
+type nop struct{}
+
+func (nop) Debug(string, ...interface{}) {}
+func (nop) Info(string, ...interface{})  {}
+func (nop) Warn(string, ...interface{})  {}
+func (nop) Error(string, ...interface{}) {}
+
+func (n nop) With(...interface{}) Logger {
+	return n
+}
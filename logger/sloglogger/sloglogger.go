@@ -0,0 +1,47 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+//go:build go1.21
+// +build go1.21
+
+// Package sloglogger adapts a log/slog Logger to a logger.Logger.
+package sloglogger
+
+import (
+	"context"
+	"log/slog"
+
+	"src.bluestatic.org/mailpopbox/logger"
+)
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// New returns a logger.Logger that writes to |l|.
+func New(l *slog.Logger) logger.Logger {
+	return slogLogger{l}
+}
+
+func (l slogLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.l.Log(context.Background(), slog.LevelDebug, msg, keysAndValues...)
+}
+
+func (l slogLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.l.Log(context.Background(), slog.LevelInfo, msg, keysAndValues...)
+}
+
+func (l slogLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.l.Log(context.Background(), slog.LevelWarn, msg, keysAndValues...)
+}
+
+func (l slogLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.l.Log(context.Background(), slog.LevelError, msg, keysAndValues...)
+}
+
+func (l slogLogger) With(keysAndValues ...interface{}) logger.Logger {
+	return slogLogger{l.l.With(keysAndValues...)}
+}
@@ -0,0 +1,43 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+//go:build go1.21
+// +build go1.21
+
+package sloglogger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	h := slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})
+	log := New(slog.New(h)).With("client", "192.0.2.1")
+
+	log.Debug("hidden")
+	log.Warn("failed", "error", errors.New("boom"), "attempts", 3)
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Want one JSON record, got %q: %v", buf.String(), err)
+	}
+	for key, want := range map[string]interface{}{
+		"level":    "WARN",
+		"msg":      "failed",
+		"client":   "192.0.2.1",
+		"error":    "boom",
+		"attempts": float64(3),
+	} {
+		if got := record[key]; want != got {
+			t.Errorf("Want %s %v, got %v", key, want, got)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+// Package zaplogger adapts a zap.Logger to a logger.Logger.
+package zaplogger
+
+import (
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/logger"
+)
+
+type zapLogger struct {
+	s *zap.SugaredLogger
+}
+
+// New returns a logger.Logger that writes to |l|, encoding values as with
+// zap.Any.
+func New(l *zap.Logger) logger.Logger {
+	return zapLogger{l.WithOptions(zap.AddCallerSkip(1)).Sugar()}
+}
+
+func (l zapLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.s.Debugw(msg, keysAndValues...)
+}
+
+func (l zapLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.s.Infow(msg, keysAndValues...)
+}
+
+func (l zapLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.s.Warnw(msg, keysAndValues...)
+}
+
+func (l zapLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.s.Errorw(msg, keysAndValues...)
+}
+
+func (l zapLogger) With(keysAndValues ...interface{}) logger.Logger {
+	return zapLogger{l.s.With(keysAndValues...)}
+}
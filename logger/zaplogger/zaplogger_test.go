@@ -0,0 +1,43 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package zaplogger
+
+import (
+	"errors"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLogger(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	log := New(zap.New(core)).With("client", "192.0.2.1")
+
+	log.Debug("hidden")
+	log.Warn("failed", "error", errors.New("boom"), "attempts", 3)
+
+	entries := logs.AllUntimed()
+	if want, got := 1, len(entries); want != got {
+		t.Fatalf("Want %d entry, got %d", want, got)
+	}
+	e := entries[0]
+	if want, got := zapcore.WarnLevel, e.Level; want != got {
+		t.Errorf("Want level %v, got %v", want, got)
+	}
+	fields := e.ContextMap()
+	if want, got := "192.0.2.1", fields["client"]; want != got {
+		t.Errorf("Want client %q, got %v", want, got)
+	}
+	if want, got := "boom", fields["error"]; want != got {
+		t.Errorf("Want error %q, got %v", want, got)
+	}
+	if want, got := int64(3), fields["attempts"]; want != got {
+		t.Errorf("Want attempts %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,47 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// LogConfig sets where the server writes its log, which by default is
+// only the console log on standard error.
+type LogConfig struct {
+	// SlogPath, if set, also writes each message as JSON through log/slog,
+	// to this file, or to standard output if it is "-". It requires a binary
+	// built with Go 1.21 or later.
+	SlogPath string
+
+	// SlogOnly turns off the console log, when SlogPath is set.
+	SlogOnly bool
+}
+
+// newLogger creates the server's logger from |config|.
+func newLogger(config *LogConfig) (*zap.Logger, error) {
+	logConfig := zap.NewDevelopmentConfig()
+	logConfig.Development = false
+	logConfig.DisableStacktrace = true
+	logConfig.Level.SetLevel(zap.DebugLevel)
+	log, err := logConfig.Build()
+	if err != nil || config == nil || config.SlogPath == "" {
+		return log, err
+	}
+
+	slogCore, err := newSlogCore(config.SlogPath)
+	if err != nil {
+		return nil, err
+	}
+	return log.WithOptions(zap.WrapCore(func(console zapcore.Core) zapcore.Core {
+		if config.SlogOnly {
+			return slogCore
+		}
+		return zapcore.NewTee(console, slogCore)
+	})), nil
+}
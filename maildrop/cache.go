@@ -0,0 +1,81 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package maildrop
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// ListCache holds the listings of maildrops, so that a maildrop with many
+// messages is not re-read on every login. A listing is reused until the
+// maildrop directory's modification time changes or it is explicitly
+// invalidated. A nil ListCache does no caching.
+type ListCache struct {
+	mu         sync.Mutex
+	generation uint64
+	listings   map[string]cachedListing
+}
+
+type cachedListing struct {
+	modTime time.Time
+	entries []Entry
+}
+
+func NewListCache() *ListCache {
+	return &ListCache{listings: make(map[string]cachedListing)}
+}
+
+// List returns the messages in |md|, like Maildrop.List.
+func (c *ListCache) List(md *Maildrop) ([]Entry, error) {
+	if c == nil {
+		return md.List()
+	}
+
+	fi, err := os.Stat(md.path)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	cached, ok := c.listings[md.path]
+	generation := c.generation
+	c.mu.Unlock()
+
+	if ok && cached.modTime.Equal(fi.ModTime()) {
+		return append([]Entry(nil), cached.entries...), nil
+	}
+
+	entries, err := md.List()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	// Do not store a listing that raced with an invalidation, since it may
+	// not include the change.
+	if c.generation == generation {
+		c.listings[md.path] = cachedListing{modTime: fi.ModTime(), entries: entries}
+	}
+	c.mu.Unlock()
+
+	return append([]Entry(nil), entries...), nil
+}
+
+// Invalidate discards the listing of the maildrop at |path|. This is needed
+// when the filesystem's timestamp granularity is too coarse to observe a
+// change.
+func (c *ListCache) Invalidate(path string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.generation++
+	delete(c.listings, path)
+	c.mu.Unlock()
+}
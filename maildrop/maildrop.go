@@ -0,0 +1,380 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+// Package maildrop stores delivered messages on disk. Each message is a pair
+// of files named by its envelope ID: the raw RFC 5322 message in ID.msg, and
+// its envelope metadata and flags in ID.meta.
+package maildrop
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"src.bluestatic.org/mailpopbox/chaos"
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+// Version is the current version of the on-disk message layout. Version 0 is
+// a bare .msg file without metadata, as written by mailpopbox 2.1 and
+// earlier.
+const Version = 1
+
+const (
+	MessageExt  = ".msg"
+	MetadataExt = ".meta"
+)
+
+// Metadata is stored alongside each message.
+type Metadata struct {
+	Version int
+
+	ID         string
+	MailFrom   string
+	RcptTo     []string
+	Received   time.Time
+	RemoteAddr string `json:",omitempty"`
+	EHLO       string `json:",omitempty"`
+	// TLS is nil if the message was received without TLS.
+	TLS       *smtp.TLSInfo  `json:",omitempty"`
+	HeloCheck smtp.HeloCheck `json:",omitempty"`
+
+	// Annotations are the notes attached by filters before delivery.
+	Annotations []smtp.Annotation `json:",omitempty"`
+
+	// Flags are markers attached to the message after delivery.
+	Flags []string `json:",omitempty"`
+}
+
+// Entry is a message in a maildrop listing.
+type Entry struct {
+	ID      string
+	Size    int64
+	ModTime time.Time
+}
+
+type Maildrop struct {
+	path string
+}
+
+func New(path string) *Maildrop {
+	return &Maildrop{path: path}
+}
+
+func (md *Maildrop) Path() string {
+	return md.path
+}
+
+// Folder returns the maildrop stored in the subdirectory |name|, which holds
+// messages set aside from the main maildrop, such as quarantined mail. The
+// folder must already exist.
+func (md *Maildrop) Folder(name string) (*Maildrop, error) {
+	if !validFolderName(name) {
+		return nil, fmt.Errorf("maildrop: invalid folder name %q", name)
+	}
+	path := filepath.Join(md.path, name)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("maildrop: %s is not a folder", path)
+	}
+	return New(path), nil
+}
+
+// CreateFolder returns the folder |name|, like Folder, creating it if it does
+// not exist.
+func (md *Maildrop) CreateFolder(name string) (*Maildrop, error) {
+	if !validFolderName(name) {
+		return nil, fmt.Errorf("maildrop: invalid folder name %q", name)
+	}
+	if err := os.Mkdir(filepath.Join(md.path, name), 0700); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	return md.Folder(name)
+}
+
+func validFolderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+func (md *Maildrop) messagePath(id string) string {
+	return filepath.Join(md.path, id+MessageExt)
+}
+
+func (md *Maildrop) metadataPath(id string) string {
+	return filepath.Join(md.path, id+MetadataExt)
+}
+
+// Deliver stores the envelope's message and metadata. If either cannot be
+// written, nothing of the message is left in the maildrop.
+func (md *Maildrop) Deliver(en smtp.Envelope) error {
+	if err := chaos.DiskError("deliver"); err != nil {
+		return err
+	}
+
+	path := md.messagePath(en.ID)
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := smtp.WriteEnvelopeForDelivery(f, en); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	meta := Metadata{
+		Version:   Version,
+		ID:        en.ID,
+		MailFrom:  en.MailFrom.Address,
+		Received:  en.Received,
+		EHLO:      en.EHLO,
+		TLS:       en.TLS,
+		HeloCheck: en.HeloCheck,
+
+		Annotations: en.Annotations,
+	}
+	for _, rcpt := range en.RcptTo {
+		meta.RcptTo = append(meta.RcptTo, rcpt.Address)
+	}
+	if en.RemoteAddr != nil {
+		meta.RemoteAddr = en.RemoteAddr.String()
+	}
+	if err := md.WriteMetadata(meta); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// List returns the messages in the maildrop, ordered by ID.
+func (md *Maildrop) List() ([]Entry, error) {
+	files, err := ioutil.ReadDir(md.path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(files))
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != MessageExt {
+			continue
+		}
+		entries = append(entries, Entry{
+			ID:      strings.TrimSuffix(file.Name(), MessageExt),
+			Size:    file.Size(),
+			ModTime: file.ModTime(),
+		})
+	}
+	return entries, nil
+}
+
+// Usage returns the total size of the messages in the maildrop.
+func (md *Maildrop) Usage() (int64, error) {
+	entries, err := md.List()
+	if err != nil {
+		return 0, err
+	}
+	var usage int64
+	for _, entry := range entries {
+		usage += entry.Size
+	}
+	return usage, nil
+}
+
+// ListOldest returns the messages in the maildrop, least recently delivered
+// first, which is the order that TrimOldest removes them in.
+func (md *Maildrop) ListOldest() ([]Entry, error) {
+	entries, err := md.List()
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].ModTime.Before(entries[j].ModTime)
+	})
+	return entries, nil
+}
+
+// TrimOldest removes the least recently delivered messages until the
+// maildrop's Usage is at most |size|. It returns the removed messages.
+func (md *Maildrop) TrimOldest(size int64) ([]Entry, error) {
+	entries, err := md.ListOldest()
+	if err != nil {
+		return nil, err
+	}
+
+	var usage int64
+	for _, entry := range entries {
+		usage += entry.Size
+	}
+
+	var removed []Entry
+	for _, entry := range entries {
+		if usage <= size {
+			break
+		}
+		if err := md.Remove(entry.ID); err != nil {
+			return removed, err
+		}
+		usage -= entry.Size
+		removed = append(removed, entry)
+	}
+	return removed, nil
+}
+
+// Open returns the raw message content.
+func (md *Maildrop) Open(id string) (*os.File, error) {
+	return os.Open(md.messagePath(id))
+}
+
+// Metadata returns the metadata for a message. Version 0 messages have their
+// metadata reconstructed from the delivery headers.
+func (md *Maildrop) Metadata(id string) (Metadata, error) {
+	var meta Metadata
+
+	f, err := os.Open(md.metadataPath(id))
+	if os.IsNotExist(err) {
+		return md.legacyMetadata(id)
+	}
+	if err != nil {
+		return meta, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(&meta); err != nil {
+		return meta, fmt.Errorf("maildrop: %s: %v", id, err)
+	}
+	if meta.Version > Version {
+		return meta, fmt.Errorf("maildrop: %s: unsupported version %d", id, meta.Version)
+	}
+	return meta, nil
+}
+
+// WriteMetadata replaces the stored metadata for a message.
+func (md *Maildrop) WriteMetadata(meta Metadata) error {
+	meta.Version = Version
+
+	if err := chaos.DiskError("write metadata"); err != nil {
+		return err
+	}
+
+	tmp := md.metadataPath(meta.ID) + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(meta); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, md.metadataPath(meta.ID)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Remove deletes a message and its metadata.
+func (md *Maildrop) Remove(id string) error {
+	if err := os.Remove(md.messagePath(id)); err != nil {
+		return err
+	}
+	if err := os.Remove(md.metadataPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Migrate upgrades all messages in the maildrop to the current Version,
+// returning the number of messages that were changed.
+func (md *Maildrop) Migrate() (int, error) {
+	entries, err := md.List()
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, entry := range entries {
+		meta, err := md.Metadata(entry.ID)
+		if err != nil {
+			return migrated, err
+		}
+		if meta.Version == Version {
+			continue
+		}
+		if err := md.WriteMetadata(meta); err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	return migrated, nil
+}
+
+// legacyMetadata builds the metadata for a version 0 message from the
+// Delivered-To and Return-Path headers written by WriteEnvelopeForDelivery.
+func (md *Maildrop) legacyMetadata(id string) (Metadata, error) {
+	meta := Metadata{
+		Version: 0,
+		ID:      id,
+	}
+
+	f, err := md.Open(id)
+	if err != nil {
+		return meta, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return meta, err
+	}
+	meta.Received = fi.ModTime()
+
+	header, err := textproto.NewReader(bufio.NewReader(f)).ReadMIMEHeader()
+	if err != nil && err != io.EOF && len(header) == 0 {
+		// Not a parseable message, but it is still a message.
+		return meta, nil
+	}
+
+	if rcpt := trimAngle(header.Get("Delivered-To")); rcpt != "" {
+		meta.RcptTo = []string{rcpt}
+	}
+	meta.MailFrom = trimAngle(header.Get("Return-Path"))
+
+	return meta, nil
+}
+
+func trimAngle(s string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(s), "<"), ">")
+}
@@ -0,0 +1,416 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package maildrop
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+func newTestMaildrop(t testing.TB) *Maildrop {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return New(dir)
+}
+
+func TestDeliver(t *testing.T) {
+	md := newTestMaildrop(t)
+
+	received := time.Date(2020, time.June, 1, 12, 0, 0, 0, time.UTC)
+	en := smtp.Envelope{
+		RemoteAddr: &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)},
+		EHLO:       "mx.sender.net",
+		MailFrom:   mail.Address{Address: "from@sender.net"},
+		RcptTo:     []mail.Address{{Address: "a@example.com"}, {Address: "b@example.com"}},
+		Data:       []byte("Subject: hello\r\n\r\nworld\r\n"),
+		Received:   received,
+		ID:         "m.1234",
+		TLS:        &smtp.TLSInfo{Version: "TLSv1.3", CipherSuite: "TLS_AES_128_GCM_SHA256"},
+	}
+	en.AddHeader("X-Spam-Score", "4.5")
+	en.Annotate("spam-score", "4.5")
+	en.Annotate("rule", "FREE_MONEY")
+	if err := md.Deliver(en); err != nil {
+		t.Fatalf("Failed to deliver: %v", err)
+	}
+
+	entries, err := md.List()
+	if err != nil {
+		t.Fatalf("Failed to list: %v", err)
+	}
+	if want, got := 1, len(entries); want != got {
+		t.Fatalf("Want %d message, got %d", want, got)
+	}
+	if want, got := en.ID, entries[0].ID; want != got {
+		t.Errorf("Want ID %q, got %q", want, got)
+	}
+
+	f, err := md.Open(en.ID)
+	if err != nil {
+		t.Fatalf("Failed to open message: %v", err)
+	}
+	data, _ := ioutil.ReadAll(f)
+	f.Close()
+	if !bytes.HasSuffix(data, append([]byte("X-Spam-Score: 4.5\r\n"), en.Data...)) {
+		t.Errorf("Stored message does not contain header and data: %q", data)
+	}
+	if want, got := int64(len(data)), entries[0].Size; want != got {
+		t.Errorf("Want size %d, got %d", want, got)
+	}
+
+	meta, err := md.Metadata(en.ID)
+	if err != nil {
+		t.Fatalf("Failed to read metadata: %v", err)
+	}
+	if want, got := Version, meta.Version; want != got {
+		t.Errorf("Want version %d, got %d", want, got)
+	}
+	if want, got := "from@sender.net", meta.MailFrom; want != got {
+		t.Errorf("Want MailFrom %q, got %q", want, got)
+	}
+	if want, got := 2, len(meta.RcptTo); want != got {
+		t.Errorf("Want %d RcptTo, got %d", want, got)
+	}
+	if !meta.Received.Equal(received) {
+		t.Errorf("Want Received %v, got %v", received, meta.Received)
+	}
+	if want, got := "192.0.2.1", meta.RemoteAddr; want != got {
+		t.Errorf("Want RemoteAddr %q, got %q", want, got)
+	}
+	if meta.TLS == nil || *meta.TLS != *en.TLS {
+		t.Errorf("Want TLS %v, got %v", en.TLS, meta.TLS)
+	}
+	if want, got := fmt.Sprint(en.Annotations), fmt.Sprint(meta.Annotations); want != got {
+		t.Errorf("Want Annotations %s, got %s", want, got)
+	}
+
+	if err := md.Remove(en.ID); err != nil {
+		t.Errorf("Failed to remove: %v", err)
+	}
+	files, _ := ioutil.ReadDir(md.Path())
+	if want, got := 0, len(files); want != got {
+		t.Errorf("Want %d files after Remove, got %d", want, got)
+	}
+}
+
+func TestDeliverFailure(t *testing.T) {
+	md := newTestMaildrop(t)
+
+	// A non-empty directory in place of the metadata makes it fail to write.
+	en := smtp.Envelope{
+		MailFrom: mail.Address{Address: "from@sender.net"},
+		RcptTo:   []mail.Address{{Address: "a@example.com"}},
+		Data:     []byte("Subject: hello\r\n\r\nworld\r\n"),
+		ID:       "m.1234",
+	}
+	blocker := filepath.Join(md.metadataPath(en.ID), "x")
+	if err := os.MkdirAll(blocker, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := md.Deliver(en); err == nil {
+		t.Fatalf("Want delivery to fail")
+	}
+
+	files, _ := ioutil.ReadDir(md.Path())
+	if want, got := 1, len(files); want != got || files[0].Name() != en.ID+MetadataExt {
+		t.Errorf("Want only the blocking directory left, got %d files", got)
+	}
+}
+
+func TestCreateFolder(t *testing.T) {
+	md := newTestMaildrop(t)
+
+	if _, err := md.Folder("sent"); err == nil {
+		t.Errorf("Want error opening missing folder")
+	}
+	for i := 0; i < 2; i++ {
+		folder, err := md.CreateFolder("sent")
+		if err != nil {
+			t.Fatalf("Failed to create folder: %v", err)
+		}
+		if want, got := filepath.Join(md.Path(), "sent"), folder.Path(); want != got {
+			t.Errorf("Want folder %q, got %q", want, got)
+		}
+	}
+	if _, err := md.CreateFolder("../sent"); err == nil {
+		t.Errorf("Want error creating invalid folder")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	md := newTestMaildrop(t)
+
+	legacy := "Delivered-To: <rcpt@example.com>\r\nReturn-Path: <sender@other.net>\r\nSubject: old\r\n\r\nbody\r\n"
+	if err := ioutil.WriteFile(filepath.Join(md.Path(), "m.old.msg"), []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(md.Path(), "garbage.msg"), []byte("\x00\x01"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := md.Metadata("m.old")
+	if err != nil {
+		t.Fatalf("Failed to read legacy metadata: %v", err)
+	}
+	if want, got := 0, meta.Version; want != got {
+		t.Errorf("Want version %d, got %d", want, got)
+	}
+
+	migrated, err := md.Migrate()
+	if err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+	if want, got := 2, migrated; want != got {
+		t.Errorf("Want %d migrated, got %d", want, got)
+	}
+
+	meta, err = md.Metadata("m.old")
+	if err != nil {
+		t.Fatalf("Failed to read migrated metadata: %v", err)
+	}
+	if want, got := Version, meta.Version; want != got {
+		t.Errorf("Want version %d, got %d", want, got)
+	}
+	if want, got := "sender@other.net", meta.MailFrom; want != got {
+		t.Errorf("Want MailFrom %q, got %q", want, got)
+	}
+	if len(meta.RcptTo) != 1 || meta.RcptTo[0] != "rcpt@example.com" {
+		t.Errorf("Unexpected RcptTo %v", meta.RcptTo)
+	}
+
+	migrated, err = md.Migrate()
+	if err != nil || migrated != 0 {
+		t.Errorf("Second migration should be a no-op, got %d, %v", migrated, err)
+	}
+
+	entries, _ := md.List()
+	if want, got := 2, len(entries); want != got {
+		t.Errorf("Metadata files should not be listed as messages, got %d entries", got)
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	md := newTestMaildrop(t)
+
+	ioutil.WriteFile(filepath.Join(md.Path(), "m.new.msg"), []byte("Subject: x\r\n\r\n"), 0600)
+	ioutil.WriteFile(filepath.Join(md.Path(), "m.new.meta"), []byte(`{"Version": 99, "ID": "m.new"}`), 0600)
+
+	if _, err := md.Metadata("m.new"); err == nil {
+		t.Errorf("Expected error reading metadata from a newer version")
+	}
+}
+
+func TestListCache(t *testing.T) {
+	md := newTestMaildrop(t)
+	cache := NewListCache()
+
+	deliver := func(id string) {
+		err := md.Deliver(smtp.Envelope{
+			MailFrom: mail.Address{Address: "from@sender.net"},
+			RcptTo:   []mail.Address{{Address: "to@example.com"}},
+			Data:     []byte("Subject: " + id + "\r\n\r\nbody\r\n"),
+			ID:       id,
+		})
+		if err != nil {
+			t.Fatalf("Failed to deliver %s: %v", id, err)
+		}
+	}
+	list := func() []Entry {
+		entries, err := cache.List(md)
+		if err != nil {
+			t.Fatalf("Failed to list: %v", err)
+		}
+		return entries
+	}
+
+	stamp := time.Date(2020, time.June, 1, 12, 0, 0, 0, time.UTC)
+	setModTime := func(t2 time.Time) {
+		if err := os.Chtimes(md.Path(), t2, t2); err != nil {
+			t.Fatalf("Failed to set mtime: %v", err)
+		}
+	}
+
+	deliver("m.1")
+	setModTime(stamp)
+	if want, got := 1, len(list()); want != got {
+		t.Errorf("Want %d entries, got %d", want, got)
+	}
+
+	// A change that does not update the mtime is not observed.
+	deliver("m.2")
+	setModTime(stamp)
+	if want, got := 1, len(list()); want != got {
+		t.Errorf("Want %d cached entries, got %d", want, got)
+	}
+
+	// Until the listing is invalidated.
+	cache.Invalidate(md.Path())
+	if want, got := 2, len(list()); want != got {
+		t.Errorf("Want %d entries after invalidation, got %d", want, got)
+	}
+
+	// A changed mtime also re-reads the listing.
+	deliver("m.3")
+	setModTime(stamp.Add(time.Second))
+	entries := list()
+	if want, got := 3, len(entries); want != got {
+		t.Errorf("Want %d entries after mtime change, got %d", want, got)
+	}
+
+	// Callers may modify the returned listing.
+	entries[0].ID = "changed"
+	if want, got := "m.1", list()[0].ID; want != got {
+		t.Errorf("Want first ID %q, got %q", want, got)
+	}
+}
+
+func TestTrimOldest(t *testing.T) {
+	md := newTestMaildrop(t)
+
+	start := time.Now().Add(-time.Hour)
+	for i, id := range []string{"m.3", "m.1", "m.2"} {
+		path := filepath.Join(md.Path(), id+MessageExt)
+		if err := ioutil.WriteFile(path, bytes.Repeat([]byte("x"), 100), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := start.Add(time.Duration(i) * time.Minute)
+		os.Chtimes(path, mtime, mtime)
+	}
+
+	usage, err := md.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := int64(300), usage; want != got {
+		t.Errorf("Want usage %d, got %d", want, got)
+	}
+
+	removed, err := md.TrimOldest(150)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(removed); want != got {
+		t.Fatalf("Want %d removed, got %d", want, got)
+	}
+	if removed[0].ID != "m.3" || removed[1].ID != "m.1" {
+		t.Errorf("Want the oldest removed, got %v", removed)
+	}
+
+	entries, _ := md.List()
+	if want, got := 1, len(entries); want != got || entries[0].ID != "m.2" {
+		t.Errorf("Want only m.2 left, got %v", entries)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	md := newTestMaildrop(t)
+
+	received := time.Date(2020, time.June, 1, 12, 0, 0, 0, time.UTC)
+	for _, id := range []string{"m.1", "m.2"} {
+		en := smtp.Envelope{
+			MailFrom: mail.Address{Address: "from@sender.net"},
+			RcptTo:   []mail.Address{{Address: "a@example.com"}},
+			Data:     []byte("Subject: hello\r\n\r\nworld\r\n"),
+			Received: received,
+			ID:       id,
+		}
+		if err := md.Deliver(en); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if trashed, err := md.Trashed(); err != nil || len(trashed) != 0 {
+		t.Errorf("Want empty trash, got %v, %v", trashed, err)
+	}
+
+	for _, id := range []string{"m.1", "m.2"} {
+		if err := md.Trash(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries, _ := md.List(); len(entries) != 0 {
+		t.Errorf("Want trashed messages out of the listing, got %v", entries)
+	}
+	trashed, err := md.Trashed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(trashed); want != got {
+		t.Fatalf("Want %d trashed, got %d", want, got)
+	}
+	if time.Since(trashed[0].ModTime) > time.Minute {
+		t.Errorf("Want the trash time, got %v", trashed[0].ModTime)
+	}
+	if _, err := md.Folder(TrashDir); err == nil {
+		t.Errorf("Want the trash not to be a folder")
+	}
+
+	if err := md.Undelete("m.1"); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := md.List()
+	if want, got := 1, len(entries); want != got || entries[0].ID != "m.1" {
+		t.Fatalf("Want m.1 restored, got %v", entries)
+	}
+	if !entries[0].ModTime.Equal(received) {
+		t.Errorf("Want the received time restored, got %v", entries[0].ModTime)
+	}
+	if meta, err := md.Metadata("m.1"); err != nil || meta.ID != "m.1" {
+		t.Errorf("Want metadata restored, got %+v, %v", meta, err)
+	}
+
+	if removed, err := md.EmptyTrash(time.Now().Add(-time.Hour)); err != nil || len(removed) != 0 {
+		t.Errorf("Want nothing expired, got %v, %v", removed, err)
+	}
+	removed, err := md.EmptyTrash(time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(removed); want != got || removed[0].ID != "m.2" {
+		t.Errorf("Want m.2 removed, got %v", removed)
+	}
+	if err := md.Undelete("m.2"); err == nil {
+		t.Errorf("Want error undeleting a removed message")
+	}
+}
+
+func BenchmarkDeliver(b *testing.B) {
+	md := newTestMaildrop(b)
+
+	en := smtp.Envelope{
+		RemoteAddr: &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)},
+		EHLO:       "mx.sender.net",
+		MailFrom:   mail.Address{Address: "from@sender.net"},
+		RcptTo:     []mail.Address{{Address: "a@example.com"}},
+		Data:       bytes.Repeat([]byte("0123456789abcdefghijklmnopqrstuvwxyz0123456789abcdefghijklmnopqrstuvwxyz0123\r\n"), 52),
+		Received:   time.Now(),
+	}
+	en.AddHeader("X-Spam-Score", "4.5")
+	en.Annotate("spam-score", "4.5")
+
+	b.SetBytes(int64(len(en.Data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		en.ID = fmt.Sprintf("m.%d", i)
+		if err := md.Deliver(en); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
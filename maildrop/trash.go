@@ -0,0 +1,95 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package maildrop
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// TrashDir is the subdirectory of a maildrop that holds deleted messages. It
+// is not a valid folder name, so it cannot be opened as a folder.
+const TrashDir = ".trash"
+
+func (md *Maildrop) trash() *Maildrop {
+	return New(filepath.Join(md.path, TrashDir))
+}
+
+// Trash moves a message and its metadata to the trash, from which it can be
+// restored with Undelete until the trash is emptied. The message's
+// modification time is set to when it was trashed.
+func (md *Maildrop) Trash(id string) error {
+	trash := md.trash()
+	if err := os.Mkdir(trash.path, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if err := os.Rename(md.messagePath(id), trash.messagePath(id)); err != nil {
+		return err
+	}
+	if err := os.Rename(md.metadataPath(id), trash.metadataPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	now := time.Now()
+	return os.Chtimes(trash.messagePath(id), now, now)
+}
+
+// Trashed returns the messages in the trash, ordered by ID. Each entry's
+// ModTime is when it was trashed.
+func (md *Maildrop) Trashed() ([]Entry, error) {
+	entries, err := md.trash().List()
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return entries, err
+}
+
+// TrashedMetadata returns the metadata for a message in the trash.
+func (md *Maildrop) TrashedMetadata(id string) (Metadata, error) {
+	return md.trash().Metadata(id)
+}
+
+// Undelete moves a message from the trash back to the maildrop. Its
+// modification time is restored to when it was received.
+func (md *Maildrop) Undelete(id string) error {
+	trash := md.trash()
+	meta, err := trash.Metadata(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(trash.metadataPath(id), md.metadataPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(trash.messagePath(id), md.messagePath(id)); err != nil {
+		return err
+	}
+	if meta.Version == 0 {
+		return nil
+	}
+	return os.Chtimes(md.messagePath(id), meta.Received, meta.Received)
+}
+
+// EmptyTrash permanently removes the messages that were trashed before
+// |before|, and returns them.
+func (md *Maildrop) EmptyTrash(before time.Time) ([]Entry, error) {
+	entries, err := md.Trashed()
+	if err != nil {
+		return nil, err
+	}
+	trash := md.trash()
+	var removed []Entry
+	for _, entry := range entries {
+		if !entry.ModTime.Before(before) {
+			continue
+		}
+		if err := trash.Remove(entry.ID); err != nil {
+			return removed, err
+		}
+		removed = append(removed, entry)
+	}
+	return removed, nil
+}
@@ -0,0 +1,117 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+// Package maillog writes a delivery log in the one-line-per-event syslog
+// format used by Postfix, so that tools like pflogsumm can summarize it. The
+// program names are prefixed with "mailpopbox/" instead of "postfix/", e.g.
+// `pflogsumm --syslog-name=mailpopbox`.
+package maillog
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type Status string
+
+const (
+	StatusSent     Status = "sent"
+	StatusBounced  Status = "bounced"
+	StatusDeferred Status = "deferred"
+)
+
+// Delivery is the outcome of an attempt to deliver a message to a single
+// recipient.
+type Delivery struct {
+	// ID is the envelope ID of the message.
+	ID string
+	To string
+	// Relay is the host that the message was sent to, as "name[ip]:port", or
+	// "local" for messages stored in a maildrop.
+	Relay string
+	// Delay is the time since the message was received.
+	Delay time.Duration
+	// DSN is the RFC 3463 enhanced status code.
+	DSN    string
+	Status Status
+	// Detail is a human-readable explanation of the status.
+	Detail string
+}
+
+// Writer writes maillog lines. A nil *Writer discards all events.
+type Writer struct {
+	mu       sync.Mutex
+	w        io.Writer
+	hostname string
+	pid      int
+
+	// now is overridden in tests.
+	now func() time.Time
+}
+
+// New creates a Writer that writes to |w|, with |hostname| in each line.
+func New(w io.Writer, hostname string) *Writer {
+	return &Writer{
+		w:        w,
+		hostname: hostname,
+		pid:      os.Getpid(),
+		now:      time.Now,
+	}
+}
+
+// Open creates a Writer that appends to the file at |path|.
+func Open(path, hostname string) (*Writer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return New(f, hostname), nil
+}
+
+// Queued records that a message was accepted for delivery to |nrcpt|
+// recipients.
+func (w *Writer) Queued(id, from string, size, nrcpt int) {
+	w.printf("qmgr", "%s: from=<%s>, size=%d, nrcpt=%d (queue active)", id, from, size, nrcpt)
+}
+
+// Delivery records the result of delivering a message to one recipient.
+func (w *Writer) Delivery(d Delivery) {
+	program := "smtp"
+	if d.Relay == "local" {
+		program = "local"
+	}
+	w.printf(program, "%s: to=<%s>, relay=%s, delay=%.2f, dsn=%s, status=%s (%s)",
+		d.ID, d.To, d.Relay, d.Delay.Seconds(), d.DSN, d.Status, d.Detail)
+}
+
+// Removed records that processing of the message has finished.
+func (w *Writer) Removed(id string) {
+	w.printf("qmgr", "%s: removed", id)
+}
+
+func (w *Writer) printf(program, format string, args ...interface{}) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	prefix := fmt.Sprintf("%s %s mailpopbox/%s[%d]: ", w.now().Format(time.Stamp), w.hostname, program, w.pid)
+	fmt.Fprintf(w.w, prefix+format+"\n", args...)
+}
+
+// DelaySince returns the delay for a message received at |t|, or 0 if it is
+// not known.
+func DelaySince(t time.Time) time.Duration {
+	if t.IsZero() {
+		return 0
+	}
+	return time.Since(t)
+}
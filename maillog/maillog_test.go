@@ -0,0 +1,66 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package maillog
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := New(&buf, "mx.example.com")
+	w.pid = 42
+	w.now = func() time.Time {
+		return time.Date(2020, time.March, 5, 9, 8, 7, 0, time.UTC)
+	}
+
+	w.Queued("m.1", "from@sender.net", 1234, 2)
+	w.Delivery(Delivery{
+		ID:     "m.1",
+		To:     "to@dest.net",
+		Relay:  "mx.dest.net[192.0.2.1]:25",
+		Delay:  1500 * time.Millisecond,
+		DSN:    "2.0.0",
+		Status: StatusSent,
+		Detail: "delivered",
+	})
+	w.Delivery(Delivery{
+		ID:     "m.1",
+		To:     "mailbox@example.com",
+		Relay:  "local",
+		DSN:    "2.0.0",
+		Status: StatusSent,
+		Detail: "delivered to maildrop",
+	})
+	w.Removed("m.1")
+
+	want := []string{
+		"Mar  5 09:08:07 mx.example.com mailpopbox/qmgr[42]: m.1: from=<from@sender.net>, size=1234, nrcpt=2 (queue active)",
+		"Mar  5 09:08:07 mx.example.com mailpopbox/smtp[42]: m.1: to=<to@dest.net>, relay=mx.dest.net[192.0.2.1]:25, delay=1.50, dsn=2.0.0, status=sent (delivered)",
+		"Mar  5 09:08:07 mx.example.com mailpopbox/local[42]: m.1: to=<mailbox@example.com>, relay=local, delay=0.00, dsn=2.0.0, status=sent (delivered to maildrop)",
+		"Mar  5 09:08:07 mx.example.com mailpopbox/qmgr[42]: m.1: removed",
+	}
+	got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(want) != len(got) {
+		t.Fatalf("Want %d lines, got %d: %q", len(want), len(got), got)
+	}
+	for i := range want {
+		if want[i] != got[i] {
+			t.Errorf("Line %d: want %q, got %q", i, want[i], got[i])
+		}
+	}
+}
+
+func TestNilWriter(t *testing.T) {
+	var w *Writer
+	w.Queued("m.1", "", 0, 0)
+	w.Delivery(Delivery{})
+	w.Removed("m.1")
+}
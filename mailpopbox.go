@@ -7,63 +7,155 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 
 	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/backend"
+	"src.bluestatic.org/mailpopbox/chaos"
+	"src.bluestatic.org/mailpopbox/maildrop"
 )
 
 func main() {
-	if len(os.Args) != 2 {
-		fmt.Fprintf(os.Stderr, "Usage: %s config.json\n", os.Args[0])
-		os.Exit(1)
+	if len(os.Args) < 2 {
+		usage()
 	}
 
-	if os.Args[1] == "version" {
+	switch os.Args[1] {
+	case "version":
 		fmt.Print(versionString)
 		os.Exit(0)
+	case "export":
+		os.Exit(runExport(os.Args[2:]))
+	case "undelete":
+		os.Exit(runUndelete(os.Args[2:]))
+	case "import":
+		os.Exit(runImport(os.Args[2:]))
 	}
 
-	configFile, err := os.Open(os.Args[1])
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "config file: %s\n", err)
-		os.Exit(2)
+	if len(os.Args) != 2 {
+		usage()
 	}
 
-	var config Config
-	if err := json.NewDecoder(configFile).Decode(&config); err != nil {
+	config, err := loadConfig(os.Args[1])
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "config file: %s\n", err)
 		os.Exit(3)
 	}
-	configFile.Close()
 
-	logConfig := zap.NewDevelopmentConfig()
-	logConfig.Development = false
-	logConfig.DisableStacktrace = true
-	logConfig.Level.SetLevel(zap.DebugLevel)
-	log, err := logConfig.Build()
+	log, err := newLogger(config.Log)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "create logger: %v\n", err)
 		os.Exit(4)
 	}
 
-	log.Info("starting mailpopbox", zap.String("hostname", config.Hostname))
+	log.Info("starting mailpopbox", zap.String("hostname", config.Hostname), zap.String("mode", config.Mode))
+
+	if config.Chaos != nil {
+		if !chaos.Enabled {
+			log.Warn("ignoring Chaos config in a binary built without chaos mode")
+		} else if err := chaos.Configure(*config.Chaos); err != nil {
+			fmt.Fprintf(os.Stderr, "config file: Chaos: %v\n", err)
+			os.Exit(3)
+		} else {
+			log.Warn("chaos mode is enabled", zap.Any("config", *config.Chaos))
+		}
+	}
+
+	if err := configureDNS(config.DNS); err != nil {
+		fmt.Fprintf(os.Stderr, "config file: DNS: %v\n", err)
+		os.Exit(3)
+	}
+
+	var be *backend.Client
+	switch config.Mode {
+	case "":
+	case ModeBackend:
+		<-runBackendServer(config, log)
+		os.Exit(5)
+	case ModeFrontend:
+		be, err = dialBackend(config, log)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "dial backend: %v\n", err)
+			os.Exit(5)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "config file: unknown Mode %q\n", config.Mode)
+		os.Exit(3)
+	}
 
-	pop3 := runPOP3Server(config, log)
-	smtp := runSMTPServer(config, log)
+	wd, err := newWatchdog(config, log)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config file: WatchdogInterval: %v\n", err)
+		os.Exit(3)
+	}
+
+	smtpAccess, err := newAccessControl(config.SMTPAccess)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config file: SMTPAccess: %v\n", err)
+		os.Exit(3)
+	}
+	pop3Access, err := newAccessControl(config.POP3Access)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config file: POP3Access: %v\n", err)
+		os.Exit(3)
+	}
+	go reloadAccessLists(os.Args[1], smtpAccess, pop3Access, log)
+
+	listings := maildrop.NewListCache()
+	events := startMailboxEvents(listings)
+
+	var reputation *reputationDB
+	if config.Reputation != nil && config.Mode != ModeFrontend {
+		if reputation, err = openReputation(*config.Reputation, log); err != nil {
+			fmt.Fprintf(os.Stderr, "config file: Reputation: %v\n", err)
+			os.Exit(3)
+		}
+		go reputation.saveEvery(reputationSaveInterval)
+	}
+
+	pop3 := runPOP3Server(config, be, listings, events, pop3Access, log)
+	smtp := runSMTPServer(config, be, events, reputation, smtpAccess, log)
+
+	go wd.run()
+
+	var admin <-chan ServerControlMessage
+	if config.AdminAddress != "" {
+		admin = runAdminServer(config, wd, events, reputation, log)
+	}
+
+	stopChan := CreateStopSignal()
 
 	for {
 		select {
+		case <-stopChan:
+			log.Info("shutting down")
+			listeners.Shutdown(shutdownTimeout, log)
+			if err := reputation.save(); err != nil {
+				log.Error("failed to save sender reputation", zap.Error(err))
+			}
+			os.Exit(0)
 		case cm := <-pop3:
 			if cm == ServerControlRestart {
-				pop3 = runPOP3Server(config, log)
+				pop3 = runPOP3Server(config, be, listings, events, pop3Access, log)
 			} else {
 				break
 			}
 		case <-smtp:
 			// smtp never reloads.
 			break
+		case <-admin:
+			break
 		}
 	}
 }
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s config.json\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s export [-config config.json] -domain example.com -out export.zip\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s import [-config config.json] -domain example.com [-folder name] [message.eml...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s undelete [-config config.json] -domain example.com [-folder name] [-all | ID...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s version\n", os.Args[0])
+	os.Exit(1)
+}
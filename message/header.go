@@ -0,0 +1,203 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+// Package message provides helpers for inspecting and rewriting RFC 5322
+// messages. Unlike net/mail, the header is kept in its original order and
+// formatting, so that only the fields which are changed differ in the output.
+package message
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// Field is a single header field.
+type Field struct {
+	// Name is the field name as it appears in the message. It is empty for
+	// malformed lines that do not have a colon.
+	Name string
+
+	// Raw is the complete field, including any folded continuation lines and
+	// the trailing line ending.
+	Raw []byte
+}
+
+// Value returns the unfolded field body with surrounding whitespace removed.
+func (f Field) Value() string {
+	idx := bytes.IndexByte(f.Raw, ':')
+	if idx == -1 {
+		return ""
+	}
+	v := string(f.Raw[idx+1:])
+	v = strings.NewReplacer("\r\n", "", "\n", "").Replace(v)
+	return strings.TrimSpace(v)
+}
+
+// Header is an ordered list of header fields.
+type Header struct {
+	Fields []Field
+
+	// EOL is the line ending used for new fields. Parse sets it to match the
+	// first line of the message.
+	EOL string
+}
+
+// Parse splits data into its header and body. The body is everything after
+// the blank line that ends the header, and it aliases data. If there is no
+// blank line, the entire message is treated as a header.
+func Parse(data []byte) (*Header, []byte) {
+	h := &Header{EOL: "\r\n"}
+
+	if idx := bytes.IndexByte(data, '\n'); idx > 0 && data[idx-1] != '\r' {
+		h.EOL = "\n"
+	}
+
+	rest := data
+	for len(rest) > 0 {
+		idx := bytes.IndexByte(rest, '\n')
+		var line []byte
+		if idx == -1 {
+			line, rest = rest, nil
+		} else {
+			line, rest = rest[:idx+1], rest[idx+1:]
+		}
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return h, rest
+		}
+
+		if (line[0] == ' ' || line[0] == '\t') && len(h.Fields) > 0 {
+			last := &h.Fields[len(h.Fields)-1]
+			last.Raw = append(last.Raw[:len(last.Raw):len(last.Raw)], line...)
+			continue
+		}
+
+		f := Field{Raw: line}
+		if colon := bytes.IndexByte(line, ':'); colon != -1 {
+			f.Name = string(bytes.TrimSpace(line[:colon]))
+		}
+		h.Fields = append(h.Fields, f)
+	}
+
+	return h, nil
+}
+
+func (h *Header) eol() string {
+	if h.EOL == "" {
+		return "\r\n"
+	}
+	return h.EOL
+}
+
+func (h *Header) newField(name, value string) Field {
+	return Field{
+		Name: name,
+		Raw:  []byte(name + ": " + value + h.eol()),
+	}
+}
+
+// Index returns the position of the first field with the given name, or -1.
+func (h *Header) Index(name string) int {
+	for i, f := range h.Fields {
+		if strings.EqualFold(f.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Get returns the value of the first field with the given name.
+func (h *Header) Get(name string) string {
+	if i := h.Index(name); i != -1 {
+		return h.Fields[i].Value()
+	}
+	return ""
+}
+
+// Values returns the values of all fields with the given name.
+func (h *Header) Values(name string) []string {
+	var values []string
+	for _, f := range h.Fields {
+		if strings.EqualFold(f.Name, name) {
+			values = append(values, f.Value())
+		}
+	}
+	return values
+}
+
+// Set replaces the first field with the given name in place, and removes any
+// other fields with that name. If there is no such field, it is added at the
+// end of the header.
+func (h *Header) Set(name, value string) {
+	i := h.Index(name)
+	if i == -1 {
+		h.Add(name, value)
+		return
+	}
+	h.Fields[i] = h.newField(h.Fields[i].Name, value)
+
+	fields := h.Fields[:i+1]
+	for _, f := range h.Fields[i+1:] {
+		if !strings.EqualFold(f.Name, name) {
+			fields = append(fields, f)
+		}
+	}
+	h.Fields = fields
+}
+
+// Add appends a field to the end of the header.
+func (h *Header) Add(name, value string) {
+	h.Fields = append(h.Fields, h.newField(name, value))
+}
+
+// Prepend inserts a field at the start of the header, which is where trace
+// fields belong.
+func (h *Header) Prepend(name, value string) {
+	h.Fields = append([]Field{h.newField(name, value)}, h.Fields...)
+}
+
+// Del removes all fields with the given name.
+func (h *Header) Del(name string) {
+	fields := h.Fields[:0]
+	for _, f := range h.Fields {
+		if !strings.EqualFold(f.Name, name) {
+			fields = append(fields, f)
+		}
+	}
+	h.Fields = fields
+}
+
+// WriteTo writes the header fields followed by the blank line that separates
+// the header from the body.
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for _, f := range h.Fields {
+		n, err := w.Write(f.Raw)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	n, err := io.WriteString(w, h.eol())
+	total += int64(n)
+	return total, err
+}
+
+// Bytes returns the serialized header, including the terminating blank line.
+func (h *Header) Bytes() []byte {
+	var buf bytes.Buffer
+	h.WriteTo(&buf)
+	return buf.Bytes()
+}
+
+// Join reassembles a message from a header and body.
+func Join(h *Header, body []byte) []byte {
+	var buf bytes.Buffer
+	h.WriteTo(&buf)
+	buf.Write(body)
+	return buf.Bytes()
+}
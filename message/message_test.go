@@ -0,0 +1,167 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package message
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRoundTrip(t *testing.T) {
+	cases := []string{
+		"From: <a@example.com>\r\nSubject: hi\r\n\r\nbody\r\n",
+		"From: <a@example.com>\nSubject: hi\n\nbody\n",
+		"Subject: folded\r\n  continuation\r\nTo: b@example.com\r\n\r\n",
+		"not a header\nFrom: x\n\nbody",
+	}
+	for i, c := range cases {
+		h, body := Parse([]byte(c))
+		if want, got := c, string(Join(h, body)); want != got {
+			t.Errorf("Case %d: want %q, got %q", i, want, got)
+		}
+	}
+}
+
+func TestHeaderGet(t *testing.T) {
+	h, body := Parse([]byte("Subject: folded\r\n  continuation\r\nto: one\r\nTo: two\r\n\r\nbody"))
+
+	if want, got := "folded  continuation", h.Get("subject"); want != got {
+		t.Errorf("Want Subject %q, got %q", want, got)
+	}
+	if want, got := "one", h.Get("To"); want != got {
+		t.Errorf("Want To %q, got %q", want, got)
+	}
+	if want, got := 2, len(h.Values("TO")); want != got {
+		t.Errorf("Want %d To values, got %d", want, got)
+	}
+	if want, got := "", h.Get("Cc"); want != got {
+		t.Errorf("Want missing field to be empty, got %q", got)
+	}
+	if want, got := "body", string(body); want != got {
+		t.Errorf("Want body %q, got %q", want, got)
+	}
+}
+
+func TestHeaderRewrite(t *testing.T) {
+	h, body := Parse([]byte("Received: x\nTo: one\nSubject: hi\nTo: two\n\nbody\n"))
+
+	h.Set("to", "three")
+	h.Del("Received")
+	h.Add("X-Added", "yes")
+	h.Prepend("Return-Path", "<a@example.com>")
+
+	want := "Return-Path: <a@example.com>\nTo: three\nSubject: hi\nX-Added: yes\n\nbody\n"
+	if got := string(Join(h, body)); want != got {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+
+	empty := &Header{}
+	empty.Set("Subject", "new")
+	if want, got := "Subject: new\r\n\r\n", string(empty.Bytes()); want != got {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+}
+
+const multipartMessage = "From: a@example.com\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"preamble\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"hello\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"inner\"\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"<p>caf=C3=A9</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/octet-stream; name=\"data.bin\"\r\n" +
+	"Content-Disposition: attachment; filename=\"report.txt\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"aGVsbG8g\r\n" +
+	"d29ybGQ=\r\n" +
+	"--outer--\r\n" +
+	"epilogue\r\n"
+
+func TestWalk(t *testing.T) {
+	var types []string
+	var parts []*Part
+	err := Walk([]byte(multipartMessage), func(p *Part) error {
+		types = append(types, p.MediaType)
+		parts = append(parts, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+
+	want := "multipart/mixed text/plain multipart/alternative text/html application/octet-stream"
+	if got := strings.Join(types, " "); want != got {
+		t.Fatalf("Want parts %q, got %q", want, got)
+	}
+
+	if want, got := "hello", string(parts[1].Body); want != got {
+		t.Errorf("Want text body %q, got %q", want, got)
+	}
+	if want, got := 2, parts[3].Depth; want != got {
+		t.Errorf("Want depth %d, got %d", want, got)
+	}
+
+	html, err := parts[3].Decoded()
+	if err != nil {
+		t.Errorf("Failed to decode: %v", err)
+	}
+	if want, got := "<p>café</p>", string(html); want != got {
+		t.Errorf("Want decoded %q, got %q", want, got)
+	}
+
+	attachment := parts[4]
+	if want, got := "report.txt", attachment.Filename(); want != got {
+		t.Errorf("Want filename %q, got %q", want, got)
+	}
+	data, err := attachment.Decoded()
+	if err != nil {
+		t.Errorf("Failed to decode: %v", err)
+	}
+	if want, got := "hello world", string(data); want != got {
+		t.Errorf("Want decoded %q, got %q", want, got)
+	}
+}
+
+func TestWalkSkipChildren(t *testing.T) {
+	count := 0
+	Walk([]byte(multipartMessage), func(p *Part) error {
+		count++
+		if p.MediaType == "multipart/alternative" {
+			return ErrSkipChildren
+		}
+		return nil
+	})
+	if want, got := 4, count; want != got {
+		t.Errorf("Want %d parts visited, got %d", want, got)
+	}
+}
+
+func TestWalkNotMultipart(t *testing.T) {
+	count := 0
+	Walk([]byte("Subject: plain\n\nhello\n"), func(p *Part) error {
+		count++
+		if want, got := "text/plain", p.MediaType; want != got {
+			t.Errorf("Want default type %q, got %q", want, got)
+		}
+		return nil
+	})
+	if want, got := 1, count; want != got {
+		t.Errorf("Want %d part, got %d", want, got)
+	}
+}
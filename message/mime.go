@@ -0,0 +1,184 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package message
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+)
+
+// maxDepth limits how deeply nested multipart bodies are walked.
+const maxDepth = 20
+
+// ErrSkipChildren can be returned from a WalkFunc to avoid descending into
+// the parts of a multipart body.
+var ErrSkipChildren = errors.New("message: skip children")
+
+// Part is a single MIME entity within a message.
+type Part struct {
+	Header *Header
+
+	// MediaType is the lower-case media type from the Content-Type field,
+	// which defaults to text/plain.
+	MediaType string
+	Params    map[string]string
+
+	// Body is the still-encoded body of the part. For multipart types, it
+	// contains all the child parts.
+	Body []byte
+
+	// Depth is 0 for the message itself, and increases by one for each
+	// enclosing multipart.
+	Depth int
+}
+
+// Filename returns the name of an attachment, from either the
+// Content-Disposition or Content-Type field.
+func (p *Part) Filename() string {
+	if _, params, err := mime.ParseMediaType(p.Header.Get("Content-Disposition")); err == nil {
+		if name := params["filename"]; name != "" {
+			return name
+		}
+	}
+	return p.Params["name"]
+}
+
+// Decoded returns the Body with its Content-Transfer-Encoding removed.
+func (p *Part) Decoded() ([]byte, error) {
+	switch strings.ToLower(p.Header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		return ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, newlineStripper{bytes.NewReader(p.Body)}))
+	case "quoted-printable":
+		return ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(p.Body)))
+	default:
+		return p.Body, nil
+	}
+}
+
+// WalkFunc is called for each part visited by Walk.
+type WalkFunc func(p *Part) error
+
+// Walk parses data as a MIME message and calls fn for the message and then
+// for each of its parts, depth-first. Encapsulated message/rfc822 parts are
+// not descended into. If fn returns an error other than ErrSkipChildren,
+// the walk stops and that error is returned.
+func Walk(data []byte, fn WalkFunc) error {
+	h, body := Parse(data)
+	return walk(h, body, 0, fn)
+}
+
+func walk(h *Header, body []byte, depth int, fn WalkFunc) error {
+	p := &Part{
+		Header:    h,
+		MediaType: "text/plain",
+		Body:      body,
+		Depth:     depth,
+	}
+	if ct := h.Get("Content-Type"); ct != "" {
+		if mt, params, err := mime.ParseMediaType(ct); err == nil {
+			p.MediaType = mt
+			p.Params = params
+		}
+	}
+
+	err := fn(p)
+	if err == ErrSkipChildren {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	boundary := p.Params["boundary"]
+	if !strings.HasPrefix(p.MediaType, "multipart/") || boundary == "" || depth >= maxDepth {
+		return nil
+	}
+
+	for _, child := range splitMultipart(body, boundary) {
+		ch, cb := Parse(child)
+		if err := walk(ch, cb, depth+1, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitMultipart returns the raw content of each part in a multipart body.
+// The preamble and epilogue are discarded, and a missing close delimiter is
+// tolerated.
+func splitMultipart(body []byte, boundary string) [][]byte {
+	delim := []byte("--" + boundary)
+
+	var parts [][]byte
+	var start = -1
+	rest := body
+	offset := 0
+	for len(rest) > 0 {
+		idx := bytes.IndexByte(rest, '\n')
+		var line []byte
+		if idx == -1 {
+			line = rest
+		} else {
+			line = rest[:idx+1]
+		}
+		lineStart := offset
+		offset += len(line)
+		rest = rest[len(line):]
+
+		trimmed := bytes.TrimRight(line, " \t\r\n")
+		if !bytes.HasPrefix(trimmed, delim) {
+			continue
+		}
+		suffix := trimmed[len(delim):]
+		if len(suffix) != 0 && !bytes.Equal(suffix, []byte("--")) {
+			continue
+		}
+
+		if start != -1 {
+			parts = append(parts, trimEOL(body[start:lineStart]))
+		}
+		if len(suffix) != 0 {
+			return parts
+		}
+		start = offset
+	}
+	if start != -1 && start < len(body) {
+		parts = append(parts, body[start:])
+	}
+	return parts
+}
+
+// trimEOL removes the line ending that belongs to the following delimiter.
+func trimEOL(b []byte) []byte {
+	b = bytes.TrimSuffix(b, []byte("\n"))
+	return bytes.TrimSuffix(b, []byte("\r"))
+}
+
+type newlineStripper struct {
+	r *bytes.Reader
+}
+
+func (n newlineStripper) Read(p []byte) (int, error) {
+	for {
+		c, err := n.r.Read(p)
+		w := 0
+		for _, b := range p[:c] {
+			if b != '\r' && b != '\n' && b != ' ' && b != '\t' {
+				p[w] = b
+				w++
+			}
+		}
+		if w > 0 || err != nil {
+			return w, err
+		}
+	}
+}
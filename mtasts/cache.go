@@ -0,0 +1,208 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package mtasts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"src.bluestatic.org/mailpopbox/resolver"
+)
+
+const (
+	lookupTimeout = 10 * time.Second
+	fetchTimeout  = 60 * time.Second
+
+	// maxPolicySize is the largest policy file that is read.
+	maxPolicySize = 64 * 1024
+)
+
+// Cache fetches policies and keeps them until they expire, in memory and in
+// a directory so that they survive restarts (RFC 8461 § 5.1).
+type Cache struct {
+	// LookupTXT and Client fetch the _mta-sts TXT records and the policy
+	// files.
+	LookupTXT resolver.LookupTXT
+	Client    *http.Client
+
+	dir string
+
+	mu       sync.Mutex
+	policies map[string]*cachedPolicy // Keyed by domain.
+}
+
+// cachedPolicy is the form of a policy stored in the cache directory.
+type cachedPolicy struct {
+	ID      string
+	Fetched time.Time
+	Policy  *Policy
+}
+
+func (c *cachedPolicy) valid(now time.Time) bool {
+	return c != nil && now.Before(c.Fetched.Add(c.Policy.MaxAge))
+}
+
+// NewCache returns a Cache that stores policies in |dir|, which is created
+// if needed.
+func NewCache(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Cache{
+		LookupTXT: resolver.Default.LookupTXT,
+		Client: &http.Client{
+			Timeout: fetchTimeout,
+			// Redirects must not be followed (RFC 8461 § 3.3).
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		dir:      dir,
+		policies: make(map[string]*cachedPolicy),
+	}, nil
+}
+
+// Policy returns the policy of |domain|, or nil if it has none. A new policy
+// is fetched when the domain's policy ID changes or the cached one expires.
+// If it cannot be fetched, an unexpired cached policy is still returned. A
+// policy may be returned along with an error if it could not be saved.
+func (c *Cache) Policy(domain string) (*Policy, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" || strings.HasPrefix(domain, ".") || strings.ContainsAny(domain, "/\\") {
+		return nil, nil
+	}
+	now := time.Now()
+	cached := c.load(domain)
+
+	id, err := c.lookupID(domain)
+	if err != nil {
+		if cached.valid(now) {
+			return cached.Policy, nil
+		}
+		if err == errNoRecord {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if cached.valid(now) && cached.ID == id {
+		return cached.Policy, nil
+	}
+
+	policy, err := c.fetch(domain)
+	if err != nil {
+		if cached.valid(now) {
+			return cached.Policy, nil
+		}
+		return nil, err
+	}
+	return policy, c.store(domain, &cachedPolicy{ID: id, Fetched: now, Policy: policy})
+}
+
+var errNoRecord = errors.New("mtasts: no policy record")
+
+// lookupID returns the id= of the _mta-sts TXT record of |domain|.
+func (c *Cache) lookupID(domain string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	txts, err := c.LookupTXT(ctx, "_mta-sts."+domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return "", errNoRecord
+		}
+		return "", err
+	}
+
+	var id string
+	for _, txt := range txts {
+		fields := strings.Split(txt, ";")
+		if strings.TrimSpace(fields[0]) != "v=STSv1" {
+			continue
+		}
+		if id != "" {
+			// Multiple records are treated as none (RFC 8461 § 3.1).
+			return "", errNoRecord
+		}
+		for _, field := range fields[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(field), "=", 2); len(kv) == 2 && kv[0] == "id" {
+				id = kv[1]
+			}
+		}
+		if id == "" {
+			return "", errNoRecord
+		}
+	}
+	if id == "" {
+		return "", errNoRecord
+	}
+	return id, nil
+}
+
+// fetch gets the policy file of |domain| from its policy host.
+func (c *Cache) fetch(domain string) (*Policy, error) {
+	resp, err := c.Client.Get("https://mta-sts." + domain + "/.well-known/mta-sts.txt")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("mtasts: fetching policy: %s", resp.Status)
+	}
+	if mt, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err != nil || mt != "text/plain" {
+		return nil, fmt.Errorf("mtasts: policy has Content-Type %q", resp.Header.Get("Content-Type"))
+	}
+	return ParsePolicy(io.LimitReader(resp.Body, maxPolicySize))
+}
+
+// load returns the cached policy of |domain|, reading it from the cache
+// directory if it is not in memory.
+func (c *Cache) load(domain string) *cachedPolicy {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok := c.policies[domain]; ok {
+		return p
+	}
+
+	var p *cachedPolicy
+	if data, err := ioutil.ReadFile(c.path(domain)); err == nil {
+		p = &cachedPolicy{}
+		if json.Unmarshal(data, p) != nil || p.Policy == nil {
+			p = nil
+		}
+	}
+	c.policies[domain] = p
+	return p
+}
+
+func (c *Cache) store(domain string, p *cachedPolicy) error {
+	c.mu.Lock()
+	c.policies[domain] = p
+	c.mu.Unlock()
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.path(domain), data, 0600)
+}
+
+func (c *Cache) path(domain string) string {
+	return filepath.Join(c.dir, domain+".json")
+}
@@ -0,0 +1,124 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+// Package mtasts fetches SMTP MTA Strict Transport Security policies
+// (RFC 8461), with which a domain requires that mail to it be sent over TLS
+// to authenticated MX hosts.
+package mtasts
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mode is how a sending MTA applies a policy.
+type Mode string
+
+const (
+	// ModeEnforce refuses delivery to MX hosts that do not match the policy
+	// or that cannot negotiate TLS with a valid certificate.
+	ModeEnforce Mode = "enforce"
+	// ModeTesting delivers regardless, but reports failures with TLSRPT.
+	ModeTesting Mode = "testing"
+	// ModeNone means the domain has withdrawn its policy.
+	ModeNone Mode = "none"
+)
+
+// maxMaxAge is the largest max_age allowed, about one year.
+const maxMaxAge = 31557600 * time.Second
+
+// Policy is a domain's MTA-STS policy.
+type Policy struct {
+	Mode   Mode
+	MX     []string
+	MaxAge time.Duration
+}
+
+// ParsePolicy parses the policy file in |r| (RFC 8461 § 3.2).
+func ParsePolicy(r io.Reader) (*Policy, error) {
+	p := &Policy{}
+	var version string
+	haveMaxAge := false
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		kv := strings.SplitN(s.Text(), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "version":
+			version = value
+		case "mode":
+			p.Mode = Mode(value)
+			if p.Mode != ModeEnforce && p.Mode != ModeTesting && p.Mode != ModeNone {
+				return nil, fmt.Errorf("mtasts: invalid mode %q", value)
+			}
+		case "max_age":
+			secs, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("mtasts: invalid max_age %q", value)
+			}
+			p.MaxAge = time.Duration(secs) * time.Second
+			if p.MaxAge > maxMaxAge {
+				p.MaxAge = maxMaxAge
+			}
+			haveMaxAge = true
+		case "mx":
+			p.MX = append(p.MX, strings.ToLower(value))
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if version != "STSv1" {
+		return nil, errors.New("mtasts: missing version STSv1")
+	}
+	if p.Mode == "" {
+		return nil, errors.New("mtasts: missing mode")
+	}
+	if !haveMaxAge {
+		return nil, errors.New("mtasts: missing max_age")
+	}
+	if len(p.MX) == 0 && p.Mode != ModeNone {
+		return nil, errors.New("mtasts: missing mx")
+	}
+	return p, nil
+}
+
+// Matches reports whether the MX host |host| is allowed by the policy. A
+// pattern like "*.example.com" matches a single leftmost label.
+func (p *Policy) Matches(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, mx := range p.MX {
+		if mx == host {
+			return true
+		}
+		if strings.HasPrefix(mx, "*.") && strings.HasSuffix(host, mx[1:]) {
+			label := strings.TrimSuffix(host, mx[1:])
+			if label != "" && !strings.Contains(label, ".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Strings returns the lines of the policy, as in a TLSRPT policy-string.
+func (p *Policy) Strings() []string {
+	lines := []string{"version: STSv1", "mode: " + string(p.Mode)}
+	for _, mx := range p.MX {
+		lines = append(lines, "mx: "+mx)
+	}
+	return append(lines, fmt.Sprintf("max_age: %d", p.MaxAge/time.Second))
+}
@@ -0,0 +1,198 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package mtasts
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePolicy(t *testing.T) {
+	p, err := ParsePolicy(strings.NewReader("version: STSv1\r\nmode: enforce\r\nmx: mail.example.com\r\nmx: *.Example.net\r\nmax_age: 86400\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := ModeEnforce, p.Mode; want != got {
+		t.Errorf("Want mode %q, got %q", want, got)
+	}
+	if want, got := []string{"mail.example.com", "*.example.net"}, p.MX; !reflect.DeepEqual(want, got) {
+		t.Errorf("Want mx %v, got %v", want, got)
+	}
+	if want, got := 24*time.Hour, p.MaxAge; want != got {
+		t.Errorf("Want max_age %v, got %v", want, got)
+	}
+	if want, got := []string{"version: STSv1", "mode: enforce", "mx: mail.example.com", "mx: *.example.net", "max_age: 86400"}, p.Strings(); !reflect.DeepEqual(want, got) {
+		t.Errorf("Want strings %v, got %v", want, got)
+	}
+
+	invalid := []string{
+		"mode: enforce\nmx: mail.example.com\nmax_age: 86400\n",
+		"version: STSv1\nmode: strict\nmx: mail.example.com\nmax_age: 86400\n",
+		"version: STSv1\nmode: enforce\nmax_age: 86400\n",
+		"version: STSv1\nmode: enforce\nmx: mail.example.com\n",
+		"version: STSv1\nmode: enforce\nmx: mail.example.com\nmax_age: -1\n",
+	}
+	for _, policy := range invalid {
+		if _, err := ParsePolicy(strings.NewReader(policy)); err == nil {
+			t.Errorf("Expected error for %q", policy)
+		}
+	}
+
+	if _, err := ParsePolicy(strings.NewReader("version: STSv1\nmode: none\nmax_age: 86400\n")); err != nil {
+		t.Errorf("Want mode none without mx, got %v", err)
+	}
+}
+
+func TestPolicyMatches(t *testing.T) {
+	p := &Policy{MX: []string{"mail.example.com", "*.example.net"}}
+	cases := []struct {
+		host    string
+		matches bool
+	}{
+		{"mail.example.com", true},
+		{"MAIL.example.com.", true},
+		{"mx.example.com", false},
+		{"mx1.example.net", true},
+		{"a.mx1.example.net", false},
+		{"example.net", false},
+	}
+	for _, c := range cases {
+		if want, got := c.matches, p.Matches(c.host); want != got {
+			t.Errorf("%s: want match %v, got %v", c.host, want, got)
+		}
+	}
+}
+
+func newTestCache(t *testing.T, dir string, records map[string]string, server *httptest.Server) *Cache {
+	c, err := NewCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.LookupTXT = func(ctx context.Context, name string) ([]string, error) {
+		if txt, ok := records[name]; ok {
+			return []string{txt}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	// Every policy host is the test server.
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+		},
+	}
+	c.Client.Transport = transport
+	return c
+}
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtasts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fetches := 0
+	mode := "enforce"
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "mta-sts.example.com" || r.URL.Path != "/.well-known/mta-sts.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		fetches++
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "version: STSv1\nmode: %s\nmx: mail.example.com\nmax_age: 3600\n", mode)
+	}))
+	defer server.Close()
+
+	records := map[string]string{"_mta-sts.example.com": "v=STSv1; id=1"}
+	c := newTestCache(t, dir, records, server)
+
+	p, err := c.Policy("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p == nil || p.Mode != ModeEnforce {
+		t.Fatalf("Want enforce policy, got %+v", p)
+	}
+
+	// The policy is cached while the ID is unchanged.
+	if _, err := c.Policy("Example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, fetches; want != got {
+		t.Errorf("Want %d fetch, got %d", want, got)
+	}
+
+	// A new cache uses the policy stored on disk, even if the record is gone.
+	delete(records, "_mta-sts.example.com")
+	c = newTestCache(t, dir, records, server)
+	if p, err = c.Policy("example.com"); err != nil || p == nil {
+		t.Fatalf("Want stored policy, got %+v, %v", p, err)
+	}
+	if want, got := 1, fetches; want != got {
+		t.Errorf("Want %d fetch, got %d", want, got)
+	}
+
+	// A new ID fetches the policy again.
+	records["_mta-sts.example.com"] = "v=STSv1; id=2"
+	mode = "testing"
+	if p, err = c.Policy("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := ModeTesting, p.Mode; want != got {
+		t.Errorf("Want mode %q, got %q", want, got)
+	}
+	if want, got := 2, fetches; want != got {
+		t.Errorf("Want %d fetches, got %d", want, got)
+	}
+
+	// A domain without a record has no policy.
+	if p, err = c.Policy("other.com"); p != nil || err != nil {
+		t.Errorf("Want no policy, got %+v, %v", p, err)
+	}
+
+	// A policy that cannot be fetched is an error.
+	records["_mta-sts.missing.com"] = "v=STSv1; id=1"
+	if p, err = c.Policy("missing.com"); p != nil || err == nil {
+		t.Errorf("Want fetch error, got %+v, %v", p, err)
+	}
+}
+
+func TestCacheExpired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtasts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+
+	records := map[string]string{"_mta-sts.example.com": "v=STSv1; id=1"}
+	c := newTestCache(t, dir, records, server)
+	c.policies["example.com"] = &cachedPolicy{
+		ID:      "1",
+		Fetched: time.Now().Add(-2 * time.Hour),
+		Policy:  &Policy{Mode: ModeEnforce, MX: []string{"mail.example.com"}, MaxAge: time.Hour},
+	}
+
+	// The expired policy is not used when it cannot be refreshed.
+	if p, err := c.Policy("example.com"); p != nil || err == nil {
+		t.Errorf("Want fetch error, got %+v, %v", p, err)
+	}
+}
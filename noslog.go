@@ -0,0 +1,20 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+//go:build !go1.21
+// +build !go1.21
+
+package main
+
+import (
+	"errors"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func newSlogCore(path string) (zapcore.Core, error) {
+	return nil, errors.New("Log SlogPath requires a binary built with Go 1.21 or later")
+}
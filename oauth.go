@@ -0,0 +1,73 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+
+	"go.uber.org/zap"
+)
+
+// tokenAuthServer adds bearer token authentication to an smtpServer, for
+// when a Server has a TokenIntrospectionURL. It is separate so that the
+// token mechanisms are only advertised when they can succeed.
+type tokenAuthServer struct {
+	*smtpServer
+}
+
+// hasTokenAuth reports whether any server accepts bearer tokens.
+func (c Config) hasTokenAuth() bool {
+	for _, s := range c.Servers {
+		if s.TokenIntrospectionURL != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthenticateToken checks |token| with the server's introspection endpoint
+// (RFC 7662). Only the mailbox address can authenticate, as with passwords.
+func (server tokenAuthServer) AuthenticateToken(user, token string) bool {
+	addr, err := mail.ParseAddress(user)
+	if err != nil {
+		return false
+	}
+	s := server.configForAddress(*addr)
+	if s == nil || s.TokenIntrospectionURL == "" || addr.Address != MailboxAccount+s.Domain {
+		return false
+	}
+
+	client := &http.Client{Timeout: verifyTimeout}
+	resp, err := client.PostForm(s.TokenIntrospectionURL, url.Values{
+		"token":           {token},
+		"token_type_hint": {"access_token"},
+	})
+	if err != nil {
+		server.log.Error("failed to introspect token", zap.Error(err))
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		server.log.Error("failed to introspect token", zap.Error(fmt.Errorf("HTTP status %s", resp.Status)))
+		return false
+	}
+
+	var result struct {
+		Active   bool   `json:"active"`
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		server.log.Error("failed to decode token introspection", zap.Error(err))
+		return false
+	}
+	return result.Active && (result.Username == "" || result.Username == addr.Address)
+}
@@ -7,23 +7,34 @@
 package main
 
 import (
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	"os"
-	"path"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"go.uber.org/zap"
 
+	"src.bluestatic.org/mailpopbox/backend"
+	"src.bluestatic.org/mailpopbox/logger/zaplogger"
+	"src.bluestatic.org/mailpopbox/maildrop"
 	"src.bluestatic.org/mailpopbox/pop3"
 )
 
-func runPOP3Server(config Config, log *zap.Logger) <-chan ServerControlMessage {
+// pop3CommandTimeout is the POP3 listener's CommandTimeout by default, the
+// minimum autologout timer of RFC 1939 § 3.
+const pop3CommandTimeout = 10 * time.Minute
+
+func runPOP3Server(config Config, be *backend.Client, listings *maildrop.ListCache, events *mailboxEvents, access *accessControl, log *zap.Logger) <-chan ServerControlMessage {
 	server := pop3Server{
 		config:      config,
+		backend:     be,
+		listings:    listings,
+		events:      events,
+		access:      access,
 		controlChan: make(chan ServerControlMessage),
 		log:         log.With(zap.String("server", "pop3")),
 	}
@@ -32,17 +43,31 @@ func runPOP3Server(config Config, log *zap.Logger) <-chan ServerControlMessage {
 }
 
 type pop3Server struct {
-	config      Config
+	config Config
+
+	// If non-nil, mailboxes are stored by the backend rather than locally.
+	backend *backend.Client
+
+	// listings caches the maildrop listings. If nil, they are read on every
+	// login.
+	listings *maildrop.ListCache
+
+	// events is published the messages that clients remove.
+	events *mailboxEvents
+
+	access *accessControl
+
 	controlChan chan ServerControlMessage
 	log         *zap.Logger
 }
 
 func (server *pop3Server) run() {
-	for _, s := range server.config.Servers {
-		if err := os.Mkdir(s.MaildropPath, 0700); err != nil && !os.IsExist(err) {
-			server.log.Error("failed to open maildrop", zap.Error(err))
-			server.controlChan <- ServerControlFatalError
-		}
+	var po pop3.PostOffice = server
+	if server.backend != nil {
+		po = server.backend.PostOffice(server)
+	} else if err := server.createMaildrops(); err != nil {
+		server.controlChan <- ServerControlFatalError
+		return
 	}
 
 	l, err := server.newListener()
@@ -50,51 +75,95 @@ func (server *pop3Server) run() {
 		server.controlChan <- ServerControlFatalError
 		return
 	}
-
-	connChan := make(chan net.Conn)
-	go RunAcceptLoop(l, connChan, server.log)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- l.Serve(func(conn net.Conn) {
+			server.serveConnection(conn, po)
+		})
+	}()
 
 	reloadChan := CreateReloadSignal()
 
-	for {
-		select {
-		case <-reloadChan:
-			server.log.Info("restarting server")
-			l.Close()
-			server.controlChan <- ServerControlRestart
-			break
-		case conn, ok := <-connChan:
-			if ok {
-				go pop3.AcceptConnection(conn, server, server.log)
-			} else {
-				server.controlChan <- ServerControlFatalError
-				break
+	select {
+	case <-reloadChan:
+		server.log.Info("restarting server")
+		l.Close()
+		server.controlChan <- ServerControlRestart
+	case <-serveErr:
+		server.controlChan <- ServerControlFatalError
+	}
+}
+
+// serveConnection serves |conn| as a session in the registry.
+func (server *pop3Server) serveConnection(conn net.Conn, po pop3.PostOffice) {
+	s := sessions.Track(conn, "pop3")
+	defer s.Done()
+
+	opts := server.config.POP3Options
+	opts.StateChanged = s.SetState
+	pop3.AcceptConnection(s.Conn(), po, opts, zaplogger.New(server.log))
+}
+
+func (server *pop3Server) createMaildrops() error {
+	for _, s := range server.config.Servers {
+		if err := os.Mkdir(s.MaildropPath, 0700); err != nil && !os.IsExist(err) {
+			server.log.Error("failed to open maildrop", zap.Error(err))
+			return err
+		}
+
+		if _, err := trashRetention(s); err != nil {
+			server.log.Error("invalid TrashRetention", zap.String("domain", s.Domain), zap.Error(err))
+			return err
+		}
+
+		if s.SentFolder != "" {
+			if _, err := maildrop.New(s.MaildropPath).CreateFolder(s.SentFolder); err != nil {
+				server.log.Error("failed to create sent folder", zap.Error(err))
+				return err
 			}
 		}
+
+		if s.RoleFolder != "" {
+			if _, err := maildrop.New(s.MaildropPath).CreateFolder(s.RoleFolder); err != nil {
+				server.log.Error("failed to create role folder", zap.Error(err))
+				return err
+			}
+		}
+
+		migrated, err := maildrop.New(s.MaildropPath).Migrate()
+		if err != nil {
+			server.log.Error("failed to migrate maildrop", zap.String("dir", s.MaildropPath), zap.Error(err))
+			return err
+		}
+		if migrated > 0 {
+			server.log.Info("migrated maildrop messages",
+				zap.String("dir", s.MaildropPath),
+				zap.Int("count", migrated),
+				zap.Int("version", maildrop.Version))
+		}
 	}
+	return nil
 }
 
-func (server *pop3Server) newListener() (net.Listener, error) {
-	tlsConfig, err := server.config.GetTLSConfig()
+func (server *pop3Server) newListener() (*listener, error) {
+	tlsConfig, err := server.config.GetPOP3TLSConfig()
 	if err != nil {
 		server.log.Error("failed to configure TLS", zap.Error(err))
 		return nil, err
 	}
 
-	addr := fmt.Sprintf(":%d", server.config.POP3Port)
-	server.log.Info("starting server", zap.String("address", addr))
-
-	var l net.Listener
-	if tlsConfig == nil {
-		l, err = net.Listen("tcp", addr)
-	} else {
-		l, err = tls.Listen("tcp", addr, tlsConfig)
-	}
+	l, err := listen("pop3", server.config.POP3Port, server.config.POP3Listener, server.access, server.log)
 	if err != nil {
 		server.log.Error("listen", zap.Error(err))
 		return nil, err
 	}
-
+	l.tlsConfig = tlsConfig
+	if server.config.POP3Listener.CommandTimeout == "" {
+		l.commandTimeout = pop3CommandTimeout
+	}
+	l.busy = func(conn net.Conn) {
+		fmt.Fprintf(conn, "-ERR [SYS/TEMP] too many connections\r\n")
+	}
 	return l, nil
 }
 
@@ -102,46 +171,106 @@ func (server *pop3Server) Name() string {
 	return server.config.Hostname
 }
 
+// OpenMailbox opens the maildrop for mailbox@domain. The user
+// mailbox+folder@domain opens a folder of the maildrop instead, such as the
+// one holding quarantined mail, and the user quarantine@domain opens that
+// quarantine folder.
 func (server *pop3Server) OpenMailbox(user, pass string) (pop3.Mailbox, error) {
+	var folder string
+	isFolder := false
+	isQuarantine := false
+	if at := strings.LastIndexByte(user, '@'); strings.HasPrefix(user, "mailbox+") && at != -1 {
+		folder = user[len("mailbox+"):at]
+		isFolder = true
+		user = MailboxAccount + user[at+1:]
+	} else if strings.HasPrefix(user, QuarantineAccount) {
+		isQuarantine = true
+		user = MailboxAccount + user[len(QuarantineAccount):]
+	}
+
 	for _, s := range server.config.Servers {
 		if user == MailboxAccount+s.Domain && pass == s.MailboxPassword {
-			return server.openMailbox(s.MaildropPath)
+			retention, _ := trashRetention(s)
+			if isQuarantine {
+				// The quarantine is created if needed, so that it can be
+				// opened before anything has been quarantined.
+				md, err := maildrop.New(s.MaildropPath).CreateFolder(quarantineFolder(s))
+				if err != nil {
+					server.log.Error("failed to open quarantine", zap.String("domain", s.Domain), zap.Error(err))
+					return nil, errors.New("no such folder")
+				}
+				return server.openMailbox(md, retention)
+			}
+			if !isFolder {
+				return server.openMailbox(maildrop.New(s.MaildropPath), retention)
+			}
+			md, err := maildrop.New(s.MaildropPath).Folder(folder)
+			if err != nil {
+				server.log.Error("failed to open folder", zap.String("folder", folder), zap.Error(err))
+				return nil, errors.New("no such folder")
+			}
+			return server.openMailbox(md, retention)
 		}
 	}
 	return nil, errors.New("permission denied")
 }
 
-func (server *pop3Server) openMailbox(maildrop string) (*mailbox, error) {
-	files, err := ioutil.ReadDir(maildrop)
+// trashRetention returns how long messages deleted from the maildrop of |s|
+// are kept in its trash, or zero if they are removed at once.
+func trashRetention(s Server) (time.Duration, error) {
+	if s.TrashRetention == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s.TrashRetention)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("must be positive")
+	}
+	return d, err
+}
+
+// openMailbox opens |md| for a POP3 session. If |retention| is non-zero,
+// deleted messages are moved to the trash and kept that long.
+func (server *pop3Server) openMailbox(md *maildrop.Maildrop, retention time.Duration) (*mailbox, error) {
+	path := md.Path()
+	entries, err := server.listings.List(md)
 	if err != nil {
-		server.log.Error("failed read maildrop dir", zap.String("dir", maildrop), zap.Error(err))
+		server.log.Error("failed read maildrop dir", zap.String("dir", path), zap.Error(err))
 		return nil, errors.New("error opening maildrop")
 	}
 
 	mb := &mailbox{
-		messages: make([]message, 0, len(files)),
+		md:        md,
+		listings:  server.listings,
+		events:    server.events,
+		retention: retention,
+		log:       server.log,
+		messages:  make([]message, 0, len(entries)),
 	}
 
-	i := 0
-	for _, file := range files {
-		if file.IsDir() {
-			continue
-		}
-
+	for i, entry := range entries {
 		msg := message{
-			filename: path.Join(maildrop, file.Name()),
+			filename: filepath.Join(path, entry.ID+maildrop.MessageExt),
 			index:    i,
-			size:     file.Size(),
+			size:     entry.Size,
+			modTime:  entry.ModTime,
 		}
 		mb.messages = append(mb.messages, msg)
-		i++
 	}
 
 	return mb, nil
 }
 
 type mailbox struct {
+	md       *maildrop.Maildrop
+	listings *maildrop.ListCache
+	events   *mailboxEvents
 	messages []message
+
+	// retention is how long deleted messages are kept in the trash, or zero
+	// if they are removed at once.
+	retention time.Duration
+
+	log *zap.Logger
 }
 
 type message struct {
@@ -149,11 +278,14 @@ type message struct {
 	index    int
 	size     int64
 	deleted  bool
+	// modTime is when the message file was written, which is when it was
+	// delivered.
+	modTime time.Time
 }
 
 func (m message) UniqueID() string {
 	l := len(m.filename)
-	return path.Base(m.filename[:l-len(".msg")])
+	return filepath.Base(m.filename[:l-len(maildrop.MessageExt)])
 }
 
 func (m message) ID() int {
@@ -168,6 +300,10 @@ func (m message) Deleted() bool {
 	return m.deleted
 }
 
+func (m message) Delivered() time.Time {
+	return m.modTime
+}
+
 func (mb *mailbox) ListMessages() ([]pop3.Message, error) {
 	msgs := make([]pop3.Message, len(mb.messages))
 	for i := 0; i < len(mb.messages); i++ {
@@ -194,10 +330,37 @@ func (mb *mailbox) Delete(msg pop3.Message) error {
 }
 
 func (mb *mailbox) Close() error {
+	var removed []string
 	for _, message := range mb.messages {
-		if message.deleted {
-			os.Remove(message.filename)
+		if !message.deleted {
+			continue
+		}
+		id := message.UniqueID()
+		if mb.retention > 0 {
+			if err := mb.md.Trash(id); err != nil {
+				mb.log.Error("failed to trash message", zap.String("id", id), zap.Error(err))
+				continue
+			}
+		} else {
+			mb.md.Remove(id)
 		}
+		removed = append(removed, id)
+	}
+	if mb.retention > 0 {
+		expired, err := mb.md.EmptyTrash(time.Now().Add(-mb.retention))
+		if err != nil {
+			mb.log.Error("failed to empty trash", zap.String("dir", mb.md.Path()), zap.Error(err))
+		} else if len(expired) > 0 {
+			mb.log.Info("emptied trash", zap.String("dir", mb.md.Path()), zap.Int("removed", len(expired)))
+		}
+	}
+	if len(removed) > 0 {
+		// The listing is invalidated now, rather than by the event, so that
+		// the next login does not see the removed messages.
+		mb.listings.Invalidate(mb.md.Path())
+	}
+	for _, id := range removed {
+		mb.events.publish(mailboxEvent{Kind: mailboxRemoved, Path: mb.md.Path(), ID: id})
 	}
 	return nil
 }
@@ -0,0 +1,286 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package pop3
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client is a POP3 client, for fetching mail from another server.
+type Client struct {
+	tp *textproto.Conn
+
+	// caps is nil until Capabilities succeeds.
+	caps map[string]string
+}
+
+// MessageInfo describes a message in a maildrop listing.
+type MessageInfo struct {
+	ID   int
+	Size int64
+	// UID is the unique-id from UIDL, or empty if the server does not
+	// support it.
+	UID string
+	// Delivered is the time from the XLISTTIME extension, or zero if the
+	// server did not report it.
+	Delivered time.Time
+}
+
+// ServerError is a -ERR reply from the server.
+type ServerError string
+
+func (e ServerError) Error() string {
+	return "pop3: " + string(e)
+}
+
+// Dial connects to the POP3 server at |addr|. For a TLS connection, use
+// tls.Dial and NewClient.
+func Dial(addr string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn)
+}
+
+// NewClient reads the greeting from the server on |conn|.
+func NewClient(conn net.Conn) (*Client, error) {
+	c := &Client{tp: textproto.NewConn(conn)}
+	if _, err := c.readResponse(); err != nil {
+		c.tp.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Client) Close() error {
+	return c.tp.Close()
+}
+
+// cmd sends a command and reads the status line, returning the text after
+// +OK.
+func (c *Client) cmd(format string, args ...interface{}) (string, error) {
+	if err := c.tp.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+	return c.readResponse()
+}
+
+func (c *Client) readResponse() (string, error) {
+	line, err := c.tp.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(line, "+OK") {
+		return strings.TrimSpace(line[3:]), nil
+	}
+	if strings.HasPrefix(line, "-ERR") {
+		return "", ServerError(strings.TrimSpace(line[4:]))
+	}
+	return "", fmt.Errorf("pop3: malformed response %q", line)
+}
+
+// Capabilities returns the server's CAPA response, keyed by capability
+// name, with any parameters as the value. A server that does not support
+// CAPA has no capabilities.
+func (c *Client) Capabilities() (map[string]string, error) {
+	if c.caps != nil {
+		return c.caps, nil
+	}
+
+	caps := make(map[string]string)
+	_, err := c.cmd("CAPA")
+	if _, ok := err.(ServerError); ok {
+		c.caps = caps
+		return caps, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	lines, err := c.tp.ReadDotLines()
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		fields := strings.SplitN(line, " ", 2)
+		name := strings.ToUpper(fields[0])
+		if len(fields) == 2 {
+			caps[name] = fields[1]
+		} else {
+			caps[name] = ""
+		}
+	}
+	c.caps = caps
+	return caps, nil
+}
+
+// Auth logs in with USER and PASS.
+func (c *Client) Auth(user, pass string) error {
+	if _, err := c.cmd("USER %s", user); err != nil {
+		return err
+	}
+	_, err := c.cmd("PASS %s", pass)
+	return err
+}
+
+// Stat returns the number of messages and their total size.
+func (c *Client) Stat() (int, int64, error) {
+	resp, err := c.cmd("STAT")
+	if err != nil {
+		return 0, 0, err
+	}
+	var count int
+	var size int64
+	if _, err := fmt.Sscanf(resp, "%d %d", &count, &size); err != nil {
+		return 0, 0, fmt.Errorf("pop3: malformed STAT response %q", resp)
+	}
+	return count, size, nil
+}
+
+// ListTimes asks the server to add delivery times to List, if it supports
+// the XLISTTIME extension. It reports whether it does.
+func (c *Client) ListTimes() (bool, error) {
+	caps, err := c.Capabilities()
+	if err != nil {
+		return false, err
+	}
+	if _, ok := caps["XLISTTIME"]; !ok {
+		return false, nil
+	}
+	if _, err := c.cmd("XLISTTIME"); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// List returns the ID and size of each message, and the delivery time if
+// ListTimes enabled it.
+func (c *Client) List() ([]MessageInfo, error) {
+	lines, err := c.multiline("LIST")
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]MessageInfo, 0, len(lines))
+	for _, line := range lines {
+		var msg MessageInfo
+		var delivered int64
+		n, err := fmt.Sscanf(line, "%d %d %d", &msg.ID, &msg.Size, &delivered)
+		if n < 2 {
+			return nil, fmt.Errorf("pop3: malformed LIST line %q", line)
+		}
+		if err == nil {
+			msg.Delivered = time.Unix(delivered, 0)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// UIDL returns the ID and unique-id of each message.
+func (c *Client) UIDL() ([]MessageInfo, error) {
+	lines, err := c.multiline("UIDL")
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]MessageInfo, 0, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("pop3: malformed UIDL line %q", line)
+		}
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("pop3: malformed UIDL line %q", line)
+		}
+		msgs = append(msgs, MessageInfo{ID: id, UID: fields[1]})
+	}
+	return msgs, nil
+}
+
+// NewMessages returns the messages whose UIDs are not in |seen|, with their
+// sizes. If the server does not support UIDL, every message is returned,
+// with an empty UID.
+func (c *Client) NewMessages(seen map[string]bool) ([]MessageInfo, error) {
+	list, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+
+	caps, err := c.Capabilities()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := caps["UIDL"]; !ok && len(caps) > 0 {
+		return list, nil
+	}
+
+	uids, err := c.UIDL()
+	if _, ok := err.(ServerError); ok {
+		// Without CAPA, the only way to know is to try.
+		return list, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	uidByID := make(map[int]string, len(uids))
+	for _, msg := range uids {
+		uidByID[msg.ID] = msg.UID
+	}
+
+	var msgs []MessageInfo
+	for _, msg := range list {
+		msg.UID = uidByID[msg.ID]
+		if msg.UID != "" && seen[msg.UID] {
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// Retr returns the content of message |id|, with dot-stuffing removed.
+func (c *Client) Retr(id int) ([]byte, error) {
+	if _, err := c.cmd("RETR %d", id); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(c.tp.DotReader())
+}
+
+// Dele marks message |id| for deletion when the session ends with Quit.
+func (c *Client) Dele(id int) error {
+	_, err := c.cmd("DELE %d", id)
+	return err
+}
+
+// Quit ends the session, which deletes the marked messages, and closes the
+// connection.
+func (c *Client) Quit() error {
+	_, err := c.cmd("QUIT")
+	if cerr := c.tp.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (c *Client) multiline(cmd string) ([]string, error) {
+	if _, err := c.cmd(cmd); err != nil {
+		return nil, err
+	}
+	lines, err := c.tp.ReadDotLines()
+	if err == io.EOF {
+		err = errors.New("pop3: connection closed during " + cmd)
+	}
+	return lines, err
+}
@@ -0,0 +1,147 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package pop3
+
+import (
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+func TestClientNewMessages(t *testing.T) {
+	s := newTestServer()
+	l := runServer(t, s)
+	defer l.Close()
+
+	s.mb.msgs[1] = &testMessage{1, 10, false, "one\r\n"}
+	s.mb.msgs[2] = &testMessage{2, 20, false, ".two\r\n"}
+	s.mb.msgs[3] = &testMessage{3, 30, false, "three\r\n"}
+
+	c, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	caps, err := c.Capabilities()
+	ok(t, err)
+	if _, has := caps["UIDL"]; !has {
+		t.Errorf("Want UIDL capability, got %v", caps)
+	}
+
+	if err := c.Auth("u", "x"); err == nil {
+		t.Errorf("Want error for bad password")
+	}
+	ok(t, c.Auth("u", "p"))
+
+	count, size, err := c.Stat()
+	ok(t, err)
+	if count != 3 || size != 60 {
+		t.Errorf("Want STAT 3 60, got %d %d", count, size)
+	}
+
+	seen := map[string]bool{
+		s.mb.msgs[1].UniqueID(): true,
+		s.mb.msgs[3].UniqueID(): true,
+	}
+	msgs, err := c.NewMessages(seen)
+	ok(t, err)
+	if want, got := 1, len(msgs); want != got {
+		t.Fatalf("Want %d new messages, got %d: %v", want, got, msgs)
+	}
+	if want, got := (MessageInfo{ID: 2, Size: 20, UID: s.mb.msgs[2].UniqueID()}), msgs[0]; want != got {
+		t.Errorf("Want %v, got %v", want, got)
+	}
+
+	body, err := c.Retr(2)
+	ok(t, err)
+	if want, got := ".two\n", string(body); want != got {
+		t.Errorf("Want body %q, got %q", want, got)
+	}
+
+	ok(t, c.Dele(2))
+	ok(t, c.Quit())
+	if !s.mb.msgs[2].Deleted() {
+		t.Errorf("Message was not deleted")
+	}
+}
+
+func TestClientListTimes(t *testing.T) {
+	s := newTestServer()
+	l := runServer(t, s)
+	defer l.Close()
+
+	s.mb.msgs[1] = &testMessage{1, 10, false, "one\r\n"}
+
+	c, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ok(t, c.Auth("u", "p"))
+
+	msgs, err := c.List()
+	ok(t, err)
+	if len(msgs) != 1 || !msgs[0].Delivered.IsZero() {
+		t.Errorf("Want no delivery time before ListTimes, got %v", msgs)
+	}
+
+	enabled, err := c.ListTimes()
+	ok(t, err)
+	if !enabled {
+		t.Fatalf("Want XLISTTIME to be supported")
+	}
+	msgs, err = c.List()
+	ok(t, err)
+	if want := (MessageInfo{ID: 1, Size: 10, Delivered: time.Unix(1600000001, 0)}); len(msgs) != 1 || msgs[0] != want {
+		t.Errorf("Want %v, got %v", want, msgs)
+	}
+	ok(t, c.Quit())
+}
+
+func TestClientNewMessagesWithoutUIDL(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		tp := textproto.NewConn(server)
+		tp.PrintfLine("+OK ready")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			switch line {
+			case "LIST":
+				tp.PrintfLine("+OK")
+				tp.PrintfLine("1 100")
+				tp.PrintfLine("2 200")
+				tp.PrintfLine(".")
+			default:
+				tp.PrintfLine("-ERR unknown command")
+			}
+		}
+	}()
+
+	c, err := NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	msgs, err := c.NewMessages(map[string]bool{})
+	ok(t, err)
+	if want, got := 2, len(msgs); want != got {
+		t.Fatalf("Want %d messages, got %d", want, got)
+	}
+	for i, msg := range msgs {
+		if msg.ID != i+1 || msg.UID != "" {
+			t.Errorf("Unexpected message %v", msg)
+		}
+	}
+}
@@ -7,15 +7,27 @@
 package pop3
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/textproto"
 	"strings"
+	"sync"
 
-	"go.uber.org/zap"
+	"src.bluestatic.org/mailpopbox/logger"
 )
 
+// copyBufferPool holds buffers for copying messages to clients.
+var copyBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 32*1024)
+		return &buf
+	},
+}
+
 type state int
 
 const (
@@ -24,6 +36,18 @@ const (
 	stateUpdate
 )
 
+func (s state) String() string {
+	switch s {
+	case stateAuth:
+		return "authorization"
+	case stateTxn:
+		return "transaction"
+	case stateUpdate:
+		return "update"
+	}
+	return fmt.Sprintf("state(%d)", int(s))
+}
+
 const (
 	errStateAuth  = "not in AUTHORIZATION"
 	errStateTxn   = "not in TRANSACTION"
@@ -31,39 +55,93 @@ const (
 	errDeletedMsg = "no such message - deleted"
 )
 
+// Defaults for Options. The line length is from RFC 2449 §4.
+const (
+	DefaultMaxLineLength = 255
+	DefaultMaxCommands   = 100000
+)
+
+var errLineTooLong = errors.New("line too long")
+
+// Options configures the connections handled by AcceptConnection. Zero values
+// use the defaults.
+type Options struct {
+	// MaxLineLength is the longest command line accepted, including the CRLF.
+	MaxLineLength int
+	// MaxCommands is the number of commands after which the connection is
+	// closed.
+	MaxCommands int
+
+	// StateChanged, if set, is called with the name of the connection's
+	// protocol state each time it changes.
+	StateChanged func(state string) `json:"-"`
+}
+
+func (o Options) withDefaults() Options {
+	if o.MaxLineLength <= 0 {
+		o.MaxLineLength = DefaultMaxLineLength
+	}
+	if o.MaxCommands <= 0 {
+		o.MaxCommands = DefaultMaxCommands
+	}
+	return o
+}
+
 type connection struct {
-	po PostOffice
-	mb Mailbox
+	po   PostOffice
+	mb   Mailbox
+	opts Options
 
 	tp         *textproto.Conn
 	remoteAddr net.Addr
 
-	log *zap.Logger
+	log logger.Logger
 
 	state
 	line string
 
 	user string
+
+	// listTime is set by XLISTTIME to add delivery times to LIST.
+	listTime bool
 }
 
-func AcceptConnection(netConn net.Conn, po PostOffice, log *zap.Logger) {
-	log = log.With(zap.Stringer("client", netConn.RemoteAddr()))
+func AcceptConnection(netConn net.Conn, po PostOffice, opts Options, log logger.Logger) {
+	log = log.With("client", netConn.RemoteAddr())
 	conn := connection{
-		po:    po,
-		tp:    textproto.NewConn(netConn),
-		state: stateAuth,
-		log:   log,
+		po:   po,
+		opts: opts.withDefaults(),
+		tp:   textproto.NewConn(netConn),
+		log:  log,
 	}
+	conn.setState(stateAuth)
 
 	conn.log.Info("accepted connection")
 	conn.ok(fmt.Sprintf("POP3 (mailpopbox) server %s", po.Name()))
 
 	var err error
 
-	for {
-		conn.line, err = conn.tp.ReadLine()
-		if err != nil {
-			conn.log.Error("ReadLine()", zap.Error(err))
+	for commands := 1; ; commands++ {
+		// The line ending is not returned, but it counts towards the limit.
+		conn.line, err = readLimitedLine(conn.tp.R, conn.opts.MaxLineLength-2)
+		if err == errLineTooLong {
+			conn.err("line too long")
+			continue
+		} else if isTimeout(err) {
+			// The autologout timer of RFC 1939 § 3.
+			conn.log.Info("connection timed out")
+			conn.err("autologout")
+			conn.tp.Close()
+			return
+		} else if err != nil {
+			conn.log.Error("ReadLine()", "error", err)
+			conn.tp.Close()
+			return
+		}
+
+		if commands > conn.opts.MaxCommands {
+			conn.log.Warn("too many commands", "commands", commands)
+			conn.err("too many commands")
 			conn.tp.Close()
 			return
 		}
@@ -74,7 +152,7 @@ func AcceptConnection(netConn net.Conn, po PostOffice, log *zap.Logger) {
 			continue
 		}
 
-		conn.log = log.With(zap.String("command", cmd))
+		conn.log = log.With("command", cmd)
 
 		switch strings.ToUpper(cmd) {
 		case "QUIT":
@@ -90,6 +168,8 @@ func AcceptConnection(netConn net.Conn, po PostOffice, log *zap.Logger) {
 			conn.doLIST()
 		case "RETR":
 			conn.doRETR()
+		case "TOP":
+			conn.doTOP()
 		case "DELE":
 			conn.doDELE()
 		case "NOOP":
@@ -100,14 +180,55 @@ func AcceptConnection(netConn net.Conn, po PostOffice, log *zap.Logger) {
 			conn.doUIDL()
 		case "CAPA":
 			conn.doCAPA()
+		case "XLISTTIME":
+			conn.doXLISTTIME()
 		default:
 			conn.err("unknown command")
 		}
 	}
 }
 
+// isTimeout reports whether |err| is from a read that passed the deadline
+// set by the listener.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// readLimitedLine reads the next line, without the line ending. If the line
+// is longer than |max| bytes, the rest of it is discarded and errLineTooLong
+// is returned.
+func readLimitedLine(r *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		chunk, more, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		if len(line)+len(chunk) > max {
+			for more {
+				if _, more, err = r.ReadLine(); err != nil {
+					return "", err
+				}
+			}
+			return "", errLineTooLong
+		}
+		line = append(line, chunk...)
+		if !more {
+			return string(line), nil
+		}
+	}
+}
+
+func (conn *connection) setState(s state) {
+	conn.state = s
+	if conn.opts.StateChanged != nil {
+		conn.opts.StateChanged(s.String())
+	}
+}
+
 func (conn *connection) ok(msg string) {
-	conn.log.Info("ok", zap.String("reply", msg))
+	conn.log.Info("ok", "reply", msg)
 	if len(msg) > 0 {
 		msg = " " + msg
 	}
@@ -115,7 +236,7 @@ func (conn *connection) ok(msg string) {
 }
 
 func (conn *connection) err(msg string) {
-	conn.log.Error("error", zap.String("message", msg))
+	conn.log.Error("error", "message", msg)
 	if len(msg) > 0 {
 		msg = " " + msg
 		conn.tp.PrintfLine("-ERR%s", msg)
@@ -170,12 +291,12 @@ func (conn *connection) doPASS() {
 
 	pass := conn.line[cmd:]
 	if mbox, err := conn.po.OpenMailbox(conn.user, pass); err == nil {
-		conn.log.Info("authenticated", zap.String("user", conn.user))
-		conn.state = stateTxn
+		conn.log.Info("authenticated", "user", conn.user)
+		conn.setState(stateTxn)
 		conn.mb = mbox
 		conn.ok("")
 	} else {
-		conn.log.Error("failed to open mailbox", zap.Error(err))
+		conn.log.Error("failed to open mailbox", "error", err)
 		conn.err(err.Error())
 	}
 }
@@ -188,7 +309,7 @@ func (conn *connection) doSTAT() {
 
 	msgs, err := conn.mb.ListMessages()
 	if err != nil {
-		conn.log.Error("failed to list messages", zap.Error(err))
+		conn.log.Error("failed to list messages", "error", err)
 		conn.err(err.Error())
 		return
 	}
@@ -214,13 +335,20 @@ func (conn *connection) doLIST() {
 
 	msgs, err := conn.mb.ListMessages()
 	if err != nil {
-		conn.log.Error("failed to list messages", zap.Error(err))
+		conn.log.Error("failed to list messages", "error", err)
 		conn.err(err.Error())
 		return
 	}
 
 	conn.ok("scan listing")
 	for _, msg := range msgs {
+		// RFC 1939 § 5 allows more information after the size.
+		if tm, ok := msg.(TimedMessage); ok && conn.listTime {
+			if delivered := tm.Delivered(); !delivered.IsZero() {
+				conn.tp.PrintfLine("%d %d %d", msg.ID(), msg.Size(), delivered.Unix())
+				continue
+			}
+		}
 		conn.tp.PrintfLine("%d %d", msg.ID(), msg.Size())
 	}
 	conn.tp.PrintfLine(".")
@@ -244,19 +372,101 @@ func (conn *connection) doRETR() {
 
 	rc, err := conn.mb.Retrieve(msg)
 	if err != nil {
-		conn.log.Error("failed to retrieve messages", zap.Error(err))
+		conn.log.Error("failed to retrieve messages", "error", err)
 		conn.err(err.Error())
 		return
 	}
 
-	conn.log.Info("retrieve message", zap.String("unique-id", msg.UniqueID()))
+	conn.log.Info("retrieve message", "unique-id", msg.UniqueID())
 	conn.ok(fmt.Sprintf("%d", msg.Size()))
 
+	bufp := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(bufp)
+
 	w := conn.tp.DotWriter()
-	io.Copy(w, rc)
+	// Hide any WriterTo implementation so that the pooled buffer is used.
+	io.CopyBuffer(w, struct{ io.Reader }{rc}, *bufp)
 	w.Close()
 }
 
+// doTOP sends the header of a message and the first lines of its body (RFC
+// 1939 § 7), which lets clients preview large messages without downloading
+// them. Only as much of the message as is sent is read.
+func (conn *connection) doTOP() {
+	if conn.state != stateTxn {
+		conn.err(errStateTxn)
+		return
+	}
+
+	var cmd string
+	var idx, lines int
+	if _, err := fmt.Sscanf(conn.line, "%s %d %d", &cmd, &idx, &lines); err != nil || lines < 0 {
+		conn.err(errSyntax)
+		return
+	}
+
+	msg := conn.getRequestedMessage()
+	if msg == nil {
+		return
+	}
+
+	if msg.Deleted() {
+		conn.err(errDeletedMsg)
+		return
+	}
+
+	rc, err := conn.mb.Retrieve(msg)
+	if err != nil {
+		conn.log.Error("failed to retrieve messages", "error", err)
+		conn.err(err.Error())
+		return
+	}
+	defer rc.Close()
+
+	conn.log.Info("top of message", "unique-id", msg.UniqueID(), "lines", lines)
+	conn.ok("top of message follows")
+
+	w := conn.tp.DotWriter()
+	if err := copyTop(w, rc, lines); err != nil {
+		conn.log.Error("failed to read message", "error", err)
+	}
+	w.Close()
+}
+
+// copyTop copies the header of the message in |r| to |w|, followed by the
+// first |lines| lines of its body. The rest of |r| is not read.
+func copyTop(w io.Writer, r io.Reader, lines int) error {
+	br := bufio.NewReader(r)
+	inBody, continued := false, false
+	for !inBody || lines > 0 {
+		line, err := br.ReadSlice('\n')
+		if len(line) > 0 {
+			if _, err := w.Write(line); err != nil {
+				return err
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			// Part of a long line, which continues in the next read.
+			continued = true
+			continue
+		}
+		if len(line) > 0 {
+			if inBody {
+				lines--
+			} else if !continued && len(bytes.TrimRight(line, "\r\n")) == 0 {
+				inBody = true
+			}
+		}
+		continued = false
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (conn *connection) doDELE() {
 	if conn.state != stateTxn {
 		conn.err(errStateTxn)
@@ -274,10 +484,10 @@ func (conn *connection) doDELE() {
 	}
 
 	if err := conn.mb.Delete(msg); err != nil {
-		conn.log.Error("failed to delete message", zap.Error(err))
+		conn.log.Error("failed to delete message", "error", err)
 		conn.err(err.Error())
 	} else {
-		conn.log.Info("delete message", zap.String("unique-id", msg.UniqueID()))
+		conn.log.Info("delete message", "unique-id", msg.UniqueID())
 		conn.ok("")
 	}
 }
@@ -300,7 +510,7 @@ func (conn *connection) doUIDL() {
 
 	msgs, err := conn.mb.ListMessages()
 	if err != nil {
-		conn.log.Error("failed to list messages", zap.Error(err))
+		conn.log.Error("failed to list messages", "error", err)
 		conn.err(err.Error())
 		return
 	}
@@ -321,6 +531,8 @@ func (conn *connection) doCAPA() {
 	caps := []string{
 		"USER",
 		"UIDL",
+		"TOP",
+		"XLISTTIME",
 		".",
 	}
 	for _, c := range caps {
@@ -328,6 +540,14 @@ func (conn *connection) doCAPA() {
 	}
 }
 
+// doXLISTTIME enables the XLISTTIME extension for the rest of the session.
+// Each line of the LIST response then ends with the time the message was
+// delivered, in seconds since the Unix epoch, if it is known.
+func (conn *connection) doXLISTTIME() {
+	conn.listTime = true
+	conn.ok("LIST includes delivery times")
+}
+
 func (conn *connection) getRequestedMessage() Message {
 	var cmd string
 	var idx int
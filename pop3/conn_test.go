@@ -18,8 +18,9 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
-	"go.uber.org/zap"
+	"src.bluestatic.org/mailpopbox/logger"
 )
 
 func _fl(depth int) string {
@@ -56,6 +57,10 @@ func responseERR(t testing.TB, conn *textproto.Conn) string {
 }
 
 func runServer(t *testing.T, po PostOffice) net.Listener {
+	return runServerWithOptions(t, po, Options{})
+}
+
+func runServerWithOptions(t *testing.T, po PostOffice, opts Options) net.Listener {
 	l, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
 		t.Fatal(err)
@@ -68,7 +73,7 @@ func runServer(t *testing.T, po PostOffice) net.Listener {
 			if err != nil {
 				return
 			}
-			go AcceptConnection(conn, po, zap.NewNop())
+			go AcceptConnection(conn, po, opts, logger.Nop())
 		}
 	}()
 	return l
@@ -162,6 +167,9 @@ func (m *testMessage) Size() int {
 func (m *testMessage) Deleted() bool {
 	return m.deleted
 }
+func (m *testMessage) Delivered() time.Time {
+	return time.Unix(int64(1600000000+m.id), 0)
+}
 
 func newTestServer() *testServer {
 	return &testServer{
@@ -235,7 +243,11 @@ func expectOKResponse(predicate func(string) bool) func(testing.TB, *textproto.C
 }
 
 func clientServerTest(t *testing.T, s *testServer, sequence []requestResponse) {
-	l := runServer(t, s)
+	clientServerTestWithOptions(t, s, Options{}, sequence)
+}
+
+func clientServerTestWithOptions(t *testing.T, s *testServer, opts Options, sequence []requestResponse) {
+	l := runServerWithOptions(t, s, opts)
 	defer l.Close()
 
 	conn, err := textproto.Dial(l.Addr().Network(), l.Addr().String())
@@ -360,6 +372,61 @@ func TestRetr(t *testing.T) {
 	})
 }
 
+func TestTop(t *testing.T) {
+	s := newTestServer()
+	s.mb.msgs[1] = &testMessage{1, 60, false, "Subject: hi\r\nFrom: a@example.com\r\n\r\none\r\n.\r\nthree\r\nfour\r\n"}
+	s.mb.msgs[2] = &testMessage{2, 9, false, "Subject: hi"}
+
+	topTest := func(want []string) func(testing.TB, *textproto.Conn) string {
+		return func(t testing.TB, tp *textproto.Conn) string {
+			responseOK(t, tp)
+			if t.Failed() {
+				return ""
+			}
+
+			resp, err := tp.ReadDotLines()
+			if err != nil {
+				t.Error(err)
+				return ""
+			}
+
+			if !reflect.DeepEqual(resp, want) {
+				t.Errorf("Want %v, got %v", want, resp)
+			}
+			return ""
+		}
+	}
+
+	clientServerTest(t, s, []requestResponse{
+		{"TOP 1 0", responseERR},
+		{"USER u", responseOK},
+		{"PASS p", responseOK},
+		{"TOP 1 0", topTest([]string{"Subject: hi", "From: a@example.com", ""})},
+		{"TOP 1 2", topTest([]string{"Subject: hi", "From: a@example.com", "", "one", "."})},
+		{"TOP 1 10", topTest([]string{"Subject: hi", "From: a@example.com", "", "one", ".", "three", "four"})},
+		{"TOP 2 5", topTest([]string{"Subject: hi"})},
+		{"TOP 1", responseERR},
+		{"TOP 1 -1", responseERR},
+		{"TOP 3 1", responseERR},
+		{"DELE 1", responseOK},
+		{"TOP 1 1", responseERR},
+		{"QUIT", responseOK},
+	})
+}
+
+func TestCopyTopLongLines(t *testing.T) {
+	long := strings.Repeat("x", 5000)
+	msg := "Subject: " + long + "\r\n\r\n" + long + "\r\nsecond\r\n"
+
+	var buf strings.Builder
+	if err := copyTop(&buf, strings.NewReader(msg), 1); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "Subject: "+long+"\r\n\r\n"+long+"\r\n", buf.String(); want != got {
+		t.Errorf("Want %d bytes, got %d", len(want), len(got))
+	}
+}
+
 func TestUidl(t *testing.T) {
 	s := newTestServer()
 	s.mb.msgs[1] = &testMessage{1, 3, false, "abc"}
@@ -395,6 +462,33 @@ func TestUidl(t *testing.T) {
 	})
 }
 
+func TestListTime(t *testing.T) {
+	s := newTestServer()
+	s.mb.msgs[1] = &testMessage{1, 3, false, "abc"}
+	s.mb.msgs[2] = &testMessage{2, 4, false, "test"}
+
+	listTest := func(want ...string) func(testing.TB, *textproto.Conn) string {
+		return func(t testing.TB, tp *textproto.Conn) string {
+			responseOK(t, tp)
+			resp, err := tp.ReadDotLines()
+			ok(t, err)
+			if !reflect.DeepEqual(resp, want) {
+				t.Errorf("Want %v, got %v", want, resp)
+			}
+			return ""
+		}
+	}
+
+	clientServerTest(t, s, []requestResponse{
+		{"USER u", responseOK},
+		{"PASS p", responseOK},
+		{"LIST", listTest("1 3", "2 4")},
+		{"XLISTTIME", responseOK},
+		{"LIST", listTest("1 3 1600000001", "2 4 1600000002")},
+		{"QUIT", responseOK},
+	})
+}
+
 func TestDele(t *testing.T) {
 	s := newTestServer()
 	s.mb.msgs[1] = &testMessage{1, 3, false, "abc"}
@@ -464,8 +558,10 @@ func TestCapa(t *testing.T) {
 		)
 
 		caps := map[string]int{
-			"USER": capNeeded,
-			"UIDL": capNeeded,
+			"USER":      capNeeded,
+			"UIDL":      capNeeded,
+			"TOP":       capNeeded,
+			"XLISTTIME": capNeeded,
 		}
 		for _, line := range resp {
 			if val, ok := caps[line]; ok {
@@ -495,3 +591,60 @@ func TestCapa(t *testing.T) {
 		{"QUIT", responseOK},
 	})
 }
+
+func TestLineLimit(t *testing.T) {
+	clientServerTestWithOptions(t, newTestServer(), Options{MaxLineLength: 12}, []requestResponse{
+		{"USER u", responseOK},
+		{"USER " + strings.Repeat("x", 8000), responseERR},
+		{"PASS p", responseOK},
+		{"NOOP", responseOK},
+		{"QUIT", responseOK},
+	})
+}
+
+func TestCommandLimit(t *testing.T) {
+	s := newTestServer()
+	l := runServerWithOptions(t, s, Options{MaxCommands: 2})
+	defer l.Close()
+
+	conn, err := textproto.Dial(l.Addr().Network(), l.Addr().String())
+	ok(t, err)
+	responseOK(t, conn)
+
+	ok(t, conn.PrintfLine("NOOP"))
+	responseOK(t, conn)
+	ok(t, conn.PrintfLine("NOOP"))
+	responseOK(t, conn)
+	ok(t, conn.PrintfLine("NOOP"))
+	responseERR(t, conn)
+
+	if _, err := conn.ReadLine(); err != io.EOF {
+		t.Errorf("Expected connection to be closed, got %v", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	ok(t, err)
+	defer l.Close()
+	go func() {
+		nc, err := l.Accept()
+		if err != nil {
+			return
+		}
+		// The listener sets deadlines like this in the server.
+		nc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		AcceptConnection(nc, newTestServer(), Options{}, logger.Nop())
+	}()
+
+	conn, err := textproto.Dial(l.Addr().Network(), l.Addr().String())
+	ok(t, err)
+	responseOK(t, conn)
+
+	if want, got := "-ERR autologout", responseERR(t, conn); want != got {
+		t.Errorf("Want timeout reply %q, got %q", want, got)
+	}
+	if _, err := conn.ReadLine(); err != io.EOF {
+		t.Errorf("Expected connection to be closed, got %v", err)
+	}
+}
@@ -8,6 +8,7 @@ package pop3
 
 import (
 	"io"
+	"time"
 )
 
 type Message interface {
@@ -17,6 +18,13 @@ type Message interface {
 	Deleted() bool
 }
 
+// TimedMessage may be implemented by a Message to report when it was
+// delivered. With the XLISTTIME extension, the time is added to its LIST
+// line, so clients can tell the age of messages without retrieving them.
+type TimedMessage interface {
+	Delivered() time.Time
+}
+
 type Mailbox interface {
 	ListMessages() ([]Message, error)
 	GetMessage(int) Message
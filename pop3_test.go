@@ -12,15 +12,18 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/pop3"
 )
 
 func TestReset(t *testing.T) {
 	mbox := mailbox{
 		messages: []message{
-			{"msg1", 1, 4, false},
-			{"msg2", 2, 4, false},
+			{filename: "msg1", index: 1, size: 4},
+			{filename: "msg2", index: 2, size: 4},
 		},
 	}
 
@@ -117,7 +120,15 @@ func TestBasicListener(t *testing.T) {
 
 	go s.run()
 
-	conn, err := textproto.Dial("tcp", "localhost:9648")
+	// The listener is created asynchronously, so allow a few attempts.
+	var conn *textproto.Conn
+	for i := 0; i < 50; i++ {
+		conn, err = textproto.Dial("tcp", "localhost:9648")
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 	if err != nil {
 		t.Errorf("Failed to dial test server: %v", err)
 		return
@@ -130,6 +141,44 @@ func TestBasicListener(t *testing.T) {
 	}
 }
 
+func TestListenerInvalidMaildrop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &pop3Server{
+		config: Config{
+			Hostname: "example.com",
+			Servers: []Server{
+				{
+					Domain:         "example.com",
+					MaildropPath:   dir,
+					TrashRetention: "-1h",
+				},
+			},
+		},
+		controlChan: make(chan ServerControlMessage, 1),
+		log:         zap.NewNop(),
+	}
+
+	// The server stops rather than listening after a fatal error.
+	done := make(chan struct{})
+	go func() {
+		s.run()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server kept running after failing to open the maildrops")
+	}
+	if want, got := ServerControlFatalError, <-s.controlChan; want != got {
+		t.Errorf("Want %v, got %v", want, got)
+	}
+}
+
 func TestMailbox(t *testing.T) {
 	dir, err := ioutil.TempDir("", "maildrop")
 	if err != nil {
@@ -167,6 +216,10 @@ func TestMailbox(t *testing.T) {
 		}
 	}
 	f.Close()
+	delivered := time.Date(2020, time.March, 5, 9, 8, 7, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(dir, "b.msg"), delivered, delivered); err != nil {
+		t.Fatal(err)
+	}
 
 	s := &pop3Server{
 		config: Config{
@@ -178,8 +231,10 @@ func TestMailbox(t *testing.T) {
 				},
 			},
 		},
-		log: zap.NewNop(),
+		events: &mailboxEvents{},
+		log:    zap.NewNop(),
 	}
+	events := s.events.subscribe()
 
 	// Test message metadata.
 	mb, err := s.OpenMailbox("mailbox@example.com", "letmein")
@@ -220,6 +275,9 @@ func TestMailbox(t *testing.T) {
 	if want, got := 1024*3, msgs[1].Size(); want != got {
 		t.Errorf("Want message #2 size to be %v, got %v", want, got)
 	}
+	if got := msgs[1].(pop3.TimedMessage).Delivered(); !got.Equal(delivered) {
+		t.Errorf("Want message #2 delivered at %v, got %v", delivered, got)
+	}
 
 	// Test message contents.
 	rc, err := mb.Retrieve(msgs[0])
@@ -255,6 +313,10 @@ func TestMailbox(t *testing.T) {
 		t.Errorf("Failed to close mailbox: %v", err)
 	}
 
+	if want, got := (mailboxEvent{Kind: mailboxRemoved, Path: dir, ID: "a"}), <-events; want != got {
+		t.Errorf("Want event %+v, got %+v", want, got)
+	}
+
 	mb, err = s.OpenMailbox("mailbox@example.com", "letmein")
 	if err != nil {
 		t.Errorf("Failed to re-open mailbox: %v", err)
@@ -273,3 +335,65 @@ func TestMailbox(t *testing.T) {
 		t.Errorf("Message Unique ID should be %s, got %s", want, got)
 	}
 }
+
+func TestOpenMailboxFolder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, "spam"), 0700); err != nil {
+		t.Fatalf("Failed to create folder: %v", err)
+	}
+	for _, name := range []string{"a.msg", filepath.Join("spam", "s1.msg"), filepath.Join("spam", "s2.msg")} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("Subject: x\r\n\r\n"), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	s := &pop3Server{
+		config: Config{
+			Servers: []Server{
+				{
+					Domain:          "example.com",
+					MailboxPassword: "letmein",
+					MaildropPath:    dir,
+				},
+			},
+		},
+		log: zap.NewNop(),
+	}
+
+	cases := []struct {
+		user, pass string
+		messages   int
+	}{
+		{"mailbox@example.com", "letmein", 1},
+		{"mailbox+spam@example.com", "letmein", 2},
+		{"mailbox+spam@example.com", "wrong", -1},
+		{"mailbox+missing@example.com", "letmein", -1},
+		{"mailbox+..@example.com", "letmein", -1},
+		{"mailbox+@example.com", "letmein", -1},
+		{"quarantine@example.com", "letmein", 0},
+		{"quarantine@example.com", "wrong", -1},
+		{"quarantine@example.net", "letmein", -1},
+	}
+	for _, c := range cases {
+		mb, err := s.OpenMailbox(c.user, c.pass)
+		if c.messages < 0 {
+			if err == nil {
+				t.Errorf("%s: expected error", c.user)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: failed to open: %v", c.user, err)
+			continue
+		}
+		msgs, _ := mb.ListMessages()
+		if want, got := c.messages, len(msgs); want != got {
+			t.Errorf("%s: want %d messages, got %d", c.user, want, got)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderMax is the longest v1 header, including the CRLF.
+const proxyHeaderMax = 107
+
+// proxyHeaderTimeout is how long a proxy has to send the PROXY header, before
+// the connection's own timeouts apply.
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyConn is a connection whose client address came from a PROXY header.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// readProxyHeader reads a PROXY protocol v1 header from |conn|, and returns
+// the connection with the client address it names. For "PROXY UNKNOWN",
+// the proxy's address is kept. The header must arrive within |timeout|.
+func readProxyHeader(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReaderSize(conn, 2*proxyHeaderMax)
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || len(line) > proxyHeaderMax {
+		return nil, errors.New("header too long")
+	} else if err != nil {
+		return nil, err
+	}
+
+	header := strings.TrimSuffix(string(line), "\r\n")
+	if header == string(line) {
+		return nil, errors.New("header does not end with CRLF")
+	}
+
+	fields := strings.Split(header, " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, fmt.Errorf("not a PROXY header: %q", header)
+	}
+	pc := &proxyConn{Conn: conn, r: r, remote: conn.RemoteAddr()}
+	switch fields[1] {
+	case "UNKNOWN":
+		return pc, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unknown protocol %q", fields[1])
+	}
+
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("malformed header: %q", header)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid source address: %q", header)
+	}
+	pc.remote = &net.TCPAddr{IP: ip, Port: int(port)}
+	return pc, nil
+}
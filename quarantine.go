@@ -0,0 +1,135 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+
+	rfc5322 "src.bluestatic.org/mailpopbox/message"
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+var quarantineMetrics = expvar.NewMap("quarantine")
+
+// QuarantineConfig delivers a Server's inbound mail that is classified as
+// spam into a folder of its maildrop, instead of the maildrop itself. A
+// message is spam if rspamd says to add a header to it or rewrite its
+// subject, or if a header field matches one of the Rules. The rules see the
+// headers added by the ContentFilter, so a filter like spamc can classify
+// mail with an X-Spam-Flag header.
+type QuarantineConfig struct {
+	// Folder is the maildrop folder for spam. It defaults to the DMARC
+	// QuarantineFolder, so that both kinds of quarantined mail are kept
+	// together.
+	Folder string
+
+	// Rules are the static rules that classify a message as spam.
+	Rules []QuarantineRule
+}
+
+// QuarantineRule matches messages with a header field whose value matches a
+// regular expression.
+type QuarantineRule struct {
+	// Header is the name of the field, like "X-Spam-Flag".
+	Header string
+
+	// Pattern is the regular expression, like "(?i)^yes". A field with any
+	// value matches if it is empty.
+	Pattern string
+}
+
+// quarantine is the running form of a QuarantineConfig. A nil *quarantine
+// classifies nothing as spam.
+type quarantine struct {
+	folder string
+	rules  []quarantineRule
+}
+
+type quarantineRule struct {
+	header  string
+	pattern *regexp.Regexp
+}
+
+func newQuarantine(s Server) (*quarantine, error) {
+	q := &quarantine{folder: quarantineFolder(s)}
+	for i, r := range s.Quarantine.Rules {
+		if r.Header == "" {
+			return nil, fmt.Errorf("Rules[%d]: missing Header", i)
+		}
+		pattern, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Rules[%d]: %v", i, err)
+		}
+		q.rules = append(q.rules, quarantineRule{r.Header, pattern})
+	}
+	return q, nil
+}
+
+// quarantineFolder returns the name of the maildrop folder that holds the
+// quarantined mail of |s|.
+func quarantineFolder(s Server) string {
+	if s.Quarantine != nil && s.Quarantine.Folder != "" {
+		return s.Quarantine.Folder
+	}
+	if s.DMARC != nil && s.DMARC.QuarantineFolder != "" {
+		return s.DMARC.QuarantineFolder
+	}
+	return defaultQuarantineFolder
+}
+
+// check classifies |en|, after it has been through the content filter and
+// rspamd. If it is spam, the message is annotated with the reason and the
+// quarantine folder is returned. Otherwise, the result is empty.
+func (q *quarantine) check(en *smtp.Envelope, log *zap.Logger) string {
+	if q == nil {
+		return ""
+	}
+	reason := q.classify(en)
+	if reason == "" {
+		return ""
+	}
+	log.Info("quarantining message classified as spam",
+		zap.String("id", en.ID),
+		zap.String("reason", reason),
+		zap.String("folder", q.folder))
+	quarantineMetrics.Add("quarantined", 1)
+	en.Annotate("quarantine", reason)
+	return q.folder
+}
+
+// classify returns why |en| is spam, or the empty string if it is not.
+func (q *quarantine) classify(en *smtp.Envelope) string {
+	for _, a := range en.Annotations {
+		if a.Name == "rspamd-action" && (a.Value == RspamdActionAddHeader || a.Value == RspamdActionRewriteSubject) {
+			return "rspamd"
+		}
+	}
+
+	if len(q.rules) == 0 {
+		return ""
+	}
+	header, _ := rfc5322.Parse(en.Data)
+	for _, r := range q.rules {
+		values := header.Values(r.header)
+		for _, h := range en.Headers {
+			if strings.EqualFold(h.Name, r.header) {
+				values = append(values, h.Value)
+			}
+		}
+		for _, v := range values {
+			if r.pattern.MatchString(v) {
+				return "rule " + r.header
+			}
+		}
+	}
+	return ""
+}
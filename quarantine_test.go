@@ -0,0 +1,128 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+func TestQuarantine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := Server{
+		Domain:          "example.com",
+		MailboxPassword: "letmein",
+		MaildropPath:    dir,
+		Quarantine: &QuarantineConfig{
+			Folder: "junk",
+			Rules: []QuarantineRule{
+				{Header: "X-Spam-Flag", Pattern: "(?i)^yes"},
+				{Header: "X-Virus"},
+			},
+		},
+	}
+	server := &smtpServer{config: Config{Servers: []Server{s}}, log: zap.NewNop()}
+	if err := server.setupDelivery(); err != nil {
+		t.Fatal(err)
+	}
+
+	newEnvelope := func(id, header string) smtp.Envelope {
+		return smtp.Envelope{
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25},
+			MailFrom:   mail.Address{Address: "sender@sender.net"},
+			RcptTo:     []mail.Address{{Address: "user@example.com"}},
+			Data:       []byte(header + "Subject: test\r\n\r\nbody\r\n"),
+			ID:         id,
+		}
+	}
+
+	for _, test := range []struct {
+		name        string
+		en          smtp.Envelope
+		quarantined bool
+	}{
+		{"clean", newEnvelope("clean", ""), false},
+		{"not spam", newEnvelope("notspam", "X-Spam-Flag: NO\r\n"), false},
+		{"spam flag", newEnvelope("flag", "X-Spam-Flag: YES\r\n"), true},
+		{"any value", newEnvelope("virus", "X-Virus: Eicar\r\n"), true},
+		{"filter header", func() smtp.Envelope {
+			en := newEnvelope("filter", "")
+			en.AddHeader("X-Spam-Flag", "yes")
+			return en
+		}(), true},
+		{"rspamd", func() smtp.Envelope {
+			en := newEnvelope("rspamd", "")
+			en.Annotate("rspamd-action", RspamdActionAddHeader)
+			return en
+		}(), true},
+	} {
+		if rl := server.DeliverMessage(test.en); rl != nil {
+			t.Errorf("%s: rejected: %v", test.name, rl)
+			continue
+		}
+		path := filepath.Join(dir, test.en.ID+".msg")
+		if test.quarantined {
+			path = filepath.Join(dir, "junk", test.en.ID+".msg")
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s: want message at %s: %v", test.name, path, err)
+		}
+	}
+
+	po := &pop3Server{config: server.config, log: zap.NewNop()}
+	mb, err := po.OpenMailbox(QuarantineAccount+"example.com", "letmein")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, _ := mb.ListMessages()
+	if want, got := 4, len(msgs); want != got {
+		t.Errorf("Want %d quarantined messages over POP3, got %d", want, got)
+	}
+}
+
+func TestQuarantineConfig(t *testing.T) {
+	for _, test := range []struct {
+		config QuarantineConfig
+		valid  bool
+	}{
+		{QuarantineConfig{}, true},
+		{QuarantineConfig{Rules: []QuarantineRule{{Header: "X-Spam-Flag", Pattern: "YES"}}}, true},
+		{QuarantineConfig{Rules: []QuarantineRule{{Pattern: "YES"}}}, false},
+		{QuarantineConfig{Rules: []QuarantineRule{{Header: "X-Spam-Flag", Pattern: "("}}}, false},
+	} {
+		config := test.config
+		_, err := newQuarantine(Server{Quarantine: &config})
+		if want, got := test.valid, err == nil; want != got {
+			t.Errorf("%+v: want valid %t, got %v", test.config, want, err)
+		}
+	}
+
+	if want, got := "quarantine", quarantineFolder(Server{}); want != got {
+		t.Errorf("Want default folder %q, got %q", want, got)
+	}
+	s := Server{DMARC: &DMARCConfig{QuarantineFolder: "dmarc"}}
+	if want, got := "dmarc", quarantineFolder(s); want != got {
+		t.Errorf("Want DMARC folder %q, got %q", want, got)
+	}
+	s.Quarantine = &QuarantineConfig{Folder: "spam"}
+	if want, got := "spam", quarantineFolder(s); want != got {
+		t.Errorf("Want Quarantine folder %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,178 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/maildrop"
+	rfc5322 "src.bluestatic.org/mailpopbox/message"
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+var (
+	replyMailboxFull   = smtp.ReplyLine{Code: 452, Message: "4.2.2 mailbox full"}
+	replyOverQuotaSize = smtp.ReplyLine{Code: 552, Message: "5.2.3 message larger than mailbox quota"}
+)
+
+// checkQuota makes room for |en| in |md| under the server's MaildropQuota,
+// either by rejecting the message or, with QuotaTrimOldest, by removing the
+// oldest messages and leaving a notice about them. A nil reply means the
+// message can be delivered.
+func (server *smtpServer) checkQuota(s *Server, md *maildrop.Maildrop, en smtp.Envelope) *smtp.ReplyLine {
+	if s.MaildropQuota <= 0 {
+		return nil
+	}
+
+	usage, err := md.Usage()
+	if err != nil {
+		// Do not lose mail over accounting.
+		server.log.Error("failed to compute maildrop usage", zap.String("maildrop", md.Path()), zap.Error(err))
+		return nil
+	}
+
+	size := deliveredSize(en)
+	if usage+size <= s.MaildropQuota {
+		return nil
+	}
+
+	log := server.log.With(zap.String("id", en.ID),
+		zap.Int64("usage", usage),
+		zap.Int64("size", size),
+		zap.Int64("quota", s.MaildropQuota))
+
+	if size > s.MaildropQuota {
+		log.Warn("message larger than quota")
+		return &replyOverQuotaSize
+	}
+	if !s.QuotaTrimOldest {
+		log.Warn("mailbox full")
+		return &replyMailboxFull
+	}
+
+	entries, err := md.ListOldest()
+	if err != nil {
+		log.Error("failed to list maildrop", zap.Error(err))
+		return &replyMailboxFull
+	}
+	var total int64
+	for _, entry := range entries {
+		total += entry.Size
+	}
+	room := s.MaildropQuota - size
+	remove, ok := planTrim(s.Domain, entries, total, room)
+	if !ok {
+		log.Warn("mailbox cannot fit the message and a trim notice")
+		return &replyMailboxFull
+	}
+
+	target := room - trimNoticeSize(s.Domain, entries[:remove])
+	if target < 0 {
+		target = 0
+	}
+	removed, err := md.TrimOldest(target)
+	if err != nil {
+		log.Error("failed to trim maildrop", zap.Error(err))
+	}
+	if len(removed) == 0 {
+		return &replyMailboxFull
+	}
+	log.Info("trimmed maildrop to quota", zap.Int("removed", len(removed)))
+	for _, entry := range removed {
+		server.events.publish(mailboxEvent{Kind: mailboxRemoved, Path: md.Path(), ID: entry.ID})
+	}
+
+	notice := newTrimNotice(s.Domain, removed)
+	if err := md.Deliver(notice); err != nil {
+		log.Error("failed to deliver trim notice", zap.Error(err))
+	} else {
+		server.events.publish(mailboxEvent{Kind: mailboxDelivered, Path: md.Path(), ID: notice.ID})
+	}
+	return nil
+}
+
+// planTrim returns how many of the oldest |entries|, whose sizes total
+// |usage|, must be removed so that the rest and the notice listing the
+// removed ones fit in |room|. It returns false if they do not fit even with
+// every message removed.
+func planTrim(domain string, entries []maildrop.Entry, usage, room int64) (int, bool) {
+	// The notice is its empty form, with a count of 0, plus a line for each
+	// removed message.
+	noticeSize := trimNoticeSize(domain, nil) - 1
+	for k := 0; k <= len(entries); k++ {
+		if k > 0 {
+			usage -= entries[k-1].Size
+			noticeSize += int64(len(trimNoticeLine(entries[k-1])))
+		}
+		if usage+noticeSize+int64(len(strconv.Itoa(k))) <= room {
+			return k, true
+		}
+	}
+	return 0, false
+}
+
+// trimNoticeSize returns how much of the maildrop's Usage the notice listing
+// |removed| takes once delivered.
+func trimNoticeSize(domain string, removed []maildrop.Entry) int64 {
+	return deliveredSize(newTrimNotice(domain, removed))
+}
+
+// deliveredSize returns how much of the maildrop's Usage |en| takes once
+// delivered, which includes the headers added by WriteEnvelopeForDelivery.
+func deliveredSize(en smtp.Envelope) int64 {
+	var w countingWriter
+	// Writes to a countingWriter do not fail.
+	smtp.WriteEnvelopeForDelivery(&w, en)
+	return int64(w)
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter int64
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	*w += countingWriter(len(b))
+	return len(b), nil
+}
+
+func trimNoticeLine(entry maildrop.Entry) string {
+	return fmt.Sprintf("%s  %s  %d bytes\r\n", entry.ModTime.Format(time.RFC1123Z), entry.ID, entry.Size)
+}
+
+// newTrimNotice returns a message for the mailbox that lists the messages
+// removed by checkQuota.
+func newTrimNotice(domain string, removed []maildrop.Entry) smtp.Envelope {
+	now := time.Now()
+	mailbox := mail.Address{Name: "mailpopbox", Address: MailboxAccount + domain}
+	en := smtp.Envelope{
+		MailFrom: mailbox,
+		RcptTo:   []mail.Address{mailbox},
+		Received: now,
+		ID:       smtp.GenerateEnvelopeId("q", now),
+	}
+
+	header := &rfc5322.Header{}
+	header.Add("From", mailbox.String())
+	header.Add("To", mailbox.String())
+	header.Add("Subject", "Messages removed to stay within quota")
+	header.Add("Message-ID", newMessageID(domain, ""))
+	header.Add("Date", now.Format(time.RFC1123Z))
+
+	var buf bytes.Buffer
+	header.WriteTo(&buf)
+	fmt.Fprintf(&buf, "The mailbox reached its quota, so the oldest %d messages were removed:\r\n\r\n", len(removed))
+	for _, entry := range removed {
+		buf.WriteString(trimNoticeLine(entry))
+	}
+	en.Data = buf.Bytes()
+	return en
+}
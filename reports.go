@@ -0,0 +1,247 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/dmarc"
+	rfc5322 "src.bluestatic.org/mailpopbox/message"
+	"src.bluestatic.org/mailpopbox/smtp"
+	"src.bluestatic.org/mailpopbox/tlsrpt"
+)
+
+// maxReportSize bounds a decompressed report attachment.
+const maxReportSize = 16 << 20
+
+// ReportsConfig recognizes the DMARC and TLS aggregate reports that other
+// servers send about a domain's mail.
+type ReportsConfig struct {
+	// Addresses receive reports, such as the rua addresses in the domain's
+	// DMARC and TLSRPT records.
+	Addresses []string
+
+	// Directory, if set, stores a JSON digest of each report.
+	Directory string
+}
+
+// reportDigest summarizes a DMARC or TLS aggregate report.
+type reportDigest struct {
+	Type         string // "dmarc" or "tlsrpt".
+	Organization string
+	ReportID     string
+	Domain       string
+	Begin        time.Time
+	End          time.Time
+
+	// Total counts messages for DMARC and sessions for TLS, and Failed the
+	// ones that failed.
+	Total  int
+	Failed int
+
+	Failures []reportFailure `json:",omitempty"`
+}
+
+// reportFailure is a source of failures in a report.
+type reportFailure struct {
+	Source string
+	Detail string
+	Count  int
+}
+
+func (d *reportDigest) summary() string {
+	return fmt.Sprintf("%s report from %s for %s: %d of %d failed (%s)",
+		d.Type, d.Organization, d.Domain, d.Failed, d.Total, d.Begin.Format("2006-01-02"))
+}
+
+// isReportAddress reports whether |addr| receives reports for |s|.
+func isReportAddress(s *Server, addr mail.Address) bool {
+	if s.Reports == nil {
+		return false
+	}
+	for _, a := range s.Reports.Addresses {
+		if strings.EqualFold(a, addr.Address) {
+			return true
+		}
+	}
+	return false
+}
+
+// digestReports finds the aggregate reports attached to |en|, if it is sent
+// to a report address of |s|. Each report is summarized in a header and an
+// annotation of the message, and its digest is stored in the Directory.
+func (server *smtpServer) digestReports(s *Server, en *smtp.Envelope) {
+	if !isReportAddress(s, en.RcptTo[0]) {
+		return
+	}
+	log := server.log.With(zap.String("id", en.ID))
+
+	var digests []*reportDigest
+	err := rfc5322.Walk(en.Data, func(p *rfc5322.Part) error {
+		if strings.HasPrefix(p.MediaType, "multipart/") {
+			return nil
+		}
+		data, err := p.Decoded()
+		if err != nil {
+			return nil
+		}
+		for _, report := range reportContents(p.MediaType, p.Filename(), data) {
+			if d := parseReport(report); d != nil {
+				digests = append(digests, d)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warn("failed to read report message", zap.Error(err))
+	}
+
+	for _, d := range digests {
+		summary := d.summary()
+		log.Info("received report", zap.String("report", summary), zap.String("report-id", d.ReportID))
+		en.AddHeader("X-Mailpopbox-Report", summary)
+		en.Annotate("report", summary)
+		if s.Reports.Directory != "" {
+			if err := storeDigest(s.Reports.Directory, d); err != nil {
+				log.Error("failed to store report digest", zap.Error(err))
+			}
+		}
+	}
+}
+
+// reportContents returns the report documents in an attachment, which may
+// be compressed with gzip or zip.
+func reportContents(mediaType, filename string, data []byte) [][]byte {
+	filename = strings.ToLower(filename)
+	switch {
+	case strings.HasSuffix(mediaType, "gzip") || strings.HasSuffix(filename, ".gz"):
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(r, maxReportSize))
+		if err != nil {
+			return nil
+		}
+		return [][]byte{data}
+
+	case strings.HasSuffix(mediaType, "zip") || strings.HasSuffix(filename, ".zip"):
+		r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil
+		}
+		var contents [][]byte
+		for _, f := range r.File {
+			rc, err := f.Open()
+			if err != nil {
+				continue
+			}
+			data, err := ioutil.ReadAll(io.LimitReader(rc, maxReportSize))
+			rc.Close()
+			if err == nil {
+				contents = append(contents, data)
+			}
+		}
+		return contents
+
+	case strings.HasSuffix(mediaType, "xml") || strings.HasSuffix(mediaType, "json"):
+		return [][]byte{data}
+	}
+	return nil
+}
+
+// parseReport returns the digest of a DMARC or TLS report document, or nil
+// if it is neither.
+func parseReport(data []byte) *reportDigest {
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("<")) {
+		r, err := dmarc.ParseAggregateReport(data)
+		if err != nil {
+			return nil
+		}
+		d := &reportDigest{
+			Type:         "dmarc",
+			Organization: r.Metadata.OrgName,
+			ReportID:     r.Metadata.ReportID,
+			Domain:       r.PolicyPublished.Domain,
+			Begin:        r.Begin(),
+			End:          r.End(),
+		}
+		for _, record := range r.Records {
+			d.Total += record.Row.Count
+			if record.Passed() {
+				continue
+			}
+			d.Failed += record.Row.Count
+			d.Failures = append(d.Failures, reportFailure{
+				Source: record.Row.SourceIP,
+				Detail: fmt.Sprintf("disposition=%s dkim=%s spf=%s header.from=%s",
+					record.Row.PolicyEvaluated.Disposition, record.Row.PolicyEvaluated.DKIM,
+					record.Row.PolicyEvaluated.SPF, record.Identifiers.HeaderFrom),
+				Count: record.Row.Count,
+			})
+		}
+		return d
+	}
+
+	r, err := tlsrpt.Parse(data)
+	if err != nil {
+		return nil
+	}
+	d := &reportDigest{
+		Type:         "tlsrpt",
+		Organization: r.OrganizationName,
+		ReportID:     r.ReportID,
+		Domain:       r.Domain(),
+		Begin:        r.DateRange.Start,
+		End:          r.DateRange.End,
+	}
+	for _, p := range r.Policies {
+		d.Total += p.Summary.Successful + p.Summary.Failure
+		d.Failed += p.Summary.Failure
+		for _, f := range p.FailureDetails {
+			d.Failures = append(d.Failures, reportFailure{
+				Source: f.ReceivingMXHostname,
+				Detail: f.ResultType,
+				Count:  f.FailedSessionCount,
+			})
+		}
+	}
+	return d
+}
+
+// storeDigest writes |d| to |dir| as JSON, named for its type, organization,
+// and ID.
+func storeDigest(dir string, d *reportDigest) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || strings.ContainsRune(".@_-", r) {
+			return r
+		}
+		return '_'
+	}, d.Type+"-"+d.Organization+"-"+d.ReportID)
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, name+".json"), data, 0600)
+}
@@ -0,0 +1,170 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/maildrop"
+	"src.bluestatic.org/mailpopbox/smtp"
+	"src.bluestatic.org/mailpopbox/tlsrpt"
+)
+
+const testDMARCReport = `<?xml version="1.0" encoding="UTF-8" ?>
+<feedback>
+  <report_metadata>
+    <org_name>google.com</org_name>
+    <email>noreply-dmarc-support@google.com</email>
+    <report_id>1234567890</report_id>
+    <date_range><begin>1590969600</begin><end>1591055999</end></date_range>
+  </report_metadata>
+  <policy_published><domain>example.com</domain><p>reject</p></policy_published>
+  <record>
+    <row>
+      <source_ip>192.0.2.1</source_ip>
+      <count>10</count>
+      <policy_evaluated><disposition>none</disposition><dkim>pass</dkim><spf>pass</spf></policy_evaluated>
+    </row>
+    <identifiers><header_from>example.com</header_from></identifiers>
+  </record>
+  <record>
+    <row>
+      <source_ip>198.51.100.7</source_ip>
+      <count>2</count>
+      <policy_evaluated><disposition>reject</disposition><dkim>fail</dkim><spf>fail</spf></policy_evaluated>
+    </row>
+    <identifiers><header_from>example.com</header_from></identifiers>
+  </record>
+</feedback>
+`
+
+func TestDigestReports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	reportsDir := filepath.Join(dir, "reports")
+
+	server := &smtpServer{
+		config: Config{
+			Servers: []Server{{
+				Domain:       "example.com",
+				MaildropPath: dir,
+				Reports: &ReportsConfig{
+					Addresses: []string{"dmarc@example.com"},
+					Directory: reportsDir,
+				},
+			}},
+		},
+		log: zap.NewNop(),
+	}
+
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	f, _ := zw.Create("google.com!example.com!1590969600!1591055999.xml")
+	f.Write([]byte(testDMARCReport))
+	zw.Close()
+	dmarcMessage := "From: <noreply-dmarc-support@google.com>\r\n" +
+		"Subject: Report domain: example.com\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: application/zip; name=\"report.zip\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		base64.StdEncoding.EncodeToString(zipped.Bytes()) + "\r\n"
+
+	start := time.Date(2020, time.June, 1, 0, 0, 0, 0, time.UTC)
+	tlsMessage, err := (&tlsrpt.Report{
+		OrganizationName: "mx.sender.net",
+		DateRange:        tlsrpt.DateRange{Start: start, End: start.Add(24 * time.Hour)},
+		ReportID:         "r1",
+		Policies: []tlsrpt.Policy{{
+			Policy:  tlsrpt.PolicyDetails{Type: tlsrpt.PolicyTypeNone, Domain: "example.com"},
+			Summary: tlsrpt.Summary{Successful: 7, Failure: 1},
+			FailureDetails: []tlsrpt.FailureDetail{{
+				ResultType:          smtp.TLSResultExpired,
+				ReceivingMXHostname: "mx.example.com",
+				FailedSessionCount:  1,
+			}},
+		}},
+	}).Message("reports@sender.net", "dmarc@example.com", start)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, data := range [][]byte{[]byte(dmarcMessage), tlsMessage} {
+		en := smtp.Envelope{
+			MailFrom: mail.Address{Address: "reports@sender.net"},
+			RcptTo:   []mail.Address{{Address: "dmarc@example.com"}},
+			Data:     data,
+			ID:       []string{"m.dmarc", "m.tls"}[i],
+		}
+		if rl := server.DeliverMessage(en); rl != nil {
+			t.Fatalf("Failed to deliver: %v", rl)
+		}
+	}
+
+	md := maildrop.New(dir)
+	for id, want := range map[string]string{
+		"m.dmarc": "dmarc report from google.com for example.com: 2 of 12 failed (2020-06-01)",
+		"m.tls":   "tlsrpt report from mx.sender.net for example.com: 1 of 8 failed (2020-06-01)",
+	} {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, id+".msg"))
+		if !bytes.Contains(data, []byte("X-Mailpopbox-Report: "+want+"\r\n")) {
+			t.Errorf("%s: want report header %q: %q", id, want, data)
+		}
+		meta, err := md.Metadata(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(meta.Annotations) != 1 || meta.Annotations[0].Value != want {
+			t.Errorf("%s: want annotation %q, got %v", id, want, meta.Annotations)
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(reportsDir, "dmarc-google.com-1234567890.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var digest reportDigest
+	if err := json.Unmarshal(data, &digest); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(digest.Failures); want != got {
+		t.Fatalf("Want %d failure source, got %+v", want, digest.Failures)
+	}
+	if want, got := "198.51.100.7", digest.Failures[0].Source; want != got {
+		t.Errorf("Want failure source %q, got %q", want, got)
+	}
+	if _, err := os.Stat(filepath.Join(reportsDir, "tlsrpt-mx.sender.net-r1.json")); err != nil {
+		t.Errorf("TLS report digest was not stored: %v", err)
+	}
+
+	// Mail to other addresses is not examined.
+	en := smtp.Envelope{
+		MailFrom: mail.Address{Address: "reports@sender.net"},
+		RcptTo:   []mail.Address{{Address: "user@example.com"}},
+		Data:     tlsMessage,
+		ID:       "m.user",
+	}
+	if rl := server.DeliverMessage(en); rl != nil {
+		t.Fatalf("Failed to deliver: %v", rl)
+	}
+	if meta, _ := md.Metadata("m.user"); len(meta.Annotations) != 0 {
+		t.Errorf("Want no annotations for a regular address, got %v", meta.Annotations)
+	}
+}
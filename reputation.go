@@ -0,0 +1,351 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/dmarc"
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+const (
+	defaultReputationMinMessages = 5
+	defaultReputationExpiry      = 30 * 24 * time.Hour
+	defaultReputationMaxEntries  = 10000
+
+	// reputationSaveInterval is how often changed counts are written to the
+	// ReputationConfig Path.
+	reputationSaveInterval = time.Minute
+)
+
+var reputationMetrics = expvar.NewMap("reputation")
+
+var replyReputationRejected = smtp.ReplyLine{Code: 550, Message: "5.7.1 sender has a poor reputation"}
+
+// ReputationConfig keeps counts of the inbound mail from each sender domain
+// and client IP that was accepted, bounced by a check, or flagged as spam.
+// Senders with enough messages are scored by the percentage that were bounced
+// or spam, in a reputation-score annotation.
+type ReputationConfig struct {
+	// Path is a JSON file in which the counts are kept across restarts.
+	Path string
+
+	// MinMessages is how many messages a sender must have sent before it is
+	// scored. The default is 5.
+	MinMessages int
+
+	// RejectScore, if non-zero, rejects mail from senders whose score is at
+	// least this. Those rejections are not counted, so a sender is given
+	// another chance once its counts expire.
+	RejectScore int
+
+	// Expiry is how long a sender's counts are kept after its last message,
+	// as a Go duration string. The default is 720h.
+	Expiry string
+
+	// MaxEntries bounds the number of senders that are tracked, dropping the
+	// least recently seen. The default is 10000.
+	MaxEntries int
+}
+
+// reputationCounts are the outcomes of a sender's messages.
+type reputationCounts struct {
+	Accepted int64
+	Bounced  int64
+	Spam     int64
+	Updated  time.Time
+}
+
+// score returns the percentage of messages that were bounced or spam.
+func (c reputationCounts) score() int {
+	total := c.Accepted + c.Bounced + c.Spam
+	if total == 0 {
+		return 0
+	}
+	return int(100 * (c.Bounced + c.Spam) / total)
+}
+
+// reputationDB is the running form of a ReputationConfig. A nil
+// *reputationDB scores and records nothing.
+type reputationDB struct {
+	path        string
+	minMessages int
+	rejectScore int
+	expiry      time.Duration
+	maxEntries  int
+
+	mu      sync.Mutex
+	entries map[string]*reputationCounts // Keyed by reputationKeys.
+	dirty   bool
+
+	now func() time.Time
+	log *zap.Logger
+}
+
+// openReputation loads the counts from the Path of |config|, if it exists.
+func openReputation(config ReputationConfig, log *zap.Logger) (*reputationDB, error) {
+	db := &reputationDB{
+		path:        config.Path,
+		minMessages: config.MinMessages,
+		rejectScore: config.RejectScore,
+		expiry:      defaultReputationExpiry,
+		maxEntries:  config.MaxEntries,
+		entries:     make(map[string]*reputationCounts),
+		now:         time.Now,
+		log:         log.With(zap.String("reputation", config.Path)),
+	}
+	if db.path == "" {
+		return nil, fmt.Errorf("missing Path")
+	}
+	if db.minMessages <= 0 {
+		db.minMessages = defaultReputationMinMessages
+	}
+	if db.maxEntries <= 0 {
+		db.maxEntries = defaultReputationMaxEntries
+	}
+	if config.Expiry != "" {
+		var err error
+		if db.expiry, err = time.ParseDuration(config.Expiry); err != nil {
+			return nil, fmt.Errorf("Expiry: %v", err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(db.path)
+	if os.IsNotExist(err) {
+		return db, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &db.entries); err != nil {
+		return nil, fmt.Errorf("%s: %v", db.path, err)
+	}
+	db.prune(db.now())
+	return db, nil
+}
+
+// reputationKeys returns the keys under which the sender of |en| is counted:
+// its MAIL FROM domain, unless it is a bounce, and its client IP.
+func reputationKeys(en *smtp.Envelope) []string {
+	var keys []string
+	if domain := smtp.DomainForAddress(en.MailFrom); domain != "" {
+		keys = append(keys, "domain:"+strings.ToLower(domain))
+	}
+	if ip := clientIP(en.RemoteAddr); ip != "" {
+		keys = append(keys, "ip:"+ip)
+	}
+	return keys
+}
+
+// check scores the sender of |en|, by the worse of its domain and IP, and
+// annotates the message with the score. It returns a reply if the message is
+// rejected.
+func (db *reputationDB) check(en *smtp.Envelope) *smtp.ReplyLine {
+	if db == nil {
+		return nil
+	}
+	db.mu.Lock()
+	score := -1
+	for _, key := range reputationKeys(en) {
+		c, ok := db.entries[key]
+		if !ok || c.Accepted+c.Bounced+c.Spam < int64(db.minMessages) {
+			continue
+		}
+		if s := c.score(); s > score {
+			score = s
+		}
+	}
+	db.mu.Unlock()
+
+	if score < 0 {
+		return nil
+	}
+	en.Annotate("reputation-score", strconv.Itoa(score))
+	if db.rejectScore > 0 && score >= db.rejectScore {
+		db.log.Info("rejected message by sender reputation",
+			zap.String("id", en.ID),
+			zap.String("mail-from", en.MailFrom.Address),
+			zap.Stringer("client", en.RemoteAddr),
+			zap.Int("score", score))
+		reputationMetrics.Add("rejected", 1)
+		return &replyReputationRejected
+	}
+	return nil
+}
+
+// record counts the outcome of delivering |en|, which was refused with
+// |reply| if it is non-nil. Messages that were deferred, or refused for
+// reasons that are not the sender's fault, are not counted.
+func (db *reputationDB) record(en *smtp.Envelope, reply *smtp.ReplyLine) {
+	if db == nil {
+		return
+	}
+
+	var spam bool
+	for _, a := range en.Annotations {
+		switch {
+		case a.Name == "content-filter" && a.Value == "reject", a.Name == "quarantine":
+			spam = true
+		case a.Name == "rspamd-action" && (a.Value == RspamdActionReject || a.Value == RspamdActionAddHeader || a.Value == RspamdActionRewriteSubject):
+			spam = true
+		case a.Name == "dmarc" && (a.Value == string(dmarc.PolicyQuarantine) || a.Value == string(dmarc.PolicyReject)):
+			spam = true
+		}
+	}
+
+	var count func(c *reputationCounts)
+	switch {
+	case spam:
+		count = func(c *reputationCounts) { c.Spam++ }
+	case reply == nil:
+		count = func(c *reputationCounts) { c.Accepted++ }
+	case reply.Code == 550 || reply.Code == 554:
+		count = func(c *reputationCounts) { c.Bounced++ }
+	default:
+		return
+	}
+
+	now := db.now()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, key := range reputationKeys(en) {
+		c, ok := db.entries[key]
+		if !ok {
+			c = &reputationCounts{}
+			db.entries[key] = c
+		}
+		count(c)
+		c.Updated = now
+	}
+	db.dirty = true
+}
+
+// prune drops the expired entries, and then the least recently updated
+// entries over maxEntries. It must be called with mu held, or before the
+// database is shared.
+func (db *reputationDB) prune(now time.Time) {
+	for key, c := range db.entries {
+		if now.Sub(c.Updated) >= db.expiry {
+			delete(db.entries, key)
+		}
+	}
+	if len(db.entries) <= db.maxEntries {
+		return
+	}
+	keys := make([]string, 0, len(db.entries))
+	for key := range db.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return db.entries[keys[i]].Updated.Before(db.entries[keys[j]].Updated)
+	})
+	for _, key := range keys[:len(keys)-db.maxEntries] {
+		delete(db.entries, key)
+	}
+}
+
+// save writes the counts to the Path, if they have changed.
+func (db *reputationDB) save() error {
+	if db == nil {
+		return nil
+	}
+	db.mu.Lock()
+	if !db.dirty {
+		db.mu.Unlock()
+		return nil
+	}
+	db.prune(db.now())
+	data, err := json.Marshal(db.entries)
+	db.dirty = false
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := db.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, db.path)
+}
+
+// saveEvery saves the counts every |interval|, forever.
+func (db *reputationDB) saveEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := db.save(); err != nil {
+			db.log.Error("failed to save sender reputation", zap.Error(err))
+		}
+	}
+}
+
+// reputationHandler serves the /reputation admin endpoint. GET returns the
+// counts and score of each sender, or of the one in the "key" parameter, like
+// "domain:example.com" or "ip:192.0.2.1". POST forgets the sender in "key",
+// and requires the AdminToken.
+type reputationHandler struct {
+	db    *reputationDB
+	token string
+}
+
+type reputationEntry struct {
+	reputationCounts
+	Score int
+}
+
+func (h *reputationHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	key := req.FormValue("key")
+	db := h.db
+
+	switch req.Method {
+	case http.MethodGet:
+		db.mu.Lock()
+		entries := make(map[string]reputationEntry)
+		for k, c := range db.entries {
+			if key == "" || k == key {
+				entries[k] = reputationEntry{*c, c.score()}
+			}
+		}
+		db.mu.Unlock()
+		if key != "" && len(entries) == 0 {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	case http.MethodPost:
+		if !adminAuthorized(h.token, req) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		db.mu.Lock()
+		_, ok := db.entries[key]
+		delete(db.entries, key)
+		db.dirty = db.dirty || ok
+		db.mu.Unlock()
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,209 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+func reputationEnvelope(from, ip string) smtp.Envelope {
+	return smtp.Envelope{
+		ID:         "m.1",
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 25},
+		MailFrom:   mail.Address{Address: from},
+	}
+}
+
+func reputationScore(en smtp.Envelope) string {
+	for _, a := range en.Annotations {
+		if a.Name == "reputation-score" {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func TestReputation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reputation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "reputation.json")
+
+	config := ReputationConfig{Path: path, MinMessages: 4, RejectScore: 75}
+	db, err := openReputation(config, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spam := reputationEnvelope("spammer@Bad.Example", "192.0.2.1")
+	spam.Annotate("content-filter", "reject")
+	for i := 0; i < 3; i++ {
+		db.record(&spam, &replyContentFilterRejected)
+	}
+	en := reputationEnvelope("someone@bad.example", "192.0.2.1")
+	db.record(&en, &replyHeloRejected)
+
+	// Deferrals and full mailboxes are not the sender's fault.
+	db.record(&en, &replyContentFilterTempFail)
+	db.record(&en, &replyOverQuotaSize)
+
+	good := reputationEnvelope("friend@good.example", "198.51.100.1")
+	for i := 0; i < 3; i++ {
+		db.record(&good, nil)
+	}
+
+	// The bad domain is rejected, from any IP.
+	en = reputationEnvelope("other@bad.example", "198.51.100.2")
+	if want, got := &replyReputationRejected, db.check(&en); want != got {
+		t.Errorf("Want reply %v, got %v", want, got)
+	}
+	if want, got := "100", reputationScore(en); want != got {
+		t.Errorf("Want reputation-score %q, got %q", want, got)
+	}
+
+	// A good sender from the bad IP is also rejected.
+	en = reputationEnvelope("friend@good.example", "192.0.2.1")
+	if reply := db.check(&en); reply == nil {
+		t.Errorf("Want rejection for bad IP")
+	}
+
+	// Senders with too few messages are not scored.
+	en = reputationEnvelope("friend@good.example", "198.51.100.1")
+	if reply := db.check(&en); reply != nil {
+		t.Errorf("Want no rejection, got %v", reply)
+	}
+	if want, got := "", reputationScore(en); want != got {
+		t.Errorf("Want no reputation-score, got %q", got)
+	}
+	db.record(&good, nil)
+	quarantined := good
+	quarantined.Annotations = nil
+	quarantined.Annotate("dmarc", "quarantine")
+	db.record(&quarantined, nil)
+	en = reputationEnvelope("friend@good.example", "203.0.113.1")
+	if reply := db.check(&en); reply != nil {
+		t.Errorf("Want no rejection, got %v", reply)
+	}
+	if want, got := "20", reputationScore(en); want != got {
+		t.Errorf("Want reputation-score %q, got %q", want, got)
+	}
+
+	// The counts persist.
+	if err := db.save(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = openReputation(config, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := reputationCounts{Accepted: 4, Spam: 1}
+	got := *db.entries["domain:good.example"]
+	got.Updated = time.Time{}
+	if want != got {
+		t.Errorf("Want counts %+v, got %+v", want, got)
+	}
+	want = reputationCounts{Bounced: 1, Spam: 3}
+	got = *db.entries["ip:192.0.2.1"]
+	got.Updated = time.Time{}
+	if want != got {
+		t.Errorf("Want counts %+v, got %+v", want, got)
+	}
+
+	// Messages that rspamd flags are spam, even if they are delivered.
+	flagged := reputationEnvelope("list@news.example", "203.0.113.9")
+	flagged.Annotate("rspamd-action", RspamdActionAddHeader)
+	db.record(&flagged, nil)
+	if want, got := int64(1), db.entries["domain:news.example"].Spam; want != got {
+		t.Errorf("Want %d spam, got %d", want, got)
+	}
+
+	var nilDB *reputationDB
+	nilDB.record(&en, nil)
+	if reply := nilDB.check(&en); reply != nil {
+		t.Errorf("Want nil database to accept, got %v", reply)
+	}
+}
+
+func TestReputationPrune(t *testing.T) {
+	now := time.Date(2020, time.June, 1, 0, 0, 0, 0, time.UTC)
+	db := &reputationDB{
+		expiry:     24 * time.Hour,
+		maxEntries: 2,
+		entries: map[string]*reputationCounts{
+			"ip:192.0.2.1": {Accepted: 1, Updated: now.Add(-48 * time.Hour)},
+			"ip:192.0.2.2": {Accepted: 1, Updated: now.Add(-3 * time.Hour)},
+			"ip:192.0.2.3": {Accepted: 1, Updated: now.Add(-2 * time.Hour)},
+			"ip:192.0.2.4": {Accepted: 1, Updated: now.Add(-1 * time.Hour)},
+		},
+	}
+	db.prune(now)
+	if want, got := 2, len(db.entries); want != got {
+		t.Fatalf("Want %d entries, got %d", want, got)
+	}
+	for _, key := range []string{"ip:192.0.2.3", "ip:192.0.2.4"} {
+		if _, ok := db.entries[key]; !ok {
+			t.Errorf("Want %s to be kept", key)
+		}
+	}
+}
+
+func TestReputationHandler(t *testing.T) {
+	db := &reputationDB{
+		entries: map[string]*reputationCounts{
+			"domain:bad.example": {Accepted: 1, Spam: 3},
+		},
+	}
+	h := &reputationHandler{db: db, token: "s3cret"}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/reputation", nil))
+	var entries map[string]reputationEntry
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 75, entries["domain:bad.example"].Score; want != got {
+		t.Errorf("Want score %d, got %d", want, got)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/reputation?key=ip:192.0.2.1", nil))
+	if want, got := http.StatusNotFound, w.Code; want != got {
+		t.Errorf("Want status %d, got %d", want, got)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/reputation?key=domain:bad.example", nil))
+	if want, got := http.StatusUnauthorized, w.Code; want != got {
+		t.Errorf("Want status %d, got %d", want, got)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/reputation?key=domain:bad.example", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if want, got := http.StatusNoContent, w.Code; want != got {
+		t.Errorf("Want status %d, got %d", want, got)
+	}
+	if len(db.entries) != 0 || !db.dirty {
+		t.Errorf("Want entry to be forgotten, got %v", db.entries)
+	}
+}
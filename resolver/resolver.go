@@ -0,0 +1,247 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+// Package resolver looks up DNS records for the rest of the server, through
+// a configurable DNS server, with a timeout on each lookup and an LRU cache
+// of the answers. Names that do not exist are cached too.
+package resolver
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTimeout     = 5 * time.Second
+	DefaultCacheSize   = 1024
+	DefaultTTL         = 5 * time.Minute
+	DefaultNegativeTTL = time.Minute
+)
+
+// Options configure a Resolver. Zero values use the defaults.
+type Options struct {
+	// Server is the host:port of the DNS server to query. By default, the
+	// system's resolver is used.
+	Server string
+
+	// Timeout bounds each lookup, in addition to the caller's context.
+	Timeout time.Duration
+
+	// CacheSize is how many answers are cached. A negative size disables the
+	// cache.
+	CacheSize int
+
+	// TTL is how long an answer is cached, since the record TTLs are not
+	// available. NegativeTTL is how long it is cached that a name does not
+	// exist, or has no records of a type. Other failures are not cached.
+	TTL         time.Duration
+	NegativeTTL time.Duration
+}
+
+// Resolver is a caching DNS resolver. Its methods match those of
+// net.Resolver, so it can be used wherever one is. The slices it returns
+// must not be modified.
+type Resolver struct {
+	mu      sync.Mutex
+	opts    Options
+	r       *net.Resolver
+	entries map[key]*list.Element
+	lru     *list.List // Of *entry, most recently used at the front.
+	stats   Stats
+}
+
+// Default is the Resolver used by the server's packages. It can be
+// reconfigured with Configure.
+var Default = New(Options{})
+
+// Stats counts the lookups made by a Resolver.
+type Stats struct {
+	Hits    int64
+	Misses  int64
+	Entries int
+}
+
+type key struct {
+	kind string
+	name string
+}
+
+type entry struct {
+	key     key
+	value   interface{}
+	err     error
+	expires time.Time
+}
+
+// New returns a Resolver with |opts|.
+func New(opts Options) *Resolver {
+	r := &Resolver{}
+	r.Configure(opts)
+	return r
+}
+
+// Configure replaces the options of |r| and empties its cache.
+func (r *Resolver) Configure(opts Options) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.CacheSize == 0 {
+		opts.CacheSize = DefaultCacheSize
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = DefaultTTL
+	}
+	if opts.NegativeTTL <= 0 {
+		opts.NegativeTTL = DefaultNegativeTTL
+	}
+
+	resolver := net.DefaultResolver
+	if server := opts.Server; server != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.opts = opts
+	r.r = resolver
+	r.entries = make(map[key]*list.Element)
+	r.lru = list.New()
+}
+
+// Stats returns the lookup counts of |r|.
+func (r *Resolver) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := r.stats
+	stats.Entries = r.lru.Len()
+	return stats
+}
+
+// lookup returns the cached answer for |k|, or calls |fn| with the resolver
+// and caches its answer.
+func (r *Resolver) lookup(ctx context.Context, k key, fn func(context.Context, *net.Resolver) (interface{}, error)) (interface{}, error) {
+	now := time.Now()
+
+	r.mu.Lock()
+	if elem, ok := r.entries[k]; ok {
+		e := elem.Value.(*entry)
+		if now.Before(e.expires) {
+			r.lru.MoveToFront(elem)
+			r.stats.Hits++
+			r.mu.Unlock()
+			return e.value, e.err
+		}
+		r.lru.Remove(elem)
+		delete(r.entries, k)
+	}
+	r.stats.Misses++
+	opts, resolver := r.opts, r.r
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+	value, err := fn(ctx, resolver)
+
+	ttl := opts.TTL
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return value, err
+		}
+		ttl = opts.NegativeTTL
+	}
+	if opts.CacheSize < 0 {
+		return value, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.opts != opts {
+		// The resolver was reconfigured during the lookup.
+		return value, err
+	}
+	if elem, ok := r.entries[k]; ok {
+		// Another caller finished the same lookup first.
+		r.lru.Remove(elem)
+	}
+	r.entries[k] = r.lru.PushFront(&entry{
+		key:     k,
+		value:   value,
+		err:     err,
+		expires: now.Add(ttl),
+	})
+	for r.lru.Len() > opts.CacheSize {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.entries, oldest.Value.(*entry).key)
+	}
+	return value, err
+}
+
+// LookupTXT looks up the TXT records of a domain name, like
+// net.Resolver.LookupTXT. The packages that read policies from TXT records
+// take one, so that tests can answer for DNS.
+type LookupTXT func(ctx context.Context, name string) ([]string, error)
+
+// LookupTXT returns the TXT records of |name|.
+func (r *Resolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	v, err := r.lookup(ctx, key{"TXT", name}, func(ctx context.Context, nr *net.Resolver) (interface{}, error) {
+		return nr.LookupTXT(ctx, name)
+	})
+	txts, _ := v.([]string)
+	return txts, err
+}
+
+// LookupMX returns the MX records of |name|, sorted by preference.
+func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	v, err := r.lookup(ctx, key{"MX", name}, func(ctx context.Context, nr *net.Resolver) (interface{}, error) {
+		return nr.LookupMX(ctx, name)
+	})
+	mxs, _ := v.([]*net.MX)
+	return mxs, err
+}
+
+// LookupIPAddr returns the IP addresses of |host|.
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	v, err := r.lookup(ctx, key{"IP", host}, func(ctx context.Context, nr *net.Resolver) (interface{}, error) {
+		return nr.LookupIPAddr(ctx, host)
+	})
+	addrs, _ := v.([]net.IPAddr)
+	return addrs, err
+}
+
+// LookupHost returns the IP addresses of |host|, as strings.
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addrs, err := r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make([]string, len(addrs))
+	for i, addr := range addrs {
+		hosts[i] = addr.String()
+	}
+	return hosts, nil
+}
+
+// LookupAddr returns the hostnames of the IP address |addr|, from its PTR
+// records.
+func (r *Resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	v, err := r.lookup(ctx, key{"PTR", addr}, func(ctx context.Context, nr *net.Resolver) (interface{}, error) {
+		return nr.LookupAddr(ctx, addr)
+	})
+	names, _ := v.([]string)
+	return names, err
+}
@@ -0,0 +1,166 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// runServer serves TXT records from |records|, keyed by fully qualified
+// name, and NXDOMAIN for other names. It returns its address and the number
+// of queries it has answered. If |records| is nil, it does not answer.
+func runServer(t *testing.T, records map[string]string) (string, *int64) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	var queries int64
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(buf[:n]); err != nil || len(msg.Questions) != 1 || records == nil {
+				continue
+			}
+			atomic.AddInt64(&queries, 1)
+
+			q := msg.Questions[0]
+			msg.Header.Response = true
+			msg.Header.RecursionAvailable = true
+			msg.Additionals = nil
+			txt, ok := records[q.Name.String()]
+			if !ok {
+				msg.Header.RCode = dnsmessage.RCodeNameError
+			} else if q.Type == dnsmessage.TypeTXT {
+				msg.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 300},
+					Body:   &dnsmessage.TXTResource{TXT: []string{txt}},
+				}}
+			}
+			resp, err := msg.Pack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), &queries
+}
+
+func TestCache(t *testing.T) {
+	addr, queries := runServer(t, map[string]string{
+		"a.example.com.": "v=a",
+		"b.example.com.": "v=b",
+	})
+	r := New(Options{Server: addr, CacheSize: 2})
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		txts, err := r.LookupTXT(ctx, "a.example.com.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(txts) != 1 || txts[0] != "v=a" {
+			t.Errorf("Want TXT v=a, got %v", txts)
+		}
+	}
+	if want, got := int64(1), atomic.LoadInt64(queries); want != got {
+		t.Errorf("Want %d query, got %d", want, got)
+	}
+
+	// Names that do not exist are cached too.
+	for i := 0; i < 2; i++ {
+		_, err := r.LookupTXT(ctx, "missing.example.com.")
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Errorf("Want not found error, got %v", err)
+		}
+	}
+	if want, got := int64(2), atomic.LoadInt64(queries); want != got {
+		t.Errorf("Want %d queries, got %d", want, got)
+	}
+
+	// The least recently used answer, for a.example.com, is evicted.
+	if _, err := r.LookupTXT(ctx, "b.example.com."); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.LookupTXT(ctx, "a.example.com."); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := int64(4), atomic.LoadInt64(queries); want != got {
+		t.Errorf("Want %d queries, got %d", want, got)
+	}
+	if want, got := (Stats{Hits: 2, Misses: 4, Entries: 2}), r.Stats(); want != got {
+		t.Errorf("Want stats %+v, got %+v", want, got)
+	}
+
+	// Reconfiguring empties the cache.
+	r.Configure(Options{Server: addr, CacheSize: 2})
+	if _, err := r.LookupTXT(ctx, "a.example.com."); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := int64(5), atomic.LoadInt64(queries); want != got {
+		t.Errorf("Want %d queries, got %d", want, got)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	addr, queries := runServer(t, map[string]string{"a.example.com.": "v=a"})
+	r := New(Options{Server: addr, TTL: 50 * time.Millisecond, NegativeTTL: time.Hour})
+	ctx := context.Background()
+
+	r.LookupTXT(ctx, "a.example.com.")
+	r.LookupTXT(ctx, "missing.example.com.")
+	time.Sleep(100 * time.Millisecond)
+	r.LookupTXT(ctx, "a.example.com.")
+	r.LookupTXT(ctx, "missing.example.com.")
+	if want, got := int64(3), atomic.LoadInt64(queries); want != got {
+		t.Errorf("Want %d queries, got %d", want, got)
+	}
+}
+
+func TestCacheDisabled(t *testing.T) {
+	addr, queries := runServer(t, map[string]string{"a.example.com.": "v=a"})
+	r := New(Options{Server: addr, CacheSize: -1})
+	ctx := context.Background()
+
+	r.LookupTXT(ctx, "a.example.com.")
+	r.LookupTXT(ctx, "a.example.com.")
+	if want, got := int64(2), atomic.LoadInt64(queries); want != got {
+		t.Errorf("Want %d queries, got %d", want, got)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	addr, _ := runServer(t, nil)
+	r := New(Options{Server: addr, Timeout: 100 * time.Millisecond})
+
+	start := time.Now()
+	if _, err := r.LookupTXT(context.Background(), "a.example.com."); err == nil {
+		t.Errorf("Want timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Lookup took %v, longer than the timeout", elapsed)
+	}
+	if want, got := 0, r.Stats().Entries; want != got {
+		t.Errorf("Want failures not to be cached, got %d entries", got)
+	}
+}
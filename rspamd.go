@@ -0,0 +1,214 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+// Actions returned by rspamd.
+const (
+	RspamdActionNoAction       = "no action"
+	RspamdActionGreylist       = "greylist"
+	RspamdActionAddHeader      = "add header"
+	RspamdActionRewriteSubject = "rewrite subject"
+	RspamdActionSoftReject     = "soft reject"
+	RspamdActionReject         = "reject"
+)
+
+const defaultRspamdTimeout = 10 * time.Second
+
+var rspamdMetrics = expvar.NewMap("rspamd")
+
+var (
+	replyRspamdRejected   = smtp.ReplyLine{Code: 550, Message: "5.7.1 message rejected as spam"}
+	replyRspamdTempFail   = smtp.ReplyLine{Code: 451, Message: "4.7.1 message deferred by spam filter, try again later"}
+	replyRspamdGreylisted = smtp.ReplyLine{Code: 451, Message: "4.7.1 greylisted, try again later"}
+)
+
+// RspamdConfig scores each inbound message with rspamd, by posting it to the
+// /checkv2 endpoint of a normal worker, and applies the action it returns.
+// Messages that rspamd does not reject or greylist get X-Spam-Score,
+// X-Spam-Action, and X-Spam-Symbols headers, and an X-Spam header if rspamd
+// says to add one.
+type RspamdConfig struct {
+	// URL is the address of the rspamd worker, like
+	// "http://localhost:11333".
+	URL string
+
+	// Password, if set, is sent in the Password header.
+	Password string
+
+	// Timeout is how long to wait for rspamd, as a Go duration string. It
+	// defaults to 10 seconds.
+	Timeout string
+
+	// OnError is what happens to a message when rspamd cannot be reached or
+	// fails: "tempfail", the default, or "accept".
+	OnError string
+}
+
+// rspamd is the running form of an RspamdConfig. A nil *rspamd accepts every
+// message.
+type rspamd struct {
+	url      string
+	password string
+	onError  string
+	client   *http.Client
+}
+
+// rspamdResult is the part of the /checkv2 response that is used.
+type rspamdResult struct {
+	Score         float64 `json:"score"`
+	RequiredScore float64 `json:"required_score"`
+	Action        string  `json:"action"`
+	Symbols       map[string]struct {
+		Score float64 `json:"score"`
+	} `json:"symbols"`
+	Messages struct {
+		SMTPMessage string `json:"smtp_message"`
+	} `json:"messages"`
+}
+
+func newRspamd(config RspamdConfig) (*rspamd, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL %q", config.URL)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/checkv2"
+
+	timeout := defaultRspamdTimeout
+	if config.Timeout != "" {
+		if timeout, err = time.ParseDuration(config.Timeout); err != nil {
+			return nil, fmt.Errorf("Timeout: %v", err)
+		}
+	}
+
+	r := &rspamd{
+		url:      u.String(),
+		password: config.Password,
+		onError:  config.OnError,
+		client:   &http.Client{Timeout: timeout},
+	}
+	switch r.onError {
+	case "":
+		r.onError = ContentFilterOnErrorTempFail
+	case ContentFilterOnErrorTempFail, ContentFilterOnErrorAccept:
+	default:
+		return nil, fmt.Errorf("unknown OnError %q", r.onError)
+	}
+	return r, nil
+}
+
+// check scores |en| with rspamd and applies its action. It returns a reply if
+// the message is refused, and otherwise adds the X-Spam headers and the
+// rspamd-score and rspamd-action annotations.
+func (r *rspamd) check(en *smtp.Envelope, log *zap.Logger) *smtp.ReplyLine {
+	if r == nil {
+		return nil
+	}
+	log = log.With(zap.String("id", en.ID))
+
+	result, err := r.post(en)
+	if err != nil {
+		log.Error("rspamd check failed", zap.String("on-error", r.onError), zap.Error(err))
+		rspamdMetrics.Add("errors", 1)
+		if r.onError == ContentFilterOnErrorAccept {
+			return nil
+		}
+		return &replyRspamdTempFail
+	}
+
+	rspamdMetrics.Add(result.Action, 1)
+	en.Annotate("rspamd-score", fmt.Sprintf("%.2f", result.Score))
+	en.Annotate("rspamd-action", result.Action)
+	log = log.With(zap.Float64("score", result.Score), zap.String("action", result.Action))
+
+	switch result.Action {
+	case RspamdActionReject:
+		log.Info("rejected message by rspamd")
+		return filterReply(replyRspamdRejected, result.Messages.SMTPMessage)
+	case RspamdActionSoftReject:
+		log.Info("deferred message by rspamd")
+		return filterReply(replyRspamdTempFail, result.Messages.SMTPMessage)
+	case RspamdActionGreylist:
+		log.Info("greylisted message by rspamd")
+		return &replyRspamdGreylisted
+	}
+
+	symbols := make([]string, 0, len(result.Symbols))
+	for name := range result.Symbols {
+		symbols = append(symbols, name)
+	}
+	sort.Strings(symbols)
+
+	if result.Action == RspamdActionAddHeader || result.Action == RspamdActionRewriteSubject {
+		en.AddHeader("X-Spam", "Yes")
+	}
+	en.AddHeader("X-Spam-Score", fmt.Sprintf("%.2f / %.2f", result.Score, result.RequiredScore))
+	en.AddHeader("X-Spam-Action", result.Action)
+	if len(symbols) > 0 {
+		en.AddHeader("X-Spam-Symbols", strings.Join(symbols, ", "))
+	}
+	return nil
+}
+
+// post sends |en| to rspamd, with its envelope in the request headers.
+func (r *rspamd) post(en *smtp.Envelope) (*rspamdResult, error) {
+	var body bytes.Buffer
+	en.WriteHeaders(&body)
+	body.Write(en.Data)
+
+	req, err := http.NewRequest(http.MethodPost, r.url, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Queue-Id", en.ID)
+	req.Header.Set("From", en.MailFrom.Address)
+	for _, rcpt := range en.RcptTo {
+		req.Header.Add("Rcpt", rcpt.Address)
+	}
+	if ip := clientIP(en.RemoteAddr); ip != "" {
+		req.Header.Set("IP", ip)
+	}
+	if en.EHLO != "" {
+		req.Header.Set("Helo", en.EHLO)
+	}
+	if r.password != "" {
+		req.Header.Set("Password", r.password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP status %s", resp.Status)
+	}
+
+	var result rspamdResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.Action == "" {
+		return nil, fmt.Errorf("response has no action")
+	}
+	return &result, nil
+}
@@ -0,0 +1,178 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+func TestRspamd(t *testing.T) {
+	var response string
+	var status int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		checks := []struct{ name, want, got string }{
+			{"path", "/rspamd/checkv2", req.URL.Path},
+			{"Queue-Id", "m.1", req.Header.Get("Queue-Id")},
+			{"From", "from@sender.net", req.Header.Get("From")},
+			{"Rcpt", "a@example.com,b@example.com", strings.Join(req.Header["Rcpt"], ",")},
+			{"IP", "192.0.2.1", req.Header.Get("IP")},
+			{"Helo", "mx.sender.net", req.Header.Get("Helo")},
+			{"Password", "hunter2", req.Header.Get("Password")},
+			{"body", "X-Test: 1\r\nSubject: hi\r\n\r\nbody\r\n", string(body)},
+		}
+		for _, c := range checks {
+			if c.want != c.got {
+				t.Errorf("Want %s %q, got %q", c.name, c.want, c.got)
+			}
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(response))
+	}))
+	defer srv.Close()
+
+	r, err := newRspamd(RspamdConfig{URL: srv.URL + "/rspamd/", Password: "hunter2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newEnvelope := func() smtp.Envelope {
+		en := smtp.Envelope{
+			ID:         "m.1",
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4321},
+			EHLO:       "mx.sender.net",
+			MailFrom:   mail.Address{Address: "from@sender.net"},
+			RcptTo:     []mail.Address{{Address: "a@example.com"}, {Address: "b@example.com"}},
+			Data:       []byte("Subject: hi\r\n\r\nbody\r\n"),
+		}
+		en.AddHeader("X-Test", "1")
+		return en
+	}
+
+	cases := []struct {
+		name     string
+		status   int
+		response string
+		reply    *smtp.ReplyLine
+		headers  []smtp.HeaderField
+	}{
+		{
+			name:     "no action",
+			status:   http.StatusOK,
+			response: `{"score": 1.5, "required_score": 15, "action": "no action", "symbols": {"R_SPF_ALLOW": {"score": -0.2}, "DMARC_NA": {"score": 0}}}`,
+			headers: []smtp.HeaderField{
+				{Name: "X-Spam-Score", Value: "1.50 / 15.00"},
+				{Name: "X-Spam-Action", Value: "no action"},
+				{Name: "X-Spam-Symbols", Value: "DMARC_NA, R_SPF_ALLOW"},
+			},
+		},
+		{
+			name:     "add header",
+			status:   http.StatusOK,
+			response: `{"score": 7, "required_score": 15, "action": "add header"}`,
+			headers: []smtp.HeaderField{
+				{Name: "X-Spam", Value: "Yes"},
+				{Name: "X-Spam-Score", Value: "7.00 / 15.00"},
+				{Name: "X-Spam-Action", Value: "add header"},
+			},
+		},
+		{
+			name:     "reject",
+			status:   http.StatusOK,
+			response: `{"score": 20, "required_score": 15, "action": "reject", "messages": {"smtp_message": "spam message rejected"}}`,
+			reply:    &smtp.ReplyLine{Code: 550, Message: "5.7.1 spam message rejected"},
+		},
+		{
+			name:     "soft reject",
+			status:   http.StatusOK,
+			response: `{"score": 20, "required_score": 15, "action": "soft reject"}`,
+			reply:    &replyRspamdTempFail,
+		},
+		{
+			name:     "greylist",
+			status:   http.StatusOK,
+			response: `{"score": 5, "required_score": 15, "action": "greylist"}`,
+			reply:    &replyRspamdGreylisted,
+		},
+		{
+			name:     "error",
+			status:   http.StatusInternalServerError,
+			response: `{"error": "oops"}`,
+			reply:    &replyRspamdTempFail,
+		},
+		{
+			name:     "no action in response",
+			status:   http.StatusOK,
+			response: `{}`,
+			reply:    &replyRspamdTempFail,
+		},
+	}
+	for _, c := range cases {
+		status, response = c.status, c.response
+		en := newEnvelope()
+		reply := r.check(&en, zap.NewNop())
+		if c.reply != nil {
+			if reply == nil || *c.reply != *reply {
+				t.Errorf("%s: want reply %v, got %v", c.name, c.reply, reply)
+			}
+			continue
+		}
+		if reply != nil {
+			t.Errorf("%s: want accepted, got %v", c.name, reply)
+			continue
+		}
+		headers := en.Headers[1:]
+		if want, got := len(c.headers), len(headers); want != got {
+			t.Errorf("%s: want %d headers, got %v", c.name, want, headers)
+			continue
+		}
+		for i := range headers {
+			if want, got := c.headers[i], headers[i]; want != got {
+				t.Errorf("%s: want header %v, got %v", c.name, want, got)
+			}
+		}
+	}
+
+	// Errors can accept the message instead.
+	status, response = http.StatusInternalServerError, ""
+	r.onError = ContentFilterOnErrorAccept
+	en := newEnvelope()
+	if reply := r.check(&en, zap.NewNop()); reply != nil {
+		t.Errorf("Want accepted on error, got %v", reply)
+	}
+
+	var nilRspamd *rspamd
+	if reply := nilRspamd.check(&en, zap.NewNop()); reply != nil {
+		t.Errorf("Want nil rspamd to accept, got %v", reply)
+	}
+}
+
+func TestNewRspamd(t *testing.T) {
+	if _, err := newRspamd(RspamdConfig{}); err == nil {
+		t.Errorf("Want error for missing URL")
+	}
+	if _, err := newRspamd(RspamdConfig{URL: "http://localhost:11333", OnError: "drop"}); err == nil {
+		t.Errorf("Want error for unknown OnError")
+	}
+	r, err := newRspamd(RspamdConfig{URL: "http://localhost:11333"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "http://localhost:11333/checkv2", r.url; want != got {
+		t.Errorf("Want URL %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,74 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"sync"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/maildrop"
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+// sentArchive holds the relayed messages whose domain has a SentFolder until
+// they are delivered to a recipient, at which point they are copied to the
+// folder.
+type sentArchive struct {
+	mu      sync.Mutex
+	pending map[string]smtp.Envelope
+}
+
+// holdSentCopy keeps |en| to be archived if its sender's domain has a
+// SentFolder.
+func (server *smtpServer) holdSentCopy(en smtp.Envelope) {
+	if s := server.configForAddress(en.MailFrom); s == nil || s.SentFolder == "" {
+		return
+	}
+	server.sent.mu.Lock()
+	defer server.sent.mu.Unlock()
+	if server.sent.pending == nil {
+		server.sent.pending = make(map[string]smtp.Envelope)
+	}
+	server.sent.pending[en.ID] = en
+}
+
+// releaseSentCopy removes the message |id| from the archive, returning it
+// and whether it was held.
+func (server *smtpServer) releaseSentCopy(id string) (smtp.Envelope, bool) {
+	server.sent.mu.Lock()
+	defer server.sent.mu.Unlock()
+	en, ok := server.sent.pending[id]
+	delete(server.sent.pending, id)
+	return en, ok
+}
+
+// storeSentCopy stores the held message |id| in its domain's SentFolder. It
+// is called once the message is delivered to a recipient.
+func (server *smtpServer) storeSentCopy(id string) {
+	en, ok := server.releaseSentCopy(id)
+	if !ok {
+		return
+	}
+	log := server.log.With(zap.String("id", id))
+
+	s := server.configForAddress(en.MailFrom)
+	if s == nil || s.SentFolder == "" {
+		return
+	}
+	md, err := maildrop.New(s.MaildropPath).CreateFolder(s.SentFolder)
+	if err != nil {
+		log.Error("failed to open sent folder", zap.Error(err))
+		return
+	}
+	if err := md.Deliver(en); err != nil {
+		log.Error("failed to store sent message", zap.Error(err))
+		return
+	}
+	log.Info("stored sent message", zap.String("folder", s.SentFolder))
+	server.events.publish(mailboxEvent{Kind: mailboxDelivered, Path: md.Path(), ID: en.ID})
+}
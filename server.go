@@ -7,12 +7,9 @@
 package main
 
 import (
-	"net"
 	"os"
 	"os/signal"
 	"syscall"
-
-	"go.uber.org/zap"
 )
 
 type ServerControlMessage int
@@ -22,21 +19,15 @@ const (
 	ServerControlRestart
 )
 
-func RunAcceptLoop(l net.Listener, c chan<- net.Conn, log *zap.Logger) {
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			log.Error("accept", zap.Error(err))
-			close(c)
-			return
-		}
-
-		c <- conn
-	}
-}
-
 func CreateReloadSignal() <-chan os.Signal {
 	reloadChan := make(chan os.Signal, 1)
 	signal.Notify(reloadChan, syscall.SIGHUP)
 	return reloadChan
 }
+
+// CreateStopSignal returns a channel that receives the signals to shut down.
+func CreateStopSignal() <-chan os.Signal {
+	stopChan := make(chan os.Signal, 1)
+	signal.Notify(stopChan, syscall.SIGTERM, os.Interrupt)
+	return stopChan
+}
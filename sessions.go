@@ -0,0 +1,181 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sessions tracks the live SMTP and POP3 connections, for the admin server.
+var sessions = newSessionRegistry()
+
+type sessionRegistry struct {
+	mu       sync.Mutex
+	nextID   uint64
+	sessions map[uint64]*session
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[uint64]*session)}
+}
+
+// session is a connection in the registry. Its conn counts the bytes read
+// and written, and closing it ends the session.
+type session struct {
+	// Accessed atomically, and first for alignment.
+	bytesRead    int64
+	bytesWritten int64
+
+	id       uint64
+	protocol string
+	start    time.Time
+	conn     net.Conn
+
+	registry *sessionRegistry
+
+	mu    sync.Mutex
+	state string
+}
+
+// SessionInfo is the admin server's report of a session.
+type SessionInfo struct {
+	ID           uint64
+	Protocol     string
+	RemoteAddr   string
+	State        string
+	Start        time.Time
+	BytesRead    int64
+	BytesWritten int64
+}
+
+// Track adds |conn| to the registry. The returned session's Conn should be
+// served in place of |conn|, and Done must be called when it is finished.
+func (r *sessionRegistry) Track(conn net.Conn, protocol string) *session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	s := &session{
+		id:       r.nextID,
+		protocol: protocol,
+		start:    time.Now(),
+		registry: r,
+	}
+	s.conn = &sessionConn{Conn: conn, s: s}
+	r.sessions[s.id] = s
+	return s
+}
+
+// List returns the live sessions, oldest first.
+func (r *sessionRegistry) List() []SessionInfo {
+	r.mu.Lock()
+	infos := make([]SessionInfo, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		infos = append(infos, s.info())
+	}
+	r.mu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// Kill closes the connection of the session with |id|, reporting whether
+// it was found.
+func (r *sessionRegistry) Kill(id uint64) bool {
+	r.mu.Lock()
+	s, ok := r.sessions[id]
+	r.mu.Unlock()
+	if ok {
+		s.conn.Close()
+	}
+	return ok
+}
+
+// ServeHTTP lists the sessions as JSON on GET, and kills the session named
+// by the "id" query parameter on POST.
+func (r *sessionRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.List())
+	case http.MethodPost:
+		id, err := strconv.ParseUint(req.FormValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		if !r.Kill(id) {
+			http.NotFound(w, req)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *session) Conn() net.Conn {
+	return s.conn
+}
+
+// SetState records the protocol state of the session. It is used as the
+// StateChanged callback of smtp.Options and pop3.Options.
+func (s *session) SetState(state string) {
+	s.mu.Lock()
+	s.state = state
+	s.mu.Unlock()
+}
+
+// Done removes the session from the registry.
+func (s *session) Done() {
+	s.registry.mu.Lock()
+	delete(s.registry.sessions, s.id)
+	s.registry.mu.Unlock()
+}
+
+func (s *session) info() SessionInfo {
+	s.mu.Lock()
+	state := s.state
+	s.mu.Unlock()
+
+	return SessionInfo{
+		ID:           s.id,
+		Protocol:     s.protocol,
+		RemoteAddr:   s.conn.RemoteAddr().String(),
+		State:        state,
+		Start:        s.start,
+		BytesRead:    atomic.LoadInt64(&s.bytesRead),
+		BytesWritten: atomic.LoadInt64(&s.bytesWritten),
+	}
+}
+
+type sessionConn struct {
+	net.Conn
+	s *session
+}
+
+func (c *sessionConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.s.bytesRead, int64(n))
+	return n, err
+}
+
+func (c *sessionConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.s.bytesWritten, int64(n))
+	return n, err
+}
@@ -0,0 +1,105 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/logger"
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+func TestSessionRegistry(t *testing.T) {
+	registry := newSessionRegistry()
+	server := &smtpServer{
+		config: Config{Hostname: "mx.example.com"},
+		log:    zap.NewNop(),
+	}
+
+	client, serverConn := net.Pipe()
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	s := registry.Track(pipeConn{serverConn, remote}, "smtp")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer s.Done()
+		smtp.AcceptConnection(s.Conn(), server, smtp.Options{StateChanged: s.SetState}, logger.Nop())
+	}()
+
+	r := bufio.NewReader(client)
+	r.ReadString('\n')
+	fmt.Fprintf(client, "EHLO client.net\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "250 ") {
+			break
+		}
+	}
+	// The state is recorded after the EHLO reply is sent, so wait for
+	// another command.
+	fmt.Fprintf(client, "NOOP\r\n")
+	r.ReadString('\n')
+
+	w := httptest.NewRecorder()
+	registry.ServeHTTP(w, httptest.NewRequest("GET", "/sessions", nil))
+	var infos []SessionInfo
+	if err := json.NewDecoder(w.Body).Decode(&infos); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(infos); want != got {
+		t.Fatalf("Want %d session, got %d", want, got)
+	}
+	info := infos[0]
+	if want, got := "smtp", info.Protocol; want != got {
+		t.Errorf("Want protocol %q, got %q", want, got)
+	}
+	if want, got := remote.String(), info.RemoteAddr; want != got {
+		t.Errorf("Want remote address %q, got %q", want, got)
+	}
+	if want, got := "initial", info.State; want != got {
+		t.Errorf("Want state %q, got %q", want, got)
+	}
+	if want, got := int64(len("EHLO client.net\r\nNOOP\r\n")), info.BytesRead; want != got {
+		t.Errorf("Want %d bytes read, got %d", want, got)
+	}
+	if info.BytesWritten == 0 {
+		t.Errorf("Want bytes written")
+	}
+
+	w = httptest.NewRecorder()
+	registry.ServeHTTP(w, httptest.NewRequest("POST", "/sessions?id=99", nil))
+	if want, got := http.StatusNotFound, w.Code; want != got {
+		t.Errorf("Want HTTP status %d, got %d", want, got)
+	}
+
+	w = httptest.NewRecorder()
+	registry.ServeHTTP(w, httptest.NewRequest("POST", fmt.Sprintf("/sessions?id=%d", info.ID), nil))
+	if want, got := http.StatusNoContent, w.Code; want != got {
+		t.Errorf("Want HTTP status %d, got %d", want, got)
+	}
+
+	<-done
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Errorf("Want connection closed")
+	}
+	if want, got := 0, len(registry.List()); want != got {
+		t.Errorf("Want %d sessions after kill, got %d", want, got)
+	}
+}
@@ -0,0 +1,89 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// newSlogCore returns a zap core that writes JSON through log/slog to
+// |path|, or to standard output if it is "-".
+func newSlogCore(path string) (zapcore.Core, error) {
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	return slogCore{slog.NewJSONHandler(w, &slog.HandlerOptions{Level: slog.LevelDebug})}, nil
+}
+
+// slogCore is a zapcore.Core that hands entries to a slog.Handler.
+type slogCore struct {
+	h slog.Handler
+}
+
+func (c slogCore) Enabled(level zapcore.Level) bool {
+	return c.h.Enabled(context.Background(), slogLevel(level))
+}
+
+func (c slogCore) With(fields []zapcore.Field) zapcore.Core {
+	return slogCore{c.h.WithAttrs(slogAttrs(fields))}
+}
+
+func (c slogCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+func (c slogCore) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	r := slog.NewRecord(e.Time, slogLevel(e.Level), e.Message, 0)
+	r.AddAttrs(slogAttrs(fields)...)
+	return c.h.Handle(context.Background(), r)
+}
+
+func (c slogCore) Sync() error {
+	return nil
+}
+
+func slogLevel(level zapcore.Level) slog.Level {
+	switch {
+	case level <= zapcore.DebugLevel:
+		return slog.LevelDebug
+	case level == zapcore.InfoLevel:
+		return slog.LevelInfo
+	case level == zapcore.WarnLevel:
+		return slog.LevelWarn
+	}
+	return slog.LevelError
+}
+
+// slogAttrs converts zap fields to attributes, in order.
+func slogAttrs(fields []zapcore.Field) []slog.Attr {
+	enc := zapcore.NewMapObjectEncoder()
+	attrs := make([]slog.Attr, 0, len(fields))
+	for _, f := range fields {
+		f.AddTo(enc)
+		if v, ok := enc.Fields[f.Key]; ok {
+			attrs = append(attrs, slog.Any(f.Key, v))
+			delete(enc.Fields, f.Key)
+		}
+	}
+	return attrs
+}
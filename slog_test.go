@@ -0,0 +1,69 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestSlogLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mailpopbox.json")
+
+	log, err := newLogger(&LogConfig{SlogPath: path, SlogOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log = log.With(zap.String("server", "smtp"))
+	log.Debug("accepted connection", zap.Int("port", 25))
+	log.Error("failed to deliver", zap.Error(errors.New("disk full")), zap.Duration("delay", 2*time.Second))
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []map[string]interface{}
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		var r map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("Invalid JSON %q: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+
+	if want, got := 2, len(records); want != got {
+		t.Fatalf("Want %d records, got %d", want, got)
+	}
+	cases := []map[string]interface{}{
+		{"level": "DEBUG", "msg": "accepted connection", "server": "smtp", "port": float64(25)},
+		{"level": "ERROR", "msg": "failed to deliver", "server": "smtp", "error": "disk full", "delay": float64(2 * time.Second)},
+	}
+	for i, c := range cases {
+		for key, want := range c {
+			if got := records[i][key]; want != got {
+				t.Errorf("record %d: want %s %v, got %v", i, key, want, got)
+			}
+		}
+	}
+}
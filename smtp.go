@@ -7,38 +7,322 @@
 package main
 
 import (
-	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"expvar"
 	"fmt"
 	"net"
 	"net/mail"
-	"os"
-	"path"
+	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
 
+	"src.bluestatic.org/mailpopbox/backend"
+	"src.bluestatic.org/mailpopbox/batv"
+	"src.bluestatic.org/mailpopbox/dane"
+	"src.bluestatic.org/mailpopbox/dkim"
+	"src.bluestatic.org/mailpopbox/logger/zaplogger"
+	"src.bluestatic.org/mailpopbox/maildrop"
+	"src.bluestatic.org/mailpopbox/maillog"
+	// Renamed to avoid a conflict with the pop3 message type.
+	rfc5322 "src.bluestatic.org/mailpopbox/message"
+	"src.bluestatic.org/mailpopbox/mtasts"
 	"src.bluestatic.org/mailpopbox/smtp"
 )
 
 var sendAsSubject = regexp.MustCompile(`(?i)\[sendas:\s*([a-zA-Z0-9\.\-_]+)\]`)
 
-func runSMTPServer(config Config, log *zap.Logger) <-chan ServerControlMessage {
+var relayMetrics = expvar.NewMap("relay")
+
+func runSMTPServer(config Config, be *backend.Client, events *mailboxEvents, reputation *reputationDB, access *accessControl, log *zap.Logger) <-chan ServerControlMessage {
 	server := smtpServer{
 		config:      config,
+		backend:     be,
+		events:      events,
+		reputation:  reputation,
+		access:      access,
 		controlChan: make(chan ServerControlMessage),
 		log:         log.With(zap.String("server", "smtp")),
 	}
-	server.mta = smtp.NewDefaultMTA(&server, server.log)
 	go server.run()
 	return server.controlChan
 }
 
+// loadGeoIP opens the GeoIP databases, if they are configured.
+func (server *smtpServer) loadGeoIP() error {
+	if server.config.GeoIP == nil {
+		return nil
+	}
+	geo, err := openGeoIP(*server.config.GeoIP)
+	if err != nil {
+		return err
+	}
+	server.geo = geo
+	return nil
+}
+
+// acceptConnection refuses banned clients and applies the GeoIP policy to a
+// new connection, and then serves it.
+func (server *smtpServer) acceptConnection(conn net.Conn, handler smtp.Server) {
+	log := server.log
+	if server.harvest.Banned(conn.RemoteAddr()) {
+		harvestMetrics.Add("refused", 1)
+		log.Info("refused banned client", zap.Stringer("client", conn.RemoteAddr()))
+		fmt.Fprintf(conn, "421 4.7.0 %s access temporarily denied\r\n", server.Name())
+		conn.Close()
+		return
+	}
+	if server.geo != nil {
+		info := server.geo.Lookup(conn.RemoteAddr())
+		action, _ := server.geo.Policy(info)
+		countConnection(info, action)
+		log = log.With(info.fields()...)
+
+		switch action {
+		case GeoIPActionReject:
+			log.Info("rejected connection by GeoIP policy", zap.Stringer("client", conn.RemoteAddr()))
+			conn.Close()
+			return
+		case GeoIPActionTarpit:
+			time.Sleep(server.geo.tarpit)
+		}
+	}
+	opts := server.config.SMTPOptions
+	opts.RequireTLS = server.config.SMTPListener.RequireTLS
+	opts.ReceivedPrivacy = server.config.SMTPListener.ReceivedPrivacy
+	opts.Trusted = server.config.SMTPListener.TrustSocketClients
+	server.serveConnection(conn, handler, opts, "smtp", log)
+}
+
+// serveConnection serves |conn| as a session in the registry.
+func (server *smtpServer) serveConnection(conn net.Conn, handler smtp.Server, opts smtp.Options, protocol string, log *zap.Logger) {
+	s := sessions.Track(conn, protocol)
+	defer s.Done()
+
+	opts.StateChanged = s.SetState
+	smtp.AcceptConnection(s.Conn(), handler, opts, zaplogger.New(log))
+}
+
+// setupDelivery opens the maillog and creates the MTA, for a server that
+// delivers and relays messages itself.
+func (server *smtpServer) setupDelivery() error {
+	maxDeliveries := server.config.MaxConcurrentDeliveries
+	if maxDeliveries <= 0 {
+		maxDeliveries = DefaultMaxConcurrentDeliveries
+	}
+	server.deliverySlots = make(chan struct{}, maxDeliveries)
+
+	if server.config.MaillogPath != "" {
+		ml, err := maillog.Open(server.config.MaillogPath, server.config.Hostname)
+		if err != nil {
+			return err
+		}
+		server.maillog = ml
+	}
+
+	opts := smtp.MTAOptions{Maillog: server.maillog}
+	if server.config.TemplatesPath != "" {
+		templates, err := smtp.LoadTemplates(server.config.TemplatesPath)
+		if err != nil {
+			return err
+		}
+		opts.Templates = templates
+	}
+	if retry := server.config.RelayRetry; retry != nil {
+		var err error
+		if opts.Retry, err = retry.parse(); err != nil {
+			return fmt.Errorf("RelayRetry: %v", err)
+		}
+		opts.DomainRetry = make(map[string]smtp.RetryPolicy)
+		for domain, p := range retry.Domains {
+			if opts.DomainRetry[domain], err = p.parse(); err != nil {
+				return fmt.Errorf("RelayRetry %s: %v", domain, err)
+			}
+		}
+	}
+	if server.config.RelayDeadHostTTL != "" {
+		var err error
+		if opts.DeadHostTTL, err = time.ParseDuration(server.config.RelayDeadHostTTL); err != nil {
+			return fmt.Errorf("RelayDeadHostTTL: %v", err)
+		}
+	}
+	if server.config.RelayConcurrency < 0 {
+		return fmt.Errorf("RelayConcurrency: must not be negative")
+	}
+	opts.Concurrency = server.config.RelayConcurrency
+	if server.config.Smarthost != nil {
+		var err error
+		if opts.Smarthost, err = server.config.Smarthost.smarthost(); err != nil {
+			return fmt.Errorf("Smarthost: %v", err)
+		}
+	}
+	if server.config.MTASTSCachePath != "" {
+		cache, err := mtasts.NewCache(server.config.MTASTSCachePath)
+		if err != nil {
+			return fmt.Errorf("MTASTSCachePath: %v", err)
+		}
+		opts.STSPolicies = cache
+	}
+	if d := server.config.DANE; d != nil {
+		if d.Resolver == "" {
+			return fmt.Errorf("DANE: missing Resolver")
+		}
+		switch d.Fallback {
+		case "", smtp.DANEFallbackVerify, smtp.DANEFallbackOpportunistic:
+		default:
+			return fmt.Errorf("DANE: unknown Fallback %q", d.Fallback)
+		}
+		opts.DANE = &dane.Resolver{Addr: d.Resolver}
+		opts.DANEFallback = d.Fallback
+	}
+	if err := validateRelaySourceIPs(server.config); err != nil {
+		return err
+	}
+	signers, err := loadDKIMSigners(server.config.Servers)
+	if err != nil {
+		return err
+	}
+	server.dkimSigners = signers
+
+	server.mta = smtp.NewMTA(server, opts, zaplogger.New(server.log))
+
+	if server.config.TLSReport != nil {
+		interval := defaultTLSReportInterval
+		if server.config.TLSReport.Interval != "" {
+			var err error
+			if interval, err = time.ParseDuration(server.config.TLSReport.Interval); err != nil {
+				return fmt.Errorf("TLSReport Interval: %v", err)
+			}
+		}
+		server.tlsReports = newTLSReports(server.config)
+		go server.reportTLS(interval)
+	}
+
+	if err := validateHeloPolicies(server.config.HeloPolicies); err != nil {
+		return err
+	}
+	if server.config.ContentFilter != nil {
+		var err error
+		if server.contentFilter, err = newContentFilter(*server.config.ContentFilter); err != nil {
+			return fmt.Errorf("ContentFilter: %v", err)
+		}
+	}
+	if server.config.Rspamd != nil {
+		var err error
+		if server.rspamd, err = newRspamd(*server.config.Rspamd); err != nil {
+			return fmt.Errorf("Rspamd: %v", err)
+		}
+	}
+
+	server.quarantines = make(map[string]*quarantine)
+	for _, s := range server.config.Servers {
+		if s.Quarantine != nil {
+			q, err := newQuarantine(s)
+			if err != nil {
+				return fmt.Errorf("%s: Quarantine: %v", s.Domain, err)
+			}
+			server.quarantines[s.Domain] = q
+		}
+	}
+
+	report := false
+	for _, s := range server.config.Servers {
+		if s.DMARC != nil {
+			if err := s.DMARC.validate(); err != nil {
+				return fmt.Errorf("%s: %v", s.Domain, err)
+			}
+			report = true
+		}
+	}
+	if report {
+		interval := defaultDMARCReportInterval
+		if server.config.DMARCReportInterval != "" {
+			var err error
+			if interval, err = time.ParseDuration(server.config.DMARCReportInterval); err != nil {
+				return fmt.Errorf("DMARCReportInterval: %v", err)
+			}
+		}
+		go server.reportDMARC(interval)
+	}
+
+	if server.config.InboundSpool != nil {
+		var err error
+		if server.spool, err = openSpool(*server.config.InboundSpool, server.deliverMessage, server.notifyUndelivered, server.log); err != nil {
+			return fmt.Errorf("InboundSpool: %v", err)
+		}
+	}
+	return nil
+}
+
 type smtpServer struct {
-	config    Config
+	config Config
+
+	// tlsMu guards tlsConfig and clientCerts, which are replaced on reload
+	// while connections read them.
+	tlsMu     sync.RWMutex
 	tlsConfig *tls.Config
 
-	mta smtp.MTA
+	mta     smtp.MTA
+	maillog *maillog.Writer
+
+	// deliverySlots bounds the number of concurrent DeliverMessage calls. If
+	// nil, there is no limit.
+	deliverySlots chan struct{}
+
+	// events is published each change that the server makes to a maildrop.
+	events *mailboxEvents
+
+	access *accessControl
+
+	// sent holds relayed messages to copy to a SentFolder.
+	sent sentArchive
+
+	// geo is nil unless GeoIP is configured.
+	geo *geoIP
+
+	trustedRelays []*net.IPNet
+
+	// harvest is nil unless Harvest is configured.
+	harvest *harvestGuard
+
+	dmarcStats dmarcStats
+
+	// tlsReports is nil unless TLSReport is configured.
+	tlsReports *tlsReports
+
+	// contentFilter is nil unless ContentFilter is configured.
+	contentFilter *contentFilter
+
+	// rspamd is nil unless Rspamd is configured.
+	rspamd *rspamd
+
+	// dkimSigners holds the DKIM signer of each Server that signs its
+	// relayed mail, keyed by domain.
+	dkimSigners map[string]*dkim.Signer
+
+	// quarantines holds the spam quarantine of each Server that has one,
+	// keyed by domain.
+	quarantines map[string]*quarantine
+
+	// reputation is nil unless Reputation is configured.
+	reputation *reputationDB
+
+	// spool is nil unless InboundSpool is configured.
+	spool *spool
+
+	// clientCerts holds the client certificates trusted by each Server,
+	// keyed by domain.
+	clientCerts map[string]*clientCertAuth
+
+	// If non-nil, messages are delivered and relayed by the backend rather
+	// than locally.
+	backend *backend.Client
 
 	log *zap.Logger
 
@@ -50,18 +334,89 @@ func (server *smtpServer) run() {
 		return
 	}
 
-	addr := fmt.Sprintf(":%d", server.config.SMTPPort)
-	server.log.Info("starting server", zap.String("address", addr))
+	if err := server.loadGeoIP(); err != nil {
+		server.log.Error("failed to open GeoIP databases", zap.Error(err))
+		server.controlChan <- ServerControlFatalError
+		return
+	}
 
-	l, err := net.Listen("tcp", addr)
+	trustedRelays, err := parseNets(server.config.TrustedRelays)
 	if err != nil {
-		server.log.Error("listen", zap.Error(err))
+		server.log.Error("invalid TrustedRelays", zap.Error(err))
 		server.controlChan <- ServerControlFatalError
 		return
 	}
+	server.trustedRelays = trustedRelays
 
-	connChan := make(chan net.Conn)
-	go RunAcceptLoop(l, connChan, server.log)
+	if server.config.Harvest != nil {
+		if server.harvest, err = newHarvestGuard(*server.config.Harvest, server.log); err != nil {
+			server.log.Error("invalid Harvest config", zap.Error(err))
+			server.controlChan <- ServerControlFatalError
+			return
+		}
+	}
+
+	if server.backend == nil {
+		if err := server.setupDelivery(); err != nil {
+			server.log.Error("failed to set up delivery", zap.Error(err))
+			server.controlChan <- ServerControlFatalError
+			return
+		}
+		if server.spool != nil {
+			server.spool.start()
+		}
+	}
+
+	var handler smtp.Server = server
+	if server.config.hasTokenAuth() {
+		handler = tokenAuthServer{server}
+	}
+	if server.backend != nil {
+		handler = server.backend.SMTPServer(handler)
+	}
+
+	l := server.listen("smtp", server.config.smtpAddress(), server.config.SMTPListener)
+	if l == nil {
+		return
+	}
+	serveErr := make(chan error, 3)
+	go func() {
+		serveErr <- l.Serve(func(conn net.Conn) {
+			server.acceptConnection(conn, handler)
+		})
+	}()
+
+	if server.config.SubmissionPort != 0 {
+		submission := server.listen("submission", fmt.Sprintf(":%d", server.config.SubmissionPort), server.config.SubmissionListener)
+		if submission == nil {
+			l.Close()
+			return
+		}
+		submissionOptions := server.config.SMTPOptions
+		submissionOptions.Submission = true
+		submissionOptions.RequireTLS = server.config.SubmissionListener.RequireTLS
+		submissionOptions.ReceivedPrivacy = server.config.SubmissionListener.ReceivedPrivacy
+		go func() {
+			serveErr <- submission.Serve(func(conn net.Conn) {
+				server.serveConnection(conn, handler, submissionOptions, "submission", server.log)
+			})
+		}()
+	}
+
+	if server.config.LMTPAddress != "" {
+		lmtp := server.listen("lmtp", server.config.LMTPAddress, server.config.LMTPListener)
+		if lmtp == nil {
+			l.Close()
+			return
+		}
+		lmtpOptions := server.config.SMTPOptions
+		lmtpOptions.LMTP = true
+		go func() {
+			serveErr <- lmtp.Serve(func(conn net.Conn) {
+				server.serveConnection(conn, handler, lmtpOptions, "lmtp", server.log)
+			})
+		}()
+	}
 
 	reloadChan := CreateReloadSignal()
 
@@ -71,24 +426,45 @@ func (server *smtpServer) run() {
 			if !server.loadTLSConfig() {
 				return
 			}
-		case conn, ok := <-connChan:
-			if ok {
-				go smtp.AcceptConnection(conn, server, server.log)
-			} else {
-				break
-			}
+		case <-serveErr:
+			server.controlChan <- ServerControlFatalError
+			return
 		}
 	}
 }
 
+// listen opens the |name| listener on |addr|. On failure, it reports a fatal
+// error and returns nil.
+func (server *smtpServer) listen(name, addr string, opts ListenerOptions) *listener {
+	l, err := listenAddress(name, addr, opts, server.access, server.log)
+	if err != nil {
+		server.log.Error("listen", zap.Error(err))
+		server.controlChan <- ServerControlFatalError
+		return nil
+	}
+	l.busy = func(conn net.Conn) {
+		fmt.Fprintf(conn, "421 %s too many connections\r\n", server.Name())
+	}
+	return l
+}
+
 func (server *smtpServer) loadTLSConfig() bool {
-	var err error
-	server.tlsConfig, err = server.config.GetTLSConfig()
+	tlsConfig, err := server.config.GetSMTPTLSConfig()
 	if err != nil {
 		server.log.Error("failed to configure TLS", zap.Error(err))
 		server.controlChan <- ServerControlFatalError
 		return false
 	}
+	clientCerts, err := loadClientCertAuth(server.config)
+	if err != nil {
+		server.log.Error("failed to load client certificates", zap.Error(err))
+		server.controlChan <- ServerControlFatalError
+		return false
+	}
+
+	server.tlsMu.Lock()
+	server.tlsConfig, server.clientCerts = tlsConfig, clientCerts
+	server.tlsMu.Unlock()
 	server.log.Info("loaded TLS config")
 	return true
 }
@@ -97,7 +473,25 @@ func (server *smtpServer) Name() string {
 	return server.config.Hostname
 }
 
+// IsTrustedRelay reports whether |addr| is in TrustedRelays. The clients of
+// a unix socket are trusted only by the listener's TrustSocketClients.
+func (server *smtpServer) IsTrustedRelay(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && containsIP(server.trustedRelays, tcpAddr.IP)
+}
+
+// InvalidRecipient counts a nonexistent recipient tried by the client at
+// |addr|, which is disconnected and banned if it tries too many.
+func (server *smtpServer) InvalidRecipient(addr net.Addr, rcpt mail.Address) bool {
+	if server.IsTrustedRelay(addr) {
+		return false
+	}
+	return server.harvest.Record(addr)
+}
+
 func (server *smtpServer) TLSConfig() *tls.Config {
+	server.tlsMu.RLock()
+	defer server.tlsMu.RUnlock()
 	return server.tlsConfig
 }
 
@@ -106,14 +500,86 @@ func (server *smtpServer) VerifyAddress(addr mail.Address) smtp.ReplyLine {
 	if s == nil {
 		return smtp.ReplyBadMailbox
 	}
+	address := batv.Strip(addr.Address)
+	if isRoleAddress(s, address) {
+		return smtp.ReplyOK
+	}
 	for _, blocked := range s.BlockedAddresses {
-		if blocked == addr.Address {
+		if blocked == address {
+			return smtp.ReplyMailboxUnallowed
+		}
+	}
+	if s.BlockedAddressesFile != "" {
+		blocked, err := addressFiles.Match(s.BlockedAddressesFile, address, server.log)
+		if err != nil {
+			server.log.Error("failed to read BlockedAddressesFile", zap.Error(err))
+			return replyVerifyUnavailable
+		}
+		if blocked {
 			return smtp.ReplyMailboxUnallowed
 		}
 	}
+	if s.AllowedAddressesFile != "" && address != MailboxAccount+s.Domain {
+		allowed, err := addressFiles.Match(s.AllowedAddressesFile, address, server.log)
+		if err != nil {
+			server.log.Error("failed to read AllowedAddressesFile", zap.Error(err))
+			return replyVerifyUnavailable
+		}
+		if !allowed {
+			return smtp.ReplyBadMailbox
+		}
+	}
+	if v := newAddressVerifier(*s, server.log); v != nil {
+		return v.VerifyAddress(address)
+	}
 	return smtp.ReplyOK
 }
 
+// isRoleAddress reports whether |address| is one of the RoleAccounts of the
+// domain of |s|. Like postmaster, the local part is matched without case.
+func isRoleAddress(s *Server, address string) bool {
+	at := strings.LastIndexByte(address, '@')
+	if at == -1 || !strings.EqualFold(address[at+1:], s.Domain) {
+		return false
+	}
+	for _, role := range RoleAccounts {
+		if strings.EqualFold(address[:at], role) {
+			return true
+		}
+	}
+	return false
+}
+
+// forRoles reports whether every recipient of |en| is a role address of |s|.
+func forRoles(s *Server, en smtp.Envelope) bool {
+	for _, rcpt := range en.RcptTo {
+		if !isRoleAddress(s, batv.Strip(rcpt.Address)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (server *smtpServer) MaxMessageSize(rcpt mail.Address) int64 {
+	if s := server.configForAddress(rcpt); s != nil {
+		return s.MaxMessageSize
+	}
+	return 0
+}
+
+func (server *smtpServer) MaxInboundMessageSize() int64 {
+	var limit int64
+	for _, s := range server.config.Servers {
+		if s.MaxMessageSize <= 0 {
+			return 0
+		}
+		if s.MaxMessageSize > limit {
+			limit = s.MaxMessageSize
+		}
+	}
+	return limit
+}
+
 func (server *smtpServer) Authenticate(authz, authc, passwd string) bool {
 	authcAddr, err := mail.ParseAddress(authc)
 	if err != nil {
@@ -138,21 +604,144 @@ func (server *smtpServer) Authenticate(authz, authc, passwd string) bool {
 	return false
 }
 
+// replyLocalError is returned when a message cannot be stored, which is
+// temporary, so that the sender or the spool tries again rather than the
+// message being lost.
+var replyLocalError = smtp.ReplyLine{Code: 451, Message: "4.3.0 local error in processing, try again later"}
+
+// DeliverMessage delivers |en|, or accepts it into the InboundSpool to be
+// delivered later.
 func (server *smtpServer) DeliverMessage(en smtp.Envelope) *smtp.ReplyLine {
-	maildrop := server.maildropForAddress(en.RcptTo[0])
-	if maildrop == "" {
+	if server.spool != nil {
+		return server.spool.accept(en)
+	}
+	return server.deliverMessage(en)
+}
+
+// deliverMessage filters |en| and stores it in its maildrop, returning a
+// reply if it is refused.
+func (server *smtpServer) deliverMessage(en smtp.Envelope) (reply *smtp.ReplyLine) {
+	if server.deliverySlots != nil {
+		select {
+		case server.deliverySlots <- struct{}{}:
+			defer func() { <-server.deliverySlots }()
+		default:
+			server.log.Warn("too many concurrent deliveries", zap.String("id", en.ID))
+			return &smtp.ReplyServerBusy
+		}
+	}
+
+	if reply := server.reputation.check(&en); reply != nil {
+		return reply
+	}
+	defer func() { server.reputation.record(&en, reply) }()
+
+	if reply := server.checkBounceSignatures(&en); reply != nil {
+		return reply
+	}
+
+	if server.geo != nil {
+		info := server.geo.Lookup(en.RemoteAddr)
+		_, score := server.geo.Policy(info)
+		en.AddHeader("X-Mailpopbox-GeoIP", info.header(score))
+		en.Annotate("geoip-score", strconv.Itoa(score))
+	}
+
+	if reply := server.applyHeloPolicies(&en); reply != nil {
+		return reply
+	}
+
+	if smtp.IsDeliveryLoop(en.Data, en.RcptTo[0].Address) {
+		server.log.Warn("mail loop", zap.String("id", en.ID), zap.String("address", en.RcptTo[0].Address))
+		return &smtp.ReplyMailLoop
+	}
+
+	s := server.configForAddress(en.RcptTo[0])
+	if s == nil || s.MaildropPath == "" {
 		server.log.Error("faild to open maildrop to deliver message", zap.String("id", en.ID))
-		return &smtp.ReplyBadMailbox
+		return &replyLocalError
 	}
+	maildropPath := s.MaildropPath
+	md := maildrop.New(maildropPath)
 
-	f, err := os.Create(path.Join(maildrop, en.ID+".msg"))
-	if err != nil {
-		server.log.Error("failed to create message file", zap.String("id", en.ID), zap.Error(err))
-		return &smtp.ReplyBadMailbox
+	folder, reply := server.applyDMARC(s, &en)
+	if reply != nil {
+		return reply
+	}
+
+	if reply := server.contentFilter.filter(&en, server.log); reply != nil {
+		return reply
+	}
+
+	if reply := server.rspamd.check(&en, server.log); reply != nil {
+		return reply
+	}
+
+	// Mail for the role accounts goes to the RoleFolder rather than being
+	// quarantined, since abuse reports often quote spam.
+	roleFolder := folder == "" && s.RoleFolder != "" && forRoles(s, en)
+	if roleFolder {
+		folder = s.RoleFolder
+	}
+	if folder == "" {
+		folder = server.quarantines[s.Domain].check(&en, server.log)
+	}
+
+	if folder != "" {
+		quarantine, err := md.CreateFolder(folder)
+		if err != nil {
+			server.log.Error("failed to open folder", zap.String("id", en.ID), zap.String("folder", folder), zap.Error(err))
+			return &replyLocalError
+		}
+		md, maildropPath = quarantine, quarantine.Path()
 	}
 
-	smtp.WriteEnvelopeForDelivery(f, en)
-	f.Close()
+	// The quota applies to the folder that the message goes to, so that mail
+	// for a folder does not displace the inbox.
+	if reply := server.checkQuota(s, md, en); reply != nil {
+		return reply
+	}
+
+	server.digestReports(s, &en)
+
+	delivery := maillog.Delivery{
+		ID:     en.ID,
+		Relay:  "local",
+		Delay:  maillog.DelaySince(en.Received),
+		DSN:    "2.0.0",
+		Status: maillog.StatusSent,
+		Detail: "delivered to maildrop",
+	}
+	if roleFolder {
+		delivery.Detail = "delivered to " + folder
+	} else if folder != "" {
+		delivery.Detail = "quarantined to " + folder
+	}
+	server.maillog.Queued(en.ID, en.MailFrom.Address, len(en.Data), len(en.RcptTo))
+	defer server.maillog.Removed(en.ID)
+
+	// The recipients share one copy of the message, and each is logged.
+	logDelivery := func() {
+		for _, rcpt := range en.RcptTo {
+			delivery.To = rcpt.Address
+			server.maillog.Delivery(delivery)
+		}
+	}
+	if err := md.Deliver(en); err != nil {
+		server.log.Error("failed to store message", zap.String("id", en.ID), zap.Error(err))
+		delivery.DSN = "4.3.0"
+		delivery.Status = maillog.StatusDeferred
+		delivery.Detail = err.Error()
+		logDelivery()
+		return &replyLocalError
+	}
+	logDelivery()
+
+	if !isArchiveAddress(s, en.RcptTo[0]) {
+		server.archiveMessage(s, en, archiveInbound)
+	}
+
+	server.events.publish(mailboxEvent{Kind: mailboxDelivered, Path: maildropPath, ID: en.ID})
 	return nil
 }
 
@@ -166,83 +755,250 @@ func (server *smtpServer) configForAddress(addr mail.Address) *Server {
 	return nil
 }
 
-func (server *smtpServer) maildropForAddress(addr mail.Address) string {
-	s := server.configForAddress(addr)
-	if s != nil {
-		return s.MaildropPath
+// Mailbox returns the maildrop that |rcpt| is delivered to, so that the
+// domains of a shared MaildropPath get one copy of an LMTP message.
+func (server *smtpServer) Mailbox(rcpt mail.Address) string {
+	s := server.configForAddress(rcpt)
+	if s == nil || s.MaildropPath == "" {
+		return strings.ToLower(smtp.DomainForAddress(rcpt))
 	}
-	return ""
+	if path, err := filepath.Abs(s.MaildropPath); err == nil {
+		return path
+	}
+	return filepath.Clean(s.MaildropPath)
 }
 
+// RelayMessage queues |en| to be relayed. It is prepared for sending on the
+// relay queue, so that a burst of submissions does not run unbounded.
 func (server *smtpServer) RelayMessage(en smtp.Envelope, authc string) {
-	go func() {
+	server.mta.QueueMessage(en, func(en *smtp.Envelope) {
 		log := server.log.With(zap.String("id", en.ID))
-		server.handleSendAs(log, &en, authc)
-		server.mta.RelayMessage(en)
-	}()
+		server.handleSendAs(log, en, authc)
+		server.addMissingHeaders(log, en)
+		server.holdSentCopy(*en)
+		if s := server.configForAddress(en.MailFrom); s != nil {
+			server.archiveMessage(s, *en, archiveOutbound)
+		}
+		server.signSender(en)
+		server.signMessage(log, en)
+	}, func(en smtp.Envelope) {
+		// Discard the copy if the message was never delivered.
+		server.releaseSentCopy(en.ID)
+	})
 }
 
-func (server *smtpServer) handleSendAs(log *zap.Logger, en *smtp.Envelope, authc string) {
-	// Find the separator between the message header and body.
-	headerIdx := bytes.Index(en.Data, []byte("\n\n"))
-	if headerIdx == -1 {
-		log.Error("send-as: could not find headers index")
-		return
+// RelayHelloName returns the configured EHLO name for relaying messages from
+// the domain of |en|.
+func (server *smtpServer) RelayHelloName(en smtp.Envelope) string {
+	if s := server.configForAddress(en.MailFrom); s != nil && s.RelayHostname != "" {
+		return s.RelayHostname
 	}
+	return server.config.RelayHostname
+}
 
-	var buf bytes.Buffer
-
-	headers := bytes.SplitAfter(en.Data[:headerIdx], []byte("\n"))
-
-	var fromIdx, subjectIdx int
-	for i, header := range headers {
-		if bytes.HasPrefix(header, []byte("From:")) {
-			fromIdx = i
-			continue
-		}
-		if bytes.HasPrefix(header, []byte("Subject:")) {
-			subjectIdx = i
-			continue
-		}
+// RelayResult records the outcome of relaying a message to a recipient in the
+// relay metrics. The first delivery of a message archives it to the sender's
+// SentFolder.
+func (server *smtpServer) RelayResult(r smtp.RelayResult) {
+	if r.Delivered() {
+		relayMetrics.Add("delivered", 1)
+		server.storeSentCopy(r.ID)
+	} else {
+		relayMetrics.Add("failed", 1)
 	}
+	server.log.Info("relay result",
+		zap.String("id", r.ID),
+		zap.String("recipient", r.Recipient),
+		zap.String("relay", r.Relay),
+		zap.Int("code", r.Code),
+		zap.String("status", r.Status))
+}
+
+func (server *smtpServer) handleSendAs(log *zap.Logger, en *smtp.Envelope, authc string) {
+	header, body := rfc5322.Parse(en.Data)
 
-	if subjectIdx == -1 {
+	if header.Index("Subject") == -1 {
 		log.Error("send-as: could not find Subject header")
 		return
 	}
-	if fromIdx == -1 {
+	if header.Index("From") == -1 {
 		log.Error("send-as: could not find From header")
 		return
 	}
 
-	sendAs := sendAsSubject.FindSubmatchIndex(headers[subjectIdx])
+	subject := header.Get("Subject")
+	sendAs := sendAsSubject.FindStringSubmatchIndex(subject)
 	if sendAs == nil {
 		// No send-as modification.
 		return
 	}
 
 	// Submatch 0 is the whole sendas magic. Submatch 1 is the address prefix.
-	sendAsUser := headers[subjectIdx][sendAs[2]:sendAs[3]]
-	sendAsAddress := string(sendAsUser) + "@" + smtp.DomainForAddressString(authc)
+	sendAsUser := subject[sendAs[2]:sendAs[3]]
+	sendAsAddress := sendAsUser + "@" + smtp.DomainForAddressString(authc)
 
 	log.Info("handling send-as", zap.String("address", sendAsAddress))
 
-	for i, header := range headers {
-		if i == subjectIdx {
-			buf.Write(header[:sendAs[0]])
-			buf.Write(header[sendAs[1]:])
-		} else if i == fromIdx {
-			addressStart := bytes.LastIndexByte(header, byte('<'))
-			buf.Write(header[:addressStart+1])
-			buf.WriteString(sendAsAddress)
-			buf.WriteString(">\n")
-		} else {
-			buf.Write(header)
+	from := mail.Address{Address: sendAsAddress}
+	origFrom, err := mail.ParseAddress(header.Get("From"))
+	if err == nil {
+		from.Name = origFrom.Name
+	}
+
+	header.Set("Subject", subject[:sendAs[0]]+subject[sendAs[1]:])
+	header.Set("From", from.String())
+
+	if header.Index("Reply-To") != -1 {
+		mailboxAddrs := []string{authc}
+		if origFrom != nil {
+			mailboxAddrs = append(mailboxAddrs, origFrom.Address)
+		}
+		strip := false
+		if s := server.configForAddress(mail.Address{Address: authc}); s != nil {
+			strip = s.SendAsStripReplyTo
 		}
+		rewriteReplyTo(log, header, mailboxAddrs, from, strip)
 	}
 
-	buf.Write(en.Data[headerIdx:])
+	// The client's Message-ID typically names the domain of the real mailbox
+	// provider, so replace it. References is left alone so that the message
+	// still threads with the conversation it replies to.
+	sendAsDomain := smtp.DomainForAddressString(sendAsAddress)
+	if msgID := header.Get("Message-ID"); !strings.HasSuffix(msgID, "@"+sendAsDomain+">") {
+		header.Set("Message-ID", newMessageID(sendAsDomain, msgID))
+	}
 
-	en.Data = buf.Bytes()
+	en.Data = rfc5322.Join(header, body)
 	en.MailFrom.Address = sendAsAddress
 }
+
+// addMissingHeaders adds the Message-ID and Date fields, which RFC 5322 §
+// 3.6 requires, to a submitted message |en| that lacks them. Many scripts
+// leave them out, and providers reject the relayed message without them.
+func (server *smtpServer) addMissingHeaders(log *zap.Logger, en *smtp.Envelope) {
+	header, body := rfc5322.Parse(en.Data)
+
+	var added []string
+	if header.Index("Message-ID") == -1 {
+		domain := smtp.DomainForAddress(en.MailFrom)
+		if domain == "" {
+			domain = server.config.Hostname
+		}
+		header.Add("Message-ID", newMessageID(domain, ""))
+		added = append(added, "Message-ID")
+	}
+	if header.Index("Date") == -1 {
+		date := en.Received
+		if date.IsZero() {
+			date = time.Now()
+		}
+		header.Add("Date", date.Format(time.RFC1123Z))
+		added = append(added, "Date")
+	}
+	if len(added) == 0 {
+		return
+	}
+
+	log.Info("added missing header fields", zap.Strings("fields", added))
+	en.Data = rfc5322.Join(header, body)
+}
+
+// signSender signs the envelope sender of |en| with BATV, if its domain is
+// configured to.
+func (server *smtpServer) signSender(en *smtp.Envelope) {
+	if s := server.configForAddress(en.MailFrom); s != nil && s.BATVKey != "" {
+		en.MailFrom.Address = batv.Sign([]byte(s.BATVKey), en.MailFrom.Address, time.Now())
+	}
+}
+
+// checkBounceSignatures removes the BATV signatures from the recipients of
+// |en|. If |en| is a bounce, which has a null sender, to a recipient in a
+// domain with a BATVKey that is not validly signed, it was not caused by mail
+// from this server. Such a bounce is rejected, or marked with a header.
+func (server *smtpServer) checkBounceSignatures(en *smtp.Envelope) *smtp.ReplyLine {
+	var failure error
+	rcptTo := make([]mail.Address, len(en.RcptTo))
+	for i, rcpt := range en.RcptTo {
+		rcptTo[i] = rcpt
+		s := server.configForAddress(rcpt)
+		if s == nil || s.BATVKey == "" {
+			continue
+		}
+
+		plain, err := batv.Verify([]byte(s.BATVKey), rcpt.Address, time.Now())
+		rcptTo[i].Address = plain
+		if err == nil || en.MailFrom.Address != "" {
+			continue
+		}
+
+		server.log.Warn("bounce without a valid signature",
+			zap.String("id", en.ID),
+			zap.String("address", rcpt.Address),
+			zap.Error(err))
+		if s.BATVReject {
+			return &smtp.ReplyLine{Code: 550, Message: "bounce to an address that did not send mail"}
+		}
+		failure = err
+	}
+	en.RcptTo = rcptTo
+
+	if failure != nil {
+		en.AddHeader("X-Mailpopbox-BATV", "fail ("+failure.Error()+")")
+		en.Annotate("batv", "fail")
+	}
+	return nil
+}
+
+// rewriteReplyTo replaces any of the mailboxAddrs in the Reply-To header with
+// sendAs, or removes them if strip is true. Other addresses are kept.
+func rewriteReplyTo(log *zap.Logger, header *rfc5322.Header, mailboxAddrs []string, sendAs mail.Address, strip bool) {
+	replyTo, err := mail.ParseAddressList(header.Get("Reply-To"))
+	if err != nil {
+		log.Error("send-as: could not parse Reply-To header", zap.Error(err))
+		return
+	}
+
+	var addrs []string
+	changed := false
+	for _, addr := range replyTo {
+		isMailbox := false
+		for _, mailboxAddr := range mailboxAddrs {
+			if strings.EqualFold(addr.Address, mailboxAddr) {
+				isMailbox = true
+				break
+			}
+		}
+		if !isMailbox {
+			addrs = append(addrs, addr.String())
+			continue
+		}
+		changed = true
+		if !strip {
+			addrs = append(addrs, sendAs.String())
+		}
+	}
+
+	if !changed {
+		return
+	}
+	if len(addrs) == 0 {
+		header.Del("Reply-To")
+	} else {
+		header.Set("Reply-To", strings.Join(addrs, ", "))
+	}
+}
+
+// newMessageID returns a Message-ID with the right-hand side set to domain.
+// If the message had an |original| ID, the new one is derived from it. A
+// client that is told "too many recipients" sends the same message again in
+// another transaction, and every copy needs to have the same ID.
+func newMessageID(domain, original string) string {
+	if original != "" {
+		sum := sha256.Sum256([]byte(original))
+		return fmt.Sprintf("<%x@%s>", sum[:16], domain)
+	}
+
+	var idBytes [8]byte
+	rand.Read(idBytes[:])
+	return fmt.Sprintf("<%d.%x@%s>", time.Now().UnixNano(), idBytes, domain)
+}
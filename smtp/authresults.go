@@ -0,0 +1,147 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"src.bluestatic.org/mailpopbox/dkim"
+	"src.bluestatic.org/mailpopbox/dmarc"
+	"src.bluestatic.org/mailpopbox/message"
+	"src.bluestatic.org/mailpopbox/resolver"
+	"src.bluestatic.org/mailpopbox/spf"
+)
+
+// dkimTimeout bounds the key lookups for the signatures on one message.
+const dkimTimeout = 10 * time.Second
+
+// spfTimeout bounds the lookups for the SPF and DMARC records of one message.
+const spfTimeout = 20 * time.Second
+
+var (
+	lookupTXT   resolver.LookupTXT = resolver.Default.LookupTXT
+	spfResolver spf.Resolver       = resolver.Default
+)
+
+// verifyDKIM checks the DKIM signatures of the message |data|.
+func verifyDKIM(data []byte, now time.Time) []dkim.Result {
+	ctx, cancel := context.WithTimeout(context.Background(), dkimTimeout)
+	defer cancel()
+	return dkim.Verify(ctx, data, lookupTXT, now)
+}
+
+// spfIdentity returns the identity checked by SPF for |env| and its domain,
+// which is the MAIL FROM address or the HELO name for a null sender.
+func spfIdentity(env Envelope) (string, string) {
+	if env.MailFrom.Address == "" {
+		return "helo", env.EHLO
+	}
+	return "mailfrom", DomainForAddress(env.MailFrom)
+}
+
+// checkSPF evaluates the SPF record of the sender of |env|.
+func checkSPF(env Envelope) spf.Result {
+	host, _, err := net.SplitHostPort(env.RemoteAddr.String())
+	if err != nil {
+		host = env.RemoteAddr.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return spf.None
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), spfTimeout)
+	defer cancel()
+	sender := env.MailFrom.Address
+	if sender == "" {
+		sender = env.EHLO
+	}
+	return spf.Check(ctx, spfResolver, ip, env.EHLO, sender)
+}
+
+// evaluateDMARC applies the DMARC policy of the domain in the From header of
+// the message |data| to the SPF and DKIM results of |env|.
+func evaluateDMARC(data []byte, env Envelope) dmarc.Result {
+	header, _ := message.Parse(data)
+	from := header.Values("From")
+	if len(from) != 1 {
+		return dmarc.Result{Status: dmarc.StatusPermError}
+	}
+	domain, err := dmarc.FromDomain(from[0])
+	if err != nil {
+		return dmarc.Result{Status: dmarc.StatusPermError}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), spfTimeout)
+	defer cancel()
+	_, spfDomain := spfIdentity(env)
+	return dmarc.Evaluate(ctx, lookupTXT, domain, env.SPF, spfDomain, env.DKIM)
+}
+
+// writeAuthenticationResults writes an Authentication-Results header (RFC
+// 8601) for the SPF, DKIM, and DMARC results of |env| to |buf|, as
+// |authservID|.
+func writeAuthenticationResults(buf *bytes.Buffer, authservID string, env Envelope) {
+	fmt.Fprintf(buf, "Authentication-Results: %s;", authservID)
+
+	identity, domain := spfIdentity(env)
+	fmt.Fprintf(buf, "\r\n\tspf=%s smtp.%s=%s;", env.SPF, identity, domain)
+
+	if len(env.DKIM) == 0 {
+		buf.WriteString("\r\n\tdkim=none;")
+	}
+	for _, r := range env.DKIM {
+		fmt.Fprintf(buf, "\r\n\tdkim=%s", r.Status)
+		if r.Reason != "" {
+			fmt.Fprintf(buf, " reason=%q", r.Reason)
+		}
+		if r.Domain != "" {
+			fmt.Fprintf(buf, " header.d=%s", r.Domain)
+		}
+		if r.Selector != "" {
+			fmt.Fprintf(buf, " header.s=%s", r.Selector)
+		}
+		if r.Signature != "" {
+			fmt.Fprintf(buf, " header.b=%s", r.Signature)
+		}
+		buf.WriteString(";")
+	}
+
+	fmt.Fprintf(buf, "\r\n\tdmarc=%s", env.DMARC.Status)
+	if env.DMARC.Policy != "" {
+		fmt.Fprintf(buf, " (p=%s dis=%s)", env.DMARC.Policy, env.DMARC.Disposition)
+	}
+	if env.DMARC.Domain != "" {
+		fmt.Fprintf(buf, " header.from=%s", env.DMARC.Domain)
+	}
+	buf.WriteString("\r\n")
+}
+
+// removeAuthenticationResults removes the Authentication-Results headers of
+// |data| that claim to be from |authservID|, since they were forged by the
+// sender (RFC 8601 § 5).
+func removeAuthenticationResults(data []byte, authservID string) []byte {
+	header, body := message.Parse(data)
+	fields := header.Fields[:0]
+	for _, f := range header.Fields {
+		if strings.EqualFold(f.Name, "Authentication-Results") {
+			id := strings.TrimSpace(strings.SplitN(f.Value(), ";", 2)[0])
+			if strings.EqualFold(id, authservID) {
+				continue
+			}
+		}
+		fields = append(fields, f)
+	}
+	if len(fields) == len(header.Fields) {
+		return data
+	}
+	header.Fields = fields
+	return message.Join(header, body)
+}
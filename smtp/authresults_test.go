@@ -0,0 +1,134 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package smtp
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"src.bluestatic.org/mailpopbox/dkim"
+	"src.bluestatic.org/mailpopbox/dmarc"
+	"src.bluestatic.org/mailpopbox/resolver"
+	"src.bluestatic.org/mailpopbox/spf"
+)
+
+// txtResolver is an spf.Resolver that only has TXT records.
+type txtResolver struct {
+	lookup resolver.LookupTXT
+}
+
+func (r txtResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return r.lookup(ctx, name)
+}
+
+func (r txtResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r txtResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func TestAuthenticationResults(t *testing.T) {
+	defer func(l resolver.LookupTXT, r spf.Resolver) {
+		lookupTXT = l
+		spfResolver = r
+	}(lookupTXT, spfResolver)
+	records := map[string]string{
+		"sender.net":        "v=spf1 ip4:127.0.0.1 -all",
+		"_dmarc.sender.net": "v=DMARC1; p=reject",
+	}
+	var lookups []string
+	lookupTXT = func(ctx context.Context, name string) ([]string, error) {
+		if txt, ok := records[name]; ok {
+			return []string{txt}, nil
+		}
+		lookups = append(lookups, name)
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	spfResolver = txtResolver{lookupTXT}
+
+	s := &deliveryServer{testServer: testServer{domain: "example.com"}}
+	l := runServer(t, s)
+	defer l.Close()
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	send := func(data string) requestResponse {
+		return requestResponse{"DATA", 0, func(t testing.TB, conn *textproto.Conn) {
+			readCodeLine(t, conn, 354)
+			ok(t, conn.PrintfLine("%s\r\n.", data))
+			readCodeLine(t, conn, 250)
+		}}
+	}
+
+	runTableTest(t, conn, []requestResponse{
+		{"EHLO sender.net", 0, func(t testing.TB, conn *textproto.Conn) { conn.ReadResponse(250) }},
+		{"MAIL FROM:<sender@sender.net>", 250, nil},
+		{"RCPT TO:<user@example.com>", 250, nil},
+		send("From: <sender@sender.net>\r\nSubject: unsigned\r\n\r\nbody"),
+		{"MAIL FROM:<bounce@other.net>", 250, nil},
+		{"RCPT TO:<user@example.com>", 250, nil},
+		send("Authentication-Results: Test-Server; dkim=pass header.d=example.com\r\n" +
+			"Authentication-Results: gateway.net; dkim=pass\r\n" +
+			"DKIM-Signature: v=1; a=rsa-sha256; d=sender.net; s=sel; h=from;\r\n bh=AAAA; b=BBBBBBBBBBBB\r\n" +
+			"From: <sender@sender.net>\r\nSubject: signed\r\n\r\nbody"),
+	})
+
+	if want, got := 2, len(s.messages); want != got {
+		t.Fatalf("Want %d messages, got %d", want, got)
+	}
+
+	unsigned := s.messages[0]
+	if len(unsigned.DKIM) != 0 {
+		t.Errorf("Want no DKIM results, got %v", unsigned.DKIM)
+	}
+	if want, got := spf.Pass, unsigned.SPF; want != got {
+		t.Errorf("Want SPF %s, got %s", want, got)
+	}
+	if want, got := (dmarc.Result{Status: dmarc.StatusPass, Domain: "sender.net", Policy: dmarc.PolicyReject, Disposition: dmarc.PolicyNone, SPFAligned: true}), unsigned.DMARC; want != got {
+		t.Errorf("Want DMARC %+v, got %+v", want, got)
+	}
+	want := "\r\nAuthentication-Results: Test-Server;\r\n" +
+		"\tspf=pass smtp.mailfrom=sender.net;\r\n" +
+		"\tdkim=none;\r\n" +
+		"\tdmarc=pass (p=reject dis=none) header.from=sender.net\r\n"
+	if !strings.Contains(string(unsigned.Data), want) {
+		t.Errorf("Want %q in message: %q", want, unsigned.Data)
+	}
+
+	signed := s.messages[1]
+	if want, got := []string{"sel._domainkey.sender.net", "other.net"}, lookups; len(got) != 2 || want[0] != got[0] || want[1] != got[1] {
+		t.Errorf("Want lookups %v, got %v", want, got)
+	}
+	if len(signed.DKIM) != 1 || signed.DKIM[0].Status != dkim.StatusPermError {
+		t.Errorf("Want permerror result, got %v", signed.DKIM)
+	}
+	if want, got := spf.None, signed.SPF; want != got {
+		t.Errorf("Want SPF %s, got %s", want, got)
+	}
+	if want, got := dmarc.PolicyReject, signed.DMARC.Disposition; want != got {
+		t.Errorf("Want DMARC disposition %s, got %s", want, got)
+	}
+	data := string(signed.Data)
+	want = "Authentication-Results: Test-Server;\r\n" +
+		"\tspf=none smtp.mailfrom=other.net;\r\n" +
+		"\tdkim=permerror reason=\"no key for signature\" header.d=sender.net header.s=sel header.b=BBBBBBBB;\r\n" +
+		"\tdmarc=fail (p=reject dis=reject) header.from=sender.net\r\n"
+	if !strings.Contains(data, want) {
+		t.Errorf("Want %q in message: %q", want, data)
+	}
+	if strings.Contains(data, "Test-Server; dkim=pass") {
+		t.Errorf("Forged Authentication-Results was not removed: %q", data)
+	}
+	if !strings.Contains(data, "Authentication-Results: gateway.net; dkim=pass") {
+		t.Errorf("Other Authentication-Results was removed: %q", data)
+	}
+}
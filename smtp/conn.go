@@ -7,16 +7,22 @@
 package smtp
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/mail"
 	"net/textproto"
+	"strconv"
 	"strings"
 	"time"
 
-	"go.uber.org/zap"
+	"src.bluestatic.org/mailpopbox/logger"
 )
 
 type state int
@@ -29,6 +35,22 @@ const (
 	stateData
 )
 
+func (s state) String() string {
+	switch s {
+	case stateNew:
+		return "new"
+	case stateInitial:
+		return "initial"
+	case stateMail:
+		return "mail"
+	case stateRecipient:
+		return "recipient"
+	case stateData:
+		return "data"
+	}
+	return fmt.Sprintf("state(%d)", int(s))
+}
+
 type delivery int
 
 func (d delivery) String() string {
@@ -49,8 +71,111 @@ const (
 	deliverOutbound          // Mail IS from one of this server's domains.
 )
 
+// Defaults for Options, from RFC 5321 §4.5.3.1 where it specifies one.
+const (
+	DefaultMaxLineLength = 512
+	DefaultMaxCommands   = 1000
+	DefaultMaxRecipients = 100
+
+	DefaultMaxAuthAttempts = 5
+
+	DefaultMaxMessageSize = 40960000
+
+	// DefaultMaxHops is the least hop count at which RFC 5321 § 6.3 allows
+	// a message to be treated as looping.
+	DefaultMaxHops = 100
+)
+
+// maxAuthLineLength is the limit on AUTH command and response lines, from
+// RFC 4954 §4, which exceeds the limit for other commands.
+const maxAuthLineLength = 12288
+
+var errLineTooLong = errors.New("line too long")
+
+// Options configures the connections handled by AcceptConnection. Zero values
+// use the defaults.
+type Options struct {
+	// MaxLineLength is the longest command line accepted, including the CRLF.
+	MaxLineLength int
+	// MaxCommands is the number of commands after which the connection is
+	// closed.
+	MaxCommands int
+	// MaxRecipients is the number of RCPT TO addresses accepted in one
+	// transaction.
+	MaxRecipients int
+	// MaxAuthAttempts is the number of failed AUTH commands after which the
+	// connection is closed.
+	MaxAuthAttempts int
+	// MaxMessageSize is the largest message accepted, in bytes, which is
+	// advertised with the SIZE extension (RFC 1870).
+	MaxMessageSize int64
+	// MaxHops is the most Received headers a message can have, including
+	// the one added by this server. Messages with more are rejected as mail
+	// loops.
+	MaxHops int
+
+	// Submission makes the connection a message submission agent (RFC 6409),
+	// rather than an MX. It requires AUTH before MAIL, and only accepts mail
+	// from the authenticated domain, for relaying.
+	Submission bool
+
+	// RequireTLS refuses MAIL, RCPT, and DATA until the client has used
+	// STARTTLS (RFC 3207 § 4).
+	RequireTLS bool
+
+	// LMTP makes the connection a local delivery agent that speaks LMTP (RFC
+	// 2033) to an MTA in front of it, rather than an MX. The client greets
+	// with LHLO, is trusted like a relay, and all of its mail is delivered
+	// inbound, with a reply for each recipient after the message.
+	LMTP bool
+
+	// Trusted makes every client a trusted relay, for a listener that only
+	// trusted clients can reach.
+	Trusted bool
+
+	// ReceivedPrivacy, if set, hides the client of an authenticated session
+	// in the Received header of its messages, since it is often the user's
+	// home address. It is ReceivedPrivacyRedact or ReceivedPrivacyOmit.
+	ReceivedPrivacy string
+
+	// StateChanged, if set, is called with the name of the connection's
+	// protocol state each time it changes.
+	StateChanged func(state string) `json:"-"`
+}
+
+const (
+	// ReceivedPrivacyRedact replaces the client's EHLO name and address in
+	// the from clause with "redacted".
+	ReceivedPrivacyRedact = "redact"
+	// ReceivedPrivacyOmit leaves out the from clause.
+	ReceivedPrivacyOmit = "omit"
+)
+
+func (o Options) withDefaults() Options {
+	if o.MaxLineLength <= 0 {
+		o.MaxLineLength = DefaultMaxLineLength
+	}
+	if o.MaxCommands <= 0 {
+		o.MaxCommands = DefaultMaxCommands
+	}
+	if o.MaxRecipients <= 0 {
+		o.MaxRecipients = DefaultMaxRecipients
+	}
+	if o.MaxAuthAttempts <= 0 {
+		o.MaxAuthAttempts = DefaultMaxAuthAttempts
+	}
+	if o.MaxMessageSize <= 0 {
+		o.MaxMessageSize = DefaultMaxMessageSize
+	}
+	if o.MaxHops <= 0 {
+		o.MaxHops = DefaultMaxHops
+	}
+	return o
+}
+
 type connection struct {
 	server Server
+	opts   Options
 
 	tp *textproto.Conn
 
@@ -60,11 +185,14 @@ type connection struct {
 	esmtp bool
 	tls   *tls.ConnectionState
 
-	log *zap.Logger
+	log logger.Logger
 
-	// The authcid from a PLAIN SASL login. Non-empty iff tls is non-nil and
-	// doAUTH() succeeded.
+	// The authcid from a SASL login. Non-empty iff tls is non-nil and
+	// doAUTH() succeeded or the client certificate was trusted, or a trusted
+	// relay passed the login with XCLIENT.
 	authc string
+	// The number of AUTH commands that have failed.
+	authFailures int
 
 	state
 	line string
@@ -76,67 +204,165 @@ type connection struct {
 	ehlo     string
 	mailFrom *mail.Address
 	rcptTo   []mail.Address
+
+	// The SIZE parameter of MAIL, or 0 if none was given.
+	declaredSize int64
+	// The smallest MaxMessageSize of the recipients, or 0 if none has one.
+	rcptSizeLimit int64
+	// The DSN parameters of MAIL and RCPT.
+	dsn DSNParameters
+
+	// Set if the client is a trusted relay, which can use XCLIENT, and whose
+	// Received header names the origin client.
+	trusted bool
+	// Set after XCLIENT replaced the client's address. The name and HELO are
+	// those it gave, if any.
+	xclient     bool
+	xclientName string
+	xclientHelo string
+	// Set if XCLIENT gave the PROTO, so it is kept by HELO or EHLO.
+	xclientProto bool
+
+	// The message received so far with BDAT, from a pooled buffer. Non-nil
+	// iff state is stateData.
+	chunks *bytes.Buffer
 }
 
-func AcceptConnection(netConn net.Conn, server Server, log *zap.Logger) {
+func AcceptConnection(netConn net.Conn, server Server, opts Options, log logger.Logger) {
 	conn := connection{
 		server:     server,
+		opts:       opts.withDefaults(),
 		tp:         textproto.NewConn(netConn),
 		nc:         netConn,
 		remoteAddr: netConn.RemoteAddr(),
-		log:        log.With(zap.Stringer("client", netConn.RemoteAddr())),
-		state:      stateNew,
+		log:        log.With("client", netConn.RemoteAddr()),
+	}
+	conn.setState(stateNew)
+
+	if conn.opts.LMTP || conn.opts.Trusted {
+		conn.trusted = true
+	} else if checker, ok := server.(TrustedRelayChecker); ok {
+		conn.trusted = checker.IsTrustedRelay(netConn.RemoteAddr())
 	}
 
-	conn.log.Info("accepted connection")
-	conn.writeReply(220, fmt.Sprintf("%s ESMTP [%s] (mailpopbox)",
-		server.Name(), netConn.LocalAddr()))
+	conn.log.Info("accepted connection", "trusted", conn.trusted)
+	conn.greet()
+
+	// The line is read up to the AUTH limit, and then other commands are
+	// checked against the smaller limit.
+	maxRead := maxAuthLineLength
+	if conn.opts.MaxLineLength > maxRead {
+		maxRead = conn.opts.MaxLineLength
+	}
+
+	for commands := 1; ; commands++ {
+		// Replies are buffered while pipelined commands (RFC 2920) are
+		// waiting, and sent once the client has to wait for them.
+		if conn.tp.R.Buffered() == 0 {
+			conn.flush()
+		}
 
-	for {
 		var err error
-		conn.line, err = conn.tp.ReadLine()
-		if err != nil {
-			conn.log.Error("ReadLine()", zap.Error(err))
+		conn.line, err = conn.readLine(maxRead)
+		if err == errLineTooLong {
+			conn.writeReply(500, "line too long")
+			continue
+		} else if isTimeout(err) {
+			conn.timedOut()
+			conn.close()
+			return
+		} else if err != nil {
+			conn.log.Error("ReadLine()", "error", err)
 			conn.tp.Close()
 			return
 		}
 
+		if commands > conn.opts.MaxCommands {
+			conn.log.Warn("too many commands", "commands", commands)
+			conn.writeReply(421, "too many commands")
+			conn.close()
+			return
+		}
+
 		lineForLog := conn.line
-		const authPlain = "AUTH PLAIN "
-		if strings.HasPrefix(conn.line, authPlain) {
-			lineForLog = authPlain + "[redacted]"
+		if fields := strings.Fields(conn.line); len(fields) > 2 && strings.EqualFold(fields[0], "AUTH") {
+			lineForLog = fields[0] + " " + fields[1] + " [redacted]"
 		}
-		conn.log.Info("ReadLine()", zap.String("line", lineForLog))
+		conn.log.Info("ReadLine()", "line", lineForLog)
 
 		var cmd string
 		if _, err = fmt.Sscanf(conn.line, "%s", &cmd); err != nil {
 			conn.reply(ReplyBadSyntax)
 			continue
 		}
+		cmd = strings.ToUpper(cmd)
+
+		if len(conn.line)+2 > conn.opts.MaxLineLength && cmd != "AUTH" {
+			conn.writeReply(500, "line too long")
+			continue
+		}
+
+		switch cmd {
+		case "MAIL", "RCPT", "DATA":
+			if conn.opts.RequireTLS && conn.tls == nil {
+				conn.reply(replyTLSRequired)
+				continue
+			}
+		case "HELO", "EHLO":
+			if conn.opts.LMTP {
+				conn.reply(replyUseLHLO)
+				continue
+			}
+		case "LHLO":
+			if !conn.opts.LMTP {
+				conn.writeReply(500, "unrecognized command")
+				continue
+			}
+		}
 
-		switch strings.ToUpper(cmd) {
+		switch cmd {
 		case "QUIT":
 			conn.writeReply(221, "Goodbye")
-			conn.tp.Close()
+			conn.close()
 			return
 		case "HELO":
-			conn.esmtp = false
+			if !conn.xclientProto {
+				conn.esmtp = false
+			}
 			fallthrough
-		case "EHLO":
-			conn.esmtp = true
+		case "EHLO", "LHLO":
+			if !conn.xclientProto {
+				conn.esmtp = true
+			}
 			conn.doEHLO()
 		case "STARTTLS":
 			conn.doSTARTTLS()
 		case "AUTH":
-			conn.doAUTH()
+			if !conn.doAUTH() {
+				conn.close()
+				return
+			}
 		case "MAIL":
 			conn.doMAIL()
 		case "RCPT":
-			conn.doRCPT()
+			if !conn.doRCPT() {
+				conn.close()
+				return
+			}
 		case "DATA":
-			conn.doDATA()
+			if !conn.doDATA() {
+				conn.close()
+				return
+			}
+		case "BDAT":
+			if !conn.doBDAT() {
+				conn.close()
+				return
+			}
 		case "RSET":
 			conn.doRSET()
+		case "XCLIENT":
+			conn.doXCLIENT()
 		case "VRFY":
 			conn.writeReply(252, "I'll do my best")
 		case "EXPN":
@@ -151,26 +377,99 @@ func AcceptConnection(netConn net.Conn, server Server, log *zap.Logger) {
 	}
 }
 
+// readLine reads the next line from the client, without the line ending. If
+// the line, including the CRLF, is longer than |max| bytes, the rest of it is
+// discarded and errLineTooLong is returned.
+func (conn *connection) readLine(max int) (string, error) {
+	return readLimitedLine(conn.tp.R, max-2)
+}
+
+// isTimeout reports whether |err| is from a read that passed the deadline
+// set by the listener.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// timedOut tells the client that it is being disconnected for being idle
+// (RFC 5321 § 4.5.3.2).
+func (conn *connection) timedOut() {
+	conn.log.Info("connection timed out")
+	conn.writeReply(421, fmt.Sprintf("4.4.2 %s timeout, closing connection", conn.server.Name()))
+}
+
+func readLimitedLine(r *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		chunk, more, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		if len(line)+len(chunk) > max {
+			for more {
+				if _, more, err = r.ReadLine(); err != nil {
+					return "", err
+				}
+			}
+			return "", errLineTooLong
+		}
+		line = append(line, chunk...)
+		if !more {
+			return string(line), nil
+		}
+	}
+}
+
 func (conn *connection) reply(reply ReplyLine) error {
 	return conn.writeReply(reply.Code, reply.Message)
 }
 
+// writeReply buffers a reply, which is sent by the next flush.
 func (conn *connection) writeReply(code int, msg string) error {
-	conn.log.Info("writeReply", zap.Int("code", code))
+	conn.log.Info("writeReply", "code", code)
 	var err error
 	if len(msg) > 0 {
-		err = conn.tp.PrintfLine("%d %s", code, msg)
+		_, err = fmt.Fprintf(conn.tp.W, "%d %s\r\n", code, msg)
 	} else {
-		err = conn.tp.PrintfLine("%d", code)
+		_, err = fmt.Fprintf(conn.tp.W, "%d\r\n", code)
 	}
 	if err != nil {
 		conn.log.Error("writeReply",
-			zap.Int("code", code),
-			zap.Error(err))
+			"code", code,
+			"error", err)
 	}
 	return err
 }
 
+// flush sends the buffered replies.
+func (conn *connection) flush() error {
+	err := conn.tp.W.Flush()
+	if err != nil {
+		conn.log.Error("flush", "error", err)
+	}
+	return err
+}
+
+// close sends the buffered replies and closes the connection.
+func (conn *connection) close() {
+	conn.flush()
+	conn.tp.Close()
+}
+
+var replyTLSRequired = ReplyLine{530, "5.7.0 Must issue a STARTTLS command first"}
+
+var replyMessageTooBig = ReplyLine{552, "5.3.4 message size exceeds fixed maximum message size"}
+
+// sizeParameter returns the value of the SIZE parameter of a MAIL command
+// (RFC 1870), or 0 if there is none.
+func sizeParameter(line string) (int64, error) {
+	size, ok := pathParameter(line, "SIZE")
+	if !ok {
+		return 0, nil
+	}
+	return strconv.ParseInt(size, 10, 64)
+}
+
 // parsePath parses out either a forward-, reverse-, or return-path from the
 // current connection line. Returns a (valid-path, ReplyOK) if it was
 // successfully parsed.
@@ -181,7 +480,8 @@ func (conn *connection) parsePath(command string) (string, ReplyLine) {
 	if strings.ToUpper(command) != strings.ToUpper(conn.line[:len(command)]) {
 		return "", ReplyLine{500, "unrecognized command"}
 	}
-	params := conn.line[len(command):]
+	// Some clients put a space before the path, like "MAIL FROM: <>".
+	params := strings.TrimLeft(conn.line[len(command):], " ")
 	idx := strings.Index(params, ">")
 	if idx == -1 {
 		return "", ReplyBadSyntax
@@ -189,32 +489,56 @@ func (conn *connection) parsePath(command string) (string, ReplyLine) {
 	return strings.ToLower(params[:idx+1]), ReplyOK
 }
 
+// greet sends the 220 greeting that starts a session.
+func (conn *connection) greet() {
+	protocol := "ESMTP"
+	if conn.opts.LMTP {
+		protocol = "LMTP"
+	}
+	conn.writeReply(220, fmt.Sprintf("%s %s [%s] (mailpopbox)",
+		conn.server.Name(), protocol, conn.nc.LocalAddr()))
+}
+
 func (conn *connection) doEHLO() {
 	conn.resetBuffers()
 
-	var cmd string
-	_, err := fmt.Sscanf(conn.line, "%s %s", &cmd, &conn.ehlo)
+	var cmd, ehlo string
+	_, err := fmt.Sscanf(conn.line, "%s %s", &cmd, &ehlo)
 	if err != nil {
 		conn.reply(ReplyBadSyntax)
 		return
 	}
+	// A HELO name from XCLIENT is the origin client's, so it is kept.
+	if conn.xclientHelo == "" {
+		conn.ehlo = ehlo
+	}
 
 	if cmd == "HELO" {
 		conn.writeReply(250, fmt.Sprintf("Hello %s [%s]", conn.ehlo, conn.remoteAddr))
 	} else {
 		conn.tp.PrintfLine("250-Hello %s [%s]", conn.ehlo, conn.remoteAddr)
-		if conn.server.TLSConfig() != nil && conn.tls == nil {
+		conn.tp.PrintfLine("250-PIPELINING")
+		if conn.server.TLSConfig() != nil && conn.tls == nil && !conn.opts.LMTP {
 			conn.tp.PrintfLine("250-STARTTLS")
 		}
-		if conn.tls != nil {
-			conn.tp.PrintfLine("250-AUTH PLAIN")
+		if conn.tls != nil && !conn.opts.LMTP {
+			if _, ok := conn.server.(TokenAuthenticator); ok {
+				conn.tp.PrintfLine("250-AUTH PLAIN XOAUTH2 OAUTHBEARER")
+			} else {
+				conn.tp.PrintfLine("250-AUTH PLAIN")
+			}
+		}
+		if conn.trusted {
+			conn.tp.PrintfLine("250-XCLIENT ADDR PORT NAME HELO LOGIN PROTO")
 		}
-		conn.tp.PrintfLine("250 SIZE %d", 40960000)
+		conn.tp.PrintfLine("250-CHUNKING")
+		conn.tp.PrintfLine("250-DSN")
+		conn.tp.PrintfLine("250 SIZE %d", conn.advertisedSize())
 	}
 
-	conn.log.Info("doEHLO()", zap.String("ehlo", conn.ehlo))
+	conn.log.Info("doEHLO()", "ehlo", conn.ehlo)
 
-	conn.state = stateInitial
+	conn.setState(stateInitial)
 }
 
 func (conn *connection) doSTARTTLS() {
@@ -231,87 +555,166 @@ func (conn *connection) doSTARTTLS() {
 
 	conn.log.Info("doSTARTTLS()")
 	conn.writeReply(220, "initiate TLS connection")
+	if conn.flush() != nil {
+		return
+	}
 
 	tlsConn := tls.Server(conn.nc, tlsConfig)
 	if err := tlsConn.Handshake(); err != nil {
-		conn.log.Error("failed to do TLS handshake", zap.Error(err))
+		conn.log.Error("failed to do TLS handshake", "error", err)
 		return
 	}
 
 	conn.nc = tlsConn
 	conn.tp = textproto.NewConn(tlsConn)
-	conn.state = stateNew
+	conn.setState(stateNew)
 
 	connState := tlsConn.ConnectionState()
 	conn.tls = &connState
 
-	conn.log.Info("TLS connection done", zap.String("state", conn.getTransportString()))
+	conn.log.Info("TLS connection done", "state", newTLSInfo(conn.tls))
+
+	if certAuth, ok := conn.server.(CertificateAuthenticator); ok && len(connState.PeerCertificates) > 0 {
+		if authc := certAuth.CertificateAuthenticate(connState); authc != "" {
+			conn.log.Info("authenticated by client certificate", "authc", authc)
+			conn.authc = authc
+		}
+	}
 }
 
-func (conn *connection) doAUTH() {
+// doAUTH handles the AUTH command, per RFC 4954. It returns false if the
+// connection should be closed.
+func (conn *connection) doAUTH() bool {
 	if conn.state != stateInitial || conn.tls == nil {
 		conn.reply(ReplyBadSequence)
-		return
+		return true
 	}
 
 	if conn.authc != "" {
 		conn.writeReply(503, "already authenticated")
-		return
+		return true
 	}
 
-	var cmd, authType, authString string
-	n, err := fmt.Sscanf(conn.line, "%s %s %s", &cmd, &authType, &authString)
-	if n < 2 {
+	fields := strings.Fields(conn.line)
+	if len(fields) < 2 || len(fields) > 3 {
 		conn.reply(ReplyBadSyntax)
-		return
+		return true
 	}
 
-	if authType != "PLAIN" {
+	mechanism := strings.ToUpper(fields[1])
+	tokenAuth, _ := conn.server.(TokenAuthenticator)
+	switch mechanism {
+	case "PLAIN":
+	case "XOAUTH2", "OAUTHBEARER":
+		if tokenAuth == nil {
+			conn.writeReply(504, "unrecognized auth type")
+			return true
+		}
+	default:
 		conn.writeReply(504, "unrecognized auth type")
-		return
+		return true
 	}
 
-	// If only 2 tokens were scanned, then an initial response was not provided.
-	if n == 2 && conn.line[len(conn.line)-1] != ' ' {
-		conn.reply(ReplyBadSyntax)
-		return
+	conn.log.Info("doAUTH()", "mechanism", mechanism)
+
+	var authString string
+	if len(fields) == 3 {
+		authString = fields[2]
+		// An initial response of "=" is an empty response.
+		if authString == "=" {
+			authString = ""
+		}
+	} else {
+		// The first challenge for every mechanism is empty, which is just the
+		// space after the code.
+		var ok bool
+		if authString, ok = conn.readAuthResponse(""); !ok {
+			return false
+		}
+		if authString == "*" {
+			conn.log.Info("auth cancelled")
+			return conn.authFailed(ReplyLine{501, "authentication cancelled"})
+		}
 	}
 
-	conn.log.Info("doAUTH()")
+	authBytes, err := base64.StdEncoding.DecodeString(authString)
+	if err != nil {
+		return conn.authFailed(ReplyBadSyntax)
+	}
 
-	if authString == "" {
-		conn.writeReply(334, " ")
+	var authz, authc string
+	if mechanism == "PLAIN" {
+		authParts := strings.Split(string(authBytes), "\x00")
+		if len(authParts) != 3 {
+			conn.log.Error("bad auth line syntax")
+			return conn.authFailed(ReplyBadSyntax)
+		}
 
-		authString, err = conn.tp.ReadLine()
+		authz, authc = authParts[0], authParts[1]
+		if !conn.server.Authenticate(authz, authc, authParts[2]) {
+			conn.log.Error("failed to authenticate", "authc", authc)
+			return conn.authFailed(ReplyLine{535, "invalid credentials"})
+		}
+	} else {
+		user, token, err := parseBearerResponse(mechanism, string(authBytes))
 		if err != nil {
-			conn.log.Error("failed to read auth line", zap.Error(err))
-			conn.reply(ReplyBadSyntax)
-			return
+			conn.log.Error("bad auth line syntax", "error", err)
+			return conn.authFailed(ReplyBadSyntax)
 		}
-	}
 
-	authBytes, err := base64.StdEncoding.DecodeString(authString)
-	if err != nil {
-		conn.reply(ReplyBadSyntax)
-		return
+		authc = user
+		if !tokenAuth.AuthenticateToken(user, token) {
+			conn.log.Error("failed to authenticate", "authc", authc)
+			// RFC 7628 §3.2.2: the failure is sent as a challenge, which the
+			// client answers before getting the final reply.
+			if _, ok := conn.readAuthResponse(bearerErrorChallenge); !ok {
+				return false
+			}
+			return conn.authFailed(ReplyLine{535, "invalid credentials"})
+		}
 	}
 
-	authParts := strings.Split(string(authBytes), "\x00")
-	if len(authParts) != 3 {
-		conn.log.Error("bad auth line syntax")
-		conn.reply(ReplyBadSyntax)
-		return
+	conn.log.Info("authenticated", "authz", authz, "authc", authc)
+	conn.authc = authc
+	conn.reply(ReplyAuthOK)
+	return true
+}
+
+// readAuthResponse sends an AUTH |challenge|, which is already base64
+// encoded, and reads the client's response. It returns false if the
+// connection should be closed.
+func (conn *connection) readAuthResponse(challenge string) (string, bool) {
+	if err := conn.tp.PrintfLine("334 %s", challenge); err != nil {
+		conn.log.Error("writeReply", "code", 334, "error", err)
+		return "", false
 	}
 
-	if !conn.server.Authenticate(authParts[0], authParts[1], authParts[2]) {
-		conn.log.Error("failed to authenticate", zap.String("authc", authParts[1]))
-		conn.writeReply(535, "invalid credentials")
-		return
+	response, err := conn.readLine(maxAuthLineLength)
+	if err == errLineTooLong {
+		// Treat it like a malformed response, rather than dropping the client.
+		return "", true
+	} else if isTimeout(err) {
+		conn.timedOut()
+		return "", false
+	} else if err != nil {
+		conn.log.Error("failed to read auth line", "error", err)
+		return "", false
 	}
+	return response, true
+}
 
-	conn.log.Info("authenticated", zap.String("authz", authParts[0]), zap.String("authc", authParts[1]))
-	conn.authc = authParts[1]
-	conn.reply(ReplyAuthOK)
+// authFailed counts a failed AUTH command and sends |reply|, unless that was
+// the last allowed attempt. It returns false if the connection should be
+// closed.
+func (conn *connection) authFailed(reply ReplyLine) bool {
+	conn.authFailures++
+	if conn.authFailures >= conn.opts.MaxAuthAttempts {
+		conn.log.Warn("too many auth failures", "failures", conn.authFailures)
+		conn.writeReply(421, "too many authentication failures")
+		return false
+	}
+	conn.reply(reply)
+	return true
 }
 
 func (conn *connection) doMAIL() {
@@ -320,89 +723,303 @@ func (conn *connection) doMAIL() {
 		return
 	}
 
+	if conn.opts.Submission && conn.authc == "" {
+		conn.writeReply(530, "5.7.0 authentication required")
+		return
+	}
+
 	mailFrom, reply := conn.parsePath("MAIL FROM:")
 	if reply != ReplyOK {
 		conn.reply(reply)
 		return
 	}
 
-	var err error
-	conn.mailFrom, err = mail.ParseAddress(mailFrom)
-	if err != nil || conn.mailFrom == nil {
+	size, err := sizeParameter(conn.line)
+	if err != nil {
 		conn.reply(ReplyBadSyntax)
 		return
 	}
+	if size > conn.opts.MaxMessageSize {
+		conn.reply(replyMessageTooBig)
+		return
+	}
+
+	dsn, reply := mailDSNParameters(conn.line)
+	if reply != ReplyOK {
+		conn.reply(reply)
+		return
+	}
 
-	if conn.server.VerifyAddress(*conn.mailFrom) == ReplyOK {
+	if mailFrom == "<>" {
+		// The null reverse-path, used by delivery status notifications.
+		conn.mailFrom = &mail.Address{}
+	} else {
+		conn.mailFrom, err = mail.ParseAddress(mailFrom)
+		if err != nil || conn.mailFrom == nil {
+			conn.reply(ReplyBadSyntax)
+			return
+		}
+	}
+
+	if conn.opts.LMTP {
+		// The MTA has already decided that the message is for local
+		// delivery, even if it is from one of the server's domains.
+		conn.delivery = deliverInbound
+	} else if conn.server.VerifyAddress(*conn.mailFrom) == ReplyOK {
 		if DomainForAddress(*conn.mailFrom) != DomainForAddressString(conn.authc) {
 			conn.writeReply(550, "not authenticated")
 			return
 		}
 		conn.delivery = deliverOutbound
+	} else if conn.opts.Submission {
+		conn.reply(ReplyMailboxUnallowed)
+		return
 	} else {
 		conn.delivery = deliverInbound
 	}
 
-	conn.log.Info("doMAIL()", zap.String("address", conn.mailFrom.Address))
+	conn.log.Info("doMAIL()", "address", conn.mailFrom.Address)
 
-	conn.state = stateMail
+	conn.declaredSize = size
+	conn.dsn = dsn
+	conn.setState(stateMail)
 	conn.reply(ReplyOK)
 }
 
-func (conn *connection) doRCPT() {
+// doRCPT handles the RCPT command. It returns false if the connection should
+// be closed.
+func (conn *connection) doRCPT() bool {
 	if conn.state != stateMail && conn.state != stateRecipient {
 		conn.reply(ReplyBadSequence)
-		return
+		return true
+	}
+
+	if len(conn.rcptTo) >= conn.opts.MaxRecipients {
+		conn.writeReply(452, "too many recipients")
+		return true
 	}
 
 	rcptTo, reply := conn.parsePath("RCPT TO:")
 	if reply != ReplyOK {
 		conn.reply(reply)
-		return
+		return true
 	}
 
 	address, err := mail.ParseAddress(rcptTo)
 	if err != nil {
 		conn.reply(ReplyBadSyntax)
-		return
+		return true
+	}
+
+	notify, reply := notifyParameter(conn.line)
+	if reply != ReplyOK {
+		conn.reply(reply)
+		return true
 	}
 
 	if reply := conn.server.VerifyAddress(*address); reply != ReplyOK && conn.delivery == deliverInbound {
 		conn.log.Warn("invalid address",
-			zap.String("address", address.Address),
-			zap.Stringer("reply", reply))
+			"address", address.Address,
+			"reply", reply)
+		if reporter, ok := conn.server.(InvalidRecipientReporter); ok && reporter.InvalidRecipient(conn.remoteAddr, *address) {
+			conn.log.Warn("disconnecting client for invalid recipients")
+			conn.writeReply(421, "4.7.0 too many invalid recipients")
+			return false
+		}
 		conn.reply(reply)
-		return
+		return true
+	}
+
+	if limiter, ok := conn.server.(MessageSizeLimiter); ok {
+		if limit := limiter.MaxMessageSize(*address); limit > 0 {
+			if conn.declaredSize > limit {
+				conn.writeReply(552, "5.3.4 message too big for recipient")
+				return true
+			}
+			if conn.rcptSizeLimit == 0 || limit < conn.rcptSizeLimit {
+				conn.rcptSizeLimit = limit
+			}
+		}
 	}
 
 	conn.log.Info("doRCPT()",
-		zap.String("address", address.Address),
-		zap.String("delivery", conn.delivery.String()))
+		"address", address.Address,
+		"delivery", conn.delivery.String())
 
 	conn.rcptTo = append(conn.rcptTo, *address)
+	if notify != nil {
+		if conn.dsn.Notify == nil {
+			conn.dsn.Notify = make(map[string][]string)
+		}
+		conn.dsn.Notify[address.Address] = notify
+	}
 
-	conn.state = stateRecipient
+	conn.setState(stateRecipient)
 	conn.reply(ReplyOK)
+	return true
 }
 
-func (conn *connection) doDATA() {
+// doDATA handles the DATA command. It returns false if the connection
+// should be closed.
+func (conn *connection) doDATA() bool {
 	if conn.state != stateRecipient {
 		conn.reply(ReplyBadSequence)
-		return
+		return true
 	}
 
 	conn.writeReply(354, "Start mail input; end with <CRLF>.<CRLF>")
+	conn.flush()
 	conn.log.Info("doDATA()")
 
-	data, err := conn.tp.ReadDotBytes()
-	if err != nil {
-		conn.log.Error("failed to ReadDotBytes()",
-			zap.Error(err),
-			zap.String("bytes", fmt.Sprintf("%x", data)))
+	// Read the message into a pooled buffer, rather than letting
+	// ReadDotBytes grow a new one, so the only allocation that outlives the
+	// transaction is the final Envelope.Data.
+	limit := conn.messageSizeLimit()
+
+	data := getBuffer()
+	defer putBuffer(data)
+	dr := conn.tp.DotReader()
+	if _, err := data.ReadFrom(io.LimitReader(dr, limit+1)); isTimeout(err) {
+		conn.timedOut()
+		return false
+	} else if err != nil {
+		conn.log.Error("failed to read DATA",
+			"error", err,
+			"bytes", fmt.Sprintf("%x", data.Bytes()))
 		conn.writeReply(552, "transaction failed")
-		return
+		return true
+	}
+	if int64(data.Len()) > limit {
+		// Read the rest of the message so the connection can continue.
+		if _, err := io.Copy(ioutil.Discard, dr); isTimeout(err) {
+			conn.timedOut()
+			return false
+		} else if err != nil {
+			conn.log.Error("failed to read DATA", "error", err)
+		}
+		conn.log.Warn("message too big", "limit", limit)
+		conn.setState(stateInitial)
+		conn.resetBuffers()
+		conn.reply(replyMessageTooBig)
+		return true
 	}
 
+	conn.deliverMessage(data.Bytes())
+	return true
+}
+
+// doBDAT handles a chunk of the message with the CHUNKING extension (RFC
+// 3030). The chunks are gathered until the LAST one, and then the message is
+// delivered as with DATA. It returns false if the connection should be
+// closed.
+func (conn *connection) doBDAT() bool {
+	fields := strings.Fields(conn.line)
+	if len(fields) < 2 || len(fields) > 3 {
+		conn.reply(ReplyBadSyntax)
+		return true
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		conn.reply(ReplyBadSyntax)
+		return true
+	}
+	last := len(fields) == 3
+	if last && !strings.EqualFold(fields[2], "LAST") {
+		conn.reply(ReplyBadSyntax)
+		return true
+	}
+
+	// The chunk follows the command regardless of the reply, so it must be
+	// read for the connection to continue.
+	if conn.state != stateRecipient && conn.state != stateData {
+		conn.discardChunk(size)
+		conn.reply(ReplyBadSequence)
+		return true
+	}
+
+	if conn.chunks == nil {
+		conn.chunks = getBuffer()
+	}
+	// The size is compared to what is left, since a sum could overflow.
+	limit := conn.messageSizeLimit()
+	if size > limit-int64(conn.chunks.Len()) {
+		conn.discardChunk(size)
+		conn.log.Warn("message too big", "limit", limit)
+		conn.setState(stateInitial)
+		conn.resetBuffers()
+		conn.reply(replyMessageTooBig)
+		return true
+	}
+	if _, err := io.CopyN(conn.chunks, conn.tp.R, size); isTimeout(err) {
+		conn.timedOut()
+		return false
+	} else if err != nil {
+		conn.log.Error("failed to read BDAT", "error", err)
+		conn.setState(stateInitial)
+		conn.resetBuffers()
+		conn.writeReply(552, "transaction failed")
+		return true
+	}
+	conn.setState(stateData)
+
+	if !last {
+		conn.writeReply(250, fmt.Sprintf("2.0.0 %d octets received", size))
+		return true
+	}
+
+	conn.log.Info("doBDAT()", "bytes", conn.chunks.Len())
+
+	// Store the message with the same line endings as one read by the
+	// DotReader for DATA.
+	data := bytes.ReplaceAll(conn.chunks.Bytes(), []byte("\r\n"), []byte("\n"))
+	conn.deliverMessage(data)
+
+	// Unlike DATA, a rejected message ends the transaction, since the client
+	// cannot send more chunks (RFC 3030 § 2).
+	if conn.state == stateData {
+		conn.setState(stateInitial)
+		conn.resetBuffers()
+	}
+	return true
+}
+
+// discardChunk reads and discards a BDAT chunk of |size| bytes.
+func (conn *connection) discardChunk(size int64) {
+	if _, err := io.CopyN(ioutil.Discard, conn.tp.R, size); err != nil {
+		conn.log.Error("failed to read BDAT", "error", err)
+	}
+}
+
+// advertisedSize returns the SIZE to advertise in EHLO. Submission and
+// authenticated clients may send to any recipient, so they are given
+// Options.MaxMessageSize. Other clients deliver inbound mail, so they are
+// given the largest size that the Server's recipients can receive.
+func (conn *connection) advertisedSize() int64 {
+	limit := conn.opts.MaxMessageSize
+	if conn.opts.Submission || conn.authc != "" {
+		return limit
+	}
+	if limiter, ok := conn.server.(InboundSizeLimiter); ok {
+		if inbound := limiter.MaxInboundMessageSize(); inbound > 0 && inbound < limit {
+			limit = inbound
+		}
+	}
+	return limit
+}
+
+// messageSizeLimit returns the largest message that can be accepted for the
+// current recipients.
+func (conn *connection) messageSizeLimit() int64 {
+	limit := conn.opts.MaxMessageSize
+	if conn.rcptSizeLimit > 0 && conn.rcptSizeLimit < limit {
+		limit = conn.rcptSizeLimit
+	}
+	return limit
+}
+
+// deliverMessage adds the trace headers to the message |data| and delivers or
+// relays it, replying to the client. The data is copied into the Envelope.
+func (conn *connection) deliverMessage(data []byte) {
 	received := time.Now()
 	env := Envelope{
 		RemoteAddr: conn.remoteAddr,
@@ -410,23 +1027,82 @@ func (conn *connection) doDATA() {
 		MailFrom:   *conn.mailFrom,
 		RcptTo:     conn.rcptTo,
 		Received:   received,
-		ID:         generateEnvelopeId("m", received),
-		Data:       data,
+		ID:         GenerateEnvelopeId("m", received),
+		TLS:        newTLSInfo(conn.tls),
+		DSN:        conn.dsn,
 	}
 
 	conn.log.Info("received message",
-		zap.Int("bytes", len(data)),
-		zap.Time("date", received),
-		zap.String("id", env.ID),
-		zap.String("delivery", conn.delivery.String()))
+		"bytes", len(data),
+		"date", received,
+		"id", env.ID,
+		"delivery", conn.delivery.String())
+
+	// The trace header this server adds is a hop too.
+	if hops := countHops(data) + 1; hops > conn.opts.MaxHops {
+		conn.log.Warn("too many hops", "id", env.ID, "hops", hops, "limit", conn.opts.MaxHops)
+		conn.setState(stateInitial)
+		conn.resetBuffers()
+		// LMTP replies for each recipient.
+		replies := 1
+		if conn.opts.LMTP {
+			replies = len(env.RcptTo)
+		}
+		for i := 0; i < replies; i++ {
+			conn.reply(ReplyMailLoop)
+		}
+		return
+	}
+
+	// For a trusted relay that did not use XCLIENT, the origin client is the
+	// one in the Received header the relay added.
+	if conn.trusted && !conn.xclient {
+		if helo, ip := receivedOrigin(data); ip != nil {
+			env.EHLO = helo
+			env.RemoteAddr = &net.TCPAddr{IP: ip}
+			conn.log.Info("origin from Received header",
+				"id", env.ID,
+				"origin", env.RemoteAddr,
+				"helo", helo)
+		}
+	}
 
-	trace := conn.getReceivedInfo(env)
+	check, rdns := checkHelo(env.EHLO, env.RemoteAddr)
+	env.HeloCheck = check
 
-	env.Data = append(trace, env.Data...)
+	if conn.delivery == deliverInbound {
+		data = removeAuthenticationResults(data, conn.server.Name())
+		env.DKIM = verifyDKIM(data, received)
+		env.SPF = checkSPF(env)
+		env.DMARC = evaluateDMARC(data, env)
+		conn.log.Info("authenticated message",
+			"id", env.ID,
+			"spf", string(env.SPF),
+			"dkim-signatures", len(env.DKIM),
+			"dmarc", string(env.DMARC.Status),
+			"dmarc-disposition", string(env.DMARC.Disposition))
+	}
+
+	trace := getBuffer()
+	defer putBuffer(trace)
+	conn.writeReceivedInfo(trace, env)
+	if conn.delivery == deliverInbound {
+		writeAuthenticationResults(trace, conn.server.Name(), env)
+		fmt.Fprintf(trace, "X-Mailpopbox-Helo-Check: %s (helo=%s; rdns=%s)\r\n", check, env.EHLO, rdns)
+	}
+
+	env.Data = make([]byte, 0, trace.Len()+len(data))
+	env.Data = append(env.Data, trace.Bytes()...)
+	env.Data = append(env.Data, data...)
+
+	if conn.opts.LMTP {
+		conn.deliverLMTP(env)
+		return
+	}
 
 	if conn.delivery == deliverInbound {
 		if reply := conn.server.DeliverMessage(env); reply != nil {
-			conn.log.Warn("message was rejected", zap.String("id", env.ID))
+			conn.log.Warn("message was rejected", "id", env.ID)
 			conn.reply(*reply)
 			return
 		}
@@ -434,78 +1110,195 @@ func (conn *connection) doDATA() {
 		conn.server.RelayMessage(env, conn.authc)
 	}
 
-	conn.state = stateInitial
+	conn.setState(stateInitial)
 	conn.resetBuffers()
 	conn.reply(ReplyOK)
 }
 
 func (conn *connection) getReceivedInfo(envelope Envelope) []byte {
-	base := fmt.Sprintf("Received: from %s (%s)\r\n        ", conn.ehlo, lookupRemoteHost(conn.remoteAddr))
+	var buf bytes.Buffer
+	conn.writeReceivedInfo(&buf, envelope)
+	return buf.Bytes()
+}
 
+// writeReceivedInfo writes the Received trace header (RFC 5321 § 4.4) for
+// |envelope| to |buf|. Each clause is on its own line, and lines that are too
+// long are folded at their spaces. For an authenticated client, the from
+// clause follows Options.ReceivedPrivacy.
+func (conn *connection) writeReceivedInfo(buf *bytes.Buffer, envelope Envelope) {
+	// The protocol types are registered by RFC 3848.
 	with := "SMTP"
 	if conn.esmtp {
-		with = "E" + with
-	}
-	if conn.tls != nil {
-		with += "S"
+		with = "ESMTP"
+		if conn.opts.LMTP {
+			with = "LMTP"
+		}
+		if envelope.TLS != nil {
+			with += "S"
+		}
+		if conn.authc != "" {
+			with += "A"
+		}
 	}
-	base += fmt.Sprintf("by %s (mailpopbox) with %s id %s\r\n        ", conn.server.Name(), with, envelope.ID)
 
+	privacy := ""
+	if conn.authc != "" {
+		privacy = conn.opts.ReceivedPrivacy
+	}
+	var clauses []string
+	switch privacy {
+	case ReceivedPrivacyRedact:
+		clauses = append(clauses, "from redacted (redacted)")
+	case ReceivedPrivacyOmit:
+		// The header starts with the by clause instead.
+	default:
+		clauses = append(clauses, conn.receivedFrom())
+	}
+	clauses = append(clauses, fmt.Sprintf("by %s (mailpopbox) with %s id %s", conn.server.Name(), with, envelope.ID))
 	if len(envelope.RcptTo) > 0 {
-		base += fmt.Sprintf("for <%s>\r\n        ", envelope.RcptTo[0].Address)
-	}
-
-	transport := conn.getTransportString()
-	date := envelope.Received.Format(time.RFC1123Z) // Same as RFC 5322 § 3.3
-	base += fmt.Sprintf("(using %s);\r\n        %s\r\n", transport, date)
-
-	return []byte(base)
-}
-
-func (conn *connection) getTransportString() string {
-	if conn.tls == nil {
-		return "PLAINTEXT"
-	}
-
-	ciphers := map[uint16]string{
-		tls.TLS_RSA_WITH_RC4_128_SHA:                      "TLS_RSA_WITH_RC4_128_SHA",
-		tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA:                 "TLS_RSA_WITH_3DES_EDE_CBC_SHA",
-		tls.TLS_RSA_WITH_AES_128_CBC_SHA:                  "TLS_RSA_WITH_AES_128_CBC_SHA",
-		tls.TLS_RSA_WITH_AES_256_CBC_SHA:                  "TLS_RSA_WITH_AES_256_CBC_SHA",
-		tls.TLS_RSA_WITH_AES_128_CBC_SHA256:               "TLS_RSA_WITH_AES_128_CBC_SHA256",
-		tls.TLS_RSA_WITH_AES_128_GCM_SHA256:               "TLS_RSA_WITH_AES_128_GCM_SHA256",
-		tls.TLS_RSA_WITH_AES_256_GCM_SHA384:               "TLS_RSA_WITH_AES_256_GCM_SHA384",
-		tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA:              "TLS_ECDHE_ECDSA_WITH_RC4_128_SHA",
-		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:          "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
-		tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:          "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
-		tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA:                "TLS_ECDHE_RSA_WITH_RC4_128_SHA",
-		tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA:           "TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA",
-		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:            "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
-		tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:            "TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
-		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256:       "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256",
-		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256:         "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256",
-		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:         "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
-		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256:       "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
-		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:         "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
-		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384:       "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
-		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256:   "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
-		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256: "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
-		tls.TLS_AES_128_GCM_SHA256:                        "TLS_AES_128_GCM_SHA256",
-		tls.TLS_AES_256_GCM_SHA384:                        "TLS_AES_256_GCM_SHA384",
-		tls.TLS_CHACHA20_POLY1305_SHA256:                  "TLS_CHACHA20_POLY1305_SHA256",
-	}
-	versions := map[uint16]string{
-		tls.VersionSSL30: "SSLv3.0",
-		tls.VersionTLS10: "TLSv1.0",
-		tls.VersionTLS11: "TLSv1.1",
-		tls.VersionTLS12: "TLSv1.2",
-		tls.VersionTLS13: "TLSv1.3",
-	}
-
-	state := conn.tls
-
-	version := versions[state.Version]
-	cipher := ciphers[state.CipherSuite]
+		clauses = append(clauses, fmt.Sprintf("for <%s>", receivedToken(envelope.RcptTo[0].Address)))
+	}
+	clauses = append(clauses, "(using "+receivedComment(envelope.TLS.String())+");",
+		envelope.Received.Format(time.RFC1123Z)) // Same as RFC 5322 § 3.3
+
+	buf.WriteString("Received: ")
+	for i, clause := range clauses {
+		width := len("Received: ")
+		if i > 0 {
+			buf.WriteString("\r\n\t")
+			width = 1
+		}
+		writeFolded(buf, clause, width)
+	}
+	buf.WriteString("\r\n")
+}
+
+// receivedFrom returns the from clause of the Received header, which names
+// the client by its EHLO and address.
+func (conn *connection) receivedFrom() string {
+	// A client on a unix socket has no address to name.
+	tcpInfo := "localhost"
+	if conn.remoteAddr.Network() != "unix" {
+		ip, _, err := net.SplitHostPort(conn.remoteAddr.String())
+		if err != nil {
+			ip = conn.remoteAddr.String()
+		}
+		rhost := conn.xclientName
+		if rhost == "" {
+			rhost = defaultReverseResolver.LookupAddr(ip)
+		}
+		tcpInfo = addressLiteral(ip)
+		if rhost != "" {
+			tcpInfo = receivedToken(rhost) + " " + tcpInfo
+		}
+	}
+	return fmt.Sprintf("from %s (%s)", receivedToken(conn.ehlo), tcpInfo)
+}
+
+// foldWidth is the line length that header lines are folded to fit within,
+// per RFC 5322 § 2.1.1.
+const foldWidth = 78
+
+// writeFolded writes |s| to a header line that is already |width| long,
+// folding it at spaces so that no line is longer than foldWidth. Words longer
+// than that are not broken.
+func writeFolded(buf *bytes.Buffer, s string, width int) {
+	for i, word := range strings.Split(s, " ") {
+		if i > 0 {
+			if width+1+len(word) > foldWidth {
+				buf.WriteString("\r\n\t")
+				width = 1
+			} else {
+				buf.WriteByte(' ')
+				width++
+			}
+		}
+		buf.WriteString(word)
+		width += len(word)
+	}
+}
+
+// addressLiteral formats |ip| as an RFC 5321 § 4.1.3 address literal.
+func addressLiteral(ip string) string {
+	if strings.Contains(ip, ":") {
+		return "[IPv6:" + ip + "]"
+	}
+	return "[" + ip + "]"
+}
+
+// receivedToken replaces the characters of the client-supplied |s| that would
+// break the structure of a Received header: controls, spaces, non-ASCII, and
+// the comment and clause delimiters.
+func receivedToken(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune("()<>;\\\"", r) {
+			return '?'
+		}
+		return r
+	}, s)
+}
+
+// receivedComment escapes |s| for use as the text of a header comment.
+func receivedComment(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r < ' ' || r >= 0x7f:
+			b.WriteByte('?')
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+var tlsCipherNames = map[uint16]string{
+	tls.TLS_RSA_WITH_RC4_128_SHA:                      "TLS_RSA_WITH_RC4_128_SHA",
+	tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA:                 "TLS_RSA_WITH_3DES_EDE_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA:                  "TLS_RSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA:                  "TLS_RSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA256:               "TLS_RSA_WITH_AES_128_CBC_SHA256",
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256:               "TLS_RSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384:               "TLS_RSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA:              "TLS_ECDHE_ECDSA_WITH_RC4_128_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:          "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:          "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA:                "TLS_ECDHE_RSA_WITH_RC4_128_SHA",
+	tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA:           "TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:            "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:            "TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256:       "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256:         "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:         "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256:       "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:         "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384:       "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256:   "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256: "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+	tls.TLS_AES_128_GCM_SHA256:                        "TLS_AES_128_GCM_SHA256",
+	tls.TLS_AES_256_GCM_SHA384:                        "TLS_AES_256_GCM_SHA384",
+	tls.TLS_CHACHA20_POLY1305_SHA256:                  "TLS_CHACHA20_POLY1305_SHA256",
+}
+var tlsVersionNames = map[uint16]string{
+	tls.VersionSSL30: "SSLv3.0",
+	tls.VersionTLS10: "TLSv1.0",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// newTLSInfo returns the TLSInfo for |state|, or nil if the connection is not
+// using TLS.
+func newTLSInfo(state *tls.ConnectionState) *TLSInfo {
+	if state == nil {
+		return nil
+	}
+
+	version := tlsVersionNames[state.Version]
+	cipher := tlsCipherNames[state.CipherSuite]
 
 	if version == "" {
 		version = fmt.Sprintf("%x", state.Version)
@@ -514,24 +1307,37 @@ func (conn *connection) getTransportString() string {
 		cipher = fmt.Sprintf("%x", state.CipherSuite)
 	}
 
-	name := ""
-	if state.ServerName != "" {
-		name = fmt.Sprintf(" name=%s", state.ServerName)
+	return &TLSInfo{
+		Version:     version,
+		CipherSuite: cipher,
+		ServerName:  state.ServerName,
 	}
-
-	return fmt.Sprintf("%s cipher=%s%s", version, cipher, name)
 }
 
 func (conn *connection) doRSET() {
 	conn.log.Info("doRSET()")
-	conn.state = stateInitial
+	conn.setState(stateInitial)
 	conn.resetBuffers()
 	conn.reply(ReplyOK)
 }
 
+func (conn *connection) setState(s state) {
+	conn.state = s
+	if conn.opts.StateChanged != nil {
+		conn.opts.StateChanged(s.String())
+	}
+}
+
 func (conn *connection) resetBuffers() {
 	conn.delivery = deliverUnknown
 	conn.sendAs = nil
 	conn.mailFrom = nil
 	conn.rcptTo = make([]mail.Address, 0)
+	conn.declaredSize = 0
+	conn.rcptSizeLimit = 0
+	conn.dsn = DSNParameters{}
+	if conn.chunks != nil {
+		putBuffer(conn.chunks)
+		conn.chunks = nil
+	}
 }
@@ -7,9 +7,12 @@
 package smtp
 
 import (
+	"bytes"
 	"crypto/tls"
 	"encoding/base64"
 	"fmt"
+	"io"
+	"math"
 	"net"
 	"net/mail"
 	"net/textproto"
@@ -19,7 +22,7 @@ import (
 	"testing"
 	"time"
 
-	"go.uber.org/zap"
+	"src.bluestatic.org/mailpopbox/logger"
 )
 
 func _fl(depth int) string {
@@ -43,7 +46,11 @@ func readCodeLine(t testing.TB, conn *textproto.Conn, code int) string {
 
 // runServer creates a TCP socket, runs a listening server, and returns the connection.
 // The server exits when the Conn is closed.
-func runServer(t *testing.T, server Server) net.Listener {
+func runServer(t testing.TB, server Server) net.Listener {
+	return runServerWithOptions(t, server, Options{})
+}
+
+func runServerWithOptions(t testing.TB, server Server, opts Options) net.Listener {
 	l, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
 		t.Fatal(err)
@@ -56,7 +63,7 @@ func runServer(t *testing.T, server Server) net.Listener {
 			if err != nil {
 				return
 			}
-			go AcceptConnection(conn, server, zap.NewNop())
+			go AcceptConnection(conn, server, opts, logger.Nop())
 		}
 	}()
 
@@ -106,7 +113,7 @@ func (s *testServer) RelayMessage(en Envelope, authc string) {
 	s.relayed = append(s.relayed, en)
 }
 
-func createClient(t *testing.T, addr net.Addr) *textproto.Conn {
+func createClient(t testing.TB, addr net.Addr) *textproto.Conn {
 	conn, err := textproto.Dial(addr.Network(), addr.String())
 	if err != nil {
 		t.Fatal(err)
@@ -253,21 +260,22 @@ func TestCaseSensitivty(t *testing.T) {
 func TestGetReceivedInfo(t *testing.T) {
 	conn := connection{
 		server:     &testServer{},
-		remoteAddr: &net.IPAddr{net.IPv4(127, 0, 0, 1), ""},
+		remoteAddr: &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)},
 	}
 
 	now := time.Now()
 
 	const crlf = "\r\n"
 	const line1 = "Received: from remote.test. (localhost [127.0.0.1])" + crlf
-	const line2 = "by Test-Server (mailpopbox) with "
+	const line2 = "\tby Test-Server (mailpopbox) with "
 	const msgId = "abcdef.hijk"
-	lineLast := now.Format(time.RFC1123Z) + crlf
+	lineLast := "\t" + now.Format(time.RFC1123Z) + crlf
 
 	type params struct {
 		ehlo    string
 		esmtp   bool
 		tls     bool
+		authc   string
 		address string
 	}
 
@@ -276,11 +284,41 @@ func TestGetReceivedInfo(t *testing.T) {
 
 		expect []string
 	}{
-		{params{"remote.test.", true, false, "foo@bar.com"},
+		{params{"remote.test.", false, false, "", "foo@bar.com"},
+			[]string{line1,
+				line2 + "SMTP id " + msgId + crlf,
+				"\tfor <foo@bar.com>" + crlf,
+				"\t(using PLAINTEXT);" + crlf,
+				lineLast, ""}},
+		{params{"remote.test.", true, false, "", "foo@bar.com"},
+			[]string{line1,
+				line2 + "ESMTP id " + msgId + crlf,
+				"\tfor <foo@bar.com>" + crlf,
+				"\t(using PLAINTEXT);" + crlf,
+				lineLast, ""}},
+		{params{"remote.test.", true, true, "", "foo@bar.com"},
 			[]string{line1,
+				line2 + "ESMTPS id " + msgId + crlf,
+				"\tfor <foo@bar.com>" + crlf,
+				"\t(using TLSv1.3 cipher=TLS_AES_128_GCM_SHA256 name=mx.test);" + crlf,
+				lineLast, ""}},
+		{params{"remote.test.", true, false, "user", "foo@bar.com"},
+			[]string{line1,
+				line2 + "ESMTPA id " + msgId + crlf,
+				"\tfor <foo@bar.com>" + crlf,
+				"\t(using PLAINTEXT);" + crlf,
+				lineLast, ""}},
+		{params{"remote.test.", true, true, "user", "foo@bar.com"},
+			[]string{line1,
+				line2 + "ESMTPSA id " + msgId + crlf,
+				"\tfor <foo@bar.com>" + crlf,
+				"\t(using TLSv1.3 cipher=TLS_AES_128_GCM_SHA256 name=mx.test);" + crlf,
+				lineLast, ""}},
+		{params{"bad(name);\x01", true, false, "", "foo@bar.com"},
+			[]string{"Received: from bad?name??? (localhost [127.0.0.1])" + crlf,
 				line2 + "ESMTP id " + msgId + crlf,
-				"for <foo@bar.com>" + crlf,
-				"(using PLAINTEXT);" + crlf,
+				"\tfor <foo@bar.com>" + crlf,
+				"\t(using PLAINTEXT);" + crlf,
 				lineLast, ""}},
 	}
 
@@ -289,13 +327,20 @@ func TestGetReceivedInfo(t *testing.T) {
 
 		conn.ehlo = test.params.ehlo
 		conn.esmtp = test.params.esmtp
-		//conn.tls = test.params.tls
+		conn.authc = test.params.authc
 
 		envelope := Envelope{
-			RcptTo:   []mail.Address{{"", test.params.address}},
+			RcptTo:   []mail.Address{{Address: test.params.address}},
 			Received: now,
 			ID:       msgId,
 		}
+		if test.params.tls {
+			envelope.TLS = newTLSInfo(&tls.ConnectionState{
+				Version:     tls.VersionTLS13,
+				CipherSuite: tls.TLS_AES_128_GCM_SHA256,
+				ServerName:  "mx.test",
+			})
+		}
 
 		actual := conn.getReceivedInfo(envelope)
 		actualLines := strings.SplitAfter(string(actual), crlf)
@@ -306,12 +351,113 @@ func TestGetReceivedInfo(t *testing.T) {
 		}
 
 		for i, line := range actualLines {
-			if want, got := test.expect[i], strings.TrimLeft(line, " "); want != got {
+			if want, got := test.expect[i], line; want != got {
 				t.Errorf("want equal string %q, got %q", want, got)
 			}
 		}
 	}
+}
 
+func TestReceivedPrivacy(t *testing.T) {
+	now := time.Now()
+	envelope := Envelope{
+		RcptTo:   []mail.Address{{Address: "foo@bar.com"}},
+		Received: now,
+		ID:       "abcdef.hijk",
+	}
+
+	tests := []struct {
+		privacy string
+		authc   string
+		first   string
+	}{
+		{"", "user", "Received: from home.example.net (localhost [127.0.0.1])"},
+		{ReceivedPrivacyRedact, "user", "Received: from redacted (redacted)"},
+		{ReceivedPrivacyOmit, "user", "Received: by Test-Server (mailpopbox) with ESMTPA id abcdef.hijk"},
+		// Unauthenticated clients are always named.
+		{ReceivedPrivacyRedact, "", "Received: from home.example.net (localhost [127.0.0.1])"},
+		{ReceivedPrivacyOmit, "", "Received: from home.example.net (localhost [127.0.0.1])"},
+	}
+	for _, test := range tests {
+		conn := connection{
+			server:     &testServer{},
+			opts:       Options{ReceivedPrivacy: test.privacy},
+			remoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4567},
+			ehlo:       "home.example.net",
+			esmtp:      true,
+			authc:      test.authc,
+		}
+		header := string(conn.getReceivedInfo(envelope))
+		if got := header[:strings.Index(header, "\r\n")]; got != test.first {
+			t.Errorf("%q, authc=%q: want %q, got %q", test.privacy, test.authc, test.first, got)
+		}
+		if test.authc != "" && test.privacy != "" && strings.Contains(header, "127.0.0.1") {
+			t.Errorf("%q: client address was not hidden: %q", test.privacy, header)
+		}
+	}
+}
+
+func TestReceivedInfoParses(t *testing.T) {
+	conn := connection{
+		server:     &testServer{},
+		remoteAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 25},
+		ehlo:       "client.example.com",
+		esmtp:      true,
+	}
+	now := time.Now().Truncate(time.Second)
+	envelope := Envelope{
+		RcptTo:   []mail.Address{{Address: "foo@bar.com"}},
+		Received: now,
+		ID:       "abcdef.hijk",
+		TLS: newTLSInfo(&tls.ConnectionState{
+			Version:     tls.VersionTLS12,
+			CipherSuite: tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+			ServerName:  "a-rather-long-server-name.mx.example.com",
+		}),
+	}
+
+	header := conn.getReceivedInfo(envelope)
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if len(strings.TrimSuffix(line, "\r\n")) > foldWidth {
+			t.Errorf("Want line of at most %d characters, got %q", foldWidth, line)
+		}
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(append(header, "Subject: hi\r\n\r\nbody\r\n"...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := msg.Header.Get("Received")
+	if want, got := "hi", msg.Header.Get("Subject"); want != got {
+		t.Errorf("Want Subject %q after Received, got %q", want, got)
+	}
+	if !strings.HasPrefix(received, "from client.example.com ([IPv6:2001:db8::1])") {
+		t.Errorf("Want from clause with an IPv6 address literal, got %q", received)
+	}
+	if !strings.Contains(received, "with ESMTPS id abcdef.hijk") {
+		t.Errorf("Want ESMTPS protocol, got %q", received)
+	}
+
+	// The date follows the last semicolon.
+	i := strings.LastIndex(received, ";")
+	if i < 0 {
+		t.Fatalf("Want date after a semicolon, got %q", received)
+	}
+	date, err := mail.ParseDate(strings.TrimSpace(received[i+1:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !date.Equal(now) {
+		t.Errorf("Want date %v, got %v", now, date)
+	}
+
+	helo, ip := receivedOrigin(header)
+	if want, got := "client.example.com", helo; want != got {
+		t.Errorf("Want origin HELO %q, got %q", want, got)
+	}
+	if want, got := "2001:db8::1", ip.String(); want != got {
+		t.Errorf("Want origin IP %q, got %q", want, got)
+	}
 }
 
 func getTLSConfig(t *testing.T) *tls.Config {
@@ -371,6 +517,56 @@ func TestTLS(t *testing.T) {
 	setupTLSClient(t, l.Addr())
 }
 
+func TestRequireTLS(t *testing.T) {
+	s := &testServer{domain: "example.com", tlsConfig: getTLSConfig(t)}
+	l := runServerWithOptions(t, s, Options{RequireTLS: true})
+	defer l.Close()
+
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+	runTableTest(t, conn, []requestResponse{
+		{"EHLO test", 0, func(t testing.TB, conn *textproto.Conn) { conn.ReadResponse(250) }},
+		{"MAIL FROM:<sender@example.net>", 530, nil},
+		{"RCPT TO:<user@example.com>", 530, nil},
+		{"DATA", 530, nil},
+		{"NOOP", 250, nil},
+	})
+	conn.Close()
+
+	conn = setupTLSClient(t, l.Addr())
+	runTableTest(t, conn, []requestResponse{
+		{"MAIL FROM:<sender@example.net>", 250, nil},
+		{"RCPT TO:<user@example.com>", 250, nil},
+	})
+}
+
+type certAuthServer struct {
+	testServer
+}
+
+func (s *certAuthServer) CertificateAuthenticate(state tls.ConnectionState) string {
+	if state.PeerCertificates[0].Subject.CommonName != "localhost" {
+		return ""
+	}
+	return "mailbox@example.com"
+}
+
+func TestCertificateAuth(t *testing.T) {
+	tlsConfig := getTLSConfig(t)
+	tlsConfig.ClientAuth = tls.RequestClientCert
+	s := &certAuthServer{testServer{domain: "example.com", tlsConfig: tlsConfig}}
+	l := runServer(t, s)
+	defer l.Close()
+
+	// setupTLSClient presents the test certificate as its client certificate.
+	conn := setupTLSClient(t, l.Addr())
+	runTableTest(t, conn, []requestResponse{
+		{"AUTH PLAIN", 503, nil}, // Already authenticated.
+		{"MAIL FROM:<mailbox@example.com>", 250, nil},
+		{"RCPT TO:<dest@another.net>", 250, nil},
+	})
+}
+
 func TestAuthWithoutTLS(t *testing.T) {
 	l := runServer(t, &testServer{})
 	defer l.Close()
@@ -403,7 +599,8 @@ func TestAuth(t *testing.T) {
 	runTableTest(t, conn, []requestResponse{
 		{"AUTH", 501, nil},
 		{"AUTH OAUTHBEARER", 504, nil},
-		{"AUTH PLAIN", 501, nil}, // Bad syntax, missing space.
+		{"AUTH PLAIN", 334, nil},
+		{"*", 501, nil}, // Cancelled.
 		{"AUTH PLAIN ", 334, nil},
 		{b64enc("abc\x00def\x00ghf"), 535, nil},
 		{"AUTH PLAIN ", 334, nil},
@@ -435,6 +632,108 @@ func TestAuthNoInitialResponse(t *testing.T) {
 	})
 }
 
+func TestAuthEmptyChallenge(t *testing.T) {
+	l := runServer(t, &testServer{
+		tlsConfig: getTLSConfig(t),
+		userAuth: &userAuth{
+			authz:  "",
+			authc:  "user",
+			passwd: "longpassword",
+		},
+	})
+	defer l.Close()
+
+	conn := setupTLSClient(t, l.Addr())
+
+	ok(t, conn.PrintfLine("auth plain"))
+	line, err := conn.ReadLine()
+	ok(t, err)
+	if want, got := "334 ", line; want != got {
+		t.Errorf("Want challenge %q, got %q", want, got)
+	}
+
+	runTableTest(t, conn, []requestResponse{
+		{b64enc("\x00user\x00longpassword"), 235, nil},
+	})
+}
+
+func TestAuthEmptyInitialResponse(t *testing.T) {
+	l := runServer(t, &testServer{
+		tlsConfig: getTLSConfig(t),
+		userAuth: &userAuth{
+			authz:  "",
+			authc:  "user",
+			passwd: "longpassword",
+		},
+	})
+	defer l.Close()
+
+	conn := setupTLSClient(t, l.Addr())
+
+	runTableTest(t, conn, []requestResponse{
+		{"AUTH PLAIN =", 501, nil},
+		{"AUTH PLAIN " + b64enc("\x00user\x00longpassword"), 235, nil},
+	})
+}
+
+func TestAuthAttemptLimit(t *testing.T) {
+	l := runServerWithOptions(t, &testServer{
+		tlsConfig: getTLSConfig(t),
+		userAuth: &userAuth{
+			authz:  "",
+			authc:  "user",
+			passwd: "longpassword",
+		},
+	}, Options{MaxAuthAttempts: 2})
+	defer l.Close()
+
+	conn := setupTLSClient(t, l.Addr())
+
+	runTableTest(t, conn, []requestResponse{
+		{"AUTH PLAIN " + b64enc("\x00user\x00guess"), 535, nil},
+		{"AUTH PLAIN " + b64enc("\x00user\x00guess"), 421, nil},
+	})
+
+	if _, err := conn.ReadLine(); err != io.EOF {
+		t.Errorf("Want connection closed, got %v", err)
+	}
+}
+
+// harvestServer disconnects a client after its second invalid recipient.
+type harvestServer struct {
+	testServer
+	invalid []string
+}
+
+func (s *harvestServer) InvalidRecipient(addr net.Addr, rcpt mail.Address) bool {
+	s.invalid = append(s.invalid, rcpt.Address)
+	return len(s.invalid) >= 2
+}
+
+func TestInvalidRecipientReporter(t *testing.T) {
+	s := &harvestServer{testServer: testServer{domain: "example.com"}}
+	l := runServer(t, s)
+	defer l.Close()
+
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	runTableTest(t, conn, []requestResponse{
+		{"EHLO test", 0, func(t testing.TB, conn *textproto.Conn) { conn.ReadResponse(250) }},
+		{"MAIL FROM:<sender@sender.net>", 250, nil},
+		{"RCPT TO:<valid@example.com>", 250, nil},
+		{"RCPT TO:<alice@other.net>", 550, nil},
+		{"RCPT TO:<bob@other.net>", 421, nil},
+	})
+
+	if _, err := conn.ReadLine(); err != io.EOF {
+		t.Errorf("Want connection closed, got %v", err)
+	}
+	if want, got := "alice@other.net bob@other.net", strings.Join(s.invalid, " "); want != got {
+		t.Errorf("Want invalid recipients %q, got %q", want, got)
+	}
+}
+
 func TestRelayRequiresAuth(t *testing.T) {
 	l := runServer(t, &testServer{
 		domain:    "example.com",
@@ -458,6 +757,48 @@ func TestRelayRequiresAuth(t *testing.T) {
 	})
 }
 
+func TestSubmission(t *testing.T) {
+	server := &testServer{
+		domain:    "example.com",
+		tlsConfig: getTLSConfig(t),
+		userAuth: &userAuth{
+			authz:  "",
+			authc:  "mailbox@example.com",
+			passwd: "test",
+		},
+	}
+	l := runServerWithOptions(t, server, Options{Submission: true})
+	defer l.Close()
+
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	runTableTest(t, conn, []requestResponse{
+		{"EHLO test", 0, func(t testing.TB, conn *textproto.Conn) { conn.ReadResponse(250) }},
+		{"MAIL FROM:<sender@another.net>", 530, nil},
+		{"MAIL FROM:<mailbox@example.com>", 530, nil},
+	})
+
+	conn = setupTLSClient(t, l.Addr())
+	runTableTest(t, conn, []requestResponse{
+		{"MAIL FROM:<sender@another.net>", 530, nil},
+		{"AUTH PLAIN " + b64enc("\x00mailbox@example.com\x00test"), 235, nil},
+		{"MAIL FROM:<sender@another.net>", 553, nil},
+		{"MAIL FROM:<mailbox@example.com>", 250, nil},
+		{"RCPT TO:<dest@another.net>", 250, nil},
+		{"DATA", 354, func(t testing.TB, conn *textproto.Conn) {
+			readCodeLine(t, conn, 354)
+			ok(t, conn.PrintfLine("Subject: Submission\n"))
+			ok(t, conn.PrintfLine("."))
+			readCodeLine(t, conn, 250)
+		}},
+	})
+
+	if want, got := 1, len(server.relayed); want != got {
+		t.Errorf("Want %d relayed message, got %d", want, got)
+	}
+}
+
 func setupRelayTest(t *testing.T) (server *testServer, l net.Listener, conn *textproto.Conn) {
 	server = &testServer{
 		domain:    "example.com",
@@ -547,3 +888,509 @@ func TestSendMultipleRelay(t *testing.T) {
 		t.Errorf("Could not find Subject: header in message %q", msg)
 	}
 }
+
+func TestLineLimit(t *testing.T) {
+	s := testServer{domain: "example.com"}
+	l := runServerWithOptions(t, &s, Options{MaxLineLength: 32})
+	defer l.Close()
+
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	runTableTest(t, conn, []requestResponse{
+		{"EHLO test", 0, func(t testing.TB, conn *textproto.Conn) {
+			_, _, err := conn.ReadResponse(250)
+			ok(t, err)
+		}},
+		{"MAIL FROM:<sender@" + strings.Repeat("a", 20) + ".net>", 500, nil},
+		// Longer than the bufio.Reader, and the AUTH limit.
+		{"MAIL FROM:<" + strings.Repeat("a", 20000) + ">", 500, nil},
+		{"MAIL FROM:<sender@a.net>", 250, nil},
+		{"QUIT", 221, nil},
+	})
+}
+
+func TestCommandLimit(t *testing.T) {
+	s := testServer{domain: "example.com"}
+	l := runServerWithOptions(t, &s, Options{MaxCommands: 2})
+	defer l.Close()
+
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	runTableTest(t, conn, []requestResponse{
+		{"NOOP", 250, nil},
+		{"NOOP", 250, nil},
+		{"NOOP", 421, nil},
+	})
+
+	if _, err := conn.ReadLine(); err == nil {
+		t.Errorf("Expected connection to be closed")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		nc, err := l.Accept()
+		if err != nil {
+			return
+		}
+		// The listener sets deadlines like this in the server.
+		nc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		AcceptConnection(nc, &testServer{domain: "example.com"}, Options{}, logger.Nop())
+	}()
+
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+	runTableTest(t, conn, []requestResponse{
+		{"NOOP", 250, nil},
+	})
+
+	if want, got := "4.4.2 Test-Server timeout, closing connection", readCodeLine(t, conn, 421); want != got {
+		t.Errorf("Want timeout reply %q, got %q", want, got)
+	}
+	if _, err := conn.ReadLine(); err == nil {
+		t.Errorf("Expected connection to be closed")
+	}
+}
+
+func TestRecipientLimit(t *testing.T) {
+	s := testServer{domain: "example.com"}
+	l := runServerWithOptions(t, &s, Options{MaxRecipients: 2})
+	defer l.Close()
+
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	runTableTest(t, conn, []requestResponse{
+		{"HELO test", 250, nil},
+		{"MAIL FROM:<sender@sender.net>", 250, nil},
+		{"RCPT TO:<a@example.com>", 250, nil},
+		{"RCPT TO:<b@example.com>", 250, nil},
+		{"RCPT TO:<c@example.com>", 452, nil},
+		{"RSET", 250, nil},
+		{"MAIL FROM:<sender@sender.net>", 250, nil},
+		{"RCPT TO:<c@example.com>", 250, nil},
+		{"QUIT", 221, nil},
+	})
+}
+
+func TestNullReversePath(t *testing.T) {
+	s := &deliveryServer{
+		testServer: testServer{domain: "example.com"},
+	}
+	l := runServer(t, s)
+	defer l.Close()
+
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	runTableTest(t, conn, []requestResponse{
+		{"HELO mx.other.net", 250, nil},
+		{"MAIL FROM:<>", 250, nil},
+		{"RCPT TO:<mailbox@example.com>", 250, nil},
+		{"DATA", 354, nil},
+		{"Subject: Delivery Status Notification\r\n\r\nFailed.\r\n.", 250, nil},
+		// Some clients put a space before the path.
+		{"MAIL FROM: <>", 250, nil},
+		{"RCPT TO:<mailbox@example.com>", 250, nil},
+		{"DATA", 354, nil},
+		{"Subject: Delivery Status Notification\r\n\r\nFailed.\r\n.", 250, nil},
+		{"QUIT", 221, nil},
+	})
+
+	if want, got := 2, len(s.messages); want != got {
+		t.Fatalf("Want %d messages, got %d", want, got)
+	}
+	for _, en := range s.messages {
+		if want, got := "", en.MailFrom.Address; want != got {
+			t.Errorf("Want null sender, got %q", got)
+		}
+	}
+}
+
+func TestHopLimit(t *testing.T) {
+	s := &deliveryServer{
+		testServer: testServer{domain: "example.com"},
+	}
+	l := runServerWithOptions(t, s, Options{MaxHops: 3})
+	defer l.Close()
+
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	runTableTest(t, conn, []requestResponse{
+		{"HELO mx.other.net", 250, nil},
+		{"MAIL FROM:<sender@other.net>", 250, nil},
+		{"RCPT TO:<mailbox@example.com>", 250, nil},
+		{"DATA", 354, nil},
+		{"Received: from a\r\nReceived: from b\r\nSubject: hi\r\n\r\nReceived: in the body\r\n.", 250, nil},
+		{"MAIL FROM:<sender@other.net>", 250, nil},
+		{"RCPT TO:<mailbox@example.com>", 250, nil},
+		{"DATA", 354, nil},
+		{"Received: from a\r\nReceived: from b\r\nReceived: from c\r\nSubject: hi\r\n\r\nLoop.\r\n.", 554, nil},
+		// The transaction was aborted.
+		{"RCPT TO:<mailbox@example.com>", 503, nil},
+		{"QUIT", 221, nil},
+	})
+
+	if want, got := 1, len(s.messages); want != got {
+		t.Errorf("Want %d messages, got %d", want, got)
+	}
+}
+
+type tokenTestServer struct {
+	testServer
+	token string
+}
+
+func (s *tokenTestServer) AuthenticateToken(user, token string) bool {
+	return user == s.authc && token == s.token
+}
+
+func TestAuthBearerToken(t *testing.T) {
+	l := runServer(t, &tokenTestServer{
+		testServer: testServer{
+			domain:    "example.com",
+			tlsConfig: getTLSConfig(t),
+			userAuth:  &userAuth{authc: "mailbox@example.com"},
+		},
+		token: "ya29.token",
+	})
+	defer l.Close()
+
+	conn := setupTLSClient(t, l.Addr())
+	ok(t, conn.PrintfLine("EHLO test"))
+	_, resp, err := conn.ReadResponse(250)
+	ok(t, err)
+	if !strings.Contains(resp, "AUTH PLAIN XOAUTH2 OAUTHBEARER") {
+		t.Errorf("Token mechanisms not advertised: %q", resp)
+	}
+
+	runTableTest(t, conn, []requestResponse{
+		{"AUTH XOAUTH2 " + b64enc("user=mailbox@example.com\x01auth=Bearer wrong\x01\x01"), 0, func(t testing.TB, conn *textproto.Conn) {
+			msg := readCodeLine(t, conn, 334)
+			if challenge, _ := base64.StdEncoding.DecodeString(msg); !strings.Contains(string(challenge), "invalid_token") {
+				t.Errorf("Want error challenge, got %q", challenge)
+			}
+			ok(t, conn.PrintfLine(""))
+			readCodeLine(t, conn, 535)
+		}},
+		{"AUTH XOAUTH2 " + b64enc("user=mailbox@example.com\x01auth=Basic ya29.token\x01\x01"), 501, nil},
+		{"AUTH OAUTHBEARER", 334, nil},
+		{b64enc("n,a=mailbox@example.com,\x01host=mx.example.com\x01auth=Bearer ya29.token\x01\x01"), 235, nil},
+		{"MAIL FROM:<mailbox@example.com>", 250, nil},
+	})
+
+	conn = setupTLSClient(t, l.Addr())
+	runTableTest(t, conn, []requestResponse{
+		{"AUTH XOAUTH2 " + b64enc("user=mailbox@example.com\x01auth=Bearer ya29.token\x01\x01"), 235, nil},
+	})
+}
+
+func TestAuthBearerTokenUnsupported(t *testing.T) {
+	l := runServer(t, &testServer{
+		tlsConfig: getTLSConfig(t),
+		userAuth:  &userAuth{authc: "user"},
+	})
+	defer l.Close()
+
+	conn := setupTLSClient(t, l.Addr())
+	runTableTest(t, conn, []requestResponse{
+		{"AUTH XOAUTH2 " + b64enc("user=user\x01auth=Bearer x\x01\x01"), 504, nil},
+		{"AUTH OAUTHBEARER", 504, nil},
+	})
+}
+
+type sizeLimitTestServer struct {
+	testServer
+	limit int64
+}
+
+func (s *sizeLimitTestServer) MaxMessageSize(rcpt mail.Address) int64 {
+	if rcpt.Address == "small@example.com" {
+		return s.limit
+	}
+	return 0
+}
+
+func TestMessageSizeLimit(t *testing.T) {
+	l := runServerWithOptions(t, &sizeLimitTestServer{
+		testServer: testServer{domain: "example.com"},
+		limit:      50,
+	}, Options{MaxMessageSize: 100})
+	defer l.Close()
+
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	sendData := func(size int, code int) func(testing.TB, *textproto.Conn) {
+		return func(t testing.TB, conn *textproto.Conn) {
+			readCodeLine(t, conn, 354)
+			ok(t, conn.PrintfLine("%s", strings.Repeat("x", size)))
+			ok(t, conn.PrintfLine("."))
+			readCodeLine(t, conn, code)
+		}
+	}
+
+	runTableTest(t, conn, []requestResponse{
+		{"EHLO test", 0, func(t testing.TB, conn *textproto.Conn) {
+			_, resp, err := conn.ReadResponse(250)
+			ok(t, err)
+			if !strings.Contains(resp, "SIZE 100") {
+				t.Errorf("SIZE not advertised: %q", resp)
+			}
+		}},
+		{"MAIL FROM:<sender@another.net> SIZE=101", 552, nil},
+		{"MAIL FROM:<sender@another.net> SIZE=abc", 501, nil},
+		{"MAIL FROM:<sender@another.net> SIZE=60", 250, nil},
+		{"RCPT TO:<small@example.com>", 552, nil},
+		{"RCPT TO:<big@example.com>", 250, nil},
+		{"DATA", 0, sendData(200, 552)},
+		// The transaction was aborted.
+		{"RCPT TO:<big@example.com>", 503, nil},
+		{"MAIL FROM:<sender@another.net>", 250, nil},
+		{"RCPT TO:<big@example.com>", 250, nil},
+		{"RCPT TO:<small@example.com>", 250, nil},
+		{"DATA", 0, sendData(60, 552)},
+		{"MAIL FROM:<sender@another.net>", 250, nil},
+		{"RCPT TO:<small@example.com>", 250, nil},
+		{"DATA", 0, sendData(40, 250)},
+		{"QUIT", 221, nil},
+	})
+}
+
+type inboundSizeTestServer struct {
+	testServer
+	inbound int64
+}
+
+func (s *inboundSizeTestServer) MaxInboundMessageSize() int64 {
+	return s.inbound
+}
+
+func TestAdvertisedSize(t *testing.T) {
+	cases := []struct {
+		inbound    int64
+		submission bool
+		size       string
+	}{
+		{0, false, "SIZE 100"},
+		{50, false, "SIZE 50"},
+		{500, false, "SIZE 100"},
+		{50, true, "SIZE 100"},
+	}
+	for _, c := range cases {
+		l := runServerWithOptions(t, &inboundSizeTestServer{
+			testServer: testServer{domain: "example.com"},
+			inbound:    c.inbound,
+		}, Options{MaxMessageSize: 100, Submission: c.submission})
+
+		conn := createClient(t, l.Addr())
+		readCodeLine(t, conn, 220)
+		ok(t, conn.PrintfLine("EHLO test"))
+		_, resp, err := conn.ReadResponse(250)
+		ok(t, err)
+		if !strings.HasSuffix(resp, c.size) {
+			t.Errorf("%+v: want %s advertised, got %q", c, c.size, resp)
+		}
+		conn.Close()
+		l.Close()
+	}
+}
+
+func TestPipelining(t *testing.T) {
+	l := runServer(t, &testServer{domain: "example.com"})
+	defer l.Close()
+
+	nc, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := textproto.NewConn(nc)
+	defer conn.Close()
+	readCodeLine(t, conn, 220)
+
+	ok(t, conn.PrintfLine("EHLO test"))
+	_, resp, err := conn.ReadResponse(250)
+	ok(t, err)
+	if !strings.Contains(resp, "PIPELINING\n") {
+		t.Errorf("PIPELINING not advertised: %q", resp)
+	}
+
+	// Send the whole transaction in one write, as a pipelining client would.
+	batch := "MAIL FROM:<sender@another.net>\r\n" +
+		"RCPT TO:<one@example.com>\r\n" +
+		"RCPT TO:<two@other.net>\r\n" +
+		"RCPT TO:<three@example.com>\r\n" +
+		"DATA\r\n"
+	if _, err := nc.Write([]byte(batch)); err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range []int{250, 250, 550, 250, 354} {
+		readCodeLine(t, conn, code)
+	}
+
+	if _, err := nc.Write([]byte("Subject: pipelined\r\n\r\nbody\r\n.\r\nRSET\r\nNOOP\r\nQUIT\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range []int{250, 250, 250, 221} {
+		readCodeLine(t, conn, code)
+	}
+}
+
+func TestChunking(t *testing.T) {
+	s := &deliveryServer{testServer: testServer{domain: "example.com"}}
+	l := runServer(t, s)
+	defer l.Close()
+
+	nc, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := textproto.NewConn(nc)
+	defer conn.Close()
+	readCodeLine(t, conn, 220)
+
+	ok(t, conn.PrintfLine("EHLO test"))
+	_, resp, err := conn.ReadResponse(250)
+	ok(t, err)
+	if !strings.Contains(resp, "CHUNKING\n") {
+		t.Errorf("CHUNKING not advertised: %q", resp)
+	}
+
+	bdat := func(chunk string, last bool, code int) {
+		cmd := fmt.Sprintf("BDAT %d", len(chunk))
+		if last {
+			cmd += " LAST"
+		}
+		if _, err := nc.Write([]byte(cmd + "\r\n" + chunk)); err != nil {
+			t.Fatal(err)
+		}
+		readCodeLine(t, conn, code)
+	}
+
+	// A chunk outside a transaction is still read.
+	bdat("hello", true, 503)
+	runTableTest(t, conn, []requestResponse{
+		{"NOOP", 250, nil},
+		{"MAIL FROM:<sender@another.net>", 250, nil},
+		{"RCPT TO:<one@example.com>", 250, nil},
+	})
+	bdat("Subject: chunked\r\n\r\n", false, 250)
+	bdat("body\r\n.\r\n", false, 250)
+	// DATA cannot be mixed with BDAT.
+	runTableTest(t, conn, []requestResponse{
+		{"DATA", 503, nil},
+	})
+	bdat("", true, 250)
+
+	if want, got := 1, len(s.messages); want != got {
+		t.Fatalf("Want %d message, got %d", want, got)
+	}
+	data := string(s.messages[0].Data)
+	if !strings.HasSuffix(data, "Subject: chunked\n\nbody\n.\n") {
+		t.Errorf("Unexpected message data: %q", data)
+	}
+
+	// The transaction is over, and RSET discards a partial message.
+	runTableTest(t, conn, []requestResponse{
+		{"RCPT TO:<one@example.com>", 503, nil},
+		{"MAIL FROM:<sender@another.net>", 250, nil},
+		{"RCPT TO:<one@example.com>", 250, nil},
+	})
+	bdat("partial", false, 250)
+	runTableTest(t, conn, []requestResponse{
+		{"RSET", 250, nil},
+		{"BDAT abc", 501, nil},
+		{"QUIT", 221, nil},
+	})
+	if want, got := 1, len(s.messages); want != got {
+		t.Errorf("Want %d message, got %d", want, got)
+	}
+}
+
+func TestChunkingHugeChunk(t *testing.T) {
+	s := &deliveryServer{testServer: testServer{domain: "example.com"}}
+	l := runServer(t, s)
+	defer l.Close()
+
+	nc, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := textproto.NewConn(nc)
+	defer conn.Close()
+	readCodeLine(t, conn, 220)
+
+	runTableTest(t, conn, []requestResponse{
+		{"EHLO test", 0, func(t testing.TB, conn *textproto.Conn) { conn.ReadResponse(250) }},
+		{"MAIL FROM:<sender@another.net>", 250, nil},
+		{"RCPT TO:<one@example.com>", 250, nil},
+	})
+	if _, err := nc.Write([]byte("BDAT 1\r\nx")); err != nil {
+		t.Fatal(err)
+	}
+	readCodeLine(t, conn, 250)
+
+	// The second chunk's size would overflow when added to the first, so it
+	// must be refused rather than buffered. Closing the write side ends the
+	// chunk early.
+	if _, err := nc.Write([]byte(fmt.Sprintf("BDAT %d LAST\r\nxxxx", int64(math.MaxInt64)))); err != nil {
+		t.Fatal(err)
+	}
+	nc.(*net.TCPConn).CloseWrite()
+	if want, got := replyMessageTooBig.Message, readCodeLine(t, conn, replyMessageTooBig.Code); want != got {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+	if want, got := 0, len(s.messages); want != got {
+		t.Errorf("Want %d messages, got %d", want, got)
+	}
+}
+
+// benchmarkSessions sends b.N messages over |parallelism| sessions per
+// GOMAXPROCS, one message per session, down the happy path.
+func benchmarkSessions(b *testing.B, parallelism int) {
+	s := &testServer{domain: "example.com"}
+	l := runServer(b, s)
+	defer l.Close()
+
+	body := strings.Repeat(strings.Repeat("x", 76)+"\r\n", 52)
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.SetParallelism(parallelism)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			conn := createClient(b, l.Addr())
+			readCodeLine(b, conn, 220)
+			runTableTest(b, conn, []requestResponse{
+				{"EHLO bench.example.net", 0, func(t testing.TB, conn *textproto.Conn) { conn.ReadResponse(250) }},
+				{"MAIL FROM:<sender@example.net>", 250, nil},
+				{"RCPT TO:<rcpt@example.com>", 250, nil},
+				{"DATA", 354, func(t testing.TB, conn *textproto.Conn) {
+					readCodeLine(t, conn, 354)
+					w := conn.DotWriter()
+					io.WriteString(w, "Subject: benchmark\r\n\r\n"+body)
+					w.Close()
+					readCodeLine(t, conn, 250)
+				}},
+				{"QUIT", 221, nil},
+			})
+			conn.Close()
+		}
+	})
+}
+
+func BenchmarkSession(b *testing.B) {
+	benchmarkSessions(b, 1)
+}
+
+func BenchmarkSessionConcurrent(b *testing.B) {
+	benchmarkSessions(b, 16)
+}
@@ -0,0 +1,79 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package smtp
+
+import (
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultDeadHostTTL is the MTAOptions.DeadHostTTL if it is zero.
+const DefaultDeadHostTTL = 2 * time.Minute
+
+// deadHostCache remembers relay hosts that could not be reached, so that
+// relaying during an outage skips them instead of waiting on each to fail
+// again. A nil *deadHostCache remembers nothing.
+type deadHostCache struct {
+	ttl time.Duration
+
+	mu   sync.Mutex
+	dead map[string]time.Time // The expiration, keyed by host:port.
+
+	now func() time.Time
+}
+
+func newDeadHostCache(ttl time.Duration) *deadHostCache {
+	if ttl <= 0 {
+		ttl = DefaultDeadHostTTL
+	}
+	return &deadHostCache{
+		ttl:  ttl,
+		dead: make(map[string]time.Time),
+		now:  time.Now,
+	}
+}
+
+// add marks |hostPort| as unreachable for the TTL.
+func (c *deadHostCache) add(hostPort string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dead[hostPort] = c.now().Add(c.ttl)
+}
+
+// isDead reports whether |hostPort| failed within the TTL.
+func (c *deadHostCache) isDead(hostPort string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires, ok := c.dead[hostPort]
+	if ok && !c.now().Before(expires) {
+		delete(c.dead, hostPort)
+		return false
+	}
+	return ok
+}
+
+// orderMX sorts |mxs| by preference, shuffling hosts of equal preference so
+// that load is spread among them (RFC 5321 § 5.1).
+func orderMX(mxs []*net.MX) []*net.MX {
+	ordered := append([]*net.MX(nil), mxs...)
+	rand.Shuffle(len(ordered), func(i, j int) {
+		ordered[i], ordered[j] = ordered[j], ordered[i]
+	})
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Pref < ordered[j].Pref
+	})
+	return ordered
+}
@@ -0,0 +1,60 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package smtp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDeadHostCache(t *testing.T) {
+	c := newDeadHostCache(time.Minute)
+	now := time.Date(2020, time.June, 1, 12, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	c.add("mx1.example.com:25")
+	if !c.isDead("mx1.example.com:25") {
+		t.Errorf("Want host dead")
+	}
+	if c.isDead("mx2.example.com:25") {
+		t.Errorf("Want other host not dead")
+	}
+
+	now = now.Add(time.Minute)
+	if c.isDead("mx1.example.com:25") {
+		t.Errorf("Want dead host to expire")
+	}
+
+	var nilCache *deadHostCache
+	nilCache.add("mx1.example.com:25")
+	if nilCache.isDead("mx1.example.com:25") {
+		t.Errorf("Want nil cache to remember nothing")
+	}
+}
+
+func TestOrderMX(t *testing.T) {
+	mxs := []*net.MX{
+		{Host: "backup.example.com", Pref: 20},
+		{Host: "a.example.com", Pref: 10},
+		{Host: "b.example.com", Pref: 10},
+	}
+	firsts := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		ordered := orderMX(mxs)
+		if want, got := "backup.example.com", ordered[2].Host; want != got {
+			t.Fatalf("Want %q last, got %q", want, got)
+		}
+		firsts[ordered[0].Host]++
+	}
+	if firsts["a.example.com"] == 0 || firsts["b.example.com"] == 0 {
+		t.Errorf("Want equal-preference hosts shuffled, got firsts %v", firsts)
+	}
+	if want, got := "backup.example.com", mxs[0].Host; want != got {
+		t.Errorf("Input was reordered: want %q first, got %q", want, got)
+	}
+}
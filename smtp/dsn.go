@@ -0,0 +1,136 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package smtp
+
+import (
+	"bytes"
+	"mime"
+	"mime/multipart"
+	"strings"
+
+	"src.bluestatic.org/mailpopbox/message"
+)
+
+// DSNParameters are the requests for delivery status notifications made with
+// the DSN extension (RFC 3461).
+type DSNParameters struct {
+	// Return is the RET parameter, "FULL" or "HDRS", or empty if none was
+	// given. With "HDRS", notifications only include the message header.
+	Return string `json:",omitempty"`
+	// EnvelopeID is the ENVID parameter, decoded from xtext.
+	EnvelopeID string `json:",omitempty"`
+	// Notify holds the NOTIFY parameter of each recipient that gave one,
+	// keyed by address. The value is either "NEVER", or some of "SUCCESS",
+	// "FAILURE", and "DELAY".
+	Notify map[string][]string `json:",omitempty"`
+}
+
+// Wants reports whether a notification of |event| ("SUCCESS", "FAILURE", or
+// "DELAY") was requested for |rcpt|. Without a NOTIFY parameter, failures
+// and delays are reported.
+func (p DSNParameters) Wants(rcpt, event string) bool {
+	notify, ok := p.Notify[strings.ToLower(rcpt)]
+	if !ok {
+		return event != "SUCCESS"
+	}
+	for _, n := range notify {
+		if n == event {
+			return true
+		}
+	}
+	return false
+}
+
+// pathParameter returns the value of the ESMTP parameter |name| that follows
+// the path in the MAIL or RCPT |line|, and whether it is present.
+func pathParameter(line, name string) (string, bool) {
+	idx := strings.Index(line, ">")
+	if idx == -1 {
+		return "", false
+	}
+	for _, param := range strings.Fields(line[idx+1:]) {
+		kv := strings.SplitN(param, "=", 2)
+		if strings.EqualFold(kv[0], name) {
+			if len(kv) == 2 {
+				return kv[1], true
+			}
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// mailDSNParameters parses the RET and ENVID parameters of a MAIL |line|.
+func mailDSNParameters(line string) (DSNParameters, ReplyLine) {
+	var p DSNParameters
+	if ret, ok := pathParameter(line, "RET"); ok {
+		p.Return = strings.ToUpper(ret)
+		if p.Return != "FULL" && p.Return != "HDRS" {
+			return p, ReplyLine{501, "5.5.4 invalid RET parameter"}
+		}
+	}
+	if envid, ok := pathParameter(line, "ENVID"); ok {
+		var err error
+		if p.EnvelopeID, err = decodeXtext(envid); err != nil || p.EnvelopeID == "" || len(p.EnvelopeID) > 100 {
+			return p, ReplyLine{501, "5.5.4 invalid ENVID parameter"}
+		}
+	}
+	return p, ReplyOK
+}
+
+// notifyParameter parses the NOTIFY parameter of a RCPT |line|. It returns
+// nil if there is none.
+func notifyParameter(line string) ([]string, ReplyLine) {
+	value, ok := pathParameter(line, "NOTIFY")
+	if !ok {
+		return nil, ReplyOK
+	}
+
+	invalid := ReplyLine{501, "5.5.4 invalid NOTIFY parameter"}
+	notify := strings.Split(strings.ToUpper(value), ",")
+	for _, n := range notify {
+		switch n {
+		case "NEVER":
+			if len(notify) != 1 {
+				return nil, invalid
+			}
+		case "SUCCESS", "FAILURE", "DELAY":
+		default:
+			return nil, invalid
+		}
+	}
+	return notify, ReplyOK
+}
+
+// isBounce reports whether |env| is a delivery status notification, which
+// has the null reverse-path or a message/delivery-status part (RFC 3464). A
+// failure to deliver one is never reported, so that notifications cannot
+// loop (RFC 5321 § 4.5.5).
+func isBounce(env Envelope) bool {
+	if env.MailFrom.Address == "" {
+		return true
+	}
+
+	header, body := message.Parse(env.Data)
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return false
+	}
+	if mediaType == "multipart/report" && strings.EqualFold(params["report-type"], "delivery-status") {
+		return true
+	}
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return false
+		}
+		if partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type")); partType == "message/delivery-status" {
+			return true
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+
+	"src.bluestatic.org/mailpopbox/logger"
+)
+
+func TestDSNParameters(t *testing.T) {
+	s := &deliveryServer{testServer: testServer{domain: "example.com"}}
+	l := runServer(t, s)
+	defer l.Close()
+
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	runTableTest(t, conn, []requestResponse{
+		{"EHLO test", 0, func(t testing.TB, conn *textproto.Conn) {
+			_, resp, err := conn.ReadResponse(250)
+			ok(t, err)
+			if !strings.Contains(resp, "DSN\n") {
+				t.Errorf("DSN not advertised: %q", resp)
+			}
+		}},
+		{"MAIL FROM:<sender@another.net> RET=BODY", 501, nil},
+		{"MAIL FROM:<sender@another.net> ENVID=abc+2", 501, nil},
+		{"MAIL FROM:<sender@another.net> RET=hdrs ENVID=abc+2Bdef", 250, nil},
+		{"RCPT TO:<one@example.com> NOTIFY=NEVER,SUCCESS", 501, nil},
+		{"RCPT TO:<one@example.com> NOTIFY=BOUNCE", 501, nil},
+		{"RCPT TO:<one@example.com> NOTIFY=never", 250, nil},
+		{"RCPT TO:<two@example.com> NOTIFY=SUCCESS,DELAY ORCPT=rfc822;two@example.com", 250, nil},
+		{"RCPT TO:<three@example.com>", 250, nil},
+		{"DATA", 0, func(t testing.TB, conn *textproto.Conn) {
+			readCodeLine(t, conn, 354)
+			ok(t, conn.PrintfLine("Subject: dsn\r\n\r\nbody\r\n."))
+			readCodeLine(t, conn, 250)
+		}},
+	})
+
+	if want, got := 1, len(s.messages); want != got {
+		t.Fatalf("Want %d message, got %d", want, got)
+	}
+	want := DSNParameters{
+		Return:     "HDRS",
+		EnvelopeID: "abc+def",
+		Notify: map[string][]string{
+			"one@example.com": {"NEVER"},
+			"two@example.com": {"SUCCESS", "DELAY"},
+		},
+	}
+	if got := s.messages[0].DSN; !reflect.DeepEqual(want, got) {
+		t.Errorf("Want DSN parameters %+v, got %+v", want, got)
+	}
+
+	cases := []struct {
+		rcpt, event string
+		wants       bool
+	}{
+		{"one@example.com", "FAILURE", false},
+		{"two@example.com", "FAILURE", false},
+		{"two@example.com", "DELAY", true},
+		{"Two@Example.com", "SUCCESS", true},
+		{"three@example.com", "FAILURE", true},
+		{"three@example.com", "DELAY", true},
+		{"three@example.com", "SUCCESS", false},
+	}
+	for _, c := range cases {
+		if want, got := c.wants, want.Wants(c.rcpt, c.event); want != got {
+			t.Errorf("%s %s: want %v, got %v", c.rcpt, c.event, want, got)
+		}
+	}
+}
+
+func TestDSNNotifyNever(t *testing.T) {
+	defer func(f func(string) ([]*net.MX, error)) {
+		lookupMX = f
+	}(lookupMX)
+	lookupMX = func(domain string) ([]*net.MX, error) {
+		return nil, fmt.Errorf("no such host %s", domain)
+	}
+
+	s := &deliveryServer{}
+	mta := mta{
+		server: s,
+		log:    logger.Nop(),
+	}
+	mta.relayAndWait(Envelope{
+		MailFrom: mail.Address{Address: "from@sender.org"},
+		RcptTo: []mail.Address{
+			{Address: "quiet@receive.net"},
+			{Address: "loud@receive.net"},
+		},
+		Data: []byte("Subject: hi\nX-Test: yes\n\nsecret body\n"),
+		ID:   "m.dsn",
+		DSN: DSNParameters{
+			Return:     "HDRS",
+			EnvelopeID: "client-id-1",
+			Notify: map[string][]string{
+				"quiet@receive.net": {"NEVER"},
+			},
+		},
+	})
+
+	if want, got := 1, len(s.messages); want != got {
+		t.Fatalf("Want %d failure notification, got %d", want, got)
+	}
+	data := s.messages[0].Data
+	if bytes.Contains(data, []byte("quiet@receive.net")) {
+		t.Errorf("Recipient with NOTIFY=NEVER was reported: %s", data)
+	}
+	if !bytes.Contains(data, []byte("Final-Recipient: rfc822; loud@receive.net")) {
+		t.Errorf("Failed recipient was not reported: %s", data)
+	}
+	if !bytes.Contains(data, []byte("Original-Envelope-ID: client-id-1")) {
+		t.Errorf("ENVID was not reported: %s", data)
+	}
+	if !bytes.Contains(data, []byte("Content-Type: text/rfc822-headers")) || !bytes.Contains(data, []byte("X-Test: yes")) {
+		t.Errorf("Header of the message was not returned: %s", data)
+	}
+	if bytes.Contains(data, []byte("secret body")) {
+		t.Errorf("Body returned with RET=HDRS: %s", data)
+	}
+}
@@ -0,0 +1,61 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package smtp
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// replyUseLHLO is the reply to HELO and EHLO from an LMTP client, which must
+// greet with LHLO instead (RFC 2033 § 4.1).
+var replyUseLHLO = ReplyLine{500, "5.5.1 use LHLO"}
+
+// deliverLMTP delivers |env| for an LMTP client and replies with the status
+// of each recipient, in the order they were accepted (RFC 2033 § 4.2). Since
+// the Server stores the mail of a mailbox together, the message is delivered
+// once for each recipient mailbox, and the recipients of a mailbox share its
+// status.
+func (conn *connection) deliverLMTP(env Envelope) {
+	var mailboxes []string
+	recipients := make(map[string][]mail.Address)
+	for _, rcpt := range env.RcptTo {
+		mailbox := conn.mailboxFor(rcpt)
+		if _, ok := recipients[mailbox]; !ok {
+			mailboxes = append(mailboxes, mailbox)
+		}
+		recipients[mailbox] = append(recipients[mailbox], rcpt)
+	}
+
+	replies := make(map[string]ReplyLine)
+	for _, mailbox := range mailboxes {
+		en := env
+		en.RcptTo = recipients[mailbox]
+		replies[mailbox] = ReplyOK
+		if reply := conn.server.DeliverMessage(en); reply != nil {
+			conn.log.Warn("message was rejected", "id", en.ID, "recipients", len(en.RcptTo))
+			replies[mailbox] = *reply
+		}
+	}
+
+	// Unlike SMTP, the transaction is over even if the message was rejected
+	// for every recipient.
+	conn.setState(stateInitial)
+	conn.resetBuffers()
+	for _, rcpt := range env.RcptTo {
+		conn.reply(replies[conn.mailboxFor(rcpt)])
+	}
+}
+
+// mailboxFor returns the mailbox that |rcpt| is delivered to, from the
+// Server's MailboxResolver or else the recipient's domain.
+func (conn *connection) mailboxFor(rcpt mail.Address) string {
+	if resolver, ok := conn.server.(MailboxResolver); ok {
+		return resolver.Mailbox(rcpt)
+	}
+	return strings.ToLower(DomainForAddress(rcpt))
+}
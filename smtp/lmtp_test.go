@@ -0,0 +1,222 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package smtp
+
+import (
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"src.bluestatic.org/mailpopbox/logger"
+)
+
+// lmtpServer accepts mail for two domains, and rejects messages to the full
+// one.
+type lmtpServer struct {
+	deliveryServer
+}
+
+func (s *lmtpServer) VerifyAddress(addr mail.Address) ReplyLine {
+	switch DomainForAddress(addr) {
+	case "example.com", "full.com":
+		return ReplyOK
+	}
+	return ReplyBadMailbox
+}
+
+func (s *lmtpServer) DeliverMessage(en Envelope) *ReplyLine {
+	if DomainForAddress(en.RcptTo[0]) == "full.com" {
+		return &ReplyLine{452, "4.2.2 mailbox full"}
+	}
+	return s.deliveryServer.DeliverMessage(en)
+}
+
+// sharedMailboxServer is an lmtpServer where example.org is stored in the
+// example.com mailbox.
+type sharedMailboxServer struct {
+	lmtpServer
+}
+
+func (s *sharedMailboxServer) VerifyAddress(addr mail.Address) ReplyLine {
+	if DomainForAddress(addr) == "example.org" {
+		return ReplyOK
+	}
+	return s.lmtpServer.VerifyAddress(addr)
+}
+
+func (s *sharedMailboxServer) Mailbox(rcpt mail.Address) string {
+	if domain := DomainForAddress(rcpt); domain != "example.org" {
+		return domain
+	}
+	return "example.com"
+}
+
+// runLMTPServer serves |s| over LMTP on a unix socket, and returns its
+// address.
+func runLMTPServer(t *testing.T, s Server) net.Addr {
+	dir, err := ioutil.TempDir("", "lmtp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	l, err := net.Listen("unix", filepath.Join(dir, "lmtp.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go AcceptConnection(conn, s, Options{LMTP: true}, logger.Nop())
+		}
+	}()
+	return l.Addr()
+}
+
+func TestLMTP(t *testing.T) {
+	s := &lmtpServer{}
+	conn := createClient(t, runLMTPServer(t, s))
+	defer conn.Close()
+	if msg := readCodeLine(t, conn, 220); !strings.Contains(msg, " LMTP ") {
+		t.Errorf("Greeting does not name LMTP: %q", msg)
+	}
+
+	runTableTest(t, conn, []requestResponse{
+		{"HELO mta.example.com", 500, nil},
+		{"EHLO mta.example.com", 500, nil},
+		{"LHLO mta.example.com", 0, func(t testing.TB, conn *textproto.Conn) {
+			_, resp, err := conn.ReadResponse(250)
+			ok(t, err)
+			if !strings.Contains(resp, "PIPELINING") {
+				t.Errorf("PIPELINING not advertised: %q", resp)
+			}
+		}},
+		// Mail from the server's own domain is delivered, not relayed.
+		{"MAIL FROM:<me@example.com>", 250, nil},
+		{"RCPT TO:<one@example.com>", 250, nil},
+		{"RCPT TO:<nobody@other.net>", 550, nil},
+		{"RCPT TO:<user@full.com>", 250, nil},
+		{"RCPT TO:<two@example.com>", 250, nil},
+		{"DATA", 0, func(t testing.TB, conn *textproto.Conn) {
+			readCodeLine(t, conn, 354)
+			ok(t, conn.PrintfLine("Subject: lmtp\r\n\r\nbody\r\n."))
+			// One reply for each accepted recipient, in order.
+			readCodeLine(t, conn, 250)
+			readCodeLine(t, conn, 452)
+			readCodeLine(t, conn, 250)
+		}},
+		// The transaction is over.
+		{"RCPT TO:<one@example.com>", 503, nil},
+		{"QUIT", 221, nil},
+	})
+
+	if want, got := 1, len(s.messages); want != got {
+		t.Fatalf("Want %d message, got %d", want, got)
+	}
+	en := s.messages[0]
+	if want, got := 2, len(en.RcptTo); want != got {
+		t.Errorf("Want %d recipients, got %v", want, en.RcptTo)
+	}
+	if en.MailFrom.Address != "me@example.com" {
+		t.Errorf("Unexpected sender: %v", en.MailFrom)
+	}
+	received := string(en.Data[:strings.Index(string(en.Data), "\r\n\t")])
+	if want := "Received: from mta.example.com (localhost)"; received != want {
+		t.Errorf("Want %q, got %q", want, received)
+	}
+	if !strings.Contains(string(en.Data), "with LMTP id") {
+		t.Errorf("Received header does not name LMTP: %q", en.Data)
+	}
+}
+
+func TestLMTPSharedMailbox(t *testing.T) {
+	s := &sharedMailboxServer{}
+	conn := createClient(t, runLMTPServer(t, s))
+	defer conn.Close()
+	readCodeLine(t, conn, 220)
+
+	runTableTest(t, conn, []requestResponse{
+		{"LHLO mta.example.com", 0, func(t testing.TB, conn *textproto.Conn) {
+			_, _, err := conn.ReadResponse(250)
+			ok(t, err)
+		}},
+		{"MAIL FROM:<sender@remote.net>", 250, nil},
+		{"RCPT TO:<one@example.com>", 250, nil},
+		{"RCPT TO:<user@full.com>", 250, nil},
+		{"RCPT TO:<alias@example.org>", 250, nil},
+		{"DATA", 0, func(t testing.TB, conn *textproto.Conn) {
+			readCodeLine(t, conn, 354)
+			ok(t, conn.PrintfLine("Subject: shared\r\n\r\nbody\r\n."))
+			readCodeLine(t, conn, 250)
+			readCodeLine(t, conn, 452)
+			readCodeLine(t, conn, 250)
+		}},
+		{"QUIT", 221, nil},
+	})
+
+	// The two domains in the shared mailbox get one copy, addressed to both.
+	if want, got := 1, len(s.messages); want != got {
+		t.Fatalf("Want %d message, got %d", want, got)
+	}
+	rcpts := s.messages[0].RcptTo
+	if len(rcpts) != 2 || rcpts[0].Address != "one@example.com" || rcpts[1].Address != "alias@example.org" {
+		t.Errorf("Want both recipients of the shared mailbox, got %v", rcpts)
+	}
+}
+
+func TestLMTPHopLimit(t *testing.T) {
+	s := &lmtpServer{}
+	conn := createClient(t, runLMTPServer(t, s))
+	defer conn.Close()
+	readCodeLine(t, conn, 220)
+
+	runTableTest(t, conn, []requestResponse{
+		{"LHLO mta.example.com", 0, func(t testing.TB, conn *textproto.Conn) {
+			_, _, err := conn.ReadResponse(250)
+			ok(t, err)
+		}},
+		{"MAIL FROM:<sender@remote.net>", 250, nil},
+		{"RCPT TO:<one@example.com>", 250, nil},
+		{"RCPT TO:<two@example.com>", 250, nil},
+		{"DATA", 0, func(t testing.TB, conn *textproto.Conn) {
+			readCodeLine(t, conn, 354)
+			hops := strings.Repeat("Received: from relay\r\n", DefaultMaxHops)
+			ok(t, conn.PrintfLine("%sSubject: loop\r\n\r\nbody\r\n.", hops))
+			// The loop is reported for each recipient.
+			readCodeLine(t, conn, 554)
+			readCodeLine(t, conn, 554)
+		}},
+		{"QUIT", 221, nil},
+	})
+
+	if want, got := 0, len(s.messages); want != got {
+		t.Errorf("Want %d messages, got %d", want, got)
+	}
+}
+
+func TestLHLOWithoutLMTP(t *testing.T) {
+	l := runServer(t, &testServer{domain: "example.com"})
+	defer l.Close()
+
+	conn := createClient(t, l.Addr())
+	defer conn.Close()
+	readCodeLine(t, conn, 220)
+	runTableTest(t, conn, []requestResponse{
+		{"LHLO mta.example.com", 500, nil},
+		{"HELO mta.example.com", 250, nil},
+	})
+}
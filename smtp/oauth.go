@@ -0,0 +1,79 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package smtp
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// bearerErrorChallenge is the base64 error challenge sent when a token is
+// rejected, per RFC 7628 §3.2.2.
+var bearerErrorChallenge = base64.StdEncoding.EncodeToString([]byte(`{"status":"invalid_token"}`))
+
+// parseBearerResponse returns the user and token from a decoded XOAUTH2 or
+// OAUTHBEARER (RFC 7628) client response.
+//
+//	XOAUTH2:     user=USER ^A auth=Bearer TOKEN ^A ^A
+//	OAUTHBEARER: n,a=USER, ^A auth=Bearer TOKEN ^A ^A
+func parseBearerResponse(mechanism, response string) (user, token string, err error) {
+	if !strings.HasSuffix(response, "\x01\x01") {
+		return "", "", errors.New("response is not terminated")
+	}
+	pairs := strings.Split(strings.TrimSuffix(response, "\x01\x01"), "\x01")
+
+	if mechanism == "OAUTHBEARER" {
+		user, err = parseGS2Header(pairs[0])
+		if err != nil {
+			return "", "", err
+		}
+		pairs = pairs[1:]
+	}
+
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return "", "", errors.New("malformed key-value pair")
+		}
+		switch kv[0] {
+		case "user":
+			if mechanism == "XOAUTH2" {
+				user = kv[1]
+			}
+		case "auth":
+			const bearer = "bearer "
+			if len(kv[1]) <= len(bearer) || !strings.EqualFold(kv[1][:len(bearer)], bearer) {
+				return "", "", errors.New("auth is not a bearer token")
+			}
+			token = kv[1][len(bearer):]
+		}
+	}
+
+	if user == "" || token == "" {
+		return "", "", errors.New("missing user or token")
+	}
+	return user, token, nil
+}
+
+// parseGS2Header returns the authorization identity from the GS2 header of an
+// OAUTHBEARER response, like "n,a=user@example.com,".
+func parseGS2Header(header string) (string, error) {
+	parts := strings.Split(header, ",")
+	if len(parts) != 3 || parts[2] != "" {
+		return "", errors.New("malformed GS2 header")
+	}
+	if parts[0] != "n" && parts[0] != "y" {
+		return "", errors.New("channel binding is not supported")
+	}
+	if !strings.HasPrefix(parts[1], "a=") {
+		return "", errors.New("GS2 header has no authorization identity")
+	}
+	// RFC 5801 §4: "," and "=" are escaped in the saslname.
+	user := strings.NewReplacer("=2C", ",", "=3D", "=").Replace(parts[1][2:])
+	return user, nil
+}
@@ -0,0 +1,76 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package smtp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"src.bluestatic.org/mailpopbox/resolver"
+)
+
+const reverseLookupTimeout = 3 * time.Second
+
+// reverseResolver looks up the hostnames of IP addresses for receive traces.
+// Lookups are bounded by a timeout, so that a slow resolver does not stall
+// the end of DATA. The answers are cached by the resolver package.
+type reverseResolver struct {
+	lookup  func(ctx context.Context, addr string) ([]string, error)
+	timeout time.Duration
+}
+
+var defaultReverseResolver = newReverseResolver(resolver.Default.LookupAddr)
+
+// lookupHost resolves names for the HELO check. It is replaced in tests.
+var lookupHost = resolver.Default.LookupHost
+
+func newReverseResolver(lookup func(context.Context, string) ([]string, error)) *reverseResolver {
+	return &reverseResolver{
+		lookup:  lookup,
+		timeout: reverseLookupTimeout,
+	}
+}
+
+// LookupAddr returns the first hostname for |ip|, or the empty string if
+// there is none or the lookup failed.
+func (r *reverseResolver) LookupAddr(ip string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	if names, err := r.lookup(ctx, ip); err == nil && len(names) > 0 {
+		return names[0]
+	}
+	return ""
+}
+
+// forwardConfirmed reports whether |name|, the rDNS name of |ip|, resolves
+// back to |ip|.
+func forwardConfirmed(name, ip string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), reverseLookupTimeout)
+	defer cancel()
+	addrs, err := lookupHost(ctx, name)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if net.ParseIP(addr).Equal(net.ParseIP(ip)) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostExists reports whether |name| has addresses. Only a name that does not
+// exist is reported false, not one whose lookup failed.
+func hostExists(name string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), reverseLookupTimeout)
+	defer cancel()
+	_, err := lookupHost(ctx, name)
+	var dnsErr *net.DNSError
+	return !errors.As(err, &dnsErr) || !dnsErr.IsNotFound
+}
@@ -0,0 +1,90 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package smtp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReverseResolverTimeout(t *testing.T) {
+	r := newReverseResolver(func(ctx context.Context, ip string) ([]string, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	r.timeout = 10 * time.Millisecond
+
+	start := time.Now()
+	if want, got := "", r.LookupAddr("192.0.2.1"); want != got {
+		t.Errorf("Want name %q, got %q", want, got)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Lookup took %v", elapsed)
+	}
+}
+
+// stubLookupHost replaces lookupHost with |hosts| for the test. Other names
+// do not exist.
+func stubLookupHost(t *testing.T, hosts map[string][]string) {
+	orig := lookupHost
+	t.Cleanup(func() { lookupHost = orig })
+	lookupHost = func(ctx context.Context, name string) ([]string, error) {
+		if addrs, ok := hosts[strings.ToLower(strings.TrimSuffix(name, "."))]; ok {
+			return addrs, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+}
+
+func TestCheckHelo(t *testing.T) {
+	defer func(r *reverseResolver) { defaultReverseResolver = r }(defaultReverseResolver)
+	defaultReverseResolver = newReverseResolver(func(ctx context.Context, ip string) ([]string, error) {
+		switch ip {
+		case "192.0.2.1":
+			return []string{"mx.example.com."}, nil
+		case "192.0.2.4":
+			return []string{"spoofed.example.com."}, nil
+		}
+		return nil, errors.New("no such host")
+	})
+	stubLookupHost(t, map[string][]string{
+		"mx.example.com":      {"192.0.2.1"},
+		"other.example.com":   {"192.0.2.8"},
+		"spoofed.example.com": {"192.0.2.8"},
+	})
+
+	cases := []struct {
+		ehlo, addr string
+		check      HeloCheck
+	}{
+		{"mx.example.com", "192.0.2.1:25", HeloCheckPass},
+		{"MX.Example.com.", "192.0.2.1:25", HeloCheckPass},
+		{"other.example.com", "192.0.2.1:25", HeloCheckFail},
+		{"mx.example.com", "192.0.2.2:25", HeloCheckNone},
+		{"[192.0.2.2]", "192.0.2.2:25", HeloCheckPass},
+		{"[192.0.2.3]", "192.0.2.2:25", HeloCheckNone},
+		{"[IPv6:2001:db8::1]", "[2001:db8::1]:25", HeloCheckPass},
+		{"192.0.2.2", "192.0.2.2:25", HeloCheckBareIP},
+		{"2001:db8::1", "[2001:db8::1]:25", HeloCheckBareIP},
+		{"nowhere.example.com", "192.0.2.1:25", HeloCheckUnresolvable},
+		// The rDNS name does not resolve back to the client.
+		{"spoofed.example.com", "192.0.2.4:25", HeloCheckNone},
+	}
+	for i, c := range cases {
+		addr, err := net.ResolveTCPAddr("tcp", c.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if check, _ := checkHelo(c.ehlo, addr); c.check != check {
+			t.Errorf("case %d, want %q, got %q", i, c.check, check)
+		}
+	}
+}
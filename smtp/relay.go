@@ -8,93 +8,781 @@ package smtp
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"mime"
 	"mime/multipart"
 	"net"
 	"net/mail"
 	"net/smtp"
 	"net/textproto"
+	"strings"
+	"sync"
 	"time"
 
-	"go.uber.org/zap"
+	"src.bluestatic.org/mailpopbox/dane"
+	"src.bluestatic.org/mailpopbox/logger"
+	"src.bluestatic.org/mailpopbox/maillog"
+	"src.bluestatic.org/mailpopbox/message"
+	"src.bluestatic.org/mailpopbox/mtasts"
+	"src.bluestatic.org/mailpopbox/resolver"
 )
 
-func (m *mta) RelayMessage(env Envelope) {
-	for _, rcptTo := range env.RcptTo {
-		sendLog := m.log.With(zap.String("address", rcptTo.Address), zap.String("id", env.ID))
+// These are replaced in tests.
+var (
+	lookupMX = func(domain string) ([]*net.MX, error) {
+		return resolver.Default.LookupMX(context.Background(), domain)
+	}
+	relayPort = "25"
+)
+
+// daneLookupTimeout bounds each DNS query made for DANE.
+const daneLookupTimeout = 10 * time.Second
+
+func (m *mta) QueueMessage(env Envelope, prepare func(*Envelope), done func(Envelope)) {
+	m.messages.submit(env.ID, func() {
+		if prepare != nil {
+			prepare(&env)
+		}
+		m.relayQueued(m.newRelayState(env), done)
+	})
+}
+
+// relayQueued makes an attempt to relay the message of |rs|, and submits the
+// next attempt to the message queue after the retry interval, if needed.
+func (m *mta) relayQueued(rs *relayState, done func(Envelope)) {
+	wait := m.relayAttempt(rs)
+	if len(rs.pending) == 0 {
+		m.opts.Maillog.Removed(rs.env.ID)
+		if done != nil {
+			done(rs.env)
+		}
+		return
+	}
+	rs.log.Info("deferring relay", "recipients", len(rs.pending), "wait", wait)
+	time.AfterFunc(wait, func() {
+		m.messages.submit(rs.env.ID, func() { m.relayQueued(rs, done) })
+	})
+}
+
+// relayState tracks a message across its relay attempts.
+type relayState struct {
+	env     Envelope
+	log     logger.Logger
+	pending []mail.Address // The recipients still to be tried.
+	attempt int
+	warned  map[string]bool // Recipients sent a delay warning.
+}
+
+func (m *mta) newRelayState(env Envelope) *relayState {
+	m.opts.Maillog.Queued(env.ID, env.MailFrom.Address, len(env.Data), len(env.RcptTo))
+	return &relayState{
+		env:     env,
+		log:     m.log.With("id", env.ID),
+		pending: env.RcptTo,
+		warned:  make(map[string]bool),
+	}
+}
+
+// relayAttempt tries to relay the message of |rs| to its pending recipients,
+// and leaves pending the ones to retry. It returns how long to wait before
+// retrying them.
+func (m *mta) relayAttempt(rs *relayState) time.Duration {
+	env, log := rs.env, rs.log
+	receiver, _ := m.server.(RelayResultReceiver)
+	rs.attempt++
+
+	var failures, delays []DSNFailure
+	var retry []mail.Address
+	var wait time.Duration
+
+	outcomes := m.relayRecipients(env, log, rs.pending)
+	for i, rcptTo := range rs.pending {
+		sendLog := log.With("address", rcptTo.Address)
+		relay, failure := outcomes[i].relay, outcomes[i].failure
+
+		delivery := maillog.Delivery{
+			ID:     env.ID,
+			To:     rcptTo.Address,
+			Relay:  relay,
+			Delay:  maillog.DelaySince(env.Received),
+			DSN:    "2.0.0",
+			Status: maillog.StatusSent,
+			Detail: "delivered",
+		}
+		if failure != nil {
+			delivery.DSN = failure.Status
+			delivery.Status = maillog.StatusBounced
+			delivery.Detail = failure.Error + ": " + failure.Detail
+		}
+
+		policy := m.opts.retryPolicy(DomainForAddress(rcptTo))
+		if failure != nil && failure.temporary && policy.canRetry(env.Received) {
+			delivery.Status = maillog.StatusDeferred
+			m.opts.Maillog.Delivery(delivery)
+
+			retry = append(retry, rcptTo)
+			if wait == 0 || policy.interval() < wait {
+				wait = policy.interval()
+			}
+			if policy.DelayWarning > 0 && !rs.warned[rcptTo.Address] && time.Since(env.Received) >= policy.DelayWarning {
+				rs.warned[rcptTo.Address] = true
+				if env.DSN.Wants(rcptTo.Address, "DELAY") {
+					delays = append(delays, *failure)
+				}
+			}
+			continue
+		}
+
+		if failure != nil {
+			if env.DSN.Wants(rcptTo.Address, "FAILURE") {
+				failures = append(failures, *failure)
+			} else {
+				sendLog.Info("failure notification not requested")
+			}
+		}
+		m.opts.Maillog.Delivery(delivery)
+
+		if receiver != nil {
+			result := RelayResult{
+				ID:        env.ID,
+				Recipient: rcptTo.Address,
+				Relay:     relay,
+				Attempts:  rs.attempt,
+				Code:      250,
+				Status:    "2.0.0",
+			}
+			if failure != nil {
+				result.Code = failure.Code
+				result.Status = failure.Status
+				result.Error = delivery.Detail
+			}
+			receiver.RelayResult(result)
+		}
+	}
+
+	if len(failures) > 0 {
+		m.deliverRelayFailure(env, log, failures, false)
+	}
+	if len(delays) > 0 {
+		m.deliverRelayFailure(env, log, delays, true)
+	}
+	rs.pending = retry
+	return wait
+}
+
+// relayOutcome is the result of relaying to one recipient.
+type relayOutcome struct {
+	relay   string
+	failure *DSNFailure
+}
+
+// relayRecipients relays |env| to each of |rcptTo| on the relay queue, and
+// returns the outcomes in the same order. Recipients in different domains are
+// relayed concurrently, and those in the same domain together, in one
+// transaction.
+func (m *mta) relayRecipients(env Envelope, log logger.Logger, rcptTo []mail.Address) []relayOutcome {
+	outcomes := make([]relayOutcome, len(rcptTo))
+	byDomain := make(map[string][]int)
+	var domains []string
+	for i, addr := range rcptTo {
+		domain := strings.ToLower(DomainForAddress(addr))
+		if _, ok := byDomain[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		byDomain[domain] = append(byDomain[domain], i)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(domains))
+	for _, domain := range domains {
+		indices := byDomain[domain]
+		m.queue.submit(domain, func() {
+			defer wg.Done()
+			domainRcpts := make([]mail.Address, len(indices))
+			for j, i := range indices {
+				domainRcpts[j] = rcptTo[i]
+			}
+			sendLog := log.With("domain", domain, "recipients", len(domainRcpts))
+			relay, failures := m.relayToRecipients(env, sendLog, domainRcpts)
+			for j, i := range indices {
+				outcomes[i] = relayOutcome{relay: relay, failure: failures[j]}
+			}
+		})
+	}
+	wg.Wait()
+	return outcomes
+}
+
+// relayToRecipients looks up the MX for |rcptTo|, which are all in one
+// domain, and sends the message to it, or sends it to the smarthost if there
+// is one. The MX hosts are tried in order of preference until one can be
+// reached, and hosts that recently could not be are skipped, as are hosts not
+// allowed by an enforced MTA-STS policy. It returns a description of the relay
+// host, and for each recipient a failure or nil on success.
+func (m *mta) relayToRecipients(env Envelope, log logger.Logger, rcptTo []mail.Address) (string, []*DSNFailure) {
+	to := make([]string, len(rcptTo))
+	for i, addr := range rcptTo {
+		to[i] = addr.Address
+	}
+
+	if sh := m.opts.Smarthost; sh != nil {
+		return m.relayMessageToHost(env, log, to, sh.Host, sh.Port, relayTLS{})
+	}
+
+	mx, failure := lookupRelayHosts(log, rcptTo[0])
+	if failure != nil {
+		return "none", failureForEach(failure, to)
+	}
 
-		domain := DomainForAddress(rcptTo)
-		mx, err := net.LookupMX(domain)
-		if err != nil || len(mx) < 1 {
-			m.deliverRelayFailure(env, sendLog, rcptTo.Address, "failed to lookup MX records", err)
-			return
+	domain := DomainForAddress(rcptTo[0])
+	policy := m.stsPolicy(log, domain)
+	rt := relayTLS{sts: policy, dane: m.secureMX(log, domain)}
+	relay, allowed := "none", 0
+	for _, host := range orderMX(mx) {
+		if policy != nil && !policy.Matches(host.Host) {
+			log.Info("MX host is not in the MTA-STS policy",
+				"mx", host.Host,
+				"mode", string(policy.Mode))
+			if policy.Mode == mtasts.ModeEnforce {
+				continue
+			}
+		}
+		allowed++
+
+		hostPort := net.JoinHostPort(host.Host, relayPort)
+		if m.dead.isDead(hostPort) {
+			log.Info("skipping unreachable host", "host", hostPort)
+			continue
+		}
+		var failures []*DSNFailure
+		relay, failures = m.relayMessageToHost(env, log, to, host.Host, relayPort, rt)
+		// A host that cannot be reached fails every recipient alike.
+		if failures[0] == nil || !failures[0].unreachable {
+			return relay, failures
+		}
+		failure = failures[0]
+		m.dead.add(hostPort)
+	}
+	if allowed == 0 {
+		log.Error("no MX host matches the MTA-STS policy")
+		return relay, failureForEach(&DSNFailure{
+			Error:     "no MX host matches the MTA-STS policy",
+			Detail:    "the MTA-STS policy of " + domain + " does not list its MX hosts",
+			Status:    "4.7.5",
+			temporary: true,
+		}, to)
+	}
+	if failure == nil {
+		log.Error("all MX hosts were recently unreachable")
+		failure = &DSNFailure{
+			Error:     "failed to dial host",
+			Detail:    "all MX hosts were recently unreachable",
+			Status:    "4.4.1",
+			temporary: true,
+		}
+	}
+	return relay, failureForEach(failure, to)
+}
+
+// failureForEach returns a copy of |failure| for each recipient in |to|.
+func failureForEach(failure *DSNFailure, to []string) []*DSNFailure {
+	failures := make([]*DSNFailure, len(to))
+	for i, rcpt := range to {
+		f := *failure
+		f.Recipient = rcpt
+		failures[i] = &f
+	}
+	return failures
+}
+
+// stsPolicy returns the MTA-STS policy of |domain|, or nil if it has none or
+// does not apply one.
+func (m *mta) stsPolicy(log logger.Logger, domain string) *mtasts.Policy {
+	if m.opts.STSPolicies == nil {
+		return nil
+	}
+	policy, err := m.opts.STSPolicies.Policy(domain)
+	if err != nil {
+		log.Warn("failed to get MTA-STS policy", "error", err)
+	}
+	if policy == nil || policy.Mode == mtasts.ModeNone {
+		return nil
+	}
+	return policy
+}
+
+// secureMX reports whether DANE applies to the MX hosts of |domain|.
+func (m *mta) secureMX(log logger.Logger, domain string) bool {
+	if m.opts.DANE == nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), daneLookupTimeout)
+	defer cancel()
+	secure, err := m.opts.DANE.SecureMX(ctx, domain)
+	if err != nil {
+		log.Warn("failed to check MX records for DANE", "error", err)
+	}
+	return secure
+}
+
+// lookupRelayHosts returns the MX hosts of the domain of |rcptTo|. A domain
+// without MX records that has an address is its own host (RFC 5321 § 5.1),
+// and a domain with a null MX does not accept mail (RFC 7505).
+func lookupRelayHosts(log logger.Logger, rcptTo mail.Address) ([]*net.MX, *DSNFailure) {
+	domain := DomainForAddress(rcptTo)
+	mx, err := lookupMX(domain)
+	var dnsErr *net.DNSError
+	if (err == nil && len(mx) == 0) || (errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		ctx, cancel := context.WithTimeout(context.Background(), reverseLookupTimeout)
+		defer cancel()
+		if _, hostErr := lookupHost(ctx, domain); hostErr != nil {
+			return nil, relayFailure(log, rcptTo.Address, "failed to lookup MX records", hostErr)
+		}
+		log.Info("no MX records, relaying to the domain's address")
+		return []*net.MX{{Host: domain}}, nil
+	}
+	if err != nil {
+		return nil, relayFailure(log, rcptTo.Address, "failed to lookup MX records", err)
+	}
+	if len(mx) == 1 && mx[0].Host == "." {
+		log.Error("domain does not accept mail", "domain", domain)
+		return nil, &DSNFailure{
+			Recipient: rcptTo.Address,
+			Error:     "domain does not accept mail",
+			Detail:    domain + " has a null MX record",
+			Status:    "5.1.10",
 		}
-		m.relayMessageToHost(env, sendLog, rcptTo.Address, mx[0].Host, "25")
 	}
+	return mx, nil
+}
+
+// relayTLS is what the recipient domain requires of the TLS connections to
+// its MX hosts.
+type relayTLS struct {
+	sts  *mtasts.Policy
+	dane bool // The domain's MX records are DNSSEC-signed.
+}
+
+func (rt relayTLS) enforceSTS() bool {
+	return rt.sts != nil && rt.sts.Mode == mtasts.ModeEnforce
 }
 
-func (m *mta) relayMessageToHost(env Envelope, log *zap.Logger, to, host, port string) {
-	from := env.MailFrom.Address
+// authMode names how the connections to a host must be authenticated for
+// |rt|. It is part of the relay pool key, so that a connection opened for a
+// domain without DANE, which may not use TLS at all, is not reused for one
+// whose MX host must be authenticated by its TLSA records.
+func (rt relayTLS) authMode() string {
+	switch {
+	case rt.dane:
+		return "dane"
+	case rt.enforceSTS():
+		return "sts"
+	}
+	return "none"
+}
+
+// relayMessageToHost sends the message for the recipients |to| to the SMTP
+// server at |host|:|port| in one transaction, reusing an idle connection to it
+// if there is one. The connection must meet |rt|. It returns a description of
+// the relay host, and for each recipient a failure or nil on success.
+func (m *mta) relayMessageToHost(env Envelope, log logger.Logger, to []string, host, port string, rt relayTLS) (string, []*DSNFailure) {
 	hostPort := net.JoinHostPort(host, port)
-	log = log.With(zap.String("host", hostPort))
+	log = log.With("host", hostPort)
+	helloName := m.helloName(env)
+	sourceIP := m.sourceIP(env)
+	key := hostPort + " " + helloName + " " + rt.authMode()
+	if sourceIP != nil {
+		key += " " + sourceIP.String()
+	}
 
-	c, err := smtp.Dial(hostPort)
+	rc := m.pool.get(key)
+	if rc != nil && rt.enforceSTS() && !rc.verified {
+		m.pool.put(key, rc)
+		rc = nil
+	}
+	if rc != nil {
+		if err := rc.c.Reset(); err != nil {
+			log.Info("discarding idle connection", "error", err)
+			rc.c.Close()
+			rc = nil
+		} else {
+			log.Debug("reusing connection", "relay", rc.relay)
+		}
+	}
+	if rc == nil {
+		var failure *DSNFailure
+		rc, failure = m.dialRelay(log, to[0], host, port, helloName, sourceIP, rt)
+		if failure != nil {
+			return rc.relay, failureForEach(failure, to)
+		}
+	}
+
+	rejected, step, err := sendMessage(rc.c, env.MailFrom.Address, to, env.Data)
+	failures := make([]*DSNFailure, len(to))
+	for i, rcptErr := range rejected {
+		if rcptErr != nil {
+			failures[i] = relayFailure(log.With("address", to[i]), to[i], "failed to RCPT TO", rcptErr)
+		}
+	}
 	if err != nil {
-		// TODO - retry, or look at other MX records
-		m.deliverRelayFailure(env, log, to, "failed to dial host", err)
-		return
+		// A rejection leaves the connection ready for the next message, but
+		// any other error means it is broken.
+		if _, ok := err.(*textproto.Error); ok {
+			m.pool.put(key, rc)
+		} else {
+			rc.c.Close()
+		}
+		failure := relayFailure(log, to[0], step, err)
+		for i, f := range failureForEach(failure, to) {
+			if failures[i] == nil {
+				failures[i] = f
+			}
+		}
+		return rc.relay, failures
 	}
-	defer c.Quit()
 
-	if err = c.Hello(m.server.Name()); err != nil {
-		m.deliverRelayFailure(env, log, to, "failed to HELO", err)
-		return
+	m.pool.put(key, rc)
+	return rc.relay, failures
+}
+
+// dialRelay connects to |host|:|port|, from |sourceIP| if it is non-nil, and
+// greets it, starting TLS if it is offered. TLS may be required by |rt|. The
+// returned relayConn describes the host even on failure.
+func (m *mta) dialRelay(log logger.Logger, to, host, port, helloName string, sourceIP net.IP, rt relayTLS) (*relayConn, *DSNFailure) {
+	hostPort := net.JoinHostPort(host, port)
+	rc := &relayConn{relay: hostPort}
+
+	var auth relayAuth
+	if m.opts.Smarthost == nil {
+		var failure *DSNFailure
+		if auth, failure = m.relayAuth(log, to, host, port, rt); failure != nil {
+			return rc, failure
+		}
 	}
 
-	if hasTls, _ := c.Extension("STARTTLS"); hasTls {
-		config := &tls.Config{ServerName: host}
-		if err = c.StartTLS(config); err != nil {
-			m.deliverRelayFailure(env, log, to, "failed to STARTTLS", err)
-			return
+	var dialer net.Dialer
+	if sourceIP != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: sourceIP}
+	}
+	var conn net.Conn
+	var err error
+	if sh := m.opts.Smarthost; sh != nil && sh.ImplicitTLS {
+		conn, err = tls.DialWithDialer(&dialer, "tcp", hostPort, sh.tlsConfig())
+	} else {
+		conn, err = dialer.Dial("tcp", hostPort)
+	}
+	if err != nil {
+		failure := relayFailure(log, to, "failed to dial host", err)
+		failure.unreachable = true
+		return rc, failure
+	}
+	if ip, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		rc.relay = fmt.Sprintf("%s[%s]:%s", host, ip, port)
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return rc, relayFailure(log, to, "failed to dial host", err)
+	}
+
+	if err = c.Hello(helloName); err != nil {
+		quitClient(c)
+		return rc, relayFailure(log, to, "failed to HELO", err)
+	}
+
+	if m.opts.Smarthost != nil {
+		if failure := m.secureSmarthost(log, c, to); failure != nil {
+			return rc, failure
 		}
+		rc.c, rc.verified = c, true
+		return rc, nil
 	}
 
-	if err = c.Mail(from); err != nil {
-		m.deliverRelayFailure(env, log, to, "failed MAIL FROM", err)
-		return
+	result := TLSResult{
+		Domain: DomainForAddressString(to),
+		Host:   host,
+		IP:     addrHost(conn.RemoteAddr()),
+		// The local address is read before StartTLS, which closes the
+		// connection on failure.
+		SendingIP: addrHost(conn.LocalAddr()),
+		STSPolicy: rt.sts,
+	}
+	for _, r := range auth.tlsa {
+		result.TLSA = append(result.TLSA, r.String())
 	}
+	hasTls, _ := c.Extension("STARTTLS")
+	if hasTls {
+		if err = c.StartTLS(auth.config); err != nil {
+			result.Failure, result.Detail = tlsFailure(err), err.Error()
+			m.reportTLSResult(result)
+			quitClient(c)
+			return rc, relayFailure(log, to, "failed to STARTTLS", err)
+		}
+		rc.verified = auth.verified
+	} else {
+		result.Failure = TLSResultStartTLSNotSupported
+	}
+	m.reportTLSResult(result)
 
-	if err = c.Rcpt(to); err != nil {
-		m.deliverRelayFailure(env, log, to, "failed to RCPT TO", err)
-		return
+	if !hasTls && auth.required != "" {
+		quitClient(c)
+		return rc, tlsRequiredFailure(log, to, "MX host does not offer STARTTLS, which "+auth.required+" requires")
 	}
 
-	wc, err := c.Data()
+	rc.c = c
+	return rc, nil
+}
+
+// relayAuth is how the TLS connection to an MX host is authenticated.
+type relayAuth struct {
+	config *tls.Config
+	// required names what requires TLS, or is empty if it is optional.
+	required string
+	// verified is whether config authenticates the host.
+	verified bool
+	// tlsa is the host's TLSA records, if DANE applies.
+	tlsa []dane.TLSA
+}
+
+// relayAuth returns how to authenticate the MX host |host|:|port|. Hosts with
+// DNSSEC-signed TLSA records are authenticated by them and must use TLS, in
+// preference to an MTA-STS policy (RFC 8461 § 2). Other hosts are verified
+// against the system roots, unless the DANEFallback is opportunistic and no
+// MTA-STS policy is enforced.
+func (m *mta) relayAuth(log logger.Logger, to, host, port string, rt relayTLS) (relayAuth, *DSNFailure) {
+	auth := relayAuth{config: &tls.Config{ServerName: host}, verified: true}
+	if rt.enforceSTS() {
+		auth.required = "its MTA-STS policy"
+	}
+	if m.opts.DANE == nil {
+		return auth, nil
+	}
+
+	if rt.dane {
+		ctx, cancel := context.WithTimeout(context.Background(), daneLookupTimeout)
+		defer cancel()
+		records, err := m.opts.DANE.LookupTLSA(ctx, host, port)
+		if err != nil {
+			// The records may exist, so the host cannot be trusted without them.
+			log.Error("failed to look up TLSA records", "error", err)
+			return auth, &DSNFailure{
+				Recipient: to,
+				Error:     "failed to look up TLSA records",
+				Detail:    err.Error(),
+				Status:    "4.7.5",
+				temporary: true,
+			}
+		}
+		if len(records) > 0 {
+			auth.tlsa = records
+			auth.required = "its TLSA records"
+			auth.config = &tls.Config{ServerName: host, InsecureSkipVerify: true}
+			usable := dane.Usable(records)
+			if len(usable) == 0 {
+				// TLS is still required, but cannot be authenticated.
+				log.Warn("no usable TLSA records")
+				auth.verified = false
+				return auth, nil
+			}
+			auth.config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				return dane.Verify(usable, host, rawCerts)
+			}
+			return auth, nil
+		}
+	}
+
+	if m.opts.DANEFallback == DANEFallbackOpportunistic && !rt.enforceSTS() {
+		auth.config.InsecureSkipVerify = true
+		auth.verified = false
+	}
+	return auth, nil
+}
+
+// secureSmarthost starts TLS with the smarthost on |c|, which is required,
+// and authenticates to it if there are credentials. The client is closed on
+// failure.
+func (m *mta) secureSmarthost(log logger.Logger, c *smtp.Client, to string) *DSNFailure {
+	sh := m.opts.Smarthost
+	if !sh.ImplicitTLS {
+		if hasTls, _ := c.Extension("STARTTLS"); !hasTls {
+			quitClient(c)
+			return tlsRequiredFailure(log, to, "smarthost does not offer STARTTLS")
+		}
+		if err := c.StartTLS(sh.tlsConfig()); err != nil {
+			quitClient(c)
+			return relayFailure(log, to, "failed to STARTTLS", err)
+		}
+	}
+	if sh.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", sh.Username, sh.Password, sh.Host)); err != nil {
+			quitClient(c)
+			return relayFailure(log, to, "failed to AUTH", err)
+		}
+	}
+	return nil
+}
+
+// tlsRequiredFailure is the temporary failure for a host that must be relayed
+// to over TLS, but that does not offer STARTTLS.
+func tlsRequiredFailure(log logger.Logger, to, detail string) *DSNFailure {
+	log.Error(detail)
+	return &DSNFailure{
+		Recipient: to,
+		Error:     "failed to STARTTLS",
+		Detail:    detail,
+		Status:    "4.7.0",
+		temporary: true,
+	}
+}
+
+// reportTLSResult passes |result| to the server, if it is a
+// TLSResultReceiver.
+func (m *mta) reportTLSResult(result TLSResult) {
+	if receiver, ok := m.server.(TLSResultReceiver); ok {
+		receiver.TLSResult(result)
+	}
+}
+
+// tlsFailure classifies a STARTTLS error as a TLSResult failure type.
+func tlsFailure(err error) string {
+	var hostErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var authorityErr x509.UnknownAuthorityError
+	switch {
+	case errors.Is(err, dane.ErrNoMatch):
+		return TLSResultTLSAInvalid
+	case errors.As(err, &hostErr):
+		return TLSResultHostMismatch
+	case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		return TLSResultExpired
+	case errors.As(err, &authorityErr):
+		return TLSResultNotTrusted
+	}
+	return TLSResultValidationFailure
+}
+
+func addrHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
 	if err != nil {
-		m.deliverRelayFailure(env, log, to, "failed to DATA", err)
-		return
+		return addr.String()
+	}
+	return host
+}
+
+// sendMessage runs a mail transaction for the recipients |to| on |c|. It
+// returns the reply to each recipient that was rejected, or nil for those
+// accepted. The message is only sent if a recipient was accepted. If the
+// transaction fails, it also returns a description of the step that failed
+// and the error.
+func sendMessage(c *smtp.Client, from string, to []string, data []byte) ([]error, string, error) {
+	if err := c.Mail(from); err != nil {
+		return nil, "failed MAIL FROM", err
 	}
 
-	_, err = wc.Write(env.Data)
+	rejected := make([]error, len(to))
+	accepted := 0
+	for i, rcpt := range to {
+		err := c.Rcpt(rcpt)
+		if _, ok := err.(*textproto.Error); ok {
+			rejected[i] = err
+			continue
+		} else if err != nil {
+			return rejected, "failed to RCPT TO", err
+		}
+		accepted++
+	}
+	if accepted == 0 {
+		return rejected, "", nil
+	}
+
+	wc, err := c.Data()
 	if err != nil {
+		return rejected, "failed to DATA", err
+	}
+
+	if _, err = wc.Write(data); err != nil {
 		wc.Close()
-		m.deliverRelayFailure(env, log, to, "failed to write DATA", err)
-		return
+		return rejected, "failed to write DATA", err
 	}
 
 	if err = wc.Close(); err != nil {
-		m.deliverRelayFailure(env, log, to, "failed to close DATA", err)
-		return
+		return rejected, "failed to close DATA", err
 	}
+	return rejected, "", nil
 }
 
-// deliverRelayFailure logs and generates a delivery status notification. It
-// writes to |log| the |errorStr| and |sendErr|, as well as preparing a new
-// message, based of |env|, delivered to |server| that reports error
-// information about the attempted delivery.
-func (m *mta) deliverRelayFailure(env Envelope, log *zap.Logger, to, errorStr string, sendErr error) {
-	log.Error(errorStr, zap.Error(sendErr))
+// quitClient ends the session on |c|, closing it even if QUIT fails.
+func quitClient(c *smtp.Client) {
+	if err := c.Quit(); err != nil {
+		c.Close()
+	}
+}
+
+func (m *mta) helloName(env Envelope) string {
+	if namer, ok := m.server.(RelayHelloNamer); ok {
+		if name := namer.RelayHelloName(env); name != "" {
+			return name
+		}
+	}
+	return m.server.Name()
+}
+
+func (m *mta) sourceIP(env Envelope) net.IP {
+	if selector, ok := m.server.(RelaySourceSelector); ok {
+		return selector.RelaySourceIP(env)
+	}
+	return nil
+}
+
+// relayFailure logs that relaying to |to| failed at the step described by
+// |errorStr|, and returns the failure for a delivery status notification.
+func relayFailure(log logger.Logger, to, errorStr string, err error) *DSNFailure {
+	log.Error(errorStr, "error", err)
+
+	// Errors without a reply, like network errors, may be temporary, but
+	// a missing domain or MX record is not.
+	failure := &DSNFailure{
+		Recipient: to,
+		Error:     errorStr,
+		Status:    "5.0.0",
+		temporary: err != nil,
+	}
+	if err != nil {
+		failure.Detail = err.Error()
+	}
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		failure.temporary = false
+	}
+	if te, ok := err.(*textproto.Error); ok {
+		failure.temporary = te.Code/100 == 4
+		if failure.temporary {
+			failure.Status = "4.0.0"
+		}
+		failure.Diagnostic = fmt.Sprintf("%d %s", te.Code, te.Msg)
+		failure.Code = te.Code
+	}
+	return failure
+}
+
+// deliverRelayFailure generates a single delivery status notification for
+// all the recipients of |env| in |failures|, and delivers it to the sender
+// via |server|. If |delayed|, the notification warns that delivery is still
+// being retried, rather than reporting that it failed.
+func (m *mta) deliverRelayFailure(env Envelope, log logger.Logger, failures []DSNFailure, delayed bool) {
+	if isBounce(env) {
+		log.Info("not sending a notification about a bounce", "recipients", len(failures))
+		return
+	}
+
+	var failedRcpts []string
+	for _, failure := range failures {
+		failedRcpts = append(failedRcpts, failure.Recipient)
+	}
 
 	buf := &bytes.Buffer{}
 	mw := multipart.NewWriter(buf)
@@ -102,56 +790,117 @@ func (m *mta) deliverRelayFailure(env Envelope, log *zap.Logger, to, errorStr st
 	now := time.Now()
 
 	failure := Envelope{
-		MailFrom: mail.Address{"mailpopbox", "mailbox@" + DomainForAddress(env.MailFrom)},
+		MailFrom: mail.Address{Name: "mailpopbox", Address: "mailbox@" + DomainForAddress(env.MailFrom)},
 		RcptTo:   []mail.Address{env.MailFrom},
-		ID:       generateEnvelopeId("f", now),
+		ID:       GenerateEnvelopeId("f", now),
 		Received: now,
 	}
 
-	fmt.Fprintf(buf, "From: %s\n", failure.MailFrom.String())
-	fmt.Fprintf(buf, "To: %s\n", failure.RcptTo[0].String())
-	fmt.Fprintf(buf, "Subject: Delivery Status Notification (Failure)\n")
-	fmt.Fprintf(buf, "X-Failed-Recipients: %s\n", to)
-	fmt.Fprintf(buf, "Message-ID: %s\n", failure.ID)
-	fmt.Fprintf(buf, "Date: %s\n", now.Format(time.RFC1123Z))
-	fmt.Fprintf(buf, "Content-Type: multipart/report; boundary=%s; report-type=delivery-status\n\n", mw.Boundary())
+	header := &message.Header{}
+	header.Add("From", failure.MailFrom.String())
+	header.Add("To", failure.RcptTo[0].String())
+	if delayed {
+		header.Add("Subject", "Delivery Status Notification (Delay)")
+	} else {
+		header.Add("Subject", "Delivery Status Notification (Failure)")
+		header.Add("X-Failed-Recipients", strings.Join(failedRcpts, ", "))
+	}
+	header.Add("Message-ID", failure.ID)
+	header.Add("Date", now.Format(time.RFC1123Z))
+	header.Add("Content-Type", mime.FormatMediaType("multipart/report", map[string]string{
+		"boundary":    mw.Boundary(),
+		"report-type": "delivery-status",
+	}))
+	header.WriteTo(buf)
 
 	tw, err := mw.CreatePart(textproto.MIMEHeader{
 		"Content-Type": []string{"text/plain; charset=UTF-8"},
 	})
 	if err != nil {
-		log.Error("failed to create multipart 0", zap.Error(err))
+		log.Error("failed to create multipart 0", "error", err)
+		return
+	}
+	orig, _ := message.Parse(env.Data)
+	data := DSNTemplateData{
+		Hostname:   m.server.Name(),
+		EnvelopeID: env.ID,
+		MailFrom:   env.MailFrom.Address,
+		Subject:    orig.Get("Subject"),
+		Received:   env.Received,
+		TLS:        env.TLS,
+		Failures:   failures,
+	}
+	templateName, action := TemplateDSN, "failed"
+	if delayed {
+		templateName, action = TemplateDSNDelay, "delayed"
+	}
+	if err := m.opts.Templates.Execute(tw, templateName, messageLanguages(orig), data); err != nil {
+		log.Error("failed to execute DSN template", "error", err)
 		return
 	}
-	fmt.Fprintf(tw, "* * * Delivery Failure * * *\n\n")
-	fmt.Fprintf(tw, "The server failed to relay the message:\n\n%s:\n%s\n", errorStr, sendErr.Error())
 
 	sw, err := mw.CreatePart(textproto.MIMEHeader{
 		"Content-Type": []string{"message/delivery-status"},
 	})
 	if err != nil {
-		log.Error("failed to create multipart 1", zap.Error(err))
+		log.Error("failed to create multipart 1", "error", err)
 		return
 	}
-	fmt.Fprintf(sw, "Original-Envelope-ID: %s\n", env.ID)
+	envelopeID := env.ID
+	if env.DSN.EnvelopeID != "" {
+		envelopeID = env.DSN.EnvelopeID
+	}
+	fmt.Fprintf(sw, "Original-Envelope-ID: %s\n", envelopeID)
 	fmt.Fprintf(sw, "Reporting-UA: %s\n", env.EHLO)
 	if env.RemoteAddr != nil {
 		fmt.Fprintf(sw, "Reporting-MTA: dns; %s\n", lookupRemoteHost(env.RemoteAddr))
 	}
 	fmt.Fprintf(sw, "Date: %s\n", env.Received.Format(time.RFC1123Z))
+	fmt.Fprintf(sw, "X-Mailpopbox-Received-TLS: %s\n", env.TLS)
+	for _, failure := range failures {
+		fmt.Fprintf(sw, "\nFinal-Recipient: rfc822; %s\n", failure.Recipient)
+		fmt.Fprintf(sw, "Action: %s\n", action)
+		fmt.Fprintf(sw, "Status: %s\n", failure.Status)
+		if failure.Diagnostic != "" {
+			fmt.Fprintf(sw, "Diagnostic-Code: smtp; %s\n", failure.Diagnostic)
+		}
+	}
 
+	// With RET=HDRS, only the header of the original message is returned.
+	returnType, returnData := "message/rfc822", env.Data
+	if env.DSN.Return == "HDRS" {
+		returnType, returnData = "text/rfc822-headers", orig.Bytes()
+	}
 	ocw, err := mw.CreatePart(textproto.MIMEHeader{
-		"Content-Type": []string{"message/rfc822"},
+		"Content-Type": []string{returnType},
 	})
 	if err != nil {
-		log.Error("failed to create multipart 2", zap.Error(err))
+		log.Error("failed to create multipart 2", "error", err)
 		return
 	}
 
-	ocw.Write(env.Data)
+	ocw.Write(returnData)
 
 	mw.Close()
 
 	failure.Data = buf.Bytes()
 	m.server.DeliverMessage(failure)
 }
+
+// messageLanguages returns the languages that a reply to the message should
+// prefer, from its Accept-Language and Content-Language fields.
+func messageLanguages(h *message.Header) []string {
+	var langs []string
+	for _, field := range []string{"Accept-Language", "Content-Language"} {
+		for _, lang := range strings.Split(h.Get(field), ",") {
+			// Drop any quality value, e.g. "de;q=0.8".
+			if idx := strings.IndexByte(lang, ';'); idx != -1 {
+				lang = lang[:idx]
+			}
+			if lang = strings.TrimSpace(lang); lang != "" {
+				langs = append(langs, lang)
+			}
+		}
+	}
+	return langs
+}
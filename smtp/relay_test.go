@@ -8,16 +8,27 @@ package smtp
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io/ioutil"
 	"mime"
 	"mime/multipart"
 	"net"
 	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
-	"go.uber.org/zap"
+	"src.bluestatic.org/mailpopbox/dane"
+	"src.bluestatic.org/mailpopbox/logger"
+	"src.bluestatic.org/mailpopbox/mtasts"
 )
 
 type deliveryServer struct {
@@ -47,9 +58,9 @@ func TestRelayRoundTrip(t *testing.T) {
 	host, port, _ := net.SplitHostPort(l.Addr().String())
 	mta := mta{
 		server: s,
-		log:    zap.NewNop(),
+		log:    logger.Nop(),
 	}
-	mta.relayMessageToHost(env, zap.NewNop(), env.RcptTo[0].Address, host, port)
+	mta.relayMessageToHost(env, logger.Nop(), []string{env.RcptTo[0].Address}, host, port, relayTLS{})
 
 	if want, got := 1, len(s.messages); want != got {
 		t.Errorf("Want %d message to be delivered, got %d", want, got)
@@ -83,16 +94,16 @@ func TestDeliveryFailureMessage(t *testing.T) {
 		Data:       []byte("Message\n"),
 		ID:         "m.willfail",
 		EHLO:       "mx.receive.net",
-		RemoteAddr: &net.IPAddr{net.IPv4(127, 0, 0, 1), ""},
+		RemoteAddr: &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)},
 	}
 
 	errorStr1 := "internal message"
 	errorStr2 := "general error 122"
 	mta := mta{
 		server: s,
-		log:    zap.NewNop(),
+		log:    logger.Nop(),
 	}
-	mta.deliverRelayFailure(env, zap.NewNop(), env.RcptTo[0].Address, errorStr1, fmt.Errorf(errorStr2))
+	mta.deliverRelayFailure(env, logger.Nop(), []DSNFailure{*relayFailure(logger.Nop(), env.RcptTo[0].Address, errorStr1, fmt.Errorf(errorStr2))}, false)
 
 	if want, got := 1, len(s.messages); want != got {
 		t.Errorf("Want %d failure notification, got %d", want, got)
@@ -217,3 +228,1077 @@ func TestDeliveryFailureMessage(t *testing.T) {
 		t.Errorf("Byte content of original message does not match")
 	}
 }
+
+func TestDeliveryFailureTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "dsn.tmpl"), []byte("Default {{.Subject}}"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "dsn.de.tmpl"), []byte("Zustellung an{{range .Failures}} {{.Recipient}}{{end}} fehlgeschlagen"), 0600)
+
+	templates, err := LoadTemplates(dir)
+	if err != nil {
+		t.Fatalf("Failed to load templates: %v", err)
+	}
+
+	cases := []struct {
+		data string
+		want string
+	}{
+		{"Subject: Hello\n\nMessage\n", "Default Hello"},
+		{"Subject: Hallo\nContent-Language: de-DE\n\nNachricht\n", "Zustellung an to@receive.net fehlgeschlagen"},
+		{"Subject: Bonjour\nAccept-Language: fr, de;q=0.5\n\nMessage\n", "Zustellung an to@receive.net fehlgeschlagen"},
+	}
+	for i, c := range cases {
+		s := &deliveryServer{}
+		mta := mta{
+			server: s,
+			opts:   MTAOptions{Templates: templates},
+			log:    logger.Nop(),
+		}
+		env := Envelope{
+			MailFrom: mail.Address{Address: "from@sender.org"},
+			RcptTo:   []mail.Address{{Address: "to@receive.net"}},
+			Data:     []byte(c.data),
+			ID:       "m.willfail",
+		}
+		mta.deliverRelayFailure(env, logger.Nop(), []DSNFailure{{Recipient: env.RcptTo[0].Address, Error: "failed"}}, false)
+
+		if want, got := 1, len(s.messages); want != got {
+			t.Errorf("Case %d: want %d failure notification, got %d", i, want, got)
+			continue
+		}
+		if !bytes.Contains(s.messages[0].Data, []byte(c.want)) {
+			t.Errorf("Case %d: missing %q in %q", i, c.want, s.messages[0].Data)
+		}
+	}
+}
+
+func TestDeliveryFailureOfBounce(t *testing.T) {
+	report := "Content-Type: multipart/report; report-type=delivery-status; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nFailed.\r\n" +
+		"--b\r\nContent-Type: message/delivery-status\r\n\r\nStatus: 5.0.0\r\n" +
+		"--b--\r\n"
+	forwarded := "Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nSee below.\r\n" +
+		"--b\r\nContent-Type: message/delivery-status\r\n\r\nStatus: 5.0.0\r\n" +
+		"--b--\r\n"
+	mixed := "Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nHello.\r\n" +
+		"--b--\r\n"
+
+	cases := []struct {
+		from   string
+		data   string
+		bounce bool
+	}{
+		{"", "Subject: failed\r\n\r\nbody\r\n", true},
+		{"from@sender.org", report, true},
+		{"from@sender.org", forwarded, true},
+		{"from@sender.org", mixed, false},
+		{"from@sender.org", "Subject: hello\r\n\r\nbody\r\n", false},
+	}
+	for i, c := range cases {
+		s := &deliveryServer{}
+		mta := mta{
+			server: s,
+			log:    logger.Nop(),
+		}
+		env := Envelope{
+			MailFrom: mail.Address{Address: c.from},
+			RcptTo:   []mail.Address{{Address: "to@receive.net"}},
+			Data:     []byte(c.data),
+			ID:       "m.willfail",
+		}
+		mta.deliverRelayFailure(env, logger.Nop(), []DSNFailure{{Recipient: env.RcptTo[0].Address, Error: "failed"}}, false)
+
+		want := 1
+		if c.bounce {
+			want = 0
+		}
+		if got := len(s.messages); want != got {
+			t.Errorf("Case %d: want %d failure notifications, got %d", i, want, got)
+		}
+	}
+}
+
+func TestDeliveryFailureMultipleRecipients(t *testing.T) {
+	s := &deliveryServer{}
+
+	env := Envelope{
+		MailFrom: mail.Address{Address: "from@sender.org"},
+		RcptTo: []mail.Address{
+			{Address: "one@receive.net"},
+			{Address: "two@other.net"},
+			{Address: "three@other.net"},
+		},
+		Data: []byte("Message\n"),
+		ID:   "m.willfail",
+	}
+
+	mta := mta{
+		server: s,
+		log:    logger.Nop(),
+	}
+	mta.deliverRelayFailure(env, logger.Nop(), []DSNFailure{
+		*relayFailure(logger.Nop(), "one@receive.net", "failed to dial host", fmt.Errorf("connection refused")),
+		*relayFailure(logger.Nop(), "three@other.net", "failed to RCPT TO", &textproto.Error{Code: 450, Msg: "mailbox busy"}),
+	}, false)
+
+	if want, got := 1, len(s.messages); want != got {
+		t.Fatalf("Want %d failure notification, got %d", want, got)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(s.messages[0].Data))
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	if want, got := "one@receive.net, three@other.net", msg.Header.Get("X-Failed-Recipients"); want != got {
+		t.Errorf("Want X-Failed-Recipients %q, got %q", want, got)
+	}
+
+	_, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	mpr := multipart.NewReader(msg.Body, params["boundary"])
+	mpr.NextPart()
+	part, err := mpr.NextPart()
+	if err != nil {
+		t.Fatalf("Error reading part 1: %v", err)
+	}
+	content, _ := ioutil.ReadAll(part)
+	status := string(content)
+
+	for _, want := range []string{
+		"\nFinal-Recipient: rfc822; one@receive.net\nAction: failed\nStatus: 5.0.0\n",
+		"\nFinal-Recipient: rfc822; three@other.net\nAction: failed\nStatus: 4.0.0\nDiagnostic-Code: smtp; 450 mailbox busy\n",
+	} {
+		if !strings.Contains(status, want) {
+			t.Errorf("Missing %q in %q", want, status)
+		}
+	}
+	if strings.Contains(status, "two@other.net") {
+		t.Errorf("Successful recipient should not be reported in %q", status)
+	}
+}
+
+type relayResultServer struct {
+	deliveryServer
+	results []RelayResult
+}
+
+func (s *relayResultServer) RelayResult(r RelayResult) {
+	s.results = append(s.results, r)
+}
+
+func TestRelayResult(t *testing.T) {
+	dest := &deliveryServer{
+		testServer: testServer{domain: "receive.net", blockList: []string{"bad@receive.net"}},
+	}
+	l := runServer(t, dest)
+	defer l.Close()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	defer func(f func(string) ([]*net.MX, error), p string) {
+		lookupMX, relayPort = f, p
+	}(lookupMX, relayPort)
+	lookupMX = func(domain string) ([]*net.MX, error) {
+		if domain == "receive.net" {
+			return []*net.MX{{Host: host}}, nil
+		}
+		return nil, fmt.Errorf("no such host %s", domain)
+	}
+	relayPort = port
+
+	s := &relayResultServer{}
+	mta := mta{
+		server: s,
+		log:    logger.Nop(),
+	}
+	mta.relayAndWait(Envelope{
+		MailFrom: mail.Address{Address: "from@sender.org"},
+		RcptTo: []mail.Address{
+			{Address: "to@receive.net"},
+			{Address: "bad@receive.net"},
+			{Address: "to@nowhere.net"},
+		},
+		Data: []byte("Subject: hi\r\n\r\nbody\r\n"),
+		ID:   "m.relay",
+	})
+
+	if want, got := 3, len(s.results); want != got {
+		t.Fatalf("Want %d results, got %d", want, got)
+	}
+
+	cases := []struct {
+		recipient string
+		delivered bool
+		code      int
+		status    string
+		relay     string
+	}{
+		{"to@receive.net", true, 250, "2.0.0", host + "[" + host + "]:" + port},
+		{"bad@receive.net", false, 550, "5.0.0", host + "[" + host + "]:" + port},
+		{"to@nowhere.net", false, 0, "5.0.0", "none"},
+	}
+	for i, c := range cases {
+		r := s.results[i]
+		if want, got := "m.relay", r.ID; want != got {
+			t.Errorf("%d: want ID %q, got %q", i, want, got)
+		}
+		if want, got := c.recipient, r.Recipient; want != got {
+			t.Errorf("%d: want recipient %q, got %q", i, want, got)
+		}
+		if want, got := c.delivered, r.Delivered(); want != got {
+			t.Errorf("%d: want delivered %v, got %v (%s)", i, want, got, r.Error)
+		}
+		if want, got := c.code, r.Code; want != got {
+			t.Errorf("%d: want code %d, got %d", i, want, got)
+		}
+		if want, got := c.status, r.Status; want != got {
+			t.Errorf("%d: want status %q, got %q", i, want, got)
+		}
+		if want, got := c.relay, r.Relay; want != got {
+			t.Errorf("%d: want relay %q, got %q", i, want, got)
+		}
+		if want, got := 1, r.Attempts; want != got {
+			t.Errorf("%d: want %d attempts, got %d", i, want, got)
+		}
+	}
+
+	// The two failures are reported to the sender.
+	if want, got := 1, len(s.messages); want != got {
+		t.Errorf("Want %d failure notification, got %d", want, got)
+	}
+}
+
+func TestRelaySharedTransaction(t *testing.T) {
+	dest := &deliveryServer{
+		testServer: testServer{domain: "receive.net", blockList: []string{"bad@receive.net"}},
+	}
+	l := runServer(t, dest)
+	defer l.Close()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	defer func(f func(string) ([]*net.MX, error), p string) {
+		lookupMX, relayPort = f, p
+	}(lookupMX, relayPort)
+	lookups := 0
+	lookupMX = func(domain string) ([]*net.MX, error) {
+		lookups++
+		return []*net.MX{{Host: host}}, nil
+	}
+	relayPort = port
+
+	s := &relayResultServer{}
+	mta := NewMTA(s, MTAOptions{}, logger.Nop()).(*mta)
+	mta.relayAndWait(Envelope{
+		MailFrom: mail.Address{Address: "from@sender.org"},
+		RcptTo: []mail.Address{
+			{Address: "a@receive.net"},
+			{Address: "bad@receive.net"},
+			{Address: "b@Receive.net"},
+		},
+		Data: []byte("Subject: hi\r\n\r\nbody\r\n"),
+		ID:   "m.shared",
+	})
+
+	// The accepted recipients get one copy of the message.
+	if want, got := 1, len(dest.messages); want != got {
+		t.Fatalf("Want %d messages, got %d", want, got)
+	}
+	received := dest.messages[0]
+	if want, got := 2, len(received.RcptTo); want != got {
+		t.Fatalf("Want %d recipients, got %d", want, got)
+	}
+	if want, got := "b@receive.net", received.RcptTo[1].Address; want != got {
+		t.Errorf("Want recipient %q, got %q", want, got)
+	}
+	if want, got := 1, len(s.messages); want != got {
+		t.Errorf("Want %d failure notification, got %d", want, got)
+	}
+	if want, got := 1, lookups; want != got {
+		t.Errorf("Want %d MX lookup, got %d", want, got)
+	}
+
+	if want, got := 3, len(s.results); want != got {
+		t.Fatalf("Want %d results, got %d", want, got)
+	}
+	for i, delivered := range []bool{true, false, true} {
+		if want, got := delivered, s.results[i].Delivered(); want != got {
+			t.Errorf("%d: want delivered %v, got %v (%s)", i, want, got, s.results[i].Error)
+		}
+	}
+}
+
+func TestRelayMXFailover(t *testing.T) {
+	dest := &deliveryServer{
+		testServer: testServer{domain: "receive.net"},
+	}
+	l := runServer(t, dest)
+	defer l.Close()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	defer func(f func(string) ([]*net.MX, error), p string) {
+		lookupMX, relayPort = f, p
+	}(lookupMX, relayPort)
+	// Nothing listens on the preferred host, which is on the loopback network.
+	lookupMX = func(domain string) ([]*net.MX, error) {
+		return []*net.MX{{Host: host, Pref: 20}, {Host: "127.0.0.2", Pref: 10}}, nil
+	}
+	relayPort = port
+
+	s := &relayResultServer{}
+	mta := NewMTA(s, MTAOptions{}, logger.Nop()).(*mta)
+	for _, id := range []string{"m.1", "m.2"} {
+		mta.relayAndWait(Envelope{
+			MailFrom: mail.Address{Address: "from@sender.org"},
+			RcptTo:   []mail.Address{{Address: "to@receive.net"}},
+			Data:     []byte("Subject: hi\r\n\r\nbody\r\n"),
+			ID:       id,
+		})
+	}
+
+	if want, got := 2, len(dest.messages); want != got {
+		t.Fatalf("Want %d messages delivered, got %d", want, got)
+	}
+	for _, r := range s.results {
+		if !r.Delivered() {
+			t.Errorf("Want %s delivered, got %s", r.ID, r.Error)
+		}
+	}
+	if !mta.dead.isDead(net.JoinHostPort("127.0.0.2", port)) {
+		t.Errorf("Want unreachable host remembered")
+	}
+}
+
+func TestRelayImplicitMX(t *testing.T) {
+	dest := &deliveryServer{
+		testServer: testServer{domain: "localhost"},
+	}
+	l := runServer(t, dest)
+	defer l.Close()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	defer func(f func(string) ([]*net.MX, error), p string) {
+		lookupMX, relayPort = f, p
+	}(lookupMX, relayPort)
+	lookupMX = func(domain string) ([]*net.MX, error) {
+		return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+	}
+	relayPort = port
+	stubLookupHost(t, map[string][]string{"localhost": {"127.0.0.1"}})
+
+	s := &relayResultServer{}
+	mta := NewMTA(s, MTAOptions{}, logger.Nop()).(*mta)
+	mta.relayAndWait(Envelope{
+		MailFrom: mail.Address{Address: "from@sender.org"},
+		RcptTo: []mail.Address{
+			{Address: "to@localhost"},
+			{Address: "to@nowhere.net"},
+		},
+		Data: []byte("Subject: hi\r\n\r\nbody\r\n"),
+		ID:   "m.implicit",
+	})
+
+	if want, got := 1, len(dest.messages); want != got {
+		t.Fatalf("Want %d messages delivered, got %d", want, got)
+	}
+	if want, got := 2, len(s.results); want != got {
+		t.Fatalf("Want %d results, got %d", want, got)
+	}
+	if !s.results[0].Delivered() {
+		t.Errorf("Want delivery to the domain's address, got %s", s.results[0].Error)
+	}
+	if want, got := "5.0.0", s.results[1].Status; want != got {
+		t.Errorf("Want status %q for a domain without an address, got %q", want, got)
+	}
+}
+
+func TestRelayNullMX(t *testing.T) {
+	defer func(f func(string) ([]*net.MX, error)) {
+		lookupMX = f
+	}(lookupMX)
+	lookupMX = func(domain string) ([]*net.MX, error) {
+		return []*net.MX{{Host: ".", Pref: 0}}, nil
+	}
+
+	s := &relayResultServer{}
+	mta := NewMTA(s, MTAOptions{}, logger.Nop()).(*mta)
+	mta.relayAndWait(Envelope{
+		MailFrom: mail.Address{Address: "from@sender.org"},
+		RcptTo:   []mail.Address{{Address: "to@receive.net"}},
+		Data:     []byte("Subject: hi\r\n\r\nbody\r\n"),
+		ID:       "m.null",
+	})
+
+	if want, got := 1, len(s.results); want != got {
+		t.Fatalf("Want %d results, got %d", want, got)
+	}
+	r := s.results[0]
+	if r.Delivered() {
+		t.Errorf("Want delivery to a null MX to fail")
+	}
+	if want, got := "5.1.10", r.Status; want != got {
+		t.Errorf("Want status %q, got %q", want, got)
+	}
+	if want, got := 1, r.Attempts; want != got {
+		t.Errorf("Want %d attempt, got %d", want, got)
+	}
+	if want, got := 1, len(s.messages); want != got {
+		t.Errorf("Want %d failure notification, got %d", want, got)
+	}
+}
+
+func TestRelaySmarthost(t *testing.T) {
+	smarthost := &testServer{
+		domain:    "smarthost.net",
+		tlsConfig: getTLSConfig(t),
+		userAuth:  &userAuth{authc: "user@smarthost.net", passwd: "secret"},
+	}
+	l := runServer(t, smarthost)
+	defer l.Close()
+
+	defer func(f func(string) ([]*net.MX, error)) {
+		lookupMX = f
+	}(lookupMX)
+	lookupMX = func(domain string) ([]*net.MX, error) {
+		t.Errorf("Unexpected MX lookup for %s", domain)
+		return nil, fmt.Errorf("no such host %s", domain)
+	}
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	s := &relayResultServer{}
+	mta := NewMTA(s, MTAOptions{
+		Smarthost: &Smarthost{
+			Host:      host,
+			Port:      port,
+			Username:  "user@smarthost.net",
+			Password:  "secret",
+			TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}, logger.Nop()).(*mta)
+	mta.relayAndWait(Envelope{
+		MailFrom: mail.Address{Address: "from@smarthost.net"},
+		RcptTo:   []mail.Address{{Address: "to@receive.net"}},
+		Data:     []byte("Subject: hi\r\n\r\nbody\r\n"),
+		ID:       "m.smarthost",
+	})
+
+	if want, got := 1, len(smarthost.relayed); want != got {
+		t.Fatalf("Want %d message relayed by the smarthost, got %d", want, got)
+	}
+	if want, got := "to@receive.net", smarthost.relayed[0].RcptTo[0].Address; want != got {
+		t.Errorf("Want recipient %q, got %q", want, got)
+	}
+	if want, got := 1, len(s.results); want != got {
+		t.Fatalf("Want %d result, got %d", want, got)
+	}
+	if !s.results[0].Delivered() {
+		t.Errorf("Want delivered, got %s", s.results[0].Error)
+	}
+}
+
+func TestRelaySmarthostRequiresTLS(t *testing.T) {
+	smarthost := &testServer{domain: "smarthost.net"}
+	l := runServer(t, smarthost)
+	defer l.Close()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	s := &relayResultServer{}
+	mta := NewMTA(s, MTAOptions{
+		Smarthost: &Smarthost{Host: host, Port: port},
+	}, logger.Nop()).(*mta)
+	mta.relayAndWait(Envelope{
+		MailFrom: mail.Address{Address: "from@sender.org"},
+		RcptTo:   []mail.Address{{Address: "to@receive.net"}},
+		Data:     []byte("Subject: hi\r\n\r\nbody\r\n"),
+		ID:       "m.plaintext",
+	})
+
+	if want, got := 0, len(smarthost.relayed); want != got {
+		t.Errorf("Want %d messages relayed, got %d", want, got)
+	}
+	if want, got := 1, len(s.results); want != got {
+		t.Fatalf("Want %d result, got %d", want, got)
+	}
+	if want, got := "4.7.0", s.results[0].Status; want != got {
+		t.Errorf("Want status %q, got %q", want, got)
+	}
+}
+
+type stsPolicies map[string]*mtasts.Policy
+
+func (p stsPolicies) Policy(domain string) (*mtasts.Policy, error) {
+	return p[domain], nil
+}
+
+func TestRelayMTASTS(t *testing.T) {
+	dest := &deliveryServer{
+		testServer: testServer{domain: "receive.net"},
+	}
+	l := runServer(t, dest)
+	defer l.Close()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	defer func(f func(string) ([]*net.MX, error), p string) {
+		lookupMX, relayPort = f, p
+	}(lookupMX, relayPort)
+	lookupMX = func(domain string) ([]*net.MX, error) {
+		return []*net.MX{{Host: host, Pref: 10}}, nil
+	}
+	relayPort = port
+
+	cases := []struct {
+		policy    *mtasts.Policy
+		delivered bool
+		status    string
+	}{
+		{nil, true, ""},
+		{&mtasts.Policy{Mode: mtasts.ModeTesting, MX: []string{"mx.receive.net"}}, true, ""},
+		{&mtasts.Policy{Mode: mtasts.ModeNone}, true, ""},
+		// The test server does not offer STARTTLS.
+		{&mtasts.Policy{Mode: mtasts.ModeEnforce, MX: []string{host}}, false, "4.7.0"},
+		{&mtasts.Policy{Mode: mtasts.ModeEnforce, MX: []string{"mx.receive.net"}}, false, "4.7.5"},
+	}
+	for i, c := range cases {
+		dest.messages = nil
+		s := &relayResultServer{}
+		mta := NewMTA(s, MTAOptions{
+			STSPolicies: stsPolicies{"receive.net": c.policy},
+		}, logger.Nop()).(*mta)
+		mta.relayAndWait(Envelope{
+			MailFrom: mail.Address{Address: "from@sender.org"},
+			RcptTo:   []mail.Address{{Address: "to@receive.net"}},
+			Data:     []byte("Subject: hi\r\n\r\nbody\r\n"),
+			ID:       "m.sts",
+		})
+
+		if want, got := 1, len(s.results); want != got {
+			t.Fatalf("%d: want %d result, got %d", i, want, got)
+		}
+		r := s.results[0]
+		if want, got := c.delivered, r.Delivered(); want != got {
+			t.Errorf("%d: want delivered %v, got %v (%s)", i, want, got, r.Error)
+		}
+		if want, got := c.status, r.Status; !c.delivered && want != got {
+			t.Errorf("%d: want status %q, got %q", i, want, got)
+		}
+		if want, got := c.delivered, len(dest.messages) == 1; want != got {
+			t.Errorf("%d: want message received %v, got %v", i, want, got)
+		}
+	}
+}
+
+type tlsResultServer struct {
+	relayResultServer
+	tlsResults []TLSResult
+}
+
+func (s *tlsResultServer) TLSResult(r TLSResult) {
+	s.tlsResults = append(s.tlsResults, r)
+}
+
+func TestRelayTLSResult(t *testing.T) {
+	plain := runServer(t, &deliveryServer{testServer: testServer{domain: "plain.net"}})
+	defer plain.Close()
+	// The test certificate has expired.
+	expired := runServer(t, &deliveryServer{testServer: testServer{domain: "expired.net", tlsConfig: getTLSConfig(t)}})
+	defer expired.Close()
+
+	defer func(f func(string) ([]*net.MX, error), p string) {
+		lookupMX, relayPort = f, p
+	}(lookupMX, relayPort)
+	lookupMX = func(domain string) ([]*net.MX, error) {
+		return []*net.MX{{Host: "localhost"}}, nil
+	}
+
+	s := &tlsResultServer{}
+	mta := mta{server: s, log: logger.Nop()}
+	for _, l := range []net.Listener{plain, expired} {
+		_, relayPort, _ = net.SplitHostPort(l.Addr().String())
+		mta.relayAndWait(Envelope{
+			MailFrom: mail.Address{Address: "from@sender.org"},
+			RcptTo:   []mail.Address{{Address: "to@dest.net"}},
+			Data:     []byte("Subject: hi\r\n\r\nbody\r\n"),
+			ID:       "m.tls",
+		})
+	}
+
+	if want, got := 2, len(s.tlsResults); want != got {
+		t.Fatalf("Want %d TLS results, got %v", want, s.tlsResults)
+	}
+	for i, want := range []string{TLSResultStartTLSNotSupported, TLSResultExpired} {
+		r := s.tlsResults[i]
+		if got := r.Failure; want != got {
+			t.Errorf("%d: want failure %q, got %q (%s)", i, want, got, r.Detail)
+		}
+		if r.Domain != "dest.net" || r.Host != "localhost" || r.IP == "" || r.SendingIP == "" {
+			t.Errorf("%d: incomplete result %+v", i, r)
+		}
+	}
+}
+
+func TestRelayRetry(t *testing.T) {
+	dest := &deliveryServer{
+		testServer: testServer{domain: "receive.net"},
+	}
+	l := runServer(t, dest)
+	defer l.Close()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	defer func(f func(string) ([]*net.MX, error), p string) {
+		lookupMX, relayPort = f, p
+	}(lookupMX, relayPort)
+	lookups := 0
+	lookupMX = func(domain string) ([]*net.MX, error) {
+		if domain == "receive.net" {
+			lookups++
+			if lookups < 3 {
+				return nil, fmt.Errorf("temporary lookup failure")
+			}
+			return []*net.MX{{Host: host}}, nil
+		}
+		return nil, fmt.Errorf("temporary lookup failure")
+	}
+	relayPort = port
+
+	s := &relayResultServer{}
+	mta := mta{
+		server: s,
+		log:    logger.Nop(),
+		opts: MTAOptions{
+			Retry: RetryPolicy{
+				Retry:        time.Minute,
+				Interval:     10 * time.Millisecond,
+				DelayWarning: time.Nanosecond,
+			},
+			DomainRetry: map[string]RetryPolicy{
+				"nowhere.net": {},
+			},
+		},
+	}
+	mta.relayAndWait(Envelope{
+		MailFrom: mail.Address{Address: "from@sender.org"},
+		RcptTo: []mail.Address{
+			{Address: "to@receive.net"},
+			{Address: "to@nowhere.net"},
+		},
+		Data:     []byte("Subject: hi\r\n\r\nbody\r\n"),
+		ID:       "m.retry",
+		Received: time.Now(),
+	})
+
+	if want, got := 2, len(s.results); want != got {
+		t.Fatalf("Want %d results, got %d", want, got)
+	}
+	// The domain override bounces on the first attempt.
+	if want, got := "to@nowhere.net", s.results[0].Recipient; want != got {
+		t.Errorf("Want first result for %q, got %q", want, got)
+	}
+	if want, got := 1, s.results[0].Attempts; want != got {
+		t.Errorf("Want %d attempts, got %d", want, got)
+	}
+	if !s.results[1].Delivered() {
+		t.Errorf("Want message delivered after retry, got %s", s.results[1].Error)
+	}
+	if want, got := 3, s.results[1].Attempts; want != got {
+		t.Errorf("Want %d attempts, got %d", want, got)
+	}
+	if want, got := 1, len(dest.messages); want != got {
+		t.Errorf("Want %d delivered message, got %d", want, got)
+	}
+
+	// One failure notification for the bounce, and one delay warning.
+	if want, got := 2, len(s.messages); want != got {
+		t.Fatalf("Want %d notifications, got %d", want, got)
+	}
+	subjects := []string{"Delivery Status Notification (Failure)", "Delivery Status Notification (Delay)"}
+	for i, subject := range subjects {
+		msg, err := mail.ReadMessage(bytes.NewReader(s.messages[i].Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := subject, msg.Header.Get("Subject"); want != got {
+			t.Errorf("%d: want subject %q, got %q", i, want, got)
+		}
+	}
+	if !bytes.Contains(s.messages[1].Data, []byte("Action: delayed")) {
+		t.Errorf("Delay warning missing delayed action")
+	}
+}
+
+// relayAndWait relays |env| and returns once every recipient has succeeded
+// or failed permanently.
+func (m *mta) relayAndWait(env Envelope) {
+	done := make(chan struct{})
+	m.QueueMessage(env, nil, func(Envelope) { close(done) })
+	<-done
+}
+
+func TestQueueMessage(t *testing.T) {
+	dest := &deliveryServer{
+		testServer: testServer{domain: "receive.net"},
+	}
+	l := runServer(t, dest)
+	defer l.Close()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	defer func(f func(string) ([]*net.MX, error), p string) {
+		lookupMX, relayPort = f, p
+	}(lookupMX, relayPort)
+	var mu sync.Mutex
+	slowLookups := 0
+	lookupMX = func(domain string) ([]*net.MX, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if domain == "slow.net" {
+			slowLookups++
+			if slowLookups < 2 {
+				return nil, fmt.Errorf("temporary lookup failure")
+			}
+		}
+		return []*net.MX{{Host: host}}, nil
+	}
+	relayPort = port
+
+	// A single worker is not held by a message waiting to be retried.
+	mta := mta{
+		server:   &deliveryServer{},
+		log:      logger.Nop(),
+		queue:    newRelayQueue(1),
+		messages: newRelayQueue(1),
+		opts: MTAOptions{
+			Retry: RetryPolicy{Retry: time.Minute, Interval: 200 * time.Millisecond},
+		},
+	}
+	done := make(chan Envelope, 2)
+	prepare := func(en *Envelope) {
+		en.Data = append([]byte("X-Prepared: yes\r\n"), en.Data...)
+	}
+	for _, rcpt := range []string{"to@slow.net", "to@receive.net"} {
+		mta.QueueMessage(Envelope{
+			MailFrom: mail.Address{Address: "from@sender.org"},
+			RcptTo:   []mail.Address{{Address: rcpt}},
+			Data:     []byte("Subject: hi\r\n\r\nbody\r\n"),
+			ID:       rcpt,
+			Received: time.Now(),
+		}, prepare, func(en Envelope) { done <- en })
+	}
+
+	for _, want := range []string{"to@receive.net", "to@slow.net"} {
+		select {
+		case en := <-done:
+			if want != en.ID {
+				t.Errorf("Want %q relayed, got %q", want, en.ID)
+			}
+			if !bytes.HasPrefix(en.Data, []byte("X-Prepared: yes")) {
+				t.Errorf("Want %q prepared, got %q", en.ID, en.Data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %q", want)
+		}
+	}
+}
+
+type tlsaResolver struct {
+	secure  bool
+	records []dane.TLSA
+}
+
+func (r *tlsaResolver) SecureMX(ctx context.Context, domain string) (bool, error) {
+	return r.secure, nil
+}
+
+func (r *tlsaResolver) LookupTLSA(ctx context.Context, host, port string) ([]dane.TLSA, error) {
+	return r.records, nil
+}
+
+func TestRelayDANE(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("../testtls/domain.crt", "../testtls/domain.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	spki := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	wrong := sha256.Sum256([]byte("wrong"))
+	match := []dane.TLSA{{Usage: dane.UsageDANEEE, Selector: dane.SelectorSPKI, MatchingType: dane.MatchingSHA256, Data: spki[:]}}
+	mismatch := []dane.TLSA{{Usage: dane.UsageDANEEE, Selector: dane.SelectorSPKI, MatchingType: dane.MatchingSHA256, Data: wrong[:]}}
+
+	// The test certificate has expired, which DANE-EE records ignore.
+	dest := &deliveryServer{testServer: testServer{domain: "dest.net", tlsConfig: getTLSConfig(t)}}
+	l := runServer(t, dest)
+	defer l.Close()
+	plain := runServer(t, &deliveryServer{testServer: testServer{domain: "dest.net"}})
+	defer plain.Close()
+
+	defer func(f func(string) ([]*net.MX, error), p string) {
+		lookupMX, relayPort = f, p
+	}(lookupMX, relayPort)
+	lookupMX = func(domain string) ([]*net.MX, error) {
+		return []*net.MX{{Host: "localhost"}}, nil
+	}
+
+	cases := []struct {
+		name      string
+		listener  net.Listener
+		resolver  *tlsaResolver
+		fallback  string
+		delivered bool
+		failure   string
+	}{
+		{"match", l, &tlsaResolver{true, match}, "", true, ""},
+		{"mismatch", l, &tlsaResolver{true, mismatch}, "", false, TLSResultTLSAInvalid},
+		{"insecure MX", l, &tlsaResolver{false, match}, "", false, TLSResultExpired},
+		{"no records", l, &tlsaResolver{true, nil}, "", false, TLSResultExpired},
+		{"opportunistic", l, &tlsaResolver{true, nil}, DANEFallbackOpportunistic, true, ""},
+		{"no STARTTLS", plain, &tlsaResolver{true, match}, "", false, TLSResultStartTLSNotSupported},
+		{"plain opportunistic", plain, &tlsaResolver{true, nil}, DANEFallbackOpportunistic, true, TLSResultStartTLSNotSupported},
+	}
+	for _, c := range cases {
+		_, relayPort, _ = net.SplitHostPort(c.listener.Addr().String())
+		s := &tlsResultServer{}
+		mta := NewMTA(s, MTAOptions{DANE: c.resolver, DANEFallback: c.fallback}, logger.Nop()).(*mta)
+		mta.relayAndWait(Envelope{
+			MailFrom: mail.Address{Address: "from@sender.org"},
+			RcptTo:   []mail.Address{{Address: "to@dest.net"}},
+			Data:     []byte("Subject: hi\r\n\r\nbody\r\n"),
+			ID:       "m.dane",
+		})
+
+		if want, got := 1, len(s.results); want != got {
+			t.Fatalf("%s: want %d result, got %d", c.name, want, got)
+		}
+		if want, got := c.delivered, s.results[0].Delivered(); want != got {
+			t.Errorf("%s: want delivered %v, got %v (%s)", c.name, want, got, s.results[0].Error)
+		}
+		if want, got := 1, len(s.tlsResults); want != got {
+			t.Fatalf("%s: want %d TLS result, got %d", c.name, want, got)
+		}
+		if want, got := c.failure, s.tlsResults[0].Failure; want != got {
+			t.Errorf("%s: want TLS failure %q, got %q", c.name, want, got)
+		}
+	}
+}
+
+type relayHelloServer struct {
+	deliveryServer
+	helloName string
+}
+
+func (s *relayHelloServer) RelayHelloName(Envelope) string {
+	return s.helloName
+}
+
+func TestRelayHelloName(t *testing.T) {
+	dest := &deliveryServer{
+		testServer: testServer{domain: "receive.net"},
+	}
+	l := runServer(t, dest)
+	defer l.Close()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+
+	env := Envelope{
+		MailFrom: mail.Address{Address: "from@sender.org"},
+		RcptTo:   []mail.Address{{Address: "to@receive.net"}},
+		Data:     []byte("Subject: hi\r\n\r\nbody\r\n"),
+		ID:       "m.hello",
+	}
+
+	for _, name := range []string{"out.sender.org", ""} {
+		s := &relayHelloServer{helloName: name}
+		mta := mta{
+			server: s,
+			log:    logger.Nop(),
+		}
+		if _, failures := mta.relayMessageToHost(env, logger.Nop(), []string{env.RcptTo[0].Address}, host, port, relayTLS{}); failures[0] != nil {
+			t.Fatalf("Failed to relay: %v", failures[0])
+		}
+
+		want := name
+		if want == "" {
+			want = s.Name()
+		}
+		if got := dest.messages[len(dest.messages)-1].EHLO; want != got {
+			t.Errorf("Want EHLO %q, got %q", want, got)
+		}
+	}
+}
+
+type relaySourceServer struct {
+	deliveryServer
+	sourceIP net.IP
+}
+
+func (s *relaySourceServer) RelaySourceIP(Envelope) net.IP {
+	return s.sourceIP
+}
+
+func TestRelaySourceIP(t *testing.T) {
+	// Linux routes all of 127.0.0.0/8 to the loopback interface, but other
+	// systems may not.
+	if probe, err := net.Listen("tcp", "127.0.0.2:0"); err != nil {
+		t.Skipf("127.0.0.2 is not available: %v", err)
+	} else {
+		probe.Close()
+	}
+
+	dest := &deliveryServer{
+		testServer: testServer{domain: "receive.net"},
+	}
+	l := runServer(t, dest)
+	defer l.Close()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+
+	env := Envelope{
+		MailFrom: mail.Address{Address: "from@sender.org"},
+		RcptTo:   []mail.Address{{Address: "to@receive.net"}},
+		Data:     []byte("Subject: hi\r\n\r\nbody\r\n"),
+		ID:       "m.source",
+	}
+
+	mta := mta{
+		server: &relaySourceServer{sourceIP: net.ParseIP("127.0.0.2")},
+		pool:   newRelayPool(),
+		log:    logger.Nop(),
+	}
+	if _, failures := mta.relayMessageToHost(env, logger.Nop(), []string{env.RcptTo[0].Address}, host, port, relayTLS{}); failures[0] != nil {
+		t.Fatalf("Failed to relay: %v", failures[0])
+	}
+	if want, got := "127.0.0.2", addrHost(dest.messages[0].RemoteAddr); want != got {
+		t.Errorf("Want message from %s, got %s", want, got)
+	}
+}
+
+func TestRelayConnectionReuse(t *testing.T) {
+	dest := &deliveryServer{
+		testServer: testServer{domain: "receive.net", blockList: []string{"bad@receive.net"}},
+	}
+	l := runServer(t, dest)
+	defer l.Close()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+
+	mta := mta{
+		server: &deliveryServer{},
+		pool:   newRelayPool(),
+		log:    logger.Nop(),
+	}
+	relay := func(to string) {
+		env := Envelope{
+			MailFrom: mail.Address{Address: "from@sender.org"},
+			RcptTo:   []mail.Address{{Address: to}},
+			Data:     []byte("Subject: hi\r\n\r\nbody\r\n"),
+			ID:       "m.reuse",
+		}
+		mta.relayMessageToHost(env, logger.Nop(), []string{to}, host, port, relayTLS{})
+	}
+	lastRemote := func() string {
+		return dest.messages[len(dest.messages)-1].RemoteAddr.String()
+	}
+
+	relay("a@receive.net")
+	first := lastRemote()
+
+	// A rejected recipient does not prevent reuse.
+	relay("bad@receive.net")
+	relay("b@receive.net")
+	if want, got := 2, len(dest.messages); want != got {
+		t.Fatalf("Want %d messages, got %d", want, got)
+	}
+	if want, got := first, lastRemote(); want != got {
+		t.Errorf("Want connection %s to be reused, got %s", want, got)
+	}
+
+	// An expired connection is not.
+	mta.pool.idleTimeout = 0
+	relay("c@receive.net")
+	if first == lastRemote() {
+		t.Errorf("Want a new connection after the idle timeout, got %s", first)
+	}
+}
+
+func TestRelayConnectionReuseDANE(t *testing.T) {
+	// The destination does not offer STARTTLS.
+	dest := &deliveryServer{
+		testServer: testServer{domain: "receive.net"},
+	}
+	l := runServer(t, dest)
+	defer l.Close()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+
+	// Any TLSA record requires TLS.
+	records := []dane.TLSA{{Usage: dane.UsageDANEEE, Selector: dane.SelectorSPKI, MatchingType: dane.MatchingSHA256, Data: make([]byte, 32)}}
+	m := mta{
+		server: &deliveryServer{},
+		opts:   MTAOptions{DANE: &tlsaResolver{true, records}},
+		pool:   newRelayPool(),
+		log:    logger.Nop(),
+	}
+	relay := func(rt relayTLS) []*DSNFailure {
+		env := Envelope{
+			MailFrom: mail.Address{Address: "from@sender.org"},
+			RcptTo:   []mail.Address{{Address: "to@receive.net"}},
+			Data:     []byte("Subject: hi\r\n\r\nbody\r\n"),
+			ID:       "m.reuse",
+		}
+		_, failures := m.relayMessageToHost(env, logger.Nop(), []string{"to@receive.net"}, host, port, rt)
+		return failures
+	}
+
+	if failures := relay(relayTLS{}); failures[0] != nil {
+		t.Fatalf("Failed to relay without DANE: %v", failures[0])
+	}
+	if want, got := 1, len(m.pool.idle); want != got {
+		t.Fatalf("Want %d pooled connection, got %d", want, got)
+	}
+
+	// The plaintext connection is not reused for a domain with DANE, which
+	// must dial its own and then fails for the lack of STARTTLS.
+	if failures := relay(relayTLS{dane: true}); failures[0] == nil || failures[0].Status != "4.7.0" {
+		t.Errorf("Want the DANE delivery to require TLS, got %v", failures[0])
+	}
+	if want, got := 1, len(dest.messages); want != got {
+		t.Errorf("Want %d message, got %d", want, got)
+	}
+}
+
+func TestRelayPoolLimit(t *testing.T) {
+	dest := &deliveryServer{
+		testServer: testServer{domain: "receive.net"},
+	}
+	l := runServer(t, dest)
+	defer l.Close()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+
+	m := mta{
+		server: &deliveryServer{},
+		pool:   newRelayPool(),
+		log:    logger.Nop(),
+	}
+
+	var conns []*relayConn
+	for i := 0; i < 3; i++ {
+		rc, failure := m.dialRelay(logger.Nop(), "to@receive.net", host, port, "test", nil, relayTLS{})
+		if failure != nil {
+			t.Fatalf("Failed to dial: %v", failure)
+		}
+		conns = append(conns, rc)
+	}
+	for _, rc := range conns {
+		m.pool.put("key", rc)
+	}
+
+	if want, got := relayPoolMaxIdle, len(m.pool.idle["key"]); want != got {
+		t.Errorf("Want %d idle connections, got %d", want, got)
+	}
+	if rc := m.pool.get("key"); rc != conns[1] {
+		t.Errorf("Want the most recent idle connection")
+	}
+	if rc := m.pool.get("other"); rc != nil {
+		t.Errorf("Want no connection for another key, got %v", rc)
+	}
+}
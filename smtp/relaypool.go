@@ -0,0 +1,112 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package smtp
+
+import (
+	"net/smtp"
+	"sync"
+	"time"
+)
+
+const (
+	// relayPoolIdleTimeout is well under the five minutes that RFC 5321
+	// §4.5.3.2.7 has servers wait for the next command.
+	relayPoolIdleTimeout = 30 * time.Second
+	relayPoolMaxIdle     = 2
+)
+
+// relayConn is an established connection to a relay host.
+type relayConn struct {
+	c     *smtp.Client
+	relay string
+	// verified is whether the connection uses TLS with an authenticated
+	// certificate.
+	verified bool
+
+	idleSince time.Time
+}
+
+// relayPool holds idle relay connections, so that a burst of messages to the
+// same host does not pay for a new connection, TLS handshake, and EHLO each
+// time. Connections are keyed by host, EHLO name, source IP, and how the host
+// must be authenticated. A nil *relayPool does not hold any connections.
+type relayPool struct {
+	idleTimeout time.Duration
+	maxIdle     int
+
+	mu   sync.Mutex
+	idle map[string][]*relayConn
+}
+
+func newRelayPool() *relayPool {
+	return &relayPool{
+		idleTimeout: relayPoolIdleTimeout,
+		maxIdle:     relayPoolMaxIdle,
+		idle:        make(map[string][]*relayConn),
+	}
+}
+
+// get removes and returns the most recently used idle connection for |key|,
+// or nil if there is none.
+func (p *relayPool) get(key string) *relayConn {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expireLocked(time.Now())
+
+	conns := p.idle[key]
+	if len(conns) == 0 {
+		return nil
+	}
+	rc := conns[len(conns)-1]
+	p.idle[key] = conns[:len(conns)-1]
+	return rc
+}
+
+// put returns |rc| to the pool, or closes it if the pool for |key| is full.
+func (p *relayPool) put(key string, rc *relayConn) {
+	if p == nil || p.maxIdle <= 0 {
+		quitClient(rc.c)
+		return
+	}
+
+	now := time.Now()
+	rc.idleSince = now
+
+	p.mu.Lock()
+	p.expireLocked(now)
+	conns := p.idle[key]
+	if len(conns) >= p.maxIdle {
+		p.mu.Unlock()
+		quitClient(rc.c)
+		return
+	}
+	p.idle[key] = append(conns, rc)
+	p.mu.Unlock()
+}
+
+func (p *relayPool) expireLocked(now time.Time) {
+	for key, conns := range p.idle {
+		live := conns[:0]
+		for _, rc := range conns {
+			if now.Sub(rc.idleSince) >= p.idleTimeout {
+				// Closing rather than quitting, to not block while locked.
+				rc.c.Close()
+			} else {
+				live = append(live, rc)
+			}
+		}
+		if len(live) == 0 {
+			delete(p.idle, key)
+		} else {
+			p.idle[key] = live
+		}
+	}
+}
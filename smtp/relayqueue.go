@@ -0,0 +1,111 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package smtp
+
+import (
+	"strings"
+	"sync"
+)
+
+// DefaultRelayConcurrency is the MTAOptions.Concurrency if it is zero.
+const DefaultRelayConcurrency = 8
+
+// relayJob relays a message to its recipients in one destination domain.
+type relayJob struct {
+	domain string
+	run    func()
+}
+
+// relayQueue runs relay jobs on a fixed number of worker goroutines, so that
+// a burst of messages does not open an unbounded number of connections. Jobs
+// for the same destination domain run one at a time, in the order they were
+// submitted, so that a burst to one domain does not hammer its MX hosts. The
+// workers are started by the first submit. A nil *relayQueue runs each job
+// on the submitting goroutine.
+type relayQueue struct {
+	workers int
+	start   sync.Once
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	ready   []relayJob
+	blocked map[string][]relayJob // Jobs waiting for their domain, by domain.
+	busy    map[string]bool
+}
+
+func newRelayQueue(workers int) *relayQueue {
+	if workers <= 0 {
+		workers = DefaultRelayConcurrency
+	}
+	q := &relayQueue{
+		workers: workers,
+		blocked: make(map[string][]relayJob),
+		busy:    make(map[string]bool),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// submit queues |run| to relay to |domain|, and returns without waiting for
+// it unless |q| is nil.
+func (q *relayQueue) submit(domain string, run func()) {
+	if q == nil {
+		run()
+		return
+	}
+
+	q.start.Do(func() {
+		for i := 0; i < q.workers; i++ {
+			go q.work()
+		}
+	})
+
+	job := relayJob{domain: strings.ToLower(domain), run: run}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.busy[job.domain] {
+		q.blocked[job.domain] = append(q.blocked[job.domain], job)
+		return
+	}
+	q.busy[job.domain] = true
+	q.ready = append(q.ready, job)
+	q.cond.Signal()
+}
+
+func (q *relayQueue) work() {
+	for {
+		q.mu.Lock()
+		for len(q.ready) == 0 {
+			q.cond.Wait()
+		}
+		job := q.ready[0]
+		q.ready = q.ready[1:]
+		q.mu.Unlock()
+
+		job.run()
+		q.finish(job.domain)
+	}
+}
+
+// finish readies the next job for |domain|, or marks it idle if there is none.
+func (q *relayQueue) finish(domain string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	next := q.blocked[domain]
+	if len(next) == 0 {
+		delete(q.busy, domain)
+		return
+	}
+	q.ready = append(q.ready, next[0])
+	if len(next) == 1 {
+		delete(q.blocked, domain)
+	} else {
+		q.blocked[domain] = next[1:]
+	}
+	q.cond.Signal()
+}
@@ -0,0 +1,93 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package smtp
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRelayQueueConcurrency(t *testing.T) {
+	q := newRelayQueue(2)
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		q.submit(fmt.Sprintf("domain%d.com", i), func() {
+			defer wg.Done()
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+
+	if want, got := 2, maxRunning; want != got {
+		t.Errorf("Want %d jobs at once, got %d", want, got)
+	}
+}
+
+func TestRelayQueueDomainSerialized(t *testing.T) {
+	q := newRelayQueue(4)
+
+	var mu sync.Mutex
+	var order []int
+	running := make(map[string]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		i := i
+		domain := "example.com"
+		if i%2 == 1 {
+			domain = "Example.COM"
+		}
+		wg.Add(1)
+		q.submit(domain, func() {
+			defer wg.Done()
+			mu.Lock()
+			if running["example.com"] {
+				t.Errorf("Job %d ran alongside another job for its domain", i)
+			}
+			running["example.com"] = true
+			order = append(order, i)
+			mu.Unlock()
+
+			time.Sleep(5 * time.Millisecond)
+
+			mu.Lock()
+			running["example.com"] = false
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+
+	for i, job := range order {
+		if i != job {
+			t.Errorf("Want jobs in submission order, got %v", order)
+			break
+		}
+	}
+
+	var nilQueue *relayQueue
+	ran := false
+	nilQueue.submit("example.com", func() { ran = true })
+	if !ran {
+		t.Errorf("Want nil queue to run the job at once")
+	}
+}
@@ -7,16 +7,29 @@
 package smtp
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"net/mail"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
-	"go.uber.org/zap"
+	"src.bluestatic.org/mailpopbox/dane"
+	"src.bluestatic.org/mailpopbox/dkim"
+	"src.bluestatic.org/mailpopbox/dmarc"
+	"src.bluestatic.org/mailpopbox/logger"
+	"src.bluestatic.org/mailpopbox/maillog"
+	"src.bluestatic.org/mailpopbox/message"
+	"src.bluestatic.org/mailpopbox/mtasts"
+	"src.bluestatic.org/mailpopbox/spf"
 )
 
 type ReplyLine struct {
@@ -35,6 +48,8 @@ var (
 	ReplyBadSequence      = ReplyLine{503, "bad sequence of commands"}
 	ReplyBadMailbox       = ReplyLine{550, "mailbox unavailable"}
 	ReplyMailboxUnallowed = ReplyLine{553, "mailbox name not allowed"}
+	ReplyServerBusy       = ReplyLine{451, "server busy, try again later"}
+	ReplyMailLoop         = ReplyLine{554, "5.4.6 mail loop detected"}
 )
 
 func DomainForAddress(addr mail.Address) string {
@@ -57,18 +72,191 @@ type Envelope struct {
 	Data       []byte
 	Received   time.Time
 	ID         string
+	// TLS describes the connection the message was received on, or is nil if
+	// it was not encrypted.
+	TLS *TLSInfo
+	// HeloCheck is the result of comparing EHLO to the client's reverse DNS.
+	HeloCheck HeloCheck
+	// DSN holds the client's requests for delivery status notifications.
+	DSN DSNParameters
+	// DKIM holds the result of verifying each DKIM signature on an inbound
+	// message, which is empty if it is not signed.
+	DKIM []dkim.Result
+	// SPF is the result of checking the SPF record of the MAIL FROM domain,
+	// or of the EHLO name for a null sender, of an inbound message.
+	SPF spf.Result
+	// DMARC is the result of applying the DMARC policy of the domain in the
+	// From header of an inbound message.
+	DMARC dmarc.Result
+	// Headers are added to the message by filters, with AddHeader. They are
+	// written ahead of Data when the message is stored.
+	Headers []HeaderField `json:",omitempty"`
+	// Annotations are structured notes from filters, added with Annotate.
+	// They are kept in the message's stored metadata.
+	Annotations []Annotation `json:",omitempty"`
 }
 
-func WriteEnvelopeForDelivery(w io.Writer, e Envelope) {
-	fmt.Fprintf(w, "Delivered-To: <%s>\r\n", e.RcptTo[0].Address)
-	fmt.Fprintf(w, "Return-Path: <%s>\r\n", e.MailFrom.Address)
-	w.Write(e.Data)
+// HeaderField is a header added to a message by a filter.
+type HeaderField struct {
+	Name  string
+	Value string
 }
 
-func generateEnvelopeId(prefix string, t time.Time) string {
+// Annotation is a note that a filter attaches to an Envelope, like a spam
+// score or the name of a matched rule.
+type Annotation struct {
+	Name  string
+	Value string
+}
+
+// AddHeader adds the header field |name| to the message, without changing
+// Data.
+func (e *Envelope) AddHeader(name, value string) {
+	e.Headers = append(e.Headers, HeaderField{name, value})
+}
+
+// Annotate attaches the annotation |name| to the envelope. Names may repeat,
+// such as for each matched rule.
+func (e *Envelope) Annotate(name, value string) {
+	e.Annotations = append(e.Annotations, Annotation{name, value})
+}
+
+// WriteHeaders writes the Headers added by filters to |buf|.
+func (e *Envelope) WriteHeaders(buf *bytes.Buffer) {
+	for _, h := range e.Headers {
+		fmt.Fprintf(buf, "%s: %s\r\n", h.Name, h.Value)
+	}
+}
+
+// envelopeFields has the fields of Envelope without its JSON methods.
+type envelopeFields Envelope
+
+// jsonEnvelope shadows the interface-typed RemoteAddr field of the Envelope,
+// which cannot be decoded from JSON.
+type jsonEnvelope struct {
+	*envelopeFields
+	RemoteAddr *jsonAddr `json:",omitempty"`
+}
+
+type jsonAddr struct {
+	Net  string
+	Addr string
+}
+
+func (a *jsonAddr) Network() string {
+	return a.Net
+}
+
+func (a *jsonAddr) String() string {
+	return a.Addr
+}
+
+// MarshalJSON encodes the envelope, with RemoteAddr as its network and
+// address, so that it can be stored or sent to another process.
+func (e Envelope) MarshalJSON() ([]byte, error) {
+	je := jsonEnvelope{envelopeFields: (*envelopeFields)(&e)}
+	if e.RemoteAddr != nil {
+		je.RemoteAddr = &jsonAddr{e.RemoteAddr.Network(), e.RemoteAddr.String()}
+	}
+	return json.Marshal(je)
+}
+
+// UnmarshalJSON decodes an envelope encoded by MarshalJSON.
+func (e *Envelope) UnmarshalJSON(data []byte) error {
+	je := jsonEnvelope{envelopeFields: (*envelopeFields)(e)}
+	if err := json.Unmarshal(data, &je); err != nil {
+		return err
+	}
+	e.RemoteAddr = nil
+	if je.RemoteAddr != nil {
+		e.RemoteAddr = je.RemoteAddr
+	}
+	return nil
+}
+
+// TLSInfo records the TLS parameters of a connection.
+type TLSInfo struct {
+	Version     string
+	CipherSuite string
+	// ServerName is the SNI name requested by the client, if any.
+	ServerName string `json:",omitempty"`
+}
+
+func (i *TLSInfo) String() string {
+	if i == nil {
+		return "PLAINTEXT"
+	}
+	s := fmt.Sprintf("%s cipher=%s", i.Version, i.CipherSuite)
+	if i.ServerName != "" {
+		s += " name=" + i.ServerName
+	}
+	return s
+}
+
+// WriteEnvelopeForDelivery writes the message in |e| to |w| as it is stored
+// for the first recipient, with its Delivered-To and Return-Path headers.
+func WriteEnvelopeForDelivery(w io.Writer, e Envelope) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	buf.WriteString("Delivered-To: <")
+	buf.WriteString(e.RcptTo[0].Address)
+	buf.WriteString(">\r\nReturn-Path: <")
+	buf.WriteString(e.MailFrom.Address)
+	buf.WriteString(">\r\n")
+	e.WriteHeaders(buf)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	_, err := w.Write(e.Data)
+	return err
+}
+
+// IsDeliveryLoop reports whether the message in |data| was already delivered
+// to |address|, according to the Delivered-To headers written by
+// WriteEnvelopeForDelivery.
+func IsDeliveryLoop(data []byte, address string) bool {
+	header, _ := message.Parse(data)
+	for _, deliveredTo := range header.Values("Delivered-To") {
+		if strings.EqualFold(strings.Trim(strings.TrimSpace(deliveredTo), "<>"), address) {
+			return true
+		}
+	}
+	return false
+}
+
+// countHops returns the number of Received headers in the message |data|,
+// each of which is a server it passed through.
+func countHops(data []byte) int {
+	header, _ := message.Parse(data)
+	return len(header.Values("Received"))
+}
+
+// envelopeClock makes the timestamps of envelope IDs strictly increasing.
+var envelopeClock struct {
+	sync.Mutex
+	last int64
+}
+
+// GenerateEnvelopeId returns a new, unique Envelope.ID that starts with
+// |prefix|. The ID holds the UnixNano time of |t|, moved ahead if needed so
+// that IDs from this process sort in the order they were generated, followed
+// by random bytes so that IDs from other processes differ.
+func GenerateEnvelopeId(prefix string, t time.Time) string {
+	nanos := t.UnixNano()
+	envelopeClock.Lock()
+	if nanos <= envelopeClock.last {
+		nanos = envelopeClock.last + 1
+	}
+	envelopeClock.last = nanos
+	envelopeClock.Unlock()
+
 	var idBytes [4]byte
-	rand.Read(idBytes[:])
-	return fmt.Sprintf("%s.%d.%x", prefix, t.UnixNano(), idBytes)
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		// The timestamp is still unique within the process.
+		binary.BigEndian.PutUint32(idBytes[:], uint32(os.Getpid()))
+	}
+	return fmt.Sprintf("%s.%d.%x", prefix, nanos, idBytes)
 }
 
 // lookupRemoteHost attempts to reverse look-up the provided IP address. On
@@ -80,14 +268,64 @@ func lookupRemoteHost(addr net.Addr) string {
 		rhost = addr.String()
 	}
 
-	rhosts, err := net.LookupAddr(rhost)
-	if err == nil {
-		rhost = fmt.Sprintf("%s [%s]", rhosts[0], rhost)
+	if name := defaultReverseResolver.LookupAddr(rhost); name != "" {
+		rhost = fmt.Sprintf("%s [%s]", name, rhost)
 	}
 
 	return rhost
 }
 
+// HeloCheck is the result of comparing the name a client gave in EHLO to its
+// forward-confirmed reverse DNS name.
+type HeloCheck string
+
+const (
+	// HeloCheckPass means the EHLO name is the FCrDNS name, or is an address
+	// literal of the client's IP.
+	HeloCheckPass HeloCheck = "pass"
+	// HeloCheckFail means the EHLO name differs from the FCrDNS name.
+	HeloCheckFail HeloCheck = "fail"
+	// HeloCheckNone means the client's IP has no rDNS name, or the name does
+	// not resolve back to the IP.
+	HeloCheckNone HeloCheck = "none"
+	// HeloCheckBareIP means the EHLO name is an IP address that is not in
+	// brackets as an address literal.
+	HeloCheckBareIP HeloCheck = "bare-ip"
+	// HeloCheckUnresolvable means the EHLO name does not exist in the DNS.
+	HeloCheckUnresolvable HeloCheck = "unresolvable"
+)
+
+// checkHelo compares |ehlo| to the forward-confirmed reverse DNS name of
+// |addr|, returning the result and the rDNS name.
+func checkHelo(ehlo string, addr net.Addr) (HeloCheck, string) {
+	ip, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		ip = addr.String()
+	}
+
+	literal := strings.HasPrefix(ehlo, "[") && strings.HasSuffix(ehlo, "]")
+	if literal {
+		literal := strings.TrimPrefix(ehlo[1:len(ehlo)-1], "IPv6:")
+		if parsed := net.ParseIP(literal); parsed != nil && parsed.Equal(net.ParseIP(ip)) {
+			return HeloCheckPass, ""
+		}
+	} else if net.ParseIP(ehlo) != nil {
+		return HeloCheckBareIP, ""
+	}
+
+	name := defaultReverseResolver.LookupAddr(ip)
+	if !literal && !hostExists(ehlo) {
+		return HeloCheckUnresolvable, name
+	}
+	if name == "" || !forwardConfirmed(name, ip) {
+		return HeloCheckNone, name
+	}
+	if strings.EqualFold(strings.TrimSuffix(name, "."), strings.TrimSuffix(ehlo, ".")) {
+		return HeloCheckPass, name
+	}
+	return HeloCheckFail, name
+}
+
 // Server provides an interface for handling incoming SMTP requests via
 // AcceptConnection.
 type Server interface {
@@ -115,26 +353,323 @@ type Server interface {
 	RelayMessage(en Envelope, authc string)
 }
 
+// RelayResultReceiver may be implemented by a Server to be told the final
+// outcome of relaying a message to each of its recipients.
+type RelayResultReceiver interface {
+	RelayResult(RelayResult)
+}
+
+// TLSResultReceiver may be implemented by a Server to be told the outcome of
+// negotiating TLS on each new connection to a relay host, such as to send
+// RFC 8460 TLS reports.
+type TLSResultReceiver interface {
+	TLSResult(TLSResult)
+}
+
+// RelayHelloNamer may be implemented by a Server to use a different name
+// than Name() in the EHLO when relaying a message.
+type RelayHelloNamer interface {
+	// RelayHelloName returns the name to use when relaying |en|, or the empty
+	// string to use Name().
+	RelayHelloName(en Envelope) string
+}
+
+// RelaySourceSelector may be implemented by a Server to relay messages from
+// a particular local IP address, rather than the one chosen by the system.
+type RelaySourceSelector interface {
+	// RelaySourceIP returns the address to relay |en| from, or nil to let
+	// the system choose.
+	RelaySourceIP(en Envelope) net.IP
+}
+
+// MailboxResolver may be implemented by a Server whose recipient addresses
+// can share a mailbox, such as domains stored in the same maildrop. An LMTP
+// delivery is then made once for each mailbox, rather than once for each
+// recipient domain, so the mailbox gets a single copy.
+type MailboxResolver interface {
+	// Mailbox returns a key that is the same for every recipient whose mail
+	// is stored with |rcpt|'s.
+	Mailbox(rcpt mail.Address) string
+}
+
+// TrustedRelayChecker may be implemented by a Server that receives mail from
+// filtering gateways. A trusted relay can use XCLIENT, and the origin client
+// of its messages is taken from their Received header.
+type TrustedRelayChecker interface {
+	// IsTrustedRelay reports whether the client at |addr| is a trusted relay.
+	IsTrustedRelay(addr net.Addr) bool
+}
+
+// InvalidRecipientReporter may be implemented by a Server to learn of the
+// recipients rejected by VerifyAddress, such as to detect clients harvesting
+// addresses.
+type InvalidRecipientReporter interface {
+	// InvalidRecipient is called when the client at |addr| is refused
+	// |rcpt|. It returns true if the client should be disconnected.
+	InvalidRecipient(addr net.Addr, rcpt mail.Address) bool
+}
+
+// TokenAuthenticator may be implemented by a Server to accept OAuth 2.0
+// bearer tokens with the XOAUTH2 and OAUTHBEARER AUTH mechanisms.
+type TokenAuthenticator interface {
+	// AuthenticateToken verifies that |token| grants access to send mail as
+	// the |user| address.
+	AuthenticateToken(user, token string) bool
+}
+
+// CertificateAuthenticator may be implemented by a Server to authenticate
+// clients by the certificate they present in the STARTTLS handshake, as if
+// they had used AUTH.
+type CertificateAuthenticator interface {
+	// CertificateAuthenticate returns the authcid for the client
+	// certificates of |state|, or the empty string if they are not trusted.
+	CertificateAuthenticate(state tls.ConnectionState) string
+}
+
+// MessageSizeLimiter may be implemented by a Server to set a smaller
+// maximum message size than Options.MaxMessageSize for some recipients.
+type MessageSizeLimiter interface {
+	// MaxMessageSize returns the largest message, in bytes, that |rcpt| can
+	// receive, or 0 for no limit besides Options.MaxMessageSize.
+	MaxMessageSize(rcpt mail.Address) int64
+}
+
+// InboundSizeLimiter may be implemented by a Server to advertise a smaller
+// SIZE than Options.MaxMessageSize to clients delivering inbound mail, when
+// none of the Server's recipients can receive a message that large.
+type InboundSizeLimiter interface {
+	// MaxInboundMessageSize returns the largest message, in bytes, that any
+	// recipient can receive, or 0 if some recipient has no smaller limit
+	// than Options.MaxMessageSize.
+	MaxInboundMessageSize() int64
+}
+
+// RelayResult is the outcome of relaying a message to one recipient.
+type RelayResult struct {
+	// ID is the Envelope.ID of the message.
+	ID        string
+	Recipient string
+	// Relay describes the host the message was sent to, as host[ip]:port, or
+	// "none" if no host was found.
+	Relay string
+	// Attempts is the number of times delivery was tried.
+	Attempts int
+	// Code is the final reply code from the remote server, or 0 if it never
+	// replied.
+	Code int
+	// Status is the RFC 3463 enhanced status code.
+	Status string
+	// Error describes the failure, or is empty on success.
+	Error string
+}
+
+// TLS result types, from RFC 8460 § 4.3.
+const (
+	TLSResultStartTLSNotSupported = "starttls-not-supported"
+	TLSResultHostMismatch         = "certificate-host-mismatch"
+	TLSResultExpired              = "certificate-expired"
+	TLSResultNotTrusted           = "certificate-not-trusted"
+	TLSResultValidationFailure    = "validation-failure"
+	TLSResultTLSAInvalid          = "tlsa-invalid"
+)
+
+// TLSResult is the outcome of negotiating TLS with a relay host.
+type TLSResult struct {
+	// Domain is the recipient domain that the host is an MX for.
+	Domain string
+	// Host is the MX host name, and IP its address.
+	Host string
+	IP   string
+	// SendingIP is the local address of the connection.
+	SendingIP string
+	// Failure is one of the TLSResult constants, or empty if TLS was
+	// established.
+	Failure string
+	// Detail describes the failure.
+	Detail string `json:",omitempty"`
+	// STSPolicy is the MTA-STS policy of Domain, if it has one.
+	STSPolicy *mtasts.Policy `json:",omitempty"`
+	// TLSA is the TLSA records of Host, if DANE applies to it.
+	TLSA []string `json:",omitempty"`
+}
+
+// Delivered reports whether the message was accepted by the remote server.
+func (r RelayResult) Delivered() bool {
+	return r.Error == ""
+}
+
 // MTA (Mail Transport Agent) allows a Server to interface with other SMTP
 // MTAs.
 type MTA interface {
-	// RelayMessage will attempt to send the specified Envelope. It will ask the
-	// Server to dial the MX servers for the addresses in Envelope.RcptTo for
-	// delivery. If relaying fails, a failure notice will be sent to the sender
-	// via Server.DeliverMessage.
-	RelayMessage(Envelope)
+	// QueueMessage queues the Envelope to be sent to the MX servers for the
+	// addresses in Envelope.RcptTo, and returns. If relaying fails, a failure
+	// notice will be sent to the sender via Server.DeliverMessage. A bounded
+	// number of queued messages are relayed at once, and each first has
+	// |prepare| applied to it, if non-nil, so that work like signing is also
+	// bounded. |done|, if non-nil, is called with the prepared Envelope once
+	// every recipient has succeeded or failed permanently. Retries wait on a
+	// timer rather than holding a worker.
+	QueueMessage(env Envelope, prepare func(*Envelope), done func(Envelope))
+}
+
+// MTAOptions configures the MTA returned by NewMTA.
+type MTAOptions struct {
+	// Templates for the human-readable parts of delivery status
+	// notifications. If nil, the built-in templates are used.
+	Templates *Templates
+
+	// Maillog, if non-nil, records the result of each relay attempt.
+	Maillog *maillog.Writer
+
+	// Retry controls retrying temporary relay failures. DomainRetry overrides
+	// it for recipients in a domain.
+	Retry       RetryPolicy
+	DomainRetry map[string]RetryPolicy
+
+	// DeadHostTTL is how long a relay host that could not be connected to
+	// is skipped, in favor of the next MX host. If zero, it is
+	// DefaultDeadHostTTL.
+	DeadHostTTL time.Duration
+
+	// Concurrency is how many domains are relayed to at once, and how many
+	// messages from QueueMessage are relayed at once. Messages beyond it wait
+	// for a turn, as do messages to a domain that another message is being
+	// relayed to. If zero, it is DefaultRelayConcurrency.
+	Concurrency int
+
+	// Smarthost, if non-nil, relays all messages through a single SMTP
+	// server instead of to the recipients' MX hosts.
+	Smarthost *Smarthost
+
+	// STSPolicies, if non-nil, supplies the MTA-STS policies of recipient
+	// domains. A domain with an enforced policy is only relayed to over TLS,
+	// to the MX hosts that the policy lists.
+	STSPolicies STSPolicySource
+
+	// DANE, if non-nil, authenticates MX hosts by their DNSSEC-signed TLSA
+	// records (RFC 7672), and TLS is required to the hosts that have them.
+	DANE TLSAResolver
+	// DANEFallback is how the certificates of MX hosts without TLSA records
+	// are checked when DANE is used. It is DANEFallbackVerify if empty.
+	DANEFallback string
+}
+
+const (
+	// DANEFallbackVerify verifies certificates against the system roots.
+	DANEFallbackVerify = "verify"
+	// DANEFallbackOpportunistic encrypts without verifying certificates,
+	// unless an MTA-STS policy is enforced.
+	DANEFallbackOpportunistic = "opportunistic"
+)
+
+// TLSAResolver looks up the DNSSEC-signed records used by DANE, like a
+// *dane.Resolver.
+type TLSAResolver interface {
+	// SecureMX reports whether the MX records of |domain| are DNSSEC-signed,
+	// without which DANE does not apply to its MX hosts.
+	SecureMX(ctx context.Context, domain string) (bool, error)
+	// LookupTLSA returns the DNSSEC-signed TLSA records of the SMTP server
+	// at |host|:|port|, or nil if it has none.
+	LookupTLSA(ctx context.Context, host, port string) ([]dane.TLSA, error)
+}
+
+// STSPolicySource supplies MTA-STS policies, like an *mtasts.Cache.
+type STSPolicySource interface {
+	// Policy returns the policy of |domain|, or nil if it has none. A policy
+	// may be returned along with an error.
+	Policy(domain string) (*mtasts.Policy, error)
+}
+
+// Smarthost is an SMTP server that relays outbound mail on the MTA's behalf,
+// such as an ISP's submission server when outbound port 25 is blocked. TLS is
+// required when connecting to it.
+type Smarthost struct {
+	Host string
+	Port string
+
+	// ImplicitTLS connects with TLS, as on port 465, rather than issuing
+	// STARTTLS after connecting.
+	ImplicitTLS bool
+
+	// Username and Password, if set, authenticate with AUTH PLAIN.
+	Username string
+	Password string
+
+	// TLSConfig, if non-nil, is used to connect to the smarthost. Otherwise
+	// its certificate is verified against the system roots.
+	TLSConfig *tls.Config
+}
+
+func (s *Smarthost) tlsConfig() *tls.Config {
+	if s.TLSConfig != nil {
+		return s.TLSConfig
+	}
+	return &tls.Config{ServerName: s.Host}
+}
+
+func (o MTAOptions) retryPolicy(domain string) RetryPolicy {
+	if p, ok := o.DomainRetry[domain]; ok {
+		return p
+	}
+	return o.Retry
+}
+
+// DefaultRetryInterval is the RetryPolicy.Interval if it is zero.
+const DefaultRetryInterval = 5 * time.Minute
+
+// RetryPolicy controls how long a message is retried after a temporary
+// relay failure, before a failure notification is sent to the sender.
+type RetryPolicy struct {
+	// Retry is how long after the message was received to keep trying. If
+	// zero, the failure notification is sent after the first attempt.
+	Retry time.Duration
+	// Interval is the time between attempts.
+	Interval time.Duration
+	// DelayWarning, if non-zero, sends the sender a notification that the
+	// message is delayed once it has been undelivered this long.
+	DelayWarning time.Duration
+}
+
+func (p RetryPolicy) interval() time.Duration {
+	if p.Interval <= 0 {
+		return DefaultRetryInterval
+	}
+	return p.Interval
+}
+
+// canRetry reports whether there is time for another attempt to relay a
+// message that was received at |received|.
+func (p RetryPolicy) canRetry(received time.Time) bool {
+	return p.Retry > 0 && time.Since(received)+p.interval() <= p.Retry
+}
+
+func NewDefaultMTA(server Server, log logger.Logger) MTA {
+	return NewMTA(server, MTAOptions{}, log)
 }
 
-func NewDefaultMTA(server Server, log *zap.Logger) MTA {
+func NewMTA(server Server, opts MTAOptions, log logger.Logger) MTA {
 	return &mta{
 		server: server,
-		log:    log,
+		opts:   opts,
+		pool:   newRelayPool(),
+		dead:   newDeadHostCache(opts.DeadHostTTL),
+		queue:  newRelayQueue(opts.Concurrency),
+		// Each message is its own job, so that they are not serialized.
+		messages: newRelayQueue(opts.Concurrency),
+		log:      log,
 	}
 }
 
 type mta struct {
 	server Server
-	log    *zap.Logger
+	opts   MTAOptions
+	pool   *relayPool
+	dead   *deadHostCache
+	queue  *relayQueue // Relays to each domain.
+	// messages runs QueueMessage. Its jobs wait on queue, so it has its own
+	// workers.
+	messages *relayQueue
+	log      logger.Logger
 }
 
 type EmptyServerCallbacks struct{}
@@ -155,5 +690,5 @@ func (*EmptyServerCallbacks) DeliverMessage(Envelope) *ReplyLine {
 	return nil
 }
 
-func (*EmptyServerCallbacks) RelayMessage(Envelope) {
+func (*EmptyServerCallbacks) RelayMessage(Envelope, string) {
 }
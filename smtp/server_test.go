@@ -7,8 +7,14 @@
 package smtp
 
 import (
+	"encoding/json"
+	"errors"
+	"net"
 	"net/mail"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestDomainForAddress(t *testing.T) {
@@ -26,3 +32,107 @@ func TestDomainForAddress(t *testing.T) {
 		}
 	}
 }
+
+func TestIsDeliveryLoop(t *testing.T) {
+	data := []byte("Delivered-To: <Other@example.com>\r\nReceived: from x\r\nDelivered-To: <mailbox@example.com>\r\nSubject: hi\r\n\r\nDelivered-To: <body@example.com>\r\n")
+	cases := []struct {
+		address string
+		loop    bool
+	}{
+		{"mailbox@example.com", true},
+		{"other@example.com", true},
+		{"body@example.com", false},
+		{"new@example.com", false},
+	}
+	for _, c := range cases {
+		if want, got := c.loop, IsDeliveryLoop(data, c.address); want != got {
+			t.Errorf("%s: want loop %v, got %v", c.address, want, got)
+		}
+	}
+}
+
+type failWriter struct{}
+
+func (failWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestWriteEnvelopeForDeliveryError(t *testing.T) {
+	en := Envelope{
+		MailFrom: mail.Address{Address: "from@sender.net"},
+		RcptTo:   []mail.Address{{Address: "to@example.com"}},
+		Data:     []byte("Subject: hi\r\n\r\nbody\r\n"),
+	}
+	if err := WriteEnvelopeForDelivery(failWriter{}, en); err == nil {
+		t.Errorf("Want write error")
+	}
+}
+
+func TestGenerateEnvelopeId(t *testing.T) {
+	now := time.Now()
+	ids := make([]string, 100)
+	for i := range ids {
+		// The same time, or one earlier, still gives increasing IDs.
+		ids[i] = GenerateEnvelopeId("m", now.Add(-time.Duration(i%2)))
+	}
+	if !sort.StringsAreSorted(ids) {
+		t.Errorf("Want IDs in the order generated, got %v", ids)
+	}
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if seen[id] {
+			t.Errorf("Duplicate ID %q", id)
+		}
+		seen[id] = true
+		if !strings.HasPrefix(id, "m.") {
+			t.Errorf("Want prefix, got %q", id)
+		}
+	}
+}
+
+func TestCountHops(t *testing.T) {
+	data := []byte("Received: from a\r\nSubject: hi\r\nreceived: from b\r\n\r\nReceived: from c\r\n")
+	if want, got := 2, countHops(data); want != got {
+		t.Errorf("Want %d hops, got %d", want, got)
+	}
+}
+
+func TestEnvelopeJSON(t *testing.T) {
+	en := Envelope{
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4321},
+		MailFrom:   mail.Address{Address: "from@sender.net"},
+		RcptTo:     []mail.Address{{Address: "to@example.com"}},
+		Data:       []byte("Subject: hi\r\n\r\nbody\r\n"),
+		ID:         "m.1",
+	}
+	data, err := json.Marshal(en)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Envelope
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.RemoteAddr == nil {
+		t.Fatal("Want RemoteAddr decoded")
+	}
+	if want, got := "tcp 192.0.2.1:4321", got.RemoteAddr.Network()+" "+got.RemoteAddr.String(); want != got {
+		t.Errorf("Want RemoteAddr %q, got %q", want, got)
+	}
+	if want, got := "from@sender.net", got.MailFrom.Address; want != got {
+		t.Errorf("Want MailFrom %q, got %q", want, got)
+	}
+	if want, got := string(en.Data), string(got.Data); want != got {
+		t.Errorf("Want Data %q, got %q", want, got)
+	}
+
+	en.RemoteAddr = nil
+	data, _ = json.Marshal(en)
+	got = Envelope{}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.RemoteAddr != nil {
+		t.Errorf("Want nil RemoteAddr, got %v", got.RemoteAddr)
+	}
+}
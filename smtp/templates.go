@@ -0,0 +1,155 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package smtp
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// TemplateExt is the file extension of a template file.
+const TemplateExt = ".tmpl"
+
+// TemplateDSN is the name of the template for the human-readable part of a
+// delivery status notification. It is executed with DSNTemplateData.
+const TemplateDSN = "dsn"
+
+// TemplateDSNDelay is the name of the template for the human-readable part of
+// a delivery status notification that warns a message is still being retried.
+// It is also executed with DSNTemplateData.
+const TemplateDSNDelay = "dsn-delay"
+
+var defaultTemplates = map[string]string{
+	TemplateDSN: `* * * Delivery Failure * * *
+
+The server failed to relay the message:
+{{range .Failures}}
+{{.Recipient}}
+{{.Error}}:
+{{.Detail}}
+{{end}}`,
+	TemplateDSNDelay: `* * * Delivery Delayed * * *
+
+The server has not yet been able to relay the message, and will keep trying:
+{{range .Failures}}
+{{.Recipient}}
+{{.Error}}:
+{{.Detail}}
+{{end}}`,
+}
+
+// DSNTemplateData provides the variables for the TemplateDSN template.
+type DSNTemplateData struct {
+	// Hostname is the name of this server.
+	Hostname string
+
+	// Details of the original message.
+	EnvelopeID string
+	MailFrom   string
+	Subject    string
+	Received   time.Time
+	// TLS describes how the original message was received, or is nil.
+	TLS *TLSInfo
+
+	Failures []DSNFailure
+}
+
+// DSNFailure describes a recipient that could not be delivered to.
+type DSNFailure struct {
+	Recipient string
+	// Error describes which step of delivery failed.
+	Error string
+	// Detail is the error that caused the failure.
+	Detail string
+	// Status is the RFC 3463 enhanced status code.
+	Status string
+	// Diagnostic is the reply from the remote server, if there was one.
+	Diagnostic string
+	// Code is the reply code from the remote server, or 0 if there was none.
+	Code int
+
+	// temporary is set if relaying can be retried.
+	temporary bool
+	// unreachable is set if the relay host could not be connected to, so
+	// another MX host can be tried.
+	unreachable bool
+}
+
+// Templates holds the text/template files used to generate the
+// human-readable parts of messages. A template named NAME is loaded from
+// NAME.tmpl, and localized versions from NAME.LANG.tmpl, where LANG is a
+// language tag like "de" or "pt-br". A nil *Templates uses the built-in
+// templates.
+type Templates struct {
+	templates map[string]*template.Template
+}
+
+// LoadTemplates parses all the template files in dir.
+func LoadTemplates(dir string) (*Templates, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Templates{templates: make(map[string]*template.Template)}
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != TemplateExt {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSuffix(file.Name(), TemplateExt))
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err := template.New(key).Parse(string(data))
+		if err != nil {
+			return nil, err
+		}
+		t.templates[key] = tmpl
+	}
+	return t, nil
+}
+
+// Execute writes the template |name| to |w|. The first of |langs| that has a
+// localized template is used, falling back to the unlocalized template, and
+// then the built-in one. A language with a region, like "en-GB", will also
+// match a template for just the language.
+func (t *Templates) Execute(w io.Writer, name string, langs []string, data interface{}) error {
+	return t.lookup(name, langs).Execute(w, data)
+}
+
+func (t *Templates) lookup(name string, langs []string) *template.Template {
+	if t != nil {
+		for _, lang := range langs {
+			lang = strings.ToLower(strings.TrimSpace(lang))
+			if lang == "" {
+				continue
+			}
+			if tmpl, ok := t.templates[name+"."+lang]; ok {
+				return tmpl
+			}
+			if idx := strings.IndexByte(lang, '-'); idx != -1 {
+				if tmpl, ok := t.templates[name+"."+lang[:idx]]; ok {
+					return tmpl
+				}
+			}
+		}
+		if tmpl, ok := t.templates[name]; ok {
+			return tmpl
+		}
+	}
+
+	if def, ok := defaultTemplates[name]; ok {
+		return template.Must(template.New(name).Parse(def))
+	}
+	return template.Must(template.New(name).Parse(fmt.Sprintf("(no template %q)\n", name)))
+}
@@ -0,0 +1,169 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"src.bluestatic.org/mailpopbox/message"
+)
+
+// doXCLIENT handles the Postfix XCLIENT command, with which a trusted relay
+// passes on the client it received the message from. The ADDR, PORT, NAME,
+// HELO, LOGIN, and PROTO attributes are honored, and others are ignored. As
+// with Postfix, the session restarts with a new greeting.
+func (conn *connection) doXCLIENT() {
+	if !conn.trusted {
+		conn.writeReply(550, "5.7.0 insufficient authorization")
+		return
+	}
+	if conn.state != stateNew && conn.state != stateInitial {
+		conn.reply(ReplyBadSequence)
+		return
+	}
+
+	fields := strings.Fields(conn.line)[1:]
+	if len(fields) == 0 {
+		conn.reply(ReplyBadSyntax)
+		return
+	}
+
+	var ip net.IP
+	var port int
+	if addr, ok := conn.remoteAddr.(*net.TCPAddr); ok {
+		ip, port = addr.IP, addr.Port
+	}
+	var name, helo string
+	login, esmtp := conn.authc, conn.esmtp
+	proto := false
+
+	for _, field := range fields {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			conn.reply(ReplyBadSyntax)
+			return
+		}
+		value, err := decodeXtext(kv[1])
+		if err != nil {
+			conn.reply(ReplyBadSyntax)
+			return
+		}
+		attr := strings.ToUpper(kv[0])
+		if value == "[UNAVAILABLE]" || value == "[TEMPUNAVAIL]" {
+			// The client did not log in.
+			if attr == "LOGIN" {
+				login = ""
+			}
+			continue
+		}
+
+		switch attr {
+		case "ADDR":
+			if len(value) > 5 && strings.EqualFold(value[:5], "IPV6:") {
+				value = value[5:]
+			}
+			if ip = net.ParseIP(value); ip == nil {
+				conn.writeReply(501, "5.5.4 invalid ADDR")
+				return
+			}
+		case "PORT":
+			if port, err = strconv.Atoi(value); err != nil || port < 0 || port > 65535 {
+				conn.writeReply(501, "5.5.4 invalid PORT")
+				return
+			}
+		case "NAME":
+			name = value
+		case "HELO":
+			helo = value
+		case "LOGIN":
+			login = value
+		case "PROTO":
+			proto = true
+			switch strings.ToUpper(value) {
+			case "SMTP":
+				esmtp = false
+			case "ESMTP":
+				esmtp = true
+			default:
+				conn.writeReply(501, "5.5.4 invalid PROTO")
+				return
+			}
+		}
+	}
+
+	relay := conn.remoteAddr
+	conn.remoteAddr = &net.TCPAddr{IP: ip, Port: port}
+	conn.xclient = true
+	conn.xclientName = name
+	conn.xclientHelo = helo
+	conn.xclientProto = proto
+	conn.ehlo = helo
+	conn.authc = login
+	conn.esmtp = esmtp
+	conn.log = conn.log.With("origin", conn.remoteAddr)
+	conn.log.Info("doXCLIENT()",
+		"relay", relay,
+		"name", name,
+		"helo", helo,
+		"login", login)
+
+	conn.resetBuffers()
+	conn.setState(stateNew)
+	conn.greet()
+}
+
+// decodeXtext decodes an xtext value (RFC 3461 § 4), in which "+" is followed
+// by the hex code of a character.
+func decodeXtext(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '+' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return "", errors.New("truncated xtext")
+		}
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid xtext: %v", err)
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// receivedFromRe matches the "from" clause of a Received header, capturing
+// the HELO name and the comment that holds the client address.
+var receivedFromRe = regexp.MustCompile(`^from\s+(\S+)\s+\(([^)]*)\)`)
+
+// receivedAddrRe matches the bracketed address in a Received comment, like
+// "mail.example.com [192.0.2.1]".
+var receivedAddrRe = regexp.MustCompile(`\[(?i:IPv6:)?([0-9A-Fa-f.:]+)\]`)
+
+// receivedOrigin returns the HELO name and address of the client named in
+// the topmost Received header of the message |data|, as added by the relay
+// that delivered it. The address is nil if there is no such header.
+func receivedOrigin(data []byte) (string, net.IP) {
+	header, _ := message.Parse(data)
+	m := receivedFromRe.FindStringSubmatch(header.Get("Received"))
+	if m == nil {
+		return "", nil
+	}
+
+	comment := m[2]
+	if am := receivedAddrRe.FindStringSubmatch(comment); am != nil {
+		comment = am[1]
+	}
+	return m[1], net.ParseIP(strings.TrimSpace(comment))
+}
@@ -0,0 +1,227 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package smtp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+type trustedRelayServer struct {
+	deliveryServer
+}
+
+func (s *trustedRelayServer) IsTrustedRelay(addr net.Addr) bool {
+	return true
+}
+
+func TestXCLIENT(t *testing.T) {
+	defer func(r *reverseResolver) { defaultReverseResolver = r }(defaultReverseResolver)
+	defaultReverseResolver = newReverseResolver(func(ctx context.Context, ip string) ([]string, error) {
+		if ip == "192.0.2.1" {
+			return []string{"mail.origin.net."}, nil
+		}
+		return nil, errors.New("no such host")
+	})
+	stubLookupHost(t, map[string][]string{"mail.origin.net": {"192.0.2.1"}})
+
+	// An untrusted client cannot use XCLIENT.
+	l := runServer(t, &testServer{domain: "example.com"})
+	defer l.Close()
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+	runTableTest(t, conn, []requestResponse{
+		{"EHLO gateway.net", 0, func(t testing.TB, conn *textproto.Conn) {
+			_, resp, _ := conn.ReadResponse(250)
+			if strings.Contains(resp, "XCLIENT") {
+				t.Errorf("XCLIENT advertised to untrusted client: %q", resp)
+			}
+		}},
+		{"XCLIENT ADDR=192.0.2.1", 550, nil},
+	})
+
+	s := &trustedRelayServer{deliveryServer{testServer: testServer{domain: "example.com"}}}
+	l = runServer(t, s)
+	defer l.Close()
+	conn = createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	sendData := func(t testing.TB, conn *textproto.Conn) {
+		readCodeLine(t, conn, 354)
+		ok(t, conn.PrintfLine("Subject: relayed\r\n\r\nbody\r\n."))
+		readCodeLine(t, conn, 250)
+	}
+
+	runTableTest(t, conn, []requestResponse{
+		{"EHLO gateway.net", 0, func(t testing.TB, conn *textproto.Conn) {
+			_, resp, _ := conn.ReadResponse(250)
+			if !strings.Contains(resp, "XCLIENT ADDR PORT NAME HELO LOGIN PROTO\n") {
+				t.Errorf("XCLIENT not advertised: %q", resp)
+			}
+		}},
+		{"XCLIENT ADDR=nowhere", 501, nil},
+		{"XCLIENT ADDR=192.0.2.1 PORT=4000 NAME=mail.origin.net HELO=mail.origin.net LOGIN=[UNAVAILABLE]", 220, nil},
+		{"EHLO gateway.net", 0, func(t testing.TB, conn *textproto.Conn) { conn.ReadResponse(250) }},
+		{"MAIL FROM:<sender@origin.net>", 250, nil},
+		{"RCPT TO:<user@example.com>", 250, nil},
+		{"XCLIENT ADDR=192.0.2.2", 503, nil},
+		{"DATA", 0, sendData},
+	})
+
+	if want, got := 1, len(s.messages); want != got {
+		t.Fatalf("Want %d message, got %d", want, got)
+	}
+	env := s.messages[0]
+	if want, got := "192.0.2.1:4000", env.RemoteAddr.String(); want != got {
+		t.Errorf("Want remote address %q, got %q", want, got)
+	}
+	if want, got := "mail.origin.net", env.EHLO; want != got {
+		t.Errorf("Want EHLO %q, got %q", want, got)
+	}
+	if want, got := HeloCheckPass, env.HeloCheck; want != got {
+		t.Errorf("Want HELO check %q, got %q", want, got)
+	}
+	if !strings.HasPrefix(string(env.Data), "Received: from mail.origin.net (mail.origin.net [192.0.2.1])") {
+		t.Errorf("Unexpected Received header: %q", env.Data)
+	}
+}
+
+func TestXCLIENTLogin(t *testing.T) {
+	s := &trustedRelayServer{deliveryServer{testServer: testServer{domain: "example.com"}}}
+	l := runServer(t, s)
+	defer l.Close()
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	runTableTest(t, conn, []requestResponse{
+		{"EHLO gateway.net", 0, func(t testing.TB, conn *textproto.Conn) { conn.ReadResponse(250) }},
+		// Without a login, the mailbox cannot send.
+		{"MAIL FROM:<mailbox@example.com>", 550, nil},
+		{"XCLIENT ADDR=192.0.2.1 PROTO=FTP", 501, nil},
+		{"XCLIENT ADDR=192.0.2.1 LOGIN=mailbox+40example.com PROTO=SMTP", 220, nil},
+		{"EHLO gateway.net", 0, func(t testing.TB, conn *textproto.Conn) { conn.ReadResponse(250) }},
+		{"MAIL FROM:<mailbox@example.com>", 250, nil},
+		{"RCPT TO:<dest@another.net>", 250, nil},
+		{"DATA", 0, func(t testing.TB, conn *textproto.Conn) {
+			readCodeLine(t, conn, 354)
+			ok(t, conn.PrintfLine("Subject: sent\r\n\r\nbody\r\n."))
+			readCodeLine(t, conn, 250)
+		}},
+		// A login of [UNAVAILABLE] logs out.
+		{"XCLIENT LOGIN=[UNAVAILABLE]", 220, nil},
+		{"EHLO gateway.net", 0, func(t testing.TB, conn *textproto.Conn) { conn.ReadResponse(250) }},
+		{"MAIL FROM:<mailbox@example.com>", 550, nil},
+	})
+
+	if want, got := 1, len(s.relayed); want != got {
+		t.Fatalf("Want %d relayed message, got %d", want, got)
+	}
+	// PROTO is kept despite the EHLO.
+	if !strings.Contains(string(s.relayed[0].Data), "with SMTP id") {
+		t.Errorf("Want SMTP protocol in Received header: %q", s.relayed[0].Data)
+	}
+}
+
+func TestTrustedRelayReceivedOrigin(t *testing.T) {
+	defer func(r *reverseResolver) { defaultReverseResolver = r }(defaultReverseResolver)
+	defaultReverseResolver = newReverseResolver(func(ctx context.Context, ip string) ([]string, error) {
+		return nil, errors.New("no such host")
+	})
+
+	s := &trustedRelayServer{deliveryServer{testServer: testServer{domain: "example.com"}}}
+	l := runServer(t, s)
+	defer l.Close()
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	runTableTest(t, conn, []requestResponse{
+		{"EHLO gateway.net", 0, func(t testing.TB, conn *textproto.Conn) { conn.ReadResponse(250) }},
+		{"MAIL FROM:<sender@origin.net>", 250, nil},
+		{"RCPT TO:<user@example.com>", 250, nil},
+		{"DATA", 0, func(t testing.TB, conn *textproto.Conn) {
+			readCodeLine(t, conn, 354)
+			ok(t, conn.PrintfLine("Received: from client.origin.net (unknown [198.51.100.9])\r\n"+
+				"\tby gateway.net with ESMTP id 1234\r\nSubject: relayed\r\n\r\nbody\r\n."))
+			readCodeLine(t, conn, 250)
+		}},
+	})
+
+	if want, got := 1, len(s.messages); want != got {
+		t.Fatalf("Want %d message, got %d", want, got)
+	}
+	env := s.messages[0]
+	if want, got := "198.51.100.9:0", env.RemoteAddr.String(); want != got {
+		t.Errorf("Want remote address %q, got %q", want, got)
+	}
+	if want, got := "client.origin.net", env.EHLO; want != got {
+		t.Errorf("Want EHLO %q, got %q", want, got)
+	}
+	// The trace header still records the relay's connection.
+	if !strings.HasPrefix(string(env.Data), "Received: from gateway.net (") {
+		t.Errorf("Unexpected Received header: %q", env.Data)
+	}
+}
+
+func TestReceivedOrigin(t *testing.T) {
+	cases := []struct {
+		received string
+		helo     string
+		ip       string
+	}{
+		{"from mx.example.com (mx.example.com [192.0.2.1]) by gw", "mx.example.com", "192.0.2.1"},
+		{"from client (unknown [IPv6:2001:db8::1])\n by gw", "client", "2001:db8::1"},
+		{"from client (192.0.2.3) by gw", "client", "192.0.2.3"},
+		{"by gw with local", "", ""},
+		{"from client (unknown) by gw", "client", ""},
+	}
+	for _, c := range cases {
+		helo, ip := receivedOrigin([]byte("Received: " + c.received + "\n\nbody\n"))
+		if c.ip == "" {
+			if ip != nil {
+				t.Errorf("%q: want no address, got %v", c.received, ip)
+			}
+			continue
+		}
+		if want, got := c.helo, helo; want != got {
+			t.Errorf("%q: want HELO %q, got %q", c.received, want, got)
+		}
+		if want, got := c.ip, ip.String(); want != got {
+			t.Errorf("%q: want IP %q, got %q", c.received, want, got)
+		}
+	}
+}
+
+func TestDecodeXtext(t *testing.T) {
+	if got, err := decodeXtext("a+2Bb+3Dc"); err != nil || got != "a+b=c" {
+		t.Errorf("Want %q, got %q (%v)", "a+b=c", got, err)
+	}
+	for _, bad := range []string{"a+2", "a+zz"} {
+		if _, err := decodeXtext(bad); err == nil {
+			t.Errorf("%q: want error", bad)
+		}
+	}
+}
+
+func TestTrustedListener(t *testing.T) {
+	// Options.Trusted trusts a client that the server does not.
+	l := runServerWithOptions(t, &testServer{domain: "example.com"}, Options{Trusted: true})
+	defer l.Close()
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+	runTableTest(t, conn, []requestResponse{
+		{"EHLO gateway.net", 0, func(t testing.TB, conn *textproto.Conn) {
+			_, resp, _ := conn.ReadResponse(250)
+			if !strings.Contains(resp, "XCLIENT") {
+				t.Errorf("XCLIENT not advertised to trusted client: %q", resp)
+			}
+		}},
+	})
+}
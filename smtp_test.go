@@ -8,16 +8,23 @@ package main
 
 import (
 	"bytes"
+	"expvar"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/mail"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"go.uber.org/zap"
 
+	"src.bluestatic.org/mailpopbox/maildrop"
+	"src.bluestatic.org/mailpopbox/maillog"
 	"src.bluestatic.org/mailpopbox/smtp"
 )
 
@@ -155,10 +162,25 @@ type testMTA struct {
 	relayed chan smtp.Envelope
 }
 
-func (m *testMTA) RelayMessage(en smtp.Envelope) {
+func (m *testMTA) relay(en smtp.Envelope) {
 	m.relayed <- en
 }
 
+func (m *testMTA) QueueMessage(en smtp.Envelope, prepare func(*smtp.Envelope), done func(smtp.Envelope)) {
+	go queueMessage(m.relay, en, prepare, done)
+}
+
+// queueMessage runs |prepare| and then |relay| on |en|, as QueueMessage does.
+func queueMessage(relay func(smtp.Envelope), en smtp.Envelope, prepare func(*smtp.Envelope), done func(smtp.Envelope)) {
+	if prepare != nil {
+		prepare(&en)
+	}
+	relay(en)
+	if done != nil {
+		done(en)
+	}
+}
+
 func newTestMTA() *testMTA {
 	return &testMTA{
 		relayed: make(chan smtp.Envelope),
@@ -175,6 +197,8 @@ func TestBasicRelay(t *testing.T) {
 	buf := new(bytes.Buffer)
 	fmt.Fprintln(buf, "From: <mailbox@example.com>\r")
 	fmt.Fprintln(buf, "To: <dest@another.net>\r")
+	fmt.Fprintln(buf, "Date: Thu, 5 Mar 2020 09:08:07 +0000\r")
+	fmt.Fprintln(buf, "Message-ID: <basic@example.com>\r")
 	fmt.Fprintf(buf, "Subject: Basic relay\n\n")
 	fmt.Fprintln(buf, "This is a basic relay message")
 
@@ -247,3 +271,1135 @@ func TestSendAsRelay(t *testing.T) {
 		t.Errorf("Could not find modified Subject: header in message %q", msg)
 	}
 }
+
+func TestSendAsMessageID(t *testing.T) {
+	mta := newTestMTA()
+	server := smtpServer{
+		mta: mta,
+		log: zap.NewNop(),
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintln(buf, "From: <mailbox@example.com>")
+	fmt.Fprintln(buf, "To: <valid@dest.xyz>")
+	fmt.Fprintln(buf, "Message-ID: <abc123@mail.provider.net>")
+	fmt.Fprintln(buf, "References: <original@dest.xyz> <older@mail.provider.net>")
+	fmt.Fprintf(buf, "Subject: Re: thread [sendas:source]\n\n")
+	fmt.Fprintln(buf, "Reply body")
+
+	en := smtp.Envelope{
+		MailFrom: mail.Address{Address: "mailbox@example.com"},
+		RcptTo:   []mail.Address{{Address: "valid@dest.xyz"}},
+		Data:     buf.Bytes(),
+		ID:       "id1",
+	}
+
+	server.RelayMessage(en, en.MailFrom.Address)
+
+	relayed := <-mta.relayed
+	msg, err := mail.ReadMessage(bytes.NewReader(relayed.Data))
+	if err != nil {
+		t.Fatalf("Failed to parse relayed message: %v", err)
+	}
+
+	msgID := msg.Header.Get("Message-ID")
+	if !strings.HasSuffix(msgID, "@example.com>") {
+		t.Errorf("Message-ID %q should use the send-as domain", msgID)
+	}
+	if want, got := "<original@dest.xyz> <older@mail.provider.net>", msg.Header.Get("References"); want != got {
+		t.Errorf("Want References %q, got %q", want, got)
+	}
+}
+
+func TestSendAsReplyTo(t *testing.T) {
+	cases := []struct {
+		replyTo string
+		strip   bool
+		want    string
+	}{
+		{"<mailbox@example.com>", false, "<source@example.com>"},
+		{"\"Me\" <mailbox@example.com>", true, ""},
+		{"<mailbox@example.com>, <other@dest.xyz>", true, "<other@dest.xyz>"},
+		{"<mailbox@example.com>, <other@dest.xyz>", false, "<source@example.com>, <other@dest.xyz>"},
+		{"<other@dest.xyz>", true, "<other@dest.xyz>"},
+	}
+	for i, c := range cases {
+		mta := newTestMTA()
+		server := smtpServer{
+			config: Config{
+				Servers: []Server{
+					{
+						Domain:             "example.com",
+						SendAsStripReplyTo: c.strip,
+					},
+				},
+			},
+			mta: mta,
+			log: zap.NewNop(),
+		}
+
+		buf := new(bytes.Buffer)
+		fmt.Fprintln(buf, "From: <mailbox@example.com>")
+		fmt.Fprintln(buf, "To: <valid@dest.xyz>")
+		fmt.Fprintf(buf, "Reply-To: %s\n", c.replyTo)
+		fmt.Fprintf(buf, "Subject: Reply-To [sendas:source]\n\n")
+		fmt.Fprintln(buf, "Body")
+
+		en := smtp.Envelope{
+			MailFrom: mail.Address{Address: "mailbox@example.com"},
+			RcptTo:   []mail.Address{{Address: "valid@dest.xyz"}},
+			Data:     buf.Bytes(),
+			ID:       "id1",
+		}
+
+		server.RelayMessage(en, en.MailFrom.Address)
+
+		relayed := <-mta.relayed
+		msg, err := mail.ReadMessage(bytes.NewReader(relayed.Data))
+		if err != nil {
+			t.Fatalf("Case %d: failed to parse relayed message: %v", i, err)
+		}
+		if want, got := c.want, msg.Header.Get("Reply-To"); want != got {
+			t.Errorf("Case %d: want Reply-To %q, got %q", i, want, got)
+		}
+	}
+}
+
+func TestDeliveryBackpressure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := smtpServer{
+		config: Config{
+			Servers: []Server{
+				{
+					Domain:       "example.com",
+					MaildropPath: dir,
+				},
+			},
+		},
+		deliverySlots: make(chan struct{}, 1),
+		log:           zap.NewNop(),
+	}
+
+	en := smtp.Envelope{
+		MailFrom: mail.Address{Address: "from@sender.net"},
+		RcptTo:   []mail.Address{{Address: "to@example.com"}},
+		Data:     []byte("Subject: hi\r\n\r\nbody\r\n"),
+		ID:       "m.1",
+	}
+
+	// Occupy the only slot.
+	server.deliverySlots <- struct{}{}
+	if reply := server.DeliverMessage(en); reply == nil || reply.Code != 451 {
+		t.Errorf("Want 451 reply when saturated, got %v", reply)
+	}
+
+	<-server.deliverySlots
+	if reply := server.DeliverMessage(en); reply != nil {
+		t.Errorf("Want delivery to succeed, got %v", reply)
+	}
+	if want, got := 0, len(server.deliverySlots); want != got {
+		t.Errorf("Want %d slots in use after delivery, got %d", want, got)
+	}
+}
+
+func TestSendAsMessageIDSplitTransactions(t *testing.T) {
+	mta := newTestMTA()
+	server := smtpServer{
+		mta: mta,
+		log: zap.NewNop(),
+	}
+
+	// A client that receives 452 "too many recipients" sends the message again
+	// to the remaining recipients.
+	var ids []string
+	for _, rcpt := range []string{"one@dest.xyz", "two@dest.xyz"} {
+		en := smtp.Envelope{
+			MailFrom: mail.Address{Address: "mailbox@example.com"},
+			RcptTo:   []mail.Address{{Address: rcpt}},
+			Data:     []byte("From: <mailbox@example.com>\r\nMessage-ID: <abc123@mail.provider.net>\r\nSubject: Hi [sendas:source]\r\n\r\nBody\r\n"),
+			ID:       "id-" + rcpt,
+		}
+		server.RelayMessage(en, en.MailFrom.Address)
+
+		relayed := <-mta.relayed
+		msg, err := mail.ReadMessage(bytes.NewReader(relayed.Data))
+		if err != nil {
+			t.Fatalf("Failed to parse relayed message: %v", err)
+		}
+		ids = append(ids, msg.Header.Get("Message-ID"))
+	}
+
+	if ids[0] != ids[1] {
+		t.Errorf("Want the same Message-ID in each transaction, got %q and %q", ids[0], ids[1])
+	}
+	if !strings.HasSuffix(ids[0], "@example.com>") {
+		t.Errorf("Message-ID %q should use the send-as domain", ids[0])
+	}
+}
+
+func TestVerifyAddressURL(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("address") {
+		case "valid@example.com":
+			w.WriteHeader(http.StatusNoContent)
+		case "broken@example.com":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	s := smtpServer{
+		config: Config{
+			Servers: []Server{
+				{
+					Domain:           "example.com",
+					BlockedAddresses: []string{"blocked@example.com"},
+					VerifyURL:        ts.URL + "/verify?token=x",
+				},
+			},
+		},
+		log: zap.NewNop(),
+	}
+
+	cases := []struct {
+		address string
+		reply   smtp.ReplyLine
+	}{
+		{"valid@example.com", smtp.ReplyOK},
+		{"unknown@example.com", smtp.ReplyBadMailbox},
+		{"blocked@example.com", smtp.ReplyMailboxUnallowed},
+		{"broken@example.com", replyVerifyUnavailable},
+		{"valid@other.net", smtp.ReplyBadMailbox},
+	}
+	for _, c := range cases {
+		if want, got := c.reply, s.VerifyAddress(mail.Address{Address: c.address}); want != got {
+			t.Errorf("%s: want %v, got %v", c.address, want, got)
+		}
+	}
+
+	ts.Close()
+	if want, got := replyVerifyUnavailable, s.VerifyAddress(mail.Address{Address: "valid@example.com"}); want != got {
+		t.Errorf("Want %v when the endpoint is down, got %v", want, got)
+	}
+}
+
+func TestRelayResultMetrics(t *testing.T) {
+	server := smtpServer{log: zap.NewNop()}
+	counter := func(name string) int64 {
+		if v, ok := relayMetrics.Get(name).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	delivered, failed := counter("delivered"), counter("failed")
+
+	server.RelayResult(smtp.RelayResult{Recipient: "a@dest.xyz", Code: 250, Status: "2.0.0"})
+	server.RelayResult(smtp.RelayResult{Recipient: "b@dest.xyz", Code: 550, Status: "5.0.0", Error: "failed to RCPT TO"})
+	server.RelayResult(smtp.RelayResult{Recipient: "c@dest.xyz", Status: "5.0.0", Error: "failed to dial host"})
+
+	if want, got := delivered+1, counter("delivered"); want != got {
+		t.Errorf("Want %d delivered, got %d", want, got)
+	}
+	if want, got := failed+2, counter("failed"); want != got {
+		t.Errorf("Want %d failed, got %d", want, got)
+	}
+}
+
+func TestRelayHelloName(t *testing.T) {
+	server := smtpServer{
+		config: Config{
+			Hostname:      "mx.example.com",
+			RelayHostname: "out.example.com",
+			Servers: []Server{
+				{Domain: "example.com"},
+				{Domain: "other.net", RelayHostname: "mail.other.net"},
+			},
+		},
+		log: zap.NewNop(),
+	}
+
+	cases := []struct {
+		from, name string
+	}{
+		{"mailbox@example.com", "out.example.com"},
+		{"mailbox@other.net", "mail.other.net"},
+	}
+	for _, c := range cases {
+		en := smtp.Envelope{MailFrom: mail.Address{Address: c.from}}
+		if want, got := c.name, server.RelayHelloName(en); want != got {
+			t.Errorf("%s: want %q, got %q", c.from, want, got)
+		}
+	}
+
+	server.config.RelayHostname = ""
+	if want, got := "", server.RelayHelloName(smtp.Envelope{MailFrom: mail.Address{Address: "mailbox@example.com"}}); want != got {
+		t.Errorf("Want %q to use the default, got %q", want, got)
+	}
+}
+
+func TestBounceSignatures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := smtpServer{
+		config: Config{
+			Servers: []Server{
+				{
+					Domain:       "example.com",
+					MaildropPath: dir,
+					BATVKey:      "secret",
+				},
+			},
+		},
+		log: zap.NewNop(),
+	}
+
+	out := smtp.Envelope{MailFrom: mail.Address{Address: "source@example.com"}}
+	server.signSender(&out)
+	signed := out.MailFrom.Address
+	if !strings.HasPrefix(signed, "prvs=") {
+		t.Fatalf("Want a signed sender, got %q", signed)
+	}
+	if want, got := smtp.ReplyOK, server.VerifyAddress(mail.Address{Address: signed}); want != got {
+		t.Errorf("Want signed address to verify, got %v", got)
+	}
+
+	cases := []struct {
+		from, to string
+		reject   bool
+		marked   bool
+	}{
+		{"", signed, false, false},
+		{"", "source@example.com", false, true},
+		{"", "prvs=0000abcdef=source@example.com", false, true},
+		{"someone@other.net", "source@example.com", false, false},
+		{"someone@other.net", signed, false, false},
+		{"", "source@example.com", true, false},
+	}
+	for i, c := range cases {
+		server.config.Servers[0].BATVReject = c.reject
+
+		en := smtp.Envelope{
+			MailFrom: mail.Address{Address: c.from},
+			RcptTo:   []mail.Address{{Address: c.to}},
+			Data:     []byte("Subject: Undeliverable\r\n\r\nbody\r\n"),
+			ID:       fmt.Sprintf("m.%d", i),
+		}
+		reply := server.DeliverMessage(en)
+		if c.reject {
+			if reply == nil || reply.Code != 550 {
+				t.Errorf("%d: want 550, got %v", i, reply)
+			}
+			continue
+		}
+		if reply != nil {
+			t.Errorf("%d: want delivery, got %v", i, reply)
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, en.ID+".msg"))
+		if err != nil {
+			t.Fatalf("%d: failed to read message: %v", i, err)
+		}
+		if !bytes.HasPrefix(data, []byte("Delivered-To: <source@example.com>\r\n")) {
+			t.Errorf("%d: want the signature removed, got %q", i, data)
+		}
+		if want, got := c.marked, bytes.Contains(data, []byte("X-Mailpopbox-BATV: fail")); want != got {
+			t.Errorf("%d: want marked %v, got %q", i, want, data)
+		}
+	}
+}
+
+func TestDeliveryLoop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := smtpServer{
+		config: Config{
+			Servers: []Server{
+				{
+					Domain:       "example.com",
+					MaildropPath: dir,
+				},
+			},
+		},
+		log: zap.NewNop(),
+	}
+
+	en := smtp.Envelope{
+		MailFrom: mail.Address{Address: "from@sender.net"},
+		RcptTo:   []mail.Address{{Address: "to@example.com"}},
+		Data:     []byte("Delivered-To: <to@example.com>\r\nSubject: hi\r\n\r\nbody\r\n"),
+		ID:       "m.loop",
+	}
+	if want, got := smtp.ReplyMailLoop, server.DeliverMessage(en); got == nil || want != *got {
+		t.Errorf("Want %v, got %v", want, got)
+	}
+
+	en.RcptTo[0].Address = "other@example.com"
+	if reply := server.DeliverMessage(en); reply != nil {
+		t.Errorf("Want delivery to another address, got %v", reply)
+	}
+}
+
+func TestVerifyAddressFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "addrlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	blockedPath := filepath.Join(dir, "blocked")
+	allowedPath := filepath.Join(dir, "allowed")
+	ioutil.WriteFile(blockedPath, []byte("# Spam targets\nblocked@example.com\n"), 0644)
+	ioutil.WriteFile(allowedPath, []byte("valid@example.com\n*-list@example.com\nblocked@example.com\n"), 0644)
+
+	s := smtpServer{
+		config: Config{
+			Servers: []Server{
+				{
+					Domain:               "example.com",
+					BlockedAddressesFile: blockedPath,
+					AllowedAddressesFile: allowedPath,
+				},
+			},
+		},
+		log: zap.NewNop(),
+	}
+
+	cases := []struct {
+		address string
+		reply   smtp.ReplyLine
+	}{
+		{"valid@example.com", smtp.ReplyOK},
+		{"news-list@example.com", smtp.ReplyOK},
+		{"mailbox@example.com", smtp.ReplyOK},
+		{"unknown@example.com", smtp.ReplyBadMailbox},
+		{"blocked@example.com", smtp.ReplyMailboxUnallowed},
+	}
+	for _, c := range cases {
+		if want, got := c.reply, s.VerifyAddress(mail.Address{Address: c.address}); want != got {
+			t.Errorf("%s: want %v, got %v", c.address, want, got)
+		}
+	}
+
+	// Rewrite the file with a different modification time.
+	ioutil.WriteFile(blockedPath, []byte("valid@example.com\n"), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(blockedPath, later, later)
+
+	if want, got := smtp.ReplyMailboxUnallowed, s.VerifyAddress(mail.Address{Address: "valid@example.com"}); want != got {
+		t.Errorf("Want %v after reload, got %v", want, got)
+	}
+	if want, got := smtp.ReplyOK, s.VerifyAddress(mail.Address{Address: "blocked@example.com"}); want != got {
+		t.Errorf("Want %v after reload, got %v", want, got)
+	}
+
+	// A file that cannot be read keeps the last version.
+	os.Remove(blockedPath)
+	if want, got := smtp.ReplyMailboxUnallowed, s.VerifyAddress(mail.Address{Address: "valid@example.com"}); want != got {
+		t.Errorf("Want %v after removal, got %v", want, got)
+	}
+
+	s.config.Servers[0].BlockedAddressesFile = filepath.Join(dir, "missing")
+	if want, got := replyVerifyUnavailable, s.VerifyAddress(mail.Address{Address: "valid@example.com"}); want != got {
+		t.Errorf("Want %v for a missing file, got %v", want, got)
+	}
+}
+
+func TestDeliveryQuota(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := smtpServer{
+		config: Config{
+			Servers: []Server{
+				{
+					Domain:        "example.com",
+					MaildropPath:  dir,
+					MaildropQuota: 12000,
+				},
+			},
+		},
+		log: zap.NewNop(),
+	}
+
+	deliver := func(id string, size int) *smtp.ReplyLine {
+		return s.DeliverMessage(smtp.Envelope{
+			MailFrom: mail.Address{Address: "sender@mail.net"},
+			RcptTo:   []mail.Address{{Address: "receive@example.com"}},
+			Data:     bytes.Repeat([]byte("x"), size),
+			ID:       id,
+		})
+	}
+
+	start := time.Now().Add(-time.Hour)
+	for i, id := range []string{"m1", "m2", "m3"} {
+		if rl := deliver(id, 3000); rl != nil {
+			t.Fatalf("Failed to deliver %s: %v", id, rl)
+		}
+		mtime := start.Add(time.Duration(i) * time.Minute)
+		os.Chtimes(filepath.Join(dir, id+".msg"), mtime, mtime)
+	}
+
+	if want, got := &replyOverQuotaSize, deliver("huge", 13000); *want != *got {
+		t.Errorf("Want %v, got %v", want, got)
+	}
+	if want, got := &replyMailboxFull, deliver("m4", 3000); *want != *got {
+		t.Errorf("Want %v, got %v", want, got)
+	}
+
+	s.config.Servers[0].QuotaTrimOldest = true
+	if rl := deliver("m4", 3000); rl != nil {
+		t.Fatalf("Failed to deliver with trimming: %v", rl)
+	}
+
+	entries, err := maildrop.New(dir).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, entry := range entries {
+		ids = append(ids, entry.ID)
+	}
+	// Only the oldest message needs to be removed to fit the new one and the
+	// notice.
+	if want, got := 4, len(ids); want != got {
+		t.Fatalf("Want %d messages, got %v", want, ids)
+	}
+	if ids[0] != "m2" || ids[1] != "m3" || ids[2] != "m4" || !strings.HasPrefix(ids[3], "q.") {
+		t.Errorf("Want m2, m3, m4, and a notice, got %v", ids)
+	}
+
+	notice, _ := ioutil.ReadFile(filepath.Join(dir, ids[3]+".msg"))
+	if !bytes.Contains(notice, []byte("m1")) || bytes.Contains(notice, []byte("m2")) {
+		t.Errorf("Notice does not list only the removed message: %s", notice)
+	}
+	if usage, _ := maildrop.New(dir).Usage(); usage > 12000 {
+		t.Errorf("Want usage within quota, got %d", usage)
+	}
+}
+
+func TestDeliveryQuotaNearlyFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := smtpServer{
+		config: Config{
+			Servers: []Server{
+				{
+					Domain:          "example.com",
+					MaildropPath:    dir,
+					MaildropQuota:   12000,
+					QuotaTrimOldest: true,
+				},
+			},
+		},
+		log: zap.NewNop(),
+	}
+
+	deliver := func(id string, size int) *smtp.ReplyLine {
+		return s.DeliverMessage(smtp.Envelope{
+			MailFrom: mail.Address{Address: "sender@mail.net"},
+			RcptTo:   []mail.Address{{Address: "receive@example.com"}},
+			Data:     bytes.Repeat([]byte("x"), size),
+			ID:       id,
+		})
+	}
+
+	for _, id := range []string{"m1", "m2"} {
+		if rl := deliver(id, 3000); rl != nil {
+			t.Fatalf("Failed to deliver %s: %v", id, rl)
+		}
+	}
+
+	// A message just under the quota leaves no room for the notice even in
+	// an empty mailbox, so nothing is removed.
+	if want, got := &replyMailboxFull, deliver("big", 11900); got == nil || *want != *got {
+		t.Errorf("Want %v, got %v", want, got)
+	}
+	entries, err := maildrop.New(dir).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(entries); want != got {
+		t.Errorf("Want %d messages kept, got %v", want, entries)
+	}
+
+	// A message that fits with the notice replaces everything else.
+	if rl := deliver("big", 11000); rl != nil {
+		t.Fatalf("Failed to deliver with trimming: %v", rl)
+	}
+	entries, _ = maildrop.New(dir).List()
+	if want, got := 2, len(entries); want != got || entries[0].ID != "big" {
+		t.Errorf("Want only big and a notice, got %v", entries)
+	}
+	if usage, _ := maildrop.New(dir).Usage(); usage > 12000 {
+		t.Errorf("Want usage within quota, got %d", usage)
+	}
+}
+
+func TestDeliveryQuotaHeaders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := smtpServer{
+		config: Config{
+			Servers: []Server{
+				{
+					Domain:        "example.com",
+					MaildropPath:  dir,
+					MaildropQuota: 6000,
+				},
+			},
+		},
+		log: zap.NewNop(),
+	}
+
+	deliver := func(id string) *smtp.ReplyLine {
+		en := smtp.Envelope{
+			MailFrom: mail.Address{Address: "sender@mail.net"},
+			RcptTo:   []mail.Address{{Address: "receive@example.com"}},
+			Data:     bytes.Repeat([]byte("x"), 2950),
+			ID:       id,
+		}
+		en.AddHeader("X-Filter", "checked")
+		return s.DeliverMessage(en)
+	}
+
+	if rl := deliver("m1"); rl != nil {
+		t.Fatalf("Failed to deliver m1: %v", rl)
+	}
+	// The data of both fits, but not with the headers added on delivery.
+	if want, got := &replyMailboxFull, deliver("m2"); got == nil || *want != *got {
+		t.Errorf("Want %v, got %v", want, got)
+	}
+	if usage, _ := maildrop.New(dir).Usage(); usage > 6000 {
+		t.Errorf("Want usage within quota, got %d", usage)
+	}
+}
+
+func TestDeliveryQuotaFolder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := Server{
+		Domain:          "example.com",
+		MaildropPath:    dir,
+		MaildropQuota:   12000,
+		QuotaTrimOldest: true,
+		Quarantine: &QuarantineConfig{
+			Rules: []QuarantineRule{{Header: "X-Spam-Flag"}},
+		},
+	}
+	q, err := newQuarantine(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := smtpServer{
+		config:      Config{Servers: []Server{config}},
+		quarantines: map[string]*quarantine{"example.com": q},
+		log:         zap.NewNop(),
+	}
+
+	deliver := func(id string, data []byte) *smtp.ReplyLine {
+		return s.DeliverMessage(smtp.Envelope{
+			MailFrom: mail.Address{Address: "sender@mail.net"},
+			RcptTo:   []mail.Address{{Address: "receive@example.com"}},
+			Data:     data,
+			ID:       id,
+		})
+	}
+
+	for _, id := range []string{"m1", "m2", "m3"} {
+		if rl := deliver(id, bytes.Repeat([]byte("x"), 3000)); rl != nil {
+			t.Fatalf("Failed to deliver %s: %v", id, rl)
+		}
+	}
+
+	// The quarantine is empty, so the spam fits without trimming the inbox.
+	spam := append([]byte("X-Spam-Flag: YES\r\n\r\n"), bytes.Repeat([]byte("x"), 4000)...)
+	if rl := deliver("spam", spam); rl != nil {
+		t.Fatalf("Failed to deliver spam: %v", rl)
+	}
+
+	entries, err := maildrop.New(dir).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 3, len(entries); want != got || entries[0].ID != "m1" {
+		t.Errorf("Want the inbox untouched, got %v", entries)
+	}
+	folder, err := maildrop.New(dir).Folder(defaultQuarantineFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err = folder.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(entries); want != got || entries[0].ID != "spam" {
+		t.Errorf("Want only spam in the quarantine, got %v", entries)
+	}
+}
+
+func TestAuthenticateToken(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.PostFormValue("token") {
+		case "good":
+			fmt.Fprint(w, `{"active":true,"username":"mailbox@example.com"}`)
+		case "other-user":
+			fmt.Fprint(w, `{"active":true,"username":"someone@example.com"}`)
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			fmt.Fprint(w, `{"active":false}`)
+		}
+	}))
+	defer ts.Close()
+
+	s := tokenAuthServer{&smtpServer{
+		config: Config{
+			Servers: []Server{
+				{
+					Domain:                "example.com",
+					TokenIntrospectionURL: ts.URL,
+				},
+				{
+					Domain: "other.net",
+				},
+			},
+		},
+		log: zap.NewNop(),
+	}}
+
+	if !s.config.hasTokenAuth() {
+		t.Errorf("Want token auth enabled")
+	}
+
+	cases := []struct {
+		user, token string
+		ok          bool
+	}{
+		{"mailbox@example.com", "good", true},
+		{"mailbox@example.com", "expired", false},
+		{"mailbox@example.com", "other-user", false},
+		{"mailbox@example.com", "broken", false},
+		{"someone@example.com", "good", false},
+		{"mailbox@other.net", "good", false},
+	}
+	for _, c := range cases {
+		if want, got := c.ok, s.AuthenticateToken(c.user, c.token); want != got {
+			t.Errorf("%s %s: want %v, got %v", c.user, c.token, want, got)
+		}
+	}
+}
+
+// resultMTA reports to its server that each recipient is delivered, unless
+// the address starts with "fail".
+type resultMTA struct {
+	server  *smtpServer
+	relayed chan string
+}
+
+func (m *resultMTA) relay(en smtp.Envelope) {
+	for _, rcpt := range en.RcptTo {
+		r := smtp.RelayResult{ID: en.ID, Recipient: rcpt.Address, Code: 250, Status: "2.0.0"}
+		if strings.HasPrefix(rcpt.Address, "fail") {
+			r.Code, r.Status, r.Error = 550, "5.1.1", "failed to RCPT TO"
+		}
+		m.server.RelayResult(r)
+	}
+	m.relayed <- en.ID
+}
+
+func (m *resultMTA) QueueMessage(en smtp.Envelope, prepare func(*smtp.Envelope), done func(smtp.Envelope)) {
+	go queueMessage(m.relay, en, prepare, done)
+}
+
+func TestSentFolder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := &smtpServer{
+		config: Config{
+			Servers: []Server{
+				{
+					Domain:       "example.com",
+					MaildropPath: dir,
+					SentFolder:   "sent",
+				},
+			},
+		},
+		log: zap.NewNop(),
+	}
+	mta := &resultMTA{server: server, relayed: make(chan string)}
+	server.mta = mta
+
+	relay := func(id string, rcptTo ...string) {
+		en := smtp.Envelope{
+			MailFrom: mail.Address{Address: "mailbox@example.com"},
+			Data:     []byte("From: <mailbox@example.com>\r\nSubject: Hello [sendas:alice]\r\n\r\nbody\r\n"),
+			ID:       id,
+		}
+		for _, addr := range rcptTo {
+			en.RcptTo = append(en.RcptTo, mail.Address{Address: addr})
+		}
+		server.RelayMessage(en, "mailbox@example.com")
+		if want, got := id, <-mta.relayed; want != got {
+			t.Errorf("Want relayed %q, got %q", want, got)
+		}
+	}
+	relay("m1", "fail@dest.net")
+	relay("m2", "fail@dest.net", "a@dest.net", "b@dest.net")
+
+	entries, err := maildrop.New(filepath.Join(dir, "sent")).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(entries); want != got {
+		t.Fatalf("Want %d sent message, got %v", want, entries)
+	}
+	if want, got := "m2", entries[0].ID; want != got {
+		t.Errorf("Want sent message %q, got %q", want, got)
+	}
+
+	// The copy is of the message as sent.
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "sent", "m2.msg"))
+	if !bytes.Contains(data, []byte("From: <alice@example.com>")) {
+		t.Errorf("Sent copy does not have the send-as address: %s", data)
+	}
+
+	// Nothing is held once relaying finishes.
+	if _, ok := server.releaseSentCopy("m1"); ok {
+		t.Errorf("Undelivered message is still held")
+	}
+}
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mta := newTestMTA()
+	server := &smtpServer{
+		config: Config{
+			Servers: []Server{
+				{
+					Domain:       "example.com",
+					MaildropPath: dir,
+					Archive: &ArchiveConfig{
+						Inbound:  true,
+						Outbound: true,
+						Folder:   "journal",
+						Address:  "journal@archive.net",
+					},
+				},
+			},
+		},
+		mta: mta,
+		log: zap.NewNop(),
+	}
+
+	en := smtp.Envelope{
+		MailFrom: mail.Address{Address: "sender@mail.net"},
+		RcptTo:   []mail.Address{{Address: "hidden@example.com"}},
+		Data:     []byte("Subject: inbound\r\n\r\nbody\r\n"),
+		ID:       "m1",
+	}
+	en.AddHeader("X-Spam-Score", "1.0")
+	en.Annotate("rule", "NO_DATE")
+	if rl := server.DeliverMessage(en); rl != nil {
+		t.Fatalf("Failed to deliver: %v", rl)
+	}
+	journal := <-mta.relayed
+	if want, got := "journal@archive.net", journal.RcptTo[0].Address; want != got {
+		t.Errorf("Want journal recipient %q, got %q", want, got)
+	}
+	if want, got := "mailbox@example.com", journal.MailFrom.Address; want != got {
+		t.Errorf("Want journal sender %q, got %q", want, got)
+	}
+	if !bytes.HasPrefix(journal.Data, []byte("X-Envelope-From: <sender@mail.net>\r\nX-Envelope-To: <hidden@example.com>\r\n"+
+		"X-Mailpopbox-Annotation: rule=NO_DATE\r\nX-Spam-Score: 1.0\r\nSubject: inbound\r\n")) {
+		t.Errorf("Journal copy does not record the envelope and annotations: %q", journal.Data)
+	}
+
+	server.RelayMessage(smtp.Envelope{
+		MailFrom: mail.Address{Address: "mailbox@example.com"},
+		RcptTo:   []mail.Address{{Address: "dest@another.net"}},
+		Data:     []byte("Subject: outbound\r\n\r\nbody\r\n"),
+		ID:       "m2",
+	}, "mailbox@example.com")
+	relayed := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		relayed[(<-mta.relayed).RcptTo[0].Address] = true
+	}
+	if !relayed["dest@another.net"] || !relayed["journal@archive.net"] {
+		t.Errorf("Want message and journal copy relayed, got %v", relayed)
+	}
+
+	entries, err := maildrop.New(filepath.Join(dir, "journal")).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(entries); want != got {
+		t.Errorf("Want %d archived messages, got %v", want, entries)
+	}
+
+	// Mail to the archive address is not archived again.
+	en.RcptTo = []mail.Address{{Address: "journal@example.com"}}
+	en.ID = "m3"
+	server.config.Servers[0].Archive.Address = "journal@example.com"
+	if rl := server.DeliverMessage(en); rl != nil {
+		t.Fatalf("Failed to deliver: %v", rl)
+	}
+	if entries, _ := maildrop.New(filepath.Join(dir, "journal")).List(); len(entries) != 2 {
+		t.Errorf("Want archive copy to not be archived, got %v", entries)
+	}
+}
+
+func TestMaxInboundMessageSize(t *testing.T) {
+	cases := []struct {
+		sizes []int64
+		limit int64
+	}{
+		{[]int64{1000, 2000}, 2000},
+		{[]int64{1000, 0}, 0},
+		{[]int64{0}, 0},
+	}
+	for _, c := range cases {
+		s := smtpServer{log: zap.NewNop()}
+		for i, size := range c.sizes {
+			s.config.Servers = append(s.config.Servers, Server{
+				Domain:         fmt.Sprintf("domain%d.com", i),
+				MaxMessageSize: size,
+			})
+		}
+		if want, got := c.limit, s.MaxInboundMessageSize(); want != got {
+			t.Errorf("%v: want limit %d, got %d", c.sizes, want, got)
+		}
+	}
+}
+
+func TestIsTrustedRelay(t *testing.T) {
+	server := smtpServer{log: zap.NewNop()}
+	server.trustedRelays, _ = parseNets([]string{"10.0.0.0/8"})
+
+	cases := []struct {
+		addr    net.Addr
+		trusted bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.7")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, false},
+		{&net.UnixAddr{Name: "@", Net: "unix"}, false},
+	}
+	for _, c := range cases {
+		if want, got := c.trusted, server.IsTrustedRelay(c.addr); want != got {
+			t.Errorf("%v: want trusted %t, got %t", c.addr, want, got)
+		}
+	}
+}
+
+func TestSharedMailbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	shared := filepath.Join(dir, "shared")
+	var log bytes.Buffer
+	s := smtpServer{
+		config: Config{
+			Hostname: "mx.example.com",
+			Servers: []Server{
+				{Domain: "example.com", MaildropPath: shared},
+				{Domain: "example.org", MaildropPath: shared + "/"},
+				{Domain: "other.net", MaildropPath: filepath.Join(dir, "other")},
+			},
+		},
+		maillog: maillog.New(&log, "mx.example.com"),
+		log:     zap.NewNop(),
+	}
+
+	if s.Mailbox(mail.Address{Address: "a@example.com"}) != s.Mailbox(mail.Address{Address: "b@example.org"}) {
+		t.Errorf("Want domains with the same MaildropPath to share a mailbox")
+	}
+	if s.Mailbox(mail.Address{Address: "a@example.com"}) == s.Mailbox(mail.Address{Address: "a@other.net"}) {
+		t.Errorf("Want domains with different MaildropPaths to have different mailboxes")
+	}
+	if want, got := "unknown.com", s.Mailbox(mail.Address{Address: "a@Unknown.com"}); want != got {
+		t.Errorf("Want mailbox %q, got %q", want, got)
+	}
+
+	if err := os.Mkdir(shared, 0700); err != nil {
+		t.Fatal(err)
+	}
+	en := smtp.Envelope{
+		MailFrom: mail.Address{Address: "sender@mail.net"},
+		RcptTo:   []mail.Address{{Address: "a@example.com"}, {Address: "b@example.org"}},
+		Data:     []byte("Subject: shared\r\n\r\nbody\r\n"),
+		ID:       "m.shared",
+	}
+	if reply := s.DeliverMessage(en); reply != nil {
+		t.Fatalf("Failed to deliver message: %v", reply)
+	}
+
+	md := maildrop.New(shared)
+	entries, err := md.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(entries); want != got {
+		t.Fatalf("Want %d message, got %d", want, got)
+	}
+	meta, err := md.Metadata("m.shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "a@example.com b@example.org", strings.Join(meta.RcptTo, " "); want != got {
+		t.Errorf("Want recipients %q, got %q", want, got)
+	}
+	for _, rcpt := range meta.RcptTo {
+		if !strings.Contains(log.String(), "to=<"+rcpt+">") {
+			t.Errorf("Want a delivery logged for %s, got %q", rcpt, log.String())
+		}
+	}
+}
+
+func TestRoleAccounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := smtpServer{
+		config: Config{
+			Hostname: "mx.example.com",
+			Servers: []Server{
+				{
+					Domain:           "example.com",
+					MaildropPath:     dir,
+					RoleFolder:       "roles",
+					BlockedAddresses: []string{"abuse@example.com"},
+					// Other addresses cannot be checked against a missing file.
+					AllowedAddressesFile: filepath.Join(dir, "missing.txt"),
+				},
+			},
+		},
+		log: zap.NewNop(),
+	}
+
+	cases := []struct {
+		address string
+		reply   smtp.ReplyLine
+	}{
+		{"postmaster@example.com", smtp.ReplyOK},
+		{"PostMaster@example.com", smtp.ReplyOK},
+		{"abuse@example.com", smtp.ReplyOK},
+		{"user@example.com", replyVerifyUnavailable},
+		{"postmaster@other.net", smtp.ReplyBadMailbox},
+	}
+	for _, c := range cases {
+		if want, got := c.reply, s.VerifyAddress(mail.Address{Address: c.address}); want != got {
+			t.Errorf("%s: want %v, got %v", c.address, want, got)
+		}
+	}
+
+	deliver := func(id string, rcpts ...string) {
+		en := smtp.Envelope{
+			MailFrom: mail.Address{Address: "sender@mail.net"},
+			Data:     []byte("Subject: report\r\n\r\nbody\r\n"),
+			ID:       id,
+		}
+		for _, rcpt := range rcpts {
+			en.RcptTo = append(en.RcptTo, mail.Address{Address: rcpt})
+		}
+		if reply := s.DeliverMessage(en); reply != nil {
+			t.Fatalf("Failed to deliver message %s: %v", id, reply)
+		}
+	}
+	deliver("m.role", "postmaster@example.com", "Abuse@example.com")
+	deliver("m.mixed", "abuse@example.com", "user@example.com")
+
+	roles, err := maildrop.New(dir).CreateFolder("roles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := roles.Metadata("m.role"); err != nil {
+		t.Errorf("Want role mail in the RoleFolder: %v", err)
+	}
+	if _, err := maildrop.New(dir).Metadata("m.mixed"); err != nil {
+		t.Errorf("Want mail for other recipients in the maildrop: %v", err)
+	}
+}
+
+func TestAddMissingHeaders(t *testing.T) {
+	mta := newTestMTA()
+	server := smtpServer{
+		mta: mta,
+		log: zap.NewNop(),
+	}
+
+	received := time.Date(2020, time.March, 5, 9, 8, 7, 0, time.UTC)
+	en := smtp.Envelope{
+		MailFrom: mail.Address{Address: "mailbox@example.com"},
+		RcptTo:   []mail.Address{{Address: "valid@dest.xyz"}},
+		Data:     []byte("From: <mailbox@example.com>\r\nTo: <valid@dest.xyz>\r\nSubject: cron\r\n\r\nbody\r\n"),
+		Received: received,
+		ID:       "id1",
+	}
+	server.RelayMessage(en, en.MailFrom.Address)
+
+	relayed := <-mta.relayed
+	msg, err := mail.ReadMessage(bytes.NewReader(relayed.Data))
+	if err != nil {
+		t.Fatalf("Failed to parse relayed message: %v", err)
+	}
+	if msgID := msg.Header.Get("Message-ID"); !strings.HasPrefix(msgID, "<") || !strings.HasSuffix(msgID, "@example.com>") {
+		t.Errorf("Want a Message-ID in the sender's domain, got %q", msgID)
+	}
+	date, err := msg.Header.Date()
+	if err != nil || !date.Equal(received) {
+		t.Errorf("Want Date of %v, got %v (%v)", received, date, err)
+	}
+
+	// A message with the fields is relayed unchanged.
+	data := []byte("From: <mailbox@example.com>\r\nDate: Thu, 5 Mar 2020 09:08:07 +0000\r\nmessage-id: <a@b>\r\n\r\nbody\r\n")
+	en.Data = data
+	server.RelayMessage(en, en.MailFrom.Address)
+	if want, got := string(data), string((<-mta.relayed).Data); want != got {
+		t.Errorf("Want message %q, got %q", want, got)
+	}
+}
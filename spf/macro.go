@@ -0,0 +1,152 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package spf
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// expand expands the macros (RFC 7208 § 7) in the domain-spec |spec| of the
+// record for |domain|.
+func (c *checker) expand(spec, domain string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		}
+		if i+1 == len(spec) {
+			return "", permError("truncated macro in %q", spec)
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+		case '_':
+			b.WriteByte(' ')
+		case '-':
+			b.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(spec[i:], '}')
+			if end == -1 {
+				return "", permError("unterminated macro in %q", spec)
+			}
+			value, err := c.macro(spec[i+1:i+end], domain)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			i += end
+		default:
+			return "", permError("invalid macro in %q", spec)
+		}
+	}
+
+	expanded := strings.TrimSuffix(b.String(), ".")
+	for len(expanded) > 253 {
+		dot := strings.IndexByte(expanded, '.')
+		if dot == -1 {
+			return "", permError("expanded domain too long")
+		}
+		expanded = expanded[dot+1:]
+	}
+	return expanded, nil
+}
+
+// macro expands the body of one %{...} macro, like "ir" or "d2".
+func (c *checker) macro(body, domain string) (string, error) {
+	if body == "" {
+		return "", permError("empty macro")
+	}
+	letter := body[0]
+	escape := letter >= 'A' && letter <= 'Z'
+
+	var value string
+	switch strings.ToLower(string(letter)) {
+	case "s":
+		value = c.sender
+	case "l":
+		value = c.sender[:strings.LastIndexByte(c.sender, '@')]
+	case "o":
+		value = c.sender[strings.LastIndexByte(c.sender, '@')+1:]
+	case "d":
+		value = domain
+	case "i":
+		value = c.dottedIP()
+	case "p":
+		value = "unknown"
+	case "v":
+		value = "ip6"
+		if c.ip.To4() != nil {
+			value = "in-addr"
+		}
+	case "h":
+		value = c.helo
+	default:
+		return "", permError("unknown macro letter %q", letter)
+	}
+
+	rest := body[1:]
+	digits := 0
+	for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+	keep := 0
+	if digits > 0 {
+		n, err := strconv.Atoi(rest[:digits])
+		if err != nil || n == 0 {
+			return "", permError("invalid macro transformer %q", body)
+		}
+		keep = n
+	}
+	rest = rest[digits:]
+	reverse := false
+	if strings.HasPrefix(rest, "r") || strings.HasPrefix(rest, "R") {
+		reverse, rest = true, rest[1:]
+	}
+	delimiters := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", permError("invalid macro delimiter %q", body)
+		}
+		delimiters = rest
+	}
+
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delimiters, r)
+	})
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+	value = strings.Join(parts, ".")
+
+	if escape {
+		value = url.QueryEscape(value)
+	}
+	return value, nil
+}
+
+// dottedIP formats the client IP for the i macro, in which IPv6 addresses
+// are dot-separated nibbles.
+func (c *checker) dottedIP() string {
+	if ip4 := c.ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	var parts []string
+	for _, b := range c.ip.To16() {
+		parts = append(parts, fmt.Sprintf("%x", b>>4), fmt.Sprintf("%x", b&0xf))
+	}
+	return strings.Join(parts, ".")
+}
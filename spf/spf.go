@@ -0,0 +1,377 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+// Package spf evaluates Sender Policy Framework records (RFC 7208), which
+// list the hosts that may send mail for a domain.
+package spf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Result is the outcome of an SPF check, as named in an
+// Authentication-Results header (RFC 8601).
+type Result string
+
+const (
+	None      Result = "none"
+	Neutral   Result = "neutral"
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	SoftFail  Result = "softfail"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+// Limits on the DNS queries made by one check, from RFC 7208 § 4.6.4.
+const (
+	maxLookups     = 10
+	maxVoidLookups = 2
+	maxMXHosts     = 10
+)
+
+// Resolver is the subset of net.Resolver used for checks.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// Check evaluates the SPF record of the domain of |sender| for mail from the
+// client at |ip|, which greeted with |helo|. The |sender| is the MAIL FROM
+// address, or postmaster@ the HELO name to check the HELO identity.
+func Check(ctx context.Context, r Resolver, ip net.IP, helo, sender string) Result {
+	c := &checker{ctx: ctx, r: r, ip: ip, helo: helo, sender: sender}
+	if ip4 := ip.To4(); ip4 != nil {
+		c.ip = ip4
+	}
+	at := strings.LastIndexByte(sender, '@')
+	if at == -1 {
+		c.sender = "postmaster@" + sender
+		at = len("postmaster")
+	} else if at == 0 {
+		c.sender = "postmaster" + sender
+		at = len("postmaster")
+	}
+	domain := strings.TrimSuffix(c.sender[at+1:], ".")
+	if domain == "" {
+		return None
+	}
+	result, _ := c.check(domain)
+	return result
+}
+
+// errResult is an error that ends a check with a result.
+type errResult struct {
+	result Result
+	reason string
+}
+
+func (e *errResult) Error() string {
+	return string(e.result) + ": " + e.reason
+}
+
+func permError(format string, args ...interface{}) error {
+	return &errResult{PermError, fmt.Sprintf(format, args...)}
+}
+
+type checker struct {
+	ctx    context.Context
+	r      Resolver
+	ip     net.IP
+	helo   string
+	sender string
+
+	lookups     int
+	voidLookups int
+}
+
+// check evaluates the record of |domain|. A PermError or TempError result is
+// also returned as an error, so that include can tell it apart.
+func (c *checker) check(domain string) (Result, error) {
+	record, err := c.record(domain)
+	if err != nil {
+		if e, ok := err.(*errResult); ok {
+			return e.result, err
+		}
+		return PermError, err
+	}
+	if record == "" {
+		return None, nil
+	}
+
+	terms := strings.Fields(record)[1:]
+	var redirect string
+	for _, term := range terms {
+		if eq := strings.IndexByte(term, '='); eq != -1 && !strings.ContainsAny(term[:eq], ":/") {
+			name := strings.ToLower(term[:eq])
+			if name == "redirect" {
+				if redirect != "" {
+					return PermError, permError("duplicate redirect")
+				}
+				redirect = term[eq+1:]
+			}
+			// Other modifiers, including exp, are ignored.
+			continue
+		}
+
+		qualifier := Pass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = Fail, term[1:]
+		case '~':
+			qualifier, term = SoftFail, term[1:]
+		case '?':
+			qualifier, term = Neutral, term[1:]
+		}
+
+		match, err := c.mechanism(domain, term)
+		if err != nil {
+			return errorResult(err)
+		}
+		if match {
+			return qualifier, nil
+		}
+	}
+
+	if redirect != "" {
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return errorResult(err)
+		}
+		if err := c.countLookup(); err != nil {
+			return errorResult(err)
+		}
+		result, err := c.check(target)
+		if result == None {
+			return PermError, permError("redirect to %s has no record", target)
+		}
+		return result, err
+	}
+	return Neutral, nil
+}
+
+func errorResult(err error) (Result, error) {
+	if e, ok := err.(*errResult); ok {
+		return e.result, err
+	}
+	return PermError, err
+}
+
+// record returns the SPF record of |domain|, or the empty string if it has
+// none.
+func (c *checker) record(domain string) (string, error) {
+	txts, err := c.r.LookupTXT(c.ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return "", nil
+		}
+		return "", &errResult{TempError, err.Error()}
+	}
+	var record string
+	for _, txt := range txts {
+		if txt == "v=spf1" || strings.HasPrefix(strings.ToLower(txt), "v=spf1 ") {
+			if record != "" {
+				return "", permError("multiple records for %s", domain)
+			}
+			record = txt
+		}
+	}
+	return record, nil
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// countLookup counts a mechanism or modifier that queries DNS.
+func (c *checker) countLookup() error {
+	c.lookups++
+	if c.lookups > maxLookups {
+		return permError("too many DNS lookups")
+	}
+	return nil
+}
+
+// countVoid counts a lookup that returned no records.
+func (c *checker) countVoid() error {
+	c.voidLookups++
+	if c.voidLookups > maxVoidLookups {
+		return permError("too many void DNS lookups")
+	}
+	return nil
+}
+
+// mechanism reports whether the mechanism |term| of the record for |domain|
+// matches the client.
+func (c *checker) mechanism(domain, term string) (bool, error) {
+	name, arg := term, ""
+	if i := strings.IndexAny(term, ":/"); i != -1 {
+		name, arg = term[:i], term[i:]
+	}
+
+	switch strings.ToLower(name) {
+	case "all":
+		if arg != "" {
+			return false, permError("invalid mechanism %q", term)
+		}
+		return true, nil
+
+	case "include":
+		if !strings.HasPrefix(arg, ":") {
+			return false, permError("include requires a domain")
+		}
+		target, err := c.expand(arg[1:], domain)
+		if err != nil {
+			return false, err
+		}
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		result, err := c.check(target)
+		switch result {
+		case Pass:
+			return true, nil
+		case Fail, SoftFail, Neutral:
+			return false, nil
+		case None:
+			return false, permError("include of %s has no record", target)
+		}
+		return false, err
+
+	case "a", "mx":
+		target, prefix4, prefix6, err := c.domainAndPrefixes(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		hosts := []string{target}
+		if strings.EqualFold(name, "mx") {
+			mxs, err := c.r.LookupMX(c.ctx, target)
+			if err != nil && !isNotFound(err) {
+				return false, &errResult{TempError, err.Error()}
+			}
+			if len(mxs) == 0 {
+				return false, c.countVoid()
+			}
+			if len(mxs) > maxMXHosts {
+				return false, permError("too many MX hosts")
+			}
+			hosts = hosts[:0]
+			for _, mx := range mxs {
+				hosts = append(hosts, mx.Host)
+			}
+		}
+		for _, host := range hosts {
+			addrs, err := c.r.LookupIPAddr(c.ctx, host)
+			if err != nil && !isNotFound(err) {
+				return false, &errResult{TempError, err.Error()}
+			}
+			if len(addrs) == 0 && strings.EqualFold(name, "a") {
+				return false, c.countVoid()
+			}
+			for _, addr := range addrs {
+				if c.matchIP(addr.IP, prefix4, prefix6) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+
+	case "ip4", "ip6":
+		if !strings.HasPrefix(arg, ":") {
+			return false, permError("%s requires an address", name)
+		}
+		network := arg[1:]
+		if !strings.Contains(network, "/") {
+			if strings.EqualFold(name, "ip4") {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		ip, ipnet, err := net.ParseCIDR(network)
+		if err != nil || (ip.To4() != nil) != strings.EqualFold(name, "ip4") {
+			return false, permError("invalid network %q", term)
+		}
+		return ipnet.Contains(c.ip), nil
+
+	case "exists":
+		if !strings.HasPrefix(arg, ":") {
+			return false, permError("exists requires a domain")
+		}
+		target, err := c.expand(arg[1:], domain)
+		if err != nil {
+			return false, err
+		}
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		addrs, err := c.r.LookupIPAddr(c.ctx, target)
+		if err != nil && !isNotFound(err) {
+			return false, &errResult{TempError, err.Error()}
+		}
+		for _, addr := range addrs {
+			if addr.IP.To4() != nil {
+				return true, nil
+			}
+		}
+		return false, c.countVoid()
+
+	case "ptr":
+		// ptr is deprecated (RFC 7208 § 5.5) and never matches here, but it
+		// still counts as a lookup.
+		return false, c.countLookup()
+	}
+	return false, permError("unknown mechanism %q", term)
+}
+
+// domainAndPrefixes parses the optional ":domain/prefix4//prefix6" argument
+// of an a or mx mechanism.
+func (c *checker) domainAndPrefixes(arg, domain string) (string, int, int, error) {
+	prefix4, prefix6 := 32, 128
+	if i := strings.Index(arg, "//"); i != -1 {
+		n, err := strconv.Atoi(arg[i+2:])
+		if err != nil || n < 0 || n > 128 {
+			return "", 0, 0, permError("invalid prefix %q", arg)
+		}
+		prefix6, arg = n, arg[:i]
+	}
+	if i := strings.LastIndexByte(arg, '/'); i != -1 {
+		n, err := strconv.Atoi(arg[i+1:])
+		if err != nil || n < 0 || n > 32 {
+			return "", 0, 0, permError("invalid prefix %q", arg)
+		}
+		prefix4, arg = n, arg[:i]
+	}
+	target := domain
+	if strings.HasPrefix(arg, ":") {
+		var err error
+		if target, err = c.expand(arg[1:], domain); err != nil {
+			return "", 0, 0, err
+		}
+	} else if arg != "" {
+		return "", 0, 0, permError("invalid argument %q", arg)
+	}
+	return target, prefix4, prefix6, nil
+}
+
+func (c *checker) matchIP(ip net.IP, prefix4, prefix6 int) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		return c.ip.To4() != nil && ip4.Mask(net.CIDRMask(prefix4, 32)).Equal(c.ip.Mask(net.CIDRMask(prefix4, 32)))
+	}
+	return c.ip.To4() == nil && ip.Mask(net.CIDRMask(prefix6, 128)).Equal(c.ip.Mask(net.CIDRMask(prefix6, 128)))
+}
@@ -0,0 +1,176 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package spf
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+// testResolver answers from maps, and fails lookups of "timeout." names.
+type testResolver struct {
+	txt  map[string][]string
+	ip   map[string][]string
+	mx   map[string][]string
+	seen []string
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *testResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	r.seen = append(r.seen, name)
+	if name == "timeout.example" {
+		return nil, errors.New("i/o timeout")
+	}
+	if txt, ok := r.txt[name]; ok {
+		return txt, nil
+	}
+	return nil, notFound(name)
+}
+
+func (r *testResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.seen = append(r.seen, host)
+	ips, ok := r.ip[host]
+	if !ok {
+		return nil, notFound(host)
+	}
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func (r *testResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	hosts, ok := r.mx[name]
+	if !ok {
+		return nil, notFound(name)
+	}
+	var mxs []*net.MX
+	for _, host := range hosts {
+		mxs = append(mxs, &net.MX{Host: host})
+	}
+	return mxs, nil
+}
+
+func TestCheck(t *testing.T) {
+	r := &testResolver{
+		txt: map[string][]string{
+			"example.com":      {"google-site-verification=abc", "v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 a:mail.example.com mx include:partner.net -all"},
+			"partner.net":      {"v=spf1 ip4:198.51.100.7 ~all"},
+			"soft.example":     {"v=spf1 ~all"},
+			"neutral.example":  {"v=spf1 ?all"},
+			"empty.example":    {"v=spf1"},
+			"redirect.example": {"v=spf1 redirect=example.com"},
+			"double.example":   {"v=spf1 -all", "v=spf1 +all"},
+			"broken.example":   {"v=spf1 ip4:nowhere -all"},
+			"unknown.example":  {"v=spf1 frobnicate -all"},
+			"include.example":  {"v=spf1 include:timeout.example -all"},
+			"missing.example":  {"v=spf1 include:nothing.example -all"},
+			"exists.example":   {"v=spf1 exists:%{ir}.%{l1r+-}._spf.%{d} -all"},
+			"prefix.example":   {"v=spf1 a/24 -all"},
+			"loop.example":     {"v=spf1 include:loop.example -all"},
+		},
+		ip: map[string][]string{
+			"mail.example.com":                  {"203.0.113.5"},
+			"mx1.example.com":                   {"203.0.113.25", "2001:db8:ffff::25"},
+			"prefix.example":                    {"198.51.100.1"},
+			"1.2.0.192.bob._spf.exists.example": {"127.0.0.2"},
+		},
+		mx: map[string][]string{
+			"example.com": {"mx1.example.com"},
+		},
+	}
+
+	cases := []struct {
+		ip     string
+		sender string
+		want   Result
+	}{
+		{"192.0.2.7", "alice@example.com", Pass},
+		{"2001:db8::7", "alice@example.com", Pass},
+		{"203.0.113.5", "alice@example.com", Pass},
+		{"203.0.113.25", "alice@example.com", Pass},
+		{"198.51.100.7", "alice@example.com", Pass},
+		{"198.51.100.8", "alice@example.com", Fail},
+		{"198.51.100.8", "example.com", Fail},
+		{"198.51.100.8", "bob@soft.example", SoftFail},
+		{"198.51.100.8", "bob@neutral.example", Neutral},
+		{"198.51.100.8", "bob@empty.example", Neutral},
+		{"198.51.100.8", "bob@none.example", None},
+		{"192.0.2.7", "bob@redirect.example", Pass},
+		{"198.51.100.8", "bob@redirect.example", Fail},
+		{"198.51.100.8", "bob@double.example", PermError},
+		{"198.51.100.8", "bob@broken.example", PermError},
+		{"198.51.100.8", "bob@unknown.example", PermError},
+		{"198.51.100.8", "bob@include.example", TempError},
+		{"198.51.100.8", "bob@missing.example", PermError},
+		{"198.51.100.8", "bob@timeout.example", TempError},
+		{"192.0.2.1", "bob@exists.example", Pass},
+		{"192.0.2.1", "carol@exists.example", Fail},
+		{"198.51.100.200", "bob@prefix.example", Pass},
+		{"198.51.101.1", "bob@prefix.example", Fail},
+		{"198.51.100.8", "bob@loop.example", PermError},
+	}
+	for _, c := range cases {
+		if got := Check(context.Background(), r, net.ParseIP(c.ip), "mx.client.net", c.sender); got != c.want {
+			t.Errorf("%s from %s: want %q, got %q", c.sender, c.ip, c.want, got)
+		}
+	}
+}
+
+func TestVoidLookupLimit(t *testing.T) {
+	r := &testResolver{
+		txt: map[string][]string{
+			"void.example": {"v=spf1 a:a.void.example a:b.void.example a:c.void.example +all"},
+		},
+	}
+	if want, got := PermError, Check(context.Background(), r, net.ParseIP("192.0.2.1"), "", "x@void.example"); want != got {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+}
+
+func TestMacros(t *testing.T) {
+	c := &checker{ip: net.ParseIP("2001:db8::cb01"), helo: "mx.client.net", sender: "strong-bad@email.example.com"}
+	cases := []struct {
+		spec string
+		want string
+	}{
+		{"%{s}", "strong-bad@email.example.com"},
+		{"%{o}", "email.example.com"},
+		{"%{d}", "email.example.com"},
+		{"%{d4}", "email.example.com"},
+		{"%{d3}", "email.example.com"},
+		{"%{d2}", "example.com"},
+		{"%{d1}", "com"},
+		{"%{dr}", "com.example.email"},
+		{"%{d2r}", "example.email"},
+		{"%{l}", "strong-bad"},
+		{"%{l-}", "strong.bad"},
+		{"%{lr}", "strong-bad"},
+		{"%{lr-}", "bad.strong"},
+		{"%{l1r-}", "strong"},
+		{"%{h}.%%%_%-", "mx.client.net.% %20"},
+		{"%{v}", "ip6"},
+		{"%{ir}.%{v}._spf.%{d2}", "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"},
+	}
+	for _, tc := range cases {
+		got, err := c.expand(tc.spec, "email.example.com")
+		if err != nil || got != tc.want {
+			t.Errorf("%q: want %q, got %q (%v)", tc.spec, tc.want, got, err)
+		}
+	}
+	for _, bad := range []string{"%", "%{", "%{x}", "%a"} {
+		if _, err := c.expand(bad, "email.example.com"); err == nil {
+			t.Errorf("%q: want error", bad)
+		}
+	}
+}
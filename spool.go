@@ -0,0 +1,400 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/maildrop"
+	rfc5322 "src.bluestatic.org/mailpopbox/message"
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+const (
+	defaultSpoolMaxMessages   = 1000
+	defaultSpoolWorkers       = 4
+	defaultSpoolRetryInterval = 5 * time.Minute
+	defaultSpoolRetry         = 24 * time.Hour
+)
+
+var spoolMetrics = expvar.NewMap("spool")
+
+var replySpoolFull = smtp.ReplyLine{Code: 452, Message: "4.3.1 mail system full, try again later"}
+
+// SpoolConfig accepts inbound messages into a directory as soon as they are
+// received, and delivers them in the background, so that senders do not wait
+// on slow filters like ClamAV or rspamd. A message that a filter refuses
+// after it was accepted is not bounced, since the sender of unwanted mail is
+// usually forged. Instead a notice with its header is stored for the
+// postmaster of the recipient's domain before it is removed.
+type SpoolConfig struct {
+	// Path is the directory of the spool. Messages left in it are delivered
+	// when the server starts.
+	Path string
+
+	// MaxMessages is the most messages the spool holds, beyond which senders
+	// are told to try again later. It defaults to 1000.
+	MaxMessages int
+
+	// Workers is how many spooled messages are delivered at once. It
+	// defaults to 4.
+	Workers int
+
+	// RetryInterval is the time between attempts to deliver a message that
+	// failed temporarily, and Retry is how long after the message was
+	// received to keep trying, as Go duration strings. They default to 5m
+	// and 24h.
+	RetryInterval string
+	Retry         string
+}
+
+// spool is the running form of a SpoolConfig. Each message is a file of its
+// JSON Envelope, named by its ID.
+type spool struct {
+	path          string
+	maxMessages   int
+	workers       int
+	retryInterval time.Duration
+	retry         time.Duration
+
+	// deliver delivers a message, returning a reply if it was refused.
+	deliver func(smtp.Envelope) *smtp.ReplyLine
+
+	// notify tells the postmaster that a message is being removed without
+	// being delivered, for |reason|. The message is kept if it fails.
+	notify func(en smtp.Envelope, reason string) error
+
+	// ready holds the IDs of the messages to be delivered. It can hold every
+	// message in the spool, so sending to it does not block.
+	ready chan string
+
+	mu    sync.Mutex
+	count int // The number of messages in the spool.
+
+	log *zap.Logger
+}
+
+// openSpool creates the spool directory of |config| if needed and queues the
+// messages already in it. The messages are not delivered until start.
+func openSpool(config SpoolConfig, deliver func(smtp.Envelope) *smtp.ReplyLine, notify func(smtp.Envelope, string) error, log *zap.Logger) (*spool, error) {
+	sp := &spool{
+		path:          config.Path,
+		maxMessages:   config.MaxMessages,
+		workers:       config.Workers,
+		retryInterval: defaultSpoolRetryInterval,
+		retry:         defaultSpoolRetry,
+		deliver:       deliver,
+		notify:        notify,
+		log:           log.With(zap.String("spool", config.Path)),
+	}
+	if sp.path == "" {
+		return nil, fmt.Errorf("missing Path")
+	}
+	if sp.maxMessages <= 0 {
+		sp.maxMessages = defaultSpoolMaxMessages
+	}
+	if sp.workers <= 0 {
+		sp.workers = defaultSpoolWorkers
+	}
+	var err error
+	if sp.retryInterval, err = parseTimeout(config.RetryInterval, defaultSpoolRetryInterval); err != nil {
+		return nil, fmt.Errorf("RetryInterval: %v", err)
+	} else if sp.retryInterval == 0 {
+		return nil, fmt.Errorf("RetryInterval: must be positive")
+	}
+	if sp.retry, err = parseTimeout(config.Retry, defaultSpoolRetry); err != nil {
+		return nil, fmt.Errorf("Retry: %v", err)
+	}
+
+	if err := os.MkdirAll(sp.path, 0700); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(sp.path)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, fi := range files {
+		name := fi.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			// A message that was being accepted when the server stopped,
+			// which the sender was not told was accepted.
+			os.Remove(filepath.Join(sp.path, name))
+		} else if strings.HasSuffix(name, ".json") {
+			ids = append(ids, strings.TrimSuffix(name, ".json"))
+		}
+	}
+
+	size := sp.maxMessages
+	if len(ids) > size {
+		size = len(ids)
+	}
+	sp.ready = make(chan string, size)
+	for _, id := range ids {
+		sp.ready <- id
+	}
+	sp.count = len(ids)
+	if len(ids) > 0 {
+		sp.log.Info("found spooled messages", zap.Int("messages", len(ids)))
+	}
+	return sp, nil
+}
+
+// start delivers the spooled messages on the worker goroutines.
+func (sp *spool) start() {
+	for i := 0; i < sp.workers; i++ {
+		go sp.work()
+	}
+}
+
+// accept writes |en| to the spool to be delivered later. It returns a reply
+// if the message cannot be accepted.
+func (sp *spool) accept(en smtp.Envelope) *smtp.ReplyLine {
+	sp.mu.Lock()
+	if sp.count >= sp.maxMessages {
+		sp.mu.Unlock()
+		sp.log.Warn("spool is full", zap.String("id", en.ID), zap.Int("messages", sp.maxMessages))
+		spoolMetrics.Add("full", 1)
+		return &replySpoolFull
+	}
+	sp.count++
+	sp.mu.Unlock()
+
+	if err := sp.write(en); err != nil {
+		sp.log.Error("failed to spool message", zap.String("id", en.ID), zap.Error(err))
+		sp.remove(en.ID)
+		return &replySpoolFull
+	}
+	spoolMetrics.Add("accepted", 1)
+	sp.ready <- en.ID
+	return nil
+}
+
+// write stores |en| in its file, syncing it before it is renamed into place,
+// since the sender is told that it is safe.
+func (sp *spool) write(en smtp.Envelope) error {
+	data, err := json.Marshal(en)
+	if err != nil {
+		return err
+	}
+
+	path := sp.file(en.ID)
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+	}
+	return err
+}
+
+// errCorruptSpoolFile is returned by read for a file that cannot be decoded,
+// which will not get better by trying again.
+var errCorruptSpoolFile = errors.New("corrupt spool file")
+
+// read loads the message |id| from its file.
+func (sp *spool) read(id string) (smtp.Envelope, error) {
+	data, err := ioutil.ReadFile(sp.file(id))
+	if err != nil {
+		return smtp.Envelope{}, err
+	}
+	var en smtp.Envelope
+	if err := json.Unmarshal(data, &en); err != nil {
+		return smtp.Envelope{}, fmt.Errorf("%w: %v", errCorruptSpoolFile, err)
+	}
+	return en, nil
+}
+
+func (sp *spool) file(id string) string {
+	return filepath.Join(sp.path, id+".json")
+}
+
+// remove deletes the message |id| from the spool.
+func (sp *spool) remove(id string) {
+	if err := os.Remove(sp.file(id)); err != nil && !os.IsNotExist(err) {
+		sp.log.Error("failed to remove spooled message", zap.String("id", id), zap.Error(err))
+	}
+	sp.mu.Lock()
+	sp.count--
+	sp.mu.Unlock()
+}
+
+// setAside renames the message |id| so that it is no longer delivered, but is
+// kept for the operator to examine.
+func (sp *spool) setAside(id string) error {
+	if err := os.Rename(sp.file(id), sp.file(id)+".bad"); err != nil {
+		return err
+	}
+	sp.mu.Lock()
+	sp.count--
+	sp.mu.Unlock()
+	return nil
+}
+
+// retryLater queues the message |id| again after the retry interval.
+func (sp *spool) retryLater(id string) {
+	time.AfterFunc(sp.retryInterval, func() { sp.ready <- id })
+}
+
+func (sp *spool) work() {
+	for id := range sp.ready {
+		sp.deliverSpooled(id)
+	}
+}
+
+// deliverSpooled makes one attempt to deliver the message |id|. A message
+// that fails temporarily is queued again after the retry interval, until it
+// is too old. A message is only removed without being delivered once the
+// postmaster has been notified.
+func (sp *spool) deliverSpooled(id string) {
+	log := sp.log.With(zap.String("id", id))
+	en, err := sp.read(id)
+	switch {
+	case err == nil:
+	case os.IsNotExist(err):
+		log.Error("spooled message is missing")
+		spoolMetrics.Add("errors", 1)
+		sp.mu.Lock()
+		sp.count--
+		sp.mu.Unlock()
+		return
+	case errors.Is(err, errCorruptSpoolFile):
+		log.Error("setting aside unreadable spooled message", zap.Error(err))
+		spoolMetrics.Add("errors", 1)
+		if err := sp.setAside(id); err != nil {
+			log.Error("failed to set aside spooled message", zap.Error(err))
+			sp.retryLater(id)
+		}
+		return
+	default:
+		log.Error("failed to read spooled message", zap.Error(err))
+		spoolMetrics.Add("errors", 1)
+		sp.retryLater(id)
+		return
+	}
+
+	reply := sp.deliver(en)
+	var reason, metric string
+	switch {
+	case reply == nil:
+		spoolMetrics.Add("delivered", 1)
+		sp.remove(id)
+		return
+	case reply.Code >= 500:
+		reason, metric = "The message was refused: "+reply.String(), "rejected"
+	case time.Since(en.Received)+sp.retryInterval > sp.retry:
+		reason, metric = "Delivery was retried for too long. The last attempt failed: "+reply.String(), "expired"
+	default:
+		log.Info("deferred spooled message",
+			zap.Int("code", reply.Code),
+			zap.String("reply", reply.Message),
+			zap.Duration("retry-in", sp.retryInterval))
+		spoolMetrics.Add("deferred", 1)
+		sp.retryLater(id)
+		return
+	}
+
+	if err := sp.notify(en, reason); err != nil {
+		log.Error("failed to notify postmaster of undelivered message, keeping it", zap.Error(err))
+		spoolMetrics.Add("errors", 1)
+		sp.retryLater(id)
+		return
+	}
+	log.Warn("removed undelivered spooled message",
+		zap.String("sender", en.MailFrom.Address),
+		zap.String("outcome", metric),
+		zap.Int("code", reply.Code),
+		zap.String("reply", reply.Message))
+	spoolMetrics.Add(metric, 1)
+	sp.remove(id)
+}
+
+// notifyUndelivered stores a notice for the postmaster of the recipient's
+// domain that the spooled message |en| was not delivered. The notice quotes
+// only the header of the message, since its body is most likely spam.
+func (server *smtpServer) notifyUndelivered(en smtp.Envelope, reason string) error {
+	s := server.configForAddress(en.RcptTo[0])
+	if s == nil || s.MaildropPath == "" {
+		return fmt.Errorf("no maildrop for %s", en.RcptTo[0].Address)
+	}
+	md := maildrop.New(s.MaildropPath)
+	if s.RoleFolder != "" {
+		folder, err := md.CreateFolder(s.RoleFolder)
+		if err != nil {
+			return err
+		}
+		md = folder
+	}
+
+	notice := newUndeliveredNotice(s.Domain, en, reason)
+	if err := md.Deliver(notice); err != nil {
+		return err
+	}
+	server.events.publish(mailboxEvent{Kind: mailboxDelivered, Path: md.Path(), ID: notice.ID})
+	return nil
+}
+
+// newUndeliveredNotice returns a message for the postmaster of |domain| about
+// the undelivered message |en|.
+func newUndeliveredNotice(domain string, en smtp.Envelope, reason string) smtp.Envelope {
+	now := time.Now()
+	from := mail.Address{Name: "mailpopbox", Address: MailboxAccount + domain}
+	postmaster := mail.Address{Address: "postmaster@" + domain}
+	notice := smtp.Envelope{
+		MailFrom: from,
+		RcptTo:   []mail.Address{postmaster},
+		Received: now,
+		ID:       smtp.GenerateEnvelopeId("u", now),
+	}
+
+	header := &rfc5322.Header{}
+	header.Add("From", from.String())
+	header.Add("To", postmaster.String())
+	header.Add("Subject", "Undelivered message from <"+en.MailFrom.Address+">")
+	header.Add("Message-ID", newMessageID(domain, ""))
+	header.Add("Date", now.Format(time.RFC1123Z))
+
+	var buf bytes.Buffer
+	header.WriteTo(&buf)
+	fmt.Fprintf(&buf, "A message was accepted into the inbound spool but not delivered.\r\n\r\n%s\r\n\r\n", reason)
+	fmt.Fprintf(&buf, "ID: %s\r\nSender: <%s>\r\n", en.ID, en.MailFrom.Address)
+	for _, rcpt := range en.RcptTo {
+		fmt.Fprintf(&buf, "Recipient: <%s>\r\n", rcpt.Address)
+	}
+	if en.RemoteAddr != nil {
+		fmt.Fprintf(&buf, "Client: %s\r\n", en.RemoteAddr)
+	}
+	fmt.Fprintf(&buf, "Received: %s\r\n\r\nThe header of the message follows.\r\n\r\n", en.Received.Format(time.RFC1123Z))
+	original, _ := rfc5322.Parse(en.Data)
+	original.WriteTo(&buf)
+	notice.Data = buf.Bytes()
+	return notice
+}
@@ -0,0 +1,396 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/maildrop"
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+// spoolAttempt is a call to the deliver function of a spool under test.
+type spoolAttempt struct {
+	en    smtp.Envelope
+	reply chan *smtp.ReplyLine
+}
+
+// testSpool opens a spool in |dir| whose deliveries are sent to the returned
+// channel, to be answered by the test. The IDs of the messages that the
+// postmaster is notified about are sent to the second channel.
+func testSpool(t *testing.T, dir string, config SpoolConfig) (*spool, chan spoolAttempt, chan string) {
+	attempts := make(chan spoolAttempt)
+	notices := make(chan string, 10)
+	config.Path = dir
+	sp, err := openSpool(config, func(en smtp.Envelope) *smtp.ReplyLine {
+		a := spoolAttempt{en, make(chan *smtp.ReplyLine)}
+		attempts <- a
+		return <-a.reply
+	}, func(en smtp.Envelope, reason string) error {
+		notices <- en.ID
+		return nil
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sp, attempts, notices
+}
+
+func nextAttempt(t *testing.T, attempts chan spoolAttempt) spoolAttempt {
+	select {
+	case a := <-attempts:
+		return a
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for delivery")
+		return spoolAttempt{}
+	}
+}
+
+func spoolEnvelope(id string) smtp.Envelope {
+	return smtp.Envelope{
+		ID:         id,
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4321},
+		MailFrom:   mail.Address{Address: "from@sender.net"},
+		RcptTo:     []mail.Address{{Address: "to@example.com"}},
+		Data:       []byte("Subject: hi\r\n\r\nbody\r\n"),
+		Received:   time.Now(),
+	}
+}
+
+// spooledFiles returns the names of the files in the spool |dir|.
+func spooledFiles(t *testing.T, dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range files {
+		names = append(names, fi.Name())
+	}
+	return names
+}
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sp, attempts, notices := testSpool(t, dir, SpoolConfig{RetryInterval: "10ms", Workers: 1})
+	if reply := sp.accept(spoolEnvelope("m.1")); reply != nil {
+		t.Fatalf("Failed to accept message: %v", reply)
+	}
+	if want, got := []string{"m.1.json"}, spooledFiles(t, dir); len(got) != 1 || want[0] != got[0] {
+		t.Errorf("Want spool files %v, got %v", want, got)
+	}
+	sp.start()
+
+	// A temporary failure is retried.
+	a := nextAttempt(t, attempts)
+	if want, got := "from@sender.net", a.en.MailFrom.Address; want != got {
+		t.Errorf("Want sender %q, got %q", want, got)
+	}
+	if want, got := "192.0.2.1:4321", a.en.RemoteAddr.String(); want != got {
+		t.Errorf("Want client %q, got %q", want, got)
+	}
+	if want, got := "Subject: hi\r\n\r\nbody\r\n", string(a.en.Data); want != got {
+		t.Errorf("Want data %q, got %q", want, got)
+	}
+	a.reply <- &replyContentFilterTempFail
+
+	a = nextAttempt(t, attempts)
+	a.reply <- nil
+
+	// A permanent failure is removed after the postmaster is notified.
+	if reply := sp.accept(spoolEnvelope("m.2")); reply != nil {
+		t.Fatalf("Failed to accept message: %v", reply)
+	}
+	a = nextAttempt(t, attempts)
+	if want, got := "m.2", a.en.ID; want != got {
+		t.Errorf("Want message %q, got %q", want, got)
+	}
+	a.reply <- &replyContentFilterRejected
+
+	// Wait for the worker to finish with the message.
+	sp.accept(spoolEnvelope("m.3"))
+	a = nextAttempt(t, attempts)
+	if got := spooledFiles(t, dir); len(got) != 1 || got[0] != "m.3.json" {
+		t.Errorf("Want only the message being delivered spooled, got %v", got)
+	}
+	a.reply <- nil
+	if want, got := "m.2", <-notices; want != got {
+		t.Errorf("Want notice for %q, got %q", want, got)
+	}
+	if len(notices) != 0 {
+		t.Errorf("Want only one notice")
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sp, _, _ := testSpool(t, dir, SpoolConfig{MaxMessages: 2})
+	for _, id := range []string{"m.1", "m.2"} {
+		if reply := sp.accept(spoolEnvelope(id)); reply != nil {
+			t.Fatalf("Failed to accept %s: %v", id, reply)
+		}
+	}
+	if want, got := &replySpoolFull, sp.accept(spoolEnvelope("m.3")); got == nil || *want != *got {
+		t.Errorf("Want %v, got %v", want, got)
+	}
+
+	// The messages are delivered after a restart, along with new ones, and a
+	// partly written message is removed.
+	ioutil.WriteFile(filepath.Join(dir, "m.4.json.tmp"), []byte("{"), 0600)
+	sp, attempts, _ := testSpool(t, dir, SpoolConfig{MaxMessages: 2})
+	if want, got := &replySpoolFull, sp.accept(spoolEnvelope("m.3")); got == nil || *want != *got {
+		t.Errorf("Want %v after restart, got %v", want, got)
+	}
+	sp.start()
+	seen := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		a := nextAttempt(t, attempts)
+		seen[a.en.ID] = true
+		a.reply <- nil
+	}
+	if !seen["m.1"] || !seen["m.2"] {
+		t.Errorf("Want the spooled messages delivered, got %v", seen)
+	}
+	for _, name := range spooledFiles(t, dir) {
+		if name == "m.4.json.tmp" {
+			t.Errorf("Want partly written message removed")
+		}
+	}
+}
+
+func TestSpoolExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sp, attempts, notices := testSpool(t, dir, SpoolConfig{RetryInterval: "10ms", Retry: "1h"})
+	en := spoolEnvelope("m.old")
+	en.Received = time.Now().Add(-time.Hour)
+	sp.accept(en)
+	sp.start()
+
+	nextAttempt(t, attempts).reply <- &replyContentFilterTempFail
+	select {
+	case a := <-attempts:
+		t.Errorf("Want expired message removed, got another attempt")
+		a.reply <- nil
+	case <-time.After(100 * time.Millisecond):
+	}
+	if want, got := "m.old", <-notices; want != got {
+		t.Errorf("Want notice for %q, got %q", want, got)
+	}
+}
+
+func TestSpoolNoticeFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sp, attempts, _ := testSpool(t, dir, SpoolConfig{RetryInterval: "10ms"})
+	notified := false
+	sp.notify = func(smtp.Envelope, string) error {
+		if !notified {
+			notified = true
+			return errors.New("disk full")
+		}
+		return nil
+	}
+	sp.accept(spoolEnvelope("m.1"))
+	sp.start()
+
+	// The message is kept until the postmaster can be told that it was
+	// refused.
+	nextAttempt(t, attempts).reply <- &replyContentFilterRejected
+	a := nextAttempt(t, attempts)
+	if got := spooledFiles(t, dir); len(got) != 1 || got[0] != "m.1.json" {
+		t.Errorf("Want message kept after failed notice, got %v", got)
+	}
+	a.reply <- &replyContentFilterRejected
+}
+
+func TestSpoolUnreadable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "m.bad.json"), []byte("{"), 0600)
+	sp, _, _ := testSpool(t, dir, SpoolConfig{})
+	sp.deliverSpooled(<-sp.ready)
+	if got := spooledFiles(t, dir); len(got) != 1 || got[0] != "m.bad.json.bad" {
+		t.Errorf("Want unreadable message set aside, got %v", got)
+	}
+	if want, got := 0, sp.count; want != got {
+		t.Errorf("Want %d messages spooled, got %d", want, got)
+	}
+
+	// A message set aside is not delivered again.
+	sp, _, _ = testSpool(t, dir, SpoolConfig{})
+	if want, got := 0, len(sp.ready); want != got {
+		t.Errorf("Want %d messages queued after restart, got %d", want, got)
+	}
+}
+
+func TestOpenSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	deliver := func(smtp.Envelope) *smtp.ReplyLine { return nil }
+	notify := func(smtp.Envelope, string) error { return nil }
+	cases := []SpoolConfig{
+		{},
+		{Path: dir, RetryInterval: "soon"},
+		{Path: dir, RetryInterval: "0"},
+		{Path: dir, Retry: "-1h"},
+	}
+	for _, c := range cases {
+		if _, err := openSpool(c, deliver, notify, zap.NewNop()); err == nil {
+			t.Errorf("Want error for %+v", c)
+		}
+	}
+
+	sp, err := openSpool(SpoolConfig{Path: filepath.Join(dir, "new")}, deliver, notify, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := defaultSpoolMaxMessages, sp.maxMessages; want != got {
+		t.Errorf("Want MaxMessages %d, got %d", want, got)
+	}
+	if _, err := os.Stat(sp.path); err != nil {
+		t.Errorf("Want spool directory created: %v", err)
+	}
+}
+
+func TestDeliverMessageSpooled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mailbox := filepath.Join(dir, "maildrop")
+	if err := os.Mkdir(mailbox, 0700); err != nil {
+		t.Fatal(err)
+	}
+	server := &smtpServer{
+		config: Config{
+			Servers: []Server{{Domain: "example.com", MaildropPath: mailbox}},
+		},
+		log: zap.NewNop(),
+	}
+	sp, err := openSpool(SpoolConfig{Path: filepath.Join(dir, "spool")}, server.deliverMessage, server.notifyUndelivered, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.spool = sp
+
+	if reply := server.DeliverMessage(spoolEnvelope("m.spooled")); reply != nil {
+		t.Fatalf("Failed to accept message: %v", reply)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "spool", "m.spooled.json")); err != nil {
+		t.Errorf("Want message spooled: %v", err)
+	}
+
+	// Delivery stores the message in the maildrop.
+	sp.deliverSpooled(<-sp.ready)
+	if _, err := maildrop.New(mailbox).Metadata("m.spooled"); err != nil {
+		t.Errorf("Want message delivered: %v", err)
+	}
+	if got := spooledFiles(t, filepath.Join(dir, "spool")); len(got) != 0 {
+		t.Errorf("Want spool empty, got %v", got)
+	}
+}
+
+func TestNotifyUndelivered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := &smtpServer{
+		config: Config{
+			Servers: []Server{{Domain: "example.com", MaildropPath: dir, RoleFolder: "roles"}},
+		},
+		log: zap.NewNop(),
+	}
+	en := spoolEnvelope("m.refused")
+	if err := server.notifyUndelivered(en, "The message was refused: 550 no"); err != nil {
+		t.Fatal(err)
+	}
+
+	md, err := maildrop.New(dir).Folder("roles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := md.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Want 1 notice for the postmaster, got %d", len(entries))
+	}
+	data, err := ioutil.ReadFile(filepath.Join(md.Path(), entries[0].ID+".msg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"550 no", "m.refused", "<from@sender.net>", "Subject: hi\r\n"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Want notice to contain %q, got %q", want, data)
+		}
+	}
+	if strings.Contains(string(data), "body") {
+		t.Errorf("Want notice without the message body, got %q", data)
+	}
+}
+
+func TestDeliverMessageLocalError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A maildrop that cannot be written is a temporary failure.
+	server := &smtpServer{
+		config: Config{
+			Servers: []Server{{Domain: "example.com", MaildropPath: filepath.Join(dir, "missing")}},
+		},
+		log: zap.NewNop(),
+	}
+	if want, got := &replyLocalError, server.deliverMessage(spoolEnvelope("m.1")); got == nil || *want != *got {
+		t.Errorf("Want %v, got %v", want, got)
+	}
+}
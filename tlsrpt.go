@@ -0,0 +1,259 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/resolver"
+	"src.bluestatic.org/mailpopbox/smtp"
+	"src.bluestatic.org/mailpopbox/tlsrpt"
+)
+
+const (
+	defaultTLSReportInterval = 24 * time.Hour
+	tlsReportTimeout         = 30 * time.Second
+)
+
+var tlsrptMetrics = expvar.NewMap("tlsrpt")
+
+// These are replaced in tests.
+var (
+	tlsrptLookupTXT resolver.LookupTXT = resolver.Default.LookupTXT
+	tlsrptClient                       = &http.Client{Timeout: tlsReportTimeout}
+)
+
+// TLSReportConfig collects the outcome of TLS negotiation with each
+// destination domain of relayed mail, and reports it every Interval.
+type TLSReportConfig struct {
+	// Interval is a Go duration string. It defaults to 24h.
+	Interval string
+
+	// Send, if set, sends an RFC 8460 report to each domain that publishes
+	// a TLSRPT record, by mail or HTTPS. Otherwise the results are only
+	// logged.
+	Send bool
+
+	// OrganizationName and ContactInfo identify the reporter. They default
+	// to Hostname and postmaster@Hostname.
+	OrganizationName string
+	ContactInfo      string
+
+	// From is the sender of mailed reports. It defaults to the mailbox
+	// address of the first Server.
+	From string
+}
+
+// tlsReports is the running form of a TLSReportConfig.
+type tlsReports struct {
+	config TLSReportConfig
+
+	mu       sync.Mutex
+	start    time.Time
+	policies map[string]*tlsrpt.Policy // Keyed by domain.
+}
+
+func newTLSReports(config Config) *tlsReports {
+	c := *config.TLSReport
+	if c.OrganizationName == "" {
+		c.OrganizationName = config.Hostname
+	}
+	if c.ContactInfo == "" {
+		c.ContactInfo = "postmaster@" + config.Hostname
+	}
+	if c.From == "" && len(config.Servers) > 0 {
+		c.From = MailboxAccount + config.Servers[0].Domain
+	}
+	return &tlsReports{config: c, start: time.Now()}
+}
+
+// TLSResult implements smtp.TLSResultReceiver.
+func (server *smtpServer) TLSResult(r smtp.TLSResult) {
+	if server.tlsReports == nil {
+		return
+	}
+	if r.Failure != "" {
+		server.log.Info("TLS negotiation failed",
+			zap.String("domain", r.Domain),
+			zap.String("host", r.Host),
+			zap.String("result", r.Failure),
+			zap.String("detail", r.Detail))
+	}
+	server.tlsReports.record(r)
+}
+
+func (t *tlsReports) record(r smtp.TLSResult) {
+	if r.Failure == "" {
+		tlsrptMetrics.Add("successful", 1)
+	} else {
+		tlsrptMetrics.Add(r.Failure, 1)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.policies == nil {
+		t.policies = make(map[string]*tlsrpt.Policy)
+	}
+	domain := strings.ToLower(r.Domain)
+	p := t.policies[domain]
+	if p == nil {
+		p = &tlsrpt.Policy{Policy: tlsrpt.PolicyDetails{Type: tlsrpt.PolicyTypeNone, Domain: domain}}
+		t.policies[domain] = p
+	}
+	// DANE takes precedence over MTA-STS (RFC 8461 § 2).
+	if len(r.TLSA) > 0 {
+		p.Policy.Type = tlsrpt.PolicyTypeTLSA
+		p.Policy.Strings = r.TLSA
+		p.Policy.MXHosts = nil
+	} else if sts := r.STSPolicy; sts != nil && p.Policy.Type != tlsrpt.PolicyTypeTLSA {
+		p.Policy.Type = tlsrpt.PolicyTypeSTS
+		p.Policy.Strings = sts.Strings()
+		p.Policy.MXHosts = sts.MX
+	}
+	if r.Failure == "" {
+		p.Summary.Successful++
+		return
+	}
+	p.Summary.Failure++
+
+	detail := tlsrpt.FailureDetail{
+		ResultType:          r.Failure,
+		SendingMTAIP:        r.SendingIP,
+		ReceivingMXHostname: r.Host,
+		ReceivingIP:         r.IP,
+	}
+	for i := range p.FailureDetails {
+		d := &p.FailureDetails[i]
+		detail.FailedSessionCount = d.FailedSessionCount
+		if *d == detail {
+			d.FailedSessionCount++
+			return
+		}
+	}
+	detail.FailedSessionCount = 1
+	p.FailureDetails = append(p.FailureDetails, detail)
+}
+
+// flush returns a report for each domain with results since the last
+// flush, and resets the results.
+func (t *tlsReports) flush(now time.Time) []*tlsrpt.Report {
+	t.mu.Lock()
+	policies, start := t.policies, t.start
+	t.policies, t.start = nil, now
+	t.mu.Unlock()
+
+	var reports []*tlsrpt.Report
+	for _, p := range policies {
+		reports = append(reports, &tlsrpt.Report{
+			OrganizationName: t.config.OrganizationName,
+			DateRange:        tlsrpt.DateRange{Start: start.UTC(), End: now.UTC()},
+			ContactInfo:      t.config.ContactInfo,
+			ReportID:         smtp.GenerateEnvelopeId("tlsrpt", now) + "@" + t.config.OrganizationName,
+			Policies:         []tlsrpt.Policy{*p},
+		})
+	}
+	return reports
+}
+
+// reportTLS logs, and optionally sends, the TLS reports every |interval|.
+func (server *smtpServer) reportTLS(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		for _, report := range server.tlsReports.flush(now) {
+			summary := report.Policies[0].Summary
+			server.log.Info("TLS report",
+				zap.String("domain", report.Domain()),
+				zap.Time("start", report.DateRange.Start),
+				zap.Int("successful", summary.Successful),
+				zap.Int("failure", summary.Failure))
+			if server.tlsReports.config.Send {
+				server.sendTLSReport(report)
+			}
+		}
+	}
+}
+
+// sendTLSReport delivers |report| to the reporting URIs published by its
+// domain.
+func (server *smtpServer) sendTLSReport(report *tlsrpt.Report) {
+	log := server.log.With(zap.String("domain", report.Domain()), zap.String("report", report.ReportID))
+
+	ctx, cancel := context.WithTimeout(context.Background(), tlsReportTimeout)
+	defer cancel()
+	rua, err := tlsrpt.LookupRUA(ctx, tlsrptLookupTXT, report.Domain())
+	if err != nil {
+		log.Warn("failed to look up TLSRPT record", zap.Error(err))
+		return
+	}
+
+	for _, uri := range rua {
+		u, err := url.Parse(uri)
+		if err != nil {
+			log.Warn("invalid TLSRPT rua", zap.String("rua", uri), zap.Error(err))
+			continue
+		}
+		switch u.Scheme {
+		case "mailto":
+			err = server.mailTLSReport(report, u.Opaque)
+		case "https":
+			err = postTLSReport(report, uri)
+		default:
+			err = fmt.Errorf("unsupported scheme %q", u.Scheme)
+		}
+		if err != nil {
+			log.Warn("failed to send TLS report", zap.String("rua", uri), zap.Error(err))
+			continue
+		}
+		log.Info("sent TLS report", zap.String("rua", uri))
+		tlsrptMetrics.Add("reports", 1)
+	}
+}
+
+func (server *smtpServer) mailTLSReport(report *tlsrpt.Report, to string) error {
+	if server.mta == nil {
+		return fmt.Errorf("no MTA")
+	}
+	now := time.Now()
+	data, err := report.Message(server.tlsReports.config.From, to, now)
+	if err != nil {
+		return err
+	}
+	server.mta.QueueMessage(smtp.Envelope{
+		MailFrom: mail.Address{Address: server.tlsReports.config.From},
+		RcptTo:   []mail.Address{{Address: to}},
+		Data:     data,
+		ID:       smtp.GenerateEnvelopeId("r", now),
+		Received: now,
+	}, nil, nil)
+	return nil
+}
+
+func postTLSReport(report *tlsrpt.Report, uri string) error {
+	gz, err := report.Compressed()
+	if err != nil {
+		return err
+	}
+	resp, err := tlsrptClient.Post(uri, tlsrpt.ContentType, bytes.NewReader(gz))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	return nil
+}
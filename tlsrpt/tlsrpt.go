@@ -0,0 +1,215 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+// Package tlsrpt builds SMTP TLS Reports (RFC 8460), which tell a domain how
+// often its MX hosts failed to negotiate TLS.
+package tlsrpt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"src.bluestatic.org/mailpopbox/resolver"
+)
+
+// ContentType is the media type of a compressed report.
+const ContentType = "application/tlsrpt+gzip"
+
+// Policy types.
+const (
+	// PolicyTypeNone is the policy type for a domain without a policy.
+	PolicyTypeNone = "no-policy-found"
+	// PolicyTypeSTS is the policy type for a domain with an MTA-STS policy.
+	PolicyTypeSTS = "sts"
+	// PolicyTypeTLSA is the policy type for a domain whose MX hosts have
+	// DANE TLSA records.
+	PolicyTypeTLSA = "tlsa"
+)
+
+// Report is an aggregate report for one policy domain.
+type Report struct {
+	OrganizationName string    `json:"organization-name"`
+	DateRange        DateRange `json:"date-range"`
+	ContactInfo      string    `json:"contact-info"`
+	ReportID         string    `json:"report-id"`
+	Policies         []Policy  `json:"policies"`
+}
+
+type DateRange struct {
+	Start time.Time `json:"start-datetime"`
+	End   time.Time `json:"end-datetime"`
+}
+
+type Policy struct {
+	Policy         PolicyDetails   `json:"policy"`
+	Summary        Summary         `json:"summary"`
+	FailureDetails []FailureDetail `json:"failure-details,omitempty"`
+}
+
+type PolicyDetails struct {
+	Type    string   `json:"policy-type"`
+	Strings []string `json:"policy-string,omitempty"`
+	Domain  string   `json:"policy-domain"`
+	MXHosts []string `json:"mx-host,omitempty"`
+}
+
+type Summary struct {
+	Successful int `json:"total-successful-session-count"`
+	Failure    int `json:"total-failure-session-count"`
+}
+
+type FailureDetail struct {
+	ResultType          string `json:"result-type"`
+	SendingMTAIP        string `json:"sending-mta-ip,omitempty"`
+	ReceivingMXHostname string `json:"receiving-mx-hostname,omitempty"`
+	ReceivingIP         string `json:"receiving-ip,omitempty"`
+	FailedSessionCount  int    `json:"failed-session-count"`
+	FailureReasonCode   string `json:"failure-reason-code,omitempty"`
+}
+
+// Domain returns the policy domain of the report.
+func (r *Report) Domain() string {
+	if len(r.Policies) == 0 {
+		return ""
+	}
+	return r.Policies[0].Policy.Domain
+}
+
+// Compressed returns the gzipped JSON of the report.
+func (r *Report) Compressed() ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(w).Encode(r); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Filename returns the name of the report attachment (RFC 8460 § 5.1).
+func (r *Report) Filename() string {
+	return fmt.Sprintf("%s!%s!%d!%d!%s.json.gz", r.OrganizationName, r.Domain(),
+		r.DateRange.Start.Unix(), r.DateRange.End.Unix(), r.ReportID)
+}
+
+// Message returns the report as an email from |from| to |to| (RFC 8460
+// § 5.3).
+func (r *Report) Message(from, to string, date time.Time) ([]byte, error) {
+	gz, err := r.Compressed()
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	text, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	fmt.Fprintf(text, "This is an aggregate TLS report from %s for %s.\r\n", r.OrganizationName, r.Domain())
+
+	part, _ := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {ContentType},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", r.Filename())},
+	})
+	writeBase64(part, gz)
+	mw.Close()
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: <%s>\r\n", from)
+	fmt.Fprintf(&msg, "To: <%s>\r\n", to)
+	fmt.Fprintf(&msg, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Subject: Report Domain: %s Submitter: %s Report-ID: <%s>\r\n", r.Domain(), r.OrganizationName, r.ReportID)
+	fmt.Fprintf(&msg, "TLS-Report-Domain: %s\r\n", r.Domain())
+	fmt.Fprintf(&msg, "TLS-Report-Submitter: %s\r\n", r.OrganizationName)
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/report; report-type=\"tlsrpt\"; boundary=%q\r\n\r\n", mw.Boundary())
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// LookupRUA returns the reporting URIs that |domain| publishes in its
+// _smtp._tls TXT record, or none if it has no record.
+func LookupRUA(ctx context.Context, lookup resolver.LookupTXT, domain string) ([]string, error) {
+	txts, err := lookup(ctx, "_smtp._tls."+domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var rua []string
+	for _, txt := range txts {
+		uris, err := ParseRecord(txt)
+		if err != nil {
+			continue
+		}
+		if rua != nil {
+			return nil, errors.New("tlsrpt: multiple records for " + domain)
+		}
+		rua = uris
+	}
+	return rua, nil
+}
+
+// ParseRecord returns the reporting URIs of the TLSRPT record |txt|.
+func ParseRecord(txt string) ([]string, error) {
+	fields := strings.Split(txt, ";")
+	if strings.TrimSpace(fields[0]) != "v=TLSRPTv1" {
+		return nil, errors.New("tlsrpt: not a TLSRPT record")
+	}
+	var rua []string
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) != "rua" {
+			continue
+		}
+		for _, uri := range strings.Split(kv[1], ",") {
+			if uri = strings.TrimSpace(uri); uri != "" {
+				rua = append(rua, uri)
+			}
+		}
+	}
+	if len(rua) == 0 {
+		return nil, errors.New("tlsrpt: record has no rua")
+	}
+	return rua, nil
+}
+
+// writeBase64 writes |data| to |w| in base64, in lines of 76 characters.
+func writeBase64(w io.Writer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		io.WriteString(w, encoded[:76]+"\r\n")
+		encoded = encoded[76:]
+	}
+	io.WriteString(w, encoded+"\r\n")
+}
+
+// Parse parses the JSON of a report.
+func Parse(data []byte) (*Report, error) {
+	var r Report
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	if r.ReportID == "" || len(r.Policies) == 0 {
+		return nil, errors.New("tlsrpt: not a TLS report")
+	}
+	return &r, nil
+}
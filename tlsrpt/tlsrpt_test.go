@@ -0,0 +1,121 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package tlsrpt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"src.bluestatic.org/mailpopbox/message"
+)
+
+func TestParseRecord(t *testing.T) {
+	rua, err := ParseRecord("v=TLSRPTv1; rua=mailto:tls@example.com, https://reports.example.com/tlsrpt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "mailto:tls@example.com https://reports.example.com/tlsrpt", strings.Join(rua, " "); want != got {
+		t.Errorf("Want rua %q, got %q", want, got)
+	}
+
+	for _, txt := range []string{"v=spf1 -all", "v=TLSRPTv1;", "v=TLSRPTv1; ruf=mailto:a@b.com"} {
+		if _, err := ParseRecord(txt); err == nil {
+			t.Errorf("%q: want error", txt)
+		}
+	}
+}
+
+func TestLookupRUA(t *testing.T) {
+	lookup := func(ctx context.Context, name string) ([]string, error) {
+		switch name {
+		case "_smtp._tls.example.com":
+			return []string{"v=spf1 -all", "v=TLSRPTv1; rua=mailto:tls@example.com"}, nil
+		case "_smtp._tls.double.com":
+			return []string{"v=TLSRPTv1; rua=mailto:a@double.com", "v=TLSRPTv1; rua=mailto:b@double.com"}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	rua, err := LookupRUA(context.Background(), lookup, "example.com")
+	if err != nil || len(rua) != 1 || rua[0] != "mailto:tls@example.com" {
+		t.Errorf("Want one rua, got %v, %v", rua, err)
+	}
+	if rua, err := LookupRUA(context.Background(), lookup, "none.com"); err != nil || rua != nil {
+		t.Errorf("Want no rua, got %v, %v", rua, err)
+	}
+	if _, err := LookupRUA(context.Background(), lookup, "double.com"); err == nil {
+		t.Errorf("Want error for multiple records")
+	}
+}
+
+func TestMessage(t *testing.T) {
+	start := time.Date(2020, time.June, 1, 0, 0, 0, 0, time.UTC)
+	report := &Report{
+		OrganizationName: "mx.sender.net",
+		DateRange:        DateRange{start, start.Add(24 * time.Hour)},
+		ContactInfo:      "postmaster@mx.sender.net",
+		ReportID:         "r1@mx.sender.net",
+		Policies: []Policy{{
+			Policy:  PolicyDetails{Type: PolicyTypeNone, Domain: "example.com"},
+			Summary: Summary{Successful: 5, Failure: 1},
+			FailureDetails: []FailureDetail{{
+				ResultType:          "certificate-expired",
+				ReceivingMXHostname: "mx.example.com",
+				FailedSessionCount:  1,
+			}},
+		}},
+	}
+
+	data, err := report.Message("mailbox@sender.net", "tls@example.com", start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, _ := message.Parse(data)
+	if want, got := "Report Domain: example.com Submitter: mx.sender.net Report-ID: <r1@mx.sender.net>", header.Get("Subject"); want != got {
+		t.Errorf("Want Subject %q, got %q", want, got)
+	}
+	if want, got := "example.com", header.Get("TLS-Report-Domain"); want != got {
+		t.Errorf("Want TLS-Report-Domain %q, got %q", want, got)
+	}
+
+	var attachment []byte
+	err = message.Walk(data, func(p *message.Part) error {
+		if p.MediaType == ContentType {
+			if want, got := "mx.sender.net!example.com!1590969600!1591056000!r1@mx.sender.net.json.gz", p.Filename(); want != got {
+				t.Errorf("Want filename %q, got %q", want, got)
+			}
+			attachment, err = p.Decoded()
+		}
+		return err
+	})
+	if err != nil || attachment == nil {
+		t.Fatalf("Failed to find report: %v", err)
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(attachment))
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, _ := ioutil.ReadAll(r)
+	var decoded Report
+	if err := json.Unmarshal(js, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, decoded.Policies[0].FailureDetails[0].FailedSessionCount; want != got {
+		t.Errorf("Want %d failed session, got %d", want, got)
+	}
+	if !strings.Contains(string(js), `"total-successful-session-count":5`) {
+		t.Errorf("Report JSON is missing the summary: %s", js)
+	}
+}
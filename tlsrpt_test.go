@@ -0,0 +1,171 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/mtasts"
+	"src.bluestatic.org/mailpopbox/resolver"
+	"src.bluestatic.org/mailpopbox/smtp"
+	"src.bluestatic.org/mailpopbox/tlsrpt"
+)
+
+func TestTLSReports(t *testing.T) {
+	server := &smtpServer{
+		config: Config{
+			Hostname:  "mx.example.com",
+			TLSReport: &TLSReportConfig{Send: true},
+			Servers:   []Server{{Domain: "example.com"}},
+		},
+		log: zap.NewNop(),
+	}
+	server.tlsReports = newTLSReports(server.config)
+
+	expired := smtp.TLSResult{Domain: "Dest.net", Host: "mx.dest.net", IP: "192.0.2.1", Failure: smtp.TLSResultExpired}
+	server.TLSResult(smtp.TLSResult{Domain: "dest.net", Host: "mx.dest.net", IP: "192.0.2.1"})
+	server.TLSResult(expired)
+	server.TLSResult(expired)
+	server.TLSResult(smtp.TLSResult{Domain: "dest.net", Host: "mx2.dest.net", Failure: smtp.TLSResultStartTLSNotSupported})
+	server.TLSResult(smtp.TLSResult{Domain: "other.net"})
+
+	reports := server.tlsReports.flush(time.Now())
+	if want, got := 2, len(reports); want != got {
+		t.Fatalf("Want %d reports, got %d", want, got)
+	}
+	var report *tlsrpt.Report
+	for _, r := range reports {
+		if r.Domain() == "dest.net" {
+			report = r
+		}
+	}
+	if report == nil {
+		t.Fatalf("No report for dest.net")
+	}
+	p := report.Policies[0]
+	if want, got := (tlsrpt.Summary{Successful: 1, Failure: 3}), p.Summary; want != got {
+		t.Errorf("Want summary %+v, got %+v", want, got)
+	}
+	if want, got := 2, len(p.FailureDetails); want != got {
+		t.Fatalf("Want %d failure details, got %+v", want, p.FailureDetails)
+	}
+	if want, got := 2, p.FailureDetails[0].FailedSessionCount; want != got {
+		t.Errorf("Want %d expired sessions, got %d", want, got)
+	}
+	if want, got := "postmaster@mx.example.com", report.ContactInfo; want != got {
+		t.Errorf("Want contact %q, got %q", want, got)
+	}
+	if len(server.tlsReports.flush(time.Now())) != 0 {
+		t.Errorf("Want results reset after flush")
+	}
+
+	var posted []byte
+	web := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") == tlsrpt.ContentType {
+			posted, _ = ioutil.ReadAll(r.Body)
+		}
+	}))
+	defer web.Close()
+
+	defer func(l resolver.LookupTXT, c *http.Client) {
+		tlsrptLookupTXT, tlsrptClient = l, c
+	}(tlsrptLookupTXT, tlsrptClient)
+	tlsrptClient = web.Client()
+	tlsrptLookupTXT = func(ctx context.Context, name string) ([]string, error) {
+		if name == "_smtp._tls.dest.net" {
+			return []string{"v=TLSRPTv1; rua=mailto:tls@dest.net," + web.URL}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	mta := newTestMTA()
+	server.mta = mta
+	server.sendTLSReport(report)
+
+	mailed := <-mta.relayed
+	if want, got := "tls@dest.net", mailed.RcptTo[0].Address; want != got {
+		t.Errorf("Want report mailed to %q, got %q", want, got)
+	}
+	if want, got := "mailbox@example.com", mailed.MailFrom.Address; want != got {
+		t.Errorf("Want report mailed from %q, got %q", want, got)
+	}
+	if !bytes.Contains(mailed.Data, []byte("TLS-Report-Domain: dest.net\r\n")) {
+		t.Errorf("Mailed report is missing its header: %q", mailed.Data)
+	}
+	if posted == nil {
+		t.Errorf("Report was not posted")
+	}
+}
+
+func TestTLSReportsSTSPolicy(t *testing.T) {
+	server := &smtpServer{
+		config: Config{
+			Hostname:  "mx.example.com",
+			TLSReport: &TLSReportConfig{},
+		},
+		log: zap.NewNop(),
+	}
+	server.tlsReports = newTLSReports(server.config)
+
+	policy := &mtasts.Policy{Mode: mtasts.ModeEnforce, MX: []string{"*.dest.net"}, MaxAge: time.Hour}
+	server.TLSResult(smtp.TLSResult{Domain: "dest.net", Host: "mx.dest.net", STSPolicy: policy})
+
+	reports := server.tlsReports.flush(time.Now())
+	if want, got := 1, len(reports); want != got {
+		t.Fatalf("Want %d report, got %d", want, got)
+	}
+	details := reports[0].Policies[0].Policy
+	if want, got := tlsrpt.PolicyTypeSTS, details.Type; want != got {
+		t.Errorf("Want policy type %q, got %q", want, got)
+	}
+	if want, got := "mode: enforce", details.Strings[1]; want != got {
+		t.Errorf("Want policy string %q, got %q", want, got)
+	}
+	if want, got := "*.dest.net", details.MXHosts[0]; want != got {
+		t.Errorf("Want mx-host %q, got %q", want, got)
+	}
+}
+
+func TestTLSReportsTLSAPolicy(t *testing.T) {
+	server := &smtpServer{
+		config: Config{
+			Hostname:  "mx.example.com",
+			TLSReport: &TLSReportConfig{},
+		},
+		log: zap.NewNop(),
+	}
+	server.tlsReports = newTLSReports(server.config)
+
+	policy := &mtasts.Policy{Mode: mtasts.ModeEnforce, MX: []string{"*.dest.net"}, MaxAge: time.Hour}
+	server.TLSResult(smtp.TLSResult{Domain: "dest.net", Host: "mx.dest.net", TLSA: []string{"3 1 1 abcd"}, Failure: smtp.TLSResultTLSAInvalid})
+	// A later MTA-STS result does not replace the DANE policy.
+	server.TLSResult(smtp.TLSResult{Domain: "dest.net", Host: "mx.dest.net", STSPolicy: policy})
+
+	reports := server.tlsReports.flush(time.Now())
+	if want, got := 1, len(reports); want != got {
+		t.Fatalf("Want %d report, got %d", want, got)
+	}
+	p := reports[0].Policies[0]
+	if want, got := tlsrpt.PolicyTypeTLSA, p.Policy.Type; want != got {
+		t.Errorf("Want policy type %q, got %q", want, got)
+	}
+	if want, got := "3 1 1 abcd", p.Policy.Strings[0]; want != got {
+		t.Errorf("Want policy string %q, got %q", want, got)
+	}
+	if want, got := smtp.TLSResultTLSAInvalid, p.FailureDetails[0].ResultType; want != got {
+		t.Errorf("Want result type %q, got %q", want, got)
+	}
+}
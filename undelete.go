@@ -0,0 +1,98 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"src.bluestatic.org/mailpopbox/maildrop"
+)
+
+// runUndelete implements the undelete subcommand, returning the exit code.
+// Without message IDs, it lists the trash.
+func runUndelete(args []string) int {
+	flags := flag.NewFlagSet("undelete", flag.ExitOnError)
+	configPath := flags.String("config", "config.json", "path to the configuration file")
+	domain := flags.String("domain", "", "the domain whose mailbox is restored")
+	folder := flags.String("folder", "", "the folder to restore to, instead of the maildrop")
+	all := flags.Bool("all", false, "restore every message in the trash")
+	flags.Parse(args)
+
+	if *domain == "" {
+		fmt.Fprintf(os.Stderr, "Usage: %s undelete [-config config.json] -domain example.com [-folder name] [-all | ID...]\n", os.Args[0])
+		return 1
+	}
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config file: %s\n", err)
+		return 2
+	}
+
+	server := config.serverForDomain(*domain)
+	if server == nil {
+		fmt.Fprintf(os.Stderr, "no server for domain %q\n", *domain)
+		return 3
+	}
+
+	md := maildrop.New(server.MaildropPath)
+	if *folder != "" {
+		if md, err = md.Folder(*folder); err != nil {
+			fmt.Fprintf(os.Stderr, "open folder: %v\n", err)
+			return 3
+		}
+	}
+
+	ids := flags.Args()
+	if *all {
+		trashed, err := md.Trashed()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "list trash: %v\n", err)
+			return 4
+		}
+		ids = nil
+		for _, entry := range trashed {
+			ids = append(ids, entry.ID)
+		}
+	} else if len(ids) == 0 {
+		if err := listTrash(md, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "list trash: %v\n", err)
+			return 4
+		}
+		return 0
+	}
+
+	for _, id := range ids {
+		if err := md.Undelete(id); err != nil {
+			fmt.Fprintf(os.Stderr, "undelete %s: %v\n", id, err)
+			return 5
+		}
+	}
+	fmt.Printf("Restored %d messages\n", len(ids))
+	return 0
+}
+
+// listTrash writes a line to |w| for each message in the trash of |md|, with
+// its ID, when it was deleted, its sender, and its size.
+func listTrash(md *maildrop.Maildrop, w io.Writer) error {
+	trashed, err := md.Trashed()
+	if err != nil {
+		return err
+	}
+	for _, entry := range trashed {
+		from := "?"
+		if meta, err := md.TrashedMetadata(entry.ID); err == nil {
+			from = meta.MailFrom
+		}
+		fmt.Fprintf(w, "%s\t%s\t<%s>\t%d\n", entry.ID, entry.ModTime.Format(time.RFC3339), from, entry.Size)
+	}
+	return nil
+}
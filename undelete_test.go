@@ -0,0 +1,93 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/maildrop"
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+func TestMailboxTrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	md := maildrop.New(dir)
+	for _, id := range []string{"m.1", "m.2"} {
+		err := md.Deliver(smtp.Envelope{
+			MailFrom: mail.Address{Address: "from@sender.net"},
+			RcptTo:   []mail.Address{{Address: "to@example.com"}},
+			Data:     []byte("Subject: " + id + "\r\n\r\nbody\r\n"),
+			Received: time.Now(),
+			ID:       id,
+		})
+		if err != nil {
+			t.Fatalf("Failed to deliver: %v", err)
+		}
+	}
+
+	s := &pop3Server{
+		config: Config{
+			Servers: []Server{
+				{
+					Domain:          "example.com",
+					MailboxPassword: "letmein",
+					MaildropPath:    dir,
+					TrashRetention:  "24h",
+				},
+			},
+		},
+		log: zap.NewNop(),
+	}
+
+	mb, err := s.OpenMailbox("mailbox@example.com", "letmein")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb.Delete(mb.GetMessage(1))
+	if err := mb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _ := md.List()
+	if want, got := 1, len(entries); want != got {
+		t.Fatalf("Want %d message left, got %d", want, got)
+	}
+
+	var buf bytes.Buffer
+	if err := listTrash(md, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "m.1\t") || !strings.Contains(buf.String(), "\t<from@sender.net>\t") {
+		t.Errorf("Unexpected trash listing %q", buf.String())
+	}
+
+	if err := md.Undelete("m.1"); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := md.List(); len(entries) != 2 {
+		t.Errorf("Want the message restored, got %v", entries)
+	}
+
+	// An invalid retention is rejected at startup.
+	s.config.Servers[0].TrashRetention = "-1h"
+	if err := s.createMaildrops(); err == nil {
+		t.Errorf("Want error for a negative TrashRetention")
+	}
+}
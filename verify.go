@@ -0,0 +1,82 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+const verifyTimeout = 5 * time.Second
+
+var replyVerifyUnavailable = smtp.ReplyLine{Code: 451, Message: "cannot verify address, try again later"}
+
+// addressVerifier decides whether an address in a configured domain accepts
+// mail, after the BlockedAddresses check. This lets the valid addresses be
+// managed outside of the config file.
+type addressVerifier interface {
+	VerifyAddress(address string) smtp.ReplyLine
+}
+
+// newAddressVerifier returns the verifier for a server, or nil if it has
+// none.
+func newAddressVerifier(s Server, log *zap.Logger) addressVerifier {
+	if s.VerifyURL != "" {
+		return &httpVerifier{
+			url:    s.VerifyURL,
+			client: &http.Client{Timeout: verifyTimeout},
+			log:    log,
+		}
+	}
+	return nil
+}
+
+// httpVerifier asks an HTTP endpoint about each address, with a GET request
+// that has the address in the "address" query parameter. A 2xx response
+// accepts the address, and a 404 or 410 rejects it. Any other response is a
+// temporary failure, so that the sender retries.
+type httpVerifier struct {
+	url    string
+	client *http.Client
+	log    *zap.Logger
+}
+
+func (v *httpVerifier) VerifyAddress(address string) smtp.ReplyLine {
+	u, err := url.Parse(v.url)
+	if err != nil {
+		v.log.Error("invalid VerifyURL", zap.String("url", v.url), zap.Error(err))
+		return replyVerifyUnavailable
+	}
+	q := u.Query()
+	q.Set("address", address)
+	u.RawQuery = q.Encode()
+
+	resp, err := v.client.Get(u.String())
+	if err != nil {
+		v.log.Error("failed to verify address", zap.String("address", address), zap.Error(err))
+		return replyVerifyUnavailable
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return smtp.ReplyOK
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return smtp.ReplyBadMailbox
+	default:
+		v.log.Error("failed to verify address",
+			zap.String("address", address),
+			zap.Error(fmt.Errorf("HTTP status %s", resp.Status)))
+		return replyVerifyUnavailable
+	}
+}
@@ -0,0 +1,221 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultWatchdogInterval = time.Minute
+	watchdogTimeout         = 10 * time.Second
+)
+
+var watchdogMetrics = expvar.NewMap("watchdog")
+
+// probeResult is the outcome of the most recent probe of a listener.
+type probeResult struct {
+	OK      bool
+	Error   string `json:",omitempty"`
+	Time    time.Time
+	Latency time.Duration
+}
+
+// watchdog periodically connects to the server's own listeners, to detect
+// ones that are no longer accepting or responding to connections.
+type watchdog struct {
+	config   Config
+	interval time.Duration
+	timeout  time.Duration
+	log      *zap.Logger
+
+	probes map[string]func() error
+
+	mu      sync.Mutex
+	results map[string]probeResult
+}
+
+func newWatchdog(config Config, log *zap.Logger) (*watchdog, error) {
+	wd := &watchdog{
+		config:   config,
+		interval: defaultWatchdogInterval,
+		timeout:  watchdogTimeout,
+		log:      log.With(zap.String("server", "watchdog")),
+		results:  make(map[string]probeResult),
+	}
+	if config.WatchdogInterval != "" {
+		var err error
+		wd.interval, err = time.ParseDuration(config.WatchdogInterval)
+		if err != nil {
+			return nil, err
+		}
+	}
+	wd.probes = map[string]func() error{
+		"smtp": func() error {
+			addr := fmt.Sprintf("localhost:%d", config.SMTPPort)
+			if config.SMTPAddress != "" {
+				addr = config.SMTPAddress
+			}
+			return wd.probeSMTP(addr, false)
+		},
+		"pop3": func() error {
+			return wd.probePOP3(fmt.Sprintf("localhost:%d", config.POP3Port), wd.pop3UsesTLS())
+		},
+	}
+	return wd, nil
+}
+
+func (wd *watchdog) run() {
+	ticker := time.NewTicker(wd.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		wd.probeAll()
+	}
+}
+
+func (wd *watchdog) probeAll() {
+	for name, probe := range wd.probes {
+		start := time.Now()
+		err := probe()
+		result := probeResult{
+			OK:      err == nil,
+			Time:    start,
+			Latency: time.Since(start),
+		}
+
+		watchdogMetrics.Add(name+"_probes", 1)
+		if err != nil {
+			result.Error = err.Error()
+			watchdogMetrics.Add(name+"_failures", 1)
+			wd.log.Error("probe failed", zap.String("listener", name), zap.Error(err))
+		}
+
+		wd.mu.Lock()
+		wd.results[name] = result
+		wd.mu.Unlock()
+	}
+}
+
+// Healthy reports whether the last probe of every listener succeeded. Before
+// the first probe, the server is assumed to be healthy.
+func (wd *watchdog) Healthy() bool {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	for _, result := range wd.results {
+		if !result.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// ServeHTTP reports the health state as JSON, with a 503 status if any
+// listener is unhealthy.
+func (wd *watchdog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	if !wd.Healthy() {
+		status = http.StatusServiceUnavailable
+	}
+
+	wd.mu.Lock()
+	body, err := json.Marshal(wd.results)
+	wd.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func (wd *watchdog) pop3UsesTLS() bool {
+	for _, s := range wd.config.Servers {
+		if s.TLSCertPath != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (wd *watchdog) dial(addr string, useTLS bool) (*textproto.Conn, error) {
+	conn, err := net.DialTimeout(listenNetwork(addr), addr, wd.timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(wd.timeout))
+	if useTLS {
+		// This checks that our own listener is responsive, not its identity.
+		conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	}
+	return textproto.NewConn(conn), nil
+}
+
+// probeSMTP reads the banner and sends EHLO and QUIT.
+func (wd *watchdog) probeSMTP(addr string, useTLS bool) error {
+	c, err := wd.dial(addr, useTLS)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		return fmt.Errorf("banner: %v", err)
+	}
+	if err := c.PrintfLine("EHLO %s", wd.config.Hostname); err != nil {
+		return err
+	}
+	if _, _, err := c.ReadResponse(250); err != nil {
+		return fmt.Errorf("EHLO: %v", err)
+	}
+	c.PrintfLine("QUIT")
+	return nil
+}
+
+// probePOP3 reads the greeting and sends CAPA and QUIT.
+func (wd *watchdog) probePOP3(addr string, useTLS bool) error {
+	c, err := wd.dial(addr, useTLS)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	line, err := c.ReadLine()
+	if err != nil {
+		return fmt.Errorf("greeting: %v", err)
+	}
+	if !strings.HasPrefix(line, "+OK") {
+		return fmt.Errorf("greeting: %q", line)
+	}
+	if err := c.PrintfLine("CAPA"); err != nil {
+		return err
+	}
+	line, err = c.ReadLine()
+	if err != nil {
+		return fmt.Errorf("CAPA: %v", err)
+	}
+	if !strings.HasPrefix(line, "+OK") {
+		return fmt.Errorf("CAPA: %q", line)
+	}
+	if _, err := c.ReadDotLines(); err != nil {
+		return fmt.Errorf("CAPA: %v", err)
+	}
+	c.PrintfLine("QUIT")
+	return nil
+}
@@ -0,0 +1,92 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/logger"
+	"src.bluestatic.org/mailpopbox/pop3"
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+// serve accepts connections on a new listener and passes them to |handle|.
+func serve(t *testing.T, handle func(net.Conn)) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestWatchdogProbes(t *testing.T) {
+	config := Config{Hostname: "mx.example.com"}
+	wd, err := newWatchdog(config, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd.timeout = 500 * time.Millisecond
+
+	smtpAddr := serve(t, func(conn net.Conn) {
+		smtp.AcceptConnection(conn, &smtpServer{config: config, log: zap.NewNop()}, smtp.Options{}, logger.Nop())
+	})
+	pop3Addr := serve(t, func(conn net.Conn) {
+		pop3.AcceptConnection(conn, &pop3Server{config: config, log: zap.NewNop()}, pop3.Options{}, logger.Nop())
+	})
+	wedgedAddr := serve(t, func(conn net.Conn) {
+		// Accept, but never respond.
+	})
+
+	if err := wd.probeSMTP(smtpAddr, false); err != nil {
+		t.Errorf("SMTP probe failed: %v", err)
+	}
+	if err := wd.probePOP3(pop3Addr, false); err != nil {
+		t.Errorf("POP3 probe failed: %v", err)
+	}
+	if err := wd.probeSMTP(wedgedAddr, false); err == nil {
+		t.Errorf("SMTP probe of wedged listener should fail")
+	}
+	if err := wd.probeSMTP(pop3Addr, false); err == nil {
+		t.Errorf("SMTP probe of POP3 listener should fail")
+	}
+
+	wd.probes = map[string]func() error{
+		"smtp": func() error { return wd.probeSMTP(smtpAddr, false) },
+	}
+	wd.probeAll()
+	if !wd.Healthy() {
+		t.Errorf("Watchdog should be healthy: %v", wd.results)
+	}
+
+	wd.probes["wedged"] = func() error { return wd.probePOP3(wedgedAddr, false) }
+	wd.probeAll()
+	if wd.Healthy() {
+		t.Errorf("Watchdog should be unhealthy")
+	}
+
+	w := httptest.NewRecorder()
+	wd.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if want, got := http.StatusServiceUnavailable, w.Code; want != got {
+		t.Errorf("Want HTTP status %d, got %d", want, got)
+	}
+}